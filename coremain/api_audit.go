@@ -22,6 +22,8 @@ func RegisterAuditAPI(router *chi.Mux) {
     // 容量管理相关路由
 		r.Get("/capacity", handleGetAuditCapacity)
 		r.Post("/capacity", handleSetAuditCapacity)
+		r.Get("/privacy", handleGetAuditPrivacy)
+		r.Post("/privacy", handleSetAuditPrivacy)
 	})
 }
 
@@ -90,3 +92,22 @@ func handleSetAuditCapacity(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "Audit log capacity set to %d. Existing logs have been cleared.", updatedCapacity)
 }
+
+func handleGetAuditPrivacy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GlobalAuditCollector.GetPrivacy())
+}
+
+func handleSetAuditPrivacy(w http.ResponseWriter, r *http.Request) {
+	var req AuditPrivacy
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := GlobalAuditCollector.SetPrivacy(req, MainConfigBaseDir); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GlobalAuditCollector.GetPrivacy())
+}
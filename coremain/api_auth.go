@@ -0,0 +1,198 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	APIScopeRead  = "read"  // GET and HEAD requests only.
+	APIScopeAdmin = "admin" // All requests.
+)
+
+type APIAuthConfig struct {
+	// Tokens are accepted from the "Authorization: Bearer <token>" header.
+	Tokens []APITokenConfig `yaml:"tokens"`
+	// Users are accepted from HTTP basic auth.
+	Users []APIUserConfig `yaml:"users"`
+	// Public are paths that can be accessed without credentials, e.g. "/readyz".
+	// A path ending with "/" matches all paths under it.
+	Public []string `yaml:"public"`
+}
+
+type APITokenConfig struct {
+	Token string `yaml:"token"`
+	Scope string `yaml:"scope"` // "read" (default) or "admin".
+}
+
+type APIUserConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Scope    string `yaml:"scope"` // "read" (default) or "admin".
+}
+
+type apiCredential struct {
+	secret []byte // token or "username:password"
+	scope  string
+}
+
+// apiAuth authenticates api requests. A nil *apiAuth allows all requests.
+type apiAuth struct {
+	tokens []apiCredential
+	users  []apiCredential
+	public []string
+}
+
+// newAPIAuth returns nil if c has no tokens and no users.
+func newAPIAuth(c APIAuthConfig) (*apiAuth, error) {
+	if len(c.Tokens) == 0 && len(c.Users) == 0 {
+		return nil, nil
+	}
+	a := &apiAuth{public: c.Public}
+	for i, t := range c.Tokens {
+		if len(t.Token) == 0 {
+			return nil, fmt.Errorf("api token #%d is empty", i)
+		}
+		scope, err := parseAPIScope(t.Scope)
+		if err != nil {
+			return nil, fmt.Errorf("api token #%d: %w", i, err)
+		}
+		a.tokens = append(a.tokens, apiCredential{secret: []byte(t.Token), scope: scope})
+	}
+	for i, u := range c.Users {
+		if len(u.Username) == 0 || strings.Contains(u.Username, ":") {
+			return nil, fmt.Errorf("api user #%d has an invalid username %q", i, u.Username)
+		}
+		if len(u.Password) == 0 {
+			return nil, fmt.Errorf("api user %s has an empty password", u.Username)
+		}
+		scope, err := parseAPIScope(u.Scope)
+		if err != nil {
+			return nil, fmt.Errorf("api user %s: %w", u.Username, err)
+		}
+		a.users = append(a.users, apiCredential{secret: []byte(u.Username + ":" + u.Password), scope: scope})
+	}
+	return a, nil
+}
+
+func parseAPIScope(s string) (string, error) {
+	switch s {
+	case "", APIScopeRead:
+		return APIScopeRead, nil
+	case APIScopeAdmin:
+		return APIScopeAdmin, nil
+	default:
+		return "", fmt.Errorf("invalid scope %q, must be %q or %q", s, APIScopeRead, APIScopeAdmin)
+	}
+}
+
+// scope returns the scope of the credentials in r, or "" if r has no
+// valid credentials.
+func (a *apiAuth) scope(r *http.Request) string {
+	var secret []byte
+	var creds []apiCredential
+	if username, password, ok := r.BasicAuth(); ok {
+		secret, creds = []byte(username+":"+password), a.users
+	} else if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		secret, creds = []byte(strings.TrimSpace(token)), a.tokens
+	}
+	if len(secret) == 0 {
+		return ""
+	}
+	// Check all credentials to not leak which one matched through timing.
+	scope := ""
+	for _, c := range creds {
+		if subtle.ConstantTimeCompare(secret, c.secret) == 1 {
+			scope = c.scope
+		}
+	}
+	return scope
+}
+
+func (a *apiAuth) isPublic(path string) bool {
+	for _, p := range a.public {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredScope returns the scope needed to serve r.
+func requiredScope(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return APIScopeRead
+	default:
+		return APIScopeAdmin
+	}
+}
+
+// apiScopeKey is the context key of the scope of an authenticated request.
+type apiScopeKey struct{}
+
+// AdminOnly wraps the handler of a GET route that changes state, e.g. the
+// cache plugin's /flush, so that it requires the admin scope. Other methods
+// always require it. Requests are passed through if api auth is disabled
+// or the path is public.
+func AdminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if scope, ok := r.Context().Value(apiScopeKey{}).(string); ok && scope != APIScopeAdmin {
+			http.Error(w, "forbidden: admin scope required", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// middleware rejects requests without valid credentials with 401, and
+// requests that need the admin scope from read-only credentials with 403.
+// The scope is passed to the handlers for AdminOnly.
+func (a *apiAuth) middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.isPublic(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scope := a.scope(r)
+		if len(scope) == 0 {
+			if len(a.users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="mosdns"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="mosdns"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if scope != APIScopeAdmin && requiredScope(r) == APIScopeAdmin {
+			http.Error(w, "forbidden: admin scope required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiScopeKey{}, scope)))
+	})
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func newTestAPIAuth(t *testing.T) *apiAuth {
+	t.Helper()
+	a, err := newAPIAuth(APIAuthConfig{
+		Tokens: []APITokenConfig{{Token: "read-token"}, {Token: "admin-token", Scope: APIScopeAdmin}},
+		Users: []APIUserConfig{
+			{Username: "viewer", Password: "v-pass", Scope: APIScopeRead},
+			{Username: "admin", Password: "a-pass", Scope: APIScopeAdmin},
+		},
+		Public: []string{"/readyz", "/assets/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestNewAPIAuth(t *testing.T) {
+	a, err := newAPIAuth(APIAuthConfig{Public: []string{"/readyz"}})
+	if err != nil || a != nil {
+		t.Fatalf("want nil auth without credentials, got %v, %v", a, err)
+	}
+	for name, c := range map[string]APIAuthConfig{
+		"empty token":       {Tokens: []APITokenConfig{{Token: ""}}},
+		"bad token scope":   {Tokens: []APITokenConfig{{Token: "t", Scope: "root"}}},
+		"empty username":    {Users: []APIUserConfig{{Password: "p"}}},
+		"colon in username": {Users: []APIUserConfig{{Username: "a:b", Password: "p"}}},
+		"empty password":    {Users: []APIUserConfig{{Username: "a"}}},
+		"bad user scope":    {Users: []APIUserConfig{{Username: "a", Password: "p", Scope: "Admin"}}},
+	} {
+		if _, err := newAPIAuth(c); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
+
+func TestAPIAuth_Scope(t *testing.T) {
+	a := newTestAPIAuth(t)
+	tests := []struct {
+		name   string
+		header string
+		basic  []string // username, password
+		want   string
+	}{
+		{name: "missing", want: ""},
+		{name: "invalid token", header: "Bearer nope", want: ""},
+		{name: "token without scheme", header: "admin-token", want: ""},
+		{name: "read token", header: "Bearer read-token", want: APIScopeRead},
+		{name: "admin token", header: "Bearer admin-token", want: APIScopeAdmin},
+		{name: "token with spaces", header: "Bearer  admin-token ", want: APIScopeAdmin},
+		{name: "empty bearer", header: "Bearer ", want: ""},
+		{name: "read user", basic: []string{"viewer", "v-pass"}, want: APIScopeRead},
+		{name: "admin user", basic: []string{"admin", "a-pass"}, want: APIScopeAdmin},
+		{name: "wrong password", basic: []string{"admin", "v-pass"}, want: ""},
+		// Basic auth is only checked against users and bearer tokens only
+		// against tokens, a secret is not accepted through the other scheme.
+		{name: "token as basic password", basic: []string{"admin", "admin-token"}, want: ""},
+		{name: "user as bearer token", header: "Bearer admin:a-pass", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if len(tt.header) > 0 {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if tt.basic != nil {
+				r.SetBasicAuth(tt.basic[0], tt.basic[1])
+			}
+			if got := a.scope(r); got != tt.want {
+				t.Fatalf("want scope %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAPIAuth_IsPublic(t *testing.T) {
+	a := newTestAPIAuth(t)
+	for path, want := range map[string]bool{
+		"/readyz":         true,
+		"/readyz/x":       false, // no trailing slash, exact match only
+		"/readyzz":        false,
+		"/assets/":        true,
+		"/assets/app.js":  true,
+		"/assets":         false,
+		"/plugins/assets": false,
+		"/":               false,
+	} {
+		if got := a.isPublic(path); got != want {
+			t.Errorf("%s: want public %v, got %v", path, want, got)
+		}
+	}
+}
+
+func TestAPIAuth_Middleware(t *testing.T) {
+	a := newTestAPIAuth(t)
+	mux := chi.NewRouter()
+	mux.Use(a.middleware)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	mux.Get("/readyz", ok)
+	mux.Get("/plugins/cache/show", ok)
+	mux.Head("/plugins/cache/show", ok)
+	mux.Get("/plugins/cache/flush", AdminOnly(ok))
+	mux.Post("/plugins/cache/config", ok)
+	mux.Get("/plugins/set/save_as", ok) // not wrapped, read is enough
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{http.MethodGet, "/readyz", "", http.StatusOK},
+		{http.MethodGet, "/plugins/cache/show", "", http.StatusUnauthorized},
+		{http.MethodGet, "/plugins/cache/show", "nope", http.StatusUnauthorized},
+		{http.MethodGet, "/plugins/cache/show", "read-token", http.StatusOK},
+		{http.MethodHead, "/plugins/cache/show", "read-token", http.StatusOK},
+		{http.MethodGet, "/plugins/cache/flush", "read-token", http.StatusForbidden},
+		{http.MethodGet, "/plugins/cache/flush", "admin-token", http.StatusOK},
+		{http.MethodPost, "/plugins/cache/config", "read-token", http.StatusForbidden},
+		{http.MethodPost, "/plugins/cache/config", "admin-token", http.StatusOK},
+		{http.MethodGet, "/plugins/set/save_as", "read-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if len(tt.token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s %s with %q: want %d, got %d", tt.method, tt.path, tt.token, tt.want, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != `Basic realm="mosdns"` {
+			t.Errorf("%s %s: unexpected WWW-Authenticate %q", tt.method, tt.path, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestAPIAuth_MiddlewareBearerChallenge(t *testing.T) {
+	a, err := newAPIAuth(APIAuthConfig{Tokens: []APITokenConfig{{Token: "t"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	a.middleware(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Bearer realm="mosdns"` {
+		t.Fatalf("want 401 with a bearer challenge, got %d %q", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestAdminOnly_AuthDisabled(t *testing.T) {
+	var a *apiAuth // api auth disabled
+	called := false
+	h := a.middleware(AdminOnly(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/plugins/cache/flush", nil))
+	if !called || w.Code != http.StatusOK {
+		t.Fatalf("want admin-only route served without auth, got %d", w.Code)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"go.uber.org/zap"
+)
+
+type APITLSConfig struct {
+	// Cert and Key enable https on the api listener. The files are
+	// reloaded when they change.
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ClientCA is a PEM file of CAs. If set, clients must present a cert
+	// signed by one of them (mTLS).
+	ClientCA string `yaml:"client_ca"`
+}
+
+// newAPITLSConfig returns a nil *tls.Config if https is disabled. The
+// returned CertReloader must be closed when the server is closed.
+func newAPITLSConfig(c APITLSConfig, logger *zap.Logger) (*tls.Config, *server.CertReloader, error) {
+	if len(c.Cert)+len(c.Key) == 0 {
+		if len(c.ClientCA) > 0 {
+			return nil, nil, fmt.Errorf("client_ca requires cert and key")
+		}
+		return nil, nil, nil
+	}
+	var pool *x509.CertPool
+	if len(c.ClientCA) > 0 {
+		b, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read client_ca, %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, nil, fmt.Errorf("no valid cert found in client_ca %s", c.ClientCA)
+		}
+	}
+	cr, err := server.NewCertReloader(c.Cert, c.Key, 0, logger)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read tls cert, %w", err)
+	}
+	tc := &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if pool != nil {
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, cr, nil
+}
@@ -135,7 +135,8 @@ const (
 
 // <<< ADDED: Struct for persistent settings
 type AuditSettings struct {
-	Capacity int `json:"capacity"`
+	Capacity int          `json:"capacity"`
+	Privacy  AuditPrivacy `json:"privacy"`
 }
 
 // 最慢查询小顶堆，按耗时排序，存值类型（非指针）
@@ -171,6 +172,10 @@ type AuditCollector struct {
 	totalQueryDuration float64
 	ctxChan            chan *auditContext
 	workerDone         chan struct{}
+
+	privacy       AuditPrivacy
+	sensitiveSets map[string]struct{}
+	hashSalt      []byte
 }
 
 // <<< MODIFIED: Global variable is initialized with the default value first.
@@ -207,6 +212,12 @@ func InitializeAuditCollector(configBaseDir string) {
 	if initialCapacity != defaultAuditCapacity {
 		GlobalAuditCollector = NewAuditCollector(initialCapacity)
 	}
+
+	if err := settings.Privacy.validate(); err != nil {
+		mlog.S().Warnf("Invalid audit privacy settings in '%s', privacy settings ignored. Error: %v", settingsPath, err)
+	} else {
+		GlobalAuditCollector.setPrivacyLocked(settings.Privacy)
+	}
 }
 
 func NewAuditCollector(capacity int) *AuditCollector {
@@ -222,6 +233,7 @@ func NewAuditCollector(capacity int) *AuditCollector {
 		totalQueryDuration: 0.0,
 		ctxChan:            make(chan *auditContext, auditChannelCapacity),
 		workerDone:         make(chan struct{}),
+		hashSalt:           newHashSalt(),
 	}
 	heap.Init(&c.slowestQueries)
 	return c
@@ -238,9 +250,19 @@ func (c *AuditCollector) StopWorker() {
 
 func (c *AuditCollector) worker() {
 	defer close(c.workerDone)
-	for wrappedCtx := range c.ctxChan {
-		if wrappedCtx != nil && wrappedCtx.Ctx != nil {
-			c.processContext(wrappedCtx)
+	purgeTicker := time.NewTicker(retentionPurgeInterval)
+	defer purgeTicker.Stop()
+	for {
+		select {
+		case wrappedCtx, ok := <-c.ctxChan:
+			if !ok {
+				return
+			}
+			if wrappedCtx != nil && wrappedCtx.Ctx != nil {
+				c.processContext(wrappedCtx)
+			}
+		case now := <-purgeTicker.C:
+			c.purgeExpired(now)
 		}
 	}
 }
@@ -252,8 +274,12 @@ func (c *AuditCollector) processContext(wrappedCtx *auditContext) {
 	qQuestion := qCtx.QQuestion()
 	duration := wrappedCtx.ProcessingDuration
 
+	c.mu.RLock()
+	privacy, sensitiveSets := c.privacy, c.sensitiveSets
+	c.mu.RUnlock()
+
 	log := AuditLog{
-		ClientIP:   internString(qCtx.ServerMeta.ClientAddr.String()),
+		ClientIP:   internString(c.anonymizeClientIP(qCtx.ServerMeta.ClientAddr, privacy.ClientIPMode)),
 		QueryType:  internString(dns.TypeToString[qQuestion.Qtype]),
 		QueryName:  internString(strings.TrimSuffix(qQuestion.Name, ".")),
 		QueryClass: internString(dns.ClassToString[qQuestion.Qclass]),
@@ -317,6 +343,10 @@ func (c *AuditCollector) processContext(wrappedCtx *auditContext) {
 		log.ResponseCode = internString("NO_RESPONSE")
 	}
 
+	if _, ok := sensitiveSets[log.DomainSet]; ok {
+		redactAuditLog(&log)
+	}
+
 	// STEP 2: Acquire the lock ONLY to modify shared data structures.
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -324,7 +354,11 @@ func (c *AuditCollector) processContext(wrappedCtx *auditContext) {
 	if !c.capturing {
 		return
 	}
+	c.appendLocked(log)
+}
 
+// appendLocked 将日志写入环形缓冲区并更新聚合统计，调用方需持有写锁
+func (c *AuditCollector) appendLocked(log AuditLog) {
 	if len(c.logs) < c.capacity {
 		c.logs = append(c.logs, log)
 	} else {
@@ -426,6 +460,11 @@ func (c *AuditCollector) ClearLogs() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	c.resetLocked()
+}
+
+// resetLocked 清空日志与聚合统计，调用方需持有写锁
+func (c *AuditCollector) resetLocked() {
 	c.logs = make([]AuditLog, 0, c.capacity)
 	c.head = 0
 	c.slowestQueries = make(slowestQueryHeap, 0, slowestQueriesCapacity)
@@ -471,8 +510,9 @@ func (c *AuditCollector) SetCapacity(newCapacity int, configBaseDir string) {
 }
 
 // <<< ADDED: saveSettings helper function
+// The caller must hold c.mu.
 func (c *AuditCollector) saveSettings(capacityToSave int, configBaseDir string) {
-	settings := AuditSettings{Capacity: capacityToSave}
+	settings := AuditSettings{Capacity: capacityToSave, Privacy: c.privacy}
 	data, err := json.MarshalIndent(settings, "", "  ")
 	if err != nil {
 		mlog.L().Error("failed to marshal audit settings", zap.Error(err))
@@ -0,0 +1,148 @@
+package coremain
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// 客户端 IP 记录方式
+const (
+	ClientIPModeFull     = "full"     // 记录完整 IP（默认）
+	ClientIPModeTruncate = "truncate" // IPv4 保留 /24，IPv6 保留 /48
+	ClientIPModeHash     = "hash"     // 记录加盐哈希，仅可用于区分客户端
+	ClientIPModeDrop     = "drop"     // 不记录客户端 IP
+)
+
+const (
+	retentionPurgeInterval = time.Minute
+	redactedQueryName      = "[redacted]"
+	droppedClientIP        = "[hidden]"
+)
+
+// AuditPrivacy 审计日志的隐私设置
+type AuditPrivacy struct {
+	// ClientIPMode 客户端 IP 的记录方式，空值等同于 full。
+	ClientIPMode string `json:"client_ip_mode"`
+	// SensitiveDomainSets 命中这些域名集合的查询不记录域名与应答。
+	SensitiveDomainSets []string `json:"sensitive_domain_sets"`
+	// RetentionHours 日志最长保留时间（小时），0 表示不限制。
+	RetentionHours int `json:"retention_hours"`
+}
+
+func (p AuditPrivacy) validate() error {
+	switch p.ClientIPMode {
+	case "", ClientIPModeFull, ClientIPModeTruncate, ClientIPModeHash, ClientIPModeDrop:
+	default:
+		return fmt.Errorf("invalid client_ip_mode [%s]", p.ClientIPMode)
+	}
+	if p.RetentionHours < 0 {
+		return fmt.Errorf("retention_hours cannot be negative")
+	}
+	return nil
+}
+
+// 每次启动生成新的盐，哈希值不会跨进程重启关联
+func newHashSalt() []byte {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return b
+}
+
+func (c *AuditCollector) anonymizeClientIP(addr netip.Addr, mode string) string {
+	switch mode {
+	case ClientIPModeTruncate:
+		bits := 48
+		if addr.Unmap().Is4() {
+			addr = addr.Unmap()
+			bits = 24
+		}
+		if pfx, err := addr.Prefix(bits); err == nil {
+			return pfx.Addr().String()
+		}
+		return addr.String()
+	case ClientIPModeHash:
+		h := sha256.New()
+		h.Write(c.hashSalt)
+		h.Write(addr.AsSlice())
+		return hex.EncodeToString(h.Sum(nil)[:8])
+	case ClientIPModeDrop:
+		return droppedClientIP
+	default:
+		return addr.String()
+	}
+}
+
+func redactAuditLog(log *AuditLog) {
+	log.QueryName = redactedQueryName
+	log.Answers = nil
+}
+
+// setPrivacyLocked 更新隐私设置，调用方需持有写锁（或处于初始化阶段）
+func (c *AuditCollector) setPrivacyLocked(p AuditPrivacy) {
+	c.privacy = p
+	c.sensitiveSets = make(map[string]struct{}, len(p.SensitiveDomainSets))
+	for _, s := range p.SensitiveDomainSets {
+		c.sensitiveSets[s] = struct{}{}
+	}
+}
+
+func (c *AuditCollector) GetPrivacy() AuditPrivacy {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.privacy
+}
+
+// SetPrivacy 更新并持久化隐私设置。新设置仅作用于之后记录的日志，
+// 但保留时间会立即生效。
+func (c *AuditCollector) SetPrivacy(p AuditPrivacy, configBaseDir string) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.setPrivacyLocked(p)
+	c.saveSettings(c.capacity, configBaseDir)
+	c.mu.Unlock()
+
+	c.purgeExpired(time.Now())
+	return nil
+}
+
+// purgeExpired 删除超过保留时间的日志，并重建聚合统计
+func (c *AuditCollector) purgeExpired(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.privacy.RetentionHours <= 0 || len(c.logs) == 0 {
+		return
+	}
+	deadline := now.Add(-time.Duration(c.privacy.RetentionHours) * time.Hour)
+
+	// 按时间顺序取出日志
+	ordered := make([]AuditLog, 0, len(c.logs))
+	if len(c.logs) < c.capacity {
+		ordered = append(ordered, c.logs...)
+	} else {
+		ordered = append(ordered, c.logs[c.head:]...)
+		ordered = append(ordered, c.logs[:c.head]...)
+	}
+
+	firstKept := len(ordered)
+	for i, l := range ordered {
+		if !l.QueryTime.Before(deadline) {
+			firstKept = i
+			break
+		}
+	}
+	if firstKept == 0 {
+		return
+	}
+
+	c.resetLocked()
+	for _, l := range ordered[firstKept:] {
+		c.appendLocked(l)
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConfigTest is a query fixture in the "tests" section of the config.
+// It is run against the plugins by "mosdns check --run-tests".
+type ConfigTest struct {
+	Name   string           `yaml:"name"`
+	Entry  string           `yaml:"entry"` // Tag of the executable that handles the query.
+	Query  ConfigTestQuery  `yaml:"query"`
+	Expect ConfigTestExpect `yaml:"expect"`
+}
+
+type ConfigTestQuery struct {
+	Name   string `yaml:"name"`
+	Type   string `yaml:"type"`   // Default is "A".
+	Client string `yaml:"client"` // Client ip. Optional.
+}
+
+// ConfigTestExpect is the expected outcome. Unset fields are not checked.
+type ConfigTestExpect struct {
+	Blocked *bool    `yaml:"blocked"`
+	Forward string   `yaml:"forward"` // Tag of the forward plugin that answered the query.
+	Rcode   string   `yaml:"rcode"`
+	Answer  []string `yaml:"answer"` // Values of the answer records, e.g. ips.
+}
+
+// NewCheckServer loads the config at path in check mode, see CheckMode.
+func NewCheckServer(path string) (*Mosdns, error) {
+	return NewServer(&serverFlags{c: path, check: true})
+}
+
+// CheckMode reports whether mosdns was loaded to check the config.
+// In check mode, server plugins are not loaded (only their args and the
+// tags they refer to are checked) and the api is not served.
+// Plugins should avoid side effects, e.g. sending queries to upstreams.
+func (m *Mosdns) CheckMode() bool {
+	return m.checkMode
+}
+
+// ConfigTests returns the tests of the main config. It is only set in
+// check mode.
+func (m *Mosdns) ConfigTests() []ConfigTest {
+	return m.tests
+}
+
+func isServerType(typ string) bool {
+	return strings.HasSuffix(typ, "_server")
+}
+
+// PluginError is returned by NewServer if a plugin of the config failed
+// to load. File and Index locate the plugin in the config.
+type PluginError struct {
+	File  string // Config file that contains the plugin. Empty if unknown.
+	Index int    // Index of the plugin in the "plugins" section of File.
+	Tag   string
+	Err   error
+}
+
+func (e *PluginError) Error() string {
+	return fmt.Sprintf("failed to init plugin #%d %s, %v", e.Index, e.Tag, e.Err)
+}
+
+func (e *PluginError) Unwrap() error {
+	return e.Err
+}
+
+// TagReferrer can be implemented by plugin args to report the tags of
+// the plugins they refer to. It is used to check the server plugins,
+// which are not loaded in check mode.
+type TagReferrer interface {
+	ReferredTags() []string
+}
+
+// checkServerPlugin decodes the args of the server plugin c and checks
+// the tags it refers to, without loading it.
+func (m *Mosdns) checkServerPlugin(c PluginConfig) error {
+	_, args, err := decodePluginArgs(c)
+	if err != nil {
+		return err
+	}
+	if r, ok := args.(TagReferrer); ok {
+		for _, tag := range r.ReferredTags() {
+			if len(tag) == 0 {
+				continue
+			}
+			m.pluginsMu.Lock()
+			_, ok := m.plugins[tag]
+			m.pluginsMu.Unlock()
+			if !ok {
+				return fmt.Errorf("cannot find plugin by tag %q", tag)
+			}
+		}
+	}
+	return nil
+}
+
+// checkTests checks that the entries of the config tests exist.
+func (m *Mosdns) checkTests() error {
+	for i, t := range m.tests {
+		m.pluginsMu.Lock()
+		_, ok := m.plugins[t.Entry]
+		m.pluginsMu.Unlock()
+		if !ok {
+			return fmt.Errorf("test #%d %s, cannot find entry by tag %q", i, t.Name, t.Entry)
+		}
+	}
+	return nil
+}
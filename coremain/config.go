@@ -28,7 +28,9 @@ type Config struct {
 	Include []string       `yaml:"include"`
 	Plugins []PluginConfig `yaml:"plugins"`
 	API     APIConfig      `yaml:"api"`
+	Tests   []ConfigTest   `yaml:"tests"`
 	baseDir string         `yaml:"-"`
+	file    string         `yaml:"-"` // Path of the config file. Empty if unknown.
 }
 
 // PluginConfig represents a plugin config
@@ -47,5 +49,8 @@ type PluginConfig struct {
 }
 
 type APIConfig struct {
-	HTTP string `yaml:"http"`
+	HTTP      string          `yaml:"http"`
+	Readiness ReadinessConfig `yaml:"readiness"`
+	Auth      APIAuthConfig   `yaml:"auth"`
+	TLS       APITLSConfig    `yaml:"tls"`
 }
@@ -0,0 +1,211 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RuntimeConfigReporter is implemented by plugins whose config can be
+// changed at runtime through their api, e.g. rule lists added to
+// adguard_rule.
+type RuntimeConfigReporter interface {
+	// RuntimeConfig returns the current runtime config. It must be
+	// JSON serializable.
+	RuntimeConfig() any
+}
+
+// EffectiveConfig is the config that an instance is actually running.
+// Log, API and plugin args are keyed by their yaml names.
+type EffectiveConfig struct {
+	Log     any               `json:"log"`
+	API     any               `json:"api"`
+	Plugins []EffectivePlugin `json:"plugins"`
+}
+
+type EffectivePlugin struct {
+	Tag  string `json:"tag"`
+	Type string `json:"type"`
+	// Args are the decoded args. Unset fields show up with their zero
+	// values, unless they are omitempty. Secrets are redacted.
+	Args    any `json:"args"`
+	Runtime any `json:"runtime,omitempty"`
+}
+
+// EffectiveConfig returns the resolved config of m. Plugins are listed in
+// load order, with includes followed and global overrides applied. Args
+// of restarted plugins are the ones they were restarted with.
+func (m *Mosdns) EffectiveConfig() EffectiveConfig {
+	m.pluginsMu.Lock()
+	confs := make([]PluginConfig, 0, len(m.reg.order))
+	plugins := make([]any, 0, len(m.reg.order))
+	for _, tag := range m.reg.order {
+		p, ok := m.plugins[tag]
+		if !ok {
+			continue
+		}
+		confs = append(confs, m.reg.confs[tag])
+		plugins = append(plugins, p)
+	}
+	m.pluginsMu.Unlock()
+
+	ec := EffectiveConfig{
+		Log:     yamlGeneric(m.logConfig),
+		API:     yamlGeneric(m.apiConfig),
+		Plugins: make([]EffectivePlugin, 0, len(confs)),
+	}
+	for i, c := range confs {
+		ep := EffectivePlugin{Tag: c.Tag, Type: c.Type, Args: effectiveArgs(c)}
+		if rr, ok := plugins[i].(RuntimeConfigReporter); ok {
+			ep.Runtime = rr.RuntimeConfig()
+		}
+		ec.Plugins = append(ec.Plugins, ep)
+	}
+	return ec
+}
+
+// effectiveArgs returns the decoded args of c, or the raw args if they
+// cannot be decoded.
+func effectiveArgs(c PluginConfig) any {
+	var v any = c.Args
+	if _, args, err := decodePluginArgs(c); err == nil {
+		v = args
+	}
+	return yamlGeneric(v)
+}
+
+// yamlGeneric converts v to maps and slices keyed by yaml names, with
+// secrets redacted. If v cannot be converted, it is returned as is.
+func yamlGeneric(v any) any {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var generic any
+	if err := yaml.Unmarshal(b, &generic); err != nil {
+		return v
+	}
+	return redact("", generic)
+}
+
+var secretKeys = []string{"password", "secret", "token", "authorization", "cookie"}
+
+// redact replaces values of secret-looking keys and passwords in urls.
+// All values of "headers" maps are redacted, as http headers often carry
+// credentials, e.g. "Authorization: Bearer xxx" or "X-Api-Key". So are
+// the path and query of hook urls, e.g. a Telegram bot token.
+func redact(key string, v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			switch {
+			case strings.EqualFold(key, "headers"):
+				out[k] = redactAll(e)
+			case strings.EqualFold(key, "hooks") && strings.EqualFold(k, "url"):
+				out[k] = redactURLPath(e)
+			default:
+				out[k] = redact(k, e)
+			}
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = redact(key, e)
+		}
+		return out
+	case string:
+		if len(v) == 0 {
+			return v
+		}
+		lk := strings.ToLower(key)
+		for _, s := range secretKeys {
+			if strings.Contains(lk, s) {
+				return "xxxxx"
+			}
+		}
+		if strings.Contains(v, "@") {
+			return redactUserinfo(v)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// redactAll redacts all non-empty strings in v.
+func redactAll(v any) any {
+	switch v := v.(type) {
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = redactAll(e)
+		}
+		return out
+	case string:
+		if len(v) == 0 {
+			return v
+		}
+		return "xxxxx"
+	default:
+		return v
+	}
+}
+
+// redactURLPath keeps only the scheme and host of url v.
+func redactURLPath(v any) any {
+	s, ok := v.(string)
+	if !ok || len(s) == 0 {
+		return v
+	}
+	u, err := url.Parse(s)
+	if err != nil || len(u.Host) == 0 {
+		return "xxxxx"
+	}
+	if (len(u.Path) == 0 || u.Path == "/") && len(u.RawQuery) == 0 && u.User == nil {
+		return s
+	}
+	return u.Scheme + "://" + u.Host + "/xxxxx"
+}
+
+// redactUserinfo redacts the password in s if s is a url or a
+// "user:pass@host" address, e.g. a socks5 proxy.
+func redactUserinfo(s string) string {
+	if !strings.Contains(s, "://") {
+		u, err := url.Parse("x://" + s)
+		if err != nil || u.User == nil {
+			return s
+		}
+		return strings.TrimPrefix(u.Redacted(), "x://")
+	}
+	if u, err := url.Parse(s); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return s
+}
+
+func (m *Mosdns) handleEffectiveConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, m.EffectiveConfig())
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// UpstreamReporter is implemented by plugins that send queries to
+// upstreams, e.g. forward. The upstreams show up in the plugin graph.
+type UpstreamReporter interface {
+	// Upstreams returns the names of the upstreams.
+	Upstreams() []string
+}
+
+// Kinds of PluginGraph nodes.
+const (
+	GraphNodeEntry    = "entry"    // server plugins, where queries come in
+	GraphNodePlugin   = "plugin"   // other plugins from config
+	GraphNodePreset   = "preset"   // preset plugins
+	GraphNodeUpstream = "upstream" // upstreams of UpstreamReporter plugins
+)
+
+// PluginGraph is the dependency graph of the loaded plugins. An edge
+// from A to B means A refers to B, e.g. a sequence that executes B or
+// a matcher that uses the data of B.
+type PluginGraph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+	// Unreachable are the tags of plugins that cannot be reached from
+	// any entry.
+	Unreachable []string `json:"unreachable"`
+}
+
+type GraphNode struct {
+	ID        string `json:"id"` // Plugin tag, or "<tag>/<upstream>" for upstreams.
+	Label     string `json:"label"`
+	Kind      string `json:"kind"`
+	Type      string `json:"type,omitempty"` // Plugin type.
+	Reachable bool   `json:"reachable"`
+}
+
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// PluginGraph returns the dependency graph of the loaded plugins.
+// Dependencies are the plugins that were looked up by tag during init.
+func (m *Mosdns) PluginGraph() PluginGraph {
+	m.pluginsMu.Lock()
+	var g PluginGraph
+	index := make(map[string]int)
+	addNode := func(n GraphNode) {
+		index[n.ID] = len(g.Nodes)
+		g.Nodes = append(g.Nodes, n)
+	}
+	upstreams := make(map[string][]string)
+	for _, tag := range m.reg.order {
+		p, ok := m.plugins[tag]
+		if !ok {
+			continue
+		}
+		typ := m.reg.confs[tag].Type
+		kind := GraphNodePlugin
+		if isServerType(typ) {
+			kind = GraphNodeEntry
+		}
+		addNode(GraphNode{ID: tag, Label: tag, Kind: kind, Type: typ})
+		if ur, ok := p.(UpstreamReporter); ok {
+			upstreams[tag] = ur.Upstreams()
+		}
+	}
+	var presets []string
+	for tag := range m.plugins {
+		if _, ok := index[tag]; !ok {
+			presets = append(presets, tag)
+		}
+	}
+	slices.Sort(presets)
+	for _, tag := range presets {
+		addNode(GraphNode{ID: tag, Label: tag, Kind: GraphNodePreset})
+	}
+	for _, tag := range m.reg.order {
+		if _, ok := index[tag]; !ok {
+			continue
+		}
+		var deps []string
+		for dep := range m.reg.deps[tag] {
+			if _, ok := index[dep]; ok {
+				deps = append(deps, dep)
+			}
+		}
+		slices.Sort(deps)
+		for _, dep := range deps {
+			g.Edges = append(g.Edges, GraphEdge{From: tag, To: dep})
+		}
+	}
+	for _, tag := range m.reg.order {
+		for _, u := range upstreams[tag] {
+			id := tag + "/" + u
+			if _, dup := index[id]; dup {
+				continue
+			}
+			addNode(GraphNode{ID: id, Label: u, Kind: GraphNodeUpstream})
+			g.Edges = append(g.Edges, GraphEdge{From: tag, To: id})
+		}
+	}
+	m.pluginsMu.Unlock()
+
+	// Mark nodes that are reachable from entries.
+	out := make(map[string][]string)
+	for _, e := range g.Edges {
+		out[e.From] = append(out[e.From], e.To)
+	}
+	var queue []string
+	for i, n := range g.Nodes {
+		if n.Kind == GraphNodeEntry {
+			g.Nodes[i].Reachable = true
+			queue = append(queue, n.ID)
+		}
+	}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, to := range out[id] {
+			if n := &g.Nodes[index[to]]; !n.Reachable {
+				n.Reachable = true
+				queue = append(queue, to)
+			}
+		}
+	}
+	g.Unreachable = []string{}
+	for _, n := range g.Nodes {
+		if !n.Reachable && n.Kind == GraphNodePlugin {
+			g.Unreachable = append(g.Unreachable, n.ID)
+		}
+	}
+	return g
+}
+
+// DOT returns g in the graphviz dot language. Entries are drawn as
+// double boxes, upstreams as ellipses and unreachable nodes dashed.
+func (g PluginGraph) DOT() string {
+	b := new(strings.Builder)
+	b.WriteString("digraph mosdns {\n\trankdir=LR;\n\tnode [shape=box];\n")
+	for _, n := range g.Nodes {
+		label := n.Label
+		if len(n.Type) > 0 {
+			label += "\n" + n.Type
+		}
+		attrs := []string{"label=" + strconv.Quote(label)}
+		switch n.Kind {
+		case GraphNodeEntry:
+			attrs = append(attrs, "peripheries=2")
+		case GraphNodeUpstream:
+			attrs = append(attrs, "shape=ellipse")
+		case GraphNodePreset:
+			attrs = append(attrs, "color=gray")
+		}
+		if !n.Reachable && n.Kind == GraphNodePlugin {
+			attrs = append(attrs, "style=dashed")
+		}
+		fmt.Fprintf(b, "\t%s [%s];\n", strconv.Quote(n.ID), strings.Join(attrs, ", "))
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(b, "\t%s -> %s;\n", strconv.Quote(e.From), strconv.Quote(e.To))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// handlePluginGraph handles GET /api/plugins/graph. The graph is in json,
+// or in the dot language with "?format=dot".
+func (m *Mosdns) handlePluginGraph(w http.ResponseWriter, r *http.Request) {
+	g := m.PluginGraph()
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		writeJSON(w, http.StatusOK, g)
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		_, _ = w.Write([]byte(g.DOT()))
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]any{"error": "unsupported format " + format})
+	}
+}
@@ -21,6 +21,7 @@ package coremain
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"encoding/json"
 	"errors"
@@ -33,6 +34,8 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/IrineSistiana/mosdns/v5/mlog"
 	"github.com/IrineSistiana/mosdns/v5/pkg/safe_close"
@@ -50,16 +53,34 @@ type Mosdns struct {
 	logger *zap.Logger // non-nil logger.
 
 	// Plugins
-	plugins map[string]any
-
+	pluginsMu sync.Mutex
+	plugins   map[string]any
+	reg       pluginRegistry // guarded by pluginsMu
+	restartMu sync.Mutex     // serializes RestartPlugin
+	apiMu     sync.Mutex
+	apis      map[string]*pluginAPI
+
+	configPath      string
 	httpMux         *chi.Mux
 	metricsReg      *prometheus.Registry
 	sc              *safe_close.SafeClose
 	globalOverrides *GlobalOverrides // <<< ADDED
+
+	checkMode bool         // see CheckMode
+	tests     []ConfigTest // tests of the main config, only loaded in check mode
+
+	loaded    atomic.Bool // all plugins from the config were loaded
+	logConfig mlog.LogConfig
+	apiConfig APIConfig
+	apiAuth   *apiAuth // nil if api auth is disabled
 }
 
 // NewMosdns initializes a mosdns instance and its plugins.
 func NewMosdns(cfg *Config, configPath string) (*Mosdns, error) {
+	return newMosdns(cfg, configPath, false)
+}
+
+func newMosdns(cfg *Config, configPath string, checkMode bool) (*Mosdns, error) {
 	// Init logger.
 	baseLogger, err := mlog.NewLogger(cfg.Log)
 	if err != nil {
@@ -72,21 +93,36 @@ func NewMosdns(cfg *Config, configPath string) (*Mosdns, error) {
 	// Create the final logger with our TeeCore.
 	lg := zap.New(teeCore, zap.AddCaller(), zap.AddStacktrace(zap.ErrorLevel))
 
-	// Start the audit log collector's background worker.
-	GlobalAuditCollector.StartWorker()
+	// Start the audit log collector's background worker. The collector is
+	// global, a check mode instance may run next to the serving one (see
+	// checkReload) and must not touch it.
+	if !checkMode {
+		GlobalAuditCollector.StartWorker()
+	}
 
 	m := &Mosdns{
 		logger:     lg,
 		plugins:    make(map[string]any),
+		reg:        newPluginRegistry(),
+		apis:       make(map[string]*pluginAPI),
+		configPath: configPath,
 		httpMux:    chi.NewRouter(),
 		metricsReg: newMetricsReg(),
 		sc:         safe_close.NewSafeClose(),
+		checkMode:  checkMode,
+		logConfig:  cfg.Log,
+		apiConfig:  cfg.API,
+	}
+	if checkMode {
+		m.tests = cfg.Tests
 	}
 
 	// <<< START OF MODIFICATIONS >>>
 	// Step 1: Discover original settings from the raw config. This must be done
 	// before any overrides are applied. This is for the GET API fallback.
-	DiscoverAndCacheSettings(cfg)
+	if !checkMode {
+		DiscoverAndCacheSettings(cfg)
+	}
 
 	// Step 2: Load overrides from file. The application of these overrides
 	// will happen inside `loadPluginsFromCfg` for each plugin config.
@@ -106,6 +142,12 @@ func NewMosdns(cfg *Config, configPath string) (*Mosdns, error) {
 	}
 	// <<< END OF MODIFICATIONS >>>
 
+	auth, err := newAPIAuth(cfg.API.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid api auth config, %w", err)
+	}
+	m.apiAuth = auth
+
 	// This must be called after m.httpMux and m.metricsReg been set.
 	m.initHttpMux()
 
@@ -116,25 +158,48 @@ func NewMosdns(cfg *Config, configPath string) (*Mosdns, error) {
 	RegisterOverridesAPI(m.httpMux) // <<< ADDED
 	RegisterUpdateAPI(m.httpMux)  // For binary updates
 	RegisterSystemAPI(m.httpMux)  // For self-restart
+	m.httpMux.Get("/api/plugins/graph", m.handlePluginGraph)
+	m.httpMux.Post("/api/plugins/{tag}/restart", m.handleRestartPlugin)
+	m.httpMux.Get("/api/provision", m.handleProvision)
+	m.httpMux.Get("/readyz", m.handleReadyz)
+	m.httpMux.Get("/api/config/effective", m.handleEffectiveConfig)
 
 	// Start http api server
-	if httpAddr := cfg.API.HTTP; len(httpAddr) > 0 {
+	if httpAddr := cfg.API.HTTP; len(httpAddr) > 0 && !checkMode {
+		tlsConfig, cr, err := newAPITLSConfig(cfg.API.TLS, lg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid api tls config, %w", err)
+		}
 		httpServer := &http.Server{
-			Addr:    httpAddr,
-			Handler: m.httpMux,
+			Addr:      httpAddr,
+			Handler:   m.httpMux,
+			TLSConfig: tlsConfig,
 		}
 		m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
 			defer done()
+			if cr != nil {
+				defer cr.Close()
+			}
 			errChan := make(chan error, 1)
 			go func() {
-				m.logger.Info("starting api http server", zap.String("addr", httpAddr))
-				errChan <- httpServer.ListenAndServe()
+				m.logger.Info("starting api http server", zap.String("addr", httpAddr), zap.Bool("tls", tlsConfig != nil))
+				if tlsConfig != nil {
+					// Cert is served by tlsConfig.GetCertificate.
+					errChan <- httpServer.ListenAndServeTLS("", "")
+				} else {
+					errChan <- httpServer.ListenAndServe()
+				}
 			}()
 			select {
 			case err := <-errChan:
 				m.sc.SendCloseSignal(err)
 			case <-closeSignal:
-				_ = httpServer.Close()
+				// Let in-flight api requests finish.
+				ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				if err := httpServer.Shutdown(ctx); err != nil {
+					_ = httpServer.Close()
+				}
+				cancel()
 			}
 		})
 	}
@@ -148,10 +213,18 @@ func NewMosdns(cfg *Config, configPath string) (*Mosdns, error) {
 			<-closeSignal
 
 			// Stop the audit worker gracefully.
-			GlobalAuditCollector.StopWorker()
+			if !m.checkMode {
+				GlobalAuditCollector.StopWorker()
+			}
 
 			m.logger.Info("starting shutdown sequences")
+			m.pluginsMu.Lock()
+			plugins := make(map[string]any, len(m.plugins))
 			for tag, p := range m.plugins {
+				plugins[tag] = p
+			}
+			m.pluginsMu.Unlock()
+			for tag, p := range plugins {
 				if closer, _ := p.(io.Closer); closer != nil {
 					m.logger.Info("closing plugin", zap.String("tag", tag))
 					_ = closer.Close()
@@ -178,7 +251,13 @@ func NewMosdns(cfg *Config, configPath string) (*Mosdns, error) {
 		_ = m.sc.WaitClosed()
 		return nil, err
 	}
+	if err := m.checkTests(); err != nil {
+		m.sc.SendCloseSignal(err)
+		_ = m.sc.WaitClosed()
+		return nil, err
+	}
 	m.logger.Info("all plugins are loaded")
+	m.loaded.Store(true)
 
 	return m, nil
 }
@@ -189,6 +268,8 @@ func NewTestMosdnsWithPlugins(p map[string]any) *Mosdns {
 		logger:     mlog.Nop(),
 		httpMux:    chi.NewRouter(),
 		plugins:    p,
+		reg:        newPluginRegistry(),
+		apis:       make(map[string]*pluginAPI),
 		metricsReg: newMetricsReg(),
 		sc:         safe_close.NewSafeClose(),
 	}
@@ -209,21 +290,60 @@ func (m *Mosdns) Logger() *zap.Logger {
 }
 
 // GetPlugin returns a plugin.
+// Plugins referenced during a plugin's init are recorded as its
+// dependencies, see RestartPlugin.
 func (m *Mosdns) GetPlugin(tag string) any {
+	m.pluginsMu.Lock()
+	defer m.pluginsMu.Unlock()
+	m.reg.addDep(tag)
 	return m.plugins[tag]
 }
 
 // GetMetricsReg returns a prometheus.Registerer with a prefix of "mosdns_"
+// Collectors registered during a plugin's init are unregistered when the
+// plugin is restarted.
 func (m *Mosdns) GetMetricsReg() prometheus.Registerer {
-	return prometheus.WrapRegistererWithPrefix("mosdns_", m.metricsReg)
+	m.pluginsMu.Lock()
+	tag := m.reg.initTag
+	m.pluginsMu.Unlock()
+	if len(tag) == 0 {
+		return prometheus.WrapRegistererWithPrefix("mosdns_", m.metricsReg)
+	}
+	return prometheus.WrapRegistererWithPrefix("mosdns_", &pluginRegisterer{m: m, tag: tag})
+}
+
+// RegSharedCollector registers c to GetMetricsReg. If an equal collector was
+// already registered, e.g. by another plugin, the existing one is returned.
+// This allows plugins to share a collector with variable labels.
+// Shared collectors are never unregistered.
+func (m *Mosdns) RegSharedCollector(c prometheus.Collector) (prometheus.Collector, error) {
+	if err := prometheus.WrapRegistererWithPrefix("mosdns_", m.metricsReg).Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			return are.ExistingCollector, nil
+		}
+		return nil, err
+	}
+	return c, nil
 }
 
 func (m *Mosdns) GetAPIRouter() *chi.Mux {
 	return m.httpMux
 }
 
+// RegPluginAPI mounts mux to "/plugins/<tag>". If the plugin was restarted,
+// mux replaces the api of the old instance.
 func (m *Mosdns) RegPluginAPI(tag string, mux *chi.Mux) {
-	m.httpMux.Mount("/plugins/"+tag, mux)
+	m.apiMu.Lock()
+	defer m.apiMu.Unlock()
+	if a, ok := m.apis[tag]; ok {
+		a.set(mux)
+		return
+	}
+	a := new(pluginAPI)
+	a.set(mux)
+	m.apis[tag] = a
+	m.httpMux.Mount("/plugins/"+tag, a)
 }
 
 func newMetricsReg() *prometheus.Registry {
@@ -257,7 +377,7 @@ func (m *Mosdns) initHttpMux() {
 					w.Header().Set("Vary", "Origin")
 					w.Header().Set("Access-Control-Allow-Origin", origin)
 					w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-					w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Accept")
+					w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Accept, Authorization")
 					originAllowed = true
 				} else if r.Method == http.MethodOptions {
 					w.WriteHeader(http.StatusForbidden)
@@ -279,6 +399,9 @@ func (m *Mosdns) initHttpMux() {
 	}
 
 	m.httpMux.Use(corsMiddleware)
+	// Authentication covers all routes, including the plugin APIs mounted
+	// under /plugins. Preflight requests are answered by corsMiddleware.
+	m.httpMux.Use(m.apiAuth.middleware)
 
 	// metrics 处理 (只注册一次)
 	metricsHandler := promhttp.HandlerFor(m.metricsReg, promhttp.HandlerOpts{})
@@ -334,6 +457,19 @@ func (m *Mosdns) initHttpMux() {
 		}
 	}
 
+	dashboardHandler := func(w http.ResponseWriter, r *http.Request) {
+		data, err := content.ReadFile("www/dashboard.html")
+		if err != nil {
+			m.logger.Error("Error reading embedded file", zap.String("file", "www/dashboard.html"), zap.Error(err))
+			http.Error(w, "Error reading the embedded file", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if _, err := w.Write(data); err != nil {
+			m.logger.Error("Error writing response", zap.Error(err))
+		}
+	}
+
 	redirectToLog := func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/log", http.StatusFound)
 	}
@@ -376,6 +512,7 @@ func (m *Mosdns) initHttpMux() {
 	m.httpMux.Get("/graphic", graphicHandler)
 	m.httpMux.Get("/log", logHandler)
 	m.httpMux.Get("/plog", plainLogHandler)
+	m.httpMux.Get("/dashboard", dashboardHandler)
 	m.httpMux.Get("/rlog", redirectToLog)
 	m.httpMux.Get("/assets/*", staticAssetHandler)
 
@@ -412,7 +549,9 @@ func (m *Mosdns) loadPresetPlugins() error {
 		if err != nil {
 			return fmt.Errorf("failed to init preset plugin %s, %w", tag, err)
 		}
+		m.pluginsMu.Lock()
 		m.plugins[tag] = p
+		m.pluginsMu.Unlock()
 	}
 	return nil
 }
@@ -442,13 +581,20 @@ func (m *Mosdns) loadPluginsFromCfg(cfg *Config, includeDepth int, baseDir strin
 	}
 
 	for i, pc := range cfg.Plugins {
+		if m.checkMode && isServerType(pc.Type) {
+			m.logger.Info("server plugin not loaded in check mode", zap.String("tag", pc.Tag), zap.String("type", pc.Type))
+			if err := m.checkServerPlugin(pc); err != nil {
+				return &PluginError{File: cfg.file, Index: i, Tag: pc.Tag, Err: err}
+			}
+			continue
+		}
 		// <<< MODIFIED: This is the correct "interception point".
 		if m.globalOverrides != nil {
 			ApplyOverrides(&pc, m.globalOverrides)
 		}
 		// <<< END MODIFICATION
 		if err := m.newPlugin(pc); err != nil {
-			return fmt.Errorf("failed to init plugin #%d %s, %w", i, pc.Tag, err)
+			return &PluginError{File: cfg.file, Index: i, Tag: pc.Tag, Err: err}
 		}
 	}
 	return nil
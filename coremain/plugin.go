@@ -88,6 +88,7 @@ func GetPluginType(typ string) (PluginTypeInfo, bool) {
 
 // newPlugin initializes a Plugin from c and adds it to mosdns.
 func (m *Mosdns) newPlugin(c PluginConfig) error {
+	m.pluginsMu.Lock()
 	if len(c.Tag) == 0 {
 		baseTag := c.Type
 		if len(baseTag) == 0 {
@@ -106,13 +107,24 @@ func (m *Mosdns) newPlugin(c PluginConfig) error {
 		m.logger.Warn("plugin tag missing, auto-generated tag assigned", zap.String("type", c.Type), zap.String("tag", c.Tag))
 	}
 
-	if _, dup := m.plugins[c.Tag]; dup {
+	_, dup := m.plugins[c.Tag]
+	m.pluginsMu.Unlock()
+	if dup {
 		return fmt.Errorf("duplicated plugin tag %s", c.Tag)
 	}
 
+	typeInfo, args, err := decodePluginArgs(c)
+	if err != nil {
+		return err
+	}
+	return m.initPlugin(c, typeInfo, args)
+}
+
+// decodePluginArgs decodes c.Args to the args type of c.Type.
+func decodePluginArgs(c PluginConfig) (PluginTypeInfo, any, error) {
 	typeInfo, ok := GetPluginType(c.Type)
 	if !ok {
-		return fmt.Errorf("plugin type %s not defined", c.Type)
+		return typeInfo, nil, fmt.Errorf("plugin type %s not defined", c.Type)
 	}
 
 	args := typeInfo.NewArgs()
@@ -120,13 +132,26 @@ func (m *Mosdns) newPlugin(c PluginConfig) error {
 		args = c.Args
 	} else {
 		if err := utils.WeakDecode(c.Args, args); err != nil {
-			return fmt.Errorf("unable to decode plugin args: %w", err)
+			return typeInfo, nil, fmt.Errorf("unable to decode plugin args: %w", err)
 		}
 	}
+	return typeInfo, args, nil
+}
 
+// initPlugin inits the plugin of c with decoded args and adds it to mosdns.
+func (m *Mosdns) initPlugin(c PluginConfig, typeInfo PluginTypeInfo, args any) error {
 	m.logger.Info("loading plugin", zap.String("tag", c.Tag), zap.String("type", c.Type))
+	m.pluginsMu.Lock()
+	m.reg.startInit(c.Tag)
+	m.pluginsMu.Unlock()
+
 	p, err := typeInfo.NewPlugin(NewBP(c.Tag, m), args)
+
+	m.pluginsMu.Lock()
+	defer m.pluginsMu.Unlock()
+	m.reg.endInit(c, err == nil)
 	if err != nil {
+		m.unregisterCollectorsLocked(c.Tag)
 		return fmt.Errorf("failed to init plugin: %w", err)
 	}
 	m.plugins[c.Tag] = p
@@ -210,6 +235,8 @@ func (p *BP) Tag() string {
 
 // RegAPI mounts mux to mosdns api. Note: Plugins MUST NOT call RegAPI twice.
 // Since mounting same path to root chi.Mux causes runtime panic.
+// If api auth is enabled, read-only credentials can call all GET and HEAD
+// routes of mux. GET routes that change state must be wrapped with AdminOnly.
 func (p *BP) RegAPI(mux *chi.Mux) {
 	p.m.RegPluginAPI(p.tag, mux)
 }
@@ -0,0 +1,363 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// pluginRegistry records what is needed to restart plugins that were
+// loaded from config.
+type pluginRegistry struct {
+	initTag    string                         // tag of the plugin being initialized
+	confs      map[string]PluginConfig        // tag -> config
+	order      []string                       // tags in load order
+	deps       map[string]map[string]struct{} // tag -> tags it referenced during init
+	collectors map[string][]prometheus.Collector
+}
+
+func newPluginRegistry() pluginRegistry {
+	return pluginRegistry{
+		confs:      make(map[string]PluginConfig),
+		deps:       make(map[string]map[string]struct{}),
+		collectors: make(map[string][]prometheus.Collector),
+	}
+}
+
+func (r *pluginRegistry) startInit(tag string) {
+	r.initTag = tag
+	r.deps[tag] = make(map[string]struct{})
+}
+
+func (r *pluginRegistry) addDep(dep string) {
+	if len(r.initTag) > 0 && dep != r.initTag {
+		r.deps[r.initTag][dep] = struct{}{}
+	}
+}
+
+func (r *pluginRegistry) endInit(c PluginConfig, ok bool) {
+	r.initTag = ""
+	if !ok {
+		delete(r.deps, c.Tag)
+		return
+	}
+	if _, loaded := r.confs[c.Tag]; !loaded {
+		r.order = append(r.order, c.Tag)
+	}
+	r.confs[c.Tag] = c
+}
+
+// dependents returns tag and all plugins that depend on it directly or
+// indirectly, in load order.
+func (r *pluginRegistry) dependents(tag string) []string {
+	set := map[string]struct{}{tag: {}}
+	for changed := true; changed; {
+		changed = false
+		for t, deps := range r.deps {
+			if _, ok := set[t]; ok {
+				continue
+			}
+			for d := range deps {
+				if _, ok := set[d]; ok {
+					set[t] = struct{}{}
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	var tags []string
+	for _, t := range r.order {
+		if _, ok := set[t]; ok {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// pluginRegisterer registers collectors to m.metricsReg and records them
+// for the plugin tag.
+type pluginRegisterer struct {
+	m   *Mosdns
+	tag string
+}
+
+func (r *pluginRegisterer) Register(c prometheus.Collector) error {
+	if err := r.m.metricsReg.Register(c); err != nil {
+		return err
+	}
+	r.m.pluginsMu.Lock()
+	r.m.reg.collectors[r.tag] = append(r.m.reg.collectors[r.tag], c)
+	r.m.pluginsMu.Unlock()
+	return nil
+}
+
+func (r *pluginRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (r *pluginRegisterer) Unregister(c prometheus.Collector) bool {
+	return r.m.metricsReg.Unregister(c)
+}
+
+// unregisterCollectorsLocked unregisters all collectors of tag.
+// m.pluginsMu must be held.
+func (m *Mosdns) unregisterCollectorsLocked(tag string) {
+	for _, c := range m.reg.collectors[tag] {
+		m.metricsReg.Unregister(c)
+	}
+	delete(m.reg.collectors, tag)
+}
+
+// pluginAPI is a mounted plugin api whose mux can be replaced after the
+// plugin was restarted.
+type pluginAPI struct {
+	mux atomic.Pointer[chi.Mux]
+}
+
+var _ chi.Routes = (*pluginAPI)(nil)
+
+func (a *pluginAPI) set(mux *chi.Mux) {
+	a.mux.Store(mux)
+}
+
+func (a *pluginAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mux := a.mux.Load()
+	if mux == nil {
+		http.Error(w, "plugin is restarting", http.StatusServiceUnavailable)
+		return
+	}
+	mux.ServeHTTP(w, r)
+}
+
+func (a *pluginAPI) Routes() []chi.Route {
+	if mux := a.mux.Load(); mux != nil {
+		return mux.Routes()
+	}
+	return nil
+}
+
+func (a *pluginAPI) Middlewares() chi.Middlewares {
+	if mux := a.mux.Load(); mux != nil {
+		return mux.Middlewares()
+	}
+	return nil
+}
+
+func (a *pluginAPI) Match(rctx *chi.Context, method, path string) bool {
+	if mux := a.mux.Load(); mux != nil {
+		return mux.Match(rctx, method, path)
+	}
+	return false
+}
+
+func (a *pluginAPI) Find(rctx *chi.Context, method, path string) string {
+	if mux := a.mux.Load(); mux != nil {
+		return mux.Find(rctx, method, path)
+	}
+	return ""
+}
+
+var (
+	// ErrPluginNotFound is returned by RestartPlugin if the plugin does not exist.
+	ErrPluginNotFound = errors.New("plugin not found")
+	// ErrPluginNotRestartable is returned by RestartPlugin if the plugin was
+	// not loaded from config, e.g. a preset plugin.
+	ErrPluginNotRestartable = errors.New("plugin was not loaded from config")
+)
+
+// RestartPlugin closes and re-initializes the plugin of tag. Its args are
+// re-read from the config file. Plugins that referenced it during their init
+// (e.g. sequences and servers) hold the old instance, so they are restarted
+// as well. It returns the restarted tags in load order.
+// If a plugin fails to init, the plugins restarted so far are closed again and
+// all tags are re-initialized with their previous configs, so a bad config
+// won't take down the plugins that depend on it.
+func (m *Mosdns) RestartPlugin(tag string) ([]string, error) {
+	m.restartMu.Lock()
+	defer m.restartMu.Unlock()
+
+	m.pluginsMu.Lock()
+	_, ok := m.reg.confs[tag]
+	if !ok {
+		_, exist := m.plugins[tag]
+		m.pluginsMu.Unlock()
+		if !exist {
+			return nil, ErrPluginNotFound
+		}
+		return nil, ErrPluginNotRestartable
+	}
+	tags := m.reg.dependents(tag)
+	confs := make([]PluginConfig, 0, len(tags))
+	for _, t := range tags {
+		confs = append(confs, m.reg.confs[t])
+	}
+	m.pluginsMu.Unlock()
+	prevConfs := append([]PluginConfig(nil), confs...)
+
+	// Re-read args before closing anything, so a broken config won't leave
+	// the plugins closed.
+	if len(m.configPath) > 0 {
+		fileConfs, err := m.readPluginConfs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to re-read config, %w", err)
+		}
+		for i, c := range confs {
+			if fc, ok := fileConfs[c.Tag]; ok {
+				confs[i] = fc
+			}
+		}
+	}
+	typeInfos := make([]PluginTypeInfo, len(confs))
+	args := make([]any, len(confs))
+	for i, c := range confs {
+		var err error
+		if typeInfos[i], args[i], err = decodePluginArgs(c); err != nil {
+			return nil, fmt.Errorf("invalid args of plugin %s, %w", c.Tag, err)
+		}
+	}
+
+	m.closePlugins(tags)
+	for i, c := range confs {
+		if err := m.initPlugin(c, typeInfos[i], args[i]); err != nil {
+			err = fmt.Errorf("failed to restart plugin %s, %w", c.Tag, err)
+			m.logger.Error("plugin restart failed, restoring previous plugins", zap.Strings("tags", tags), zap.Error(err))
+			m.closePlugins(tags[:i])
+			if rollbackErr := m.initPlugins(prevConfs); rollbackErr != nil {
+				err = fmt.Errorf("%w, failed to restore previous plugins, %v", err, rollbackErr)
+			}
+			return nil, err
+		}
+	}
+	m.logger.Info("plugin restarted", zap.String("tag", tag), zap.Strings("restarted", tags))
+	return tags, nil
+}
+
+// closePlugins closes and removes the plugins of tags in reverse order.
+func (m *Mosdns) closePlugins(tags []string) {
+	for i := len(tags) - 1; i >= 0; i-- {
+		t := tags[i]
+		m.pluginsMu.Lock()
+		p := m.plugins[t]
+		delete(m.plugins, t)
+		m.unregisterCollectorsLocked(t)
+		m.pluginsMu.Unlock()
+
+		m.apiMu.Lock()
+		if a, ok := m.apis[t]; ok {
+			a.set(nil)
+		}
+		m.apiMu.Unlock()
+
+		if closer, _ := p.(io.Closer); closer != nil {
+			m.logger.Info("closing plugin for restart", zap.String("tag", t))
+			if err := closer.Close(); err != nil {
+				m.logger.Warn("failed to close plugin", zap.String("tag", t), zap.Error(err))
+			}
+		}
+	}
+}
+
+// initPlugins inits confs in order. A failed plugin does not stop the
+// others from loading, all errors are returned.
+func (m *Mosdns) initPlugins(confs []PluginConfig) error {
+	var errs []error
+	for _, c := range confs {
+		typeInfo, args, err := decodePluginArgs(c)
+		if err == nil {
+			err = m.initPlugin(c, typeInfo, args)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("plugin %s, %w", c.Tag, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// readPluginConfs reads plugin configs from the config file and its
+// includes, with global overrides applied.
+func (m *Mosdns) readPluginConfs() (map[string]PluginConfig, error) {
+	return readPluginConfs(m.configPath, m.globalOverrides)
+}
+
+// readPluginConfs reads plugin configs from the config file at path and
+// its includes. overrides can be nil.
+func readPluginConfs(configPath string, overrides *GlobalOverrides) (map[string]PluginConfig, error) {
+	confs := make(map[string]PluginConfig)
+	var read func(path string, depth int) error
+	read = func(path string, depth int) error {
+		if depth > 8 {
+			return errors.New("maximum include depth reached")
+		}
+		cfg, _, err := loadConfig(path)
+		if err != nil {
+			return err
+		}
+		for _, includePath := range cfg.Include {
+			if len(cfg.baseDir) > 0 && !filepath.IsAbs(includePath) {
+				includePath = filepath.Join(cfg.baseDir, includePath)
+			}
+			if err := read(includePath, depth+1); err != nil {
+				return err
+			}
+		}
+		for _, pc := range cfg.Plugins {
+			if overrides != nil {
+				ApplyOverrides(&pc, overrides)
+			}
+			if len(pc.Tag) > 0 {
+				confs[pc.Tag] = pc
+			}
+		}
+		return nil
+	}
+	return confs, read(configPath, 0)
+}
+
+// handleRestartPlugin handles POST /api/plugins/{tag}/restart.
+func (m *Mosdns) handleRestartPlugin(w http.ResponseWriter, r *http.Request) {
+	tag := chi.URLParam(r, "tag")
+	restarted, err := m.RestartPlugin(tag)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrPluginNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, ErrPluginNotRestartable):
+			status = http.StatusBadRequest
+		}
+		writeJSON(w, status, map[string]any{"error": err.Error(), "restarted": restarted})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "restarted", "restarted": restarted})
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestRestartPlugin_Dependents(t *testing.T) {
+	path := writeTestConfig(t, t.TempDir(),
+		"upstream metric=upstream_total",
+		"other",
+		"cache upstream",
+		"seq cache other",
+		"server seq",
+		"unrelated other",
+	)
+	m := newTestServer(t, path)
+	old := map[string]*testPlugin{}
+	for _, tag := range []string{"upstream", "other", "cache", "seq", "server", "unrelated"} {
+		old[tag] = testPluginOf(t, m, tag)
+	}
+
+	restarted, err := m.RestartPlugin("upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"upstream", "cache", "seq", "server"}; !slices.Equal(restarted, want) {
+		t.Fatalf("want restarted %v, got %v", want, restarted)
+	}
+	for _, tag := range restarted {
+		if !old[tag].closed.Load() {
+			t.Errorf("old %s is not closed", tag)
+		}
+		if testPluginOf(t, m, tag) == old[tag] {
+			t.Errorf("%s is not re-initialized", tag)
+		}
+	}
+	for _, tag := range []string{"other", "unrelated"} {
+		if old[tag].closed.Load() || testPluginOf(t, m, tag) != old[tag] {
+			t.Errorf("%s should not be restarted", tag)
+		}
+	}
+	// Dependents refer to the new instances.
+	if testPluginOf(t, m, "cache").deps[0] != testPluginOf(t, m, "upstream") {
+		t.Error("cache refers to the old upstream")
+	}
+	if testPluginOf(t, m, "seq").deps[1] != old["other"] {
+		t.Error("seq does not refer to other")
+	}
+	// The old collector was unregistered, otherwise the new one could not
+	// be registered.
+	if n := metricCount(t, m, "mosdns_upstream_total"); n != 1 {
+		t.Fatalf("want 1 upstream_total metric, got %d", n)
+	}
+
+	if _, err := m.RestartPlugin("not_exist"); !errors.Is(err, ErrPluginNotFound) {
+		t.Fatalf("want ErrPluginNotFound, got %v", err)
+	}
+}
+
+func TestRestartPlugin_Rollback(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestConfig(t, dir,
+		"upstream metric=upstream_total",
+		"cache upstream metric=cache_total",
+		"seq cache",
+	)
+	m := newTestServer(t, path)
+	old := testPluginOf(t, m, "upstream")
+
+	// The new config of a dependent fails to init.
+	writeTestConfig(t, dir,
+		"upstream metric=upstream_total",
+		"cache upstream metric=cache_total fail",
+		"seq cache",
+	)
+	restarted, err := m.RestartPlugin("upstream")
+	if err == nil {
+		t.Fatal("want error")
+	}
+	if len(restarted) != 0 {
+		t.Fatalf("want no restarted plugins, got %v", restarted)
+	}
+	if !old.closed.Load() {
+		t.Fatal("old upstream is not closed")
+	}
+	// All plugins are restored from the previous configs.
+	upstream, cache, seq := testPluginOf(t, m, "upstream"), testPluginOf(t, m, "cache"), testPluginOf(t, m, "seq")
+	if cache.deps[0] != upstream || seq.deps[0] != cache {
+		t.Fatal("restored plugins do not refer to each other")
+	}
+	for _, name := range []string{"mosdns_upstream_total", "mosdns_cache_total"} {
+		if n := metricCount(t, m, name); n != 1 {
+			t.Fatalf("want 1 %s metric, got %d", name, n)
+		}
+	}
+
+	// Previous configs are still used by the next restart.
+	writeTestConfig(t, dir,
+		"upstream metric=upstream_total",
+		"cache upstream metric=cache_total",
+		"seq cache",
+	)
+	if _, err := m.RestartPlugin("cache"); err != nil {
+		t.Fatal(err)
+	}
+	if testPluginOf(t, m, "seq").deps[0] != testPluginOf(t, m, "cache") {
+		t.Fatal("seq refers to the old cache")
+	}
+}
+
+func TestRestartPlugin_InvalidConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestConfig(t, dir, "upstream", "cache upstream")
+	m := newTestServer(t, path)
+	old := testPluginOf(t, m, "cache")
+
+	if err := os.WriteFile(path, []byte("plugins: ["), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.RestartPlugin("upstream"); err == nil {
+		t.Fatal("want error")
+	}
+	// Nothing was closed.
+	if old.closed.Load() || testPluginOf(t, m, "cache") != old {
+		t.Fatal("plugins are closed by a broken config")
+	}
+}
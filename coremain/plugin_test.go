@@ -0,0 +1,147 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const testPluginType = "coremain_test"
+
+type testPluginArgs struct {
+	Deps   []string `yaml:"deps"`   // Tags of the plugins it refers to.
+	Metric string   `yaml:"metric"` // Name of a counter it registers.
+	Fail   bool     `yaml:"fail"`   // Init fails.
+}
+
+type testPlugin struct {
+	deps   []*testPlugin
+	closed atomic.Bool
+}
+
+func (p *testPlugin) Close() error {
+	p.closed.Store(true)
+	return nil
+}
+
+func init() {
+	RegNewPluginFunc(testPluginType, func(bp *BP, args any) (any, error) {
+		a := args.(*testPluginArgs)
+		if a.Fail {
+			return nil, errors.New("init failed")
+		}
+		p := new(testPlugin)
+		for _, tag := range a.Deps {
+			dep, _ := bp.M().GetPlugin(tag).(*testPlugin)
+			if dep == nil {
+				return nil, fmt.Errorf("cannot find plugin %s", tag)
+			}
+			p.deps = append(p.deps, dep)
+		}
+		if len(a.Metric) > 0 {
+			c := prometheus.NewCounter(prometheus.CounterOpts{Name: a.Metric})
+			if err := bp.M().GetMetricsReg().Register(c); err != nil {
+				return nil, err
+			}
+		}
+		return p, nil
+	}, func() any { return new(testPluginArgs) })
+}
+
+// writeTestConfig writes a config with plugins in dir and returns its path.
+// Each plugin is "tag [dep...]" with optional "metric=name" and "fail" fields.
+func writeTestConfig(t *testing.T, dir string, plugins ...string) string {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString("log:\n  level: error\nplugins:\n")
+	for _, p := range plugins {
+		fs := strings.Fields(p)
+		fmt.Fprintf(&b, "  - tag: %s\n    type: %s\n    args:\n      deps: [", fs[0], testPluginType)
+		var deps []string
+		var extra string
+		for _, f := range fs[1:] {
+			switch {
+			case f == "fail":
+				extra += "      fail: true\n"
+			case strings.HasPrefix(f, "metric="):
+				extra += "      metric: " + strings.TrimPrefix(f, "metric=") + "\n"
+			default:
+				deps = append(deps, f)
+			}
+		}
+		b.WriteString(strings.Join(deps, ", ") + "]\n" + extra)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestServer loads the config at path in check mode, which has no global
+// side effects.
+func newTestServer(t *testing.T, path string) *Mosdns {
+	t.Helper()
+	cfg, fileUsed, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMosdns(cfg, fileUsed, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		m.sc.SendCloseSignal(nil)
+		_ = m.sc.WaitClosed()
+	})
+	return m
+}
+
+func testPluginOf(t *testing.T, m *Mosdns, tag string) *testPlugin {
+	t.Helper()
+	p, _ := m.GetPlugin(tag).(*testPlugin)
+	if p == nil {
+		t.Fatalf("plugin %s is not loaded", tag)
+	}
+	return p
+}
+
+func metricCount(t *testing.T, m *Mosdns, name string) int {
+	t.Helper()
+	mfs, err := m.metricsReg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			n++
+		}
+	}
+	return n
+}
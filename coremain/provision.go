@@ -0,0 +1,191 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/provision"
+	"github.com/go-viper/mapstructure/v2"
+)
+
+// serverArgs has the fields of server plugin args that are needed to
+// provision clients.
+type serverArgs struct {
+	Listen  string `yaml:"listen"`
+	Cert    string `yaml:"cert"`
+	Key     string `yaml:"key"`
+	Entries []struct {
+		Path string `yaml:"path"`
+	} `yaml:"entries"`
+}
+
+// ProvisionListeners reads the config file at path and returns its
+// encrypted DNS listeners. Relative cert paths are resolved against the
+// config dir, as mosdns does when it starts without a working dir.
+func ProvisionListeners(path string) ([]provision.Listener, error) {
+	confs, err := readPluginConfs(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	ls, err := provisionListeners(confs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ls {
+		if !filepath.IsAbs(ls[i].Cert) {
+			ls[i].Cert = filepath.Join(filepath.Dir(path), ls[i].Cert)
+		}
+	}
+	return ls, nil
+}
+
+// provisionListeners returns DoH, DoT and DoQ listeners in confs, sorted
+// by tag. Plain UDP/TCP/HTTP listeners are ignored.
+func provisionListeners(confs map[string]PluginConfig) ([]provision.Listener, error) {
+	var ls []provision.Listener
+	for tag, c := range confs {
+		var proto string
+		switch c.Type {
+		case "http_server":
+			proto = provision.DoH
+		case "tcp_server":
+			proto = provision.DoT
+		case "quic_server":
+			proto = provision.DoQ
+		default:
+			continue
+		}
+
+		var args serverArgs
+		d, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			Result:           &args,
+			WeaklyTypedInput: true,
+			TagName:          "yaml",
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := d.Decode(c.Args); err != nil {
+			return nil, fmt.Errorf("invalid args of plugin %s, %w", tag, err)
+		}
+		if len(args.Cert) == 0 || len(args.Key) == 0 {
+			continue // not a TLS listener
+		}
+		_, portStr, err := net.SplitHostPort(args.Listen)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address of plugin %s, %w", tag, err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen port of plugin %s, %w", tag, err)
+		}
+
+		l := provision.Listener{Tag: tag, Proto: proto, Port: port, Cert: args.Cert}
+		if proto != provision.DoH {
+			ls = append(ls, l)
+			continue
+		}
+		for _, e := range args.Entries {
+			l.Path = e.Path
+			ls = append(ls, l)
+		}
+	}
+	sort.SliceStable(ls, func(i, j int) bool { return ls[i].Tag < ls[j].Tag })
+	return ls, nil
+}
+
+// handleProvision handles GET /api/provision. Query params: host (default
+// is the host of the request), addr, name and format, which is one of
+// "json" (default), "stamps", "mobileconfig" and "android".
+func (m *Mosdns) handleProvision(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	o := provision.Options{Host: q.Get("host"), Addr: q.Get("addr"), Name: q.Get("name")}
+	if len(o.Host) == 0 {
+		o.Host = r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			o.Host = h
+		}
+	}
+
+	m.pluginsMu.Lock()
+	confs := make(map[string]PluginConfig, len(m.reg.confs))
+	for tag, c := range m.reg.confs {
+		confs[tag] = c
+	}
+	m.pluginsMu.Unlock()
+	ls, err := provisionListeners(confs)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	switch format := q.Get("format"); format {
+	case "", "json":
+		type listener struct {
+			provision.Listener
+			URL   string `json:"url"`
+			Stamp string `json:"stamp"`
+		}
+		res := struct {
+			Host      string     `json:"host"`
+			Listeners []listener `json:"listeners"`
+			Android   string     `json:"android"`
+		}{Host: o.Host, Listeners: []listener{}, Android: provision.AndroidInstructions(ls, o)}
+		for _, l := range ls {
+			s, err := provision.Stamp(l, o)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			res.Listeners = append(res.Listeners, listener{Listener: l, URL: l.URL(o.Host), Stamp: s})
+		}
+		writeJSON(w, http.StatusOK, res)
+	case "stamps":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, l := range ls {
+			s, err := provision.Stamp(l, o)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, "%s %s\n", l.URL(o.Host), s)
+		}
+	case "mobileconfig":
+		b, err := provision.MobileConfig(ls, o)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-apple-aspen-config")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+o.Host+`.mobileconfig"`)
+		w.Write(b)
+	case "android":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, provision.AndroidInstructions(ls, o))
+	default:
+		http.Error(w, "unknown format "+format, http.StatusBadRequest)
+	}
+}
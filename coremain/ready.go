@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"net/http"
+	"sort"
+)
+
+// HealthReporter is implemented by plugins that depend on something that
+// can go down at runtime, e.g. upstreams or downloaded rules.
+type HealthReporter interface {
+	// Healthy returns a non-nil error if the plugin cannot work properly.
+	Healthy() error
+}
+
+type ReadinessConfig struct {
+	// Plugins are the tags of the plugins that must be healthy. Empty
+	// means all plugins that implement HealthReporter.
+	Plugins []string `yaml:"plugins"`
+}
+
+// Ready reports whether all plugins were loaded and all checked plugins
+// are healthy. The returned map contains the errors of unhealthy plugins.
+func (m *Mosdns) Ready() (bool, map[string]string) {
+	if !m.loaded.Load() {
+		return false, map[string]string{"mosdns": "plugins are loading"}
+	}
+
+	m.pluginsMu.Lock()
+	tags := m.apiConfig.Readiness.Plugins
+	if len(tags) == 0 {
+		for tag, p := range m.plugins {
+			if _, ok := p.(HealthReporter); ok {
+				tags = append(tags, tag)
+			}
+		}
+		sort.Strings(tags)
+	}
+	reporters := make(map[string]HealthReporter, len(tags))
+	for _, tag := range tags {
+		hr, _ := m.plugins[tag].(HealthReporter)
+		reporters[tag] = hr
+	}
+	m.pluginsMu.Unlock()
+
+	failed := make(map[string]string)
+	for tag, hr := range reporters {
+		if hr == nil {
+			failed[tag] = "plugin not found or cannot report health"
+			continue
+		}
+		if err := hr.Healthy(); err != nil {
+			failed[tag] = err.Error()
+		}
+	}
+	return len(failed) == 0, failed
+}
+
+// handleReadyz replies 200 if m is ready, otherwise 503. It can be used by
+// keepalived or anycast health checks to move traffic to a healthy peer.
+func (m *Mosdns) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ready, failed := m.Ready()
+	if !ready {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"ready": false, "failed": failed})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ready": true})
+}
@@ -0,0 +1,46 @@
+package coremain
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout limits how long a graceful shutdown waits for in-flight
+// api requests to finish.
+const shutdownTimeout = time.Second * 5
+
+// startupWorkDir is the working directory when mosdns started. Relative
+// paths in os.Args are resolved against it when mosdns re-executes itself.
+var startupWorkDir, _ = os.Getwd()
+
+// checkReload loads the config at path in check mode, like "mosdns config
+// check", so that invalid plugin args are reported before the running plugins
+// are closed. It must be called from the working directory of the running
+// instance, so relative paths in the config resolve the same way.
+func checkReload(path string) error {
+	cfg, fileUsed, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	m, err := newMosdns(cfg, fileUsed, true)
+	if err != nil {
+		return err
+	}
+	m.sc.SendCloseSignal(nil)
+	return m.sc.WaitClosed()
+}
+
+// reexec replaces the current process with a new mosdns process that has
+// the same arguments and pid. It only returns on error.
+func reexec() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable, %w", err)
+	}
+	if err := os.Chdir(startupWorkDir); err != nil {
+		return fmt.Errorf("failed to restore working directory, %w", err)
+	}
+	return syscall.Exec(exe, append([]string{exe}, os.Args[1:]...), os.Environ())
+}
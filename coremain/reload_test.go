@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckReload(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestConfig(t, dir, "upstream metric=upstream_total", "seq upstream")
+	// The serving instance.
+	m := newTestServer(t, path)
+
+	if err := checkReload(path); err != nil {
+		t.Fatalf("valid config is rejected, %v", err)
+	}
+
+	bad := map[string]string{
+		"yaml":        "plugins: [",
+		"unknown tag": "plugins:\n  - tag: seq\n    type: " + testPluginType + "\n    args: {deps: [not_exist]}\n",
+		"plugin args": "plugins:\n  - tag: seq\n    type: " + testPluginType + "\n    args: {fail: true}\n",
+		"args type":   "plugins:\n  - tag: seq\n    type: " + testPluginType + "\n    args: {deps: 1, unknown: 2}\n",
+		"plugin type": "plugins:\n  - tag: seq\n    type: not_exist\n",
+	}
+	for name, cfg := range bad {
+		p := filepath.Join(dir, "bad.yaml")
+		if err := os.WriteFile(p, []byte(cfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkReload(p); err == nil {
+			t.Errorf("%s: invalid config is accepted", name)
+		}
+	}
+
+	// The check must not affect the serving instance, e.g. its metrics.
+	if n := metricCount(t, m, "mosdns_upstream_total"); n != 1 {
+		t.Fatalf("want 1 upstream_total metric, got %d", n)
+	}
+	if testPluginOf(t, m, "seq").closed.Load() {
+		t.Fatal("serving plugin is closed")
+	}
+}
@@ -31,17 +31,23 @@ import (
     "os/signal"
     "path/filepath"
     "runtime"
+    "sync/atomic"
     "syscall"
 )
 
 // <<< ADDED: Global variable to store the base directory for other packages to use.
 var MainConfigBaseDir string
 
+// MainConfigFile is the absolute path of the loaded main config file.
+// It is empty if mosdns was started without a config file.
+var MainConfigFile string
+
 type serverFlags struct {
 	c         string
 	dir       string
 	cpu       int
 	asService bool
+	check     bool
 }
 
 var rootCmd = &cobra.Command{
@@ -67,14 +73,33 @@ func init() {
 				return err
 			}
 
+			// SIGHUP restarts mosdns with the new config. The config is checked
+			// first (see checkReload), then plugins are closed and mosdns
+			// re-executes itself with the same pid. This is not a hot reload:
+			// listeners are closed and reopened, queries in flight are dropped.
+			var reload atomic.Bool
 			go func() {
 				c := make(chan os.Signal, 1)
-				signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-				sig := <-c
-				m.logger.Warn("signal received", zap.Stringer("signal", sig))
-				m.sc.SendCloseSignal(nil)
+				signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+				for sig := range c {
+					m.logger.Warn("signal received", zap.Stringer("signal", sig))
+					if sig == syscall.SIGHUP {
+						if err := checkReload(MainConfigFile); err != nil {
+							m.logger.Error("invalid config, reload aborted", zap.Error(err))
+							continue
+						}
+						m.logger.Info("config validated, reloading", zap.String("file", MainConfigFile))
+						reload.Store(true)
+					}
+					m.sc.SendCloseSignal(nil)
+					return
+				}
 			}()
-			return m.GetSafeClose().WaitClosed()
+			err = m.GetSafeClose().WaitClosed()
+			if reload.Load() {
+				return reexec()
+			}
+			return err
 		},
 		DisableFlagsInUseLine: true,
 		SilenceUsage:          true,
@@ -134,8 +159,10 @@ func NewServer(sf *serverFlags) (*Mosdns, error) {
 	if fileUsed != "" {
 		if absPath, err := filepath.Abs(fileUsed); err == nil {
 			MainConfigBaseDir = filepath.Dir(absPath)
+			MainConfigFile = absPath
 		} else {
 			MainConfigBaseDir = filepath.Dir(fileUsed)
+			MainConfigFile = fileUsed
 		}
 	} else if len(sf.dir) > 0 {
 		if absPath, err := filepath.Abs(sf.dir); err == nil {
@@ -167,7 +194,7 @@ func NewServer(sf *serverFlags) (*Mosdns, error) {
         mlog.L().Info("working directory changed", zap.String("path", cfgDir))
     }
 
-	return NewMosdns(cfg, fileUsed)
+	return newMosdns(cfg, fileUsed, sf.check)
 }
 
 // loadConfig load a config from a file. If filePath is empty, it will
@@ -198,6 +225,7 @@ func loadConfig(filePath string) (*Config, string, error) {
 	}
 	fileUsed := v.ConfigFileUsed()
 	cfg.baseDir = resolveBaseDir(fileUsed)
+	cfg.file = fileUsed
 	return cfg, fileUsed, nil
 }
 
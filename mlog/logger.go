@@ -36,6 +36,9 @@ type LogConfig struct {
 
 	// Production enables json output.
 	Production bool `yaml:"production"`
+
+	// RateLimit limits repeated warning and error messages.
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
 }
 
 var (
@@ -74,10 +77,13 @@ func NewLogger(lc LogConfig) (*zap.Logger, error) {
 	}
 
 	// All created loggers will now respect the global `Lvl`.
+	var enc zapcore.Encoder
 	if lc.Production {
-		return zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), out, Lvl)), nil
+		enc = zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	} else {
+		enc = zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
 	}
-	return zap.New(zapcore.NewCore(zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig()), out, Lvl)), nil
+	return zap.New(newRateLimitCore(zapcore.NewCore(enc, out, Lvl), lc.RateLimit)), nil
 }
 
 // L is a global logger.
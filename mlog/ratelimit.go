@@ -0,0 +1,181 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mlog
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	defaultRateLimitInterval = time.Minute
+	defaultRateLimitBurst    = 10
+)
+
+type RateLimitConfig struct {
+	// Disabled disables log rate limiting.
+	Disabled bool `yaml:"disabled"`
+
+	// Interval is the window in seconds. Default is 60.
+	Interval int `yaml:"interval"`
+
+	// Burst is the number of identical messages that can be written
+	// in one window. Default is 10.
+	Burst int `yaml:"burst"`
+}
+
+// rateLimitCore drops warning and error entries that repeat more than
+// burst times within interval. Entries are considered identical if they
+// have the same level, logger name and message. When a window that had
+// suppressed entries ends, a summary entry is written instead.
+type rateLimitCore struct {
+	zapcore.Core
+	rl *rateLimiter
+}
+
+func newRateLimitCore(core zapcore.Core, rc RateLimitConfig) zapcore.Core {
+	if rc.Disabled {
+		return core
+	}
+	interval := time.Duration(rc.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultRateLimitInterval
+	}
+	burst := rc.Burst
+	if burst <= 0 {
+		burst = defaultRateLimitBurst
+	}
+	return &rateLimitCore{
+		Core: core,
+		rl: &rateLimiter{
+			interval: interval,
+			burst:    burst,
+			m:        make(map[rateLimitKey]*rateLimitEntry),
+		},
+	}
+}
+
+func (c *rateLimitCore) With(fields []zapcore.Field) zapcore.Core {
+	return &rateLimitCore{Core: c.Core.With(fields), rl: c.rl}
+}
+
+func (c *rateLimitCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *rateLimitCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	if ent.Level >= zapcore.WarnLevel && !c.rl.allow(ent, c.Core) {
+		return nil
+	}
+	return c.Core.Write(ent, fields)
+}
+
+type rateLimitKey struct {
+	level   zapcore.Level
+	logger  string
+	message string
+}
+
+type rateLimitEntry struct {
+	start      time.Time
+	n          int
+	suppressed int
+	ent        zapcore.Entry
+	core       zapcore.Core // core that receives the summary
+}
+
+type rateLimiter struct {
+	interval time.Duration
+	burst    int
+
+	mu        sync.Mutex
+	m         map[rateLimitKey]*rateLimitEntry
+	lastSweep time.Time
+}
+
+func (r *rateLimiter) allow(ent zapcore.Entry, core zapcore.Core) bool {
+	k := rateLimitKey{level: ent.Level, logger: ent.LoggerName, message: ent.Message}
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sweepLocked(now)
+
+	e := r.m[k]
+	if e == nil {
+		r.m[k] = &rateLimitEntry{start: now, n: 1}
+		return true
+	}
+	if e.suppressed == 0 && now.Sub(e.start) >= r.interval {
+		e.start = now
+		e.n = 1
+		return true
+	}
+	if e.n < r.burst {
+		e.n++
+		return true
+	}
+	if e.suppressed == 0 {
+		// First suppressed entry in this window. Schedule a summary at
+		// the end of the window. The entry will be removed by then.
+		time.AfterFunc(r.interval-now.Sub(e.start), func() { r.flush(k) })
+	}
+	e.suppressed++
+	e.ent = ent
+	e.core = core
+	return false
+}
+
+// sweepLocked removes expired entries that have nothing to report,
+// so messages that never repeat don't pile up in the map.
+func (r *rateLimiter) sweepLocked(now time.Time) {
+	if now.Sub(r.lastSweep) < r.interval {
+		return
+	}
+	r.lastSweep = now
+	for k, e := range r.m {
+		if e.suppressed == 0 && now.Sub(e.start) >= r.interval {
+			delete(r.m, k)
+		}
+	}
+}
+
+func (r *rateLimiter) flush(k rateLimitKey) {
+	r.mu.Lock()
+	e := r.m[k]
+	delete(r.m, k)
+	r.mu.Unlock()
+	if e == nil || e.suppressed == 0 {
+		return
+	}
+
+	ent := e.ent
+	ent.Time = time.Now()
+	ent.Message = fmt.Sprintf("suppressed %d similar messages in the last %s: %s", e.suppressed, r.interval, k.message)
+	ent.Caller = zapcore.EntryCaller{}
+	ent.Stack = ""
+	_ = e.core.Write(ent, nil)
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mlog
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func Test_rateLimitCore(t *testing.T) {
+	obs, logs := observer.New(zap.DebugLevel)
+	core := newRateLimitCore(obs, RateLimitConfig{Burst: 3})
+	core.(*rateLimitCore).rl.interval = 100 * time.Millisecond
+	lg := zap.New(core)
+
+	for i := 0; i < 10; i++ {
+		lg.Warn("upstream failed", zap.Int("i", i))
+		lg.Info("info is not limited")
+	}
+	lg.Warn("another message")
+
+	if n := logs.FilterMessage("upstream failed").Len(); n != 3 {
+		t.Fatalf("want 3 limited messages, got %d", n)
+	}
+	if n := logs.FilterMessage("info is not limited").Len(); n != 10 {
+		t.Fatalf("want 10 info messages, got %d", n)
+	}
+	if n := logs.FilterMessage("another message").Len(); n != 1 {
+		t.Fatalf("want 1 unrelated message, got %d", n)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	summary := logs.FilterMessageSnippet("suppressed 7 similar messages").All()
+	if len(summary) != 1 || !strings.HasSuffix(summary[0].Message, "upstream failed") {
+		t.Fatalf("unexpected summary: %v", summary)
+	}
+
+	// A new window starts after the summary.
+	lg.Warn("upstream failed")
+	if n := logs.FilterMessage("upstream failed").Len(); n != 4 {
+		t.Fatalf("want 4 messages after window reset, got %d", n)
+	}
+}
+
+func Test_rateLimitCore_disabled(t *testing.T) {
+	obs, logs := observer.New(zap.DebugLevel)
+	lg := zap.New(newRateLimitCore(obs, RateLimitConfig{Disabled: true}))
+	for i := 0; i < 100; i++ {
+		lg.Warn("msg")
+	}
+	if logs.Len() != 100 {
+		t.Fatalf("want 100 messages, got %d", logs.Len())
+	}
+}
@@ -158,3 +158,29 @@ func FakeSOA(name string) *dns.SOA {
 		Minttl:  86400,
 	}
 }
+
+// GetMaxAddrTTL returns the maximum ttl of A/AAAA records in m.Answer.
+// If m has no A/AAAA record, it returns 0.
+func GetMaxAddrTTL(m *dns.Msg) uint32 {
+	var maxTTL uint32
+	for _, rr := range m.Answer {
+		hdr := rr.Header()
+		if hdr.Rrtype != dns.TypeA && hdr.Rrtype != dns.TypeAAAA {
+			continue
+		}
+		if hdr.Ttl > maxTTL {
+			maxTTL = hdr.Ttl
+		}
+	}
+	return maxTTL
+}
+
+// SetAddrTTL updates the ttl of A/AAAA records in m.Answer to ttl.
+func SetAddrTTL(m *dns.Msg, ttl uint32) {
+	for _, rr := range m.Answer {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeA || hdr.Rrtype == dns.TypeAAAA {
+			hdr.Ttl = ttl
+		}
+	}
+}
@@ -123,3 +123,60 @@ func prevLabel(s string, offset int) (string, int) {
 		return label, n
 	}
 }
+
+// ParsePTRPrefix returns the ip prefix that a reverse name contains.
+// Unlike ParsePTRQName, it also accepts the names of reverse zones.
+// e.g. "168.192.in-addr.arpa." is 192.168.0.0/16.
+func ParsePTRPrefix(fqdn string) (netip.Prefix, error) {
+	name := "." + strings.ToLower(fqdn)
+	var (
+		s     string
+		is4   bool
+		limit int
+	)
+	switch {
+	case strings.HasSuffix(name, IP4arpa):
+		s, is4, limit = name[:len(name)-len(IP4arpa)], true, 4
+	case strings.HasSuffix(name, IP6arpa):
+		s, limit = name[:len(name)-len(IP6arpa)], 32
+	default:
+		return netip.Prefix{}, errNotPTRDomain
+	}
+	s = strings.TrimPrefix(s, ".")
+	var labels []string
+	if len(s) > 0 {
+		labels = strings.Split(s, ".")
+	}
+	if len(labels) > limit {
+		return netip.Prefix{}, fmt.Errorf("too many labels, %d", len(labels))
+	}
+
+	var buf [16]byte
+	for i, label := range labels {
+		pos := len(labels) - 1 - i // labels are reversed
+		if is4 {
+			n, err := strconv.ParseUint(label, 10, 8)
+			if err != nil || (len(label) > 1 && label[0] == '0') {
+				return netip.Prefix{}, fmt.Errorf("invalid label %q", label)
+			}
+			buf[pos] = byte(n)
+			continue
+		}
+		if len(label) != 1 {
+			return netip.Prefix{}, fmt.Errorf("invalid label %q", label)
+		}
+		n, ok := hex2byte(label[0])
+		if !ok || n > 0xf {
+			return netip.Prefix{}, fmt.Errorf("invalid label %q", label)
+		}
+		if pos%2 == 0 {
+			buf[pos/2] |= n << 4
+		} else {
+			buf[pos/2] |= n
+		}
+	}
+	if is4 {
+		return netip.PrefixFrom(netip.AddrFrom4([4]byte(buf[:4])), len(labels)*8), nil
+	}
+	return netip.PrefixFrom(netip.AddrFrom16(buf), len(labels)*4), nil
+}
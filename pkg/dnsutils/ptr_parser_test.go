@@ -79,3 +79,34 @@ func Test_reverse6(t *testing.T) {
 		})
 	}
 }
+
+func Test_ParsePTRPrefix(t *testing.T) {
+	tests := []struct {
+		fqdn    string
+		want    string
+		wantErr bool
+	}{
+		{"1.1.168.192.in-addr.arpa.", "192.168.1.1/32", false},
+		{"168.192.IN-ADDR.ARPA.", "192.168.0.0/16", false},
+		{"10.in-addr.arpa.", "10.0.0.0/8", false},
+		{"in-addr.arpa.", "0.0.0.0/0", false},
+		{"d.f.ip6.arpa.", "fd00::/8", false},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.", "::1/128", false},
+		{"x.1.1.168.192.in-addr.arpa.", "", true},
+		{"256.in-addr.arpa.", "", true},
+		{"01.in-addr.arpa.", "", true},
+		{"g.ip6.arpa.", "", true},
+		{"example.com.", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fqdn, func(t *testing.T) {
+			got, err := ParsePTRPrefix(tt.fqdn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePTRPrefix() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != netip.MustParsePrefix(tt.want) {
+				t.Fatalf("ParsePTRPrefix() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -31,6 +31,7 @@ import (
 
 type Hosts struct {
 	matcher domain.Matcher[*IPs]
+	ptr     map[netip.Addr][]string // ip -> fqdns, can be nil
 }
 
 // NewHosts creates a hosts using m.
@@ -40,6 +41,15 @@ func NewHosts(m domain.Matcher[*IPs]) *Hosts {
 	}
 }
 
+// NewHostsWithPTR creates a hosts using m that also answers PTR queries
+// of the ips in ptr.
+func NewHostsWithPTR(m domain.Matcher[*IPs], ptr map[netip.Addr][]string) *Hosts {
+	return &Hosts{
+		matcher: m,
+		ptr:     ptr,
+	}
+}
+
 func (h *Hosts) Lookup(fqdn string) (ipv4, ipv6 []netip.Addr) {
 	ips, ok := h.matcher.Match(fqdn)
 	if !ok {
@@ -55,7 +65,13 @@ func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
 	q := m.Question[0]
 	typ := q.Qtype
 	fqdn := q.Name
-	if q.Qclass != dns.ClassINET || (typ != dns.TypeA && typ != dns.TypeAAAA) {
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+	if typ == dns.TypePTR {
+		return h.lookupPTR(m)
+	}
+	if typ != dns.TypeA && typ != dns.TypeAAAA {
 		return nil
 	}
 
@@ -102,6 +118,36 @@ func (h *Hosts) LookupMsg(m *dns.Msg) *dns.Msg {
 	return r
 }
 
+func (h *Hosts) lookupPTR(m *dns.Msg) *dns.Msg {
+	if len(h.ptr) == 0 {
+		return nil
+	}
+	fqdn := m.Question[0].Name
+	addr, err := dnsutils.ParsePTRQName(fqdn)
+	if err != nil {
+		return nil
+	}
+	names := h.ptr[addr]
+	if len(names) == 0 {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(m)
+	for _, name := range names {
+		r.Answer = append(r.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{
+				Name:   fqdn,
+				Rrtype: dns.TypePTR,
+				Class:  dns.ClassINET,
+				Ttl:    10,
+			},
+			Ptr: name,
+		})
+	}
+	return r
+}
+
 type IPs struct {
 	IPv4 []netip.Addr
 	IPv6 []netip.Addr
@@ -0,0 +1,238 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Matcher backends that plugins can select for their domain rules.
+const (
+	BackendMap     = "map"     // map based matchers, fast to build and update
+	BackendCompact = "compact" // compactTrie, see MixMatcher.Compact
+)
+
+// ParseBackend validates the backend name s, an empty s means BackendMap.
+// It reports whether s is BackendCompact.
+func ParseBackend(s string) (compact bool, err error) {
+	switch s {
+	case "", BackendMap:
+		return false, nil
+	case BackendCompact:
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid matcher backend %q, must be %s or %s", s, BackendMap, BackendCompact)
+}
+
+// compactTrie is a read-only trie over reversed domain labels, stored in
+// a few flat arrays instead of a map per node. Nodes are laid out in
+// breadth-first order, so the children of a node are contiguous and sorted
+// by label, and lookups use binary search. Identical labels share one copy
+// in labels.
+// Compared with SubDomainMatcher and FullMatcher it uses several times less
+// memory for large rule sets, at the cost of a slower build.
+type compactTrie[T any] struct {
+	labels     string   // all distinct labels, concatenated
+	labelOff   []uint32 // label of node i is labels[labelOff[i]:labelOff[i]+labelLen[i]]
+	labelLen   []uint16
+	childStart []uint32 // children of node i are nodes childStart[i]:childStart[i+1]
+	sub        []uint32 // 1-based index in values of the domain rule ending at node i, 0 for none
+	full       []uint32 // same as sub, for full rules
+	values     []T
+	n          int // number of rules
+}
+
+// dedupableType reports whether values of T can be compared without panicking.
+func dedupableType[T any]() bool {
+	switch reflect.TypeFor[T]().Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.String, reflect.Pointer, reflect.Chan:
+		return true
+	}
+	return false
+}
+
+// buildCompactTrie builds a compactTrie from the domain rules in subRoot and the
+// full rules in fullRoot. Both trees are left unchanged.
+func buildCompactTrie[T any](subRoot, fullRoot *labelNode[T]) *compactTrie[T] {
+	type pair struct {
+		label     string
+		sub, full *labelNode[T]
+	}
+
+	t := &compactTrie[T]{}
+	var labels strings.Builder
+	labelOffs := make(map[string]uint32)
+	// Rules often share a value (e.g. the list they come from), store such
+	// values once when T can be safely used as a map key.
+	var valueIdx map[any]uint32
+	if dedupableType[T]() {
+		valueIdx = make(map[any]uint32)
+	}
+	addValue := func(n *labelNode[T]) uint32 {
+		if n == nil || !n.hasV {
+			return 0
+		}
+		t.n++
+		if valueIdx != nil {
+			if idx, ok := valueIdx[n.v]; ok {
+				return idx
+			}
+		}
+		t.values = append(t.values, n.v)
+		idx := uint32(len(t.values))
+		if valueIdx != nil {
+			valueIdx[n.v] = idx
+		}
+		return idx
+	}
+
+	queue := []pair{{sub: subRoot, full: fullRoot}}
+	for i := 0; i < len(queue); i++ {
+		p := queue[i]
+		off, ok := labelOffs[p.label]
+		if !ok {
+			off = uint32(labels.Len())
+			labels.WriteString(p.label)
+			labelOffs[p.label] = off
+		}
+		t.labelOff = append(t.labelOff, off)
+		t.labelLen = append(t.labelLen, uint16(min(len(p.label), math.MaxUint16)))
+		t.sub = append(t.sub, addValue(p.sub))
+		t.full = append(t.full, addValue(p.full))
+		t.childStart = append(t.childStart, uint32(len(queue)))
+
+		children := make(map[string]*pair)
+		for _, side := range [...]struct {
+			n    *labelNode[T]
+			full bool
+		}{{p.sub, false}, {p.full, true}} {
+			if side.n == nil {
+				continue
+			}
+			for label, child := range side.n.children {
+				c := children[label]
+				if c == nil {
+					c = &pair{label: label}
+					children[label] = c
+				}
+				if side.full {
+					c.full = child
+				} else {
+					c.sub = child
+				}
+			}
+		}
+		keys := make([]string, 0, len(children))
+		for label := range children {
+			keys = append(keys, label)
+		}
+		sort.Strings(keys)
+		for _, label := range keys {
+			queue = append(queue, *children[label])
+		}
+		queue[i] = pair{} // release the source nodes as early as possible
+	}
+	t.childStart = append(t.childStart, uint32(len(queue)))
+	t.labels = labels.String()
+	return t
+}
+
+func (t *compactTrie[T]) label(i uint32) string {
+	off := t.labelOff[i]
+	return t.labels[off : off+uint32(t.labelLen[i])]
+}
+
+// child returns the child of node i with label.
+func (t *compactTrie[T]) child(i uint32, label string) (uint32, bool) {
+	lo, hi := t.childStart[i], t.childStart[i+1]
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		switch l := t.label(mid); {
+		case l == label:
+			return mid, true
+		case l < label:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return 0, false
+}
+
+// Match returns the value of the full rule that equals s, or else the value
+// of the longest domain rule that s is a sub domain of.
+func (t *compactTrie[T]) Match(s string) (v T, ok bool) {
+	s = NormalizeDomain(s)
+	ds := NewReverseDomainScanner(s)
+	node := uint32(0)
+	if idx := t.sub[0]; idx != 0 {
+		v, ok = t.values[idx-1], true
+	}
+	for ds.Scan() {
+		next, found := t.child(node, ds.NextLabel())
+		if !found {
+			return v, ok
+		}
+		node = next
+		if idx := t.sub[node]; idx != 0 {
+			v, ok = t.values[idx-1], true
+		}
+	}
+	if idx := t.full[node]; idx != 0 {
+		return t.values[idx-1], true
+	}
+	return v, ok
+}
+
+func (t *compactTrie[T]) Len() int {
+	return t.n
+}
+
+// appendTo adds the rules of t back into the trees subRoot and fullRoot.
+// Rules that already exist in the trees are newer and are kept.
+func (t *compactTrie[T]) appendTo(subRoot, fullRoot *labelNode[T]) {
+	var walk func(i uint32, sub, full *labelNode[T])
+	walk = func(i uint32, sub, full *labelNode[T]) {
+		if idx := t.sub[i]; idx != 0 && !sub.hasValue() {
+			sub.storeValue(t.values[idx-1])
+		}
+		if idx := t.full[i]; idx != 0 && !full.hasValue() {
+			full.storeValue(t.values[idx-1])
+		}
+		for c := t.childStart[i]; c < t.childStart[i+1]; c++ {
+			label := t.label(c)
+			subChild, fullChild := sub.getChild(label), full.getChild(label)
+			if subChild == nil {
+				subChild = sub.newChild(label)
+			}
+			if fullChild == nil {
+				fullChild = full.newChild(label)
+			}
+			walk(c, subChild, fullChild)
+		}
+	}
+	walk(0, subRoot, fullRoot)
+}
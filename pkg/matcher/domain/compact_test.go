@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMixMatcher_Compact(t *testing.T) {
+	m := NewMixMatcher[string]()
+	m.SetDefaultMatcher(MatcherDomain)
+	for _, r := range []string{
+		"cn", "a.b.com", "full:b.com", "full:x.a.b.com", "domain:c.a.b.com",
+		"keyword:kw", "regexp:^re\\.", "full:", "domain:UPPER.org.",
+	} {
+		if err := m.Add(r, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Compact()
+	if m.compact == nil || m.full.Len() != 0 || m.domain.Len() != 0 {
+		t.Fatal("full and domain rules are not compacted")
+	}
+	assertInt(t, 9, m.Len())
+
+	assert := assertFunc[string](t, m)
+	assert("cn", true, "cn")
+	assert("a.cn.", true, "cn")
+	assert("com", false, "")
+	assert("b.com", true, "full:b.com")
+	assert("a.b.com", true, "a.b.com")
+	assert("z.a.b.com", true, "a.b.com")
+	assert("x.a.b.com", true, "full:x.a.b.com")
+	assert("y.x.a.b.com", true, "a.b.com")
+	assert("c.a.b.com.", true, "domain:c.a.b.com")
+	assert("d.c.a.b.com", true, "domain:c.a.b.com")
+	assert("a.upper.ORG", true, "domain:UPPER.org.")
+	assert("kw.net", true, "keyword:kw")
+	assert("re.net", true, "regexp:^re\\.")
+	assert("", true, "full:")
+
+	// rules added after Compact are matched, and merged by the next Compact
+	m.Add("full:b.com", "new")
+	m.Add("example.net", "example.net")
+	assert("b.com", true, "full:b.com")
+	assert("a.example.net", true, "example.net")
+	m.Compact()
+	assertInt(t, 10, m.Len())
+	assert("b.com", true, "new")
+	assert("a.example.net", true, "example.net")
+	assert("x.a.b.com", true, "full:x.a.b.com")
+}
+
+func TestCompactTrie_Random(t *testing.T) {
+	sub, full := NewSubDomainMatcher[int](), NewFullMatcher[int]()
+	m := NewMixMatcher[int]()
+	for i := 0; i < 2000; i++ {
+		d := fmt.Sprintf("s%d.d%d.t%d", i%7, i%101, i%13)
+		if i%3 == 0 {
+			full.Add(d, i)
+			m.Add("full:"+d, i)
+		} else {
+			sub.Add(d, i)
+			m.Add("domain:"+d, i)
+		}
+	}
+	m.Compact()
+	for i := 0; i < 3000; i++ {
+		q := fmt.Sprintf("x.s%d.d%d.t%d", i%9, i%103, i%13)
+		for _, q := range []string{q, q[2:]} {
+			want, wantOk := full.Match(q)
+			if !wantOk {
+				want, wantOk = sub.Match(q)
+			}
+			got, ok := m.Match(q)
+			if got != want || ok != wantOk {
+				t.Fatalf("%s: want %d %v, got %d %v", q, want, wantOk, got, ok)
+			}
+		}
+	}
+}
+
+func BenchmarkMixMatcher_Compact(b *testing.B) {
+	m := NewMixMatcher[struct{}]()
+	for i := 0; i < 100000; i++ {
+		m.Add(fmt.Sprintf("domain:ad%d.tracker%d.com", i, i%1000), struct{}{})
+	}
+	m.Compact()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Match("x.ad123.tracker123.com")
+	}
+}
@@ -30,6 +30,13 @@ type Matcher[T any] interface {
 	Match(s string) (v T, ok bool)
 }
 
+// QtypeMatcher is a Matcher whose result may also depend on the query type.
+type QtypeMatcher[T any] interface {
+	Matcher[T]
+	// MatchQtype matches the domain s queried with type qtype.
+	MatchQtype(s string, qtype uint16) (v T, ok bool)
+}
+
 type WriteableMatcher[T any] interface {
 	Matcher[T]
 	Add(pattern string, v T) error
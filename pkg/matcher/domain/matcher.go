@@ -195,6 +195,7 @@ const (
 type MixMatcher[T any] struct {
 	defaultMatcher string
 
+	compact *compactTrie[T] // full and domain rules compiled by Compact, may be nil
 	full    *FullMatcher[T]
 	domain  *SubDomainMatcher[T]
 	regex   *RegexMatcher[T]
@@ -247,6 +248,11 @@ func (m *MixMatcher[T]) Add(s string, v T) error {
 }
 
 func (m *MixMatcher[T]) Match(s string) (v T, ok bool) {
+	if m.compact != nil {
+		if v, ok = m.compact.Match(s); ok {
+			return v, true
+		}
+	}
 	for _, matcher := range [...]Matcher[T]{m.full, m.domain, m.regex, m.keyword} {
 		if v, ok = matcher.Match(s); ok {
 			return v, true
@@ -257,6 +263,9 @@ func (m *MixMatcher[T]) Match(s string) (v T, ok bool) {
 
 func (m *MixMatcher[T]) Len() int {
 	sum := 0
+	if m.compact != nil {
+		sum += m.compact.Len()
+	}
 	for _, matcher := range [...]interface{ Len() int }{m.full, m.domain, m.regex, m.keyword} {
 		if matcher == nil {
 			continue
@@ -266,6 +275,29 @@ func (m *MixMatcher[T]) Len() int {
 	return sum
 }
 
+// Compact compiles the full and domain rules of m into a read-only succinct
+// trie, which uses several times less memory than the map based matchers
+// but is slower to build. It should be called once all rules are added, and
+// must not be called concurrently with Match.
+// Rules added after Compact go to the map based matchers again and are
+// compiled by the next call to Compact.
+func (m *MixMatcher[T]) Compact() {
+	if m.compact == nil && m.full.Len() == 0 && m.domain.Len() == 0 {
+		return
+	}
+	subRoot, fullRoot := m.domain.root, new(labelNode[T])
+	for d, v := range m.full.m {
+		fm := SubDomainMatcher[T]{root: fullRoot}
+		fm.Add(d, v)
+	}
+	if m.compact != nil {
+		m.compact.appendTo(subRoot, fullRoot)
+	}
+	m.compact = buildCompactTrie(subRoot, fullRoot)
+	m.full = NewFullMatcher[T]()
+	m.domain = NewSubDomainMatcher[T]()
+}
+
 func (m *MixMatcher[T]) splitTypeAndPattern(s string) (string, string) {
 	typ, pattern, ok := utils.SplitString2(s, ":")
 	if !ok {
@@ -21,6 +21,7 @@ package domain
 
 import (
 	"strings"
+	"unique"
 )
 
 type ReverseDomainScanner struct {
@@ -91,12 +92,16 @@ func (n *labelNode[T]) hasValue() bool {
 	return n.hasV
 }
 
+// newChild adds a child node for label key.
+// The key is interned, so common labels (e.g. "com") share one copy across
+// all matchers and the node does not keep the (usually much longer) rule
+// string that key was sliced from alive.
 func (n *labelNode[T]) newChild(key string) *labelNode[T] {
 	if n.children == nil {
 		n.children = make(map[string]*labelNode[T])
 	}
 	node := new(labelNode[T])
-	n.children[key] = node
+	n.children[unique.Make(key).Value()] = node
 	return node
 }
 
@@ -21,7 +21,9 @@ package domain
 
 import (
 	"reflect"
+	"strings"
 	"testing"
+	"unsafe"
 )
 
 func TestDomainScanner(t *testing.T) {
@@ -59,3 +61,27 @@ func TestDomainScanner(t *testing.T) {
 		})
 	}
 }
+
+func TestLabelNodeInternsKeys(t *testing.T) {
+	// Build the rules at runtime so the labels are slices of distinct strings.
+	r1 := strings.Repeat("a", 1) + ".example.com"
+	r2 := strings.Repeat("b", 1) + ".example.com"
+	m1 := NewSubDomainMatcher[struct{}]()
+	m2 := NewSubDomainMatcher[struct{}]()
+	m1.Add(r1, struct{}{})
+	m2.Add(r2, struct{}{})
+
+	key := func(m *SubDomainMatcher[struct{}]) string {
+		for k := range m.root.children {
+			return k
+		}
+		return ""
+	}
+	k1, k2 := key(m1), key(m2)
+	if k1 != "com" || unsafe.StringData(k1) != unsafe.StringData(k2) {
+		t.Fatal("label com is not interned")
+	}
+	if unsafe.StringData(k1) == unsafe.StringData(r1[len(r1)-3:]) {
+		t.Fatal("label still references the rule string")
+	}
+}
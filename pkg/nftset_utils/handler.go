@@ -87,6 +87,14 @@ func (h *NftSetHandler) getSetLocked() (*nftables.Set, error) {
 
 // AddElems adds netip.Prefix(s) to set in a single batch.
 func (h *NftSetHandler) AddElems(es ...netip.Prefix) error {
+	return h.AddElemsWithTimeout(0, es...)
+}
+
+// AddElemsWithTimeout adds netip.Prefix(s) to set in a single batch.
+// Elements will be removed by the kernel after timeout. The set must have
+// the 'timeout' flag. If timeout is 0, the default timeout of the set
+// will be applied.
+func (h *NftSetHandler) AddElemsWithTimeout(timeout time.Duration, es ...netip.Prefix) error {
 	h.m.Lock()
 	defer h.m.Unlock()
 
@@ -120,14 +128,14 @@ func (h *NftSetHandler) AddElems(es ...netip.Prefix) error {
 		}
 		if set.Interval {
 			start := e.Masked().Addr()
-			elems = append(elems, nftables.SetElement{Key: start.AsSlice(), IntervalEnd: false})
+			elems = append(elems, nftables.SetElement{Key: start.AsSlice(), IntervalEnd: false, Timeout: timeout})
 			
 			end := netipx.PrefixLastIP(e).Next() // may be invalid if end is overflowed
 			if end.IsValid() {
-				elems = append(elems, nftables.SetElement{Key: end.AsSlice(), IntervalEnd: true})
+				elems = append(elems, nftables.SetElement{Key: end.AsSlice(), IntervalEnd: true, Timeout: timeout})
 			}
 		} else {
-			elems = append(elems, nftables.SetElement{Key: e.Addr().AsSlice()})
+			elems = append(elems, nftables.SetElement{Key: e.Addr().AsSlice(), Timeout: timeout})
 		}
 	}
 
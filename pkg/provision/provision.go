@@ -0,0 +1,347 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package provision generates client provisioning artifacts, e.g. DNS
+// stamps and Apple configuration profiles, for encrypted DNS listeners.
+package provision
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Protocols of listeners.
+const (
+	DoH = "doh"
+	DoT = "dot"
+	DoQ = "doq"
+)
+
+// Listener is an encrypted DNS listener of the server.
+type Listener struct {
+	Tag   string `json:"tag"`
+	Proto string `json:"proto"` // DoH, DoT or DoQ
+	Port  int    `json:"port"`
+	Path  string `json:"path,omitempty"` // DoH only
+	Cert  string `json:"-"`              // cert file, used for stamp hashes
+}
+
+// URL returns the client url of l, e.g. "https://dns.example.com/dns-query".
+func (l Listener) URL(host string) string {
+	switch l.Proto {
+	case DoH:
+		return "https://" + hostPort(host, l.Port, 443) + l.Path
+	case DoT:
+		return "tls://" + hostPort(host, l.Port, 853)
+	case DoQ:
+		return "quic://" + hostPort(host, l.Port, 853)
+	}
+	return ""
+}
+
+func hostPort(host string, port, defaultPort int) string {
+	if port == 0 || port == defaultPort {
+		return host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// Options describes the server that clients will connect to.
+type Options struct {
+	// Host is the server name in the certificate, required.
+	Host string
+	// Addr is an optional ip address of the server. It is used as the
+	// bootstrap address in stamps.
+	Addr string
+	// Name is the display name of the configuration profile.
+	// Default is Host.
+	Name string
+}
+
+func (o Options) validate() error {
+	if len(o.Host) == 0 {
+		return errors.New("missing host")
+	}
+	if len(o.Addr) > 0 {
+		if _, err := netip.ParseAddr(o.Addr); err != nil {
+			return fmt.Errorf("invalid addr, %w", err)
+		}
+	}
+	return nil
+}
+
+// Stamp returns the sdns:// stamp of l.
+// See https://dnscrypt.info/stamps-specifications.
+func Stamp(l Listener, o Options) (string, error) {
+	if err := o.validate(); err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	switch l.Proto {
+	case DoH:
+		b.WriteByte(0x02)
+	case DoT:
+		b.WriteByte(0x03)
+	case DoQ:
+		b.WriteByte(0x04)
+	default:
+		return "", fmt.Errorf("unsupported protocol %s", l.Proto)
+	}
+	binary.Write(&b, binary.LittleEndian, uint64(0)) // props
+
+	defaultPort := 853
+	if l.Proto == DoH {
+		defaultPort = 443
+	}
+	addr := o.Addr
+	if len(addr) > 0 {
+		if ip, _ := netip.ParseAddr(addr); ip.Is6() {
+			addr = "[" + addr + "]"
+		}
+	}
+	writeLP(&b, addr)
+	hashes, err := certHashes(l.Cert)
+	if err != nil {
+		return "", err
+	}
+	writeVLP(&b, hashes)
+	writeLP(&b, hostPort(o.Host, l.Port, defaultPort))
+	if l.Proto == DoH {
+		path := l.Path
+		if len(path) == 0 {
+			path = "/"
+		}
+		writeLP(&b, path)
+	}
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(b.Bytes()), nil
+}
+
+func writeLP(b *bytes.Buffer, s string) {
+	b.WriteByte(byte(len(s)))
+	b.WriteString(s)
+}
+
+// writeVLP writes a variable length set. The high bit of the length of an
+// item is set if more items follow.
+func writeVLP(b *bytes.Buffer, items [][]byte) {
+	if len(items) == 0 {
+		b.WriteByte(0)
+		return
+	}
+	for i, item := range items {
+		l := byte(len(item))
+		if i < len(items)-1 {
+			l |= 0x80
+		}
+		b.WriteByte(l)
+		b.Write(item)
+	}
+}
+
+// certHashes returns the SHA256 digests of the TBS certificates that
+// sign the leaf in the cert chain file. If the file only has the leaf,
+// the digest of the leaf is returned. An empty file name returns nil.
+func certHashes(file string) ([][]byte, error) {
+	if len(file) == 0 {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cert, %w", err)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cert, %w", err)
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate in %s", file)
+	}
+	if len(certs) > 1 {
+		certs = certs[1:]
+	}
+	var hashes [][]byte
+	for _, c := range certs {
+		h := sha256.Sum256(c.RawTBSCertificate)
+		hashes = append(hashes, h[:])
+	}
+	return hashes, nil
+}
+
+// MobileConfig returns an Apple configuration profile (.mobileconfig) that
+// has a DNS settings payload for each DoH and DoT listener.
+func MobileConfig(ls []Listener, o Options) ([]byte, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	name := o.Name
+	if len(name) == 0 {
+		name = o.Host
+	}
+	type payload struct {
+		Proto      string
+		ServerURL  string
+		ServerName string
+		Addr       string
+		Name       string
+		UUID       string
+		Identifier string
+	}
+	var payloads []payload
+	for _, l := range ls {
+		p := payload{Addr: o.Addr, UUID: uuid(o.Host, l.Proto, strconv.Itoa(l.Port), l.Path)}
+		switch l.Proto {
+		case DoH:
+			p.Proto, p.ServerURL = "HTTPS", l.URL(o.Host)
+		case DoT:
+			if l.Port != 0 && l.Port != 853 {
+				continue // DoT port is not configurable in the profile.
+			}
+			p.Proto, p.ServerName = "TLS", o.Host
+		default:
+			continue
+		}
+		p.Name = fmt.Sprintf("%s (%s)", name, p.Proto)
+		p.Identifier = "com.apple.dnsSettings.managed." + p.UUID
+		p.ServerURL, p.ServerName, p.Name = xmlEscape(p.ServerURL), xmlEscape(p.ServerName), xmlEscape(p.Name)
+		payloads = append(payloads, p)
+	}
+	if len(payloads) == 0 {
+		return nil, errors.New("no DoH or DoT listener on port 853")
+	}
+
+	var b bytes.Buffer
+	err := mobileConfigTmpl.Execute(&b, map[string]any{
+		"Name":     xmlEscape(name),
+		"UUID":     uuid(o.Host, "profile"),
+		"Host":     xmlEscape(o.Host),
+		"Payloads": payloads,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// uuid returns a stable name based uuid, so re-downloaded profiles replace
+// the installed one.
+func uuid(parts ...string) string {
+	h := sha256.Sum256([]byte(strings.Join(parts, "|")))
+	h[6] = h[6]&0x0f | 0x50
+	h[8] = h[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+var mobileConfigTmpl = template.Must(template.New("mobileconfig").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+{{- range .Payloads}}
+		<dict>
+			<key>DNSSettings</key>
+			<dict>
+				<key>DNSProtocol</key>
+				<string>{{.Proto}}</string>
+{{- if .ServerURL}}
+				<key>ServerURL</key>
+				<string>{{.ServerURL}}</string>
+{{- end}}
+{{- if .ServerName}}
+				<key>ServerName</key>
+				<string>{{.ServerName}}</string>
+{{- end}}
+{{- if .Addr}}
+				<key>ServerAddresses</key>
+				<array>
+					<string>{{.Addr}}</string>
+				</array>
+{{- end}}
+			</dict>
+			<key>PayloadDisplayName</key>
+			<string>{{.Name}}</string>
+			<key>PayloadIdentifier</key>
+			<string>{{.Identifier}}</string>
+			<key>PayloadType</key>
+			<string>com.apple.dnsSettings.managed</string>
+			<key>PayloadUUID</key>
+			<string>{{.UUID}}</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+{{- end}}
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>{{.Name}}</string>
+	<key>PayloadIdentifier</key>
+	<string>mosdns.{{.Host}}</string>
+	<key>PayloadRemovalDisallowed</key>
+	<false/>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>{{.UUID}}</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`))
+
+// AndroidInstructions returns instructions for the Android Private DNS
+// setting, which only supports DoT on port 853.
+func AndroidInstructions(ls []Listener, o Options) string {
+	for _, l := range ls {
+		if l.Proto == DoT && (l.Port == 0 || l.Port == 853) {
+			return "Android 9+: Settings > Network & internet > Private DNS > " +
+				"Private DNS provider hostname, enter: " + o.Host + "\n"
+		}
+	}
+	return "Android Private DNS requires a DoT listener on port 853, but none is configured.\n"
+}
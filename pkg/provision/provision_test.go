@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package provision
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+)
+
+func Test_Stamp(t *testing.T) {
+	tests := []struct {
+		name string
+		l    Listener
+		o    Options
+		want []byte
+	}{
+		{
+			name: "doh",
+			l:    Listener{Proto: DoH, Port: 443, Path: "/dns-query"},
+			o:    Options{Host: "dns.example.com"},
+			want: append(append([]byte{0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 15}, "dns.example.com"...), append([]byte{10}, "/dns-query"...)...),
+		},
+		{
+			name: "dot with addr and port",
+			l:    Listener{Proto: DoT, Port: 8853},
+			o:    Options{Host: "a.b", Addr: "1.2.3.4"},
+			want: append(append([]byte{0x03, 0, 0, 0, 0, 0, 0, 0, 0, 7}, "1.2.3.4"...), append([]byte{0, 8}, "a.b:8853"...)...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Stamp(tt.l, tt.o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, "sdns://"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, tt.want) {
+				t.Fatalf("stamp = %x, want %x", b, tt.want)
+			}
+		})
+	}
+
+	if _, err := Stamp(Listener{Proto: DoH}, Options{}); err == nil {
+		t.Fatal("missing host should be rejected")
+	}
+}
+
+func Test_MobileConfig(t *testing.T) {
+	ls := []Listener{
+		{Proto: DoH, Port: 8443, Path: "/dns-query"},
+		{Proto: DoT, Port: 853},
+		{Proto: DoQ, Port: 853},
+	}
+	b, err := MobileConfig(ls, Options{Host: "dns.example.com", Name: "Home & Office"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		if _, err := d.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("invalid xml, %v\n%s", err, b)
+		}
+	}
+	s := string(b)
+	for _, want := range []string{
+		"<string>https://dns.example.com:8443/dns-query</string>",
+		"<string>dns.example.com</string>",
+		"Home &amp; Office (TLS)",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("profile does not contain %q", want)
+		}
+	}
+	if strings.Count(s, "com.apple.dnsSettings.managed</string>") != 2 {
+		t.Error("want a payload for each DoH and DoT listener")
+	}
+
+	b2, _ := MobileConfig(ls, Options{Host: "dns.example.com", Name: "Home & Office"})
+	if !bytes.Equal(b, b2) {
+		t.Error("profile should be stable")
+	}
+
+	if _, err := MobileConfig([]Listener{{Proto: DoT, Port: 8853}}, Options{Host: "a.b"}); err == nil {
+		t.Error("DoT on a non-standard port can not be provisioned")
+	}
+}
+
+func Test_AndroidInstructions(t *testing.T) {
+	if s := AndroidInstructions([]Listener{{Proto: DoT, Port: 853}}, Options{Host: "a.b"}); !strings.Contains(s, "a.b") {
+		t.Fatal(s)
+	}
+	if s := AndroidInstructions([]Listener{{Proto: DoH, Port: 443}}, Options{Host: "a.b"}); strings.Contains(s, "a.b") {
+		t.Fatal(s)
+	}
+}
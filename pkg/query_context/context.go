@@ -33,8 +33,39 @@ import (
 const (
 	// KeyDomainSet is the key for storing the matched domain_set name in the context.
 	KeyDomainSet uint32 = iota + 100 // Use a number unlikely to conflict with internal keys.
+	// KeyUpstream is the key for storing the name of the upstream that produced the response.
+	KeyUpstream
+	// KeyOriginalClientAddr is the key for storing the client address (netip.Addr)
+	// before it was replaced by the address of its logical client.
+	KeyOriginalClientAddr
+	// KeyClientTag is the key for storing the client tag (string) that the
+	// server assigned to the client, see server_handler.ClientACL.
+	KeyClientTag
+	// KeyUpstreamObserver is the key for storing an UpstreamObserver that
+	// is notified of the upstream exchanges of the query.
+	KeyUpstreamObserver
+	// KeyBlockReason is the key for storing why the query was blocked
+	// (string), e.g. the rule list that blocked it.
+	KeyBlockReason
+	// KeyUpstreamTransport is the key for storing the transport (string,
+	// e.g. "udp", "tcp", "tls", "https", "quic") that the response was
+	// finally received over. It differs from the upstream protocol if a
+	// truncated udp response was retried over tcp or tls.
+	KeyUpstreamTransport
+	// KeyDropQuery is the key for marking (bool) that the server should
+	// not reply the query.
+	KeyDropQuery
 )
 
+// UpstreamObserver observes the exchanges with upstreams, e.g. to log
+// them. It may be called concurrently, from other goroutines.
+type UpstreamObserver interface {
+	// ObserveUpstream is called after an exchange with upstream (its
+	// address in config). q and r are packed msgs, r is nil if the
+	// exchange failed. They are only valid during the call.
+	ObserveUpstream(upstream string, q []byte, qTime time.Time, r []byte, rTime time.Time)
+}
+
 const (
 	edns0Size = 1200
 )
@@ -250,6 +281,11 @@ func (ctx *Context) MarshalLogObject(encoder zapcore.ObjectEncoder) error {
 	if clientAddr := ctx.ServerMeta.ClientAddr; clientAddr.IsValid() {
 		zap.Stringer("client", clientAddr).AddTo(encoder)
 	}
+	if tag, ok := ctx.GetValue(KeyClientTag); ok {
+		if s, ok := tag.(string); ok {
+			encoder.AddString("client_tag", s)
+		}
+	}
 
 	question := ctx.query.Question[0]
 	encoder.AddString("qname", question.Name)
@@ -259,6 +295,11 @@ func (ctx *Context) MarshalLogObject(encoder zapcore.ObjectEncoder) error {
 	if r := ctx.resp; r != nil {
 		encoder.AddInt("rcode", r.Rcode)
 	}
+	if u, ok := ctx.GetValue(KeyUpstream); ok {
+		if name, ok := u.(string); ok {
+			encoder.AddString("upstream", name)
+		}
+	}
 	encoder.AddDuration("elapsed", time.Since(ctx.startTime))
 	return nil
 }
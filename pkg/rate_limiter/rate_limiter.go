@@ -25,7 +25,13 @@ type Limiter struct {
 
 type tableShard struct {
 	m     sync.Mutex
-	table map[netip.Addr]*limiterEntry
+	table map[limiterKey]*limiterEntry
+}
+
+// limiterKey is a client, or a client and a name.
+type limiterKey struct {
+	addr netip.Addr
+	name string
 }
 
 type limiterEntry struct {
@@ -49,7 +55,7 @@ func NewRateLimiter(limit rate.Limit, burst int) *Limiter {
 	}
 
 	for i := range l.tables {
-		l.tables[i] = &tableShard{table: make(map[netip.Addr]*limiterEntry)}
+		l.tables[i] = &tableShard{table: make(map[limiterKey]*limiterEntry)}
 	}
 
 	go l.gcLoop(gcInterval)
@@ -58,16 +64,23 @@ func NewRateLimiter(limit rate.Limit, burst int) *Limiter {
 
 // maskedUnmappedP must be a masked prefix and contain a unmapped addr.
 func (l *Limiter) Allow(unmappedAddr netip.Addr) bool {
+	return l.AllowName(unmappedAddr, "")
+}
+
+// AllowName is like Allow, but the client has a separate limit for
+// each name, e.g. a query name.
+func (l *Limiter) AllowName(unmappedAddr netip.Addr, name string) bool {
 	now := time.Now()
+	k := limiterKey{addr: unmappedAddr, name: name}
 	shard := l.getTableShard(unmappedAddr)
 	shard.m.Lock()
-	e, ok := shard.table[unmappedAddr]
+	e, ok := shard.table[k]
 	if !ok {
 		e = &limiterEntry{
 			l:        rate.NewLimiter(l.Limit, l.Burst),
 			lastSeen: now,
 		}
-		shard.table[unmappedAddr] = e
+		shard.table[k] = e
 	}
 	e.lastSeen = now
 	shard.m.Unlock()
@@ -115,8 +128,8 @@ func (l *Limiter) getTableShard(unmappedAddr netip.Addr) *tableShard {
 func (l *Limiter) ForEach(doFunc func(unmappedAddr netip.Addr, r *rate.Limiter) (doBreak bool)) (doBreak bool) {
 	for _, shard := range l.tables {
 		shard.m.Lock()
-		for a, e := range shard.table {
-			doBreak = doFunc(a, e.l)
+		for k, e := range shard.table {
+			doBreak = doFunc(k.addr, e.l)
 			if doBreak {
 				shard.m.Unlock()
 				return
@@ -1,6 +1,7 @@
 package rate_limiter
 
 import (
+	"net/netip"
 	"testing"
 	"time"
 
@@ -18,3 +19,22 @@ func BenchmarkXxx(b *testing.B) {
 	}
 	_ = l
 }
+
+func TestLimiter_AllowName(t *testing.T) {
+	l := NewRateLimiter(rate.Every(time.Hour), 1)
+	defer l.Close()
+	addr := netip.MustParseAddr("192.168.1.1")
+
+	if !l.AllowName(addr, "a.com.") {
+		t.Fatal("first query of a.com. should be allowed")
+	}
+	if l.AllowName(addr, "a.com.") {
+		t.Fatal("second query of a.com. should be limited")
+	}
+	if !l.AllowName(addr, "b.com.") {
+		t.Fatal("b.com. should have its own limit")
+	}
+	if !l.Allow(addr) {
+		t.Fatal("the client limit should be separate from its name limits")
+	}
+}
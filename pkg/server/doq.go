@@ -21,13 +21,16 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
+	"os"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"go.uber.org/zap"
 )
@@ -38,6 +41,22 @@ const (
 	quicFirstReadTimeout   = time.Second * 2
 )
 
+// DoQ error codes, RFC 9250 4.3.
+const (
+	DoQNoError          = 0x0
+	DoQInternalError    = 0x1
+	DoQProtocolError    = 0x2
+	DoQRequestCancelled = 0x3
+	DoQExcessiveLoad    = 0x4
+	DoQUnspecifiedError = 0x5
+)
+
+// DoQListener is a *quic.Listener or, to accept 0-RTT queries,
+// a *quic.EarlyListener.
+type DoQListener interface {
+	Accept(ctx context.Context) (*quic.Conn, error)
+}
+
 type DoQServerOpts struct {
 	Logger      *zap.Logger
 	IdleTimeout time.Duration
@@ -45,7 +64,9 @@ type DoQServerOpts struct {
 
 // ServeDoQ starts a server at l. It returns if l had an Accept() error.
 // It always returns a non-nil error.
-func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
+// Each stream carries one query. Streams and connections are closed with
+// the DoQ error codes of RFC 9250.
+func ServeDoQ(l DoQListener, h Handler, opts DoQServerOpts) error {
 	logger := opts.Logger
 	if logger == nil {
 		logger = nopLogger
@@ -66,7 +87,7 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 		// handle connection
 		connCtx, cancelConn := context.WithCancelCause(listenerCtx)
 		go func() {
-			defer c.CloseWithError(0, "")
+			defer c.CloseWithError(DoQNoError, "")
 			defer cancelConn(errConnectionCtxCanceled)
 
 			var clientAddr netip.Addr
@@ -93,31 +114,61 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 
 				// Handle stream.
 				// For doq, one stream, one query.
-				go func() {
-					defer func() {
-						stream.Close()
-						stream.CancelRead(0) // TODO: Needs a proper error code.
-					}()
-					// Avoid fragmentation attack.
-					stream.SetReadDeadline(time.Now().Add(streamReadTimeout))
-					req, _, err := dnsutils.ReadMsgFromTCP(stream)
-					if err != nil {
-						return
-					}
-					queryMeta := QueryMeta{
-						ClientAddr: clientAddr,
-						ServerName: c.ConnectionState().TLS.ServerName,
-					}
-
-					resp := h.Handle(connCtx, req, queryMeta, pool.PackTCPBuffer)
-					if resp == nil {
-						return
-					}
-					if _, err := stream.Write(*resp); err != nil {
-						logger.Warn("failed to write response", zap.Stringer("client", c.RemoteAddr()), zap.Error(err))
-					}
-				}()
+				go handleDoQStream(connCtx, c, stream, clientAddr, h, logger)
 			}
 		}()
 	}
 }
+
+func handleDoQStream(ctx context.Context, c *quic.Conn, stream *quic.Stream, clientAddr netip.Addr, h Handler, logger *zap.Logger) {
+	// A stream carries only one query, stop reading when it's done.
+	defer stream.CancelRead(DoQNoError)
+
+	// Avoid fragmentation attack.
+	stream.SetReadDeadline(time.Now().Add(streamReadTimeout))
+	req, _, err := dnsutils.ReadMsgFromTCP(stream)
+	if err != nil {
+		var streamErr *quic.StreamError
+		switch {
+		case errors.As(err, &streamErr): // Cancelled by client.
+			stream.CancelWrite(DoQNoError)
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			stream.CancelRead(DoQRequestCancelled)
+			stream.CancelWrite(DoQRequestCancelled)
+		default:
+			// A malformed query is a protocol error, which is fatal
+			// to the connection.
+			c.CloseWithError(DoQProtocolError, "malformed query")
+		}
+		return
+	}
+
+	// Queries in 0-RTT data can be replayed. Only answer queries that are
+	// replayable before the handshake is completed. RFC 9250 4.5.
+	if req.Opcode != dns.OpcodeQuery {
+		select {
+		case <-c.HandshakeComplete():
+		case <-ctx.Done():
+			stream.CancelWrite(DoQRequestCancelled)
+			return
+		}
+	}
+
+	queryMeta := QueryMeta{
+		ClientAddr: clientAddr,
+		ServerName: c.ConnectionState().TLS.ServerName,
+		Protocol:   ProtocolQUIC,
+	}
+	resp := h.Handle(ctx, req, queryMeta, pool.PackTCPBuffer)
+	if resp == nil {
+		stream.CancelWrite(DoQInternalError)
+		return
+	}
+	defer pool.ReleaseBuf(resp)
+	if _, err := stream.Write(*resp); err != nil {
+		logger.Warn("failed to write response", zap.Stringer("client", c.RemoteAddr()), zap.Error(err))
+		stream.CancelWrite(DoQInternalError)
+		return
+	}
+	stream.Close()
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+type doqTestHandler struct{}
+
+func (doqTestHandler) Handle(_ context.Context, q *dns.Msg, meta QueryMeta, pack func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	if q.Question[0].Name == "drop." || meta.Protocol != ProtocolQUIC {
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	b, _ := pack(r)
+	return b
+}
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"doq"},
+	}
+}
+
+func Test_ServeDoQ(t *testing.T) {
+	l, err := quic.ListenAddr("127.0.0.1:0", testTLSConfig(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go ServeDoQ(l, doqTestHandler{}, DoQServerOpts{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, err := quic.DialAddr(ctx, l.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"doq"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.CloseWithError(DoQNoError, "")
+
+	send := func(payload []byte) (*quic.Stream, error) {
+		s, err := c.OpenStreamSync(ctx)
+		if err != nil {
+			return nil, err
+		}
+		b := binary.BigEndian.AppendUint16(nil, uint16(len(payload)))
+		if _, err := s.Write(append(b, payload...)); err != nil {
+			return nil, err
+		}
+		return s, s.Close()
+	}
+	query := func(name string) ([]byte, error) {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		q.Id = 0
+		b, _ := q.Pack()
+		s, err := send(b)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(s)
+	}
+
+	b, err := query("example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := new(dns.Msg)
+	if len(b) < 2 || r.Unpack(b[2:]) != nil || !r.Response {
+		t.Fatalf("invalid response %x", b)
+	}
+
+	var streamErr *quic.StreamError
+	if _, err := query("drop."); !errors.As(err, &streamErr) || streamErr.ErrorCode != DoQInternalError {
+		t.Fatalf("want stream reset with DoQInternalError, got %v", err)
+	}
+
+	s, err := send([]byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(s)
+	var appErr *quic.ApplicationError
+	if !errors.As(err, &appErr) || appErr.ErrorCode != DoQProtocolError {
+		t.Fatalf("want connection closed with DoQProtocolError, got %v", err)
+	}
+}
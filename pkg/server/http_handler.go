@@ -24,10 +24,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/netip"
+	"strconv"
 	"strings"
 
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
@@ -96,20 +99,29 @@ func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	queryMeta := QueryMeta{
 		ClientAddr: clientAddr,
+		Protocol:   ProtocolHTTP,
 	}
 	if u := req.URL; u != nil {
 		queryMeta.UrlPath = u.Path
 	}
 	if tlsStat := req.TLS; tlsStat != nil {
 		queryMeta.ServerName = tlsStat.ServerName
+		queryMeta.Protocol = ProtocolHTTPS
 	}
-	resp := h.dnsHandler.Handle(req.Context(), q, queryMeta, pool.PackBuffer)
+	var maxAge uint32
+	packMsg := func(m *dns.Msg) (*[]byte, error) {
+		maxAge = dnsutils.GetMinimalTTL(m)
+		return pool.PackBuffer(m)
+	}
+	resp := h.dnsHandler.Handle(req.Context(), q, queryMeta, packMsg)
 	if resp == nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	defer pool.ReleaseBuf(resp)
 	w.Header().Set("Content-Type", "application/dns-message")
+	// RFC 8484 5.1: freshness lifetime should be the smallest ttl in the answer.
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(maxAge), 10))
 	if _, err := w.Write(*resp); err != nil {
 		h.warnErr(req, "failed to write response", err)
 		return
@@ -133,11 +145,12 @@ func ReadMsgFromReq(req *http.Request) (*dns.Msg, error) {
 	switch req.Method {
 	case http.MethodGet:
 		// Check accept header
-		if req.Header.Get("Accept") != "application/dns-message" {
+		if !acceptDnsMessage(req.Header.Get("Accept")) {
 			return nil, errInvalidMediaType
 		}
 
-		s := req.URL.Query().Get("dns")
+		// Some clients add padding, which is not allowed by RFC 8484.
+		s := strings.TrimRight(req.URL.Query().Get("dns"), "=")
 		if len(s) == 0 {
 			return nil, errors.New("no dns parameter")
 		}
@@ -175,3 +188,22 @@ func ReadMsgFromReq(req *http.Request) (*dns.Msg, error) {
 	}
 	return m, nil
 }
+
+// acceptDnsMessage reports whether the Accept header s allows
+// "application/dns-message". An empty header accepts everything.
+func acceptDnsMessage(s string) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for _, e := range strings.Split(s, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(e))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case "application/dns-message", "application/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_ReadMsgFromReq_Get(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		accept  string
+		param   string
+		wantErr bool
+	}{
+		{"exact accept", "application/dns-message", base64.RawURLEncoding.EncodeToString(b), false},
+		{"no accept", "", base64.RawURLEncoding.EncodeToString(b), false},
+		{"accept list", "text/html, application/dns-message;q=0.9", base64.RawURLEncoding.EncodeToString(b), false},
+		{"wildcard accept", "*/*", base64.RawURLEncoding.EncodeToString(b), false},
+		{"padded param", "application/dns-message", base64.URLEncoding.EncodeToString(b), false},
+		{"wrong accept", "text/html", base64.RawURLEncoding.EncodeToString(b), true},
+		{"no param", "application/dns-message", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/dns-query?dns="+tt.param, nil)
+			if len(tt.accept) > 0 {
+				req.Header.Set("Accept", tt.accept)
+			}
+			m, err := ReadMsgFromReq(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadMsgFromReq() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && m.Question[0].Name != "example.com." {
+				t.Fatalf("unexpected question %v", m.Question)
+			}
+		})
+	}
+}
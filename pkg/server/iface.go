@@ -14,11 +14,21 @@ import (
 // udp: do nothing.
 // tcp/dot: close the connection immediately.
 // doh: send a 500 response.
-// doq: close the stream immediately.
+// doq: reset the stream with DoQInternalError.
 type Handler interface {
 	Handle(ctx context.Context, q *dns.Msg, meta QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) (respPayload *[]byte)
 }
 
+// Protocols of QueryMeta.Protocol.
+const (
+	ProtocolUDP   = "udp"
+	ProtocolTCP   = "tcp"
+	ProtocolTLS   = "tls"
+	ProtocolHTTP  = "http"
+	ProtocolHTTPS = "https"
+	ProtocolQUIC  = "quic"
+)
+
 type QueryMeta struct {
 	FromUDP bool
 
@@ -26,4 +36,5 @@ type QueryMeta struct {
 	ClientAddr netip.Addr
 	ServerName string
 	UrlPath    string
+	Protocol   string // The transport the query came from, one of the Protocol* consts.
 }
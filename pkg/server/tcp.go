@@ -90,8 +90,10 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 
 				// Try to get server name from tls conn.
 				var serverName string
+				protocol := ProtocolTCP
 				if tlsConn, ok := c.(*tls.Conn); ok {
 					serverName = tlsConn.ConnectionState().ServerName
+					protocol = ProtocolTLS
 				}
 
 				// handle query
@@ -101,7 +103,7 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 					if ok {
 						clientAddr = ta.AddrPort().Addr()
 					}
-					r := h.Handle(tcpConnCtx, req, QueryMeta{ClientAddr: clientAddr, ServerName: serverName}, pool.PackTCPBuffer)
+					r := h.Handle(tcpConnCtx, req, QueryMeta{ClientAddr: clientAddr, ServerName: serverName, Protocol: protocol}, pool.PackTCPBuffer)
 					if r == nil {
 						c.Close() // abort the connection
 						return
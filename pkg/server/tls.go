@@ -20,7 +20,16 @@
 package server
 
 import (
+	"bytes"
 	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
 )
 
 func LoadCert(tlsCfg *tls.Config, cert, key string) error {
@@ -31,3 +40,142 @@ func LoadCert(tlsCfg *tls.Config, cert, key string) error {
 	tlsCfg.Certificates = []tls.Certificate{c}
 	return nil
 }
+
+// certReloadDelay merges the burst of events of a cert renewal, e.g. the
+// cert and the key are written one after another.
+const certReloadDelay = time.Second
+
+// CertReloader serves a cert key pair and reloads it when the files change,
+// so renewed certs take effect without restarting the server. Changes
+// are detected by watching the dirs of the files, and optionally by
+// checking the files periodically, in case file events are not available
+// (e.g. some network or container mounts).
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	logger   *zap.Logger
+
+	cert atomic.Pointer[tls.Certificate]
+
+	reloadMu    sync.Mutex
+	watcher     *fsnotify.Watcher
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+// NewCertReloader loads the cert key pair. If interval > 0, files are also
+// checked every interval. logger can be nil.
+func NewCertReloader(certFile, keyFile string, interval time.Duration, logger *zap.Logger) (*CertReloader, error) {
+	if logger == nil {
+		logger = nopLogger
+	}
+	r := &CertReloader{
+		certFile:    certFile,
+		keyFile:     keyFile,
+		logger:      logger,
+		closeNotify: make(chan struct{}),
+	}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Warn("failed to watch cert files, cert changes will only be detected periodically", zap.Error(err))
+	} else {
+		dirs := map[string]struct{}{filepath.Dir(certFile): {}, filepath.Dir(keyFile): {}}
+		for dir := range dirs {
+			if err := w.Add(dir); err != nil {
+				logger.Warn("failed to watch cert dir", zap.String("dir", dir), zap.Error(err))
+			}
+		}
+		r.watcher = w
+	}
+	go r.loop(interval)
+	return r, nil
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// Leaf returns the leaf of the current cert.
+func (r *CertReloader) Leaf() *x509.Certificate {
+	return r.cert.Load().Leaf
+}
+
+// Reload loads the files, and reports whether the cert was changed.
+// The current cert is kept if the files are invalid, e.g. partially written.
+func (r *CertReloader) Reload() (bool, error) {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	old := r.cert.Load()
+	if old != nil && bytes.Equal(old.Certificate[0], c.Certificate[0]) {
+		return false, nil
+	}
+	r.cert.Store(&c)
+	if old != nil {
+		r.logger.Info("tls cert reloaded", zap.String("cert", r.certFile), zap.Time("not_after", c.Leaf.NotAfter))
+	}
+	return true, nil
+}
+
+func (r *CertReloader) loop(interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	if r.watcher != nil {
+		events, errs = r.watcher.Events, r.watcher.Errors
+	}
+
+	delay := time.NewTimer(certReloadDelay)
+	delay.Stop()
+	defer delay.Stop()
+	certName, keyName := filepath.Clean(r.certFile), filepath.Clean(r.keyFile)
+	for {
+		select {
+		case e := <-events:
+			// Renewal tools may replace the files or the symlinks to them,
+			// or update other files in the same dir (e.g. certbot's "..data").
+			if name := filepath.Clean(e.Name); name == certName || name == keyName || filepath.Base(name) == "..data" {
+				delay.Reset(certReloadDelay)
+			}
+		case err := <-errs:
+			r.logger.Warn("cert watcher error", zap.Error(err))
+		case <-delay.C:
+			r.reload()
+		case <-tick:
+			r.reload()
+		case <-r.closeNotify:
+			return
+		}
+	}
+}
+
+func (r *CertReloader) reload() {
+	if _, err := r.Reload(); err != nil {
+		r.logger.Warn("failed to reload tls cert, keep using the current one", zap.String("cert", r.certFile), zap.Error(err))
+	}
+}
+
+// Close stops watching the files.
+func (r *CertReloader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closeNotify)
+		if r.watcher != nil {
+			r.watcher.Close()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed cert with serial to dir/cert.pem and
+// dir/key.pem.
+func writeTestCert(t *testing.T, dir string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		DNSNames:     []string{"example.com"},
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write the key first, as renewal tools do, the watcher must not pick
+	// up a mismatched pair.
+	if err := os.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_CertReloader(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir, 1)
+	r, err := NewCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if n := r.Leaf().SerialNumber.Int64(); n != 1 {
+		t.Fatalf("want serial 1, got %d", n)
+	}
+	if changed, err := r.Reload(); err != nil || changed {
+		t.Fatalf("reloading the same cert should be a no-op, %v, %v", changed, err)
+	}
+
+	// Broken files must not replace the current cert.
+	if err := os.WriteFile(filepath.Join(dir, "cert.pem"), []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reload(); err == nil {
+		t.Fatal("want reload error")
+	}
+	if n := r.Leaf().SerialNumber.Int64(); n != 1 {
+		t.Fatalf("cert should be kept, got serial %d", n)
+	}
+
+	// Picked up by the watcher.
+	writeTestCert(t, dir, 2)
+	deadline := time.Now().Add(time.Second * 5)
+	for r.Leaf().SerialNumber.Int64() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("cert was not reloaded after files changed")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	c, _ := r.GetCertificate(nil)
+	if !bytes.Equal(c.Leaf.Raw, c.Certificate[0]) {
+		t.Fatal("unexpected served cert")
+	}
+}
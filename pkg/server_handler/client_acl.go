@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_handler
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+)
+
+// ClientACL controls which clients can query a server and assigns
+// client tags to them.
+type ClientACL struct {
+	allow *netlist.List // nil allows all clients
+	deny  *netlist.List // maybe nil
+	drop  bool
+	tags  []clientTag
+}
+
+type clientTag struct {
+	tag string
+	l   *netlist.List
+}
+
+type ClientACLOpts struct {
+	// Allow contains IPs and CIDRs of allowed clients. Empty allows all.
+	Allow []string
+	// Deny contains IPs and CIDRs of denied clients. It takes priority
+	// over Allow.
+	Deny []string
+	// Drop drops queries from denied clients instead of replying REFUSED.
+	Drop bool
+	// Tags maps client tags to IPs and CIDRs. The first matched tag is
+	// assigned to the query.
+	Tags []ClientTagOpts
+}
+
+type ClientTagOpts struct {
+	Tag     string
+	Clients []string
+}
+
+func NewClientACL(opts ClientACLOpts) (*ClientACL, error) {
+	acl := &ClientACL{drop: opts.Drop}
+	var err error
+	if len(opts.Allow) > 0 {
+		if acl.allow, err = loadList(opts.Allow); err != nil {
+			return nil, fmt.Errorf("invalid allow list, %w", err)
+		}
+	}
+	if len(opts.Deny) > 0 {
+		if acl.deny, err = loadList(opts.Deny); err != nil {
+			return nil, fmt.Errorf("invalid deny list, %w", err)
+		}
+	}
+	for _, t := range opts.Tags {
+		if len(t.Tag) == 0 {
+			return nil, fmt.Errorf("empty client tag")
+		}
+		l, err := loadList(t.Clients)
+		if err != nil {
+			return nil, fmt.Errorf("invalid clients of tag %s, %w", t.Tag, err)
+		}
+		acl.tags = append(acl.tags, clientTag{tag: t.Tag, l: l})
+	}
+	return acl, nil
+}
+
+func loadList(ss []string) (*netlist.List, error) {
+	l := netlist.NewList()
+	for _, s := range ss {
+		if err := netlist.LoadFromText(l, s); err != nil {
+			return nil, err
+		}
+	}
+	l.Sort()
+	return l, nil
+}
+
+// Allowed reports whether the client addr can query the server.
+// An invalid addr is only allowed if there is no allow list.
+func (acl *ClientACL) Allowed(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return acl.allow == nil
+	}
+	if acl.deny != nil && acl.deny.Match(addr) {
+		return false
+	}
+	return acl.allow == nil || acl.allow.Match(addr)
+}
+
+// Tag returns the tag of the client addr. Empty if it has no tag.
+func (acl *ClientACL) Tag(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return ""
+	}
+	for _, t := range acl.tags {
+		if t.l.Match(addr) {
+			return t.tag
+		}
+	}
+	return ""
+}
@@ -21,20 +21,30 @@ package server_handler
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"runtime/debug"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain" // ADDED: Import coremain for audit collector
 	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
 const (
 	defaultQueryTimeout = time.Second * 5
+
+	// TraceOptionCode is the EDNS0 option code (local/experimental range) that
+	// a client sends to request the upstream trace. e.g. "dig +ednsopt=65001".
+	TraceOptionCode = 65001
 )
 
 var (
@@ -58,12 +68,48 @@ type EntryHandlerOpts struct {
 	// Required.
 	Entry sequence.Executable
 
+	// EmergencyEntry handles the query if Entry panics. If it is nil,
+	// a SERVFAIL response will be returned instead.
+	EmergencyEntry sequence.Executable
+
 	// QueryTimeout limits the timeout value of each query.
 	// Default is defaultQueryTimeout.
 	QueryTimeout time.Duration
 
 	// ADDED: Flag to enable audit and process logging for this handler instance.
 	EnableAudit bool
+
+	// NSID is the name server identifier (RFC 5001) that will be sent to
+	// clients that request it. Empty means NSID is disabled.
+	NSID string
+
+	// MinTTL is the minimum ttl of the records that will be sent to clients.
+	// It only affects the final response, not the cached one. 0 means disabled.
+	MinTTL uint32
+
+	// TraceUpstream enables the upstream trace. If a client query contains
+	// the TraceOptionCode EDNS0 option, the name of the upstream that produced
+	// the answer will be added to the response as an extended DNS error
+	// (RFC 8914) text.
+	TraceUpstream bool
+
+	// ACL controls client access and assigns client tags. Optional.
+	ACL *ClientACL
+
+	// Malformed is the behavior for malformed queries. One of MalformedDrop
+	// (default), MalformedFormErr, MalformedRepair.
+	Malformed string
+
+	// QueryTotal and QueryDuration are optional metrics of this handler.
+	QueryTotal    prometheus.Counter
+	QueryDuration prometheus.Observer
+	// MalformedTotal is an optional counter of malformed queries. It must
+	// have one "action" label.
+	MalformedTotal *prometheus.CounterVec
+	// PanicTotal is an optional counter of entry panics.
+	PanicTotal prometheus.Counter
+	// DeniedTotal is an optional counter of queries denied by ACL.
+	DeniedTotal prometheus.Counter
 }
 
 func (opts *EntryHandlerOpts) init() {
@@ -71,34 +117,79 @@ func (opts *EntryHandlerOpts) init() {
 		opts.Logger = nopLogger
 	}
 	utils.SetDefaultNum(&opts.QueryTimeout, defaultQueryTimeout)
+	utils.SetDefaultString(&opts.Malformed, MalformedDrop)
 }
 
 type EntryHandler struct {
 	opts EntryHandlerOpts
+
+	nsid string // hex encoded NSID, empty if disabled
 }
 
 var _ server.Handler = (*EntryHandler)(nil)
 
 func NewEntryHandler(opts EntryHandlerOpts) *EntryHandler {
 	opts.init()
-	return &EntryHandler{opts: opts}
+	h := &EntryHandler{opts: opts}
+	if len(opts.NSID) > 0 {
+		h.nsid = hex.EncodeToString([]byte(opts.NSID))
+	}
+	return h
 }
 
 // Handle implements server.Handler.
 // If entry returns an error, a SERVFAIL response will be returned.
+// If entry panics, the query is handled by the emergency entry. Without
+// one, a SERVFAIL response will be returned.
 // If entry returns without a response, a REFUSED response will be returned.
+// If entry marks the query with query_context.KeyDropQuery, no response
+// will be returned.
 func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server.QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
 	// basic query check.
-	if q.Response || len(q.Question) != 1 || len(q.Answer)+len(q.Ns) > 0 || len(q.Extra) > 1 {
-		return nil
+	if reason := checkQuery(q); len(reason) > 0 {
+		switch h.handleMalformed(q, reason) {
+		case malformedActionDropped:
+			return nil
+		case malformedActionFormErr:
+			resp := new(dns.Msg)
+			resp.SetRcode(q, dns.RcodeFormatError)
+			payload, _ := packMsgPayload(resp)
+			return payload
+		}
 	}
 
-	ddl := time.Now().Add(h.opts.QueryTimeout)
+	if acl := h.opts.ACL; acl != nil && !acl.Allowed(serverMeta.ClientAddr) {
+		if h.opts.DeniedTotal != nil {
+			h.opts.DeniedTotal.Inc()
+		}
+		if acl.drop || q.Response {
+			return nil
+		}
+		resp := new(dns.Msg)
+		resp.SetRcode(q, dns.RcodeRefused)
+		payload, _ := packMsgPayload(resp)
+		return payload
+	}
+
+	start := time.Now()
+	if h.opts.QueryTotal != nil {
+		h.opts.QueryTotal.Inc()
+	}
+	if h.opts.QueryDuration != nil {
+		defer func() { h.opts.QueryDuration.Observe(time.Since(start).Seconds()) }()
+	}
+
+	ddl := start.Add(h.opts.QueryTimeout)
 	ctx, cancel := context.WithDeadline(ctx, ddl)
 	defer cancel()
 
 	qCtx := query_context.NewContext(q)
 	qCtx.ServerMeta = serverMeta
+	if h.opts.ACL != nil {
+		if tag := h.opts.ACL.Tag(serverMeta.ClientAddr); len(tag) > 0 {
+			qCtx.StoreValue(query_context.KeyClientTag, tag)
+		}
+	}
 
 	// --- FINAL MODIFICATION: The definitive logic to avoid double logging ---
 	// This single flag, passed from the server config, now controls both logging systems.
@@ -111,7 +202,7 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 	// --- END OF MODIFICATION ---
 
 	// exec entry
-	err := h.opts.Entry.Exec(ctx, qCtx)
+	err := h.execEntry(ctx, qCtx)
 	var resp *dns.Msg
 	if err != nil {
 		h.opts.Logger.Warn("entry err", qCtx.InfoField(), zap.Error(err))
@@ -119,6 +210,9 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 		resp.SetReply(q)
 		resp.Rcode = dns.RcodeServerFailure
 	} else {
+		if drop, _ := qCtx.GetValue(query_context.KeyDropQuery); drop == true {
+			return nil
+		}
 		resp = qCtx.R()
 	}
 
@@ -130,8 +224,21 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 	// We assume that our server is a forwarder.
 	resp.RecursionAvailable = true
 
+	if h.opts.MinTTL > 0 {
+		dnsutils.ApplyMinimalTTL(resp, h.opts.MinTTL)
+	}
+
 	// add respOpt back to resp
 	if respOpt := qCtx.RespOpt(); respOpt != nil {
+		if len(h.nsid) > 0 && hasOption(qCtx.ClientOpt(), dns.EDNS0NSID) {
+			respOpt.Option = append(respOpt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: h.nsid})
+		}
+		if h.opts.TraceUpstream && hasOption(qCtx.ClientOpt(), TraceOptionCode) {
+			respOpt.Option = append(respOpt.Option, &dns.EDNS0_EDE{
+				InfoCode:  dns.ExtendedErrorCodeOther,
+				ExtraText: "upstream: " + upstreamName(qCtx),
+			})
+		}
 		resp.Extra = append(resp.Extra, respOpt)
 	}
 
@@ -148,6 +255,53 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 	return payload
 }
 
+// execEntry executes the entry. If it panics, the panic is logged and
+// the query is handled by the emergency entry, if any.
+func (h *EntryHandler) execEntry(ctx context.Context, qCtx *query_context.Context) error {
+	err := h.safeExec(ctx, h.opts.Entry, qCtx)
+	if !errors.Is(err, errEntryPanic) || h.opts.EmergencyEntry == nil {
+		return err
+	}
+	qCtx.SetResponse(nil)
+	return h.safeExec(ctx, h.opts.EmergencyEntry, qCtx)
+}
+
+var errEntryPanic = errors.New("entry panicked")
+
+// safeExec executes e and recovers from panics.
+func (h *EntryHandler) safeExec(ctx context.Context, e sequence.Executable, qCtx *query_context.Context) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			h.opts.Logger.Error("entry panicked", qCtx.InfoField(), zap.Any("panic", v), zap.ByteString("stack", debug.Stack()))
+			if h.opts.PanicTotal != nil {
+				h.opts.PanicTotal.Inc()
+			}
+			err = fmt.Errorf("%w: %v", errEntryPanic, v)
+		}
+	}()
+	return e.Exec(ctx, qCtx)
+}
+
+// handleMalformed repairs q if it is configured and possible, records the
+// malformed query and returns the action taken. A repaired q can be handled
+// as usual.
+func (h *EntryHandler) handleMalformed(q *dns.Msg, reason string) string {
+	var action string
+	switch {
+	case h.opts.Malformed == MalformedRepair && repairQuery(q):
+		action = malformedActionRepaired
+	case h.opts.Malformed == MalformedDrop || q.Response: // Never reply to responses.
+		action = malformedActionDropped
+	default:
+		action = malformedActionFormErr
+	}
+	if h.opts.MalformedTotal != nil {
+		h.opts.MalformedTotal.WithLabelValues(action).Inc()
+	}
+	h.opts.Logger.Debug("malformed query", zap.String("reason", reason), zap.String("action", action))
+	return action
+}
+
 // opt can be nil.
 func getValidUDPSize(opt *dns.OPT) int {
 	var s uint16
@@ -160,6 +314,30 @@ func getValidUDPSize(opt *dns.OPT) int {
 	return int(s)
 }
 
+// hasOption reports whether opt contains an option with code. opt can be nil.
+func hasOption(opt *dns.OPT, code uint16) bool {
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamName returns the upstream that produced the response, or "none"
+// if the response was not from an upstream (e.g. from cache or hosts).
+func upstreamName(qCtx *query_context.Context) string {
+	if v, ok := qCtx.GetValue(query_context.KeyUpstream); ok {
+		if name, ok := v.(string); ok && len(name) > 0 {
+			return name
+		}
+	}
+	return "none"
+}
+
 func newOpt() *dns.OPT {
 	opt := new(dns.OPT)
 	opt.Hdr.Name = "."
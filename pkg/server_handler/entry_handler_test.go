@@ -0,0 +1,318 @@
+package server_handler
+
+import (
+	"context"
+	"encoding/hex"
+	"net/netip"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/miekg/dns"
+)
+
+type replyExec struct{}
+
+func (replyExec) Exec(_ context.Context, qCtx *query_context.Context) error {
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_EntryHandler_NSID(t *testing.T) {
+	h := NewEntryHandler(EntryHandlerOpts{Entry: replyExec{}, NSID: "node-1"})
+
+	exchange := func(withNSID bool) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.SetEdns0(1232, false)
+		if withNSID {
+			opt := q.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+		}
+		var resp *dns.Msg
+		h.Handle(context.Background(), q, server.QueryMeta{}, func(m *dns.Msg) (*[]byte, error) {
+			resp = m
+			b, err := m.Pack()
+			return &b, err
+		})
+		if resp == nil {
+			t.Fatal("handler returned no response")
+		}
+		return resp
+	}
+
+	getNSID := func(m *dns.Msg) string {
+		if opt := m.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if nsid, ok := o.(*dns.EDNS0_NSID); ok {
+					return nsid.Nsid
+				}
+			}
+		}
+		return ""
+	}
+
+	if got, want := getNSID(exchange(true)), hex.EncodeToString([]byte("node-1")); got != want {
+		t.Fatalf("nsid = %q, want %q", got, want)
+	}
+	if got := getNSID(exchange(false)); got != "" {
+		t.Fatalf("nsid should not be sent if client did not request it, got %q", got)
+	}
+}
+
+type ttlExec uint32
+
+func (t ttlExec) Exec(_ context.Context, qCtx *query_context.Context) error {
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: qCtx.Q().Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(t)},
+		A:   []byte{127, 0, 0, 1},
+	})
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_EntryHandler_MinTTL(t *testing.T) {
+	for _, tt := range []struct {
+		ttl, minTTL, want uint32
+	}{
+		{ttl: 1, minTTL: 60, want: 60},
+		{ttl: 300, minTTL: 60, want: 300},
+		{ttl: 1, minTTL: 0, want: 1},
+	} {
+		h := NewEntryHandler(EntryHandlerOpts{Entry: ttlExec(tt.ttl), MinTTL: tt.minTTL})
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		var resp *dns.Msg
+		h.Handle(context.Background(), q, server.QueryMeta{}, func(m *dns.Msg) (*[]byte, error) {
+			resp = m
+			b, err := m.Pack()
+			return &b, err
+		})
+		if resp == nil || len(resp.Answer) != 1 {
+			t.Fatalf("unexpected response %v", resp)
+		}
+		if got := resp.Answer[0].Header().Ttl; got != tt.want {
+			t.Errorf("ttl %d, min_ttl %d: got %d, want %d", tt.ttl, tt.minTTL, got, tt.want)
+		}
+	}
+}
+
+type upstreamExec string
+
+func (u upstreamExec) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	qCtx.StoreValue(query_context.KeyUpstream, string(u))
+	return replyExec{}.Exec(ctx, qCtx)
+}
+
+func Test_EntryHandler_TraceUpstream(t *testing.T) {
+	exchange := func(h *EntryHandler, withTrace bool) string {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.SetEdns0(1232, false)
+		if withTrace {
+			opt := q.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: TraceOptionCode})
+		}
+		var resp *dns.Msg
+		h.Handle(context.Background(), q, server.QueryMeta{}, func(m *dns.Msg) (*[]byte, error) {
+			resp = m
+			b, err := m.Pack()
+			return &b, err
+		})
+		if resp == nil {
+			t.Fatal("handler returned no response")
+		}
+		if opt := resp.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if ede, ok := o.(*dns.EDNS0_EDE); ok {
+					return ede.ExtraText
+				}
+			}
+		}
+		return ""
+	}
+
+	h := NewEntryHandler(EntryHandlerOpts{Entry: upstreamExec("google"), TraceUpstream: true})
+	if got, want := exchange(h, true), "upstream: google"; got != want {
+		t.Fatalf("trace = %q, want %q", got, want)
+	}
+	if got := exchange(h, false); got != "" {
+		t.Fatalf("trace should not be sent if client did not request it, got %q", got)
+	}
+
+	h = NewEntryHandler(EntryHandlerOpts{Entry: upstreamExec("google")})
+	if got := exchange(h, true); got != "" {
+		t.Fatalf("trace should not be sent if it is disabled, got %q", got)
+	}
+}
+
+func Test_EntryHandler_Malformed(t *testing.T) {
+	dupQuestion := func() *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.Question = append(q.Question, dns.Question{Name: "EXAMPLE.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		q.SetEdns0(1232, false)
+		q.Extra = append(q.Extra, q.Extra[0]) // Broken clients send duplicate OPT records.
+		return q
+	}
+	diffQuestion := func() *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.Question = append(q.Question, dns.Question{Name: "example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+		return q
+	}
+	response := func() *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.Response = true
+		return q
+	}
+
+	for _, tt := range []struct {
+		name      string
+		malformed string
+		q         *dns.Msg
+		wantRcode int // -1 means no response
+	}{
+		{"drop", "", dupQuestion(), -1},
+		{"formerr", MalformedFormErr, dupQuestion(), dns.RcodeFormatError},
+		{"repair duplicate question", MalformedRepair, dupQuestion(), dns.RcodeSuccess},
+		{"repair different questions", MalformedRepair, diffQuestion(), dns.RcodeFormatError},
+		{"never reply to responses", MalformedFormErr, response(), -1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewEntryHandler(EntryHandlerOpts{Entry: replyExec{}, Malformed: tt.malformed})
+			var resp *dns.Msg
+			h.Handle(context.Background(), tt.q, server.QueryMeta{}, func(m *dns.Msg) (*[]byte, error) {
+				resp = m
+				b, err := m.Pack()
+				return &b, err
+			})
+			if tt.wantRcode < 0 {
+				if resp != nil {
+					t.Fatalf("unexpected response %v", resp)
+				}
+				return
+			}
+			if resp == nil {
+				t.Fatal("handler returned no response")
+			}
+			if resp.Rcode != tt.wantRcode {
+				t.Fatalf("rcode = %d, want %d", resp.Rcode, tt.wantRcode)
+			}
+			if len(resp.Question) != 1 {
+				t.Fatalf("response has %d questions", len(resp.Question))
+			}
+		})
+	}
+}
+
+type panicExec struct{}
+
+func (panicExec) Exec(_ context.Context, qCtx *query_context.Context) error {
+	qCtx.SetResponse(new(dns.Msg))
+	panic("boom")
+}
+
+func Test_EntryHandler_Panic(t *testing.T) {
+	exchange := func(h *EntryHandler) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		var resp *dns.Msg
+		h.Handle(context.Background(), q, server.QueryMeta{}, func(m *dns.Msg) (*[]byte, error) {
+			resp = m
+			b, err := m.Pack()
+			return &b, err
+		})
+		if resp == nil {
+			t.Fatal("handler returned no response")
+		}
+		return resp
+	}
+
+	if r := exchange(NewEntryHandler(EntryHandlerOpts{Entry: panicExec{}})); r.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("want SERVFAIL, got %s", dns.RcodeToString[r.Rcode])
+	}
+
+	r := exchange(NewEntryHandler(EntryHandlerOpts{Entry: panicExec{}, EmergencyEntry: ttlExec(60)}))
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+		t.Fatalf("want the response of the emergency entry, got %v", r)
+	}
+}
+
+type tagExec struct{ tag *string }
+
+func (e tagExec) Exec(_ context.Context, qCtx *query_context.Context) error {
+	if v, ok := qCtx.GetValue(query_context.KeyClientTag); ok {
+		*e.tag = v.(string)
+	}
+	return replyExec{}.Exec(context.Background(), qCtx)
+}
+
+func Test_EntryHandler_ClientACL(t *testing.T) {
+	acl, err := NewClientACL(ClientACLOpts{
+		Allow: []string{"192.168.1.0/24"},
+		Deny:  []string{"192.168.1.66"},
+		Tags:  []ClientTagOpts{{Tag: "kids", Clients: []string{"192.168.1.64/28"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tag string
+	h := NewEntryHandler(EntryHandlerOpts{Entry: tagExec{tag: &tag}, ACL: acl})
+
+	exchange := func(client string) *dns.Msg {
+		tag = ""
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		var resp *dns.Msg
+		h.Handle(context.Background(), q, server.QueryMeta{ClientAddr: netip.MustParseAddr(client)}, func(m *dns.Msg) (*[]byte, error) {
+			resp = m
+			b, err := m.Pack()
+			return &b, err
+		})
+		return resp
+	}
+
+	if r := exchange("192.168.1.2"); r == nil || r.Rcode != dns.RcodeSuccess || tag != "" {
+		t.Fatalf("allowed client without tag: resp %v, tag %q", r, tag)
+	}
+	if r := exchange("192.168.1.65"); r == nil || r.Rcode != dns.RcodeSuccess || tag != "kids" {
+		t.Fatalf("allowed client with tag: resp %v, tag %q", r, tag)
+	}
+	if r := exchange("192.168.1.66"); r == nil || r.Rcode != dns.RcodeRefused {
+		t.Fatalf("denied client should be refused, got %v", r)
+	}
+	if r := exchange("10.0.0.1"); r == nil || r.Rcode != dns.RcodeRefused {
+		t.Fatalf("client not in allow list should be refused, got %v", r)
+	}
+
+	acl.drop = true
+	if r := exchange("10.0.0.1"); r != nil {
+		t.Fatalf("denied query should be dropped, got %v", r)
+	}
+}
+
+type dropExec struct{}
+
+func (dropExec) Exec(_ context.Context, qCtx *query_context.Context) error {
+	qCtx.StoreValue(query_context.KeyDropQuery, true)
+	return nil
+}
+
+func Test_EntryHandler_Drop(t *testing.T) {
+	h := NewEntryHandler(EntryHandlerOpts{Entry: dropExec{}})
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	payload := h.Handle(context.Background(), q, server.QueryMeta{}, func(m *dns.Msg) (*[]byte, error) {
+		b, err := m.Pack()
+		return &b, err
+	})
+	if payload != nil {
+		t.Fatal("dropped query should not be replied")
+	}
+}
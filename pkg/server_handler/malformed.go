@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Behaviors for malformed queries.
+const (
+	// MalformedDrop silently drops malformed queries. This is the default.
+	MalformedDrop = "drop"
+	// MalformedFormErr replies FORMERR to malformed queries.
+	MalformedFormErr = "formerr"
+	// MalformedRepair repairs malformed queries if possible and replies
+	// FORMERR to the others.
+	MalformedRepair = "repair"
+)
+
+// Actions recorded by EntryHandlerOpts.MalformedTotal.
+const (
+	malformedActionDropped  = "dropped"
+	malformedActionFormErr  = "formerr"
+	malformedActionRepaired = "repaired"
+)
+
+// ValidMalformedBehavior returns an error if s is not a valid behavior.
+// Empty s is valid and means MalformedDrop.
+func ValidMalformedBehavior(s string) error {
+	switch s {
+	case "", MalformedDrop, MalformedFormErr, MalformedRepair:
+		return nil
+	default:
+		return fmt.Errorf("invalid malformed query behavior %q", s)
+	}
+}
+
+// checkQuery returns a non-empty reason if q is malformed.
+func checkQuery(q *dns.Msg) string {
+	switch {
+	case q.Response:
+		return "response bit is set"
+	case len(q.Question) == 0:
+		return "no question"
+	case len(q.Question) > 1:
+		return "multiple questions"
+	case len(q.Answer)+len(q.Ns) > 0:
+		return "answer or authority records in query"
+	case len(q.Extra) > 1:
+		return "multiple additional records"
+	}
+	return ""
+}
+
+// repairQuery tries to turn q into a valid query in place. It reports
+// whether q was repaired.
+// Identical duplicate questions are merged, answer and authority sections
+// are removed and only the first OPT record is kept in the additional
+// section. Queries with a response bit or different questions cannot be
+// repaired.
+func repairQuery(q *dns.Msg) bool {
+	if q.Response || len(q.Question) == 0 {
+		return false
+	}
+	for _, qs := range q.Question[1:] {
+		if !strings.EqualFold(qs.Name, q.Question[0].Name) || qs.Qtype != q.Question[0].Qtype || qs.Qclass != q.Question[0].Qclass {
+			return false
+		}
+	}
+	q.Question = q.Question[:1]
+	q.Answer = nil
+	q.Ns = nil
+	if len(q.Extra) > 1 {
+		var opt dns.RR
+		for _, rr := range q.Extra {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				opt = rr
+				break
+			}
+		}
+		q.Extra = q.Extra[:0]
+		if opt != nil {
+			q.Extra = append(q.Extra, opt)
+		}
+	}
+	return checkQuery(q) == ""
+}
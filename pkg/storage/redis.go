@@ -0,0 +1,288 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+const (
+	redisDialTimeout   = time.Second * 5
+	redisIOTimeout     = time.Second * 5 // Timeout of a command without payload.
+	redisMinThroughput = 1 << 20         // Bytes per second, extends the timeout of large values.
+	redisDefaultPrefix = "mosdns:"
+)
+
+// Redis stores keys in a redis server with a key prefix. It uses a single
+// connection, which is enough for occasional state persistence.
+type Redis struct {
+	addr      string
+	tlsConfig *tls.Config // nil for plain tcp
+	user      string
+	password  string
+	db        int
+	prefix    string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewRedis creates a Redis from url "redis://[user:password@]host[:port][/db][?prefix=mosdns:]".
+// Scheme "rediss" connects with TLS, the server certificate is verified
+// with the system roots or the PEM file in query "ca".
+// The connection is established lazily.
+func NewRedis(u *url.URL) (*Redis, error) {
+	s := &Redis{addr: u.Host, prefix: redisDefaultPrefix}
+	if len(u.Port()) == 0 {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	q := u.Query()
+	if u.Scheme == "rediss" {
+		s.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+		if ca := q.Get("ca"); len(ca) > 0 {
+			pool, err := utils.LoadCertPool([]string{ca})
+			if err != nil {
+				return nil, fmt.Errorf("invalid redis ca, %w", err)
+			}
+			s.tlsConfig.RootCAs = pool
+		}
+	} else if q.Has("ca") {
+		return nil, errors.New("redis ca requires the rediss scheme")
+	}
+	if u.User != nil {
+		s.user = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); len(db) > 0 {
+		n, err := strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis db %s", db)
+		}
+		s.db = n
+	}
+	if q.Has("prefix") {
+		s.prefix = q.Get("prefix")
+	}
+	return s, nil
+}
+
+func (s *Redis) Get(ctx context.Context, key string) ([]byte, error) {
+	v, err := s.do(ctx, "GET", s.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, ErrNotFound
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected redis reply %v", v)
+	}
+	return b, nil
+}
+
+func (s *Redis) Put(ctx context.Context, key string, value []byte) error {
+	_, err := s.do(ctx, "SET", s.prefix+key, string(value))
+	return err
+}
+
+func (s *Redis) Delete(ctx context.Context, key string) error {
+	_, err := s.do(ctx, "DEL", s.prefix+key)
+	return err
+}
+
+func (s *Redis) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeConnLocked()
+}
+
+func (s *Redis) closeConnLocked() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn, s.r = nil, nil
+	return err
+}
+
+// do sends a command and reads its reply. The connection is dropped on
+// any network or protocol error, and redialed by the next command.
+func (s *Redis) do(ctx context.Context, args ...string) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.connectLocked(ctx); err != nil {
+			return nil, err
+		}
+	}
+	v, err := s.roundTripLocked(ctx, args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		s.closeConnLocked()
+	}
+	return v, err
+}
+
+func (s *Redis) connectLocked(ctx context.Context) error {
+	d := net.Dialer{Timeout: redisDialTimeout}
+	var (
+		c   net.Conn
+		err error
+	)
+	if s.tlsConfig != nil {
+		td := tls.Dialer{NetDialer: &d, Config: s.tlsConfig}
+		c, err = td.DialContext(ctx, "tcp", s.addr)
+	} else {
+		c, err = d.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn, s.r = c, bufio.NewReader(c)
+
+	if len(s.password) > 0 {
+		args := []string{"AUTH", s.password}
+		if len(s.user) > 0 {
+			args = []string{"AUTH", s.user, s.password}
+		}
+		if _, err := s.roundTripLocked(ctx, args...); err != nil {
+			s.closeConnLocked()
+			return fmt.Errorf("redis auth failed, %w", err)
+		}
+	}
+	if s.db != 0 {
+		if _, err := s.roundTripLocked(ctx, "SELECT", strconv.Itoa(s.db)); err != nil {
+			s.closeConnLocked()
+			return fmt.Errorf("redis select failed, %w", err)
+		}
+	}
+	return nil
+}
+
+// roundTripLocked sends a command and reads its reply. If ctx has no
+// deadline, the timeout grows with the size of the command and of the
+// bulk replies, so large values can be transferred on slow links.
+func (s *Redis) roundTripLocked(ctx context.Context, args ...string) (any, error) {
+	ddl, hasDDL := ctx.Deadline()
+	extend := func(n int) {
+		if !hasDDL {
+			s.conn.SetDeadline(time.Now().Add(redisTimeout(n)))
+		}
+	}
+	if hasDDL {
+		s.conn.SetDeadline(ddl)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	extend(b.Len())
+	if _, err := io.WriteString(s.conn, b.String()); err != nil {
+		return nil, err
+	}
+	extend(0)
+	return readRESP(s.r, extend)
+}
+
+// redisTimeout returns the io timeout to transfer n bytes.
+func redisTimeout(n int) time.Duration {
+	return redisIOTimeout + time.Duration(n)*time.Second/redisMinThroughput
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// readRESP reads a RESP2 reply. Bulk strings are returned as []byte,
+// null replies as nil. If bulk is not nil, it is called with the length of
+// each bulk string before it is read.
+func readRESP(r *bufio.Reader, bulk func(n int)) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("invalid redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		if bulk != nil {
+			bulk(n)
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		vs := make([]any, 0, n)
+		for i := 0; i < n; i++ {
+			v, err := readRESP(r, bulk)
+			if err != nil {
+				return nil, err
+			}
+			vs = append(vs, v)
+		}
+		return vs, nil
+	default:
+		return nil, fmt.Errorf("invalid redis reply %q", line)
+	}
+}
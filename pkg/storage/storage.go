@@ -0,0 +1,160 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package storage provides a small key-value interface for plugin state,
+// so it can be kept in a local directory, a bbolt database or Redis.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ErrNotFound is returned by Storage.Get if the key does not exist.
+var ErrNotFound = errors.New("storage: key not found")
+
+// Storage is a key-value store. Keys are slash separated paths,
+// e.g. "adguard/config.json". Implementations are safe for concurrent use.
+type Storage interface {
+	// Get returns the value of key, or ErrNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put stores value atomically, replacing the old value.
+	Put(ctx context.Context, key string, value []byte) error
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+	Close() error
+}
+
+// Open opens a storage by its url. Supported urls are:
+//
+//	/path/to/dir, file:///path/to/dir    files in a directory
+//	bolt:///path/to/file.db               a bbolt database
+//	redis://[:password@]host:port[/db]    a redis server
+//	rediss://[:password@]host:port[/db]   a redis server over tls
+//
+// Storages of the same url are shared. Each returned Storage must be
+// closed, the underlying storage is closed after the last one.
+func Open(s string) (Storage, error) {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	if e, ok := shared[s]; ok {
+		e.refs++
+		return &sharedRef{e: e}, nil
+	}
+	st, err := open(s)
+	if err != nil {
+		return nil, err
+	}
+	e := &sharedEntry{url: s, s: st, refs: 1}
+	shared[s] = e
+	return &sharedRef{e: e}, nil
+}
+
+func open(s string) (Storage, error) {
+	if !strings.Contains(s, "://") {
+		return NewFS(s)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage url, %w", err)
+	}
+	switch u.Scheme {
+	case "file":
+		return NewFS(u.Host + u.Path)
+	case "bolt", "bbolt":
+		return NewBolt(u.Host + u.Path)
+	case "redis", "rediss":
+		return NewRedis(u)
+	default:
+		return nil, fmt.Errorf("unsupported storage scheme %s", u.Scheme)
+	}
+}
+
+var (
+	sharedMu sync.Mutex
+	shared   = make(map[string]*sharedEntry)
+)
+
+type sharedEntry struct {
+	url  string
+	s    Storage
+	refs int
+}
+
+type sharedRef struct {
+	e         *sharedEntry
+	closeOnce sync.Once
+}
+
+func (r *sharedRef) Get(ctx context.Context, key string) ([]byte, error) {
+	return r.e.s.Get(ctx, key)
+}
+
+func (r *sharedRef) Put(ctx context.Context, key string, value []byte) error {
+	return r.e.s.Put(ctx, key, value)
+}
+
+func (r *sharedRef) Delete(ctx context.Context, key string) error {
+	return r.e.s.Delete(ctx, key)
+}
+
+func (r *sharedRef) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		sharedMu.Lock()
+		defer sharedMu.Unlock()
+		r.e.refs--
+		if r.e.refs == 0 {
+			delete(shared, r.e.url)
+			err = r.e.s.Close()
+		}
+	})
+	return err
+}
+
+// WithPrefix returns a Storage that adds prefix to all keys of s.
+// Closing it closes s.
+func WithPrefix(s Storage, prefix string) Storage {
+	return &prefixed{s: s, prefix: prefix}
+}
+
+type prefixed struct {
+	s      Storage
+	prefix string
+}
+
+func (p *prefixed) Get(ctx context.Context, key string) ([]byte, error) {
+	return p.s.Get(ctx, p.prefix+key)
+}
+
+func (p *prefixed) Put(ctx context.Context, key string, value []byte) error {
+	return p.s.Put(ctx, p.prefix+key, value)
+}
+
+func (p *prefixed) Delete(ctx context.Context, key string) error {
+	return p.s.Delete(ctx, p.prefix+key)
+}
+
+func (p *prefixed) Close() error {
+	return p.s.Close()
+}
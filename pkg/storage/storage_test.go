@@ -0,0 +1,403 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+func testStorage(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := s.Get(ctx, "a/b"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want ErrNotFound, got %v", err)
+	}
+	if err := s.Put(ctx, "a/b", []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, "a/b", []byte("v2\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := s.Get(ctx, "a/b"); err != nil || string(b) != "v2\r\n" {
+		t.Fatalf("unexpected value %q, %v", b, err)
+	}
+	if err := s.Delete(ctx, "a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "a/b"); err != nil {
+		t.Fatalf("deleting a missing key should not fail, %v", err)
+	}
+	if _, err := s.Get(ctx, "a/b"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("want ErrNotFound after delete, got %v", err)
+	}
+}
+
+func Test_FS(t *testing.T) {
+	s, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, s)
+	if err := s.Put(context.Background(), "../escape", nil); err == nil {
+		t.Fatal("keys outside the dir should be rejected")
+	}
+}
+
+func Test_Bolt(t *testing.T) {
+	s, err := NewBolt(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testStorage(t, s)
+}
+
+func Test_Open_shared(t *testing.T) {
+	u := "bolt://" + filepath.Join(t.TempDir(), "state.db")
+	s1, err := Open(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bbolt locks its file, a second open would time out if not shared.
+	s2, err := Open(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := WithPrefix(s2, "tag/")
+	if err := p.Put(context.Background(), "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := s1.Get(context.Background(), "tag/k"); err != nil || string(b) != "v" {
+		t.Fatalf("unexpected value %q, %v", b, err)
+	}
+	p.Close()
+	if _, err := s1.Get(context.Background(), "tag/k"); err != nil {
+		t.Fatalf("storage should be open until the last ref is closed, %v", err)
+	}
+	s1.Close()
+	if len(shared) != 0 {
+		t.Fatal("storage should be released")
+	}
+}
+
+// redisStub is a RESP2 server that implements the commands used by Redis
+// the way redis-server does. It parses requests on its own, so it does not
+// share bugs with the client.
+type redisStub struct {
+	user, password string // AUTH is required if password is set
+	hang           atomic.Bool
+	conns          atomic.Int32
+
+	mu  sync.Mutex
+	dbs map[int]map[string]string
+}
+
+// serve serves l until the test ends and returns its address.
+func (s *redisStub) serve(t *testing.T, l net.Listener) string {
+	t.Cleanup(func() { l.Close() })
+	s.dbs = make(map[int]map[string]string)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			go s.handle(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (s *redisStub) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	authed := len(s.password) == 0
+	db := 0
+	for {
+		args, err := readStubCommand(r)
+		if err != nil {
+			return
+		}
+		if s.hang.Load() {
+			continue // never reply
+		}
+		cmd := strings.ToUpper(args[0])
+		if !authed && cmd != "AUTH" {
+			fmt.Fprint(c, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		s.mu.Lock()
+		m := s.dbs[db]
+		if m == nil {
+			m = make(map[string]string)
+			s.dbs[db] = m
+		}
+		switch {
+		case cmd == "AUTH" && (len(args) == 2 || len(args) == 3):
+			user := "default"
+			if len(args) == 3 {
+				user = args[1]
+			}
+			if args[len(args)-1] == s.password && (user == "default" || user == s.user) {
+				authed = true
+				fmt.Fprint(c, "+OK\r\n")
+			} else {
+				fmt.Fprint(c, "-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+			}
+		case cmd == "SELECT" && len(args) == 2:
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 0 || n > 15 {
+				fmt.Fprint(c, "-ERR DB index is out of range\r\n")
+				break
+			}
+			db = n
+			fmt.Fprint(c, "+OK\r\n")
+		case cmd == "SET" && len(args) == 3:
+			m[args[1]] = args[2]
+			fmt.Fprint(c, "+OK\r\n")
+		case cmd == "GET" && len(args) == 2:
+			if v, ok := m[args[1]]; ok {
+				fmt.Fprintf(c, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				fmt.Fprint(c, "$-1\r\n")
+			}
+		case cmd == "DEL" && len(args) >= 2:
+			n := 0
+			for _, k := range args[1:] {
+				if _, ok := m[k]; ok {
+					delete(m, k)
+					n++
+				}
+			}
+			fmt.Fprintf(c, ":%d\r\n", n)
+		default:
+			fmt.Fprintf(c, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		s.mu.Unlock()
+	}
+}
+
+// readStubCommand reads a command sent as a RESP array of bulk strings.
+func readStubCommand(r *bufio.Reader) ([]string, error) {
+	readLine := func(prefix byte) (int, error) {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		if len(line) < 3 || line[0] != prefix || !strings.HasSuffix(line, "\r\n") {
+			return 0, fmt.Errorf("protocol error, got %q", line)
+		}
+		return strconv.Atoi(line[1 : len(line)-2])
+	}
+	n, err := readLine('*')
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, errors.New("empty command")
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := readLine('$')
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, l+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		if string(b[l:]) != "\r\n" {
+			return nil, errors.New("protocol error, bulk string without crlf")
+		}
+		args = append(args, string(b[:l]))
+	}
+	return args, nil
+}
+
+func listenStub(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func Test_Redis(t *testing.T) {
+	stub := &redisStub{}
+	s, err := open("redis://" + stub.serve(t, listenStub(t)) + "/1?prefix=test:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testStorage(t, s)
+
+	// Keys are stored with the prefix in the selected db.
+	if err := s.Put(context.Background(), "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	stub.mu.Lock()
+	v, ok := stub.dbs[1]["test:k"]
+	stub.mu.Unlock()
+	if !ok || v != "v" {
+		t.Fatalf("key not stored in db 1 with the prefix, %v", stub.dbs)
+	}
+}
+
+func Test_Redis_auth(t *testing.T) {
+	stub := &redisStub{user: "mosdns", password: "secret"}
+	addr := stub.serve(t, listenStub(t))
+	for u, ok := range map[string]bool{
+		"redis://:secret@" + addr:         true,
+		"redis://mosdns:secret@" + addr:   true,
+		"redis://:wrong@" + addr:          false,
+		"redis://mosdns:wrong@" + addr:    false,
+		"redis://" + addr:                 false,
+		"redis://:secret@" + addr + "/16": false, // db out of range
+	} {
+		s, err := open(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Put(context.Background(), "k", []byte("v"))
+		if (err == nil) != ok {
+			t.Errorf("%s: want ok %v, got %v", u, ok, err)
+		}
+		s.Close()
+	}
+}
+
+func Test_Redis_tls(t *testing.T) {
+	cert, err := utils.GenerateCertificate("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := tls.NewListener(listenStub(t), &tls.Config{Certificates: []tls.Certificate{cert}})
+	_, port, _ := net.SplitHostPort((&redisStub{}).serve(t, l))
+
+	s, err := open("rediss://localhost:" + port + "?ca=" + url.QueryEscape(ca))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testStorage(t, s)
+
+	// The certificate is not trusted by the system roots.
+	s2, err := open("rediss://localhost:" + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	var certErr *tls.CertificateVerificationError
+	if _, err := s2.Get(context.Background(), "k"); !errors.As(err, &certErr) {
+		t.Fatalf("want a certificate error, got %v", err)
+	}
+
+	if _, err := open("redis://localhost:" + port + "?ca=" + url.QueryEscape(ca)); err == nil {
+		t.Fatal("ca without tls should be rejected")
+	}
+}
+
+func Test_Redis_largeValue(t *testing.T) {
+	s, err := open("redis://" + (&redisStub{}).serve(t, listenStub(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	v := bytes.Repeat([]byte("0123456789abcdef\r\n"), 1<<18) // 4.5 MiB
+	if err := s.Put(context.Background(), "big", v); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := s.Get(context.Background(), "big"); err != nil || !bytes.Equal(b, v) {
+		t.Fatalf("large value mismatch, %v", err)
+	}
+}
+
+func Test_redisTimeout(t *testing.T) {
+	if d := redisTimeout(0); d != redisIOTimeout {
+		t.Fatalf("want %v for an empty command, got %v", redisIOTimeout, d)
+	}
+	if d := redisTimeout(100 << 20); d != redisIOTimeout+100*time.Second {
+		t.Fatalf("want the timeout to grow with the payload, got %v", d)
+	}
+}
+
+func Test_Redis_deadline(t *testing.T) {
+	stub := &redisStub{}
+	s, err := open("redis://" + stub.serve(t, listenStub(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Put(context.Background(), "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	stub.hang.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := s.Get(ctx, "k"); err == nil {
+		t.Fatal("want a timeout")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("the deadline of ctx was not applied")
+	}
+
+	// The connection of the timed out command is dropped and redialed.
+	stub.hang.Store(false)
+	if b, err := s.Get(context.Background(), "k"); err != nil || string(b) != "v" {
+		t.Fatalf("unexpected value %q, %v", b, err)
+	}
+	if n := stub.conns.Load(); n != 2 {
+		t.Fatalf("want 2 connections, got %d", n)
+	}
+
+	// Error replies keep the connection.
+	if _, err := s.(*Redis).do(context.Background(), "NOPE"); err == nil {
+		t.Fatal("want an error reply")
+	}
+	if _, err := s.Get(context.Background(), "k"); err != nil || stub.conns.Load() != 2 {
+		t.Fatalf("connection dropped after an error reply, %v", err)
+	}
+}
@@ -29,6 +29,13 @@ type Event int
 const (
 	EventConnOpen Event = iota
 	EventConnClose
+
+	// EventUDPTruncated is emitted when a udp upstream replies a truncated response.
+	EventUDPTruncated
+
+	// EventUDP0x20Mismatch is emitted when a udp upstream with 0x20
+	// enabled replies a response with a mismatched question name.
+	EventUDP0x20Mismatch
 )
 
 type EventObserver interface {
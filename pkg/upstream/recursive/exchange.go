@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursive
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// exchangeNet sends q to server over udp, and retries over tcp if the
+// response was truncated.
+func (r *Resolver) exchangeNet(ctx context.Context, server netip.Addr, q *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	resp, err := r.exchangeConn(ctx, "udp", server, q)
+	if err == nil && resp.Truncated {
+		resp, err = r.exchangeConn(ctx, "tcp", server, q)
+	}
+	return resp, err
+}
+
+func (r *Resolver) exchangeConn(ctx context.Context, network string, server netip.Addr, q *dns.Msg) (*dns.Msg, error) {
+	dialer := r.udpDialer
+	if network == "tcp" {
+		dialer = r.tcpDialer
+	}
+	c, err := dialer.DialContext(ctx, network, netip.AddrPortFrom(server, 53).String())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	q = q.Copy()
+	q.Id = dns.Id()
+	conn := &dns.Conn{Conn: c, UDPSize: ednsSize}
+	if err := conn.WriteMsg(q); err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := conn.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Id == q.Id && questionMatch(q, resp) {
+			return resp, nil
+		}
+		// Stream connections are not spoofable, the server is broken.
+		if _, ok := c.(net.PacketConn); !ok {
+			return nil, fmt.Errorf("%s replied a mismatched response", server)
+		}
+	}
+}
+
+func questionMatch(q, resp *dns.Msg) bool {
+	if len(resp.Question) != 1 {
+		return false
+	}
+	a, b := q.Question[0], resp.Question[0]
+	return a.Qtype == b.Qtype && a.Qclass == b.Qclass && strings.EqualFold(a.Name, b.Name)
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursive
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	maxInfraEntries  = 16384
+	minDelegationTTL = time.Second * 30
+	maxDelegationTTL = time.Hour * 24
+)
+
+// delegation is a zone cut learnt from a referral. It is immutable once
+// it was put into the infraCache.
+type delegation struct {
+	zone   string       // lower case fqdn
+	ns     []string     // names of the name servers
+	addrs  []netip.Addr // addresses of the name servers, from glue or resolved
+	expire time.Time
+}
+
+func (d *delegation) withAddrs(addrs []netip.Addr) *delegation {
+	nd := *d
+	nd.addrs = addrs
+	return &nd
+}
+
+// infraCache caches the delegations, so the name servers of a zone don't
+// have to be found from the root for every query.
+type infraCache struct {
+	root *delegation // from the root hints
+
+	mu sync.Mutex
+	m  map[string]*delegation
+}
+
+func newInfraCache(roots []netip.Addr) *infraCache {
+	return &infraCache{
+		root: &delegation{zone: ".", addrs: roots}, // never expires
+		m:    make(map[string]*delegation),
+	}
+}
+
+// closest returns the cached delegation of the deepest zone that contains
+// qname. If parentSide is true, the delegation of qname itself is skipped,
+// e.g. DS records are served by the parent zone.
+func (c *infraCache) closest(qname string, parentSide bool) *delegation {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := qname; name != "."; {
+		if !(parentSide && name == qname) {
+			if d := c.m[name]; d != nil {
+				if now.Before(d.expire) {
+					return d
+				}
+				delete(c.m, name)
+			}
+		}
+		off, end := dns.NextLabel(name, 0)
+		if end {
+			break
+		}
+		name = name[off:]
+	}
+	return c.root
+}
+
+// put caches d. If the cache is full, it is dropped.
+func (c *infraCache) put(d *delegation) {
+	if d.zone == "." {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.m) >= maxInfraEntries {
+		for zone, v := range c.m {
+			if !now.Before(v.expire) {
+				delete(c.m, zone)
+			}
+		}
+		if len(c.m) >= maxInfraEntries {
+			return
+		}
+	}
+	c.m[d.zone] = d
+}
+
+func (c *infraCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.m)
+}
@@ -0,0 +1,478 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package recursive implements an iterative resolver that resolves
+// queries from the root servers without any forwarder.
+package recursive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	ednsSize     = 1232
+	queryTimeout = time.Millisecond * 1500 // per query to an authoritative server
+
+	maxReferrals = 32  // per name
+	maxCNAMEs    = 8   // per client query
+	maxDepth     = 4   // nested resolutions of name server addresses
+	maxQueries   = 128 // queries to authoritative servers per client query
+	maxNSLookups = 3   // name servers without glue resolved per zone
+
+	// See RFC 9156 section 2.3.
+	maxMinimiseCount = 10
+	minimiseOneLab   = 4
+)
+
+var (
+	errTooManyQueries = errors.New("too many queries to authoritative servers")
+	errTooDeep        = errors.New("name server resolution is too deep")
+)
+
+type Opts struct {
+	// RootHints are the addresses of the root servers.
+	// Default is the IANA root servers.
+	RootHints []netip.Addr
+
+	// UDPDialer and TCPDialer dial the authoritative servers. Optional.
+	UDPDialer *net.Dialer
+	TCPDialer *net.Dialer
+
+	// QNAMEMinimization sends only the labels needed to find the next
+	// zone cut to each authoritative server (RFC 9156), instead of the
+	// full query name.
+	QNAMEMinimization bool
+
+	Logger *zap.Logger
+}
+
+// Resolver resolves queries iteratively from the root servers. It follows
+// referrals and CNAMEs and caches the delegations in an infrastructure
+// cache. Answers are not cached, use a cache plugin for that.
+//
+// Queries to authoritative servers have the DO bit, so responses carry
+// DNSSEC records and can be validated by the dnssec_validator plugin. DS
+// queries are sent to the parent side of the zone cut.
+type Resolver struct {
+	logger    *zap.Logger
+	infra     *infraCache
+	udpDialer *net.Dialer
+	tcpDialer *net.Dialer
+	qmin      bool
+
+	// exchange sends q to a server. It can be replaced in tests.
+	exchange func(ctx context.Context, server netip.Addr, q *dns.Msg) (*dns.Msg, error)
+}
+
+func NewResolver(opts Opts) *Resolver {
+	roots := opts.RootHints
+	if len(roots) == 0 {
+		roots = rootHints
+	}
+	r := &Resolver{
+		logger:    opts.Logger,
+		infra:     newInfraCache(roots),
+		udpDialer: opts.UDPDialer,
+		tcpDialer: opts.TCPDialer,
+		qmin:      opts.QNAMEMinimization,
+	}
+	if r.logger == nil {
+		r.logger = zap.NewNop()
+	}
+	if r.udpDialer == nil {
+		r.udpDialer = new(net.Dialer)
+	}
+	if r.tcpDialer == nil {
+		r.tcpDialer = new(net.Dialer)
+	}
+	r.exchange = r.exchangeNet
+	return r
+}
+
+// ExchangeContext implements upstream.Upstream.
+func (r *Resolver) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		return nil, fmt.Errorf("invalid query, %w", err)
+	}
+	resp, err := r.Resolve(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return pool.PackBuffer(resp)
+}
+
+func (r *Resolver) Close() error {
+	return nil
+}
+
+// resolution is the state of one client query.
+type resolution struct {
+	queries int
+}
+
+// Resolve resolves q, which must have exactly one question. DNSSEC records
+// are kept in the response only if q has the DO bit.
+func (r *Resolver) Resolve(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if len(q.Question) != 1 {
+		return nil, errors.New("query must have exactly one question")
+	}
+	question := q.Question[0]
+	opt := q.IsEdns0()
+	do := opt != nil && opt.Do()
+
+	st := new(resolution)
+	qname := strings.ToLower(dns.Fqdn(question.Name))
+	var answer []dns.RR
+	var final *dns.Msg
+	for i := 0; ; i++ {
+		resp, err := r.resolve(ctx, st, qname, question.Qtype, 0)
+		if err != nil {
+			return nil, err
+		}
+		final = resp
+		rrs, target := chase(resp, qname, question.Qtype)
+		answer = append(answer, rrs...)
+		if len(target) == 0 || i >= maxCNAMEs {
+			break
+		}
+		qname = target
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	resp.RecursionAvailable = true
+	resp.Rcode = final.Rcode
+	resp.Answer = answer
+	if !hasType(answer, question.Qtype) {
+		resp.Ns = final.Ns // SOA and NSEC of negative responses
+	}
+	if !do {
+		resp.Answer = stripDNSSEC(resp.Answer, question.Qtype)
+		resp.Ns = stripDNSSEC(resp.Ns, question.Qtype)
+	}
+	if opt != nil {
+		resp.SetEdns0(ednsSize, do)
+	}
+	return resp, nil
+}
+
+// chase returns the records in resp.Answer that belong to qname and the
+// CNAME chain starting from it. target is the last name of the chain if the
+// records of qtype of it are not in resp and must be resolved separately.
+func chase(resp *dns.Msg, qname string, qtype uint16) (rrs []dns.RR, target string) {
+	name := qname
+	found := false // records of name, other than CNAME, are in resp
+	for i := 0; i <= maxCNAMEs; i++ {
+		var next string
+		for _, rr := range resp.Answer {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			rrs = append(rrs, rr)
+			if c, ok := rr.(*dns.CNAME); ok && qtype != dns.TypeCNAME {
+				next = strings.ToLower(c.Target)
+			} else {
+				found = true
+			}
+		}
+		if len(next) == 0 || next == name {
+			break
+		}
+		name, found = next, false
+	}
+	if name == qname || found || resp.Rcode != dns.RcodeSuccess {
+		return rrs, ""
+	}
+	return rrs, name
+}
+
+func hasType(rrs []dns.RR, qtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// stripDNSSEC removes DNSSEC records except those of qtype.
+func stripDNSSEC(rrs []dns.RR, qtype uint16) []dns.RR {
+	res := rrs[:0]
+	for _, rr := range rrs {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeDS:
+			if t != qtype {
+				continue
+			}
+		}
+		res = append(res, rr)
+	}
+	return res
+}
+
+// resolve follows the referrals from the closest cached delegation of qname
+// and returns the response of the authoritative server.
+func (r *Resolver) resolve(ctx context.Context, st *resolution, qname string, qtype uint16, depth int) (*dns.Msg, error) {
+	d := r.infra.closest(qname, qtype == dns.TypeDS)
+
+	// Labels of the minimised name. It stops above the zone cut of DS
+	// queries, which are answered by the parent.
+	minimise := r.qmin
+	labels, limit := dns.CountLabel(d.zone), dns.CountLabel(qname)
+	if qtype == dns.TypeDS {
+		limit--
+	}
+	iter := 0
+
+	for i := 0; i < maxReferrals+maxMinimiseCount; i++ {
+		name, t := qname, qtype
+		if minimise && labels < limit {
+			labels = minimisedLabels(labels, limit, iter)
+			iter++
+			name, t = lastLabels(qname, labels), dns.TypeA
+		}
+		resp, err := r.queryZone(ctx, st, d, name, t, depth)
+		if err != nil {
+			if name != qname && !errors.Is(err, errTooManyQueries) && ctx.Err() == nil {
+				minimise = false // some servers cannot handle minimised names
+				continue
+			}
+			return nil, err
+		}
+		next := referral(resp, d.zone, name)
+		if next != nil && !(qtype == dns.TypeDS && next.zone == qname) {
+			r.logger.Debug("referral", zap.String("qname", name), zap.String("from", d.zone), zap.String("to", next.zone))
+			r.infra.put(next)
+			d = next
+			labels = dns.CountLabel(next.zone)
+			continue
+		}
+		if name == qname && t == qtype {
+			return resp, nil
+		}
+		// The minimised name is not a zone cut. NXDOMAIN of an empty
+		// non-terminal is a known bug of some servers, so the full name
+		// is asked instead of stopping there (the relaxed mode of RFC 9156).
+		if resp.Rcode == dns.RcodeNameError {
+			minimise = false
+		}
+	}
+	return nil, fmt.Errorf("too many referrals for %s", qname)
+}
+
+// minimisedLabels returns the number of labels of the next minimised name,
+// RFC 9156 section 2.3. The first queries add one label each, then the
+// remaining labels are spread over the remaining queries.
+func minimisedLabels(labels, limit, iter int) int {
+	if iter < minimiseOneLab {
+		return labels + 1
+	}
+	remaining := maxMinimiseCount - iter
+	if remaining <= 1 {
+		return limit
+	}
+	return min(limit, labels+max(1, (limit-labels)/remaining))
+}
+
+// lastLabels returns the last n labels of name.
+func lastLabels(name string, n int) string {
+	idx := dns.Split(name)
+	if n >= len(idx) {
+		return name
+	}
+	return name[idx[len(idx)-n]:]
+}
+
+// referral returns the delegation in resp if resp is a referral from zone
+// to a zone below it that contains qname. Glue records outside of zone are
+// ignored.
+func referral(resp *dns.Msg, zone, qname string) *delegation {
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 || resp.Authoritative && hasType(resp.Ns, dns.TypeSOA) {
+		return nil
+	}
+	var child string
+	var ns []string
+	ttl := maxDelegationTTL
+	for _, rr := range resp.Ns {
+		v, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(v.Hdr.Name)
+		if len(child) == 0 {
+			if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, qname) {
+				return nil
+			}
+			child = owner
+		}
+		if owner != child {
+			continue
+		}
+		ns = append(ns, strings.ToLower(v.Ns))
+		ttl = min(ttl, time.Duration(v.Hdr.Ttl)*time.Second)
+	}
+	if len(ns) == 0 {
+		return nil
+	}
+
+	d := &delegation{zone: child, ns: ns, expire: time.Now().Add(max(ttl, minDelegationTTL))}
+	for _, rr := range resp.Extra {
+		owner := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(zone, owner) || !contains(ns, owner) {
+			continue
+		}
+		var addr netip.Addr
+		switch v := rr.(type) {
+		case *dns.A:
+			addr, _ = netip.AddrFromSlice(v.A.To4())
+		case *dns.AAAA:
+			addr, _ = netip.AddrFromSlice(v.AAAA)
+		}
+		if addr.IsValid() {
+			d.addrs = append(d.addrs, addr)
+		}
+	}
+	return d
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// queryZone sends the query to the name servers of d until one replies
+// with a usable response.
+func (r *Resolver) queryZone(ctx context.Context, st *resolution, d *delegation, qname string, qtype uint16, depth int) (*dns.Msg, error) {
+	addrs := d.addrs
+	if len(addrs) == 0 {
+		var err error
+		if addrs, err = r.lookupNS(ctx, st, d, depth); err != nil {
+			return nil, err
+		}
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(qname, qtype)
+	q.RecursionDesired = false
+	q.SetEdns0(ednsSize, true)
+	var lastErr error
+	for _, addr := range shuffle(addrs) {
+		if st.queries++; st.queries > maxQueries {
+			return nil, errTooManyQueries
+		}
+		resp, err := r.exchange(ctx, addr, q)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, context.Cause(ctx)
+			}
+			lastErr = err
+			continue
+		}
+		switch resp.Rcode {
+		case dns.RcodeSuccess, dns.RcodeNameError:
+			return resp, nil
+		default: // e.g. lame delegations reply REFUSED or SERVFAIL
+			lastErr = fmt.Errorf("%s replied %s", addr, dns.RcodeToString[resp.Rcode])
+		}
+	}
+	return nil, fmt.Errorf("no name server of %s replied %s, last error: %w", d.zone, qname, lastErr)
+}
+
+// shuffle returns the addresses in random order, ipv4 first.
+func shuffle(addrs []netip.Addr) []netip.Addr {
+	s := make([]netip.Addr, 0, len(addrs))
+	for _, v6 := range []bool{false, true} {
+		n := len(s)
+		for _, addr := range addrs {
+			if addr.Is6() == v6 {
+				s = append(s, addr)
+			}
+		}
+		part := s[n:]
+		rand.Shuffle(len(part), func(i, j int) { part[i], part[j] = part[j], part[i] })
+	}
+	return s
+}
+
+// lookupNS resolves the addresses of the name servers of d, which had no
+// glue, and caches them.
+func (r *Resolver) lookupNS(ctx context.Context, st *resolution, d *delegation, depth int) ([]netip.Addr, error) {
+	if depth >= maxDepth {
+		return nil, errTooDeep
+	}
+	var addrs []netip.Addr
+	var lastErr error
+	tried := 0
+	for _, ns := range d.ns {
+		// Without glue, name servers inside the zone cannot be reached.
+		if dns.IsSubDomain(d.zone, ns) {
+			continue
+		}
+		if tried++; tried > maxNSLookups {
+			break
+		}
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			resp, err := r.resolve(ctx, st, ns, qtype, depth+1)
+			if err != nil {
+				lastErr = err
+				break
+			}
+			rrs, _ := chase(resp, ns, qtype)
+			for _, rr := range rrs {
+				switch v := rr.(type) {
+				case *dns.A:
+					addr, _ := netip.AddrFromSlice(v.A.To4())
+					addrs = append(addrs, addr)
+				case *dns.AAAA:
+					addr, _ := netip.AddrFromSlice(v.AAAA)
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+		if len(addrs) > 0 {
+			break
+		}
+	}
+	if len(addrs) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no address")
+		}
+		return nil, fmt.Errorf("failed to resolve name servers of %s, %w", d.zone, lastErr)
+	}
+	if d.zone != "." {
+		r.infra.put(d.withAddrs(addrs))
+	}
+	return addrs, nil
+}
@@ -0,0 +1,263 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursive
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// fakeNet serves zones of a fake dns tree.
+type fakeNet struct {
+	mu      sync.Mutex
+	servers map[netip.Addr]func(q dns.Question) *dns.Msg
+	queries []string // "server qname qtype"
+}
+
+func (f *fakeNet) exchange(_ context.Context, server netip.Addr, q *dns.Msg) (*dns.Msg, error) {
+	f.mu.Lock()
+	f.queries = append(f.queries, server.String()+" "+q.Question[0].Name+" "+dns.TypeToString[q.Question[0].Qtype])
+	h := f.servers[server]
+	f.mu.Unlock()
+	r := h(q.Question[0])
+	rcode := r.Rcode
+	r.SetReply(q)
+	r.Rcode = rcode
+	return r, nil
+}
+
+func rr(s string) dns.RR {
+	v, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+var (
+	rootAddr = netip.MustParseAddr("192.0.2.1")
+	tldAddr  = netip.MustParseAddr("192.0.2.2")
+	exAddr   = netip.MustParseAddr("192.0.2.3")
+)
+
+func newFakeNet() *fakeNet {
+	return &fakeNet{servers: map[netip.Addr]func(q dns.Question) *dns.Msg{
+		rootAddr: func(q dns.Question) *dns.Msg {
+			m := new(dns.Msg)
+			tld := "com."
+			if dns.IsSubDomain("net.", q.Name) {
+				tld = "net."
+			}
+			m.Ns = []dns.RR{rr(tld + " 3600 IN NS a.gtld."), rr(tld + " 3600 IN DS 1 8 2 AAAA")}
+			m.Extra = []dns.RR{rr("a.gtld. 3600 IN A 192.0.2.2")}
+			return m
+		},
+		tldAddr: func(q dns.Question) *dns.Msg {
+			m := new(dns.Msg)
+			switch {
+			case q.Qtype == dns.TypeDS && q.Name == "example.com.":
+				m.Authoritative = true
+				m.Answer = []dns.RR{rr("example.com. 3600 IN DS 2 8 2 BBBB")}
+			case dns.IsSubDomain("example.com.", q.Name):
+				m.Ns = []dns.RR{rr("example.com. 3600 IN NS ns1.example.com.")}
+				m.Extra = []dns.RR{
+					rr("ns1.example.com. 3600 IN A 192.0.2.3"),
+					rr("victim.org. 3600 IN A 198.51.100.1"), // out of bailiwick
+				}
+			case dns.IsSubDomain("example.net.", q.Name):
+				m.Ns = []dns.RR{rr("example.net. 3600 IN NS ns1.example.com.")} // no glue
+			default:
+				m.Authoritative = true
+				m.Rcode = dns.RcodeNameError
+				m.Ns = []dns.RR{rr(". 3600 IN SOA a. b. 1 2 3 4 5")}
+			}
+			return m
+		},
+		exAddr: func(q dns.Question) *dns.Msg {
+			m := new(dns.Msg)
+			m.Authoritative = true
+			switch {
+			case q.Name == "www.example.com.":
+				m.Answer = []dns.RR{rr("www.example.com. 300 IN CNAME cdn.example.net.")}
+			case q.Name == "ns1.example.com." && q.Qtype == dns.TypeA:
+				m.Answer = []dns.RR{rr("ns1.example.com. 300 IN A 192.0.2.3")}
+			case q.Name == "cdn.example.net." && q.Qtype == dns.TypeA:
+				m.Answer = []dns.RR{
+					rr("cdn.example.net. 300 IN A 203.0.113.1"),
+					rr("cdn.example.net. 300 IN RRSIG A 8 3 300 20300101000000 20000101000000 1 example.net. AAAA"),
+				}
+			default:
+				m.Ns = []dns.RR{rr("example.com. 300 IN SOA ns1.example.com. h. 1 2 3 4 5")}
+			}
+			return m
+		},
+	}}
+}
+
+func newTestResolver(f *fakeNet) *Resolver {
+	r := NewResolver(Opts{RootHints: []netip.Addr{rootAddr}})
+	r.exchange = f.exchange
+	return r
+}
+
+func Test_Resolver_Resolve(t *testing.T) {
+	f := newFakeNet()
+	r := newTestResolver(f)
+	q := new(dns.Msg)
+	q.SetQuestion("WWW.example.com.", dns.TypeA)
+	resp, err := r.Resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 2 {
+		t.Fatalf("want CNAME and A without RRSIG, got %v", resp)
+	}
+	if _, ok := resp.Answer[0].(*dns.CNAME); !ok {
+		t.Fatalf("want CNAME first, got %v", resp.Answer[0])
+	}
+	if a, ok := resp.Answer[1].(*dns.A); !ok || a.A.String() != "203.0.113.1" {
+		t.Fatalf("unexpected answer %v", resp.Answer[1])
+	}
+	if !resp.RecursionAvailable || resp.Question[0].Name != "WWW.example.com." {
+		t.Fatalf("invalid response header %v", resp)
+	}
+	for _, s := range f.queries {
+		if s[:len("198.51.100.1")] == "198.51.100.1" {
+			t.Fatalf("out of bailiwick glue was used: %v", f.queries)
+		}
+	}
+	// com., net., example.com., example.net. with the resolved ns addr.
+	if n := r.infra.len(); n != 4 {
+		t.Fatalf("want 4 cached delegations, got %d", n)
+	}
+
+	// Delegations are cached, the root is not queried again.
+	f.queries = nil
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	q.SetEdns0(1232, true)
+	resp, err = r.Resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range f.queries {
+		if s[:len("192.0.2.1 ")] == "192.0.2.1 " {
+			t.Fatalf("root was queried again: %v", f.queries)
+		}
+	}
+	if len(resp.Answer) != 3 {
+		t.Fatalf("want RRSIG kept for DO query, got %v", resp.Answer)
+	}
+}
+
+func Test_Resolver_DS(t *testing.T) {
+	f := newFakeNet()
+	r := newTestResolver(f)
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	if _, err := r.Resolve(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+
+	// DS is asked from the parent, even if the child zone is cached.
+	q.SetQuestion("example.com.", dns.TypeDS)
+	resp, err := r.Resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != dns.TypeDS {
+		t.Fatalf("want DS from the parent, got %v", resp)
+	}
+}
+
+func Test_Resolver_NXDOMAIN(t *testing.T) {
+	r := newTestResolver(newFakeNet())
+	q := new(dns.Msg)
+	q.SetQuestion("nonexist.com.", dns.TypeA)
+	resp, err := r.Resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rcode != dns.RcodeNameError || len(resp.Ns) != 1 {
+		t.Fatalf("want NXDOMAIN with SOA, got %v", resp)
+	}
+}
+
+func Test_Resolver_QNAMEMinimization(t *testing.T) {
+	f := newFakeNet()
+	r := newTestResolver(f)
+	r.qmin = true
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	resp, err := r.Resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 2 {
+		t.Fatalf("unexpected answer %v", resp)
+	}
+	want := map[string]bool{
+		"192.0.2.1 com. A":             true,
+		"192.0.2.2 example.com. A":     true,
+		"192.0.2.3 www.example.com. A": true,
+	}
+	for _, s := range f.queries[:3] {
+		if !want[s] {
+			t.Fatalf("unexpected minimised queries %v", f.queries)
+		}
+	}
+
+	// Servers that reply NXDOMAIN to empty non-terminals.
+	f.servers[exAddr] = func(q dns.Question) *dns.Msg {
+		m := new(dns.Msg)
+		m.Authoritative = true
+		if q.Name == "a.b.c.example.com." {
+			m.Answer = []dns.RR{rr("a.b.c.example.com. 300 IN A 203.0.113.2")}
+		} else {
+			m.Rcode = dns.RcodeNameError
+		}
+		return m
+	}
+	q.SetQuestion("a.b.c.example.com.", dns.TypeA)
+	resp, err = r.Resolve(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("want fallback to the full name, got %v", resp)
+	}
+}
+
+func Test_minimisedLabels(t *testing.T) {
+	var got []int
+	for labels, iter := 1, 0; labels < 20; iter++ {
+		labels = minimisedLabels(labels, 20, iter)
+		got = append(got, labels)
+	}
+	if len(got) > maxMinimiseCount || got[0] != 2 || got[3] != 5 || got[len(got)-1] != 20 {
+		t.Fatalf("unexpected label counts %v", got)
+	}
+	if s := lastLabels("a.b.example.com.", 2); s != "example.com." {
+		t.Fatalf("want example.com., got %s", s)
+	}
+}
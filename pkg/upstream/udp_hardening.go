@@ -0,0 +1,168 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+)
+
+const (
+	dnsHeaderLen           = 12
+	defaultPerQueryTimeout = time.Second * 5
+)
+
+var (
+	err0x20Mismatch = errors.New("response question does not match the 0x20 encoded query")
+	errInvalidQuery = errors.New("invalid query")
+)
+
+// randomizeCase returns a copy of q with the letters of its question name
+// in random case (draft-vixie-dnsext-dns0x20), and the end offset of
+// the name.
+func randomizeCase(q []byte) (*[]byte, int, error) {
+	end, ok := questionNameEnd(q)
+	if !ok {
+		return nil, 0, errInvalidQuery
+	}
+	b := pool.GetBuf(len(q))
+	copy(*b, q)
+	name := (*b)[dnsHeaderLen:end]
+	bits := rand.Uint64()
+	for i, n := 0, 0; i < len(name); i++ {
+		c := name[i] | 0x20
+		if c < 'a' || c > 'z' {
+			continue
+		}
+		if n == 64 {
+			bits, n = rand.Uint64(), 0
+		}
+		if bits&(1<<n) != 0 {
+			name[i] = c &^ 0x20
+		} else {
+			name[i] = c
+		}
+		n++
+	}
+	return b, end, nil
+}
+
+// questionNameEnd returns the end offset of the name of the first
+// question in m.
+func questionNameEnd(m []byte) (int, bool) {
+	if len(m) < dnsHeaderLen || binary.BigEndian.Uint16(m[4:]) == 0 {
+		return 0, false
+	}
+	off := dnsHeaderLen
+	for off < len(m) {
+		l := int(m[off])
+		if l == 0 {
+			return off + 1, true
+		}
+		if l&0xc0 != 0 { // Question name of a query is never compressed.
+			return 0, false
+		}
+		off += l + 1
+	}
+	return 0, false
+}
+
+// exchange0x20 sends q with a 0x20 encoded question name. The response
+// must echo the exact name. Its name is restored to the one in q.
+func exchange0x20(ctx context.Context, u Upstream, q []byte) (*[]byte, error) {
+	eq, end, err := randomizeCase(q)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.ReleaseBuf(eq)
+	r, err := u.ExchangeContext(ctx, *eq)
+	if err != nil {
+		return nil, err
+	}
+	if len(*r) < end || !bytes.Equal((*r)[dnsHeaderLen:end], (*eq)[dnsHeaderLen:end]) {
+		pool.ReleaseBuf(r)
+		return nil, err0x20Mismatch
+	}
+	copy((*r)[dnsHeaderLen:end], q[dnsHeaderLen:end])
+	return r, nil
+}
+
+// udpPerQuery sends each query from a new socket, so each query has
+// a new random source port, and a random id.
+type udpPerQuery struct {
+	dial func(ctx context.Context) (net.Conn, error)
+}
+
+func (u *udpPerQuery) ExchangeContext(ctx context.Context, q []byte) (*[]byte, error) {
+	if len(q) < dnsHeaderLen {
+		return nil, errInvalidQuery
+	}
+	c, err := u.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	ddl, ok := ctx.Deadline()
+	if !ok {
+		ddl = time.Now().Add(defaultPerQueryTimeout)
+	}
+	c.SetDeadline(ddl)
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Now()) })
+	defer stop()
+
+	b := pool.GetBuf(len(q))
+	defer pool.ReleaseBuf(b)
+	copy(*b, q)
+	id := uint16(rand.Uint32())
+	binary.BigEndian.PutUint16(*b, id)
+	if _, err := c.Write(*b); err != nil {
+		return nil, err
+	}
+
+	rb := pool.GetBuf(65535)
+	defer pool.ReleaseBuf(rb)
+	for {
+		n, err := c.Read(*rb)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			return nil, err
+		}
+		if n < dnsHeaderLen || binary.BigEndian.Uint16(*rb) != id {
+			continue // Not our response, maybe spoofed.
+		}
+		r := pool.GetBuf(n)
+		copy(*r, (*rb)[:n])
+		copy(*r, q[:2]) // restore the original id
+		return r, nil
+	}
+}
+
+func (u *udpPerQuery) Close() error {
+	return nil
+}
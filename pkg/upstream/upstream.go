@@ -37,6 +37,7 @@ import (
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/bootstrap"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/doh"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/recursive"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/transport"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/quic-go/quic-go"
@@ -87,6 +88,10 @@ type Opt struct {
 	// BindToDevice sets the socket SO_BINDTODEVICE option in unix system.
 	BindToDevice string
 
+	// BindAddr specifies the local (source) ip address that the upstream
+	// sockets will bind to. It must be an IP address.
+	BindAddr string
+
 	// IdleTimeout specifies the idle timeout for long-connections.
 	// Default: TCP, DoT: 10s , DoH, DoH3, Quic: 30s.
 	IdleTimeout time.Duration
@@ -119,11 +124,32 @@ type Opt struct {
 	// EventObserver can observe connection events.
 	// Not implemented for quic based protocol (DoH3, DoQ).
 	EventObserver EventObserver
+
+	// TruncatedFallback specifies how a udp upstream handles truncated
+	// responses. One of "tcp" (default), "tls", "none".
+	// "tcp"/"tls": Retry the query over tcp/DoT (port 853) to the same server.
+	// "none": Return the truncated response as is.
+	TruncatedFallback string
+
+	// Enable0x20 randomizes the case of the query name and rejects responses
+	// that do not echo it exactly (draft-vixie-dnsext-dns0x20). Rejected
+	// queries are retried over the TruncatedFallback connection, if any.
+	// Available for udp upstream.
+	Enable0x20 bool
+
+	// RandomSourcePort sends each query from a new socket, so each query
+	// has a random source port. Available for udp upstream.
+	RandomSourcePort bool
+
+	// QNAMEMinimization sends only the minimal labels of the query name to
+	// each authoritative server (RFC 9156). Available for recursive upstream.
+	QNAMEMinimization bool
 }
 
 // NewUpstream creates a upstream.
 // addr has the format of: [protocol://]host[:port][/path].
 // Supported protocol: udp/tcp/tls/https/quic. Default protocol is udp.
+// "recursive://" resolves queries iteratively from the root servers.
 //
 // Helper protocol:
 //   - tcp+pipeline/tls+pipeline: Automatically set opt.EnablePipeline to true.
@@ -159,11 +185,25 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 	// split and join address and port. Try to remove brackets now.
 	addrUrlHost := tryTrimIpv6Brackets(addrURL.Host)
 
-	dialer := &net.Dialer{
-		Control: getSocketControlFunc(socketOpts{
-			so_mark:        opt.SoMark,
-			bind_to_device: opt.BindToDevice,
-		}),
+	var bindAddr netip.Addr
+	if s := opt.BindAddr; len(s) > 0 {
+		bindAddr, err = netip.ParseAddr(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bind addr, %w", err)
+		}
+	}
+
+	socketControl := getSocketControlFunc(socketOpts{
+		so_mark:        opt.SoMark,
+		bind_to_device: opt.BindToDevice,
+	})
+	dialer := &net.Dialer{Control: socketControl}
+	udpDialer := &net.Dialer{Control: socketControl}
+	listenAddr := ""
+	if bindAddr.IsValid() {
+		dialer.LocalAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(bindAddr, 0))
+		udpDialer.LocalAddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(bindAddr, 0))
+		listenAddr = net.JoinHostPort(bindAddr.String(), "0")
 	}
 
 	var bootstrapAp netip.AddrPort
@@ -285,7 +325,7 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 		dialAddr := joinPort(host, port)
 
 		dialUdpPipeline := func(ctx context.Context) (transport.DnsConn, error) {
-			c, err := dialer.DialContext(ctx, "udp", dialAddr)
+			c, err := udpDialer.DialContext(ctx, "udp", dialAddr)
 			if err != nil {
 				return nil, err
 			}
@@ -296,21 +336,66 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			}
 			return transport.NewDnsConn(to, wrapConn(c, opt.EventObserver)), nil
 		}
-		dialTcpNetConn := func(ctx context.Context) (transport.NetConn, error) {
-			c, err := dialer.DialContext(ctx, "tcp", dialAddr)
-			if err != nil {
-				return nil, err
+		var fallback *transport.ReuseConnTransport
+		fallbackName := opt.TruncatedFallback
+		switch opt.TruncatedFallback {
+		case "", "tcp":
+			fallbackName = "tcp"
+			dialTcpNetConn := func(ctx context.Context) (transport.NetConn, error) {
+				c, err := dialer.DialContext(ctx, "tcp", dialAddr)
+				if err != nil {
+					return nil, err
+				}
+				return wrapConn(c, opt.EventObserver), nil
 			}
-			return wrapConn(c, opt.EventObserver), nil
+			fallback = transport.NewReuseConnTransport(transport.ReuseConnOpts{DialContext: dialTcpNetConn})
+		case "tls":
+			const tlsPort = 853
+			tlsDialAddr := joinPort(host, tlsPort)
+			tlsConfig := opt.TLSConfig.Clone()
+			if tlsConfig == nil {
+				tlsConfig = new(tls.Config)
+			}
+			if len(tlsConfig.ServerName) == 0 {
+				tlsConfig.ServerName = host
+			}
+			dialTlsNetConn := func(ctx context.Context) (transport.NetConn, error) {
+				conn, err := dialer.DialContext(ctx, "tcp", tlsDialAddr)
+				if err != nil {
+					return nil, err
+				}
+				tlsConn := tls.Client(conn, tlsConfig)
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					tlsConn.Close()
+					return nil, err
+				}
+				return wrapConn(tlsConn, opt.EventObserver), nil
+			}
+			fallback = transport.NewReuseConnTransport(transport.ReuseConnOpts{DialContext: dialTlsNetConn})
+		case "none":
+		default:
+			return nil, fmt.Errorf("invalid truncated fallback [%s]", opt.TruncatedFallback)
 		}
 
-		return &udpWithFallback{
-			u: transport.NewPipelineTransport(transport.PipelineOpts{
+		var u Upstream
+		if opt.RandomSourcePort {
+			u = &udpPerQuery{dial: func(ctx context.Context) (net.Conn, error) {
+				c, err := udpDialer.DialContext(ctx, "udp", dialAddr)
+				return wrapConn(c, opt.EventObserver), err
+			}}
+		} else {
+			u = transport.NewPipelineTransport(transport.PipelineOpts{
 				DialContext:                    dialUdpPipeline,
 				MaxConcurrentQueryWhileDialing: maxConcurrentQueryPreConn,
 				Logger:                         opt.Logger,
-			}),
-			t: transport.NewReuseConnTransport(transport.ReuseConnOpts{DialContext: dialTcpNetConn}),
+			})
+		}
+		return &udpWithFallback{
+			u:      u,
+			t:      fallback,
+			tName:  fallbackName,
+			ob:     opt.EventObserver,
+			en0x20: opt.Enable0x20,
 		}, nil
 	case "tcp":
 		const defaultPort = 53
@@ -415,8 +500,8 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 				return nil, fmt.Errorf("failed to init udp addr bootstrap, %w", err)
 			}
 
-			lc := net.ListenConfig{Control: getSocketControlFunc(socketOpts{so_mark: opt.SoMark, bind_to_device: opt.BindToDevice})}
-			conn, err := lc.ListenPacket(context.Background(), "udp", "")
+			lc := net.ListenConfig{Control: socketControl}
+			conn, err := lc.ListenPacket(context.Background(), "udp", listenAddr)
 			if err != nil {
 				return nil, fmt.Errorf("failed to init udp socket for quic, %w", err)
 			}
@@ -509,8 +594,8 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			opt.Logger.Warn("failed to init quic stateless reset key, it will be disabled", zap.Error(err))
 		}
 
-		lc := net.ListenConfig{Control: getSocketControlFunc(socketOpts{so_mark: opt.SoMark, bind_to_device: opt.BindToDevice})}
-		uc, err := lc.ListenPacket(context.Background(), "udp", "")
+		lc := net.ListenConfig{Control: socketControl}
+		uc, err := lc.ListenPacket(context.Background(), "udp", listenAddr)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init udp socket for quic, %w", err)
 		}
@@ -548,31 +633,66 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			MaxConcurrentQueryWhileDialing: 90,
 			Logger:                         opt.Logger,
 		}), nil
+	case "recursive":
+		// Resolves iteratively from the root servers. The url has no host.
+		return recursive.NewResolver(recursive.Opts{
+			UDPDialer:         udpDialer,
+			TCPDialer:         dialer,
+			QNAMEMinimization: opt.QNAMEMinimization,
+			Logger:            opt.Logger,
+		}), nil
 	default:
 		return nil, fmt.Errorf("unsupported protocol [%s]", addrURL.Scheme)
 	}
 }
 
 type udpWithFallback struct {
-	u *transport.PipelineTransport
-	t *transport.ReuseConnTransport
+	u      Upstream
+	t      *transport.ReuseConnTransport // nil if fallback is disabled.
+	tName  string                        // transport of t, "tcp" or "tls".
+	ob     EventObserver
+	en0x20 bool
 }
 
 func (u *udpWithFallback) ExchangeContext(ctx context.Context, q []byte) (*[]byte, error) {
-	r, err := u.u.ExchangeContext(ctx, q)
+	var r *[]byte
+	var err error
+	if u.en0x20 {
+		r, err = exchange0x20(ctx, u.u, q)
+		if errors.Is(err, err0x20Mismatch) {
+			u.ob.OnEvent(EventUDP0x20Mismatch)
+			// The server may not preserve the case. Tcp is not
+			// vulnerable to off-path spoofing anyway.
+			if u.t != nil {
+				return u.fallback(ctx, q)
+			}
+		}
+	} else {
+		r, err = u.u.ExchangeContext(ctx, q)
+	}
 	if err != nil {
 		return nil, err
 	}
 	if msgTruncated(*r) {
-		pool.ReleaseBuf(r)
-		return u.t.ExchangeContext(ctx, q)
+		u.ob.OnEvent(EventUDPTruncated)
+		if u.t != nil {
+			pool.ReleaseBuf(r)
+			return u.fallback(ctx, q)
+		}
 	}
 	return r, nil
 }
 
+func (u *udpWithFallback) fallback(ctx context.Context, q []byte) (*[]byte, error) {
+	recordTransport(ctx, u.tName)
+	return u.t.ExchangeContext(ctx, q)
+}
+
 func (u *udpWithFallback) Close() error {
 	u.u.Close()
-	u.t.Close()
+	if u.t != nil {
+		u.t.Close()
+	}
 	return nil
 }
 
@@ -25,6 +25,8 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -231,3 +233,336 @@ func (s *vServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
 	time.Sleep(s.latency)
 	w.WriteMsg(r)
 }
+
+type truncServer struct{}
+
+func (s *truncServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+		r.Truncated = true
+	}
+	w.WriteMsg(r)
+}
+
+type countEO struct {
+	mu sync.Mutex
+	m  map[Event]int
+}
+
+func (c *countEO) OnEvent(typ Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[Event]int)
+	}
+	c.m[typ]++
+}
+
+func (c *countEO) count(typ Event) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.m[typ]
+}
+
+func Test_udpTruncatedFallback(t *testing.T) {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := udpConn.LocalAddr().String()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpServer := dns.Server{PacketConn: udpConn, Handler: &truncServer{}}
+	tcpServer := dns.Server{Listener: l, Handler: &truncServer{}}
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	defer udpServer.Shutdown()
+	defer tcpServer.Shutdown()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qb, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for fallback, wantTruncated := range map[string]bool{"": false, "tcp": false, "none": true} {
+		eo := new(countEO)
+		u, err := NewUpstream(addr, Opt{TruncatedFallback: fallback, EventObserver: eo})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		r, err := u.ExchangeContext(ctx, qb)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := msgTruncated(*r); got != wantTruncated {
+			t.Fatalf("fallback %q: truncated = %v, want %v", fallback, got, wantTruncated)
+		}
+		if n := eo.count(EventUDPTruncated); n != 1 {
+			t.Fatalf("fallback %q: truncated event count = %d, want 1", fallback, n)
+		}
+		u.Close()
+	}
+
+	if _, err := NewUpstream(addr, Opt{TruncatedFallback: "bad"}); err == nil {
+		t.Fatal("invalid fallback should be rejected")
+	}
+}
+
+// lowerCaseServer replies with a lower case question name.
+type lowerCaseServer struct {
+	mu    sync.Mutex
+	names []string
+	ports map[int]struct{}
+}
+
+func (s *lowerCaseServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	s.mu.Lock()
+	s.names = append(s.names, q.Question[0].Name)
+	if s.ports == nil {
+		s.ports = make(map[int]struct{})
+	}
+	if ua, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		s.ports[ua.Port] = struct{}{}
+	}
+	s.mu.Unlock()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Question[0].Name = strings.ToLower(r.Question[0].Name)
+	w.WriteMsg(r)
+}
+
+func Test_udpHardening(t *testing.T) {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := udpConn.LocalAddr().String()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(lowerCaseServer)
+	udpServer := dns.Server{PacketConn: udpConn, Handler: s}
+	tcpServer := dns.Server{Listener: l, Handler: s}
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	defer udpServer.Shutdown()
+	defer tcpServer.Shutdown()
+
+	const name = "a-long-name-with-many-letters.example.com."
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	qb, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange := func(u Upstream) (*dns.Msg, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		b, err := u.ExchangeContext(ctx, qb)
+		if err != nil {
+			return nil, err
+		}
+		r := new(dns.Msg)
+		if err := r.Unpack(*b); err != nil {
+			t.Fatal(err)
+		}
+		return r, nil
+	}
+
+	// Per query source port.
+	u, err := NewUpstream(addr, Opt{RandomSourcePort: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		r, err := exchange(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Id != q.Id {
+			t.Fatalf("id = %d, want %d", r.Id, q.Id)
+		}
+	}
+	u.Close()
+	s.mu.Lock()
+	ports := len(s.ports)
+	s.mu.Unlock()
+	if ports < 2 {
+		t.Fatalf("queries should be sent from different ports, got %d port(s)", ports)
+	}
+
+	// 0x20, the server does not preserve the case.
+	eo := new(countEO)
+	u, err = NewUpstream(addr, Opt{Enable0x20: true, RandomSourcePort: true, TruncatedFallback: "none", EventObserver: eo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exchange(u); !errors.Is(err, err0x20Mismatch) {
+		t.Fatalf("want 0x20 mismatch err, got %v", err)
+	}
+	u.Close()
+	if n := eo.count(EventUDP0x20Mismatch); n != 1 {
+		t.Fatalf("mismatch event count = %d, want 1", n)
+	}
+	s.mu.Lock()
+	sent := s.names[len(s.names)-1]
+	s.mu.Unlock()
+	if sent == name || !strings.EqualFold(sent, name) {
+		t.Fatalf("query name should be 0x20 encoded, got %s", sent)
+	}
+
+	// Mismatched queries are retried over tcp.
+	u, err = NewUpstream(addr, Opt{Enable0x20: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := exchange(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Close()
+	if got := r.Question[0].Name; got != name {
+		t.Fatalf("question name = %s, want %s", got, name)
+	}
+}
+
+func Test_exchange0x20(t *testing.T) {
+	const name = "WWW.Example.com."
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	qb, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &echoUpstream{}
+	r, err := exchange0x20(context.Background(), u, qb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(*r); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Question[0].Name; got != name {
+		t.Fatalf("question name should be restored, got %s", got)
+	}
+	if !strings.EqualFold(u.sent, name) {
+		t.Fatalf("sent name %s does not match %s", u.sent, name)
+	}
+}
+
+// echoUpstream replies the query as is.
+type echoUpstream struct {
+	sent string
+}
+
+func (u *echoUpstream) ExchangeContext(_ context.Context, q []byte) (*[]byte, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(q); err != nil {
+		return nil, err
+	}
+	u.sent = m.Question[0].Name
+	b := make([]byte, len(q))
+	copy(b, q)
+	return &b, nil
+}
+
+func (u *echoUpstream) Close() error { return nil }
+
+// remoteAddrServer records the source addresses of the queries it receives.
+type remoteAddrServer struct {
+	mu    sync.Mutex
+	addrs []netip.Addr
+}
+
+func (s *remoteAddrServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	ap, _ := netip.ParseAddrPort(w.RemoteAddr().String())
+	s.mu.Lock()
+	s.addrs = append(s.addrs, ap.Addr().Unmap())
+	s.mu.Unlock()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	w.WriteMsg(r)
+}
+
+func (s *remoteAddrServer) last() (netip.Addr, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.addrs) == 0 {
+		return netip.Addr{}, 0
+	}
+	return s.addrs[len(s.addrs)-1], len(s.addrs)
+}
+
+func Test_bindAddr(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qb, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange := func(u Upstream) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := u.ExchangeContext(ctx, qb)
+		return err
+	}
+
+	s := new(remoteAddrServer)
+	udpAddr, shutdownUDP := newUDPTestServer(t, s)
+	defer shutdownUDP()
+	tcpAddr, shutdownTCP := newTCPTestServer(t, s)
+	defer shutdownTCP()
+
+	// 127.0.0.2 is not the default source address of a loopback dial, so it
+	// shows that the option is applied. It is not routable on every system.
+	binds := []string{"127.0.0.1"}
+	if c, err := net.ListenPacket("udp", "127.0.0.2:0"); err == nil {
+		c.Close()
+		binds = append(binds, "127.0.0.2")
+	}
+	for _, bind := range binds {
+		for _, addr := range []string{"udp://" + udpAddr, "tcp://" + tcpAddr} {
+			u, err := NewUpstream(addr, Opt{BindAddr: bind})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := exchange(u); err != nil {
+				t.Fatalf("%s bind %s: %v", addr, bind, err)
+			}
+			if got, _ := s.last(); got.String() != bind {
+				t.Fatalf("%s bind %s: server saw source %s", addr, bind, got)
+			}
+			u.Close()
+		}
+	}
+
+	// An address that is not assigned to this host must fail the dial
+	// rather than fall back to the default source address.
+	for _, addr := range []string{"udp://" + udpAddr, "tcp://" + tcpAddr} {
+		_, n := s.last()
+		u, err := NewUpstream(addr, Opt{BindAddr: "192.0.2.1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := exchange(u); err == nil {
+			t.Fatalf("%s: exchange with unavailable bind addr should fail", addr)
+		}
+		u.Close()
+		if _, got := s.last(); got != n {
+			t.Fatalf("%s: query was sent despite the unavailable bind addr", addr)
+		}
+	}
+
+	if _, err := NewUpstream("udp://"+udpAddr, Opt{BindAddr: "not-an-ip"}); err == nil {
+		t.Fatal("invalid bind addr should be rejected")
+	}
+}
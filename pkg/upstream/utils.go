@@ -20,6 +20,7 @@
 package upstream
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/netip"
@@ -102,3 +103,21 @@ func tryTrimIpv6Brackets(s string) string {
 func msgTruncated(b []byte) bool {
 	return b[2]&(1<<1) != 0
 }
+
+type transportKey struct{}
+
+// WithTransportRecorder returns a ctx for Upstream.ExchangeContext that
+// records the transport the exchange was finally sent over, and a func that
+// returns it after the exchange. The func returns "" if the upstream used
+// its own protocol. Currently, only udp upstreams that fall back to tcp or
+// tls record it.
+func WithTransportRecorder(ctx context.Context) (context.Context, func() string) {
+	t := new(string)
+	return context.WithValue(ctx, transportKey{}, t), func() string { return *t }
+}
+
+func recordTransport(ctx context.Context, transport string) {
+	if t, ok := ctx.Value(transportKey{}).(*string); ok {
+		*t = transport
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package utils
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// FileWatcher calls a function after some files change. The dirs of the
+// files are watched, so files that are replaced (e.g. written to a temp
+// file and renamed) or created later are noticed. Events within delay
+// are merged into one call.
+type FileWatcher struct {
+	w           *fsnotify.Watcher
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+// NewFileWatcher starts watching files. onChange is called in the
+// watcher's goroutine. Watcher errors are logged to logger.
+func NewFileWatcher(files []string, delay time.Duration, logger *zap.Logger, onChange func()) (*FileWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]struct{}, len(files))
+	dirs := make(map[string]struct{})
+	for _, file := range files {
+		names[filepath.Clean(file)] = struct{}{}
+		dirs[filepath.Dir(file)] = struct{}{}
+	}
+	for dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+
+	fw := &FileWatcher{w: w, closeNotify: make(chan struct{})}
+	go func() {
+		timer := time.NewTimer(delay)
+		timer.Stop()
+		defer timer.Stop()
+		for {
+			select {
+			case e := <-w.Events:
+				if _, ok := names[filepath.Clean(e.Name)]; ok {
+					timer.Reset(delay)
+				}
+			case err := <-w.Errors:
+				logger.Warn("file watcher error", zap.Error(err))
+			case <-timer.C:
+				onChange()
+			case <-fw.closeNotify:
+				return
+			}
+		}
+	}()
+	return fw, nil
+}
+
+// Close stops watching the files.
+func (fw *FileWatcher) Close() error {
+	fw.closeOnce.Do(func() {
+		close(fw.closeNotify)
+		fw.w.Close()
+	})
+	return nil
+}
@@ -32,6 +32,10 @@ type Args struct {
 	Exps  []string `yaml:"exps"`
 	Sets  []string `yaml:"sets"`
 	Files []string `yaml:"files"`
+	// MatcherBackend is "map" (default) or "compact". The compact backend
+	// compiles full and domain rules into a read-only trie after loading,
+	// using much less memory but taking longer to build.
+	MatcherBackend string `yaml:"matcher_backend"`
 }
 
 type domainPayload struct {
@@ -42,9 +46,10 @@ var _ data_provider.DomainMatcherProvider = (*DomainSet)(nil)
 var _ domain.Matcher[struct{}] = (*DomainSet)(nil)
 
 type DomainSet struct {
-	mu     sync.RWMutex
-	mixM   *domain.MixMatcher[struct{}]
-	otherM []domain.Matcher[struct{}]
+	mu      sync.RWMutex
+	mixM    *domain.MixMatcher[struct{}]
+	otherM  []domain.Matcher[struct{}]
+	compact bool
 
 	ruleFile string
 	rules    []string
@@ -117,9 +122,14 @@ func (d *DomainSet) loadFileInternal(f string) ([]string, error) {
 
 func Init(bp *coremain.BP, args any) (any, error) {
 	cfg := args.(*Args)
+	compact, err := domain.ParseBackend(cfg.MatcherBackend)
+	if err != nil {
+		return nil, err
+	}
 	ds := &DomainSet{
-		mixM:   domain.NewDomainMixMatcher(),
-		otherM: make([]domain.Matcher[struct{}], 0, len(cfg.Sets)),
+		mixM:    domain.NewDomainMixMatcher(),
+		otherM:  make([]domain.Matcher[struct{}], 0, len(cfg.Sets)),
+		compact: compact,
 	}
 
 	if len(cfg.Files) > 0 {
@@ -132,6 +142,9 @@ func Init(bp *coremain.BP, args any) (any, error) {
 		return nil, fmt.Errorf("failed to load rules: %w", err)
 	}
 	ds.rules = loadedRules
+	if ds.compact {
+		ds.mixM.Compact()
+	}
 
 	for _, tag := range cfg.Sets {
 		provider, ok := bp.M().GetPlugin(tag).(data_provider.DomainMatcherProvider)
@@ -167,6 +180,19 @@ func (d *DomainSet) Match(domainStr string) (value struct{}, ok bool) {
 	return struct{}{}, false
 }
 
+// MatchQtype implements domain.QtypeMatcher, so that qtype-aware sets
+// referenced by this set (e.g. adguard_rule) receive the query type.
+func (d *DomainSet) MatchQtype(domainStr string, qtype uint16) (value struct{}, ok bool) {
+	d.mu.RLock()
+	m := d.mixM
+	d.mu.RUnlock()
+
+	if _, ok := m.Match(domainStr); ok {
+		return struct{}{}, true
+	}
+	return MatcherGroup(d.otherM).MatchQtype(domainStr, qtype)
+}
+
 func (d *DomainSet) api() *chi.Mux {
 	r := chi.NewRouter()
 
@@ -179,7 +205,7 @@ func (d *DomainSet) api() *chi.Mux {
 		}
 	})
 
-	r.Get("/save", func(w http.ResponseWriter, r *http.Request) {
+	r.Get("/save", coremain.AdminOnly(func(w http.ResponseWriter, r *http.Request) {
 		d.mu.RLock()
 		defer d.mu.RUnlock()
 		if d.ruleFile == "" {
@@ -191,7 +217,7 @@ func (d *DomainSet) api() *chi.Mux {
 			return
 		}
 		w.WriteHeader(http.StatusOK)
-	})
+	}))
 
 	r.Post("/post", func(w http.ResponseWriter, r *http.Request) {
 		var p domainPayload
@@ -212,6 +238,9 @@ func (d *DomainSet) api() *chi.Mux {
 				tmpRules = append(tmpRules, pat)
 			}
 		}
+		if d.compact {
+			tmpMix.Compact()
+		}
 
 		d.mu.Lock()
 		d.mixM = tmpMix
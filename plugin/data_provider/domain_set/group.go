@@ -31,3 +31,20 @@ func (mg MatcherGroup) Match(s string) (struct{}, bool) {
 	}
 	return struct{}{}, false
 }
+
+// MatchQtype implements domain.QtypeMatcher. Members that are not
+// domain.QtypeMatcher are matched by domain only.
+func (mg MatcherGroup) MatchQtype(s string, qtype uint16) (struct{}, bool) {
+	for _, m := range mg {
+		if qm, ok := m.(domain.QtypeMatcher[struct{}]); ok {
+			if _, ok := qm.MatchQtype(s, qtype); ok {
+				return struct{}{}, true
+			}
+			continue
+		}
+		if _, ok := m.Match(s); ok {
+			return struct{}{}, true
+		}
+	}
+	return struct{}{}, false
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain_set_ops
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/go-chi/chi/v5"
+)
+
+const PluginType = "domain_set_ops"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+// Args are tags of other domain providers.
+// The result set is (union of Union) ∩ (each of Intersect) - (each of Minus).
+// If Union is empty, the result set starts from the intersection of Intersect.
+type Args struct {
+	Union     []string `yaml:"union"`
+	Intersect []string `yaml:"intersect"`
+	Minus     []string `yaml:"minus"`
+}
+
+var _ data_provider.DomainMatcherProvider = (*DomainSetOps)(nil)
+var _ domain.Matcher[struct{}] = (*DomainSetOps)(nil)
+
+type namedMatcher struct {
+	tag string
+	m   domain.Matcher[struct{}]
+}
+
+// DomainSetOps composes other domain providers with set operations.
+// Source matchers are evaluated at match time, so a reload of any
+// source takes effect immediately.
+type DomainSetOps struct {
+	union     []namedMatcher
+	intersect []namedMatcher
+	minus     []namedMatcher
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	lookup := func(tag string) (domain.Matcher[struct{}], error) {
+		provider, _ := bp.M().GetPlugin(tag).(data_provider.DomainMatcherProvider)
+		if provider == nil {
+			return nil, fmt.Errorf("%s is not a DomainMatcherProvider", tag)
+		}
+		return provider.GetDomainMatcher(), nil
+	}
+	d, err := NewDomainSetOps(*args.(*Args), lookup)
+	if err != nil {
+		return nil, err
+	}
+	bp.RegAPI(d.api())
+	return d, nil
+}
+
+func NewDomainSetOps(args Args, lookup func(tag string) (domain.Matcher[struct{}], error)) (*DomainSetOps, error) {
+	if len(args.Union)+len(args.Intersect) == 0 {
+		return nil, errors.New("at least one union or intersect set is required")
+	}
+	load := func(tags []string) ([]namedMatcher, error) {
+		ms := make([]namedMatcher, 0, len(tags))
+		for _, tag := range tags {
+			m, err := lookup(tag)
+			if err != nil {
+				return nil, err
+			}
+			ms = append(ms, namedMatcher{tag: tag, m: m})
+		}
+		return ms, nil
+	}
+
+	d := new(DomainSetOps)
+	var err error
+	if d.union, err = load(args.Union); err != nil {
+		return nil, err
+	}
+	if d.intersect, err = load(args.Intersect); err != nil {
+		return nil, err
+	}
+	if d.minus, err = load(args.Minus); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *DomainSetOps) GetDomainMatcher() domain.Matcher[struct{}] {
+	return d
+}
+
+func (d *DomainSetOps) Match(domainStr string) (value struct{}, ok bool) {
+	return struct{}{}, d.explain(domainStr, nil)
+}
+
+// explain matches domainStr. If hits is not nil, it records the match
+// result of each source.
+func (d *DomainSetOps) explain(domainStr string, hits map[string]bool) bool {
+	match := func(nm namedMatcher) bool {
+		_, ok := nm.m.Match(domainStr)
+		if hits != nil {
+			hits[nm.tag] = ok
+		}
+		return ok
+	}
+
+	if len(d.union) > 0 {
+		matched := false
+		for _, nm := range d.union {
+			if match(nm) {
+				matched = true
+				if hits == nil {
+					break
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, nm := range d.intersect {
+		if !match(nm) {
+			return false
+		}
+	}
+	for _, nm := range d.minus {
+		if match(nm) {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *DomainSetOps) api() *chi.Mux {
+	r := chi.NewRouter()
+
+	// GET /match?domain=example.com shows the result and how each source matched.
+	r.Get("/match", func(w http.ResponseWriter, r *http.Request) {
+		domainStr := r.URL.Query().Get("domain")
+		if len(domainStr) == 0 {
+			http.Error(w, "domain is required", http.StatusBadRequest)
+			return
+		}
+		hits := make(map[string]bool)
+		matched := d.explain(domainStr, hits)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"domain": domainStr, "matched": matched, "sources": hits})
+	})
+
+	return r
+}
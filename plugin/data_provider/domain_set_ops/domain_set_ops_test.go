@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain_set_ops
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+)
+
+func Test_DomainSetOps(t *testing.T) {
+	sets := map[string][]string{
+		"cn":    {"domain:cn", "domain:baidu.com", "domain:qq.com"},
+		"proxy": {"domain:github.cn", "full:qq.com"},
+		"cdn":   {"domain:cn", "domain:qq.com"},
+	}
+	lookup := func(tag string) (domain.Matcher[struct{}], error) {
+		exps, ok := sets[tag]
+		if !ok {
+			return nil, fmt.Errorf("%s not found", tag)
+		}
+		m := domain.NewDomainMixMatcher()
+		for _, exp := range exps {
+			if err := m.Add(exp, struct{}{}); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+
+	d, err := NewDomainSetOps(Args{Union: []string{"cn"}, Intersect: []string{"cdn"}, Minus: []string{"proxy"}}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.cn.", true},
+		{"github.cn.", false},     // minus
+		{"www.baidu.com.", false}, // not in cdn
+		{"qq.com.", false},        // minus
+		{"www.qq.com.", true},
+		{"google.com.", false},
+	}
+	for _, tt := range tests {
+		if _, got := d.Match(tt.domain); got != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+
+	if _, err := NewDomainSetOps(Args{Minus: []string{"proxy"}}, lookup); err == nil {
+		t.Error("minus only args should be rejected")
+	}
+	if _, err := NewDomainSetOps(Args{Union: []string{"unknown"}}, lookup); err == nil {
+		t.Error("unknown set should be rejected")
+	}
+}
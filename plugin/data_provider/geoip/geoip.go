@@ -0,0 +1,188 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package geoip
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/go-chi/chi/v5"
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+)
+
+const PluginType = "geoip"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+type Args struct {
+	// File is a GeoLite2/GeoIP2 Country (or City) mmdb file, or a
+	// sing-geoip mmdb file. Required.
+	File string `yaml:"file"`
+}
+
+// CountryProvider looks up the ISO country code of an address.
+type CountryProvider interface {
+	// Country returns the upper case ISO 3166-1 country code of addr,
+	// or an empty string if addr is not in the database.
+	Country(addr netip.Addr) string
+}
+
+var _ CountryProvider = (*GeoIP)(nil)
+
+// GeoIP loads a mmdb file into memory. The file can be reloaded via api.
+type GeoIP struct {
+	file   string
+	logger *zap.Logger
+	db     atomic.Pointer[db]
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	g, err := NewGeoIP(args.(*Args).File, bp.L())
+	if err != nil {
+		return nil, err
+	}
+	bp.RegAPI(g.Api())
+	return g, nil
+}
+
+func NewGeoIP(file string, logger *zap.Logger) (*GeoIP, error) {
+	if len(file) == 0 {
+		return nil, errors.New("missing mmdb file")
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	g := &GeoIP{file: file, logger: logger}
+	if err := g.Reload(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Reload reloads the mmdb file. The old database is kept if the new
+// one is invalid.
+func (g *GeoIP) Reload() error {
+	b, err := os.ReadFile(g.file)
+	if err != nil {
+		return err
+	}
+	d, err := openDB(b)
+	if err != nil {
+		return fmt.Errorf("invalid mmdb file %s, %w", g.file, err)
+	}
+	g.db.Store(d)
+	g.logger.Info("mmdb loaded", zap.String("file", g.file), zap.String("type", d.r.Metadata.DatabaseType))
+	return nil
+}
+
+func (g *GeoIP) Country(addr netip.Addr) string {
+	return g.db.Load().country(addr)
+}
+
+func (g *GeoIP) Api() *chi.Mux {
+	r := chi.NewRouter()
+
+	// GET /lookup?ip=1.2.3.4
+	r.Get("/lookup", func(w http.ResponseWriter, req *http.Request) {
+		addr, err := netip.ParseAddr(req.URL.Query().Get("ip"))
+		if err != nil {
+			http.Error(w, "invalid ip", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"ip": addr.String(), "country": g.Country(addr)})
+	})
+
+	// POST /reload reloads the mmdb file, e.g. after it was updated by cron.
+	r.Post("/reload", func(w http.ResponseWriter, req *http.Request) {
+		if err := g.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return r
+}
+
+type db struct {
+	r *maxminddb.Reader
+	// sing-geoip databases store the country code as the record itself.
+	sing bool
+
+	// Many networks share a record. Cache decoded codes by record offset.
+	cache sync.Map // uintptr -> string
+}
+
+func openDB(b []byte) (*db, error) {
+	r, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	return &db{r: r, sing: r.Metadata.DatabaseType == "sing-geoip"}, nil
+}
+
+// countryRecord is the part of a GeoLite2/GeoIP2 record we need.
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+func (d *db) country(addr netip.Addr) string {
+	off, err := d.r.LookupOffset(addr.Unmap().AsSlice())
+	if err != nil || off == maxminddb.NotFound {
+		return ""
+	}
+	if v, ok := d.cache.Load(off); ok {
+		return v.(string)
+	}
+
+	var code string
+	if d.sing {
+		err = d.r.Decode(off, &code)
+	} else {
+		var rec countryRecord
+		err = d.r.Decode(off, &rec)
+		code = rec.Country.ISOCode
+		if len(code) == 0 {
+			code = rec.RegisteredCountry.ISOCode
+		}
+	}
+	if err != nil {
+		return ""
+	}
+	code = strings.ToUpper(code)
+	d.cache.Store(off, code)
+	return code
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package geosite
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers and domain types of v2ray's routercommon.proto.
+const (
+	fieldSiteListEntry = 1 // GeoSiteList.entry
+
+	fieldSiteCode   = 1 // GeoSite.country_code
+	fieldSiteDomain = 2 // GeoSite.domain
+
+	fieldDomainType  = 1 // Domain.type
+	fieldDomainValue = 2 // Domain.value
+	fieldDomainAttr  = 3 // Domain.attribute
+
+	fieldAttrKey = 1 // Domain.Attribute.key
+
+	domainTypePlain      = 0 // keyword
+	domainTypeRegex      = 1
+	domainTypeRootDomain = 2
+	domainTypeFull       = 3
+)
+
+// datIndex maps upper case category codes to their undecoded GeoSite
+// messages, so only the categories in use are decoded.
+type datIndex map[string][]byte
+
+// indexDat indexes a geosite.dat file without decoding the domains.
+func indexDat(b []byte) (datIndex, error) {
+	idx := make(datIndex)
+	err := rangeFields(b, func(num protowire.Number, v []byte) error {
+		if num != fieldSiteListEntry {
+			return nil
+		}
+		var code string
+		if err := rangeFields(v, func(num protowire.Number, fv []byte) error {
+			if num == fieldSiteCode {
+				code = strings.ToUpper(string(fv))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if len(code) == 0 {
+			return errors.New("entry without code")
+		}
+		// Merge entries with the same code, as v2ray does.
+		idx[code] = append(idx[code], v...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// category is a code with optional attribute filters,
+// e.g. "geolocation-!cn", "cn@ads" or "google@!cn".
+type category struct {
+	code  string   // upper case
+	attrs []string // lower case, "!" prefix means the domain must not have it
+}
+
+func (c category) String() string {
+	s := strings.ToLower(c.code)
+	for _, attr := range c.attrs {
+		s += "@" + attr
+	}
+	return s
+}
+
+func parseCategory(s string) (category, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "geosite:")
+	fs := strings.Split(s, "@")
+	c := category{code: strings.ToUpper(fs[0])}
+	if len(c.code) == 0 {
+		return category{}, fmt.Errorf("invalid category %q", s)
+	}
+	for _, attr := range fs[1:] {
+		attr = strings.ToLower(attr)
+		if len(strings.TrimPrefix(attr, "!")) == 0 {
+			return category{}, fmt.Errorf("invalid attribute in category %q", s)
+		}
+		c.attrs = append(c.attrs, attr)
+	}
+	return c, nil
+}
+
+// load decodes the domains of category c into m. It returns the number
+// of domains added and skipped (invalid regexps).
+func (idx datIndex) load(c category, m *domain.MixMatcher[struct{}]) (added, skipped int, err error) {
+	site, ok := idx[c.code]
+	if !ok {
+		return 0, 0, fmt.Errorf("category %s not found", c.code)
+	}
+	err = rangeFields(site, func(num protowire.Number, v []byte) error {
+		if num != fieldSiteDomain {
+			return nil
+		}
+		d, err := decodeDomain(v)
+		if err != nil {
+			return err
+		}
+		if !d.hasAttrs(c.attrs) {
+			return nil
+		}
+		var typ string
+		switch d.typ {
+		case domainTypePlain:
+			typ = domain.MatcherKeyword
+		case domainTypeRegex:
+			typ = domain.MatcherRegexp
+		case domainTypeRootDomain:
+			typ = domain.MatcherDomain
+		case domainTypeFull:
+			typ = domain.MatcherFull
+		default:
+			skipped++
+			return nil
+		}
+		if err := m.GetSubMatcher(typ).Add(d.value, struct{}{}); err != nil {
+			skipped++
+			return nil
+		}
+		added++
+		return nil
+	})
+	return added, skipped, err
+}
+
+type datDomain struct {
+	typ   uint64
+	value string
+	attrs []string // lower case keys
+}
+
+func decodeDomain(b []byte) (datDomain, error) {
+	var d datDomain
+	err := rangeFields(b, func(num protowire.Number, v []byte) error {
+		switch num {
+		case fieldDomainType:
+			n, l := protowire.ConsumeVarint(v)
+			if l < 0 {
+				return protowire.ParseError(l)
+			}
+			d.typ = n
+		case fieldDomainValue:
+			d.value = string(v)
+		case fieldDomainAttr:
+			return rangeFields(v, func(num protowire.Number, av []byte) error {
+				if num == fieldAttrKey {
+					d.attrs = append(d.attrs, strings.ToLower(string(av)))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return d, err
+}
+
+// hasAttrs reports whether d satisfies all the attribute filters.
+func (d datDomain) hasAttrs(filters []string) bool {
+	for _, f := range filters {
+		attr, not := strings.CutPrefix(f, "!")
+		has := false
+		for _, a := range d.attrs {
+			if a == attr {
+				has = true
+				break
+			}
+		}
+		if has == not {
+			return false
+		}
+	}
+	return true
+}
+
+// rangeFields calls f for every field of the protobuf message b. v is the
+// content of length-delimited fields and the raw varint of varint fields.
+// Fields of other wire types are skipped.
+func rangeFields(b []byte, f func(num protowire.Number, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v []byte
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			_, n = protowire.ConsumeVarint(b)
+			if n >= 0 {
+				v = b[:n]
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if v != nil {
+			if err := f(num, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package geosite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+const PluginType = "geosite"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const reloadDelay = time.Second
+
+type Args struct {
+	// File is a v2ray geosite.dat (or dlc.dat) file. Required.
+	File string `yaml:"file"`
+	// Codes are the categories to load, e.g. "cn", "geosite:category-ads-all".
+	// Attributes can be appended to select domains with ("cn@ads") or
+	// without ("google@!cn") an attribute. Required.
+	Codes []string `yaml:"codes"`
+	// AutoReload reloads the file when it changes.
+	AutoReload bool `yaml:"auto_reload"`
+}
+
+var _ data_provider.DomainMatcherProvider = (*GeoSite)(nil)
+var _ domain.Matcher[struct{}] = (*GeoSite)(nil)
+
+// GeoSite matches domains in categories of a geosite.dat file. Only the
+// configured categories are decoded, the rest of the file is skipped.
+type GeoSite struct {
+	file       string
+	categories []category
+	logger     *zap.Logger
+	sites      atomic.Pointer[sites]
+	w          *utils.FileWatcher
+
+	reloadMu sync.Mutex
+}
+
+// sites are the loaded categories of a file.
+type sites struct {
+	names    []string // configured names of the categories
+	matchers []*domain.MixMatcher[struct{}]
+	allCodes []string // all codes in the file, sorted
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	g, err := NewGeoSite(a.File, a.Codes, bp.L())
+	if err != nil {
+		return nil, err
+	}
+	if a.AutoReload {
+		w, err := utils.NewFileWatcher([]string{a.File}, reloadDelay, g.logger, g.reload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to watch file, %w", err)
+		}
+		g.w = w
+	}
+	bp.RegAPI(g.Api())
+	return g, nil
+}
+
+// NewGeoSite loads codes from file. logger can be nil.
+func NewGeoSite(file string, codes []string, logger *zap.Logger) (*GeoSite, error) {
+	if len(file) == 0 {
+		return nil, errors.New("missing dat file")
+	}
+	if len(codes) == 0 {
+		return nil, errors.New("no code is configured")
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	g := &GeoSite{file: file, logger: logger}
+	for _, s := range codes {
+		c, err := parseCategory(s)
+		if err != nil {
+			return nil, err
+		}
+		g.categories = append(g.categories, c)
+	}
+	if err := g.Reload(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Reload reloads the dat file. The loaded categories are kept if the
+// new file is invalid or misses any of them.
+func (g *GeoSite) Reload() error {
+	g.reloadMu.Lock()
+	defer g.reloadMu.Unlock()
+
+	b, err := os.ReadFile(g.file)
+	if err != nil {
+		return err
+	}
+	idx, err := indexDat(b)
+	if err != nil {
+		return fmt.Errorf("invalid dat file %s, %w", g.file, err)
+	}
+
+	s := &sites{allCodes: make([]string, 0, len(idx))}
+	for code := range idx {
+		s.allCodes = append(s.allCodes, code)
+	}
+	slices.Sort(s.allCodes)
+	total := 0
+	for i, c := range g.categories {
+		m := domain.NewMixMatcher[struct{}]()
+		added, skipped, err := idx.load(c, m)
+		if err != nil {
+			return fmt.Errorf("failed to load code #%d, %w", i, err)
+		}
+		if skipped > 0 {
+			g.logger.Warn("invalid domains skipped", zap.String("code", c.String()), zap.Int("skipped", skipped))
+		}
+		total += added
+		s.names = append(s.names, c.String())
+		s.matchers = append(s.matchers, m)
+	}
+	g.sites.Store(s)
+	g.logger.Info("geosite loaded", zap.String("file", g.file), zap.Int("codes", len(g.categories)), zap.Int("domains", total))
+	return nil
+}
+
+func (g *GeoSite) reload() {
+	if err := g.Reload(); err != nil {
+		g.logger.Warn("failed to reload geosite, keep using the current one", zap.Error(err))
+	}
+}
+
+// Close stops watching the file.
+func (g *GeoSite) Close() error {
+	if g.w != nil {
+		return g.w.Close()
+	}
+	return nil
+}
+
+func (g *GeoSite) GetDomainMatcher() domain.Matcher[struct{}] {
+	return g
+}
+
+func (g *GeoSite) Match(s string) (struct{}, bool) {
+	for _, m := range g.sites.Load().matchers {
+		if _, ok := m.Match(s); ok {
+			return struct{}{}, true
+		}
+	}
+	return struct{}{}, false
+}
+
+// MatchedCodes returns the configured codes that contain s.
+func (g *GeoSite) MatchedCodes(s string) []string {
+	st := g.sites.Load()
+	matched := make([]string, 0)
+	for i, m := range st.matchers {
+		if _, ok := m.Match(s); ok {
+			matched = append(matched, st.names[i])
+		}
+	}
+	return matched
+}
+
+func (g *GeoSite) Api() *chi.Mux {
+	r := chi.NewRouter()
+
+	// GET /match?domain=google.com
+	r.Get("/match", func(w http.ResponseWriter, req *http.Request) {
+		d := req.URL.Query().Get("domain")
+		if len(d) == 0 {
+			http.Error(w, "missing domain", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"domain": d, "codes": g.MatchedCodes(d)})
+	})
+
+	// GET /codes lists all codes in the file.
+	r.Get("/codes", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(g.sites.Load().allCodes)
+	})
+
+	// POST /reload reloads the dat file, e.g. after it was updated by cron.
+	r.Post("/reload", func(w http.ResponseWriter, req *http.Request) {
+		if err := g.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return r
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package geosite
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type testDomain struct {
+	typ   uint64
+	value string
+	attrs []string
+}
+
+func appendSite(b []byte, code string, domains ...testDomain) []byte {
+	var site []byte
+	site = protowire.AppendTag(site, fieldSiteCode, protowire.BytesType)
+	site = protowire.AppendString(site, code)
+	for _, d := range domains {
+		var db []byte
+		db = protowire.AppendTag(db, fieldDomainType, protowire.VarintType)
+		db = protowire.AppendVarint(db, d.typ)
+		db = protowire.AppendTag(db, fieldDomainValue, protowire.BytesType)
+		db = protowire.AppendString(db, d.value)
+		for _, attr := range d.attrs {
+			var ab []byte
+			ab = protowire.AppendTag(ab, fieldAttrKey, protowire.BytesType)
+			ab = protowire.AppendString(ab, attr)
+			ab = protowire.AppendTag(ab, 2, protowire.VarintType) // bool_value
+			ab = protowire.AppendVarint(ab, 1)
+			db = protowire.AppendTag(db, fieldDomainAttr, protowire.BytesType)
+			db = protowire.AppendBytes(db, ab)
+		}
+		site = protowire.AppendTag(site, fieldSiteDomain, protowire.BytesType)
+		site = protowire.AppendBytes(site, db)
+	}
+	b = protowire.AppendTag(b, fieldSiteListEntry, protowire.BytesType)
+	return protowire.AppendBytes(b, site)
+}
+
+func writeDat(t *testing.T, file string, b []byte) {
+	t.Helper()
+	if err := os.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeoSite(t *testing.T) {
+	var b []byte
+	b = appendSite(b, "CN",
+		testDomain{typ: domainTypeRootDomain, value: "cn"},
+		testDomain{typ: domainTypeFull, value: "www.baidu.com"},
+		testDomain{typ: domainTypePlain, value: "taobao"},
+		testDomain{typ: domainTypeRegex, value: `^qq\d+\.com$`},
+		testDomain{typ: domainTypeRegex, value: `(`}, // invalid, skipped
+		testDomain{typ: domainTypeRootDomain, value: "ads.example", attrs: []string{"ads"}},
+	)
+	b = appendSite(b, "GOOGLE",
+		testDomain{typ: domainTypeRootDomain, value: "google.com"},
+		testDomain{typ: domainTypeRootDomain, value: "google.cn", attrs: []string{"cn"}},
+	)
+	b = appendSite(b, "CATEGORY-ADS-ALL", testDomain{typ: domainTypeRootDomain, value: "doubleclick.net"})
+	file := filepath.Join(t.TempDir(), "geosite.dat")
+	writeDat(t, file, b)
+
+	g, err := NewGeoSite(file, []string{"cn@!ads", "geosite:google@cn"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"a.cn.", true},
+		{"www.baidu.com.", true},
+		{"baidu.com.", false},
+		{"world.taobao.com.", true},
+		{"qq123.com.", true},
+		{"ads.example.", false},  // excluded by !ads
+		{"google.com.", false},   // no cn attribute
+		{"www.google.cn.", true}, // in google@cn, and cn
+		{"doubleclick.net.", false},
+	}
+	for _, tt := range tests {
+		if _, ok := g.Match(tt.domain); ok != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.domain, ok, tt.want)
+		}
+	}
+	if got := g.MatchedCodes("www.google.cn."); !slices.Equal(got, []string{"cn@!ads", "google@cn"}) {
+		t.Errorf("MatchedCodes() = %v", got)
+	}
+	if got := g.sites.Load().allCodes; !slices.Equal(got, []string{"CATEGORY-ADS-ALL", "CN", "GOOGLE"}) {
+		t.Errorf("allCodes = %v", got)
+	}
+
+	if _, err := NewGeoSite(file, []string{"us"}, nil); err == nil {
+		t.Error("missing code should fail")
+	}
+
+	// A new file without a configured code is rejected, the current
+	// one is kept.
+	writeDat(t, file, appendSite(nil, "CN"))
+	if err := g.Reload(); err == nil {
+		t.Fatal("reload should fail")
+	}
+	if _, ok := g.Match("www.baidu.com."); !ok {
+		t.Error("old categories should be kept")
+	}
+
+	writeDat(t, file, appendSite(appendSite(nil, "CN"), "GOOGLE",
+		testDomain{typ: domainTypeFull, value: "google.cn", attrs: []string{"cn"}}))
+	if err := g.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.Match("www.baidu.com."); ok {
+		t.Error("categories should be reloaded")
+	}
+	if _, ok := g.Match("google.cn."); !ok {
+		t.Error("categories should be reloaded")
+	}
+
+	if _, err := indexDat([]byte{0x0a, 0xff}); err == nil {
+		t.Error("invalid dat should fail")
+	}
+}
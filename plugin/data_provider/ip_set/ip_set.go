@@ -121,7 +121,7 @@ func (d *IPSet) api() *chi.Mux {
 	})
 
 	// GET /save: persist to files
-	r.Get("/save", func(w http.ResponseWriter, r *http.Request) {
+	r.Get("/save", coremain.AdminOnly(func(w http.ResponseWriter, r *http.Request) {
 		d.mutex.RLock()
 		defer d.mutex.RUnlock()
 		if err := d.saveToFiles(); err != nil {
@@ -129,10 +129,10 @@ func (d *IPSet) api() *chi.Mux {
 			return
 		}
 		w.Write([]byte("ip_set rules saved"))
-	})
+	}))
 
 	// GET /flush: clear in-memory and save empty list
-	r.Get("/flush", func(w http.ResponseWriter, r *http.Request) {
+	r.Get("/flush", coremain.AdminOnly(func(w http.ResponseWriter, r *http.Request) {
 		d.mutex.Lock()
 		defer d.mutex.Unlock() // Use defer for safety
 
@@ -146,7 +146,7 @@ func (d *IPSet) api() *chi.Mux {
 			return
 		}
 		w.Write([]byte("ip_set flushed and saved"))
-	})
+	}))
 
 	// POST /post: replace in-memory list with provided values and save
 	r.Post("/post", func(w http.ResponseWriter, r *http.Request) {
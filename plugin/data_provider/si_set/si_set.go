@@ -27,6 +27,7 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -64,7 +65,8 @@ type Args struct {
 	LocalConfig string `yaml:"local_config"`
 }
 
-// RuleSource defines the structure for an online SRS rule source.
+// RuleSource defines the structure for an online rule source.
+// The file can be a sing-box SRS file or a plain text CIDR list.
 type RuleSource struct {
 	Name                string    `json:"name"`
 	Type                string    `json:"type"` // For informational purposes, e.g., "geoipcn"
@@ -75,6 +77,8 @@ type RuleSource struct {
 	UpdateIntervalHours int       `json:"update_interval_hours"`
 	RuleCount           int       `json:"rule_count"`
 	LastUpdated         time.Time `json:"last_updated"`
+	ETag                string    `json:"etag,omitempty"`          // ETag of the last download.
+	LastModified        string    `json:"last_modified,omitempty"` // Last-Modified of the last download.
 }
 
 // SiSet implements IPMatcherProvider and holds the state for the plugin.
@@ -153,9 +157,15 @@ func newSiSet(bp *coremain.BP, args any) (any, error) {
 	return p, nil
 }
 
-// GetIPMatcher provides the currently active IP matcher.
+// GetIPMatcher returns p itself, so consumers always see the latest
+// rules after a reload instead of the list that was active at their init.
 func (p *SiSet) GetIPMatcher() netlist.Matcher {
-	return p.matcher.Load().(netlist.Matcher)
+	return p
+}
+
+// Match matches addr against the currently active list.
+func (p *SiSet) Match(addr netip.Addr) bool {
+	return p.matcher.Load().(netlist.Matcher).Match(addr)
 }
 
 // Close gracefully shuts down the plugin.
@@ -307,60 +317,92 @@ func (p *SiSet) reloadAllRules() error {
 }
 
 // downloadAndUpdateLocalFile handles the download, validation, and file writing.
-func (p *SiSet) downloadAndUpdateLocalFile(ctx context.Context, sourceName string) error {
+// If the server replies 304 (not modified), changed is false and the local
+// file is kept as is.
+func (p *SiSet) downloadAndUpdateLocalFile(ctx context.Context, sourceName string) (changed bool, err error) {
 	p.mu.RLock()
 	source, ok := p.sources[sourceName]
 	if !ok {
 		p.mu.RUnlock()
-		return fmt.Errorf("source '%s' not found", sourceName)
+		return false, fmt.Errorf("source '%s' not found", sourceName)
 	}
 	// Make copies of fields to use outside the lock
 	sourceURL := source.URL
 	localFile := source.Files
+	etag := source.ETag
+	lastModified := source.LastModified
 	p.mu.RUnlock()
 
 	if sourceURL == "" {
-		return fmt.Errorf("source '%s' has no URL configured", sourceName)
+		return false, fmt.Errorf("source '%s' has no URL configured", sourceName)
 	}
 	if localFile == "" {
-		return fmt.Errorf("source '%s' has no local file path configured", sourceName)
+		return false, fmt.Errorf("source '%s' has no local file path configured", sourceName)
 	}
 
 	log.Printf("[%s] downloading rule for '%s' from %s", PluginType, sourceName, sourceURL)
 	req, err := http.NewRequestWithContext(ctx, "GET", sourceURL, nil)
 	if err != nil {
-		return fmt.Errorf("failed to create request for '%s': %w", sourceName, err)
+		return false, fmt.Errorf("failed to create request for '%s': %w", sourceName, err)
+	}
+
+	// Conditional request. Only if the local file exists, otherwise a
+	// lost file could never be downloaded again.
+	if _, err := os.Stat(localFile); err == nil {
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
 	}
 
 	resp, err := p.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("http request failed for '%s': %w", sourceName, err)
+		return false, fmt.Errorf("http request failed for '%s': %w", sourceName, err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		p.mu.Lock()
+		if source, ok := p.sources[sourceName]; ok {
+			source.LastUpdated = time.Now()
+		}
+		p.mu.Unlock()
+		log.Printf("[%s] rule for '%s' is not modified, skipping.", PluginType, sourceName)
+		if err := p.saveConfig(); err != nil {
+			log.Printf("[%s] ERROR: failed to save config after updating '%s': %v", PluginType, sourceName, err)
+		}
+		return false, nil
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status code for '%s': %d", sourceName, resp.StatusCode)
+		return false, fmt.Errorf("bad status code for '%s': %d", sourceName, resp.StatusCode)
 	}
 
-	srsData, err := io.ReadAll(resp.Body)
+	data, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to read response body for '%s': %w", sourceName, err)
+		return false, fmt.Errorf("failed to read response body for '%s': %w", sourceName, err)
 	}
 
 	// CRITICAL STEP: Validate the downloaded data in memory before writing to disk.
-	tempList := netlist.NewList()
-	ok, count, _ := tryLoadSRS(srsData, tempList)
-	if !ok {
-		return fmt.Errorf("downloaded file for '%s' is not a valid SRS file or is corrupted", sourceName)
+	count, err := parseRules(data, netlist.NewList())
+	if err != nil {
+		return false, fmt.Errorf("downloaded file for '%s' is invalid: %w", sourceName, err)
 	}
 	log.Printf("[%s] downloaded file for '%s' validated successfully with %d rules.", PluginType, sourceName, count)
 
 	// Ensure the target directory exists.
 	if err := os.MkdirAll(filepath.Dir(localFile), 0755); err != nil {
-		return fmt.Errorf("failed to create directory for '%s': %w", localFile, err)
+		return false, fmt.Errorf("failed to create directory for '%s': %w", localFile, err)
 	}
-	if err := os.WriteFile(localFile, srsData, 0644); err != nil {
-		return fmt.Errorf("failed to write srs file for '%s': %w", sourceName, err)
+	// Atomic write, so a concurrent reload never reads a partial file.
+	tmpFile := localFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return false, fmt.Errorf("failed to write rule file for '%s': %w", sourceName, err)
+	}
+	if err := os.Rename(tmpFile, localFile); err != nil {
+		return false, fmt.Errorf("failed to rename rule file for '%s': %w", sourceName, err)
 	}
 
 	// Update metadata. This part needs a lock.
@@ -368,6 +410,8 @@ func (p *SiSet) downloadAndUpdateLocalFile(ctx context.Context, sourceName strin
 	if source, ok := p.sources[sourceName]; ok {
 		source.RuleCount = count
 		source.LastUpdated = time.Now()
+		source.ETag = resp.Header.Get("ETag")
+		source.LastModified = resp.Header.Get("Last-Modified")
 	}
 	p.mu.Unlock()
 
@@ -376,7 +420,7 @@ func (p *SiSet) downloadAndUpdateLocalFile(ctx context.Context, sourceName strin
 		log.Printf("[%s] ERROR: failed to save config after updating '%s': %v", PluginType, sourceName, err)
 	}
 
-	return nil
+	return true, nil
 }
 
 // backgroundUpdater periodically checks for and updates rules.
@@ -411,19 +455,27 @@ func (p *SiSet) backgroundUpdater() {
 
 			log.Printf("[%s] auto-update: found %d source(s) that need updating.", PluginType, len(sourcesToUpdate))
 			var wg sync.WaitGroup
+			var anyChanged atomic.Bool
 			for _, name := range sourcesToUpdate {
 				wg.Add(1)
 				go func(sourceName string) {
 					defer wg.Done()
 					updateCtx, cancel := context.WithTimeout(p.ctx, downloadTimeout)
 					defer cancel()
-					if err := p.downloadAndUpdateLocalFile(updateCtx, sourceName); err != nil {
+					changed, err := p.downloadAndUpdateLocalFile(updateCtx, sourceName)
+					if err != nil {
 						log.Printf("[%s] ERROR: failed to auto-update source '%s': %v", PluginType, sourceName, err)
 					}
+					if changed {
+						anyChanged.Store(true)
+					}
 				}(name)
 			}
 			wg.Wait()
 
+			if !anyChanged.Load() {
+				continue
+			}
 			log.Printf("[%s] auto-update: downloads finished, triggering reload.", PluginType)
 			if err := p.reloadAllRules(); err != nil {
 				log.Printf("[%s] ERROR: failed to reload rules after auto-update: %v", PluginType, err)
@@ -467,10 +519,14 @@ func (p *SiSet) api() *chi.Mux {
 			log.Printf("[%s] manual update triggered for source '%s'.", PluginType, name)
 			updateCtx, cancel := context.WithTimeout(p.ctx, downloadTimeout*2) // Give more time for manual updates
 			defer cancel()
-			if err := p.downloadAndUpdateLocalFile(updateCtx, name); err != nil {
+			changed, err := p.downloadAndUpdateLocalFile(updateCtx, name)
+			if err != nil {
 				log.Printf("[%s] ERROR: failed to manually update source '%s': %v", PluginType, name, err)
 				return // Don't reload if download fails
 			}
+			if !changed {
+				return
+			}
 			log.Printf("[%s] manual update for '%s' successful, triggering reload.", PluginType, name)
 			if err := p.reloadAllRules(); err != nil {
 				log.Printf("[%s] ERROR: failed to reload rules after manual update: %v", PluginType, err)
@@ -497,6 +553,11 @@ func (p *SiSet) api() *chi.Mux {
 		existing, isUpdate := p.sources[name]
 		if isUpdate {
 			// Update existing source
+			if existing.URL != reqData.URL || existing.Files != reqData.Files {
+				// Validators of the old url are no longer valid.
+				existing.ETag = ""
+				existing.LastModified = ""
+			}
 			existing.Type = reqData.Type
 			existing.Files = reqData.Files
 			existing.URL = reqData.URL
@@ -509,6 +570,8 @@ func (p *SiSet) api() *chi.Mux {
 			// Add new source
 			reqData.RuleCount = 0
 			reqData.LastUpdated = time.Time{}
+			reqData.ETag = ""
+			reqData.LastModified = ""
 			p.sources[name] = &reqData
 			updatedSource = &reqData
 			statusCode = http.StatusCreated
@@ -591,15 +654,28 @@ func loadFromFile(path string, l *netlist.List) error {
 		return err
 	}
 
-	// Only try .srs binary format as per requirement.
-	ok, _, _ := tryLoadSRS(data, l)
-	if !ok {
-		return fmt.Errorf("file %s is not a valid or supported SRS file", path)
+	if _, err := parseRules(data, l); err != nil {
+		return fmt.Errorf("file %s: %w", path, err)
 	}
-
 	return nil
 }
 
+// parseRules loads data, a SRS file or a plain text CIDR list, into l.
+// It returns the number of loaded rules.
+func parseRules(data []byte, l *netlist.List) (int, error) {
+	if ok, count, _ := tryLoadSRS(data, l); ok {
+		return count, nil
+	}
+	if bytes.HasPrefix(data, srsMagic[:]) {
+		return 0, errors.New("corrupted SRS file")
+	}
+	before := l.Len()
+	if err := netlist.LoadFromReader(l, bytes.NewReader(data)); err != nil {
+		return 0, fmt.Errorf("not a valid SRS file or CIDR list: %w", err)
+	}
+	return l.Len() - before, nil
+}
+
 // --- SRS Parsing Logic (Copied directly from ip_set.go) ---
 var (
 	srsMagic            = [3]byte{'S', 'R', 'S'}
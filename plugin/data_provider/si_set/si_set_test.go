@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package si_set
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+)
+
+func Test_SiSet_conditionalUpdate(t *testing.T) {
+	body := "# test list\n1.0.0.0/24\n2001:db8::/32\n"
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	p := &SiSet{
+		sources: map[string]*RuleSource{
+			"test": {Name: "test", URL: srv.URL, Files: filepath.Join(dir, "test.txt"), Enabled: true},
+		},
+		localConfigFile: filepath.Join(dir, "config.json"),
+		httpClient:      srv.Client(),
+	}
+	p.matcher.Store(netlist.NewList())
+	m := p.GetIPMatcher() // Must observe later reloads.
+
+	changed, err := p.downloadAndUpdateLocalFile(context.Background(), "test")
+	if err != nil || !changed {
+		t.Fatalf("first download: changed = %v, err = %v", changed, err)
+	}
+	if err := p.reloadAllRules(); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Match(netip.MustParseAddr("1.0.0.1")) || !m.Match(netip.MustParseAddr("2001:db8::1")) {
+		t.Fatal("matcher does not see the reloaded rules")
+	}
+	if got := p.sources["test"].RuleCount; got != 2 {
+		t.Fatalf("rule count = %d, want 2", got)
+	}
+
+	changed, err = p.downloadAndUpdateLocalFile(context.Background(), "test")
+	if err != nil || changed {
+		t.Fatalf("second download: changed = %v, err = %v", changed, err)
+	}
+	if requests != 2 {
+		t.Fatalf("requests = %d, want 2", requests)
+	}
+}
+
+func Test_parseRules(t *testing.T) {
+	if _, err := parseRules([]byte("1.1.1.1\nnot_an_ip\n"), netlist.NewList()); err == nil {
+		t.Fatal("invalid list should be rejected")
+	}
+	if _, err := parseRules([]byte("SRS\x01garbage"), netlist.NewList()); err == nil {
+		t.Fatal("corrupted srs should be rejected")
+	}
+}
@@ -23,12 +23,16 @@ package plugin
 import (
 	// data provider
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/data_provider/domain_set"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/data_provider/domain_set_ops"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/data_provider/geoip"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/data_provider/geosite"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/data_provider/ip_set"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/data_provider/sd_set"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/data_provider/si_set"
 
 	// matcher
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/client_ip"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/client_tag"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/cname"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/env"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/has_resp"
@@ -39,27 +43,38 @@ import (
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/qtype"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/random"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/rcode"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/resp_geoip"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/resp_ip"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/string_exp"
 
 	// executable
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/addr_filter"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/arbitrary"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/black_hole"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/cache"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/debug_print"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/dhcp_leases"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/dnsmasq"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/dnssec_validator"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/dnstap"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/domain_router"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/drop_resp"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/dual_selector"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/ecs_handler"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/ecs_policy"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/forward"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/forward_edns0opt"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/hosts"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/ipset"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/local_ptr"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/metrics_collector"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/nftset"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/query_log"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/query_summary"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/rate_limiter"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/redirect"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/reverse_lookup"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/safe_search"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/domain_output"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/switcher1"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/switcher2"
@@ -75,13 +90,20 @@ import (
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/adguard"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/webinfo"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/requery"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/backup"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/rewrite"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/search_domain"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence/fallback"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence/parallel"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/shadow"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sleep"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/svcb_filter"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/ttl"
 
 	// executable and matcher
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/client_bypass"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/neighbor"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/mark"
 
 	// server
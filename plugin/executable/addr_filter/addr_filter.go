@@ -0,0 +1,208 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package addr_filter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/domain_set"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "addr_filter"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
+}
+
+const (
+	modeNodata = "nodata"
+	modeDrop   = "drop"
+)
+
+type Args struct {
+	// Type is the address type to filter, "aaaa" (default) or "a".
+	Type string `yaml:"type"`
+	// Mode is "nodata" (default) or "drop".
+	// "nodata" replies an empty NOERROR response to queries of Type
+	// without forwarding them. "drop" forwards them and removes records
+	// of Type from the response.
+	Mode string `yaml:"mode"`
+
+	// If DomainSets or Domains is set, only queries that match them are
+	// filtered. Otherwise, all queries are filtered.
+	DomainSets []string `yaml:"domain_sets"` // tags of domain providers
+	Domains    []string `yaml:"domains"`     // domain expressions
+}
+
+var _ sequence.RecursiveExecutable = (*AddrFilter)(nil)
+
+// AddrFilter filters A or AAAA records, e.g. to disable ipv6 for domains
+// that are broken on dual stack networks. In both modes, address hints
+// of the filtered family are also removed from HTTPS/SVCB responses, so
+// clients won't connect to them anyway.
+type AddrFilter struct {
+	qtype    uint16 // dns.TypeA or dns.TypeAAAA
+	drop     bool
+	matchers []domain.Matcher[struct{}] // nil means all domains
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	f, err := NewAddrFilter(a.Type, a.Mode)
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range a.DomainSets {
+		provider, _ := bp.M().GetPlugin(tag).(data_provider.DomainMatcherProvider)
+		if provider == nil {
+			return nil, fmt.Errorf("%s is not a DomainMatcherProvider", tag)
+		}
+		f.matchers = append(f.matchers, provider.GetDomainMatcher())
+	}
+	if len(a.Domains) > 0 {
+		m := domain.NewMixMatcher[struct{}]()
+		m.SetDefaultMatcher(domain.MatcherDomain)
+		if err := domain_set.LoadExps(a.Domains, m); err != nil {
+			return nil, err
+		}
+		f.matchers = append(f.matchers, m)
+	}
+	return f, nil
+}
+
+// QuickSetup format: [a|aaaa] [nodata|drop]
+// Default is "aaaa nodata".
+func QuickSetup(_ sequence.BQ, s string) (any, error) {
+	var typ, mode string
+	for _, field := range strings.Fields(s) {
+		switch field = strings.ToLower(field); field {
+		case "a", "aaaa":
+			typ = field
+		case modeNodata, modeDrop:
+			mode = field
+		default:
+			return nil, fmt.Errorf("invalid argument %s", field)
+		}
+	}
+	return NewAddrFilter(typ, mode)
+}
+
+func NewAddrFilter(typ, mode string) (*AddrFilter, error) {
+	f := new(AddrFilter)
+	switch strings.ToLower(typ) {
+	case "", "aaaa":
+		f.qtype = dns.TypeAAAA
+	case "a":
+		f.qtype = dns.TypeA
+	default:
+		return nil, fmt.Errorf("invalid type %s", typ)
+	}
+	switch strings.ToLower(mode) {
+	case "", modeNodata:
+	case modeDrop:
+		f.drop = true
+	default:
+		return nil, fmt.Errorf("invalid mode %s", mode)
+	}
+	return f, nil
+}
+
+func (f *AddrFilter) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || !f.match(q.Question[0].Name) {
+		return next.ExecNext(ctx, qCtx)
+	}
+
+	qt := q.Question[0].Qtype
+	if qt == f.qtype && !f.drop {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Ns = []dns.RR{dnsutils.FakeSOA(q.Question[0].Name)}
+		qCtx.SetResponse(r)
+		return nil
+	}
+
+	if err := next.ExecNext(ctx, qCtx); err != nil {
+		return err
+	}
+	if r := qCtx.R(); r != nil {
+		f.filter(r)
+	}
+	return nil
+}
+
+func (f *AddrFilter) match(name string) bool {
+	if f.matchers == nil {
+		return true
+	}
+	for _, m := range f.matchers {
+		if _, ok := m.Match(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// filter removes records of f.qtype and the address hints of its family
+// from r.Answer.
+func (f *AddrFilter) filter(r *dns.Msg) {
+	kept := r.Answer[:0]
+	for _, rr := range r.Answer {
+		switch rr := rr.(type) {
+		case *dns.HTTPS:
+			f.removeHints(&rr.SVCB)
+		case *dns.SVCB:
+			f.removeHints(rr)
+		}
+		if rr.Header().Rrtype == f.qtype {
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	r.Answer = kept
+}
+
+func (f *AddrFilter) removeHints(rr *dns.SVCB) {
+	kept := rr.Value[:0]
+	for _, kv := range rr.Value {
+		switch kv.(type) {
+		case *dns.SVCBIPv4Hint:
+			if f.qtype == dns.TypeA {
+				continue
+			}
+		case *dns.SVCBIPv6Hint:
+			if f.qtype == dns.TypeAAAA {
+				continue
+			}
+		}
+		kept = append(kept, kv)
+	}
+	rr.Value = kept
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package addr_filter
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// upstream answers with a CNAME, an A, an AAAA and an HTTPS record with
+// both address hints.
+type upstream struct{ called *bool }
+
+func (u upstream) Exec(_ context.Context, qCtx *query_context.Context) error {
+	*u.called = true
+	q := qCtx.Q()
+	name := q.Question[0].Name
+	hdr := func(t uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: t, Class: dns.ClassINET, Ttl: 60}
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = []dns.RR{
+		&dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: name},
+		&dns.A{Hdr: hdr(dns.TypeA), A: net.IPv4(1, 2, 3, 4)},
+		&dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: net.ParseIP("2001:db8::1")},
+		&dns.HTTPS{SVCB: dns.SVCB{Hdr: hdr(dns.TypeHTTPS), Priority: 1, Target: ".", Value: []dns.SVCBKeyValue{
+			&dns.SVCBIPv4Hint{Hint: []net.IP{net.IPv4(1, 2, 3, 4)}},
+			&dns.SVCBIPv6Hint{Hint: []net.IP{net.ParseIP("2001:db8::1")}},
+		}}},
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_AddrFilter(t *testing.T) {
+	exec := func(f *AddrFilter, name string, qt uint16) (*dns.Msg, bool) {
+		var called bool
+		next := sequence.NewChainWalker([]*sequence.ChainNode{{E: upstream{&called}}}, nil, zap.NewNop())
+		q := new(dns.Msg)
+		q.SetQuestion(name, qt)
+		qCtx := query_context.NewContext(q)
+		if err := f.Exec(context.Background(), qCtx, next); err != nil {
+			t.Fatal(err)
+		}
+		return qCtx.R(), called
+	}
+	types := func(r *dns.Msg) (ts []uint16, hints int) {
+		for _, rr := range r.Answer {
+			ts = append(ts, rr.Header().Rrtype)
+			if h, ok := rr.(*dns.HTTPS); ok {
+				hints = len(h.Value)
+			}
+		}
+		return ts, hints
+	}
+
+	f, err := NewAddrFilter("aaaa", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, called := exec(f, "example.com.", dns.TypeAAAA)
+	if called || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Fatalf("want local nodata response, called upstream %v, got %v", called, r)
+	}
+	r, _ = exec(f, "example.com.", dns.TypeHTTPS)
+	if ts, hints := types(r); len(ts) != 3 || hints != 1 {
+		t.Fatalf("aaaa records and ipv6 hints should be removed, got %v", r)
+	}
+
+	f, err = NewAddrFilter("a", modeDrop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := domain.NewMixMatcher[struct{}]()
+	m.SetDefaultMatcher(domain.MatcherDomain)
+	if err := m.Add("v6only.com", struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	f.matchers = []domain.Matcher[struct{}]{m}
+	r, called = exec(f, "www.v6only.com.", dns.TypeA)
+	if ts, hints := types(r); !called || len(ts) != 3 || ts[1] != dns.TypeAAAA || hints != 1 {
+		t.Fatalf("a records should be dropped, got %v", r)
+	}
+	r, _ = exec(f, "example.com.", dns.TypeA)
+	if ts, hints := types(r); len(ts) != 4 || hints != 2 {
+		t.Fatalf("unmatched domains should not be filtered, got %v", r)
+	}
+
+	if _, err := QuickSetup(nil, "aaaa ttl"); err == nil {
+		t.Fatal("invalid argument should fail")
+	}
+}
@@ -0,0 +1,283 @@
+package adguard_rule
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	maxRestoreSize = 512 << 20 // 恢复时归档解压后的最大总大小
+	rulesFileExt   = ".rules"
+)
+
+// handleBackup 处理 GET /backup, 返回包含 config.json、用户规则与所有规则文件的 tar.gz 归档
+func (p *AdguardRule) handleBackup(w http.ResponseWriter, r *http.Request) {
+	config, err := p.store.Get(r.Context(), configFile)
+	if err != nil {
+		// 配置可能尚未保存过, 以当前内存中的规则列表为准
+		if err := p.saveConfig(); err != nil {
+			jsonError(w, "Failed to save config", http.StatusInternalServerError)
+			return
+		}
+		if config, err = p.store.Get(r.Context(), configFile); err != nil {
+			jsonError(w, "Failed to read config", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	p.mu.RLock()
+	paths := make(map[string]string, len(p.onlineRules))
+	for id, rule := range p.onlineRules {
+		paths[id] = rule.localPath
+	}
+	p.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="adguard_rule-backup-%s.tar.gz"`, time.Now().Format("20060102-150405")))
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err = writeBackupFile(tw, configFile, config)
+	if err == nil {
+		text, _ := p.userRules.get()
+		err = writeBackupFile(tw, userRulesFile, []byte(text))
+	}
+	for id, path := range paths {
+		if err != nil {
+			break
+		}
+		data, readErr := os.ReadFile(path)
+		if readErr != nil {
+			if !os.IsNotExist(readErr) {
+				log.Printf("[adguard_rule] WARN: rule file %s skipped in backup: %v", path, readErr)
+			}
+			continue
+		}
+		err = writeBackupFile(tw, id+rulesFileExt, data)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gw.Close()
+	}
+	if err != nil {
+		// 响应头已经发出, 只能记录错误
+		log.Printf("[adguard_rule] ERROR: failed to write backup: %v", err)
+	}
+}
+
+func writeBackupFile(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// readBackup 读取并校验备份归档 (tar.gz 或 tar)。返回规则列表配置、用户规则 (不存在时为 nil)
+// 以及按规则 ID 索引的规则文件内容
+func readBackup(r io.Reader) ([]*OnlineRule, []byte, map[string][]byte, error) {
+	br := bufio.NewReader(r)
+	var src io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid gzip data: %w", err)
+		}
+		defer gr.Close()
+		src = gr
+	}
+	lr := &io.LimitedReader{R: src, N: maxRestoreSize + 1}
+	tr := tar.NewReader(lr)
+
+	var config, userRules []byte
+	ruleFiles := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid tar archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read %s: %w", hdr.Name, err)
+		}
+		if lr.N <= 0 {
+			return nil, nil, nil, fmt.Errorf("backup is larger than %d bytes", maxRestoreSize)
+		}
+		name := strings.TrimPrefix(hdr.Name, "./")
+		switch {
+		case name == configFile:
+			config = data
+		case name == userRulesFile:
+			userRules = data
+		case strings.HasSuffix(name, rulesFileExt):
+			ruleFiles[strings.TrimSuffix(name, rulesFileExt)] = data
+		}
+	}
+
+	if config == nil {
+		return nil, nil, nil, fmt.Errorf("%s not found in backup", configFile)
+	}
+	var rules []*OnlineRule
+	if err := json.Unmarshal(config, &rules); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid %s: %w", configFile, err)
+	}
+	ids := make(map[string]struct{}, len(rules))
+	for _, rule := range rules {
+		if !validRuleID(rule.ID) {
+			return nil, nil, nil, fmt.Errorf("invalid rule id %q", rule.ID)
+		}
+		if _, dup := ids[rule.ID]; dup {
+			return nil, nil, nil, fmt.Errorf("duplicated rule id %q", rule.ID)
+		}
+		ids[rule.ID] = struct{}{}
+		if !validFormat(rule.Format) {
+			return nil, nil, nil, fmt.Errorf("rule %q has invalid format %q", rule.ID, rule.Format)
+		}
+		if err := validClients(rule.Clients); err != nil {
+			return nil, nil, nil, fmt.Errorf("rule %q: %w", rule.ID, err)
+		}
+		if _, err := parseSchedule(rule.Schedule); err != nil {
+			return nil, nil, nil, fmt.Errorf("rule %q: %w", rule.ID, err)
+		}
+	}
+	for id := range ruleFiles {
+		if _, ok := ids[id]; !ok {
+			return nil, nil, nil, fmt.Errorf("rule file %s%s has no rule in %s", id, rulesFileExt, configFile)
+		}
+	}
+	return rules, userRules, ruleFiles, nil
+}
+
+// validRuleID 检查规则 ID 可以安全地用作文件名
+func validRuleID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.ContainsAny(id, `/\`+"\x00")
+}
+
+// handleRestore 处理 POST /restore, 用备份归档替换规则列表配置、用户规则与规则文件, 然后触发重载。
+// 归档在替换任何文件前被完整校验; 备份中缺失的已启用规则文件会在后台重新下载
+func (p *AdguardRule) handleRestore(w http.ResponseWriter, r *http.Request) {
+	rules, userRulesText, ruleFiles, err := readBackup(http.MaxBytesReader(w, r.Body, maxRestoreSize))
+	if err != nil {
+		jsonError(w, "Invalid backup: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 与重载互斥, 避免重载读到替换到一半的规则文件
+	p.reloadMu.Lock()
+	err = p.restore(rules, userRulesText, ruleFiles)
+	p.reloadMu.Unlock()
+	if err != nil {
+		log.Printf("[adguard_rule] ERROR: failed to restore backup: %v", err)
+		jsonError(w, "Failed to restore backup: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	missing := []string{}
+	for _, rule := range rules {
+		if _, ok := ruleFiles[rule.ID]; !ok && rule.Enabled {
+			missing = append(missing, rule.ID)
+		}
+	}
+	log.Printf("[adguard_rule] restored %d rules and %d rule files from backup", len(rules), len(ruleFiles))
+	jobID := p.startDownloadJob(jobTypeRestore, reloadSourceRestore, missing, true)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"rules":       len(rules),
+		"rule_files":  len(ruleFiles),
+		"downloading": missing,
+		"job_id":      jobID,
+	})
+}
+
+// restore 替换规则文件、规则列表配置与用户规则。规则文件先全部写入临时文件,
+// 任一写入失败时不做任何替换
+func (p *AdguardRule) restore(rules []*OnlineRule, userRulesText []byte, ruleFiles map[string][]byte) error {
+	tmps := make(map[string]string, len(ruleFiles))
+	defer func() {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}()
+	for id, data := range ruleFiles {
+		f, err := os.CreateTemp(p.dir, "restore-*.tmp")
+		if err != nil {
+			return err
+		}
+		tmps[id] = f.Name()
+		_, err = f.Write(data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write rule file of %s: %w", id, err)
+		}
+	}
+
+	config, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config to json: %w", err)
+	}
+	if err := p.store.Put(p.ctx, configFile, config); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+
+	p.mu.Lock()
+	oldRules := p.onlineRules
+	p.onlineRules = make(map[string]*OnlineRule, len(rules))
+	for _, rule := range rules {
+		rule.localPath = filepath.Join(p.dir, rule.ID+rulesFileExt)
+		p.onlineRules[rule.ID] = rule
+	}
+	p.mu.Unlock()
+
+	for id, tmp := range tmps {
+		if err := os.Rename(tmp, filepath.Join(p.dir, id+rulesFileExt)); err != nil {
+			return fmt.Errorf("failed to move rule file of %s: %w", id, err)
+		}
+		delete(tmps, id)
+	}
+	// 删除不再使用的规则文件与备份中没有的旧规则文件
+	for id, rule := range oldRules {
+		if _, ok := ruleFiles[id]; ok {
+			continue
+		}
+		if err := os.Remove(rule.localPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("[adguard_rule] WARN: failed to delete rule file %s: %v", rule.localPath, err)
+		}
+	}
+
+	if userRulesText != nil {
+		p.userRules.editMu.Lock()
+		defer p.userRules.editMu.Unlock()
+		if err := p.userRules.save(string(userRulesText)); err != nil {
+			return err
+		}
+		p.userRules.set(string(userRulesText))
+	}
+	return nil
+}
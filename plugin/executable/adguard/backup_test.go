@@ -0,0 +1,135 @@
+package adguard_rule
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarOf 返回由 files (名称, 内容交替) 组成的 tar 归档
+func tarOf(t *testing.T, files ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i+1 < len(files); i += 2 {
+		if err := writeBackupFile(tw, files[i], []byte(files[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAdguardRule_BackupRoundTrip(t *testing.T) {
+	l1 := &OnlineRule{ID: "l1", Name: "List 1", URL: "https://a.example/l1.txt", Enabled: true}
+	l2 := &OnlineRule{ID: "l2", Name: "List 2", URL: "https://a.example/l2.txt"}
+	p := newTestDownloader(t, l1, l2)
+	p.userRules.set("||user.example.com^\n")
+	if err := os.WriteFile(l1.localPath, []byte("||ads.example.com^\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	p.handleBackup(w, httptest.NewRequest(http.MethodGet, "/backup", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/gzip" {
+		t.Fatalf("backup: %d %v", w.Code, w.Header())
+	}
+	rules, userRules, ruleFiles, err := readBackup(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 || rules[0].ID != "l1" || rules[0].URL != l1.URL || !rules[0].Enabled || rules[1].ID != "l2" {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+	if string(userRules) != "||user.example.com^\n" {
+		t.Fatalf("user rules %q", userRules)
+	}
+	// l2 没有规则文件, 不在备份中
+	if len(ruleFiles) != 1 || string(ruleFiles["l1"]) != "||ads.example.com^\n" {
+		t.Fatalf("rule files %q", ruleFiles)
+	}
+}
+
+func TestReadBackup(t *testing.T) {
+	const config = `[{"id": "l1", "name": "List 1", "url": "https://a.example/l1.txt"}]`
+	tests := []struct {
+		name    string
+		files   []string
+		wantErr string
+	}{
+		{name: "plain tar", files: []string{configFile, config, "l1.rules", "||a.example.com^"}},
+		{name: "dot slash names", files: []string{"./" + configFile, config, "./l1.rules", "x", "./" + userRulesFile, "y"}},
+		{name: "unknown files ignored", files: []string{configFile, config, "README", "x"}},
+		{name: "missing config", files: []string{"l1.rules", "x"}, wantErr: "not found"},
+		{name: "invalid config", files: []string{configFile, "{"}, wantErr: "invalid"},
+		{name: "invalid id", files: []string{configFile, `[{"id": "../x"}]`}, wantErr: "invalid rule id"},
+		{name: "duplicated id", files: []string{configFile, `[{"id": "l1"}, {"id": "l1"}]`}, wantErr: "duplicated"},
+		{name: "invalid format", files: []string{configFile, `[{"id": "l1", "format": "bogus"}]`}, wantErr: "invalid format"},
+		{name: "invalid schedule", files: []string{configFile, `[{"id": "l1", "schedule": {"start": "25:00", "end": "07:00"}}]`}, wantErr: "schedule"},
+		{name: "orphan rule file", files: []string{configFile, config, "../l1.rules", "x"}, wantErr: "has no rule"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, err := readBackup(bytes.NewReader(tarOf(t, tt.files...)))
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+	if _, _, _, err := readBackup(bytes.NewReader([]byte{0x1f, 0x8b, 0, 0})); err == nil {
+		t.Fatal("want error for broken gzip")
+	}
+}
+
+func TestAdguardRule_Restore(t *testing.T) {
+	old := &OnlineRule{ID: "old", Name: "Old"}
+	kept := &OnlineRule{ID: "l1", Name: "List 1"}
+	p := newTestDownloader(t, old, kept)
+	for _, rule := range []*OnlineRule{old, kept} {
+		if err := os.WriteFile(rule.localPath, []byte("||"+rule.ID+".example.com^\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rules := []*OnlineRule{{ID: "l1", Name: "List 1 restored", Enabled: true}, {ID: "l2", Name: "List 2", Enabled: true}}
+	err := p.restore(rules, []byte("||user.example.com^\n"), map[string][]byte{"l1": []byte("||restored.example.com^\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(p.dir, "l1.rules")); string(b) != "||restored.example.com^\n" {
+		t.Fatalf("l1.rules %q", b)
+	}
+	if _, err := os.Stat(old.localPath); !os.IsNotExist(err) {
+		t.Fatalf("old rule file not removed: %v", err)
+	}
+	if len(p.onlineRules) != 2 || p.onlineRules["l1"].Name != "List 1 restored" || p.onlineRules["l2"].localPath != filepath.Join(p.dir, "l2.rules") {
+		t.Fatalf("unexpected rules %+v", p.onlineRules)
+	}
+	if text, count := p.userRules.get(); text != "||user.example.com^\n" || count != 1 {
+		t.Fatalf("user rules %q, %d", text, count)
+	}
+	if b, err := p.store.Get(context.Background(), configFile); err != nil || !strings.Contains(string(b), "List 1 restored") {
+		t.Fatalf("config %s, %v", b, err)
+	}
+	if b, err := p.store.Get(context.Background(), userRulesFile); err != nil || string(b) != "||user.example.com^\n" {
+		t.Fatalf("saved user rules %q, %v", b, err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(p.dir, "restore-*.tmp"))
+	if len(matches) > 0 {
+		t.Fatalf("temp files left: %v", matches)
+	}
+}
@@ -0,0 +1,193 @@
+package adguard_rule
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+// 拦截响应类型, 与 AdGuard Home 的 blocking_mode 一致
+const (
+	blockModeNXDomain = "nxdomain"  // 默认: NXDOMAIN
+	blockModeRefused  = "refused"   // REFUSED
+	blockModeNoData   = "nodata"    // 空的 NOERROR 响应
+	blockModeNullIP   = "null_ip"   // A 返回 0.0.0.0, AAAA 返回 ::
+	blockModeCustomIP = "custom_ip" // 返回 block_ipv4/block_ipv6 指定的地址
+)
+
+const defaultBlockTTL = 10
+
+var _ sequence.RecursiveExecutable = (*AdguardRule)(nil)
+
+// blockResponder 根据拦截模式生成拦截响应
+type blockResponder struct {
+	mode string
+	ipv4 netip.Addr
+	ipv6 netip.Addr
+	ttl  uint32
+}
+
+func newBlockResponder(cfg *Args) (*blockResponder, error) {
+	b := &blockResponder{mode: cfg.BlockMode, ttl: cfg.BlockTTL}
+	if b.mode == "" {
+		b.mode = blockModeNXDomain
+	}
+	if b.ttl == 0 {
+		b.ttl = defaultBlockTTL
+	}
+	switch b.mode {
+	case blockModeNXDomain, blockModeRefused, blockModeNoData:
+	case blockModeNullIP:
+		b.ipv4, b.ipv6 = netip.IPv4Unspecified(), netip.IPv6Unspecified()
+	case blockModeCustomIP:
+		if cfg.BlockIPv4 == "" && cfg.BlockIPv6 == "" {
+			return nil, fmt.Errorf("block_mode %s requires block_ipv4 or block_ipv6", b.mode)
+		}
+		if cfg.BlockIPv4 != "" {
+			addr, err := netip.ParseAddr(cfg.BlockIPv4)
+			if err != nil || !addr.Is4() {
+				return nil, fmt.Errorf("invalid block_ipv4 %s", cfg.BlockIPv4)
+			}
+			b.ipv4 = addr
+		}
+		if cfg.BlockIPv6 != "" {
+			addr, err := netip.ParseAddr(cfg.BlockIPv6)
+			if err != nil || !addr.Is6() {
+				return nil, fmt.Errorf("invalid block_ipv6 %s", cfg.BlockIPv6)
+			}
+			b.ipv6 = addr
+		}
+	default:
+		return nil, fmt.Errorf("invalid block_mode %s", b.mode)
+	}
+	return b, nil
+}
+
+// response 生成 q 的拦截响应。null_ip/custom_ip 模式下, 没有对应地址的查询类型返回空的 NOERROR 响应。
+func (b *blockResponder) response(q *dns.Msg) *dns.Msg {
+	question := q.Question[0]
+	var r *dns.Msg
+	switch b.mode {
+	case blockModeNXDomain:
+		r = dnsutils.GenEmptyReply(q, dns.RcodeNameError)
+	case blockModeRefused:
+		r = new(dns.Msg)
+		r.SetRcode(q, dns.RcodeRefused)
+		return r
+	default:
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: b.ttl}
+		switch {
+		case question.Qtype == dns.TypeA && b.ipv4.IsValid():
+			r = new(dns.Msg)
+			r.SetReply(q)
+			r.Answer = []dns.RR{&dns.A{Hdr: hdr, A: b.ipv4.AsSlice()}}
+			return r
+		case question.Qtype == dns.TypeAAAA && b.ipv6.IsValid():
+			r = new(dns.Msg)
+			r.SetReply(q)
+			r.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: b.ipv6.AsSlice()}}
+			return r
+		}
+		r = dnsutils.GenEmptyReply(q, dns.RcodeSuccess)
+	}
+	// SOA 的 TTL 决定了客户端对拦截结果的缓存时间
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa.Hdr.Ttl = b.ttl
+			soa.Minttl = b.ttl
+		}
+	}
+	return r
+}
+
+// Exec 实现了 sequence.RecursiveExecutable 接口。
+// 查询域名命中 $dnsrewrite 规则时按规则改写响应, 不再检查拦截规则;
+// 查询域名被拦截时按 block_mode 生成响应。启用 cname_check 且查询域名未命中任何规则时,
+// 在后续插件得到响应后检查应答中的 CNAME 目标, 目标被拦截时替换为拦截响应。
+func (p *AdguardRule) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	p.execUsed.Store(true)
+	q := qCtx.Q()
+	if len(q.Question) != 1 {
+		return next.ExecNext(ctx, qCtx)
+	}
+	info := queryInfo{
+		qtype:    q.Question[0].Qtype,
+		protocol: qCtx.ServerMeta.Protocol,
+		client:   qCtx.ServerMeta.ClientAddr,
+	}
+	if v, ok := qCtx.GetValue(query_context.KeyClientTag); ok {
+		info.clientTag, _ = v.(string)
+	}
+	if _, rws := p.rewrite(q.Question[0].Name, info); len(rws) > 0 {
+		p.stats.recordQuery(info)
+		return p.execRewrite(ctx, qCtx, next, rws)
+	}
+	listID, blocked := p.match(q.Question[0].Name, info)
+	if blocked {
+		qCtx.SetResponse(p.block.response(q))
+		qCtx.StoreValue(query_context.KeyBlockReason, p.blockReason(listID))
+	}
+	if err := next.ExecNext(ctx, qCtx); err != nil {
+		return err
+	}
+
+	// 查询域名命中放行规则时不检查 CNAME 目标
+	if !p.cnameCheck || len(listID) > 0 {
+		return nil
+	}
+	if target, listID, blocked := p.matchCNAME(qCtx.R(), info); blocked {
+		qCtx.SetResponse(p.block.response(q))
+		qCtx.StoreValue(query_context.KeyBlockReason, p.blockReason(listID)+" (CNAME "+target+")")
+	}
+	return nil
+}
+
+// matchCNAME 检查 r 的应答中的 CNAME 目标, 返回第一个被拦截的目标及决定结果的规则列表 ID
+func (p *AdguardRule) matchCNAME(r *dns.Msg, info queryInfo) (string, string, bool) {
+	if r == nil || !p.protection.enabled() {
+		return "", "", false
+	}
+	for _, rr := range r.Answer {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+		if listID, blocked := p.decide(cname.Target, info); blocked {
+			p.stats.recordBlock(listID, cname.Target, info)
+			p.emitBlocked(listID, cname.Target, info)
+			return cname.Target, listID, true
+		}
+	}
+	return "", "", false
+}
+
+// blockReason 返回拦截原因, 如 "adguard_rule: AdGuard DNS filter"
+func (p *AdguardRule) blockReason(listID string) string {
+	return PluginType + ": " + p.displayName(listID)
+}
+
+// displayName 返回规则列表的名称, 用户规则为 "user rules", 列表不存在时为 listID
+func (p *AdguardRule) displayName(listID string) string {
+	if listID == userRulesID {
+		return "user rules"
+	}
+	if n := p.listName(listID); len(n) > 0 {
+		return n
+	}
+	return listID
+}
+
+// listName 返回在线规则列表的名称, 列表不存在时为空
+func (p *AdguardRule) listName(listID string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if rule, ok := p.onlineRules[listID]; ok {
+		return rule.Name
+	}
+	return ""
+}
@@ -0,0 +1,122 @@
+package adguard_rule
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func TestNewBlockResponder(t *testing.T) {
+	tests := []struct {
+		args    Args
+		wantErr bool
+	}{
+		{args: Args{}},
+		{args: Args{BlockMode: blockModeRefused, BlockTTL: 60}},
+		{args: Args{BlockMode: blockModeCustomIP, BlockIPv4: "192.0.2.1"}},
+		{args: Args{BlockMode: blockModeCustomIP, BlockIPv6: "2001:db8::1"}},
+		{args: Args{BlockMode: blockModeCustomIP}, wantErr: true},
+		{args: Args{BlockMode: blockModeCustomIP, BlockIPv4: "2001:db8::1"}, wantErr: true},
+		{args: Args{BlockMode: blockModeCustomIP, BlockIPv6: "192.0.2.1"}, wantErr: true},
+		{args: Args{BlockMode: "sinkhole"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := newBlockResponder(&tt.args); (err != nil) != tt.wantErr {
+			t.Errorf("newBlockResponder(%+v) error = %v, wantErr %v", tt.args, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBlockResponder_Response(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   Args
+		qtype  uint16
+		rcode  int
+		answer string // 应答中的地址, 为空表示没有应答记录
+		soa    bool   // 授权段有 SOA
+	}{
+		{name: "nxdomain", args: Args{}, qtype: dns.TypeA, rcode: dns.RcodeNameError, soa: true},
+		{name: "refused", args: Args{BlockMode: blockModeRefused}, qtype: dns.TypeA, rcode: dns.RcodeRefused},
+		{name: "nodata", args: Args{BlockMode: blockModeNoData}, qtype: dns.TypeAAAA, soa: true},
+		{name: "null_ip A", args: Args{BlockMode: blockModeNullIP}, qtype: dns.TypeA, answer: "0.0.0.0"},
+		{name: "null_ip AAAA", args: Args{BlockMode: blockModeNullIP}, qtype: dns.TypeAAAA, answer: "::"},
+		{name: "null_ip HTTPS", args: Args{BlockMode: blockModeNullIP}, qtype: dns.TypeHTTPS, soa: true},
+		{name: "custom_ip A", args: Args{BlockMode: blockModeCustomIP, BlockIPv4: "192.0.2.1", BlockIPv6: "2001:db8::1"}, qtype: dns.TypeA, answer: "192.0.2.1"},
+		{name: "custom_ip AAAA", args: Args{BlockMode: blockModeCustomIP, BlockIPv4: "192.0.2.1", BlockIPv6: "2001:db8::1"}, qtype: dns.TypeAAAA, answer: "2001:db8::1"},
+		{name: "custom_ip without ipv6", args: Args{BlockMode: blockModeCustomIP, BlockIPv4: "192.0.2.1"}, qtype: dns.TypeAAAA, soa: true},
+		{name: "ttl", args: Args{BlockMode: blockModeNullIP, BlockTTL: 300}, qtype: dns.TypeA, answer: "0.0.0.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := newBlockResponder(&tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantTTL := tt.args.BlockTTL
+			if wantTTL == 0 {
+				wantTTL = defaultBlockTTL
+			}
+			q := new(dns.Msg)
+			q.SetQuestion("ads.example.com.", tt.qtype)
+			r := b.response(q)
+			if r.Id != q.Id || !r.Response || len(r.Question) != 1 || r.Question[0] != q.Question[0] {
+				t.Fatalf("response does not match the query: %v", r)
+			}
+			if r.Rcode != tt.rcode {
+				t.Errorf("rcode %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			var answer string
+			switch len(r.Answer) {
+			case 0:
+			case 1:
+				rr := r.Answer[0]
+				if rr.Header().Name != "ads.example.com." || rr.Header().Ttl != wantTTL {
+					t.Errorf("unexpected answer header %v", rr.Header())
+				}
+				switch rr := rr.(type) {
+				case *dns.A:
+					answer = rr.A.String()
+				case *dns.AAAA:
+					answer = rr.AAAA.String()
+				}
+			default:
+				t.Fatalf("unexpected answers %v", r.Answer)
+			}
+			if answer != tt.answer {
+				t.Errorf("answer %q, want %q", answer, tt.answer)
+			}
+			var soa *dns.SOA
+			for _, rr := range r.Ns {
+				soa, _ = rr.(*dns.SOA)
+			}
+			if (soa != nil) != tt.soa {
+				t.Fatalf("soa %v, want %v", soa, tt.soa)
+			}
+			if soa != nil && (soa.Hdr.Ttl != wantTTL || soa.Minttl != wantTTL) {
+				t.Errorf("soa ttl %d/%d, want %d", soa.Hdr.Ttl, soa.Minttl, wantTTL)
+			}
+		})
+	}
+}
+
+func TestAdguardRule_ExecBlock(t *testing.T) {
+	p := newTestRule(t, "||ads.example.com^\n")
+	q := new(dns.Msg)
+	q.SetQuestion("ads.example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q)
+	next := sequence.NewChainWalker(nil, nil, zap.NewNop())
+	if err := p.Exec(context.Background(), qCtx, next); err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); r == nil || r.Rcode != dns.RcodeNameError {
+		t.Fatalf("unexpected response %v", r)
+	}
+	if v, ok := qCtx.GetValue(query_context.KeyBlockReason); !ok || v == "" {
+		t.Fatal("block reason not set")
+	}
+}
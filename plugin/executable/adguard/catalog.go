@@ -0,0 +1,71 @@
+package adguard_rule
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+)
+
+// catalogJSON 是内置的常用规则列表目录, 参考 AdGuard Home 的过滤器目录
+//
+//go:embed catalog.json
+var catalogJSON []byte
+
+// CatalogEntry 是目录中的一个规则列表
+type CatalogEntry struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Category    string   `json:"category"` // general, regional, security
+	Homepage    string   `json:"homepage"`
+	URL         string   `json:"url"`
+	MirrorURLs  []string `json:"mirror_urls,omitempty"`
+	Format      string   `json:"format"`
+}
+
+var catalog = mustLoadCatalog()
+
+func mustLoadCatalog() []CatalogEntry {
+	var entries []CatalogEntry
+	if err := json.Unmarshal(catalogJSON, &entries); err != nil {
+		panic("invalid adguard_rule catalog: " + err.Error())
+	}
+	return entries
+}
+
+func catalogEntry(id string) (CatalogEntry, bool) {
+	for _, e := range catalog {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return CatalogEntry{}, false
+}
+
+// ruleIDByURL 返回 URL 相同的已有规则列表的 ID
+func (p *AdguardRule) ruleIDByURL(url string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for id, rule := range p.onlineRules {
+		if rule.URL == url {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// handleGetCatalog 处理 GET /catalog, 返回目录及各列表是否已添加 (rule_id 为已添加的规则列表 ID)
+func (p *AdguardRule) handleGetCatalog(w http.ResponseWriter, r *http.Request) {
+	type item struct {
+		CatalogEntry
+		Added  bool   `json:"added"`
+		RuleID string `json:"rule_id,omitempty"`
+	}
+	items := make([]item, 0, len(catalog))
+	for _, e := range catalog {
+		id, added := p.ruleIDByURL(e.URL)
+		items = append(items, item{CatalogEntry: e, Added: added, RuleID: id})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
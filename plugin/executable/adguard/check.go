@@ -0,0 +1,152 @@
+package adguard_rule
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// checkResult 是 /check 接口的响应格式
+type checkResult struct {
+	Domain   string `json:"domain"`
+	Blocked  bool   `json:"blocked"`
+	Matched  bool   `json:"matched"`           // 是否命中任一规则, 未命中时放行
+	ListID   string `json:"list_id,omitempty"` // 决定结果的规则列表, 用户规则为 "user"
+	ListName string `json:"list_name,omitempty"`
+	Rule     string `json:"rule,omitempty"` // 规则文件中的原始规则行, 文件已变化而未重载时可能为空
+	// Rewrite 为命中的 $dnsrewrite 改写, 如 "NOERROR;A;1.2.3.4", 此时 Blocked 为 false
+	Rewrite []string `json:"rewrite,omitempty"`
+	// ProtectionEnabled 为 false 时拦截已暂停, 实际查询不会被拦截
+	ProtectionEnabled bool `json:"protection_enabled"`
+}
+
+// handleCheck 检查域名是否会被拦截, 不计入统计。
+// GET /check?domain=example.com[&qtype=AAAA][&client=10.0.0.2][&client_tag=kids]
+// qtype 用于检查带 $dnstype 的规则, client 与 client_tag 用于检查按客户端生效的规则列表。
+func (p *AdguardRule) handleCheck(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	domainStr := strings.TrimSpace(q.Get("domain"))
+	if len(domainStr) == 0 {
+		jsonError(w, "domain is required", http.StatusBadRequest)
+		return
+	}
+	domainStr = dns.Fqdn(strings.ToLower(domainStr))
+	info := queryInfo{clientTag: q.Get("client_tag")}
+	if s := q.Get("client"); len(s) > 0 {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			jsonError(w, "invalid client", http.StatusBadRequest)
+			return
+		}
+		info.client = addr
+	}
+	if s := q.Get("qtype"); len(s) > 0 {
+		qtype, ok := dns.StringToType[strings.ToUpper(s)]
+		if !ok {
+			jsonError(w, "invalid qtype", http.StatusBadRequest)
+			return
+		}
+		info.qtype = qtype
+	}
+
+	if listID, rws := p.rewrite(domainStr, info); len(rws) > 0 {
+		res := checkResult{Domain: domainStr, Matched: true, ListID: listID, ListName: p.listName(listID), ProtectionEnabled: true}
+		for _, rw := range rws {
+			res.Rewrite = append(res.Rewrite, rw.String())
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+
+	listID, blocked := p.decide(domainStr, info)
+	res := checkResult{Domain: domainStr, Blocked: blocked, Matched: len(listID) > 0, ListID: listID, ProtectionEnabled: p.protection.enabled()}
+	if res.Matched {
+		res.ListName, res.Rule = p.findRule(listID, domainStr, info, blocked)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(res)
+}
+
+// findRule 返回规则列表的名称与其中第一条匹配 domainStr 的拦截 (blocked) 或放行规则行
+func (p *AdguardRule) findRule(listID, domainStr string, info queryInfo, blocked bool) (name, line string) {
+	if listID == userRulesID {
+		text, _ := p.userRules.get()
+		return "", findRuleLine(strings.NewReader(text), formatAuto, domainStr, info, blocked)
+	}
+
+	p.mu.RLock()
+	rule, ok := p.onlineRules[listID]
+	var path, format string
+	if ok {
+		name, path, format = rule.Name, rule.localPath, rule.Format
+	}
+	p.mu.RUnlock()
+	if !ok {
+		return "", ""
+	}
+	f, err := openRuleFile(path, p.maxListSize)
+	if err != nil {
+		return name, ""
+	}
+	defer f.Close()
+	return name, findRuleLine(f, format, domainStr, info, blocked)
+}
+
+// findRuleLine 逐行解析规则, 返回第一条匹配 domainStr 的规则行。
+// 不含域名最后一级标签且不是正则或通配符的行不可能匹配, 直接跳过。
+func findRuleLine(r io.Reader, format, domainStr string, info queryInfo, blocked bool) string {
+	if format == formatRPZ {
+		return findRPZLine(r, domainStr, blocked)
+	}
+	labels := dns.SplitDomainName(domainStr)
+	if len(labels) == 0 {
+		return ""
+	}
+	tld := labels[len(labels)-1]
+	noLog := func(string, ...any) {}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.Contains(strings.ToLower(line), tld) && !strings.ContainsAny(line, "/*") {
+			continue
+		}
+		rs := newRuleSet()
+		if _, err := parseRulesLogf(strings.NewReader(line), format, "", rs, noLog); err != nil {
+			continue
+		}
+		if _, ok := rs.matchImportant(domainStr, info, !blocked); ok {
+			return line
+		}
+		if _, ok := rs.match(domainStr, info, !blocked); ok {
+			return line
+		}
+	}
+	return ""
+}
+
+// findRPZLine 同 findRuleLine, 按顺序解析整个区域文件, 以便按 $ORIGIN 与 SOA 解析名称
+func findRPZLine(r io.Reader, domainStr string, blocked bool) string {
+	var p rpzParser
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		rule, allow := p.parseLine(scanner.Text())
+		if len(rule) == 0 || allow == blocked {
+			continue
+		}
+		rs := newRuleSet()
+		if err := rs.add(rule, "", allow, nil); err != nil {
+			continue
+		}
+		if _, ok := rs.match(domainStr, queryInfo{}, allow); ok {
+			return strings.TrimSpace(scanner.Text())
+		}
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+package adguard_rule
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdguardRule_HandleCheck(t *testing.T) {
+	const listRules = "! list\n||ads.example.com^\n||v6.example.com^$dnstype=AAAA\n@@||ok.user.example.com^\n"
+	p := newTestRule(t, "||user.example.com^\n@@||ok.ads.example.com^\n||rw.example.com^$dnsrewrite=1.2.3.4\n")
+	dir := t.TempDir()
+	list := &OnlineRule{ID: "l1", Name: "List 1", localPath: filepath.Join(dir, "l1.rules")}
+	if err := os.WriteFile(list.localPath, []byte(listRules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	kids := &OnlineRule{ID: "l2", Name: "Kids", localPath: filepath.Join(dir, "l2.rules")}
+	if err := os.WriteFile(kids.localPath, []byte("||games.example.com^\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p.onlineRules = map[string]*OnlineRule{"l1": list, "l2": kids}
+	p.clientGroups = []*ruleGroup{
+		{sets: []*ruleSet{newTestRuleSet(t, "l1", listRules)}},
+		{scope: newClientScope([]string{"kids", "10.0.0.0/24"}), sets: []*ruleSet{newTestRuleSet(t, "l2", "||games.example.com^\n")}},
+	}
+
+	tests := []struct {
+		query string
+		code  int
+		want  checkResult
+	}{
+		{query: "domain=Sub.Ads.Example.com", code: http.StatusOK,
+			want: checkResult{Domain: "sub.ads.example.com.", Blocked: true, Matched: true, ListID: "l1", ListName: "List 1", Rule: "||ads.example.com^", ProtectionEnabled: true}},
+		{query: "domain=ok.ads.example.com", code: http.StatusOK,
+			want: checkResult{Domain: "ok.ads.example.com.", Matched: true, ListID: userRulesID, Rule: "@@||ok.ads.example.com^", ProtectionEnabled: true}},
+		{query: "domain=ok.user.example.com", code: http.StatusOK,
+			want: checkResult{Domain: "ok.user.example.com.", Blocked: true, Matched: true, ListID: userRulesID, Rule: "||user.example.com^", ProtectionEnabled: true}},
+		{query: "domain=other.example.com", code: http.StatusOK,
+			want: checkResult{Domain: "other.example.com.", ProtectionEnabled: true}},
+		{query: "domain=v6.example.com", code: http.StatusOK,
+			want: checkResult{Domain: "v6.example.com.", ProtectionEnabled: true}},
+		{query: "domain=v6.example.com&qtype=aaaa", code: http.StatusOK,
+			want: checkResult{Domain: "v6.example.com.", Blocked: true, Matched: true, ListID: "l1", ListName: "List 1", Rule: "||v6.example.com^$dnstype=AAAA", ProtectionEnabled: true}},
+		{query: "domain=games.example.com", code: http.StatusOK,
+			want: checkResult{Domain: "games.example.com.", ProtectionEnabled: true}},
+		{query: "domain=games.example.com&client_tag=kids", code: http.StatusOK,
+			want: checkResult{Domain: "games.example.com.", Blocked: true, Matched: true, ListID: "l2", ListName: "Kids", Rule: "||games.example.com^", ProtectionEnabled: true}},
+		{query: "domain=games.example.com&client=10.0.0.9", code: http.StatusOK,
+			want: checkResult{Domain: "games.example.com.", Blocked: true, Matched: true, ListID: "l2", ListName: "Kids", Rule: "||games.example.com^", ProtectionEnabled: true}},
+		{query: "domain=rw.example.com", code: http.StatusOK,
+			want: checkResult{Domain: "rw.example.com.", Matched: true, ListID: userRulesID, Rewrite: []string{"NOERROR;A;1.2.3.4"}, ProtectionEnabled: true}},
+		{query: "", code: http.StatusBadRequest},
+		{query: "domain=a.example.com&client=bad", code: http.StatusBadRequest},
+		{query: "domain=a.example.com&qtype=bogus", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		p.handleCheck(w, httptest.NewRequest(http.MethodGet, "/check?"+tt.query, nil))
+		if w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.query, w.Code, tt.code)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		var got checkResult
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(tt.want)
+		if string(gotJSON) != string(wantJSON) {
+			t.Errorf("%s:\n got %s\nwant %s", tt.query, gotJSON, wantJSON)
+		}
+	}
+
+	// 检查不计入统计; 暂停拦截时仍返回规则的判断结果
+	if r := p.stats.snapshot(nil, 10); r.TotalQueries != 0 {
+		t.Fatalf("check is counted: %+v", r)
+	}
+	p.protection.pause(0)
+	defer p.protection.resume()
+	w := httptest.NewRecorder()
+	p.handleCheck(w, httptest.NewRequest(http.MethodGet, "/check?domain="+url.QueryEscape("ads.example.com"), nil))
+	if body := w.Body.String(); !strings.Contains(body, `"blocked":true`) || !strings.Contains(body, `"protection_enabled":false`) {
+		t.Fatalf("check while paused: %s", body)
+	}
+}
+
+func TestFindRuleLine(t *testing.T) {
+	const rules = "! comment\n" +
+		"0.0.0.0 hosts.example.net\n" +
+		"  ||ads.example.com^  \n" +
+		"@@||ok.ads.example.com^\n" +
+		"/tracker[0-9]+\\.example\\.org/\n" +
+		"||*.wild.example.com^\n"
+	tests := []struct {
+		domain  string
+		blocked bool
+		want    string
+	}{
+		{"a.ads.example.com.", true, "||ads.example.com^"},
+		{"ok.ads.example.com.", false, "@@||ok.ads.example.com^"},
+		{"ok.ads.example.com.", true, "||ads.example.com^"},
+		{"hosts.example.net.", true, "0.0.0.0 hosts.example.net"},
+		{"tracker12.example.org.", true, "/tracker[0-9]+\\.example\\.org/"},
+		{"x.wild.example.com.", true, "||*.wild.example.com^"},
+		{"other.example.com.", true, ""},
+		{".", true, ""},
+	}
+	for _, tt := range tests {
+		if got := findRuleLine(strings.NewReader(rules), formatAuto, tt.domain, queryInfo{}, tt.blocked); got != tt.want {
+			t.Errorf("findRuleLine(%s, %v) = %q, want %q", tt.domain, tt.blocked, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package adguard_rule
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+)
+
+// ruleGroup 是适用于同一组客户端与同一生效时段的在线规则列表的匹配器。
+// AdguardRule.clientGroups 的第一组适用于所有客户端且一直生效, 匹配值为规则列表 ID, 用于命中统计
+type ruleGroup struct {
+	scope    *clientScope // nil 表示适用于所有客户端
+	schedule *schedule    // nil 表示一直生效
+	sets     []*ruleSet   // 各列表的匹配器, 按列表 ID 排序
+}
+
+// clientScope 是规则列表的生效范围: 客户端标签 (见服务器 client_acl.tags) 或 IP/CIDR
+type clientScope struct {
+	tags map[string]struct{}
+	nets *netlist.List // 可能为 nil
+}
+
+// validClients 检查 OnlineRule.Clients。含 "/" 或可解析为 IP 的项按 IP/CIDR 处理, 其余为客户端标签
+func validClients(clients []string) error {
+	for _, c := range clients {
+		if _, err := parseClient(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseClient 解析一个 IP/CIDR, 客户端标签返回无效的 netip.Prefix
+func parseClient(c string) (netip.Prefix, error) {
+	if strings.ContainsRune(c, '/') {
+		return netip.ParsePrefix(c)
+	}
+	if addr, err := netip.ParseAddr(c); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	if c == "" || strings.ContainsAny(c, " \t") {
+		return netip.Prefix{}, fmt.Errorf("invalid client %q", c)
+	}
+	return netip.Prefix{}, nil
+}
+
+// scopeKey 返回 clients 的规范形式, 生效范围相同的规则列表共用一个 ruleGroup
+func scopeKey(clients []string) string {
+	cs := append([]string(nil), clients...)
+	sort.Strings(cs)
+	return strings.Join(cs, ",")
+}
+
+func newClientScope(clients []string) *clientScope {
+	s := &clientScope{tags: make(map[string]struct{})}
+	for _, c := range clients {
+		prefix, err := parseClient(c)
+		if err != nil {
+			continue // 已在保存时校验
+		}
+		if !prefix.IsValid() {
+			s.tags[c] = struct{}{}
+			continue
+		}
+		if s.nets == nil {
+			s.nets = netlist.NewList()
+		}
+		s.nets.Append(prefix)
+	}
+	if s.nets != nil {
+		s.nets.Sort()
+	}
+	return s
+}
+
+func (g *ruleGroup) appliesTo(info queryInfo) bool {
+	if g.schedule != nil && !g.schedule.active(time.Now()) {
+		return false
+	}
+	return g.scope == nil || g.scope.match(info)
+}
+
+// match 检查查询的客户端标签或地址是否在范围内
+func (s *clientScope) match(info queryInfo) bool {
+	if _, ok := s.tags[info.clientTag]; ok && len(info.clientTag) > 0 {
+		return true
+	}
+	return s.nets != nil && info.client.IsValid() && s.nets.Match(info.client)
+}
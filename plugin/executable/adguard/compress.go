@@ -0,0 +1,122 @@
+package adguard_rule
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// errListTooLarge 表示规则列表解压后超过了 max_list_size_mb
+var errListTooLarge = errors.New("rule list is too large")
+
+// sizeLimitReader 读取超过 max 字节后返回 errListTooLarge。
+// 与直接使用 io.LimitReader 不同, 超限时报错而不是截断, 避免保存不完整的列表。
+type sizeLimitReader struct {
+	r   io.Reader // io.LimitReader(r, max+1)
+	n   int64
+	max int64
+}
+
+func (l *sizeLimitReader) Read(b []byte) (int, error) {
+	n, err := l.r.Read(b)
+	l.n += int64(n)
+	if l.n > l.max {
+		return n, fmt.Errorf("%w: more than %d bytes after decompression", errListTooLarge, l.max)
+	}
+	return n, err
+}
+
+// multiCloser 依次关闭解压器与底层文件
+type multiCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (m *multiCloser) Close() error {
+	var firstErr error
+	for i := len(m.closers) - 1; i >= 0; i-- {
+		if err := m.closers[i].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// newDecompressReader 根据 Content-Encoding (可为空) 及文件头魔数透明解压 gzip/zstd 数据。
+// 未压缩的数据原样返回。maxSize > 0 时, 解压后的数据超过 maxSize 字节将返回 errListTooLarge。
+// Close 不会关闭 r。
+func newDecompressReader(r io.Reader, contentEncoding string, maxSize int64) (*multiCloser, error) {
+	mc := &multiCloser{Reader: r}
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip content: %w", err)
+		}
+		mc.Reader, mc.closers = gr, append(mc.closers, gr)
+	case "zstd":
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid zstd content: %w", err)
+		}
+		zrc := zr.IOReadCloser()
+		mc.Reader, mc.closers = zrc, append(mc.closers, zrc)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", contentEncoding)
+	}
+
+	// 文件本身可能是 .gz/.zst (服务器未设置 Content-Encoding), 通过魔数识别
+	br := bufio.NewReader(mc.Reader)
+	head, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			mc.Close()
+			return nil, fmt.Errorf("invalid gzip file: %w", err)
+		}
+		mc.Reader, mc.closers = gr, append(mc.closers, gr)
+	case bytes.HasPrefix(head, zstdMagic):
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			mc.Close()
+			return nil, fmt.Errorf("invalid zstd file: %w", err)
+		}
+		zrc := zr.IOReadCloser()
+		mc.Reader, mc.closers = zrc, append(mc.closers, zrc)
+	default:
+		mc.Reader = br
+	}
+	if maxSize > 0 {
+		mc.Reader = &sizeLimitReader{r: io.LimitReader(mc.Reader, maxSize+1), max: maxSize}
+	}
+	return mc, nil
+}
+
+// openRuleFile 打开本地规则文件, 压缩保存的文件会被透明解压, 解压后最多读取 maxSize 字节
+func openRuleFile(path string, maxSize int64) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := newDecompressReader(f, "", maxSize)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	rc.closers = append([]io.Closer{f}, rc.closers...)
+	return rc, nil
+}
@@ -0,0 +1,231 @@
+package adguard_rule
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const testRules = "||ads.example.com^\n||tracker.example.net^\n"
+
+func gzipOf(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdOf(t *testing.T, b []byte) []byte {
+	t.Helper()
+	w, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	return w.EncodeAll(b, nil)
+}
+
+func TestNewDecompressReader(t *testing.T) {
+	plain := []byte(testRules)
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     []byte // 为空时与 plain 相同
+		wantErr  bool
+	}{
+		{name: "plain", body: plain},
+		{name: "identity", encoding: "identity", body: plain},
+		{name: "gzip magic", body: gzipOf(t, plain)},
+		{name: "zstd magic", body: zstdOf(t, plain)},
+		{name: "gzip encoding", encoding: "gzip", body: gzipOf(t, plain)},
+		{name: "x-gzip encoding", encoding: " X-Gzip ", body: gzipOf(t, plain)},
+		{name: "zstd encoding", encoding: "zstd", body: zstdOf(t, plain)},
+		// 服务器对 .gz 文件又做了一次压缩
+		{name: "gzip encoding of gzip file", encoding: "gzip", body: gzipOf(t, gzipOf(t, plain))},
+		{name: "zstd encoding of gzip file", encoding: "zstd", body: zstdOf(t, gzipOf(t, plain))},
+		{name: "unsupported encoding", encoding: "br", body: plain, wantErr: true},
+		{name: "invalid gzip encoding", encoding: "gzip", body: plain, wantErr: true},
+		{name: "short body", body: []byte{0x1f}, want: []byte{0x1f}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc, err := newDecompressReader(bytes.NewReader(tt.body), tt.encoding, 0)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := plain
+			if tt.want != nil {
+				want = tt.want
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("want %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestNewDecompressReader_MaxSize(t *testing.T) {
+	plain := []byte(testRules)
+	max := int64(len(plain))
+	for name, body := range map[string][]byte{"plain": plain, "gzip": gzipOf(t, plain), "zstd": zstdOf(t, plain)} {
+		rc, err := newDecompressReader(bytes.NewReader(body), "", max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := io.ReadAll(rc); err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%s: list of exactly max size: %q, %v", name, got, err)
+		}
+		rc.Close()
+
+		rc, err = newDecompressReader(bytes.NewReader(body), "", max-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadAll(rc); !errors.Is(err, errListTooLarge) {
+			t.Errorf("%s: want errListTooLarge, got %v", name, err)
+		}
+		rc.Close()
+	}
+
+	// 压缩炸弹: 64 MiB 的零压缩后只有几十 KiB, 读取在超过上限后立即停止
+	bomb := gzipOf(t, make([]byte, 64<<20))
+	rc, err := newDecompressReader(bytes.NewReader(bomb), "gzip", 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	n, err := io.Copy(io.Discard, rc)
+	if !errors.Is(err, errListTooLarge) {
+		t.Fatalf("want errListTooLarge, got %v", err)
+	}
+	if n > 1<<20+1 {
+		t.Fatalf("read %d bytes past the limit", n)
+	}
+}
+
+func TestOpenRuleFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "l1.rules")
+	if err := os.WriteFile(path, gzipOf(t, []byte(testRules)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := openRuleFile(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(got) != testRules {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	rc, err = openRuleFile(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if _, err := io.ReadAll(rc); !errors.Is(err, errListTooLarge) {
+		t.Fatalf("want errListTooLarge, got %v", err)
+	}
+}
+
+func TestDownloadRuleFrom_Compressed(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		gzipped  bool // compress_local
+	}{
+		{name: "gzip encoding", encoding: "gzip", body: gzipOf(t, []byte(testRules))},
+		{name: "zstd encoding", encoding: "zstd", body: zstdOf(t, []byte(testRules))},
+		{name: ".gz file", body: gzipOf(t, []byte(testRules))},
+		{name: "compress_local", body: []byte(testRules), gzipped: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				w.Write(tt.body)
+			}))
+			defer ts.Close()
+			rule := &OnlineRule{ID: "l1", Name: "List 1", URL: ts.URL}
+			p := newTestDownloader(t, rule)
+			p.gzipLocal = tt.gzipped
+
+			if _, err := p.downloadRuleFrom(context.Background(), "l1", ts.URL); err != nil {
+				t.Fatal(err)
+			}
+			saved, err := os.ReadFile(rule.localPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isGzip := bytes.HasPrefix(saved, gzipMagic); isGzip != tt.gzipped {
+				t.Fatalf("saved file gzipped %v, want %v", isGzip, tt.gzipped)
+			}
+			rc, err := openRuleFile(rule.localPath, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+			if got, _ := io.ReadAll(rc); string(got) != testRules {
+				t.Fatalf("got %q", got)
+			}
+		})
+	}
+}
+
+func TestDownloadRuleFrom_TooLarge(t *testing.T) {
+	bomb := gzipOf(t, []byte(strings.Repeat("||ads.example.com^\n", 1<<16)))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(bomb)
+	}))
+	defer ts.Close()
+	rule := &OnlineRule{ID: "l1", Name: "List 1", URL: ts.URL}
+	p := newTestDownloader(t, rule)
+	p.maxListSize = 1 << 10
+	if err := os.WriteFile(rule.localPath, []byte(testRules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.downloadRuleFrom(context.Background(), "l1", ts.URL); !errors.Is(err, errListTooLarge) {
+		t.Fatalf("want errListTooLarge, got %v", err)
+	}
+	// 超限的下载不会替换原有文件, 也不会留下临时文件
+	if got, _ := os.ReadFile(rule.localPath); string(got) != testRules {
+		t.Fatalf("rule file replaced: %q", got)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(p.dir, "download-*.tmp")); len(tmp) > 0 {
+		t.Fatalf("temp files left: %v", tmp)
+	}
+}
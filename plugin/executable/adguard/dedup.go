@@ -0,0 +1,89 @@
+package adguard_rule
+
+import (
+	"hash/maphash"
+	"slices"
+)
+
+// dedupSeed 用于计算去重键的哈希, 哈希只在进程内比较
+var dedupSeed = maphash.MakeSeed()
+
+// dedupKey 返回去重使用的键, 放行与拦截、$important 与普通规则分别去重
+func dedupKey(pattern string, allow, important bool) string {
+	switch {
+	case allow && important:
+		return "@@!" + pattern
+	case allow:
+		return "@@" + pattern
+	case important:
+		return "!" + pattern
+	}
+	return pattern
+}
+
+// dedup 检查规则是否已添加到 rs 中。已添加过时返回 true, 调用方应跳过该规则
+func (rs *ruleSet) dedup(pattern string, allow, important bool) bool {
+	if rs.seen == nil {
+		rs.seen = make(map[string]struct{})
+	}
+	key := dedupKey(pattern, allow, important)
+	if _, ok := rs.seen[key]; ok {
+		rs.duplicates++
+		return true
+	}
+	rs.seen[key] = struct{}{}
+	return false
+}
+
+// finish 在规则全部添加后调用, 释放去重使用的内存, 返回已排序的各规则去重键的哈希,
+// 用于统计各列表独有的规则数 (见 uniqueRules)。带修饰符 (不含只带 $important) 的规则不参与去重与统计
+func (rs *ruleSet) finish() []uint64 {
+	keys := make([]uint64, 0, len(rs.seen))
+	for key := range rs.seen {
+		keys = append(keys, maphash.String(dedupSeed, key))
+	}
+	rs.seen = nil
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+// uniqueRules 返回每个列表独有 (不在 keys 的其他列表中) 的规则数。keys 为各列表 finish 的结果
+func uniqueRules(keys map[string][]uint64) map[string]int {
+	type head struct {
+		id   string
+		keys []uint64
+	}
+	unique := make(map[string]int, len(keys))
+	heads := make([]head, 0, len(keys))
+	for id, k := range keys {
+		unique[id] = 0
+		if len(k) > 0 {
+			heads = append(heads, head{id: id, keys: k})
+		}
+	}
+	// 多路归并: 每次取各列表剩余部分中最小的哈希, 只出现在一个列表中时计为该列表独有
+	for len(heads) > 0 {
+		minKey := heads[0].keys[0]
+		for _, h := range heads[1:] {
+			minKey = min(minKey, h.keys[0])
+		}
+		owner, n := "", 0
+		for i := 0; i < len(heads); i++ {
+			h := &heads[i]
+			if h.keys[0] != minKey {
+				continue
+			}
+			owner = h.id
+			n++
+			if h.keys = h.keys[1:]; len(h.keys) == 0 {
+				heads[i] = heads[len(heads)-1]
+				heads = heads[:len(heads)-1]
+				i--
+			}
+		}
+		if n == 1 {
+			unique[owner]++
+		}
+	}
+	return unique
+}
@@ -0,0 +1,143 @@
+package adguard_rule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultDownloadConcurrency = 4
+	defaultDownloadAttempts    = 3
+	defaultMaxListSizeMB       = 128
+	downloadRetryMaxDelay      = 30 * time.Second
+)
+
+// 第一次重试前的等待时间, 之后每次翻倍
+var downloadRetryBaseDelay = 2 * time.Second
+
+// downloadRules 并发下载 ruleIDs, 同时进行的下载数受 download_concurrency 限制。
+// action 用于日志, j 不为 nil 时在其中记录各列表的结果, 返回是否有规则发生变化。
+func (p *AdguardRule) downloadRules(ctx context.Context, ruleIDs []string, action string, j *job) bool {
+	var wg sync.WaitGroup
+	var anyChanged atomic.Bool
+	for _, id := range ruleIDs {
+		wg.Add(1)
+		go func(ruleID string) {
+			defer wg.Done()
+			var received atomic.Int64
+			if j != nil {
+				p.jobs.update(j, ruleID, func(l *jobList) { l.Status = jobRunning })
+			}
+			changed, err := p.downloadRuleWithRetry(withByteCounter(ctx, &received), ruleID)
+			if err != nil {
+				log.Printf("[adguard_rule] ERROR: failed to download rule during %s: %v", action, err)
+			}
+			if changed {
+				anyChanged.Store(true)
+			}
+			if j != nil {
+				p.jobs.update(j, ruleID, func(l *jobList) {
+					l.Status, l.Changed, l.Bytes = jobSucceeded, changed, received.Load()
+					if err != nil {
+						l.Status, l.Error = jobFailed, err.Error()
+					}
+				})
+			}
+		}(id)
+	}
+	wg.Wait()
+	return anyChanged.Load()
+}
+
+// downloadRuleWithRetry 下载规则, 失败时按指数退避重试, 最多尝试 download_retries 次。
+// 每次尝试占用一个并发名额并单独计算超时, 等待重试期间不占用名额。
+func (p *AdguardRule) downloadRuleWithRetry(ctx context.Context, ruleID string) (bool, error) {
+	delay := downloadRetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		changed, err := p.downloadRuleLimited(ctx, ruleID)
+		if err == nil || attempt >= p.attempts || ctx.Err() != nil || errors.Is(err, errRuleNotFound) {
+			if err != nil && attempt > 1 {
+				err = fmt.Errorf("%w (after %d attempts)", err, attempt)
+			}
+			if ctx.Err() == nil && !errors.Is(err, errRuleNotFound) {
+				p.emitUpdate(ruleID, changed, err)
+			}
+			return changed, err
+		}
+		log.Printf("[adguard_rule] WARN: download attempt %d/%d failed: %v, retrying in %s", attempt, p.attempts, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false, err
+		}
+		delay = min(delay*2, downloadRetryMaxDelay)
+	}
+}
+
+func (p *AdguardRule) downloadRuleLimited(ctx context.Context, ruleID string) (bool, error) {
+	select {
+	case p.downloadSem <- struct{}{}:
+		defer func() { <-p.downloadSem }()
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	downloadCtx, cancel := context.WithTimeout(ctx, downloadTimeout)
+	defer cancel()
+	return p.downloadRule(downloadCtx, ruleID)
+}
+
+var errRuleNotFound = errors.New("rule not found")
+
+// handleUpdateRule 处理 POST /rules/{id}/update, 立即下载指定的规则列表 (不论是否启用),
+// 有变化时同步重载, 返回是否变化与更新后的列表 (含新的规则数与 last_updated)
+func (p *AdguardRule) handleUpdateRule(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	p.mu.RLock()
+	_, ok := p.onlineRules[id]
+	p.mu.RUnlock()
+	if !ok {
+		jsonError(w, "Rule not found", http.StatusNotFound)
+		return
+	}
+
+	changed, err := p.downloadRuleWithRetry(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, errRuleNotFound) {
+			jsonError(w, "Rule not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("[adguard_rule] ERROR: failed to update rule %s: %v", id, err)
+		jsonError(w, "Failed to download rule list: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	if changed {
+		p.reloads.triggered(reloadSourceManualUpdate)
+		p.reloadAllRules(p.ctx, false)
+	}
+
+	p.mu.RLock()
+	rule, ok := p.onlineRules[id]
+	var ruleCopy OnlineRule
+	if ok {
+		ruleCopy = *rule
+	}
+	p.mu.RUnlock()
+	if !ok {
+		jsonError(w, "Rule not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"changed": changed,
+		"rule":    &ruleCopy,
+	})
+}
@@ -0,0 +1,301 @@
+package adguard_rule
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/storage"
+)
+
+// memStore 是内存中的 storage.Storage
+type memStore struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+func (s *memStore) Get(_ context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.m[key]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return v, nil
+}
+
+func (s *memStore) Put(_ context.Context, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[string][]byte)
+	}
+	s.m[key] = value
+	return nil
+}
+
+func (s *memStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, key)
+	return nil
+}
+
+func (s *memStore) Close() error { return nil }
+
+// newTestDownloader 返回只含 rules 的插件, 规则文件保存在临时目录, 配置保存在内存中
+func newTestDownloader(t *testing.T, rules ...*OnlineRule) *AdguardRule {
+	t.Helper()
+	dir := t.TempDir()
+	store := new(memStore)
+	hs, err := newHooks("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &AdguardRule{
+		ctx:          context.Background(),
+		dir:          dir,
+		store:        store,
+		httpClient:   http.DefaultClient,
+		onlineRules:  make(map[string]*OnlineRule),
+		clientGroups: []*ruleGroup{{}},
+		parsed:       make(map[string]*parsedList),
+		userRules:    newUserRules(store),
+		stats:        newRuleStats("test"),
+		reloads:      newReloadHistory("test"),
+		hooks:        hs,
+		downloadSem:  make(chan struct{}, defaultDownloadConcurrency),
+		attempts:     1,
+	}
+	for _, rule := range rules {
+		rule.localPath = filepath.Join(dir, rule.ID+".rules")
+		p.onlineRules[rule.ID] = rule
+	}
+	return p
+}
+
+// conditionalServer 按 ETag 与 Last-Modified 响应条件请求, 记录每次请求的条件请求头
+type conditionalServer struct {
+	etag, lastModified string
+
+	mu       sync.Mutex
+	requests []http.Header
+}
+
+func (s *conditionalServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Header.Clone())
+	s.mu.Unlock()
+	if (len(s.etag) > 0 && r.Header.Get("If-None-Match") == s.etag) ||
+		(len(s.etag) == 0 && len(s.lastModified) > 0 && r.Header.Get("If-Modified-Since") == s.lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if len(s.etag) > 0 {
+		w.Header().Set("ETag", s.etag)
+	}
+	if len(s.lastModified) > 0 {
+		w.Header().Set("Last-Modified", s.lastModified)
+	}
+	w.Write([]byte("||" + s.etag + "example.com^\n"))
+}
+
+func (s *conditionalServer) last() http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[len(s.requests)-1]
+}
+
+func TestDownloadRuleFrom_Conditional(t *testing.T) {
+	const lastModified = "Mon, 12 Oct 2026 08:00:00 GMT"
+	tests := []struct {
+		name         string
+		etag         string
+		lastModified string
+	}{
+		{"etag", `"v1"`, ""},
+		{"last-modified", "", lastModified},
+		{"both", `"v1"`, lastModified},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &conditionalServer{etag: tt.etag, lastModified: tt.lastModified}
+			ts := httptest.NewServer(srv)
+			defer ts.Close()
+			rule := &OnlineRule{ID: "l1", Name: "List 1", URL: ts.URL}
+			p := newTestDownloader(t, rule)
+
+			changed, err := p.downloadRuleFrom(context.Background(), "l1", ts.URL)
+			if err != nil || !changed {
+				t.Fatalf("first download: changed %v, err %v", changed, err)
+			}
+			if h := srv.last(); h.Get("If-None-Match") != "" || h.Get("If-Modified-Since") != "" {
+				t.Fatalf("first request is conditional: %v", h)
+			}
+			if rule.ETag != tt.etag || rule.LastModified != tt.lastModified || rule.SourceURL != ts.URL {
+				t.Fatalf("validators not saved: %+v", rule)
+			}
+			want, err := os.ReadFile(rule.localPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			updated := rule.LastUpdated
+
+			// 未变化时服务器返回 304, 本地文件保持不变
+			changed, err = p.downloadRuleFrom(context.Background(), "l1", ts.URL)
+			if err != nil || changed {
+				t.Fatalf("second download: changed %v, err %v", changed, err)
+			}
+			h := srv.last()
+			if h.Get("If-None-Match") != tt.etag || h.Get("If-Modified-Since") != tt.lastModified {
+				t.Fatalf("unexpected conditional headers: %v", h)
+			}
+			if got, _ := os.ReadFile(rule.localPath); string(got) != string(want) {
+				t.Fatalf("rule file changed: %q", got)
+			}
+			if !rule.LastUpdated.After(updated) {
+				t.Fatal("last_updated not refreshed on 304")
+			}
+			if b, err := p.store.Get(context.Background(), configFile); err != nil || len(b) == 0 {
+				t.Fatalf("config not saved: %v", err)
+			}
+
+			// 本地文件丢失时不发送条件请求
+			os.Remove(rule.localPath)
+			changed, err = p.downloadRuleFrom(context.Background(), "l1", ts.URL)
+			if err != nil || !changed {
+				t.Fatalf("download after removal: changed %v, err %v", changed, err)
+			}
+			if h := srv.last(); h.Get("If-None-Match") != "" || h.Get("If-Modified-Since") != "" {
+				t.Fatalf("request without local file is conditional: %v", h)
+			}
+		})
+	}
+}
+
+func TestDownloadRuleFrom_OtherSource(t *testing.T) {
+	srv := &conditionalServer{etag: `"v1"`}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	rule := &OnlineRule{ID: "l1", Name: "List 1", URL: ts.URL, ETag: `"v1"`, SourceURL: "https://mirror.example/list.txt"}
+	p := newTestDownloader(t, rule)
+	if err := os.WriteFile(rule.localPath, []byte("||old.example.com^\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// 本地文件来自其他镜像, 不能使用其 ETag
+	changed, err := p.downloadRuleFrom(context.Background(), "l1", ts.URL)
+	if err != nil || !changed {
+		t.Fatalf("changed %v, err %v", changed, err)
+	}
+	if h := srv.last(); h.Get("If-None-Match") != "" {
+		t.Fatalf("conditional request with a validator from another source: %v", h)
+	}
+	if rule.SourceURL != ts.URL {
+		t.Fatalf("source_url %s", rule.SourceURL)
+	}
+}
+
+func TestDownloadRuleFrom_BadStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	}))
+	defer ts.Close()
+	rule := &OnlineRule{ID: "l1", Name: "List 1", URL: ts.URL}
+	p := newTestDownloader(t, rule)
+	if _, err := p.downloadRuleFrom(context.Background(), "l1", ts.URL); err == nil {
+		t.Fatal("want error")
+	}
+	if _, err := os.Stat(rule.localPath); !os.IsNotExist(err) {
+		t.Fatalf("rule file written on error: %v", err)
+	}
+}
+
+func TestDownloadRule_MirrorFallback(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	handler := func(name string, status int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			w.Write([]byte("||" + name + ".example.com^\n"))
+		})
+	}
+	primary := httptest.NewServer(handler("primary", http.StatusInternalServerError))
+	defer primary.Close()
+	notFound := httptest.NewServer(handler("mirror1", http.StatusNotFound))
+	defer notFound.Close()
+	ok := httptest.NewServer(handler("mirror2", http.StatusOK))
+	defer ok.Close()
+	unused := httptest.NewServer(handler("mirror3", http.StatusOK))
+	defer unused.Close()
+	// 连接失败的镜像
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	rule := &OnlineRule{ID: "l1", Name: "List 1", URL: primary.URL, MirrorURLs: []string{closed.URL, notFound.URL, ok.URL, unused.URL}}
+	p := newTestDownloader(t, rule)
+	changed, err := p.downloadRule(context.Background(), "l1")
+	if err != nil || !changed {
+		t.Fatalf("changed %v, err %v", changed, err)
+	}
+	if got := strings.Join(order, ","); got != "primary,mirror1,mirror2" {
+		t.Fatalf("download order %s", got)
+	}
+	if rule.SourceURL != ok.URL {
+		t.Fatalf("source_url %s, want %s", rule.SourceURL, ok.URL)
+	}
+	if b, _ := os.ReadFile(rule.localPath); string(b) != "||mirror2.example.com^\n" {
+		t.Fatalf("rule file %q", b)
+	}
+
+	// 主地址恢复后重新从主地址下载
+	order = nil
+	rule.URL = unused.URL
+	rule.MirrorURLs = []string{ok.URL}
+	if _, err := p.downloadRule(context.Background(), "l1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(order, ","); got != "mirror3" || rule.SourceURL != unused.URL {
+		t.Fatalf("download order %s, source_url %s", got, rule.SourceURL)
+	}
+}
+
+func TestDownloadRule_AllSourcesFail(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+	rule := &OnlineRule{ID: "l1", Name: "List 1", URL: ts.URL + "/a", MirrorURLs: []string{ts.URL + "/b"}}
+	p := newTestDownloader(t, rule)
+	_, err := p.downloadRule(context.Background(), "l1")
+	if err == nil {
+		t.Fatal("want error")
+	}
+	// 错误中包含每个地址的失败原因
+	for _, u := range []string{ts.URL + "/a", ts.URL + "/b"} {
+		if !strings.Contains(err.Error(), u) {
+			t.Errorf("error %q does not mention %s", err, u)
+		}
+	}
+	if _, err := p.downloadRule(context.Background(), "missing"); !errors.Is(err, errRuleNotFound) {
+		t.Fatalf("missing rule: %v", err)
+	}
+}
+
+func TestCleanMirrorURLs(t *testing.T) {
+	got := cleanMirrorURLs("https://a.example/l", []string{" https://b.example/l ", "", "https://a.example/l", "https://b.example/l", "https://c.example/l"})
+	if strings.Join(got, ",") != "https://b.example/l,https://c.example/l" {
+		t.Fatalf("cleanMirrorURLs = %v", got)
+	}
+}
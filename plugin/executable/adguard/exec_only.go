@@ -0,0 +1,81 @@
+package adguard_rule
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// warnExecOnly 在插件只被用作 qname 匹配器 (从未以 exec 调用) 时, 对只在 exec 中生效的配置打印警告:
+// 带 $client 或 $dnsrewrite 的规则、设置了 clients 的列表、cname_check 与 blocked 钩子。
+// 作为匹配器时这些配置不生效, 且不会报错, 容易被忽略
+func (p *AdguardRule) warnExecOnly() {
+	if p.execUsed.Load() {
+		return
+	}
+	if features := p.execOnlyFeatures(); len(features) > 0 {
+		log.Printf("[adguard_rule] WARN: plugin is only used as a qname matcher, these features take effect only when it is called with exec: %s", strings.Join(features, ", "))
+	}
+}
+
+// execOnlyFeatures 返回已配置的只在 exec 中生效的功能
+func (p *AdguardRule) execOnlyFeatures() []string {
+	p.mu.RLock()
+	groups := p.clientGroups
+	var scoped int
+	for _, rule := range p.onlineRules {
+		if rule.Enabled && len(rule.Clients) > 0 {
+			scoped++
+		}
+	}
+	p.mu.RUnlock()
+
+	var clients, rewrites int
+	count := func(rs *ruleSet) {
+		if rs == nil {
+			return
+		}
+		c, r := rs.execOnlyRules()
+		clients += c
+		rewrites += r
+	}
+	count(p.userRules.ruleSet())
+	for _, g := range groups {
+		for _, rs := range g.sets {
+			count(rs)
+		}
+	}
+
+	var features []string
+	if clients > 0 {
+		features = append(features, fmt.Sprintf("$client rules (%d)", clients))
+	}
+	if rewrites > 0 {
+		features = append(features, fmt.Sprintf("$dnsrewrite rules (%d)", rewrites))
+	}
+	if scoped > 0 {
+		features = append(features, fmt.Sprintf("lists with clients (%d)", scoped))
+	}
+	if p.cnameCheck {
+		features = append(features, "cname_check")
+	}
+	if p.hooks.blocked {
+		features = append(features, "blocked hook")
+	}
+	return features
+}
+
+// execOnlyRules 返回带 $client 与 $dnsrewrite 的规则数
+func (rs *ruleSet) execOnlyRules() (clients, rewrites int) {
+	for _, v := range rs.mods {
+		for _, r := range v.rules {
+			if r.opts.clients != nil || r.opts.notClients != nil {
+				clients++
+			}
+			if r.opts.rewrite != nil {
+				rewrites++
+			}
+		}
+	}
+	return clients, rewrites
+}
@@ -0,0 +1,50 @@
+package adguard_rule
+
+import (
+	"bytes"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAdguardRule_ExecOnlyFeatures(t *testing.T) {
+	p := newTestRule(t, "||a.example.com^$client=10.0.0.0/8\n"+
+		"@@||a.example.com^$client=~10.0.0.2\n"+
+		"||b.example.com^$dnsrewrite=1.2.3.4\n"+
+		"||ads.example.com^\n")
+	p.cnameCheck = true
+	p.onlineRules["l1"] = &OnlineRule{ID: "l1", Enabled: true, Clients: []string{"kids"}}
+	p.onlineRules["l2"] = &OnlineRule{ID: "l2", Enabled: false, Clients: []string{"kids"}}
+
+	want := []string{"$client rules (2)", "$dnsrewrite rules (1)", "lists with clients (1)", "cname_check"}
+	if got := p.execOnlyFeatures(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("execOnlyFeatures() = %v, want %v", got, want)
+	}
+
+	// 没有只在 exec 中生效的配置
+	if got := newTestRule(t, "||ads.example.com^\n").execOnlyFeatures(); len(got) != 0 {
+		t.Fatalf("execOnlyFeatures() = %v, want none", got)
+	}
+}
+
+func TestAdguardRule_WarnExecOnly(t *testing.T) {
+	var buf bytes.Buffer
+	out := log.Writer()
+	log.SetOutput(&buf)
+	defer log.SetOutput(out)
+
+	p := newTestRule(t, "||b.example.com^$dnsrewrite=1.2.3.4\n")
+	p.warnExecOnly()
+	if !strings.Contains(buf.String(), "WARN") || !strings.Contains(buf.String(), "$dnsrewrite rules (1)") {
+		t.Fatalf("missing warning, log: %q", buf.String())
+	}
+
+	// 曾以 exec 调用后不再警告
+	buf.Reset()
+	p.execUsed.Store(true)
+	p.warnExecOnly()
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected warning after exec: %q", buf.String())
+	}
+}
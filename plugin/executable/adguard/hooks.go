@@ -0,0 +1,263 @@
+package adguard_rule
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// 钩子事件
+const (
+	hookEventUpdateSucceeded = "update_succeeded" // 规则列表下载成功 (含未变化)
+	hookEventUpdateFailed    = "update_failed"    // 规则列表下载失败 (重试后)
+	hookEventBlocked         = "blocked"          // 查询被拦截
+)
+
+const (
+	hookTimeout                 = 10 * time.Second
+	hookQueueSize               = 64 // 每个钩子待发送的事件数上限, 超过时丢弃
+	defaultHookBlockedPerMinute = 10
+)
+
+// HookArgs 是一个事件通知钩子, url 与 command 二选一
+type HookArgs struct {
+	// 以 POST 发送事件 JSON 的地址, 如 ntfy 的 https://ntfy.sh/mytopic
+	URL string `yaml:"url,omitempty"`
+	// 发送 webhook 时附加的请求头, 如 Authorization
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// 执行的命令与参数, 事件 JSON 写入标准输入, 事件名在环境变量 MOSDNS_EVENT 中。
+	// 命令须为绝对路径, 不经过 shell 与 PATH 查找, 只能在配置文件中设置
+	Command []string `yaml:"command,omitempty"`
+	// 订阅的事件: update_succeeded, update_failed, blocked, 默认只有 update_failed
+	Events []string `yaml:"events,omitempty"`
+	// blocked 事件每分钟最多发送的次数, 超过的事件被丢弃, 默认 10
+	BlockedPerMinute int `yaml:"blocked_per_minute,omitempty"`
+}
+
+// hookEvent 是发送给钩子的事件
+type hookEvent struct {
+	Event     string    `json:"event"`
+	Plugin    string    `json:"plugin"` // 插件 tag
+	Time      time.Time `json:"time"`
+	Message   string    `json:"message"` // 可读的摘要, 便于直接作为通知内容
+	ListID    string    `json:"list_id,omitempty"`
+	ListName  string    `json:"list_name,omitempty"`
+	URL       string    `json:"url,omitempty"`
+	Changed   bool      `json:"changed,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Domain    string    `json:"domain,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	ClientTag string    `json:"client_tag,omitempty"`
+	Qtype     string    `json:"qtype,omitempty"`
+}
+
+type hook struct {
+	args   HookArgs
+	queue  chan *hookEvent
+	client *http.Client
+
+	mu           sync.Mutex // 保护 blocked 事件的限速窗口
+	windowStart  time.Time
+	blockedCount int
+}
+
+// hooks 将事件异步分发给订阅的钩子
+type hooks struct {
+	tag     string
+	hooks   []*hook
+	blocked bool // 是否有钩子订阅了 blocked 事件, 用于在查询路径上快速跳过
+}
+
+func newHooks(tag string, args []HookArgs) (*hooks, error) {
+	hs := &hooks{tag: tag}
+	for i, a := range args {
+		if (a.URL == "") == (len(a.Command) == 0) {
+			return nil, fmt.Errorf("hooks[%d]: exactly one of url and command must be set", i)
+		}
+		if len(a.Command) > 0 && !filepath.IsAbs(a.Command[0]) {
+			return nil, fmt.Errorf("hooks[%d]: command %q must be an absolute path", i, a.Command[0])
+		}
+		if a.URL != "" {
+			if u, err := url.Parse(a.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				// url 中可能含有凭据 (如 Telegram bot token), 不输出
+				return nil, fmt.Errorf("hooks[%d]: invalid url, want http(s)://host/...", i)
+			}
+		}
+		if len(a.Events) == 0 {
+			a.Events = []string{hookEventUpdateFailed}
+		}
+		for _, e := range a.Events {
+			switch e {
+			case hookEventUpdateSucceeded, hookEventUpdateFailed:
+			case hookEventBlocked:
+				hs.blocked = true
+			default:
+				return nil, fmt.Errorf("hooks[%d]: invalid event %q", i, e)
+			}
+		}
+		if a.BlockedPerMinute <= 0 {
+			a.BlockedPerMinute = defaultHookBlockedPerMinute
+		}
+		hs.hooks = append(hs.hooks, &hook{
+			args:   a,
+			queue:  make(chan *hookEvent, hookQueueSize),
+			client: &http.Client{Timeout: hookTimeout},
+		})
+	}
+	return hs, nil
+}
+
+// run 启动发送事件的后台 goroutine, ctx 结束时退出
+func (hs *hooks) run(ctx context.Context) {
+	for _, h := range hs.hooks {
+		go h.run(ctx)
+	}
+}
+
+// emit 将事件放入订阅了该事件的钩子的队列, 不阻塞
+func (hs *hooks) emit(e *hookEvent) {
+	e.Plugin, e.Time = hs.tag, time.Now()
+	for _, h := range hs.hooks {
+		if !slices.Contains(h.args.Events, e.Event) {
+			continue
+		}
+		if e.Event == hookEventBlocked && !h.allowBlocked(e.Time) {
+			continue
+		}
+		select {
+		case h.queue <- e:
+		default:
+			log.Printf("[adguard_rule] WARN: hook queue is full, %s event dropped", e.Event)
+		}
+	}
+}
+
+// allowBlocked 按每分钟的固定窗口限制 blocked 事件数
+func (h *hook) allowBlocked(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if now.Sub(h.windowStart) >= time.Minute {
+		h.windowStart, h.blockedCount = now, 0
+	}
+	if h.blockedCount >= h.args.BlockedPerMinute {
+		return false
+	}
+	h.blockedCount++
+	return true
+}
+
+func (h *hook) run(ctx context.Context) {
+	for {
+		select {
+		case e := <-h.queue:
+			if err := h.send(ctx, e); err != nil {
+				log.Printf("[adguard_rule] WARN: failed to send %s event to hook: %v", e.Event, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *hook) send(ctx context.Context, e *hookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+
+	if len(h.args.Command) > 0 {
+		cmd := exec.CommandContext(ctx, h.args.Command[0], h.args.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Env = append(os.Environ(), "MOSDNS_EVENT="+e.Event)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("command %s: %w: %s", h.args.Command[0], err, bytes.TrimSpace(out))
+		}
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.args.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.args.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		// *url.Error 含有完整的 url, 只保留其中的错误原因
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("webhook %s: %w", h.redactedURL(), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s returned status %d", h.redactedURL(), resp.StatusCode)
+	}
+	return nil
+}
+
+// redactedURL 返回只含 scheme 与 host 的 url, 路径与参数中可能含有凭据 (如 Telegram bot token)
+func (h *hook) redactedURL() string {
+	u, err := url.Parse(h.args.URL)
+	if err != nil {
+		return "(invalid url)"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// emitUpdate 发送规则列表 ruleID 的下载结果
+func (p *AdguardRule) emitUpdate(ruleID string, changed bool, err error) {
+	e := &hookEvent{ListID: ruleID, Changed: changed}
+	p.mu.RLock()
+	if rule, ok := p.onlineRules[ruleID]; ok {
+		e.ListName, e.URL = rule.Name, rule.URL
+		if err == nil && rule.SourceURL != "" {
+			e.URL = rule.SourceURL
+		}
+	}
+	p.mu.RUnlock()
+	if err != nil {
+		e.Event, e.Error = hookEventUpdateFailed, err.Error()
+		e.Message = fmt.Sprintf("rule list %q update failed: %v", e.ListName, err)
+	} else {
+		e.Event = hookEventUpdateSucceeded
+		e.Message = fmt.Sprintf("rule list %q updated", e.ListName)
+		if !changed {
+			e.Message = fmt.Sprintf("rule list %q is up to date", e.ListName)
+		}
+	}
+	p.hooks.emit(e)
+}
+
+// emitBlocked 发送拦截事件, 没有钩子订阅时直接返回
+func (p *AdguardRule) emitBlocked(listID, domainStr string, info queryInfo) {
+	if !p.hooks.blocked {
+		return
+	}
+	e := &hookEvent{Event: hookEventBlocked, ListID: listID, Domain: domainStr, ClientTag: info.clientTag}
+	e.ListName = p.displayName(listID)
+	if info.client.IsValid() {
+		e.Client = info.client.String()
+	}
+	if info.qtype != 0 {
+		e.Qtype = info.qtypeKey()
+	}
+	e.Message = fmt.Sprintf("%s blocked by %s", domainStr, e.ListName)
+	p.hooks.emit(e)
+}
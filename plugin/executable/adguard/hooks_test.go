@@ -0,0 +1,240 @@
+package adguard_rule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewHooks(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    HookArgs
+		wantErr bool
+	}{
+		{"url", HookArgs{URL: "https://ntfy.sh/topic"}, false},
+		{"command", HookArgs{Command: []string{"/bin/notify", "-v"}}, false},
+		{"none", HookArgs{}, true},
+		{"both", HookArgs{URL: "https://ntfy.sh/topic", Command: []string{"/bin/notify"}}, true},
+		{"relative command", HookArgs{Command: []string{"notify.sh"}}, true},
+		{"bad url", HookArgs{URL: "ftp://example.com/"}, true},
+		{"bad event", HookArgs{URL: "https://ntfy.sh/topic", Events: []string{"updated"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newHooks("adguard", []HookArgs{tt.args})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+
+	hs, err := newHooks("adguard", []HookArgs{{URL: "https://ntfy.sh/topic"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hs.hooks[0].args.Events; len(got) != 1 || got[0] != hookEventUpdateFailed {
+		t.Fatalf("want default events [update_failed], got %v", got)
+	}
+	if hs.blocked {
+		t.Fatal("blocked events are enabled by default")
+	}
+}
+
+// queued returns the events in the queue of h.
+func queued(h *hook) []string {
+	var events []string
+	for {
+		select {
+		case e := <-h.queue:
+			events = append(events, e.Event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestHooks_EventFilter(t *testing.T) {
+	hs, err := newHooks("adguard", []HookArgs{
+		{URL: "https://a.example/"},
+		{URL: "https://b.example/", Events: []string{hookEventUpdateSucceeded, hookEventBlocked}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []string{hookEventUpdateSucceeded, hookEventUpdateFailed, hookEventBlocked} {
+		hs.emit(&hookEvent{Event: e})
+	}
+	if got := strings.Join(queued(hs.hooks[0]), ","); got != "update_failed" {
+		t.Errorf("hook 0: want update_failed, got %s", got)
+	}
+	if got := strings.Join(queued(hs.hooks[1]), ","); got != "update_succeeded,blocked" {
+		t.Errorf("hook 1: want update_succeeded,blocked, got %s", got)
+	}
+}
+
+func TestHooks_BlockedRateLimit(t *testing.T) {
+	hs, err := newHooks("adguard", []HookArgs{{URL: "https://a.example/", Events: []string{hookEventBlocked, hookEventUpdateFailed}, BlockedPerMinute: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := hs.hooks[0]
+	for i := 0; i < 5; i++ {
+		hs.emit(&hookEvent{Event: hookEventBlocked})
+	}
+	// Update events are not limited.
+	hs.emit(&hookEvent{Event: hookEventUpdateFailed})
+	if got := strings.Join(queued(h), ","); got != "blocked,blocked,blocked,update_failed" {
+		t.Fatalf("want 3 blocked events and the update, got %s", got)
+	}
+
+	// A new window starts after a minute.
+	h.mu.Lock()
+	h.windowStart = h.windowStart.Add(-time.Minute)
+	h.mu.Unlock()
+	hs.emit(&hookEvent{Event: hookEventBlocked})
+	if got := len(queued(h)); got != 1 {
+		t.Fatalf("want 1 blocked event in the new window, got %d", got)
+	}
+}
+
+func TestHooks_QueueFull(t *testing.T) {
+	hs, err := newHooks("adguard", []HookArgs{{URL: "https://a.example/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing consumes the queue, emit must not block.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < hookQueueSize*2; i++ {
+			hs.emit(&hookEvent{Event: hookEventUpdateFailed})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("emit blocked on a full queue")
+	}
+	if got := len(hs.hooks[0].queue); got != hookQueueSize {
+		t.Fatalf("want %d queued events, got %d", hookQueueSize, got)
+	}
+}
+
+func TestHooks_Send(t *testing.T) {
+	received := make(chan hookEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e hookEvent
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &e); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- e
+	}))
+	defer srv.Close()
+
+	out := filepath.Join(t.TempDir(), "out")
+	const sh = "/bin/sh"
+	if _, err := os.Stat(sh); err != nil {
+		t.Skip("no /bin/sh")
+	}
+	hs, err := newHooks("adguard", []HookArgs{
+		{URL: srv.URL, Headers: map[string]string{"Authorization": "Bearer secret"}},
+		{Command: []string{sh, "-c", `cat > "$0"; echo " $MOSDNS_EVENT" >> "$0"`, out}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	e := &hookEvent{Event: hookEventUpdateFailed, ListName: "list", Error: "boom"}
+	hs.emit(e)
+
+	for _, h := range hs.hooks {
+		if err := h.send(ctx, <-h.queue); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := <-received
+	if got.Event != hookEventUpdateFailed || got.Plugin != "adguard" || got.ListName != "list" || got.Error != "boom" {
+		t.Fatalf("unexpected webhook event %+v", got)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"error":"boom"`) || !strings.HasSuffix(string(b), " update_failed\n") {
+		t.Fatalf("unexpected command input %q", b)
+	}
+
+	// Non-2xx responses and failed commands are errors.
+	bad, err := newHooks("adguard", []HookArgs{{URL: srv.URL}, {Command: []string{sh, "-c", "exit 1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range bad.hooks {
+		if err := h.send(ctx, e); err == nil {
+			t.Errorf("want error from %+v", h.args)
+		}
+	}
+}
+
+// 发送失败的错误中不能出现 url 的路径与参数 (可能含有 token)
+func TestHooks_SendErrorRedactsURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close() // 连接被拒绝
+
+	const secret = "bot123456:SECRET"
+	for _, base := range []string{srv.URL, closed.URL} {
+		hs, err := newHooks("adguard", []HookArgs{{URL: base + "/" + secret + "/sendMessage?token=" + secret}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = hs.hooks[0].send(context.Background(), &hookEvent{Event: hookEventUpdateFailed})
+		if err == nil {
+			t.Fatalf("%s: want error", base)
+		}
+		if strings.Contains(err.Error(), "SECRET") || !strings.Contains(err.Error(), base) {
+			t.Fatalf("error should only contain the scheme and host: %v", err)
+		}
+	}
+}
+
+func TestAdguardRule_EmitBlocked(t *testing.T) {
+	hs, err := newHooks("adguard", []HookArgs{{URL: "https://a.example/", Events: []string{hookEventBlocked}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &AdguardRule{hooks: hs, onlineRules: map[string]*OnlineRule{"l1": {ID: "l1", Name: "List 1"}}}
+	p.emitBlocked("l1", "ads.example.com.", queryInfo{qtype: 28, client: netip.MustParseAddr("10.0.0.2"), clientTag: "kids"})
+	p.emitUpdate("l1", false, errors.New("boom")) // not subscribed
+	select {
+	case e := <-hs.hooks[0].queue:
+		if e.Event != hookEventBlocked || e.ListName != "List 1" || e.Domain != "ads.example.com." ||
+			e.Client != "10.0.0.2" || e.ClientTag != "kids" || e.Qtype != "AAAA" {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	default:
+		t.Fatal("no event")
+	}
+	if len(hs.hooks[0].queue) != 0 {
+		t.Fatal("unsubscribed event is queued")
+	}
+}
@@ -0,0 +1,85 @@
+package adguard_rule
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseHostsLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		ok     bool
+		count  int
+		blocks []string
+	}{
+		{line: "0.0.0.0 ads.example.com", ok: true, count: 1, blocks: []string{"ads.example.com."}},
+		{line: "127.0.0.1 a.example.com b.example.com # comment c.example.com", ok: true, count: 2, blocks: []string{"a.example.com.", "b.example.com."}},
+		{line: ":: v6.example.com", ok: true, count: 1, blocks: []string{"v6.example.com."}},
+		{line: "0.0.0.0\tTabs.Example.COM.", ok: true, count: 1, blocks: []string{"tabs.example.com."}},
+		{line: "127.0.0.1 localhost", ok: true},
+		{line: "::1 ip6-localhost ip6-loopback", ok: true},
+		{line: "0.0.0.0 0.0.0.0", ok: true},
+		{line: "0.0.0.0 nodot", ok: true},
+		{line: "0.0.0.0 bad_host!.example.com", ok: true},
+		{line: "0.0.0.0", ok: false},
+		{line: "||ads.example.com^", ok: false},
+		{line: "ads.example.com 0.0.0.0", ok: false},
+		{line: "# 0.0.0.0 commented.example.com", ok: false},
+	}
+	for _, tt := range tests {
+		rs := newRuleSet()
+		count, ok := parseHostsLine(tt.line, "l1", rs)
+		if ok != tt.ok || count != tt.count {
+			t.Errorf("parseHostsLine(%q) = %d, %v, want %d, %v", tt.line, count, ok, tt.count, tt.ok)
+			continue
+		}
+		for _, d := range tt.blocks {
+			if _, ok := rs.match(d, queryInfo{}, false); !ok {
+				t.Errorf("%q: %s is not blocked", tt.line, d)
+			}
+			// hosts 规则只匹配域名本身
+			if _, ok := rs.match("sub."+d, queryInfo{}, false); ok {
+				t.Errorf("%q: sub.%s is blocked", tt.line, d)
+			}
+		}
+	}
+}
+
+func TestParseRules_Formats(t *testing.T) {
+	const list = "! comment\n" +
+		"# comment\n" +
+		"0.0.0.0 hosts.example.com\n" +
+		"||adguard.example.com^\n" +
+		"@@||ok.adguard.example.com^\n" +
+		"plain.example.com\n"
+	tests := []struct {
+		format  string
+		count   int
+		blocked []string
+		none    []string
+	}{
+		{formatAuto, 4, []string{"hosts.example.com.", "adguard.example.com.", "plain.example.com."}, nil},
+		{formatAdguard, 3, []string{"adguard.example.com.", "plain.example.com."}, []string{"hosts.example.com."}},
+		{formatHosts, 1, []string{"hosts.example.com."}, []string{"adguard.example.com.", "plain.example.com."}},
+	}
+	for _, tt := range tests {
+		rs := newRuleSet()
+		n, err := parseRulesLogf(strings.NewReader(list), tt.format, "l1", rs, t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tt.count {
+			t.Errorf("%s: want %d rules, got %d", tt.format, tt.count, n)
+		}
+		for _, d := range tt.blocked {
+			if _, ok := rs.match(d, queryInfo{}, false); !ok {
+				t.Errorf("%s: %s is not blocked", tt.format, d)
+			}
+		}
+		for _, d := range tt.none {
+			if _, ok := rs.match(d, queryInfo{}, false); ok {
+				t.Errorf("%s: %s is blocked", tt.format, d)
+			}
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package adguard_rule
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const maxJobs = 32 // 最多保留的任务数量
+
+// 任务与其中单个列表的状态
+const (
+	jobPending   = "pending"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// 任务类型
+const (
+	jobTypeUpdate     = "update"      // POST /update
+	jobTypeAutoUpdate = "auto_update" // 后台自动更新
+	jobTypeRuleAdded  = "rule_added"  // POST /rules 新增启用的列表
+	jobTypeRestore    = "restore"     // POST /restore 后下载备份中缺少文件的列表
+)
+
+// jobList 是任务中单个规则列表的下载结果
+type jobList struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Changed bool   `json:"changed"`
+	Bytes   int64  `json:"bytes"` // 接收的字节数 (压缩传输时为压缩后的大小), 含失败的尝试与镜像
+	Error   string `json:"error,omitempty"`
+}
+
+// job 是一次在后台进行的下载与重载
+type job struct {
+	ID       string     `json:"id"`
+	Type     string     `json:"type"`
+	Status   string     `json:"status"` // running, succeeded, failed (有列表下载失败)
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Lists    []jobList  `json:"lists"`
+	Reloaded bool       `json:"reloaded"` // 完成后是否重载了规则
+}
+
+// jobStore 保存最近的 maxJobs 个任务
+type jobStore struct {
+	mu   sync.Mutex
+	jobs []*job // 按创建顺序
+}
+
+// start 创建一个运行中的任务
+func (s *jobStore) start(typ string, lists []jobList) *job {
+	j := &job{ID: uuid.New().String(), Type: typ, Status: jobRunning, Started: time.Now(), Lists: lists}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, j)
+	if len(s.jobs) > maxJobs {
+		s.jobs = s.jobs[len(s.jobs)-maxJobs:]
+	}
+	return j
+}
+
+// update 在锁内修改任务 j 中列表 id 的结果
+func (s *jobStore) update(j *job, id string, fn func(l *jobList)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range j.Lists {
+		if j.Lists[i].ID == id {
+			fn(&j.Lists[i])
+		}
+	}
+}
+
+// finish 结束任务 j, 有列表失败时任务为失败
+func (s *jobStore) finish(j *job, reloaded bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	j.Finished = &now
+	j.Reloaded = reloaded
+	j.Status = jobSucceeded
+	for _, l := range j.Lists {
+		if l.Status == jobFailed {
+			j.Status = jobFailed
+		}
+	}
+}
+
+// snapshot 返回任务的副本, id 为空时返回所有任务 (最新的在前)
+func (s *jobStore) snapshot(id string) []job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var jobs []job
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		j := s.jobs[i]
+		if id != "" && j.ID != id {
+			continue
+		}
+		c := *j
+		c.Lists = append([]jobList(nil), j.Lists...)
+		jobs = append(jobs, c)
+	}
+	return jobs
+}
+
+// startDownloadJob 在后台运行 runDownloadJob, 返回任务 ID
+func (p *AdguardRule) startDownloadJob(typ, source string, ids []string, forceReload bool) string {
+	j := p.newDownloadJob(typ, ids)
+	go p.runDownloadJob(j, source, ids, forceReload)
+	return j.ID
+}
+
+// runDownloadJob 下载 ids, 有列表变化或 forceReload 时随后重载 (重载来源为 source), 重载完成后任务结束
+func (p *AdguardRule) runDownloadJob(j *job, source string, ids []string, forceReload bool) {
+	changed := p.downloadRules(p.ctx, ids, j.Type, j)
+	reload := (changed || forceReload) && p.ctx.Err() == nil
+	if reload {
+		p.reloads.triggered(source)
+		p.reloadAllRules(p.ctx, false)
+	}
+	p.jobs.finish(j, reload)
+}
+
+// newDownloadJob 创建下载 ids 的任务
+func (p *AdguardRule) newDownloadJob(typ string, ids []string) *job {
+	lists := make([]jobList, 0, len(ids))
+	p.mu.RLock()
+	for _, id := range ids {
+		l := jobList{ID: id, Status: jobPending}
+		if rule, ok := p.onlineRules[id]; ok {
+			l.Name = rule.Name
+		}
+		lists = append(lists, l)
+	}
+	p.mu.RUnlock()
+
+	return p.jobs.start(typ, lists)
+}
+
+// handleGetJobs 处理 GET /jobs, 返回最近的任务, 最新的在前
+func (p *AdguardRule) handleGetJobs(w http.ResponseWriter, r *http.Request) {
+	jobs := p.jobs.snapshot("")
+	if jobs == nil {
+		jobs = []job{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+// handleGetJob 处理 GET /jobs/{id}
+func (p *AdguardRule) handleGetJob(w http.ResponseWriter, r *http.Request) {
+	jobs := p.jobs.snapshot(chi.URLParam(r, "id"))
+	if len(jobs) == 0 {
+		jsonError(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs[0])
+}
+
+type byteCounterKey struct{}
+
+// withByteCounter 返回带有字节计数器的 ctx, 用该 ctx 下载时接收的字节数累加到 n
+func withByteCounter(ctx context.Context, n *atomic.Int64) context.Context {
+	return context.WithValue(ctx, byteCounterKey{}, n)
+}
+
+// countBody 在 ctx 带有字节计数器时包装 body, 统计读取的字节数
+func countBody(ctx context.Context, body io.ReadCloser) io.ReadCloser {
+	n, _ := ctx.Value(byteCounterKey{}).(*atomic.Int64)
+	if n == nil {
+		return body
+	}
+	return &countingBody{ReadCloser: body, n: n}
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,67 @@
+package adguard_rule
+
+import (
+	"fmt"
+	"os"
+)
+
+// ruleFileStamp 标识规则文件的一个版本。文件与格式都没有变化时, 重载复用上次解析的结果
+type ruleFileStamp struct {
+	size    int64
+	modTime int64 // UnixNano
+	format  string
+}
+
+// parsedList 是一个规则列表的解析结果, 在重载之间缓存 (AdguardRule.parsed),
+// 使启停、修改或更新一个列表时只需重新解析该列表
+type parsedList struct {
+	stamp ruleFileStamp
+	count int
+	rs    *ruleSet // 列表未启用时为 nil, 只缓存规则数
+	keys  []uint64 // 见 ruleSet.finish, 列表未启用时为 nil
+}
+
+// loadList 返回规则列表的解析结果, 文件未变化时直接返回缓存。needRules 为 false (列表未启用) 时
+// 只统计规则数, 不保留匹配器。parsed 表示本次是否重新解析了文件。
+// 解析出错时仍返回已解析的部分, 但不缓存, 下次重载时重试。须持有 reloadMu
+func (p *AdguardRule) loadList(rule *OnlineRule, needRules bool) (pl *parsedList, parsed bool, err error) {
+	fi, err := os.Stat(rule.localPath)
+	if err != nil {
+		delete(p.parsed, rule.ID)
+		return nil, false, fmt.Errorf("cannot open local file %s: %w", rule.localPath, err)
+	}
+	stamp := ruleFileStamp{size: fi.Size(), modTime: fi.ModTime().UnixNano(), format: rule.Format}
+	if pl := p.parsed[rule.ID]; pl != nil && pl.stamp == stamp {
+		if !needRules {
+			pl.rs, pl.keys = nil, nil
+			return pl, false, nil
+		}
+		if pl.rs != nil {
+			return pl, false, nil
+		}
+	}
+
+	file, err := openRuleFile(rule.localPath, p.maxListSize)
+	if err != nil {
+		delete(p.parsed, rule.ID)
+		return nil, false, fmt.Errorf("cannot open local file %s: %w", rule.localPath, err)
+	}
+	rs := newRuleSet()
+	count, err := parseRules(file, rule.Format, rule.ID, rs)
+	file.Close()
+
+	pl = &parsedList{stamp: stamp, count: count}
+	if needRules {
+		pl.keys = rs.finish()
+		if p.compact {
+			rs.compact()
+		}
+		pl.rs = rs
+	}
+	if err != nil {
+		delete(p.parsed, rule.ID)
+		return pl, true, fmt.Errorf("failed to parse rule file %s: %w", rule.localPath, err)
+	}
+	p.parsed[rule.ID] = pl
+	return pl, true, nil
+}
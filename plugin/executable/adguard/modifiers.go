@@ -0,0 +1,388 @@
+package adguard_rule
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/miekg/dns"
+)
+
+// ruleOpts 是规则的修饰符, 如 $dnstype=AAAA
+type ruleOpts struct {
+	dnstypes    map[uint16]struct{} // 只对这些查询类型生效, 为空表示不限
+	notDnstypes map[uint16]struct{} // 对这些查询类型不生效 ($dnstype=~A)
+	rewrite     *dnsRewrite         // $dnsrewrite, 带此修饰符的规则不参与拦截与放行
+	important   bool                // $important, 优先于不带此修饰符的规则
+	clients     *clientScope        // $client, 只对这些客户端生效
+	notClients  *clientScope        // $client=~..., 对这些客户端不生效
+}
+
+// matchQuery 检查规则是否对查询生效
+func (o *ruleOpts) matchQuery(info queryInfo) bool {
+	return o.matchQtype(info.qtype) && o.matchClient(info)
+}
+
+// matchClient 检查规则是否对查询的客户端生效。客户端未知 (作为域名匹配器使用) 时, 带 $client 的规则不生效
+func (o *ruleOpts) matchClient(info queryInfo) bool {
+	if o.clients == nil && o.notClients == nil {
+		return true
+	}
+	if !info.client.IsValid() && len(info.clientTag) == 0 {
+		return false
+	}
+	if o.clients != nil && !o.clients.match(info) {
+		return false
+	}
+	return o.notClients == nil || !o.notClients.match(info)
+}
+
+// matchQtype 检查规则是否对查询类型 qtype 生效。qtype 为 0 (未知) 时, 限定了类型的规则不生效
+func (o *ruleOpts) matchQtype(qtype uint16) bool {
+	if len(o.dnstypes)+len(o.notDnstypes) == 0 {
+		return true
+	}
+	if qtype == 0 {
+		return false
+	}
+	if len(o.dnstypes) > 0 {
+		if _, ok := o.dnstypes[qtype]; !ok {
+			return false
+		}
+	}
+	_, excluded := o.notDnstypes[qtype]
+	return !excluded
+}
+
+// modRule 是一条带修饰符的规则
+type modRule struct {
+	listID string
+	allow  bool
+	opts   *ruleOpts
+}
+
+// modRules 是同一匹配规则 (如 domain:example.com) 下的所有带修饰符的规则
+type modRules struct {
+	rules []modRule
+}
+
+// splitModifiers 将规则拆分为规则主体与修饰符 (最后一个 $ 之后, 逗号分隔, 引号内的逗号不分隔)。
+// 正则规则 (/.../) 中的 $ 不视为分隔符。
+func splitModifiers(line string) (string, []string) {
+	if len(line) > 1 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+		return line, nil
+	}
+	i := strings.LastIndexByte(line, '$')
+	if i < 0 {
+		return line, nil
+	}
+	return line[:i], splitUnquoted(line[i+1:], ',')
+}
+
+// splitUnquoted 按 sep 拆分 s, 单引号或双引号内的 sep 不拆分
+func splitUnquoted(s string, sep byte) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// errUnsupportedModifier 表示规则含有不支持的修饰符, 此类规则被静默跳过
+var errUnsupportedModifier = errors.New("unsupported modifier")
+
+// parseModifiers 解析修饰符, 没有修饰符时返回 nil
+func parseModifiers(mods []string) (*ruleOpts, error) {
+	if len(mods) == 0 {
+		return nil, nil
+	}
+	opts := new(ruleOpts)
+	for _, mod := range mods {
+		name, value, _ := strings.Cut(strings.TrimSpace(mod), "=")
+		switch name {
+		case "dnstype":
+			if err := opts.parseDnstype(value); err != nil {
+				return nil, err
+			}
+		case "client":
+			if err := opts.parseClient(value); err != nil {
+				return nil, err
+			}
+		case "important":
+			if len(value) > 0 {
+				return nil, fmt.Errorf("important does not take a value")
+			}
+			opts.important = true
+		case "dnsrewrite":
+			rw, err := parseDnsrewrite(value)
+			if err != nil {
+				return nil, err
+			}
+			opts.rewrite = rw
+		default:
+			return nil, errUnsupportedModifier
+		}
+	}
+	return opts, nil
+}
+
+// parseDnstype 解析 $dnstype 的值, 如 "AAAA|A" 或 "~A|~AAAA"。不能同时包含取反与不取反的类型
+func (o *ruleOpts) parseDnstype(value string) error {
+	if len(value) == 0 {
+		return fmt.Errorf("empty dnstype")
+	}
+	for _, s := range strings.Split(value, "|") {
+		negate := strings.HasPrefix(s, "~")
+		s = strings.TrimPrefix(s, "~")
+		qtype, ok := dns.StringToType[strings.ToUpper(s)]
+		if !ok {
+			return fmt.Errorf("invalid dnstype %s", s)
+		}
+		set := &o.dnstypes
+		if negate {
+			set = &o.notDnstypes
+		}
+		if *set == nil {
+			*set = make(map[uint16]struct{})
+		}
+		(*set)[qtype] = struct{}{}
+	}
+	if len(o.dnstypes) > 0 && len(o.notDnstypes) > 0 {
+		return fmt.Errorf("dnstype %s mixes negated and non-negated types", value)
+	}
+	return nil
+}
+
+// onlyImportant 表示修饰符只有 $important
+func (o *ruleOpts) onlyImportant() bool {
+	return o.important && len(o.dnstypes)+len(o.notDnstypes) == 0 && o.rewrite == nil &&
+		o.clients == nil && o.notClients == nil
+}
+
+// parseClient 解析 $client 的值, 如 "192.168.1.0/24|'Kids iPad'" 或 "~10.0.0.2"。
+// 项为 IP/CIDR 或客户端标签 (见服务器 client_acl.tags), 含空格或 | 的标签需加引号。
+// 不能同时包含取反与不取反的项
+func (o *ruleOpts) parseClient(value string) error {
+	if len(value) == 0 {
+		return fmt.Errorf("empty client")
+	}
+	for _, s := range splitUnquoted(value, '|') {
+		negate := strings.HasPrefix(s, "~")
+		s = strings.TrimPrefix(s, "~")
+		if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+			s = s[1 : len(s)-1]
+		}
+		if len(s) == 0 {
+			return fmt.Errorf("empty client in %s", value)
+		}
+		set := &o.clients
+		if negate {
+			set = &o.notClients
+		}
+		if *set == nil {
+			*set = &clientScope{tags: make(map[string]struct{})}
+		}
+		prefix, err := parseClient(s)
+		switch {
+		case err == nil && prefix.IsValid():
+			if (*set).nets == nil {
+				(*set).nets = netlist.NewList()
+			}
+			(*set).nets.Append(prefix)
+		case strings.ContainsRune(s, '/'):
+			return fmt.Errorf("invalid client %s: %w", s, err)
+		default:
+			(*set).tags[s] = struct{}{}
+		}
+	}
+	if o.clients != nil && o.notClients != nil {
+		return fmt.Errorf("client %s mixes negated and non-negated clients", value)
+	}
+	for _, set := range []*clientScope{o.clients, o.notClients} {
+		if set != nil && set.nets != nil {
+			set.nets.Sort()
+		}
+	}
+	return nil
+}
+
+// ruleSet 是一组规则的匹配器。不带修饰符与只带 $important 的规则按域名直接匹配, 值为规则列表 ID;
+// 其他带修饰符的规则需要结合查询信息判断。
+type ruleSet struct {
+	allowM          *domain.MixMatcher[string]
+	denyM           *domain.MixMatcher[string]
+	subAllowM       *domain.MixMatcher[string] // subdomainPrefix 规则, 只匹配子域名, 见 matchSubdomain
+	subDenyM        *domain.MixMatcher[string]
+	importantAllowM *domain.MixMatcher[string]
+	importantDenyM  *domain.MixMatcher[string]
+	modM            *domain.MixMatcher[*modRules]
+	mods            map[string]*modRules // 匹配规则 -> modM 中的值, 用于合并同一匹配规则的多条规则
+	seen            map[string]struct{}  // 去重用, 见 dedup, 构建完成后由 finish 释放
+	duplicates      int                  // 被去重跳过的规则数
+}
+
+func newRuleSet() *ruleSet {
+	modM := domain.NewMixMatcher[*modRules]()
+	modM.SetDefaultMatcher(domain.MatcherDomain)
+	return &ruleSet{
+		allowM:          newRuleMatcher(),
+		denyM:           newRuleMatcher(),
+		subAllowM:       newRuleMatcher(),
+		subDenyM:        newRuleMatcher(),
+		importantAllowM: newRuleMatcher(),
+		importantDenyM:  newRuleMatcher(),
+		modM:            modM,
+		mods:            make(map[string]*modRules),
+	}
+}
+
+// subdomainPrefix 是只匹配子域名的规则前缀, 如 subdomain:example.com 匹配 a.example.com 而不匹配 example.com。
+// 只支持不带修饰符的规则
+const subdomainPrefix = "subdomain:"
+
+// add 添加一条规则, pattern 为 mosdns 格式的匹配规则 (如 domain:example.com) 或 subdomainPrefix 规则
+func (rs *ruleSet) add(pattern, listID string, allow bool, opts *ruleOpts) error {
+	if opts == nil {
+		if rs.dedup(pattern, allow, false) {
+			return nil
+		}
+		if parent, ok := strings.CutPrefix(pattern, subdomainPrefix); ok {
+			if allow {
+				return rs.subAllowM.Add(parent, listID)
+			}
+			return rs.subDenyM.Add(parent, listID)
+		}
+		if allow {
+			return rs.allowM.Add(pattern, listID)
+		}
+		return rs.denyM.Add(pattern, listID)
+	}
+	if opts.onlyImportant() {
+		if rs.dedup(pattern, allow, true) {
+			return nil
+		}
+		if allow {
+			return rs.importantAllowM.Add(pattern, listID)
+		}
+		return rs.importantDenyM.Add(pattern, listID)
+	}
+	if opts.rewrite != nil && opts.rewrite.empty && !allow {
+		return fmt.Errorf("empty dnsrewrite in blocking rule %s", pattern)
+	}
+	r := modRule{listID: listID, allow: allow, opts: opts}
+	if v, ok := rs.mods[pattern]; ok {
+		v.rules = append(v.rules, r)
+		return nil
+	}
+	v := &modRules{rules: []modRule{r}}
+	if err := rs.modM.Add(pattern, v); err != nil {
+		return err
+	}
+	rs.mods[pattern] = v
+	return nil
+}
+
+// compact 将 rs 中的匹配器编译为紧凑的只读前缀树, 见 domain.MixMatcher.Compact。
+// 须在规则全部添加后、rs 开始用于匹配前调用
+func (rs *ruleSet) compact() {
+	for _, m := range [...]*domain.MixMatcher[string]{rs.allowM, rs.denyM, rs.subAllowM, rs.subDenyM, rs.importantAllowM, rs.importantDenyM} {
+		m.Compact()
+	}
+	rs.modM.Compact()
+}
+
+// match 返回 domainStr 是否命中放行 (allow 为 true) 或拦截规则, 以及命中规则的列表 ID。
+// 不含 $important 规则 (见 matchImportant) 与 $dnsrewrite 规则 (见 rewrites)。
+func (rs *ruleSet) match(domainStr string, info queryInfo, allow bool) (string, bool) {
+	m, sm := rs.denyM, rs.subDenyM
+	if allow {
+		m, sm = rs.allowM, rs.subAllowM
+	}
+	if listID, ok := m.Match(domainStr); ok {
+		return listID, true
+	}
+	if listID, ok := matchSubdomain(sm, domainStr); ok {
+		return listID, true
+	}
+	return rs.matchMod(domainStr, info, allow, false)
+}
+
+// matchSubdomain 以 domainStr 的上一级域名匹配 m, 使 m 中的规则只匹配子域名
+func matchSubdomain(m *domain.MixMatcher[string], domainStr string) (string, bool) {
+	if m.Len() == 0 {
+		return "", false
+	}
+	_, parent, ok := strings.Cut(domainStr, ".")
+	if !ok || len(parent) == 0 || parent == "." {
+		return "", false
+	}
+	return m.Match(parent)
+}
+
+// matchImportant 同 match, 只检查 $important 规则
+func (rs *ruleSet) matchImportant(domainStr string, info queryInfo, allow bool) (string, bool) {
+	m := rs.importantDenyM
+	if allow {
+		m = rs.importantAllowM
+	}
+	if listID, ok := m.Match(domainStr); ok {
+		return listID, true
+	}
+	return rs.matchMod(domainStr, info, allow, true)
+}
+
+// matchMod 检查 modM 中的规则。只检查最精确匹配的域名下的规则
+func (rs *ruleSet) matchMod(domainStr string, info queryInfo, allow, important bool) (string, bool) {
+	if rs.modM.Len() == 0 {
+		return "", false
+	}
+	v, ok := rs.modM.Match(domainStr)
+	if !ok {
+		return "", false
+	}
+	for _, r := range v.rules {
+		if r.allow == allow && r.opts.important == important && r.opts.rewrite == nil && r.opts.matchQuery(info) {
+			return r.listID, true
+		}
+	}
+	return "", false
+}
+
+// rewrites 返回 domainStr 命中的所有 $dnsrewrite 改写及其中第一条规则的列表 ID。
+// exempt 表示命中了禁用改写的放行规则 (@@||example.com^$dnsrewrite)。
+func (rs *ruleSet) rewrites(domainStr string, info queryInfo) (listID string, rws []*dnsRewrite, exempt bool) {
+	if rs.modM.Len() == 0 {
+		return "", nil, false
+	}
+	v, ok := rs.modM.Match(domainStr)
+	if !ok {
+		return "", nil, false
+	}
+	for _, r := range v.rules {
+		if r.opts.rewrite == nil || !r.opts.matchQuery(info) {
+			continue
+		}
+		if r.allow {
+			return "", nil, true
+		}
+		if len(rws) == 0 {
+			listID = r.listID
+		}
+		rws = append(rws, r.opts.rewrite)
+	}
+	return listID, rws, false
+}
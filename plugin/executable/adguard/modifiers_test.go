@@ -0,0 +1,269 @@
+package adguard_rule
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/domain_set"
+	"github.com/miekg/dns"
+)
+
+func TestParseDnstype(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+		match   []uint16
+		noMatch []uint16
+	}{
+		{value: "AAAA", match: []uint16{dns.TypeAAAA}, noMatch: []uint16{dns.TypeA, 0}},
+		{value: "a|https", match: []uint16{dns.TypeA, dns.TypeHTTPS}, noMatch: []uint16{dns.TypeAAAA}},
+		{value: "~A|~AAAA", match: []uint16{dns.TypeHTTPS, dns.TypeMX}, noMatch: []uint16{dns.TypeA, dns.TypeAAAA, 0}},
+		{value: "", wantErr: true},
+		{value: "BOGUS", wantErr: true},
+		{value: "A|~AAAA", wantErr: true},
+		{value: "A|", wantErr: true},
+	}
+	for _, tt := range tests {
+		o := new(ruleOpts)
+		err := o.parseDnstype(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDnstype(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		for _, q := range tt.match {
+			if !o.matchQtype(q) {
+				t.Errorf("%q: want match for qtype %d", tt.value, q)
+			}
+		}
+		for _, q := range tt.noMatch {
+			if o.matchQtype(q) {
+				t.Errorf("%q: want no match for qtype %d", tt.value, q)
+			}
+		}
+	}
+}
+
+func TestParseRules_Dnstype(t *testing.T) {
+	const rules = "||v6.example.com^$dnstype=AAAA\n" +
+		"||notv4.example.com^$dnstype=~A\n" +
+		"||both.example.com^$dnstype=A,important\n" +
+		"@@||ok.v6.example.com^$dnstype=AAAA\n" +
+		"||bad.example.com^$dnstype=A|~AAAA\n" +
+		"||unsupported.example.com^$dnstype=A,third-party\n"
+	rs := newRuleSet()
+	n, err := parseRulesLogf(strings.NewReader(rules), formatAdguard, "l1", rs, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Fatalf("want 4 rules, got %d", n)
+	}
+	tests := []struct {
+		domain    string
+		qtype     uint16
+		important bool
+		allow     bool
+		want      bool
+	}{
+		{"v6.example.com.", dns.TypeAAAA, false, false, true},
+		{"a.v6.example.com.", dns.TypeAAAA, false, false, true},
+		{"v6.example.com.", dns.TypeA, false, false, false},
+		{"v6.example.com.", 0, false, false, false},
+		{"notv4.example.com.", dns.TypeAAAA, false, false, true},
+		{"notv4.example.com.", dns.TypeA, false, false, false},
+		{"both.example.com.", dns.TypeA, true, false, true},
+		{"both.example.com.", dns.TypeA, false, false, false},
+		{"ok.v6.example.com.", dns.TypeAAAA, false, true, true},
+		{"ok.v6.example.com.", dns.TypeA, false, true, false},
+		{"bad.example.com.", dns.TypeA, false, false, false},
+		{"unsupported.example.com.", dns.TypeA, false, false, false},
+	}
+	for _, tt := range tests {
+		info := queryInfo{qtype: tt.qtype}
+		var ok bool
+		if tt.important {
+			_, ok = rs.matchImportant(tt.domain, info, tt.allow)
+		} else {
+			_, ok = rs.match(tt.domain, info, tt.allow)
+		}
+		if ok != tt.want {
+			t.Errorf("%s qtype %d important %v allow %v: got %v, want %v", tt.domain, tt.qtype, tt.important, tt.allow, ok, tt.want)
+		}
+	}
+}
+
+func TestAdguardRule_MatchQtype(t *testing.T) {
+	p := newTestRule(t, "||v6.example.com^$dnstype=AAAA\n||all.example.com^\n")
+	tests := []struct {
+		domain string
+		qtype  uint16
+		want   bool
+	}{
+		{"v6.example.com.", dns.TypeAAAA, true},
+		{"v6.example.com.", dns.TypeA, false},
+		{"all.example.com.", dns.TypeA, true},
+	}
+	// 经 domain_set 引用时 qtype 同样传递给插件
+	group := domain_set.MatcherGroup{p}
+	for _, tt := range tests {
+		if _, ok := p.MatchQtype(tt.domain, tt.qtype); ok != tt.want {
+			t.Errorf("MatchQtype(%s, %d) = %v, want %v", tt.domain, tt.qtype, ok, tt.want)
+		}
+		if _, ok := group.MatchQtype(tt.domain, tt.qtype); ok != tt.want {
+			t.Errorf("MatcherGroup.MatchQtype(%s, %d) = %v, want %v", tt.domain, tt.qtype, ok, tt.want)
+		}
+	}
+	// 查询类型未知时带 $dnstype 的规则不生效
+	if _, ok := p.Match("v6.example.com."); ok {
+		t.Error("dnstype rule matches without qtype")
+	}
+	if _, ok := group.Match("all.example.com."); !ok {
+		t.Error("want match")
+	}
+}
+
+// newTestRuleSet 解析 rules 为列表 listID 的匹配器
+func newTestRuleSet(t *testing.T, listID, rules string) *ruleSet {
+	t.Helper()
+	rs := newRuleSet()
+	if _, err := parseRulesLogf(strings.NewReader(rules), formatAdguard, listID, rs, t.Logf); err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+func TestAdguardRule_DecidePriority(t *testing.T) {
+	p := newTestRule(t, "@@||d1.example^\n"+
+		"||d3.example^\n"+
+		"@@||d4.example^\n||d4.example^\n"+
+		"@@||d8.example^$important\n"+
+		"@@||d9.example^\n")
+	p.clientGroups = []*ruleGroup{{sets: []*ruleSet{
+		newTestRuleSet(t, "a", "||d1.example^$important\n"+
+			"||d2.example^$important\n"+
+			"@@||d3.example^\n"+
+			"||d5.example^\n"+
+			"||d6.example^\n"+
+			"||d8.example^$important\n"+
+			"||d9.example^$dnstype=A,important\n"),
+		newTestRuleSet(t, "b", "@@||d2.example^$important\n"+
+			"@@||d5.example^\n"),
+	}}}
+	tests := []struct {
+		name        string
+		domain      string
+		qtype       uint16
+		wantList    string
+		wantBlocked bool
+	}{
+		{"important block beats user allow", "d1.example.", dns.TypeA, "a", true},
+		{"important allow beats important block", "d2.example.", dns.TypeA, "b", false},
+		{"user block beats list allow", "d3.example.", dns.TypeA, userRulesID, true},
+		{"user allow beats user block", "d4.example.", dns.TypeA, userRulesID, false},
+		{"list allow beats other list block", "d5.example.", dns.TypeA, "b", false},
+		{"list block", "sub.d6.example.", dns.TypeA, "a", true},
+		{"no rule", "d7.example.", dns.TypeA, "", false},
+		{"user important allow beats list important block", "d8.example.", dns.TypeA, userRulesID, false},
+		{"important with matching dnstype", "d9.example.", dns.TypeA, "a", true},
+		{"important with other dnstype", "d9.example.", dns.TypeAAAA, userRulesID, false},
+	}
+	for _, tt := range tests {
+		listID, blocked := p.decide(tt.domain, queryInfo{qtype: tt.qtype})
+		if listID != tt.wantList || blocked != tt.wantBlocked {
+			t.Errorf("%s: decide(%s) = (%q, %v), want (%q, %v)", tt.name, tt.domain, listID, blocked, tt.wantList, tt.wantBlocked)
+		}
+	}
+}
+
+func TestSplitModifiers(t *testing.T) {
+	tests := []struct {
+		line string
+		body string
+		mods []string
+	}{
+		{"||example.com^", "||example.com^", nil},
+		{"||example.com^$important", "||example.com^", []string{"important"}},
+		{"||example.com^$client='a,b'|\"c d\",dnstype=A", "||example.com^", []string{"client='a,b'|\"c d\"", "dnstype=A"}},
+		{"/ads\\$/", "/ads\\$/", nil},
+	}
+	for _, tt := range tests {
+		body, mods := splitModifiers(tt.line)
+		if body != tt.body || strings.Join(mods, "\n") != strings.Join(tt.mods, "\n") {
+			t.Errorf("splitModifiers(%q) = %q, %q, want %q, %q", tt.line, body, mods, tt.body, tt.mods)
+		}
+	}
+}
+
+func TestParseClient(t *testing.T) {
+	kids := queryInfo{client: netip.MustParseAddr("192.168.1.20"), clientTag: "Kids iPad"}
+	tv := queryInfo{client: netip.MustParseAddr("10.0.0.2"), clientTag: "tv"}
+	other := queryInfo{client: netip.MustParseAddr("10.0.0.3")}
+	tagged := queryInfo{clientTag: "a|b,c"}
+	tests := []struct {
+		value   string
+		wantErr bool
+		match   []queryInfo
+		noMatch []queryInfo
+	}{
+		{value: "192.168.1.0/24", match: []queryInfo{kids}, noMatch: []queryInfo{tv, other, {}}},
+		{value: "10.0.0.2|'Kids iPad'", match: []queryInfo{kids, tv}, noMatch: []queryInfo{other}},
+		{value: `"Kids iPad"`, match: []queryInfo{kids}, noMatch: []queryInfo{tv}},
+		{value: "tv", match: []queryInfo{tv}, noMatch: []queryInfo{kids}},
+		{value: "'a|b,c'", match: []queryInfo{tagged}, noMatch: []queryInfo{tv}},
+		{value: "~10.0.0.2", match: []queryInfo{kids, other}, noMatch: []queryInfo{tv, {}}},
+		{value: "~tv|~192.168.1.0/24", match: []queryInfo{other}, noMatch: []queryInfo{tv, kids}},
+		{value: "~'Kids iPad'", match: []queryInfo{tv}, noMatch: []queryInfo{kids}},
+		{value: "", wantErr: true},
+		{value: "''", wantErr: true},
+		{value: "10.0.0.2|~tv", wantErr: true},
+		{value: "10.0.0.0/33", wantErr: true},
+	}
+	for _, tt := range tests {
+		o := new(ruleOpts)
+		err := o.parseClient(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseClient(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		for _, info := range tt.match {
+			if !o.matchClient(info) {
+				t.Errorf("%q: want match for %+v", tt.value, info)
+			}
+		}
+		for _, info := range tt.noMatch {
+			if o.matchClient(info) {
+				t.Errorf("%q: want no match for %+v", tt.value, info)
+			}
+		}
+	}
+}
+
+func TestParseRules_Client(t *testing.T) {
+	// 含 IP 与带空格的标签的规则不应被当作 hosts 格式的行跳过
+	rs := newTestRuleSet(t, "l1", "||example.com^$client='Kids iPad'|10.0.0.0/8\n"+
+		"@@||example.com^$client=~10.0.0.2\n"+
+		"||quoted.example.com^$client=\"a, b\",dnstype=A\n"+
+		"0.0.0.0 hosts.example.com\n")
+	tests := []struct {
+		domain string
+		info   queryInfo
+		allow  bool
+		want   bool
+	}{
+		{"example.com.", queryInfo{clientTag: "Kids iPad"}, false, true},
+		{"example.com.", queryInfo{client: netip.MustParseAddr("10.0.0.2")}, false, true},
+		{"example.com.", queryInfo{client: netip.MustParseAddr("192.168.0.1")}, false, false},
+		{"example.com.", queryInfo{}, false, false},
+		{"example.com.", queryInfo{client: netip.MustParseAddr("10.0.0.3")}, true, true},
+		{"example.com.", queryInfo{client: netip.MustParseAddr("10.0.0.2")}, true, false},
+		{"quoted.example.com.", queryInfo{clientTag: "a, b", qtype: dns.TypeA}, false, true},
+		{"quoted.example.com.", queryInfo{clientTag: "a, b", qtype: dns.TypeAAAA}, false, false},
+		{"hosts.example.com.", queryInfo{}, false, false},
+	}
+	for _, tt := range tests {
+		if _, ok := rs.match(tt.domain, tt.info, tt.allow); ok != tt.want {
+			t.Errorf("match(%s, %+v, allow %v) = %v, want %v", tt.domain, tt.info, tt.allow, ok, tt.want)
+		}
+	}
+}
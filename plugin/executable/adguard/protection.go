@@ -0,0 +1,121 @@
+package adguard_rule
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// protection 是拦截开关。暂停期间所有查询均放行, 设置了时长时到期自动恢复
+type protection struct {
+	paused atomic.Bool
+
+	mu    sync.Mutex
+	until time.Time   // 自动恢复的时间, 零值表示无限期暂停
+	timer *time.Timer // 自动恢复的定时器
+}
+
+// protectionStatus 是 /protection 接口的响应格式
+type protectionStatus struct {
+	Enabled          bool       `json:"enabled"`
+	PausedUntil      *time.Time `json:"paused_until,omitempty"`
+	RemainingSeconds int64      `json:"remaining_seconds,omitempty"`
+}
+
+// protectionPayload 是 POST /protection 的请求格式, duration 为 Go 时长字符串, 如 "30m"
+type protectionPayload struct {
+	Enabled  bool   `json:"enabled"`
+	Duration string `json:"duration"`
+}
+
+func (pr *protection) enabled() bool {
+	return !pr.paused.Load()
+}
+
+// pause 暂停拦截, d 为 0 时无限期暂停。再次调用会替换之前的时长
+func (pr *protection) pause(d time.Duration) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.stopTimerLocked()
+	pr.until = time.Time{}
+	if d > 0 {
+		pr.until = time.Now().Add(d)
+		var t *time.Timer
+		t = time.AfterFunc(d, func() {
+			pr.mu.Lock()
+			defer pr.mu.Unlock()
+			if pr.timer != t { // 已被新的暂停或恢复替换
+				return
+			}
+			pr.resumeLocked()
+			log.Println("[adguard_rule] protection resumed automatically")
+		})
+		pr.timer = t
+	}
+	pr.paused.Store(true)
+}
+
+func (pr *protection) resume() {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.resumeLocked()
+}
+
+func (pr *protection) resumeLocked() {
+	pr.stopTimerLocked()
+	pr.until = time.Time{}
+	pr.paused.Store(false)
+}
+
+func (pr *protection) stopTimerLocked() {
+	if pr.timer != nil {
+		pr.timer.Stop()
+		pr.timer = nil
+	}
+}
+
+func (pr *protection) status() protectionStatus {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	s := protectionStatus{Enabled: !pr.paused.Load()}
+	if !s.Enabled && !pr.until.IsZero() {
+		until := pr.until
+		s.PausedUntil = &until
+		s.RemainingSeconds = int64((time.Until(until) + time.Second - 1) / time.Second) // 向上取整
+	}
+	return s
+}
+
+func (p *AdguardRule) handleGetProtection(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(p.protection.status())
+}
+
+// handleSetProtection 暂停或恢复拦截, 如 {"enabled": false, "duration": "30m"}, 省略 duration 时无限期暂停
+func (p *AdguardRule) handleSetProtection(w http.ResponseWriter, r *http.Request) {
+	var payload protectionPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if payload.Enabled {
+		p.protection.resume()
+		log.Println("[adguard_rule] protection resumed")
+	} else {
+		var d time.Duration
+		if len(payload.Duration) > 0 {
+			var err error
+			d, err = time.ParseDuration(payload.Duration)
+			if err != nil || d <= 0 {
+				jsonError(w, "duration must be a positive duration, e.g. 30m", http.StatusBadRequest)
+				return
+			}
+		}
+		p.protection.pause(d)
+		log.Printf("[adguard_rule] protection paused, duration: %s", payload.Duration)
+	}
+	p.handleGetProtection(w, r)
+}
@@ -0,0 +1,111 @@
+package adguard_rule
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor 等待 cond 成立, 超时则失败
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProtection_AutoResume(t *testing.T) {
+	var pr protection
+	pr.pause(50 * time.Millisecond)
+	if pr.enabled() {
+		t.Fatal("want paused")
+	}
+	s := pr.status()
+	if s.Enabled || s.PausedUntil == nil || s.RemainingSeconds != 1 {
+		t.Fatalf("unexpected status %+v", s)
+	}
+	waitFor(t, pr.enabled)
+	if s := pr.status(); !s.Enabled || s.PausedUntil != nil {
+		t.Fatalf("unexpected status after resume %+v", s)
+	}
+}
+
+func TestProtection_PauseReplacesTimer(t *testing.T) {
+	var pr protection
+	pr.pause(30 * time.Millisecond)
+	// 无限期暂停取消之前的定时器
+	pr.pause(0)
+	time.Sleep(100 * time.Millisecond)
+	if pr.enabled() {
+		t.Fatal("indefinite pause was resumed by an old timer")
+	}
+	if s := pr.status(); s.PausedUntil != nil {
+		t.Fatalf("indefinite pause has paused_until: %+v", s)
+	}
+
+	// 手动恢复后, 之前的定时器不再影响新的暂停
+	pr.pause(30 * time.Millisecond)
+	pr.resume()
+	pr.pause(time.Hour)
+	time.Sleep(100 * time.Millisecond)
+	if pr.enabled() {
+		t.Fatal("pause was resumed by an old timer")
+	}
+	if s := pr.status(); s.RemainingSeconds <= 3500 {
+		t.Fatalf("unexpected remaining seconds %+v", s)
+	}
+	pr.resume()
+	if !pr.enabled() {
+		t.Fatal("want enabled")
+	}
+}
+
+func TestAdguardRule_HandleSetProtection(t *testing.T) {
+	p := newTestRule(t, "||ads.example.com^\n")
+	do := func(body string) (int, protectionStatus) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		p.handleSetProtection(w, httptest.NewRequest(http.MethodPost, "/protection", strings.NewReader(body)))
+		var s protectionStatus
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, s
+	}
+	for _, body := range []string{`{"enabled": false, "duration": "soon"}`, `{"enabled": false, "duration": "-1m"}`, `not json`} {
+		if code, _ := do(body); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", body, code)
+		}
+	}
+	if !p.protection.enabled() {
+		t.Fatal("invalid request paused protection")
+	}
+
+	code, s := do(`{"enabled": false, "duration": "50ms"}`)
+	if code != http.StatusOK || s.Enabled || s.PausedUntil == nil {
+		t.Fatalf("pause: %d %+v", code, s)
+	}
+	if _, ok := p.Match("ads.example.com."); ok {
+		t.Fatal("blocked while paused")
+	}
+	waitFor(t, p.protection.enabled)
+	if _, ok := p.Match("ads.example.com."); !ok {
+		t.Fatal("not blocked after auto resume")
+	}
+
+	if code, s := do(`{"enabled": false}`); code != http.StatusOK || s.Enabled || s.PausedUntil != nil {
+		t.Fatalf("indefinite pause: %d %+v", code, s)
+	}
+	if code, s := do(`{"enabled": true}`); code != http.StatusOK || !s.Enabled {
+		t.Fatalf("resume: %d %+v", code, s)
+	}
+}
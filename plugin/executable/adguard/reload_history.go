@@ -0,0 +1,268 @@
+package adguard_rule
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const maxReloadHistory = 50 // 最多保留的重载记录数量
+
+// 重载触发来源
+const (
+	reloadSourceInitial      = "initial"
+	reloadSourceAutoUpdate   = "auto_update"
+	reloadSourceManualUpdate = "manual_update"
+	reloadSourceRuleAdded    = "rule_added"
+	reloadSourceRuleUpdated  = "rule_updated"
+	reloadSourceRuleDeleted  = "rule_deleted"
+	reloadSourceRestore      = "restore"
+)
+
+// 重载阶段, 见 reloadStatus
+const (
+	reloadPhaseDownloading = "downloading" // 首次加载时下载缺失的列表
+	reloadPhaseParsing     = "parsing"
+)
+
+// reloadStatus 是当前重载的进度。重载期间查询继续使用旧的匹配器, 见 GET /reload_status
+type reloadStatus struct {
+	State        string     `json:"state"`           // building: 正在重载, ready: 空闲
+	Phase        string     `json:"phase,omitempty"` // 重载中的阶段: downloading, parsing
+	Started      *time.Time `json:"started,omitempty"`
+	ElapsedMs    int64      `json:"elapsed_ms"`   // 正在重载时为已用时间, 否则为上次重载的耗时
+	Lists        int        `json:"lists"`        // 参与本次重载的列表数量 (含未启用的)
+	ListsDone    int        `json:"lists_done"`   // 当前阶段已处理的列表数量
+	ListsParsed  int        `json:"lists_parsed"` // 当前阶段重新解析的列表数量, 其余复用上次的解析结果
+	LastFinished *time.Time `json:"last_finished,omitempty"`
+	Loaded       bool       `json:"loaded"` // 是否已完成过一次重载 (启动后的首次加载在后台进行)
+}
+
+// listDelta 记录单个规则列表在一次重载前后的规则数量
+type listDelta struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Before int    `json:"before"`
+	After  int    `json:"after"`
+}
+
+// reloadEvent 是一次规则重载的记录
+type reloadEvent struct {
+	Time       time.Time   `json:"time"`
+	Sources    []string    `json:"sources"`    // 本次重载合并的所有触发来源
+	Superseded int         `json:"superseded"` // 被本次重载合并 (防抖跳过) 的触发次数
+	DurationMs int64       `json:"duration_ms"`
+	Lists      int         `json:"lists"`  // 加载的启用列表数量
+	Parsed     int         `json:"parsed"` // 重新解析的列表数量, 其余列表未变化, 复用上次的解析结果
+	Rules      int         `json:"rules"`
+	RuleDelta  int         `json:"rule_delta"`        // 与上次重载相比的规则数量变化
+	Changed    []listDelta `json:"changed,omitempty"` // 规则数量有变化的列表
+}
+
+// reloadHistory 记录防抖/重载流程, 用于 API 与 prometheus 指标
+type reloadHistory struct {
+	mu         sync.Mutex
+	pending    map[string]struct{} // 尚未执行的触发来源
+	superseded int                 // 自上次重载以来被跳过的触发次数
+	lastCounts map[string]int      // 上次重载时各列表的规则数量
+	lastTotal  int
+	events     []reloadEvent // 按时间顺序, 最多 maxReloadHistory 条
+	status     reloadStatus
+
+	reloadTotal     *prometheus.CounterVec
+	reloadDuration  prometheus.Histogram
+	supersededTotal prometheus.Counter
+	skippedTotal    prometheus.Counter
+	activeRules     prometheus.Gauge
+}
+
+func newReloadHistory(tag string) *reloadHistory {
+	lb := map[string]string{"tag": tag}
+	return &reloadHistory{
+		pending:    make(map[string]struct{}),
+		lastCounts: make(map[string]int),
+		status:     reloadStatus{State: "building"},
+		reloadTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "reload_total",
+			Help:        "The total number of rule reloads by trigger source",
+			ConstLabels: lb,
+		}, []string{"source"}),
+		reloadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "reload_duration_seconds",
+			Help:        "The duration of rule reloads",
+			ConstLabels: lb,
+			Buckets:     []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		}),
+		supersededTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "reload_superseded_total",
+			Help:        "The total number of reload triggers merged into a newer one by debouncing",
+			ConstLabels: lb,
+		}),
+		skippedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "reload_skipped_total",
+			Help:        "The total number of reloads skipped because the plugin was closing",
+			ConstLabels: lb,
+		}),
+		activeRules: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "active_rules",
+			Help:        "The number of rules loaded from enabled lists",
+			ConstLabels: lb,
+		}),
+	}
+}
+
+func (h *reloadHistory) regMetricsTo(r prometheus.Registerer) error {
+	for _, c := range [...]prometheus.Collector{h.reloadTotal, h.reloadDuration, h.supersededTotal, h.skippedTotal, h.activeRules} {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// triggered 记录一次重载触发
+func (h *reloadHistory) triggered(source string) {
+	h.mu.Lock()
+	h.pending[source] = struct{}{}
+	h.mu.Unlock()
+}
+
+// recordSuperseded 记录一次被更新的触发取代的重载
+func (h *reloadHistory) recordSuperseded() {
+	h.supersededTotal.Inc()
+	h.mu.Lock()
+	h.superseded++
+	h.mu.Unlock()
+}
+
+func (h *reloadHistory) recordSkipped() {
+	h.skippedTotal.Inc()
+}
+
+// beginReload 记录一次重载开始, lists 为参与重载的列表数量
+func (h *reloadHistory) beginReload(start time.Time, lists int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status.State = "building"
+	h.status.Phase = ""
+	h.status.Started = &start
+	h.status.Lists = lists
+	h.status.ListsDone = 0
+	h.status.ListsParsed = 0
+}
+
+// setPhase 记录重载进入新的阶段, 并重置列表进度
+func (h *reloadHistory) setPhase(phase string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status.Phase = phase
+	h.status.ListsDone = 0
+	h.status.ListsParsed = 0
+}
+
+// listDone 记录当前阶段处理完一个列表, parsed 表示是否重新解析了该列表
+func (h *reloadHistory) listDone(parsed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status.ListsDone++
+	if parsed {
+		h.status.ListsParsed++
+	}
+}
+
+// reloadStatus 返回当前的重载进度
+func (h *reloadHistory) reloadStatus() reloadStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := h.status
+	if st.State == "building" && st.Started != nil {
+		st.ElapsedMs = time.Since(*st.Started).Milliseconds()
+	}
+	return st
+}
+
+// recordReload 记录一次完成的重载。counts 为各启用列表加载的规则数量, names 用于显示列表名称,
+// parsed 为重新解析的列表数量。
+func (h *reloadHistory) recordReload(start time.Time, counts map[string]int, names map[string]string, parsed int) {
+	d := time.Since(start)
+	total := 0
+	for _, c := range counts {
+		total += c
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := reloadEvent{
+		Time:       start,
+		Superseded: h.superseded,
+		DurationMs: d.Milliseconds(),
+		Lists:      len(counts),
+		Parsed:     parsed,
+		Rules:      total,
+		RuleDelta:  total - h.lastTotal,
+	}
+	for s := range h.pending {
+		e.Sources = append(e.Sources, s)
+	}
+	sort.Strings(e.Sources)
+	for id, after := range counts {
+		if before := h.lastCounts[id]; before != after {
+			e.Changed = append(e.Changed, listDelta{ID: id, Name: names[id], Before: before, After: after})
+		}
+	}
+	for id, before := range h.lastCounts {
+		if _, ok := counts[id]; !ok && before != 0 {
+			e.Changed = append(e.Changed, listDelta{ID: id, Name: names[id], Before: before})
+		}
+	}
+	sort.Slice(e.Changed, func(i, j int) bool { return e.Changed[i].Name < e.Changed[j].Name })
+
+	for _, s := range e.Sources {
+		h.reloadTotal.WithLabelValues(s).Inc()
+	}
+	h.reloadDuration.Observe(d.Seconds())
+	h.activeRules.Set(float64(total))
+
+	finished := start.Add(d)
+	h.status.State = "ready"
+	h.status.Phase = ""
+	h.status.ElapsedMs = e.DurationMs
+	h.status.LastFinished = &finished
+	h.status.Loaded = true
+
+	h.pending = make(map[string]struct{})
+	h.superseded = 0
+	h.lastCounts = counts
+	h.lastTotal = total
+	h.events = append(h.events, e)
+	if len(h.events) > maxReloadHistory {
+		h.events = h.events[len(h.events)-maxReloadHistory:]
+	}
+}
+
+// snapshot 返回重载记录, 最新的在前
+func (h *reloadHistory) snapshot() []reloadEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	events := make([]reloadEvent, len(h.events))
+	for i, e := range h.events {
+		events[len(h.events)-1-i] = e
+	}
+	return events
+}
+
+// handleGetReloads 处理 GET /reloads, 返回最近的重载记录
+func (p *AdguardRule) handleGetReloads(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.reloads.snapshot())
+}
+
+// handleGetReloadStatus 处理 GET /reload_status, 返回当前的重载进度
+func (p *AdguardRule) handleGetReloadStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.reloads.reloadStatus())
+}
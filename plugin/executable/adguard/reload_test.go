@@ -0,0 +1,218 @@
+package adguard_rule
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeList 写入规则文件, 并将修改时间设为 mtime, 以免同一时刻的两次写入无法区分
+func writeList(t *testing.T, rule *OnlineRule, text string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(rule.localPath, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(rule.localPath, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdguardRule_IncrementalReload(t *testing.T) {
+	l1 := &OnlineRule{ID: "l1", Name: "List 1", Enabled: true}
+	l2 := &OnlineRule{ID: "l2", Name: "List 2", Enabled: true}
+	l3 := &OnlineRule{ID: "l3", Name: "List 3"}
+	p := newTestDownloader(t, l1, l2, l3)
+	mtime := time.Now().Add(-time.Hour)
+	writeList(t, l1, "||one.example.com^\n", mtime)
+	writeList(t, l2, "||two.example.com^\n", mtime)
+	writeList(t, l3, "||three.example.com^\n||four.example.com^\n", mtime)
+
+	reload := func() int {
+		t.Helper()
+		p.reloadAllRules(context.Background(), false)
+		events := p.reloads.snapshot()
+		return events[0].Parsed // 最新的在前
+	}
+	blocked := func(d string) bool {
+		_, b := p.decide(d, queryInfo{})
+		return b
+	}
+
+	if n := reload(); n != 3 {
+		t.Fatalf("first reload parsed %d lists, want 3", n)
+	}
+	if !blocked("one.example.com.") || !blocked("two.example.com.") || blocked("three.example.com.") {
+		t.Fatal("unexpected matchers after first reload")
+	}
+	if l3.RuleCount != 2 || p.parsed["l3"].rs != nil {
+		t.Fatalf("disabled list: count %d, cached matcher %v", l3.RuleCount, p.parsed["l3"].rs)
+	}
+	rs1 := p.parsed["l1"].rs
+
+	// 没有变化时不重新解析, 复用同一个匹配器
+	if n := reload(); n != 0 {
+		t.Fatalf("unchanged reload parsed %d lists", n)
+	}
+	if p.parsed["l1"].rs != rs1 {
+		t.Fatal("matcher of an unchanged list was rebuilt")
+	}
+
+	// 只重新解析更新的列表
+	writeList(t, l2, "||two-updated.example.com^\n", mtime.Add(time.Minute))
+	if n := reload(); n != 1 {
+		t.Fatalf("reload after update parsed %d lists, want 1", n)
+	}
+	if blocked("two.example.com.") || !blocked("two-updated.example.com.") || p.parsed["l1"].rs != rs1 {
+		t.Fatal("unexpected matchers after update")
+	}
+
+	// 新启用的列表需要解析以构建匹配器, 修改 clients 与停用列表无需解析
+	p.mu.Lock()
+	l3.Enabled = true
+	l1.Clients = []string{"kids"}
+	l2.Enabled = false
+	p.mu.Unlock()
+	if n := reload(); n != 1 {
+		t.Fatalf("reload after toggling parsed %d lists, want 1", n)
+	}
+	if !blocked("three.example.com.") || blocked("two-updated.example.com.") || blocked("one.example.com.") {
+		t.Fatal("unexpected matchers after toggling")
+	}
+	if _, b := p.decide("one.example.com.", queryInfo{clientTag: "kids"}); !b || p.parsed["l1"].rs != rs1 {
+		t.Fatal("list with clients not reused")
+	}
+
+	// 格式变化时重新解析
+	p.mu.Lock()
+	l1.Format = formatHosts
+	p.mu.Unlock()
+	if n := reload(); n != 1 {
+		t.Fatalf("reload after format change parsed %d lists, want 1", n)
+	}
+	if p.parsed["l1"].count != 0 {
+		t.Fatalf("adguard rules parsed as hosts: %d", p.parsed["l1"].count)
+	}
+
+	// 删除的列表不再缓存, 文件丢失的列表记为加载失败
+	p.mu.Lock()
+	delete(p.onlineRules, "l2")
+	p.mu.Unlock()
+	os.Remove(l3.localPath)
+	reload()
+	if _, ok := p.parsed["l2"]; ok {
+		t.Fatal("removed list is still cached")
+	}
+	if _, ok := p.parsed["l3"]; ok {
+		t.Fatal("list without file is still cached")
+	}
+	if err := p.Healthy(); err == nil {
+		t.Fatal("want unhealthy with a missing rule file")
+	}
+}
+
+func TestAdguardRule_ReloadCompact(t *testing.T) {
+	l1 := &OnlineRule{ID: "l1", Name: "List 1", Enabled: true}
+	p := newTestDownloader(t, l1)
+	p.compact = true
+	writeList(t, l1, "||ads.example.com^\n@@||ok.ads.example.com^\nfull.example.net\n", time.Now().Add(-time.Hour))
+	p.reloadAllRules(context.Background(), false)
+	tests := []struct {
+		domain  string
+		blocked bool
+	}{
+		{"ads.example.com.", true},
+		{"a.ads.example.com.", true},
+		{"ok.ads.example.com.", false},
+		{"full.example.net.", true},
+		{"sub.full.example.net.", false},
+	}
+	for _, tt := range tests {
+		if _, b := p.decide(tt.domain, queryInfo{}); b != tt.blocked {
+			t.Errorf("%s: blocked %v, want %v", tt.domain, b, tt.blocked)
+		}
+	}
+}
+
+func TestAdguardRule_BackgroundInitialLoad(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("||remote.example.com^\n"))
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	local := &OnlineRule{ID: "l1", Name: "Local", Enabled: true}
+	remote := &OnlineRule{ID: "l2", Name: "Remote", Enabled: true, URL: ts.URL}
+	p := newTestDownloader(t, local, remote)
+	writeList(t, local, "||local.example.com^\n", time.Now().Add(-time.Hour))
+
+	status := func() reloadStatus {
+		w := httptest.NewRecorder()
+		p.handleGetReloadStatus(w, httptest.NewRequest(http.MethodGet, "/reload_status", nil))
+		var st reloadStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+	if st := status(); st.Loaded {
+		t.Fatalf("loaded before the first reload: %+v", st)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.reloadAllRules(context.Background(), true)
+	}()
+	waitFor(t, func() bool { return status().Phase == reloadPhaseDownloading })
+
+	// 下载缺失列表期间, 本地已有的列表已经生效, 查询不受阻塞
+	st := status()
+	if st.State != "building" || st.Loaded || st.Started == nil || st.Lists != 2 {
+		t.Fatalf("unexpected status while downloading: %+v", st)
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, b := p.decide("local.example.com.", queryInfo{}); !b {
+					t.Error("local list is not active during the background load")
+					return
+				}
+			}
+		}()
+	}
+	if _, b := p.decide("remote.example.com.", queryInfo{}); b {
+		t.Fatal("remote list is active before it is downloaded")
+	}
+
+	release <- struct{}{}
+	<-done
+	close(stop)
+	wg.Wait()
+
+	st = status()
+	if st.State != "ready" || !st.Loaded || st.LastFinished == nil || st.Phase != "" {
+		t.Fatalf("unexpected status after reload: %+v", st)
+	}
+	if _, b := p.decide("remote.example.com.", queryInfo{}); !b {
+		t.Fatal("remote list is not active after the reload")
+	}
+	if _, b := p.decide("local.example.com.", queryInfo{}); !b {
+		t.Fatal("local list is not active after the reload")
+	}
+}
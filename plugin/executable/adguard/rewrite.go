@@ -0,0 +1,206 @@
+package adguard_rule
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+// dnsRewrite 是 $dnsrewrite 修饰符指定的改写结果
+type dnsRewrite struct {
+	empty  bool // 空值, 只用于放行规则, 表示禁用改写
+	rcode  int
+	rrtype uint16     // 0 表示应答中没有记录
+	addr   netip.Addr // A/AAAA
+	target string     // CNAME, fqdn
+}
+
+// parseDnsrewrite 解析 $dnsrewrite 的值。完整格式为 "RCODE;RRTYPE;VALUE", 如 "NOERROR;A;1.2.3.4"、
+// "NXDOMAIN;;"; 简写格式为单个 IP、域名 (CNAME) 或 RCODE, 如 "1.2.3.4"、"example.net"、"REFUSED"。
+// 记录类型支持 A、AAAA 与 CNAME。
+func parseDnsrewrite(value string) (*dnsRewrite, error) {
+	if len(value) == 0 {
+		return &dnsRewrite{empty: true}, nil
+	}
+	if !strings.Contains(value, ";") {
+		if rcode, ok := dns.StringToRcode[strings.ToUpper(value)]; ok {
+			return &dnsRewrite{rcode: rcode}, nil
+		}
+		if addr, err := netip.ParseAddr(value); err == nil {
+			if addr.Is4() {
+				return newRecordRewrite(dns.TypeA, value)
+			}
+			return newRecordRewrite(dns.TypeAAAA, value)
+		}
+		return newRecordRewrite(dns.TypeCNAME, value)
+	}
+
+	parts := strings.Split(value, ";")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid dnsrewrite %s", value)
+	}
+	rcode, ok := dns.StringToRcode[strings.ToUpper(parts[0])]
+	if !ok {
+		return nil, fmt.Errorf("invalid dnsrewrite rcode %s", parts[0])
+	}
+	if len(parts[1]) == 0 {
+		if len(parts[2]) > 0 {
+			return nil, fmt.Errorf("dnsrewrite %s has a value but no record type", value)
+		}
+		return &dnsRewrite{rcode: rcode}, nil
+	}
+	if rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("dnsrewrite %s has records with rcode %s", value, parts[0])
+	}
+	rrtype, ok := dns.StringToType[strings.ToUpper(parts[1])]
+	if !ok {
+		return nil, fmt.Errorf("invalid dnsrewrite record type %s", parts[1])
+	}
+	return newRecordRewrite(rrtype, parts[2])
+}
+
+func newRecordRewrite(rrtype uint16, value string) (*dnsRewrite, error) {
+	rw := &dnsRewrite{rcode: dns.RcodeSuccess, rrtype: rrtype}
+	switch rrtype {
+	case dns.TypeA, dns.TypeAAAA:
+		addr, err := netip.ParseAddr(value)
+		if err != nil || addr.Is4() != (rrtype == dns.TypeA) {
+			return nil, fmt.Errorf("invalid dnsrewrite %s address %s", dns.TypeToString[rrtype], value)
+		}
+		rw.addr = addr
+	case dns.TypeCNAME:
+		// dns.IsDomainName 接受空格等任意字符, 另以 fullMatchRegex 限制为主机名
+		if _, ok := dns.IsDomainName(value); !ok || !fullMatchRegex.MatchString(strings.TrimSuffix(value, ".")) {
+			return nil, fmt.Errorf("invalid dnsrewrite CNAME target %s", value)
+		}
+		rw.target = dns.Fqdn(strings.ToLower(value))
+	default:
+		return nil, fmt.Errorf("%w: dnsrewrite record type %s", errUnsupportedModifier, dns.TypeToString[rrtype])
+	}
+	return rw, nil
+}
+
+// String 返回完整格式的改写, 如 "NOERROR;A;1.2.3.4"
+func (rw *dnsRewrite) String() string {
+	var value string
+	switch rw.rrtype {
+	case dns.TypeA, dns.TypeAAAA:
+		value = rw.addr.String()
+	case dns.TypeCNAME:
+		value = rw.target
+	}
+	var rrtype string
+	if rw.rrtype != 0 {
+		rrtype = dns.TypeToString[rw.rrtype]
+	}
+	return dns.RcodeToString[rw.rcode] + ";" + rrtype + ";" + value
+}
+
+// rewrite 返回 domainStr 命中的 $dnsrewrite 改写及决定结果的规则列表 ID。
+// 用户规则优先, 其次为适用于 info 的规则列表; 任一处命中禁用改写的放行规则时不改写
+func (p *AdguardRule) rewrite(domainStr string, info queryInfo) (string, []*dnsRewrite) {
+	if !p.protection.enabled() {
+		return "", nil
+	}
+	var listID string
+	var rws []*dnsRewrite
+	for _, rs := range p.ruleSets(info) {
+		id, v, exempt := rs.rewrites(domainStr, info)
+		if exempt {
+			return "", nil
+		}
+		if len(rws) == 0 && len(v) > 0 {
+			listID, rws = id, v
+		}
+	}
+	return listID, rws
+}
+
+// execRewrite 按 rws 生成响应。非 NOERROR 的改写优先; CNAME 改写时以目标域名继续执行后续插件,
+// 再将 CNAME 记录插入应答, 与 redirect 插件相同。
+func (p *AdguardRule) execRewrite(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker, rws []*dnsRewrite) error {
+	q := qCtx.Q()
+	question := q.Question[0]
+	for _, rw := range rws {
+		if rw.rcode != dns.RcodeSuccess {
+			qCtx.SetResponse(p.rcodeResponse(q, rw.rcode))
+			return next.ExecNext(ctx, qCtx)
+		}
+	}
+
+	hdr := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: question.Name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: p.block.ttl}
+	}
+	for _, rw := range rws {
+		if rw.rrtype != dns.TypeCNAME {
+			continue
+		}
+		cname := &dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: rw.target}
+		if question.Qtype == dns.TypeCNAME {
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.Answer = []dns.RR{cname}
+			qCtx.SetResponse(r)
+			return next.ExecNext(ctx, qCtx)
+		}
+
+		q.Question[0].Name = rw.target
+		defer func() {
+			q.Question[0].Name = question.Name
+		}()
+		err := next.ExecNext(ctx, qCtx)
+		if r := qCtx.R(); r != nil {
+			for i := range r.Question {
+				if r.Question[i].Name == rw.target {
+					r.Question[i].Name = question.Name
+				}
+			}
+			r.Answer = append([]dns.RR{cname}, r.Answer...)
+		}
+		return err
+	}
+
+	var answer []dns.RR
+	for _, rw := range rws {
+		if rw.rrtype != question.Qtype {
+			continue
+		}
+		switch rw.rrtype {
+		case dns.TypeA:
+			answer = append(answer, &dns.A{Hdr: hdr(dns.TypeA), A: rw.addr.AsSlice()})
+		case dns.TypeAAAA:
+			answer = append(answer, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: rw.addr.AsSlice()})
+		}
+	}
+	r := p.rcodeResponse(q, dns.RcodeSuccess)
+	if len(answer) > 0 {
+		r = new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = answer
+	}
+	qCtx.SetResponse(r)
+	return next.ExecNext(ctx, qCtx)
+}
+
+// rcodeResponse 生成没有应答记录的响应, SOA 的 TTL 设为 block_ttl
+func (p *AdguardRule) rcodeResponse(q *dns.Msg, rcode int) *dns.Msg {
+	if rcode != dns.RcodeSuccess && rcode != dns.RcodeNameError {
+		r := new(dns.Msg)
+		r.SetRcode(q, rcode)
+		return r
+	}
+	r := dnsutils.GenEmptyReply(q, rcode)
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa.Hdr.Ttl = p.block.ttl
+			soa.Minttl = p.block.ttl
+		}
+	}
+	return r
+}
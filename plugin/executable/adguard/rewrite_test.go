@@ -0,0 +1,157 @@
+package adguard_rule
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+func TestParseDnsrewrite(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string // String() 的结果
+		empty   bool
+		wantErr bool
+	}{
+		{value: "", empty: true},
+		{value: "1.2.3.4", want: "NOERROR;A;1.2.3.4"},
+		{value: "::1", want: "NOERROR;AAAA;::1"},
+		{value: "Example.NET", want: "NOERROR;CNAME;example.net."},
+		{value: "REFUSED", want: "REFUSED;;"},
+		{value: "nxdomain", want: "NXDOMAIN;;"},
+		{value: "NOERROR;A;1.2.3.4", want: "NOERROR;A;1.2.3.4"},
+		{value: "NOERROR;aaaa;2001:db8::1", want: "NOERROR;AAAA;2001:db8::1"},
+		{value: "NOERROR;CNAME;example.net", want: "NOERROR;CNAME;example.net."},
+		{value: "NXDOMAIN;;", want: "NXDOMAIN;;"},
+		{value: "NOERROR;;", want: "NOERROR;;"},
+		{value: "NOERROR;A;::1", wantErr: true},
+		{value: "NOERROR;AAAA;1.2.3.4", wantErr: true},
+		{value: "NOERROR;A", wantErr: true},
+		{value: "BOGUS;A;1.2.3.4", wantErr: true},
+		{value: "NXDOMAIN;A;1.2.3.4", wantErr: true},
+		{value: "NOERROR;;1.2.3.4", wantErr: true},
+		{value: "NOERROR;BOGUS;x", wantErr: true},
+		{value: "NOERROR;MX;10 mail.example.com", wantErr: true},
+		{value: "not a domain!", wantErr: true},
+	}
+	for _, tt := range tests {
+		rw, err := parseDnsrewrite(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDnsrewrite(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if rw.empty != tt.empty {
+			t.Errorf("parseDnsrewrite(%q).empty = %v", tt.value, rw.empty)
+		}
+		if !tt.empty && rw.String() != tt.want {
+			t.Errorf("parseDnsrewrite(%q) = %s, want %s", tt.value, rw, tt.want)
+		}
+	}
+}
+
+// upstream 是序列中的后续插件, 对所有查询返回 A 1.1.1.1
+type upstream struct {
+	qname string // 收到的查询域名
+}
+
+func (u *upstream) Exec(_ context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	u.qname = q.Question[0].Name
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: u.qname, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: netip.MustParseAddr("1.1.1.1").AsSlice()}}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func TestAdguardRule_ExecRewrite(t *testing.T) {
+	p := newTestRule(t, "||a.example.com^$dnsrewrite=1.2.3.4\n"+
+		"||a.example.com^$dnsrewrite=NOERROR;A;5.6.7.8\n"+
+		"||a.example.com^$dnsrewrite=::1\n"+
+		"||cname.example.com^$dnsrewrite=target.example.net\n"+
+		"||nx.example.com^$dnsrewrite=NXDOMAIN;;\n"+
+		"||refused.example.com^$dnsrewrite=REFUSED\n"+
+		"||exempt.example.com^$dnsrewrite=1.2.3.4\n"+
+		"@@||exempt.example.com^$dnsrewrite\n"+
+		"||exempt.example.com^\n")
+	tests := []struct {
+		name     string
+		qname    string
+		qtype    uint16
+		rcode    int
+		answers  []string
+		upstream string // 后续插件收到的查询域名, 为空表示未执行
+	}{
+		{name: "multiple A", qname: "a.example.com.", qtype: dns.TypeA, answers: []string{"1.2.3.4", "5.6.7.8"}},
+		{name: "AAAA", qname: "sub.a.example.com.", qtype: dns.TypeAAAA, answers: []string{"::1"}},
+		{name: "other qtype", qname: "a.example.com.", qtype: dns.TypeMX},
+		{name: "cname", qname: "cname.example.com.", qtype: dns.TypeA, answers: []string{"target.example.net.", "1.1.1.1"}, upstream: "target.example.net."},
+		{name: "cname query", qname: "cname.example.com.", qtype: dns.TypeCNAME, answers: []string{"target.example.net."}},
+		{name: "nxdomain", qname: "nx.example.com.", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+		{name: "refused", qname: "refused.example.com.", qtype: dns.TypeAAAA, rcode: dns.RcodeRefused},
+		{name: "exempt falls back to block", qname: "exempt.example.com.", qtype: dns.TypeA, rcode: dns.RcodeNameError},
+		{name: "no rule", qname: "other.example.com.", qtype: dns.TypeA, answers: []string{"1.1.1.1"}, upstream: "other.example.com."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, tt.qtype)
+			qCtx := query_context.NewContext(q)
+			u := new(upstream)
+			next := sequence.NewChainWalker([]*sequence.ChainNode{{E: u}}, nil, zap.NewNop())
+			if tt.rcode != 0 || tt.upstream == "" {
+				// 改写与拦截时后续插件仍会执行, 这里让其不修改响应
+				next = sequence.NewChainWalker(nil, nil, zap.NewNop())
+			}
+			if err := p.Exec(context.Background(), qCtx, next); err != nil {
+				t.Fatal(err)
+			}
+			if u.qname != tt.upstream {
+				t.Errorf("upstream got %q, want %q", u.qname, tt.upstream)
+			}
+			r := qCtx.R()
+			if r == nil {
+				t.Fatal("no response")
+			}
+			if r.Rcode != tt.rcode {
+				t.Errorf("rcode %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if r.Question[0].Name != tt.qname {
+				t.Errorf("response question %s", r.Question[0].Name)
+			}
+			var got []string
+			for _, rr := range r.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					got = append(got, rr.A.String())
+				case *dns.AAAA:
+					got = append(got, rr.AAAA.String())
+				case *dns.CNAME:
+					if rr.Hdr.Name != tt.qname {
+						t.Errorf("CNAME owner %s", rr.Hdr.Name)
+					}
+					got = append(got, rr.Target)
+				}
+				if ttl := rr.Header().Ttl; ttl != defaultBlockTTL && ttl != 60 {
+					t.Errorf("unexpected ttl %d", ttl)
+				}
+			}
+			if len(got) != len(tt.answers) {
+				t.Fatalf("answers %v, want %v", got, tt.answers)
+			}
+			for i := range got {
+				if got[i] != tt.answers[i] {
+					t.Fatalf("answers %v, want %v", got, tt.answers)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package adguard_rule
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RPZ 动作。CNAME 指向以下名称时为策略动作, 其余记录为本地数据 (改写)
+const (
+	rpzNXDomain = "."
+	rpzNodata   = "*."
+	rpzPassthru = "rpz-passthru."
+	rpzDrop     = "rpz-drop."
+	rpzTCPOnly  = "rpz-tcp-only."
+)
+
+// rpzTriggerSuffixes 是非 QNAME 触发器的后缀, 这些规则基于应答 IP、NS 或客户端 IP, 无法转换
+var rpzTriggerSuffixes = []string{".rpz-ip", ".rpz-nsip", ".rpz-nsdname", ".rpz-client-ip"}
+
+// parseRPZ 解析 RPZ 区域文件。
+// rpz-passthru 作为放行规则; NXDOMAIN、NODATA、rpz-drop 与本地数据 (如 A 记录改写) 均作为拦截规则,
+// 由插件的拦截响应处理。"*.example.com" 只匹配 example.com 的子域名, 不匹配 example.com 本身。
+func parseRPZ(reader io.Reader, listID string, rs *ruleSet, logf func(string, ...any)) (int, error) {
+	scanner := bufio.NewScanner(reader)
+	var p rpzParser
+	count := 0
+	for scanner.Scan() {
+		rule, allow := p.parseLine(scanner.Text())
+		if len(rule) == 0 {
+			continue
+		}
+		if err := rs.add(rule, listID, allow, nil); err != nil {
+			p.skipped++
+			continue
+		}
+		count++
+	}
+	if p.skipped > 0 {
+		logf("[adguard_rule] WARN: %d unsupported rpz rules skipped in list %s", p.skipped, listID)
+	}
+	return count, scanner.Err()
+}
+
+// rpzParser 逐行解析 RPZ 区域文件, 记录解析所需的上下文
+type rpzParser struct {
+	origin   string // 区域名 (小写, 以 . 结尾), 来自 $ORIGIN, 没有时来自 SOA 记录的名称
+	inParens bool   // 处于多行记录 (如 SOA) 的括号内
+	skipped  int    // 不支持的规则数
+}
+
+// parseLine 解析一行, 返回转换后的匹配规则及是否为放行规则。不是可转换的 QNAME 触发器时 rule 为空
+func (p *rpzParser) parseLine(line string) (rule string, allow bool) {
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	// SOA 等多行记录只解析括号前的部分
+	if p.inParens {
+		if strings.Contains(line, ")") {
+			p.inParens = false
+		}
+		return "", false
+	}
+	if i := strings.IndexByte(line, '('); i >= 0 {
+		p.inParens = !strings.Contains(line[i:], ")")
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", false
+	}
+	if strings.HasPrefix(fields[0], "$") {
+		if strings.EqualFold(fields[0], "$ORIGIN") && len(fields) > 1 {
+			p.origin = strings.ToLower(dns.Fqdn(fields[1]))
+		}
+		return "", false
+	}
+	// 以空白开头的行沿用上一条记录的名称, 不会是新的触发器
+	if line[0] == ' ' || line[0] == '\t' {
+		return "", false
+	}
+
+	rrType, rdata := rpzTypeAndData(fields[1:])
+	switch rrType {
+	case "SOA":
+		// 没有 $ORIGIN 时, 绝对名称相对于 SOA 记录的名称 (区域顶点)
+		if len(p.origin) == 0 && strings.HasSuffix(fields[0], ".") {
+			p.origin = strings.ToLower(fields[0])
+		}
+		return "", false
+	case "", "NS":
+		return "", false
+	}
+	if len(rdata) == 0 {
+		return "", false
+	}
+	owner, ok := rpzOwner(fields[0], p.origin)
+	if !ok {
+		return "", false
+	}
+
+	if rrType == "CNAME" {
+		switch strings.ToLower(rdata) {
+		case rpzNXDomain, rpzNodata, rpzDrop:
+		case rpzPassthru:
+			allow = true
+		case rpzTCPOnly:
+			p.skipped++
+			return "", false
+		}
+	}
+
+	name := owner
+	rule = "full:" + owner
+	if wildcard, ok := strings.CutPrefix(owner, "*."); ok {
+		name = wildcard
+		rule = subdomainPrefix + wildcard
+	}
+	if !strings.Contains(name, ".") {
+		return "", false
+	}
+	return rule, allow
+}
+
+// rpzOwner 返回去掉区域名后的小写 QNAME 触发器。
+// 非 QNAME 触发器与区域顶点 ("@") 返回 false。
+func rpzOwner(name, origin string) (string, bool) {
+	if name == "@" {
+		return "", false
+	}
+	name = strings.ToLower(name)
+	if strings.HasSuffix(name, ".") {
+		if len(origin) > 0 {
+			var ok bool
+			if name, ok = strings.CutSuffix(name, "."+origin); !ok {
+				return "", false
+			}
+		} else {
+			name = strings.TrimSuffix(name, ".")
+		}
+	}
+	for _, suffix := range rpzTriggerSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return "", false
+		}
+	}
+	if strings.Contains(strings.TrimPrefix(name, "*."), "*") || !fullMatchRegex.MatchString(strings.TrimPrefix(name, "*.")) {
+		return "", false
+	}
+	return name, true
+}
+
+// rpzTypeAndData 跳过可选的 TTL 与 class, 返回记录类型与第一个 rdata 字段, 没有 rdata 时为空
+func rpzTypeAndData(fields []string) (string, string) {
+	for len(fields) > 0 {
+		f := strings.ToUpper(fields[0])
+		if _, err := strconv.ParseUint(f, 10, 32); err == nil || f == "IN" {
+			fields = fields[1:]
+			continue
+		}
+		if len(fields) == 1 {
+			return f, ""
+		}
+		return f, fields[1]
+	}
+	return "", ""
+}
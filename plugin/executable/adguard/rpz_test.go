@@ -0,0 +1,152 @@
+package adguard_rule
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRPZ(t *testing.T) {
+	const soa = "$TTL 300\n@ IN SOA localhost. admin.localhost. (\n 1 3600 600 86400 300 )\n  IN NS localhost.\n"
+	tests := []struct {
+		name    string
+		zone    string
+		count   int
+		blocked []string
+		allowed []string
+		none    []string // 不命中任何规则
+	}{
+		{
+			name:    "relative owners",
+			zone:    "$ORIGIN rpz.local.\n" + soa + "ads.example.com CNAME .\nnodata.example.com 300 IN CNAME *.\nlocal.example.com A 127.0.0.1\n",
+			count:   3,
+			blocked: []string{"ads.example.com.", "nodata.example.com.", "local.example.com."},
+			none:    []string{"x.ads.example.com.", "example.com.", "rpz.local."},
+		},
+		{
+			name:    "absolute owners with origin",
+			zone:    "$ORIGIN rpz.local.\nads.example.com.rpz.local. CNAME .\nads.other.zone. CNAME .\n",
+			count:   1,
+			blocked: []string{"ads.example.com."},
+			none:    []string{"ads.example.com.rpz.local.", "ads.other.zone."},
+		},
+		{
+			name:    "absolute owners with multiline soa origin",
+			zone:    "rpz.local. 300 IN SOA localhost. admin.localhost. (\n 1 3600\n 600 86400 300 )\n  NS localhost.\nads.example.com.rpz.local. CNAME .\ntracker.example.net.rpz.local. IN CNAME rpz-drop.\n",
+			count:   2,
+			blocked: []string{"ads.example.com.", "tracker.example.net."},
+			none:    []string{"rpz.local.", "localhost.", "admin.localhost."},
+		},
+		{
+			name:    "absolute owners without origin",
+			zone:    "ads.example.com. CNAME .\n",
+			count:   1,
+			blocked: []string{"ads.example.com."},
+		},
+		{
+			name:    "wildcard is subdomain only",
+			zone:    soa + "*.example.com CNAME .\n*.com CNAME .\n",
+			count:   1,
+			blocked: []string{"a.example.com.", "a.b.example.com."},
+			none:    []string{"example.com.", "other.com."},
+		},
+		{
+			name:    "wildcard with apex",
+			zone:    soa + "example.com CNAME .\n*.example.com CNAME .\n",
+			count:   2,
+			blocked: []string{"example.com.", "a.example.com."},
+		},
+		{
+			name:    "passthru",
+			zone:    soa + "ok.example.com CNAME rpz-passthru.\n*.good.example.com CNAME rpz-passthru.\n",
+			count:   2,
+			allowed: []string{"ok.example.com.", "a.good.example.com."},
+			none:    []string{"x.ok.example.com.", "good.example.com."},
+		},
+		{
+			name:    "drop and tcp-only",
+			zone:    soa + "drop.example.com CNAME rpz-drop.\ntcp.example.com CNAME rpz-tcp-only.\n",
+			count:   1,
+			blocked: []string{"drop.example.com."},
+			none:    []string{"tcp.example.com."},
+		},
+		{
+			name:  "ip, ns and client triggers",
+			zone:  soa + "32.1.0.0.127.rpz-ip CNAME .\nns.example.com.rpz-nsdname CNAME .\n32.1.0.0.127.rpz-nsip CNAME .\n32.2.0.0.10.rpz-client-ip CNAME .\n",
+			count: 0,
+			none:  []string{"ns.example.com.", "127.0.0.1.", "1.0.0.127.rpz-ip."},
+		},
+		{
+			name:    "comments and continuation lines",
+			zone:    soa + "ads.example.com CNAME . ; comment\n  A 1.2.3.4\n; x.example.com CNAME .\n",
+			count:   1,
+			blocked: []string{"ads.example.com."},
+			none:    []string{"x.example.com."},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := newRuleSet()
+			n, err := parseRPZ(strings.NewReader(tt.zone), "l1", rs, t.Logf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.count {
+				t.Errorf("want %d rules, got %d", tt.count, n)
+			}
+			for _, d := range tt.blocked {
+				if _, ok := rs.match(d, queryInfo{}, false); !ok {
+					t.Errorf("%s is not blocked", d)
+				}
+			}
+			for _, d := range tt.allowed {
+				if _, ok := rs.match(d, queryInfo{}, true); !ok {
+					t.Errorf("%s is not allowed", d)
+				}
+			}
+			for _, d := range tt.none {
+				_, blocked := rs.match(d, queryInfo{}, false)
+				_, allowed := rs.match(d, queryInfo{}, true)
+				if blocked || allowed {
+					t.Errorf("%s matches a rule", d)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRPZ_Compact(t *testing.T) {
+	rs := newRuleSet()
+	if _, err := parseRPZ(strings.NewReader("*.example.com CNAME .\n"), "l1", rs, t.Logf); err != nil {
+		t.Fatal(err)
+	}
+	rs.compact()
+	if _, ok := rs.match("a.example.com.", queryInfo{}, false); !ok {
+		t.Error("subdomain is not blocked")
+	}
+	if _, ok := rs.match("example.com.", queryInfo{}, false); ok {
+		t.Error("apex is blocked")
+	}
+}
+
+func TestFindRPZLine(t *testing.T) {
+	const zone = "rpz.local. IN SOA localhost. admin.localhost. (\n 1 3600 600 86400 300 )\n" +
+		"ads.example.com.rpz.local. CNAME .\n" +
+		"*.example.net.rpz.local. CNAME .\n" +
+		"ok.example.net.rpz.local. CNAME rpz-passthru.\n"
+	tests := []struct {
+		domain  string
+		blocked bool
+		want    string
+	}{
+		{"ads.example.com.", true, "ads.example.com.rpz.local. CNAME ."},
+		{"a.example.net.", true, "*.example.net.rpz.local. CNAME ."},
+		{"example.net.", true, ""},
+		{"ok.example.net.", false, "ok.example.net.rpz.local. CNAME rpz-passthru."},
+		{"ads.example.com.", false, ""},
+	}
+	for _, tt := range tests {
+		if got := findRuleLine(strings.NewReader(zone), formatRPZ, tt.domain, queryInfo{}, tt.blocked); got != tt.want {
+			t.Errorf("findRuleLine(%s, %v) = %q, want %q", tt.domain, tt.blocked, got, tt.want)
+		}
+	}
+}
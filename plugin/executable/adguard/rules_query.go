@@ -0,0 +1,114 @@
+package adguard_rule
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// rulesQuery 是 GET /rules 的查询参数
+type rulesQuery struct {
+	search     string // 在名称与 URL 中搜索, 不区分大小写
+	enabled    *bool
+	autoUpdate *bool
+	sortBy     string
+	desc       bool
+	offset     int
+	limit      int // 0 表示不限
+}
+
+// rulesSortKeys 是 sort 参数可选的排序字段
+var rulesSortKeys = map[string]func(a, b *OnlineRule) bool{
+	"name":         func(a, b *OnlineRule) bool { return a.Name < b.Name },
+	"id":           func(a, b *OnlineRule) bool { return a.ID < b.ID },
+	"rule_count":   func(a, b *OnlineRule) bool { return a.RuleCount < b.RuleCount },
+	"last_updated": func(a, b *OnlineRule) bool { return a.LastUpdated.Before(b.LastUpdated) },
+}
+
+// parseRulesQuery 解析 GET /rules 的查询参数: q, enabled, auto_update, sort, order, offset, limit
+func parseRulesQuery(v url.Values) (rulesQuery, error) {
+	q := rulesQuery{search: strings.ToLower(strings.TrimSpace(v.Get("q"))), sortBy: "name"}
+	for _, f := range []struct {
+		name string
+		dst  **bool
+	}{{"enabled", &q.enabled}, {"auto_update", &q.autoUpdate}} {
+		s := v.Get(f.name)
+		if s == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return q, fmt.Errorf("invalid %s %q", f.name, s)
+		}
+		*f.dst = &b
+	}
+	if s := v.Get("sort"); s != "" {
+		if _, ok := rulesSortKeys[s]; !ok {
+			return q, fmt.Errorf("invalid sort %q", s)
+		}
+		q.sortBy = s
+	}
+	switch order := v.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		q.desc = true
+	default:
+		return q, fmt.Errorf("invalid order %q", order)
+	}
+	for _, f := range []struct {
+		name string
+		dst  *int
+	}{{"offset", &q.offset}, {"limit", &q.limit}} {
+		s := v.Get(f.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("invalid %s %q", f.name, s)
+		}
+		*f.dst = n
+	}
+	return q, nil
+}
+
+// apply 过滤并排序 rules, 返回 offset/limit 指定的一页与过滤后的总数
+func (q rulesQuery) apply(rules []*OnlineRule) ([]*OnlineRule, int) {
+	matched := rules[:0]
+	for _, rule := range rules {
+		if q.enabled != nil && rule.Enabled != *q.enabled {
+			continue
+		}
+		if q.autoUpdate != nil && rule.AutoUpdate != *q.autoUpdate {
+			continue
+		}
+		if q.search != "" && !strings.Contains(strings.ToLower(rule.Name), q.search) &&
+			!strings.Contains(strings.ToLower(rule.URL), q.search) {
+			continue
+		}
+		matched = append(matched, rule)
+	}
+	less := rulesSortKeys[q.sortBy]
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if q.desc {
+			a, b = b, a
+		}
+		if less(a, b) != less(b, a) {
+			return less(a, b)
+		}
+		return matched[i].ID < matched[j].ID // 相同时按 ID 排序, 使分页稳定
+	})
+
+	total := len(matched)
+	if q.offset >= total {
+		return []*OnlineRule{}, total
+	}
+	matched = matched[q.offset:]
+	if q.limit > 0 && q.limit < len(matched) {
+		matched = matched[:q.limit]
+	}
+	return matched, total
+}
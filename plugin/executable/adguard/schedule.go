@@ -0,0 +1,97 @@
+package adguard_rule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule 是规则列表的生效时段, 如工作日 22:00-07:00。不在时段内时规则列表不生效
+type Schedule struct {
+	Days     []string `json:"days,omitempty"`      // 生效的星期: mon, tue, wed, thu, fri, sat, sun, 为空表示每天
+	Start    string   `json:"start"`               // 开始时间 HH:MM
+	End      string   `json:"end"`                 // 结束时间 HH:MM, 不晚于 start 时跨过午夜, 在次日结束
+	TimeZone string   `json:"time_zone,omitempty"` // IANA 时区, 如 Asia/Shanghai, 为空时使用本地时区
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// schedule 是解析后的 Schedule
+type schedule struct {
+	days       [7]bool
+	start, end int // 自零点起的分钟数
+	loc        *time.Location
+}
+
+// parseSchedule 解析并校验 s, s 为 nil 时返回 nil
+func parseSchedule(s *Schedule) (*schedule, error) {
+	if s == nil {
+		return nil, nil
+	}
+	sc := &schedule{loc: time.Local}
+	if len(s.Days) == 0 {
+		sc.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, d := range s.Days {
+		wd, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule day %q", d)
+		}
+		sc.days[wd] = true
+	}
+	var err error
+	if sc.start, err = parseClock(s.Start); err != nil {
+		return nil, fmt.Errorf("invalid schedule start: %w", err)
+	}
+	if sc.end, err = parseClock(s.End); err != nil {
+		return nil, fmt.Errorf("invalid schedule end: %w", err)
+	}
+	if len(s.TimeZone) > 0 {
+		if sc.loc, err = time.LoadLocation(s.TimeZone); err != nil {
+			return nil, fmt.Errorf("invalid schedule time_zone: %w", err)
+		}
+	}
+	return sc, nil
+}
+
+// parseClock 解析 HH:MM, 返回自零点起的分钟数
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// active 返回 t 是否在生效时段内。时段跨过午夜时, 次日凌晨的部分属于前一天的时段;
+// start 与 end 相同时为整天
+func (sc *schedule) active(t time.Time) bool {
+	t = t.In(sc.loc)
+	m := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	switch {
+	case sc.start < sc.end:
+		return sc.days[today] && m >= sc.start && m < sc.end
+	case sc.start == sc.end:
+		return sc.days[today]
+	default:
+		return (sc.days[today] && m >= sc.start) || (sc.days[yesterday] && m < sc.end)
+	}
+}
+
+// groupKey 返回规则列表的分组键, 生效范围与时段都相同的规则列表共用一个 ruleGroup
+func groupKey(rule *OnlineRule) string {
+	key := scopeKey(rule.Clients)
+	if s := rule.Schedule; s != nil {
+		days := append([]string(nil), s.Days...)
+		for i := range days {
+			days[i] = strings.ToLower(days[i])
+		}
+		key += fmt.Sprintf("@%s %s-%s %s", strings.Join(days, ","), s.Start, s.End, s.TimeZone)
+	}
+	return key
+}
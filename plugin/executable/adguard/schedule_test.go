@@ -0,0 +1,102 @@
+package adguard_rule
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		s       Schedule
+		wantErr bool
+	}{
+		{s: Schedule{Start: "22:00", End: "07:00"}},
+		{s: Schedule{Days: []string{"Mon", "sat"}, Start: "00:00", End: "23:59", TimeZone: "Asia/Shanghai"}},
+		{s: Schedule{Days: []string{"monday"}, Start: "22:00", End: "07:00"}, wantErr: true},
+		{s: Schedule{Start: "24:00", End: "07:00"}, wantErr: true},
+		{s: Schedule{Start: "7:00", End: "8"}, wantErr: true},
+		{s: Schedule{Start: "", End: "07:00"}, wantErr: true},
+		{s: Schedule{Start: "22:00", End: "07:00", TimeZone: "Mars/Olympus"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := parseSchedule(&tt.s); (err != nil) != tt.wantErr {
+			t.Errorf("parseSchedule(%+v) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+		}
+	}
+	if sc, err := parseSchedule(nil); sc != nil || err != nil {
+		t.Errorf("parseSchedule(nil) = %v, %v", sc, err)
+	}
+}
+
+func TestSchedule_Active(t *testing.T) {
+	// 2026-10-12 为星期一
+	at := func(day int, clock string, loc *time.Location) time.Time {
+		c, err := time.Parse("15:04", clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2026, 10, day, c.Hour(), c.Minute(), 0, 0, loc)
+	}
+	if wd := at(12, "00:00", time.UTC).Weekday(); wd != time.Monday {
+		t.Fatalf("2026-10-12 is %s", wd)
+	}
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	weekdays := []string{"mon", "tue", "wed", "thu", "fri"}
+	tests := []struct {
+		name string
+		s    Schedule
+		t    time.Time
+		want bool
+	}{
+		{"daytime inside", Schedule{Start: "09:00", End: "17:00", TimeZone: "UTC"}, at(12, "09:00", time.UTC), true},
+		{"daytime end is exclusive", Schedule{Start: "09:00", End: "17:00", TimeZone: "UTC"}, at(12, "17:00", time.UTC), false},
+		{"daytime before", Schedule{Start: "09:00", End: "17:00", TimeZone: "UTC"}, at(12, "08:59", time.UTC), false},
+		{"daytime other day", Schedule{Days: []string{"tue"}, Start: "09:00", End: "17:00", TimeZone: "UTC"}, at(12, "10:00", time.UTC), false},
+		{"whole day", Schedule{Days: []string{"mon"}, Start: "00:00", End: "00:00", TimeZone: "UTC"}, at(12, "23:59", time.UTC), true},
+		{"whole day other day", Schedule{Days: []string{"mon"}, Start: "00:00", End: "00:00", TimeZone: "UTC"}, at(13, "00:00", time.UTC), false},
+		// 工作日 22:00-07:00: 周五晚上生效到周六早上, 周日晚上不生效, 周一早上不属于周日的时段
+		{"wrap evening", Schedule{Days: weekdays, Start: "22:00", End: "07:00", TimeZone: "UTC"}, at(16, "23:30", time.UTC), true},
+		{"wrap next morning", Schedule{Days: weekdays, Start: "22:00", End: "07:00", TimeZone: "UTC"}, at(17, "06:59", time.UTC), true},
+		{"wrap next morning end", Schedule{Days: weekdays, Start: "22:00", End: "07:00", TimeZone: "UTC"}, at(17, "07:00", time.UTC), false},
+		{"wrap sunday evening", Schedule{Days: weekdays, Start: "22:00", End: "07:00", TimeZone: "UTC"}, at(18, "22:30", time.UTC), false},
+		{"wrap monday morning", Schedule{Days: weekdays, Start: "22:00", End: "07:00", TimeZone: "UTC"}, at(12, "06:00", time.UTC), false},
+		{"wrap monday evening", Schedule{Days: weekdays, Start: "22:00", End: "07:00", TimeZone: "UTC"}, at(12, "22:00", time.UTC), true},
+		{"wrap afternoon", Schedule{Start: "22:00", End: "07:00", TimeZone: "UTC"}, at(12, "12:00", time.UTC), false},
+		// 周一 14:30 UTC 为上海的周一 22:30; 周日 23:30 UTC 为上海的周一 07:30
+		{"time zone converts clock", Schedule{Days: []string{"mon"}, Start: "22:00", End: "23:00", TimeZone: "Asia/Shanghai"}, at(12, "14:30", time.UTC), true},
+		{"time zone converts day", Schedule{Days: []string{"mon"}, Start: "07:00", End: "08:00", TimeZone: "Asia/Shanghai"}, at(11, "23:30", time.UTC), true},
+		{"time zone outside", Schedule{Days: []string{"mon"}, Start: "22:00", End: "23:00", TimeZone: "Asia/Shanghai"}, at(12, "22:30", time.UTC), false},
+		{"time zone same location", Schedule{Start: "22:00", End: "07:00", TimeZone: "Asia/Shanghai"}, at(12, "01:00", shanghai), true},
+	}
+	for _, tt := range tests {
+		sc, err := parseSchedule(&tt.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sc.active(tt.t); got != tt.want {
+			t.Errorf("%s: active(%s) = %v, want %v", tt.name, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestRuleGroup_Schedule(t *testing.T) {
+	now := time.Now()
+	start := now.Add(time.Hour).Format("15:04")
+	end := now.Add(2 * time.Hour).Format("15:04")
+	if start >= end {
+		t.Skip("schedule would wrap around midnight")
+	}
+	sc, err := parseSchedule(&Schedule{Start: start, End: end})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestRule(t, "")
+	p.clientGroups = []*ruleGroup{{schedule: sc, sets: []*ruleSet{newTestRuleSet(t, "l1", "||example.com^\n")}}}
+	if _, blocked := p.decide("example.com.", queryInfo{}); blocked {
+		t.Error("list is active outside its schedule")
+	}
+}
@@ -0,0 +1,312 @@
+package adguard_rule
+
+import (
+	"encoding/json"
+	"hash/maphash"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	maxTrackedDomains = 10000 // 最多记录的被拦截域名数量, 防止内存无限增长
+	defaultTopN       = 20
+	statShards        = 16 // 被拦截域名统计的分片数, 减少锁竞争
+)
+
+// ruleStats 记录规则命中统计。记录在 DNS 查询路径上进行, 计数均为原子操作,
+// 只有被拦截域名的统计按域名分片加锁
+type ruleStats struct {
+	cur atomic.Pointer[statCounters] // reset 时整体替换
+
+	// prometheus 指标, 不随 reset 清零
+	queryTotal   prometheus.Counter
+	blockedTotal prometheus.Counter
+	allowedTotal prometheus.Counter
+}
+
+// statCounters 是自 since 起的统计
+type statCounters struct {
+	since      time.Time
+	total      atomic.Uint64 // 匹配查询总数
+	blocked    atomic.Uint64 // 被拦截的查询数
+	allowed    atomic.Uint64 // 命中白名单的查询数
+	listHits   sync.Map      // 规则列表 ID -> *atomic.Uint64
+	byQType    sync.Map      // 查询类型 -> *breakdownCounter
+	byProtocol sync.Map      // 传输协议 -> *breakdownCounter
+	domains    [statShards]domainShard
+}
+
+type breakdownCounter struct {
+	queries, blocked, allowed atomic.Uint64
+}
+
+// domainShard 以 Space-Saving 算法记录被拦截次数最多的域名: 记录已满时替换计数最小的域名,
+// 新域名的计数从被替换域名的计数加一开始。计数可能偏大, 但次数足够多的域名不会被替换,
+// 也不会因为启动后最先出现而一直占据记录
+type domainShard struct {
+	mu   sync.Mutex
+	hits map[string]uint64
+}
+
+var domainShardSeed = maphash.MakeSeed()
+
+func (d *domainShard) add(domainStr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.hits == nil {
+		d.hits = make(map[string]uint64)
+	}
+	if _, ok := d.hits[domainStr]; ok || len(d.hits) < maxTrackedDomains/statShards {
+		d.hits[domainStr]++
+		return
+	}
+	var minDomain string
+	var minCount uint64
+	for k, c := range d.hits {
+		if len(minDomain) == 0 || c < minCount {
+			minDomain, minCount = k, c
+		}
+	}
+	delete(d.hits, minDomain)
+	d.hits[domainStr] = minCount + 1
+}
+
+// loadOrNew 返回 m 中 k 对应的值, 不存在时存入新值
+func loadOrNew[T any](m *sync.Map, k string) *T {
+	if v, ok := m.Load(k); ok {
+		return v.(*T)
+	}
+	v, _ := m.LoadOrStore(k, new(T))
+	return v.(*T)
+}
+
+func newRuleStats(tag string) *ruleStats {
+	lb := map[string]string{"tag": tag}
+	s := &ruleStats{
+		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "query_total",
+			Help:        "The total number of domains matched against the rules",
+			ConstLabels: lb,
+		}),
+		blockedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "blocked_total",
+			Help:        "The total number of blocked domains",
+			ConstLabels: lb,
+		}),
+		allowedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "allowed_total",
+			Help:        "The total number of domains that hit the allow rules",
+			ConstLabels: lb,
+		}),
+	}
+	s.reset()
+	return s
+}
+
+func (s *ruleStats) regMetricsTo(r prometheus.Registerer) error {
+	for _, c := range [...]prometheus.Collector{s.queryTotal, s.blockedTotal, s.allowedTotal} {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryInfo 是查询的类型、传输协议与客户端, 作为域名匹配器使用时只有查询类型可能已知
+type queryInfo struct {
+	qtype     uint16
+	protocol  string // server.Protocol*
+	client    netip.Addr
+	clientTag string
+}
+
+const unknownKey = "unknown"
+
+func (i queryInfo) qtypeKey() string {
+	if i.qtype == 0 {
+		return unknownKey
+	}
+	if s, ok := dns.TypeToString[i.qtype]; ok {
+		return s
+	}
+	return "TYPE" + strconv.Itoa(int(i.qtype))
+}
+
+func (i queryInfo) protocolKey() string {
+	if len(i.protocol) == 0 {
+		return unknownKey
+	}
+	return i.protocol
+}
+
+// breakdown 返回 info 对应的分类统计
+func (c *statCounters) breakdown(info queryInfo) (byQType, byProtocol *breakdownCounter) {
+	return loadOrNew[breakdownCounter](&c.byQType, info.qtypeKey()), loadOrNew[breakdownCounter](&c.byProtocol, info.protocolKey())
+}
+
+func (s *ruleStats) recordQuery(info queryInfo) {
+	s.queryTotal.Inc()
+	c := s.cur.Load()
+	c.total.Add(1)
+	t, p := c.breakdown(info)
+	t.queries.Add(1)
+	p.queries.Add(1)
+}
+
+func (s *ruleStats) reset() {
+	s.cur.Store(&statCounters{since: time.Now()})
+}
+
+func (s *ruleStats) recordAllow(listID string, info queryInfo) {
+	s.allowedTotal.Inc()
+	c := s.cur.Load()
+	c.allowed.Add(1)
+	loadOrNew[atomic.Uint64](&c.listHits, listID).Add(1)
+	t, p := c.breakdown(info)
+	t.allowed.Add(1)
+	p.allowed.Add(1)
+}
+
+func (s *ruleStats) recordBlock(listID, domainStr string, info queryInfo) {
+	s.blockedTotal.Inc()
+	c := s.cur.Load()
+	c.blocked.Add(1)
+	loadOrNew[atomic.Uint64](&c.listHits, listID).Add(1)
+	t, p := c.breakdown(info)
+	t.blocked.Add(1)
+	p.blocked.Add(1)
+	domainStr = strings.TrimSuffix(domainStr, ".")
+	c.domains[maphash.String(domainShardSeed, domainStr)%statShards].add(domainStr)
+}
+
+type listStat struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Hits uint64 `json:"hits"`
+}
+
+type domainStat struct {
+	Domain string `json:"domain"`
+	Count  uint64 `json:"count"`
+}
+
+// breakdownStat 是按查询类型或传输协议分类的统计
+type breakdownStat struct {
+	Queries uint64 `json:"queries"`
+	Blocked uint64 `json:"blocked"`
+	Allowed uint64 `json:"allowed"`
+}
+
+type statsResponse struct {
+	Since        time.Time    `json:"since"`
+	TotalQueries uint64       `json:"total_queries"`
+	Blocked      uint64       `json:"blocked"`
+	Allowed      uint64       `json:"allowed"`
+	Lists        []listStat   `json:"lists"`
+	TopBlocked   []domainStat `json:"top_blocked"`
+
+	// 按查询类型 (A, AAAA, HTTPS...) 与传输协议 (udp, tcp, tls, https, quic...) 分类
+	ByQType    map[string]breakdownStat `json:"by_qtype"`
+	ByProtocol map[string]breakdownStat `json:"by_protocol"`
+}
+
+// snapshot 生成统计快照, names 用于将列表 ID 转换为名称
+func (s *ruleStats) snapshot(names map[string]string, topN int) statsResponse {
+	c := s.cur.Load()
+	resp := statsResponse{
+		Since:        c.since,
+		TotalQueries: c.total.Load(),
+		Blocked:      c.blocked.Load(),
+		Allowed:      c.allowed.Load(),
+		Lists:        make([]listStat, 0, len(names)),
+		ByQType:      make(map[string]breakdownStat),
+		ByProtocol:   make(map[string]breakdownStat),
+	}
+	for m, out := range map[*sync.Map]map[string]breakdownStat{&c.byQType: resp.ByQType, &c.byProtocol: resp.ByProtocol} {
+		m.Range(func(k, v any) bool {
+			b := v.(*breakdownCounter)
+			out[k.(string)] = breakdownStat{Queries: b.queries.Load(), Blocked: b.blocked.Load(), Allowed: b.allowed.Load()}
+			return true
+		})
+	}
+	hit := make(map[string]bool)
+	c.listHits.Range(func(k, v any) bool {
+		id := k.(string)
+		hit[id] = true
+		resp.Lists = append(resp.Lists, listStat{ID: id, Name: names[id], Hits: v.(*atomic.Uint64).Load()})
+		return true
+	})
+	// 没有命中的列表也一并返回, 便于判断哪些列表没有作用
+	for id, name := range names {
+		if !hit[id] {
+			resp.Lists = append(resp.Lists, listStat{ID: id, Name: name})
+		}
+	}
+	for i := range c.domains {
+		d := &c.domains[i]
+		d.mu.Lock()
+		for k, n := range d.hits {
+			resp.TopBlocked = append(resp.TopBlocked, domainStat{Domain: k, Count: n})
+		}
+		d.mu.Unlock()
+	}
+	if resp.TopBlocked == nil {
+		resp.TopBlocked = []domainStat{}
+	}
+
+	sort.Slice(resp.Lists, func(i, j int) bool {
+		if resp.Lists[i].Hits != resp.Lists[j].Hits {
+			return resp.Lists[i].Hits > resp.Lists[j].Hits
+		}
+		return resp.Lists[i].Name < resp.Lists[j].Name
+	})
+	sort.Slice(resp.TopBlocked, func(i, j int) bool {
+		if resp.TopBlocked[i].Count != resp.TopBlocked[j].Count {
+			return resp.TopBlocked[i].Count > resp.TopBlocked[j].Count
+		}
+		return resp.TopBlocked[i].Domain < resp.TopBlocked[j].Domain
+	})
+	if len(resp.TopBlocked) > topN {
+		resp.TopBlocked = resp.TopBlocked[:topN]
+	}
+	return resp
+}
+
+// handleGetStats 处理 GET /stats, 可选参数 top 指定返回的被拦截域名数量
+func (p *AdguardRule) handleGetStats(w http.ResponseWriter, r *http.Request) {
+	topN := defaultTopN
+	if s := r.URL.Query().Get("top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			jsonError(w, "top must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		topN = n
+	}
+
+	p.mu.RLock()
+	names := make(map[string]string, len(p.onlineRules))
+	for id, rule := range p.onlineRules {
+		names[id] = rule.Name
+	}
+	p.mu.RUnlock()
+	names[userRulesID] = "User rules"
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.stats.snapshot(names, topN))
+}
+
+// handleResetStats 处理 DELETE /stats, 清空统计数据
+func (p *AdguardRule) handleResetStats(w http.ResponseWriter, r *http.Request) {
+	p.stats.reset()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,155 @@
+package adguard_rule
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newTestRule 返回以 rules 为用户规则的插件
+func newTestRule(t *testing.T, rules string) *AdguardRule {
+	t.Helper()
+	u := newUserRules(nil)
+	u.set(rules)
+	hs, err := newHooks("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := newBlockResponder(&Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &AdguardRule{
+		block:       block,
+		hooks:       hs,
+		userRules:   u,
+		onlineRules: make(map[string]*OnlineRule),
+		stats:       newRuleStats("test"),
+	}
+}
+
+func TestRuleStats_Record(t *testing.T) {
+	s := newRuleStats("test")
+	a := queryInfo{qtype: dns.TypeA, protocol: "udp"}
+	s.recordQuery(a)
+	s.recordBlock("l1", "ads.example.com.", a)
+	s.recordQuery(a)
+	s.recordBlock("l1", "ads.example.com.", a)
+	s.recordQuery(queryInfo{})
+	s.recordAllow("l2", queryInfo{})
+
+	r := s.snapshot(map[string]string{"l1": "List 1", "l2": "List 2", "l3": "List 3"}, 10)
+	if r.TotalQueries != 3 || r.Blocked != 2 || r.Allowed != 1 {
+		t.Fatalf("unexpected counts %+v", r)
+	}
+	if len(r.Lists) != 3 || r.Lists[0] != (listStat{ID: "l1", Name: "List 1", Hits: 2}) ||
+		r.Lists[1] != (listStat{ID: "l2", Name: "List 2", Hits: 1}) || r.Lists[2] != (listStat{ID: "l3", Name: "List 3"}) {
+		t.Fatalf("unexpected lists %+v", r.Lists)
+	}
+	if len(r.TopBlocked) != 1 || r.TopBlocked[0] != (domainStat{Domain: "ads.example.com", Count: 2}) {
+		t.Fatalf("unexpected top blocked %+v", r.TopBlocked)
+	}
+	if r.ByQType["A"] != (breakdownStat{Queries: 2, Blocked: 2}) || r.ByQType[unknownKey] != (breakdownStat{Queries: 1, Allowed: 1}) {
+		t.Fatalf("unexpected by_qtype %+v", r.ByQType)
+	}
+	if r.ByProtocol["udp"] != (breakdownStat{Queries: 2, Blocked: 2}) {
+		t.Fatalf("unexpected by_protocol %+v", r.ByProtocol)
+	}
+
+	s.reset()
+	r = s.snapshot(nil, 10)
+	if r.TotalQueries != 0 || len(r.Lists) != 0 || len(r.TopBlocked) != 0 || len(r.ByQType) != 0 {
+		t.Fatalf("stats not reset %+v", r)
+	}
+}
+
+func TestRuleStats_Concurrent(t *testing.T) {
+	s := newRuleStats("test")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				s.recordQuery(queryInfo{})
+				s.recordBlock(fmt.Sprintf("l%d", j%4), fmt.Sprintf("d%d.example.", j%50), queryInfo{})
+			}
+		}(i)
+	}
+	wg.Wait()
+	r := s.snapshot(nil, 100)
+	if r.TotalQueries != 8000 || r.Blocked != 8000 {
+		t.Fatalf("unexpected counts %+v", r)
+	}
+	var hits uint64
+	for _, l := range r.Lists {
+		hits += l.Hits
+	}
+	if hits != 8000 || len(r.TopBlocked) != 50 || r.TopBlocked[0].Count != 160 {
+		t.Fatalf("unexpected lists %+v, top %+v", r.Lists, r.TopBlocked)
+	}
+}
+
+func TestDomainShard_Evict(t *testing.T) {
+	var d domainShard
+	const limit = maxTrackedDomains / statShards
+	for i := 0; i < 5; i++ {
+		d.add("hot.example")
+	}
+	// 大量只出现一次的域名不会挤掉次数多的域名, 记录数也不会超过上限
+	for i := 0; i < limit*3; i++ {
+		d.add(fmt.Sprintf("d%d.example", i))
+	}
+	if len(d.hits) != limit {
+		t.Fatalf("want %d tracked domains, got %d", limit, len(d.hits))
+	}
+	if d.hits["hot.example"] != 5 {
+		t.Fatalf("hot domain count %d", d.hits["hot.example"])
+	}
+	// 后出现但次数更多的域名会进入记录
+	for i := 0; i < 10; i++ {
+		d.add("late.example")
+	}
+	if d.hits["late.example"] < 10 {
+		t.Fatalf("late domain count %d", d.hits["late.example"])
+	}
+}
+
+func TestAdguardRule_MatchStats(t *testing.T) {
+	p := newTestRule(t, "||ads.example.com^\n@@||ok.ads.example.com^\n")
+	// Match 供 API 等调用, 不计入统计
+	if _, ok := p.Match("ads.example.com."); !ok {
+		t.Fatal("want blocked")
+	}
+	if r := p.stats.snapshot(nil, 10); r.TotalQueries != 0 || r.Blocked != 0 {
+		t.Fatalf("Match is counted: %+v", r)
+	}
+	// MatchQtype 是 qname 匹配器对每个查询的调用, 计入统计
+	if _, ok := p.MatchQtype("x.ads.example.com.", dns.TypeA); !ok {
+		t.Fatal("want blocked")
+	}
+	r := p.stats.snapshot(nil, 10)
+	if r.TotalQueries != 1 || r.Blocked != 1 || len(r.TopBlocked) != 1 || r.TopBlocked[0].Domain != "x.ads.example.com" {
+		t.Fatalf("MatchQtype is not counted: %+v", r)
+	}
+	p.stats.reset()
+
+	if _, blocked := p.match("ads.example.com.", queryInfo{qtype: dns.TypeA}); !blocked {
+		t.Fatal("want blocked")
+	}
+	if _, blocked := p.match("ok.ads.example.com.", queryInfo{qtype: dns.TypeA}); blocked {
+		t.Fatal("want allowed")
+	}
+	p.match("other.example.", queryInfo{qtype: dns.TypeA})
+	if r := p.stats.snapshot(nil, 10); r.TotalQueries != 3 || r.Blocked != 1 || r.Allowed != 1 {
+		t.Fatalf("unexpected counts %+v", r)
+	}
+
+	p.protection.pause(0)
+	defer p.protection.resume()
+	if _, ok := p.Match("ads.example.com."); ok {
+		t.Fatal("want not blocked while paused")
+	}
+}
@@ -0,0 +1,146 @@
+package adguard_rule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/storage"
+)
+
+// userRulesID 是用户自定义规则在统计中使用的列表 ID
+const userRulesID = "user"
+
+// userRules 保存用户通过 API 编辑的自定义规则, 语法与 Adguard 规则列表相同
+type userRules struct {
+	store  storage.Storage
+	editMu sync.Mutex // 串行化 API 的修改操作
+
+	mu    sync.RWMutex
+	text  string
+	count int
+	rules *ruleSet
+}
+
+func newUserRules(store storage.Storage) *userRules {
+	return &userRules{
+		store: store,
+		rules: newRuleSet(),
+	}
+}
+
+// load 从存储加载用户规则, 不存在时视为空规则
+func (u *userRules) load() error {
+	b, err := u.store.Get(context.Background(), userRulesFile)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	count := u.set(string(b))
+	log.Printf("[adguard_rule] loaded %d user rules", count)
+	return nil
+}
+
+// set 解析规则文本并替换当前的用户规则, 返回有效规则数
+func (u *userRules) set(text string) int {
+	rules := newRuleSet()
+	count, _ := parseRules(strings.NewReader(text), formatAuto, userRulesID, rules)
+	rules.finish()
+
+	u.mu.Lock()
+	u.text = text
+	u.count = count
+	u.rules = rules
+	u.mu.Unlock()
+	return count
+}
+
+// save 将规则文本原子写入存储
+func (u *userRules) save(text string) error {
+	if err := u.store.Put(context.Background(), userRulesFile, []byte(text)); err != nil {
+		return fmt.Errorf("failed to save user rules: %w", err)
+	}
+	return nil
+}
+
+// ruleSet 返回当前用户规则的匹配器
+func (u *userRules) ruleSet() *ruleSet {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.rules
+}
+
+func (u *userRules) get() (string, int) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.text, u.count
+}
+
+// userRulesPayload 是 /user_rules 接口的请求与响应格式
+type userRulesPayload struct {
+	Rules     string `json:"rules"`
+	RuleCount int    `json:"rule_count"`
+}
+
+func (p *AdguardRule) writeUserRules(w http.ResponseWriter) {
+	text, count := p.userRules.get()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userRulesPayload{Rules: text, RuleCount: count})
+}
+
+// updateUserRules 保存并立即生效新的用户规则, 无需重新加载在线规则
+func (p *AdguardRule) updateUserRules(w http.ResponseWriter, text string) {
+	if err := p.userRules.save(text); err != nil {
+		log.Printf("[adguard_rule] ERROR: failed to save user rules: %v", err)
+		jsonError(w, "Failed to save user rules", http.StatusInternalServerError)
+		return
+	}
+	count := p.userRules.set(text)
+	log.Printf("[adguard_rule] user rules updated, %d rules active", count)
+	p.writeUserRules(w)
+}
+
+// handleGetUserRules 处理 GET /user_rules
+func (p *AdguardRule) handleGetUserRules(w http.ResponseWriter, r *http.Request) {
+	p.writeUserRules(w)
+}
+
+// handleReplaceUserRules 处理 PUT /user_rules, 使用请求中的规则替换全部用户规则
+func (p *AdguardRule) handleReplaceUserRules(w http.ResponseWriter, r *http.Request) {
+	var req userRulesPayload
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	p.userRules.editMu.Lock()
+	defer p.userRules.editMu.Unlock()
+	p.updateUserRules(w, req.Rules)
+}
+
+// handleAppendUserRules 处理 POST /user_rules, 将请求中的规则追加到现有用户规则之后
+func (p *AdguardRule) handleAppendUserRules(w http.ResponseWriter, r *http.Request) {
+	var req userRulesPayload
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Rules) == "" {
+		jsonError(w, "Rules are required", http.StatusBadRequest)
+		return
+	}
+
+	p.userRules.editMu.Lock()
+	defer p.userRules.editMu.Unlock()
+	text, _ := p.userRules.get()
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	p.updateUserRules(w, text+req.Rules)
+}
@@ -0,0 +1,104 @@
+package adguard_rule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/storage"
+)
+
+// failingStore 的写入总是失败
+type failingStore struct{ storage.Storage }
+
+func (failingStore) Put(context.Context, string, []byte) error { return errors.New("disk full") }
+
+func TestUserRules_LoadSave(t *testing.T) {
+	store, err := storage.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := newUserRules(store)
+	if err := u.load(); err != nil {
+		t.Fatalf("load without saved rules: %v", err)
+	}
+	if text, count := u.get(); text != "" || count != 0 {
+		t.Fatalf("want empty rules, got %q, %d", text, count)
+	}
+
+	const text = "||ads.example.com^\n@@||ok.ads.example.com^\n0.0.0.0 hosts.example.com\n! comment\ninvalid rule$bogus\n"
+	if err := u.save(text); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newUserRules(store)
+	if err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got, count := loaded.get(); got != text || count != 3 {
+		t.Fatalf("loaded %q, %d rules", got, count)
+	}
+	rs := loaded.ruleSet()
+	if listID, ok := rs.match("ads.example.com.", queryInfo{}, false); !ok || listID != userRulesID {
+		t.Fatalf("match = %q, %v", listID, ok)
+	}
+	if _, ok := rs.match("ok.ads.example.com.", queryInfo{}, true); !ok {
+		t.Fatal("allow rule not loaded")
+	}
+	if rs.seen != nil {
+		t.Fatal("dedup state not released")
+	}
+}
+
+func TestUserRules_API(t *testing.T) {
+	store, err := storage.NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &AdguardRule{userRules: newUserRules(store)}
+	do := func(h http.HandlerFunc, method, body string) (int, userRulesPayload) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(method, "/user_rules", strings.NewReader(body)))
+		var resp userRulesPayload
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, resp
+	}
+
+	if code, resp := do(p.handleReplaceUserRules, http.MethodPut, `{"rules": "||a.example.com^"}`); code != http.StatusOK || resp.RuleCount != 1 {
+		t.Fatalf("replace: %d %+v", code, resp)
+	}
+	if code, resp := do(p.handleAppendUserRules, http.MethodPost, `{"rules": "||b.example.com^\n"}`); code != http.StatusOK ||
+		resp.RuleCount != 2 || resp.Rules != "||a.example.com^\n||b.example.com^\n" {
+		t.Fatalf("append: %d %+v", code, resp)
+	}
+	if code, _ := do(p.handleAppendUserRules, http.MethodPost, `{"rules": "  "}`); code != http.StatusBadRequest {
+		t.Fatalf("append empty: %d", code)
+	}
+	if code, _ := do(p.handleReplaceUserRules, http.MethodPut, `not json`); code != http.StatusBadRequest {
+		t.Fatalf("replace invalid body: %d", code)
+	}
+	if code, resp := do(p.handleGetUserRules, http.MethodGet, ""); code != http.StatusOK || resp.RuleCount != 2 {
+		t.Fatalf("get: %d %+v", code, resp)
+	}
+	b, err := store.Get(context.Background(), userRulesFile)
+	if err != nil || string(b) != "||a.example.com^\n||b.example.com^\n" {
+		t.Fatalf("saved %q, %v", b, err)
+	}
+
+	// 保存失败时不替换当前规则
+	p.userRules.store = failingStore{store}
+	if code, _ := do(p.handleReplaceUserRules, http.MethodPut, `{"rules": ""}`); code != http.StatusInternalServerError {
+		t.Fatalf("replace with failing store: %d", code)
+	}
+	if _, ok := p.userRules.ruleSet().match("a.example.com.", queryInfo{}, false); !ok {
+		t.Fatal("rules replaced although saving failed")
+	}
+}
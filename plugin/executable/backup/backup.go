@@ -0,0 +1,354 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/klauspost/compress/gzip"
+	"github.com/robfig/cron/v3"
+	"go.uber.org/zap"
+)
+
+const PluginType = "backup"
+
+const (
+	snapshotTimeLayout = "20060102-150405"
+	snapshotSuffix     = ".tar.gz"
+	uploadTimeout      = time.Minute * 5
+)
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+type Args struct {
+	// Schedule is a cron spec, e.g. "0 4 * * *". Empty means snapshots
+	// are only taken via api.
+	Schedule string `yaml:"schedule"`
+	// Paths are files and directories to be archived, e.g. the config
+	// file and the adguard_rule directory. Required.
+	Paths []string `yaml:"paths"`
+	// Keep is the number of snapshots to keep on the remote storage.
+	// Older snapshots will be deleted. Default is 7. -1 keeps all snapshots.
+	Keep int `yaml:"keep"`
+	// Prefix is the snapshot file name prefix. Default is "mosdns-backup-".
+	Prefix string `yaml:"prefix"`
+
+	// Remote storage. Exactly one of them must be configured.
+	// SFTP is not supported, serve the directory over WebDAV instead.
+	WebDAV *WebDAVConfig `yaml:"webdav"`
+	S3     *S3Config     `yaml:"s3"`
+}
+
+func (a *Args) init() {
+	utils.SetDefaultNum(&a.Keep, 7)
+	utils.SetDefaultString(&a.Prefix, "mosdns-backup-")
+}
+
+// remote is a remote storage that keeps snapshots in a flat namespace.
+type remote interface {
+	Put(ctx context.Context, name string, b []byte) error
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, name string) error
+}
+
+type snapshotStatus struct {
+	Name     string    `json:"name,omitempty"`
+	Time     time.Time `json:"time"`
+	Size     int       `json:"size,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Duration string    `json:"duration"`
+}
+
+type Backup struct {
+	args      Args
+	logger    *zap.Logger
+	remote    remote
+	scheduler *cron.Cron
+
+	runMu sync.Mutex // serializes snapshots
+
+	mu   sync.Mutex
+	last *snapshotStatus
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	b, err := NewBackup(*args.(*Args), bp.L())
+	if err != nil {
+		return nil, err
+	}
+	bp.RegAPI(b.Api())
+	return b, nil
+}
+
+func NewBackup(args Args, logger *zap.Logger) (*Backup, error) {
+	args.init()
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	if len(args.Paths) == 0 {
+		return nil, errors.New("no path to backup")
+	}
+
+	var r remote
+	var err error
+	switch {
+	case args.WebDAV != nil && args.S3 != nil:
+		return nil, errors.New("only one remote storage can be configured")
+	case args.WebDAV != nil:
+		r, err = newWebDAV(*args.WebDAV)
+	case args.S3 != nil:
+		r, err = newS3(*args.S3)
+	default:
+		return nil, errors.New("no remote storage is configured")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Backup{
+		args:      args,
+		logger:    logger,
+		remote:    r,
+		scheduler: cron.New(),
+	}
+	if len(args.Schedule) > 0 {
+		if _, err := b.scheduler.AddFunc(args.Schedule, func() {
+			if _, err := b.Snapshot(context.Background()); err != nil {
+				b.logger.Error("scheduled snapshot failed", zap.Error(err))
+			}
+		}); err != nil {
+			return nil, fmt.Errorf("invalid schedule, %w", err)
+		}
+		b.scheduler.Start()
+	}
+	return b, nil
+}
+
+// Snapshot archives args.Paths, uploads it and then deletes outdated snapshots.
+// It returns the name of the new snapshot.
+func (b *Backup) Snapshot(ctx context.Context) (string, error) {
+	b.runMu.Lock()
+	defer b.runMu.Unlock()
+
+	start := time.Now()
+	status := &snapshotStatus{Time: start}
+	defer func() {
+		status.Duration = time.Since(start).Round(time.Millisecond).String()
+		b.mu.Lock()
+		b.last = status
+		b.mu.Unlock()
+	}()
+
+	name, size, err := b.snapshot(ctx, start)
+	if err != nil {
+		status.Error = err.Error()
+		return "", err
+	}
+	status.Name, status.Size = name, size
+	b.logger.Info("snapshot uploaded", zap.String("name", name), zap.Int("size", size))
+
+	if err := b.purge(ctx); err != nil {
+		// Not fatal, the snapshot was uploaded.
+		b.logger.Warn("failed to delete outdated snapshots", zap.Error(err))
+	}
+	return name, nil
+}
+
+func (b *Backup) snapshot(ctx context.Context, now time.Time) (string, int, error) {
+	buf := new(bytes.Buffer)
+	if err := writeArchive(buf, b.args.Paths); err != nil {
+		return "", 0, fmt.Errorf("failed to create archive, %w", err)
+	}
+	name := b.args.Prefix + now.UTC().Format(snapshotTimeLayout) + snapshotSuffix
+	ctx, cancel := context.WithTimeout(ctx, uploadTimeout)
+	defer cancel()
+	if err := b.remote.Put(ctx, name, buf.Bytes()); err != nil {
+		return "", 0, fmt.Errorf("failed to upload snapshot, %w", err)
+	}
+	return name, buf.Len(), nil
+}
+
+// purge deletes snapshots exceeding args.Keep.
+func (b *Backup) purge(ctx context.Context) error {
+	if b.args.Keep < 0 {
+		return nil
+	}
+	names, err := b.snapshots(ctx)
+	if err != nil {
+		return err
+	}
+	if len(names) <= b.args.Keep {
+		return nil
+	}
+	for _, name := range names[:len(names)-b.args.Keep] {
+		if err := b.remote.Delete(ctx, name); err != nil {
+			return fmt.Errorf("failed to delete %s, %w", name, err)
+		}
+		b.logger.Info("outdated snapshot deleted", zap.String("name", name))
+	}
+	return nil
+}
+
+// snapshots returns the snapshot names on the remote, oldest first.
+func (b *Backup) snapshots(ctx context.Context) ([]string, error) {
+	all, err := b.remote.List(ctx, b.args.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots, %w", err)
+	}
+	var names []string
+	for _, name := range all {
+		if strings.HasPrefix(name, b.args.Prefix) && strings.HasSuffix(name, snapshotSuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names) // Names contain timestamps.
+	return names, nil
+}
+
+func (b *Backup) Close() error {
+	<-b.scheduler.Stop().Done()
+	return nil
+}
+
+// writeArchive writes a tar.gz archive of paths to w.
+func writeArchive(w io.Writer, paths []string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() && !d.IsDir() {
+				return nil // Skip symlinks, sockets etc.
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			hdr, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name, err = archiveName(path)
+			if err != nil {
+				return err
+			}
+			if len(hdr.Name) == 0 {
+				return nil // The file system root itself.
+			}
+			if d.IsDir() {
+				hdr.Name += "/"
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// archiveName returns the name of path in an archive: its absolute path
+// without the volume name and the leading slash, e.g. "etc/mosdns/config.yaml".
+// Names never contain "..", so archives can be extracted safely and the
+// names do not depend on the working directory.
+func archiveName(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	abs = strings.TrimPrefix(abs, filepath.VolumeName(abs))
+	return strings.TrimLeft(filepath.ToSlash(abs), "/"), nil
+}
+
+func (b *Backup) Api() *chi.Mux {
+	r := chi.NewRouter()
+
+	// POST /snapshot takes a snapshot now.
+	r.Post("/snapshot", func(w http.ResponseWriter, req *http.Request) {
+		name, err := b.Snapshot(req.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"name": name})
+	})
+
+	// GET /snapshots lists snapshots on the remote storage.
+	r.Get("/snapshots", func(w http.ResponseWriter, req *http.Request) {
+		names, err := b.snapshots(req.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if names == nil {
+			names = []string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(names)
+	})
+
+	// GET /status returns the result of the last snapshot.
+	r.Get("/status", func(w http.ResponseWriter, req *http.Request) {
+		b.mu.Lock()
+		last := b.last
+		b.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"schedule": b.args.Schedule, "last": last})
+	})
+
+	return r
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/klauspost/compress/gzip"
+)
+
+// fakeWebDAV is a minimal in-memory webdav server.
+type fakeWebDAV struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (f *fakeWebDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := path.Base(r.URL.Path)
+	switch r.Method {
+	case http.MethodPut:
+		b, _ := io.ReadAll(r.Body)
+		f.files[name] = b
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		delete(f.files, name)
+		w.WriteHeader(http.StatusNoContent)
+	case "PROPFIND":
+		w.WriteHeader(http.StatusMultiStatus)
+		fmt.Fprint(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:"><d:response><d:href>/dav/</d:href></d:response>`)
+		for name := range f.files {
+			fmt.Fprintf(w, `<d:response><d:href>/dav/%s</d:href></d:response>`, name)
+		}
+		fmt.Fprint(w, `</d:multistatus>`)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func Test_Backup_Snapshot(t *testing.T) {
+	dav := &fakeWebDAV{files: make(map[string][]byte)}
+	srv := httptest.NewServer(dav)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte("log: {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBackup(Args{
+		Paths:  []string{dir},
+		Keep:   2,
+		WebDAV: &WebDAVConfig{URL: srv.URL + "/dav"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// Old snapshots and an unrelated file.
+	for _, name := range []string{"mosdns-backup-20200101-000000.tar.gz", "mosdns-backup-20200102-000000.tar.gz", "other.txt"} {
+		dav.files[name] = []byte{}
+	}
+
+	name, err := b.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(name, "mosdns-backup-"+time.Now().UTC().Format("20060102")) {
+		t.Fatalf("unexpected snapshot name %s", name)
+	}
+	if len(dav.files[name]) == 0 {
+		t.Fatal("snapshot was not uploaded")
+	}
+
+	var got []string
+	for name := range dav.files {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+	want := []string{"mosdns-backup-20200102-000000.tar.gz", name, "other.txt"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("remote files = %v, want %v", got, want)
+	}
+}
+
+func Test_writeArchive_names(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []string{"data/a.txt", "data/sub/b.txt", "work/c.txt"} {
+		p = filepath.Join(dir, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(filepath.Join(dir, "work"))
+
+	var buf bytes.Buffer
+	if err := writeArchive(&buf, []string{"../data", "./../work/c.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	gr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	var got []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(hdr.Name, "..") || strings.HasPrefix(hdr.Name, "/") {
+			t.Fatalf("unsafe entry name %s", hdr.Name)
+		}
+		got = append(got, hdr.Name)
+	}
+
+	// Names are the absolute paths without the leading slash.
+	base, err := archiveName(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, p := range []string{"data/", "data/a.txt", "data/sub/", "data/sub/b.txt", "work/c.txt"} {
+		want = append(want, base+"/"+p)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("entries = %v, want %v", got, want)
+	}
+}
+
+func Test_Args_sftp(t *testing.T) {
+	args := map[string]any{
+		"paths": []string{"/etc/mosdns"},
+		"sftp":  map[string]any{"addr": "nas:22"},
+	}
+	if err := utils.WeakDecode(args, new(Args)); err == nil || !strings.Contains(err.Error(), "sftp") {
+		t.Fatalf("sftp should be rejected as an unknown key, got %v", err)
+	}
+}
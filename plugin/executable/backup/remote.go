@@ -0,0 +1,300 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+var httpClient = &http.Client{Timeout: uploadTimeout}
+
+// checkResp returns an error if resp is not a 2xx response.
+func checkResp(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(b)))
+}
+
+func do(req *http.Request) ([]byte, error) {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResp(resp); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+type WebDAVConfig struct {
+	URL      string `yaml:"url"` // Directory url, e.g. "https://dav.example.com/backup/". Required.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type webDAV struct {
+	cfg WebDAVConfig
+	dir *url.URL
+}
+
+func newWebDAV(cfg WebDAVConfig) (*webDAV, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid webdav url %q", cfg.URL)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return &webDAV{cfg: cfg, dir: u}, nil
+}
+
+func (d *webDAV) newRequest(ctx context.Context, method, name string, body []byte) (*http.Request, error) {
+	u := d.dir.JoinPath(name)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(d.cfg.Username) > 0 {
+		req.SetBasicAuth(d.cfg.Username, d.cfg.Password)
+	}
+	return req, nil
+}
+
+func (d *webDAV) Put(ctx context.Context, name string, b []byte) error {
+	req, err := d.newRequest(ctx, http.MethodPut, name, b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	_, err = do(req)
+	return err
+}
+
+func (d *webDAV) List(ctx context.Context, _ string) ([]string, error) {
+	const body = `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><resourcetype/></prop></propfind>`
+	req, err := d.newRequest(ctx, "PROPFIND", "", []byte(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+	b, err := do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var ms struct {
+		Responses []struct {
+			Href string `xml:"href"`
+		} `xml:"response"`
+	}
+	if err := xml.Unmarshal(b, &ms); err != nil {
+		return nil, fmt.Errorf("invalid propfind response, %w", err)
+	}
+	var names []string
+	for _, r := range ms.Responses {
+		p, err := url.PathUnescape(r.Href)
+		if err != nil || strings.HasSuffix(p, "/") { // The directory itself.
+			continue
+		}
+		names = append(names, path.Base(p))
+	}
+	return names, nil
+}
+
+func (d *webDAV) Delete(ctx context.Context, name string) error {
+	req, err := d.newRequest(ctx, http.MethodDelete, name, nil)
+	if err != nil {
+		return err
+	}
+	_, err = do(req)
+	return err
+}
+
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"` // e.g. "https://s3.us-east-1.amazonaws.com". Required.
+	Region    string `yaml:"region"`   // Default is "us-east-1".
+	Bucket    string `yaml:"bucket"`   // Required.
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	// PathPrefix is the "directory" of snapshots in the bucket, e.g. "mosdns/".
+	PathPrefix string `yaml:"path_prefix"`
+	// VirtualHost uses virtual-hosted style (bucket.endpoint) urls.
+	// Default is path style (endpoint/bucket), which most S3 compatible
+	// storages support.
+	VirtualHost bool `yaml:"virtual_host"`
+}
+
+// s3 is a minimal S3 client that signs requests with AWS signature v4.
+type s3 struct {
+	cfg  S3Config
+	base *url.URL // bucket url
+}
+
+func newS3(cfg S3Config) (*s3, error) {
+	utils.SetDefaultString(&cfg.Region, "us-east-1")
+	if len(cfg.Bucket) == 0 {
+		return nil, errors.New("missing s3 bucket")
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.VirtualHost {
+		u.Host = cfg.Bucket + "." + u.Host
+		u.Path = "/"
+	} else {
+		u.Path = "/" + cfg.Bucket + "/"
+	}
+	return &s3{cfg: cfg, base: u}, nil
+}
+
+func (s *s3) do(ctx context.Context, method, key string, query url.Values, body []byte) ([]byte, error) {
+	u := *s.base
+	u.Path += key
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body, time.Now())
+	return do(req)
+}
+
+// sign signs req with AWS signature v4.
+func (s *s3) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, url.QueryEscape(k)+"="+strings.ReplaceAll(url.QueryEscape(v), "+", "%20"))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (s *s3) Put(ctx context.Context, name string, b []byte) error {
+	_, err := s.do(ctx, http.MethodPut, s.cfg.PathPrefix+name, nil, b)
+	return err
+}
+
+func (s *s3) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.cfg.PathPrefix + prefix}}
+		if len(token) > 0 {
+			q.Set("continuation-token", token)
+		}
+		b, err := s.do(ctx, http.MethodGet, "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		var res struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := xml.Unmarshal(b, &res); err != nil {
+			return nil, fmt.Errorf("invalid list response, %w", err)
+		}
+		for _, c := range res.Contents {
+			names = append(names, strings.TrimPrefix(c.Key, s.cfg.PathPrefix))
+		}
+		if !res.IsTruncated || len(res.NextContinuationToken) == 0 {
+			return names, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (s *s3) Delete(ctx context.Context, name string) error {
+	_, err := s.do(ctx, http.MethodDelete, s.cfg.PathPrefix+name, nil, nil)
+	return err
+}
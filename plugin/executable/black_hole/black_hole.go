@@ -22,6 +22,7 @@ package black_hole
 import (
 	"context"
 	"fmt"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"github.com/miekg/dns"
@@ -40,10 +41,18 @@ var _ sequence.Executable = (*BlackHole)(nil)
 type BlackHole struct {
 	ipv4 []netip.Addr
 	ipv6 []netip.Addr
+
+	// passSVCB disables the empty response for HTTPS/SVCB queries.
+	passSVCB bool
 }
 
-// QuickSetup format: [ipv4|ipv6] ...
+const passSVCBFlag = "pass_https"
+
+// QuickSetup format: [ipv4|ipv6] ... [pass_https]
 // Support both ipv4/a and ipv6/aaaa families.
+// HTTPS/SVCB queries will get an empty (NODATA) response, so clients
+// won't bypass the blocked address via ip hints. Use flag "pass_https"
+// to let HTTPS/SVCB queries pass through.
 func QuickSetup(_ sequence.BQ, s string) (any, error) {
 	return NewBlackHole(strings.Fields(s))
 }
@@ -52,6 +61,10 @@ func QuickSetup(_ sequence.BQ, s string) (any, error) {
 func NewBlackHole(ips []string) (*BlackHole, error) {
 	b := &BlackHole{}
 	for _, s := range ips {
+		if s == passSVCBFlag {
+			b.passSVCB = true
+			continue
+		}
 		addr, err := netip.ParseAddr(s)
 		if err != nil {
 			return nil, fmt.Errorf("invalid ipv4 addr %s, %w", s, err)
@@ -118,6 +131,12 @@ func (b *BlackHole) Response(q *dns.Msg) *dns.Msg {
 			r.Answer = append(r.Answer, rr)
 		}
 		return r
+
+	case (qtype == dns.TypeHTTPS || qtype == dns.TypeSVCB) && !b.passSVCB && len(b.ipv4)+len(b.ipv6) > 0:
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Ns = []dns.RR{dnsutils.FakeSOA(qName)}
+		return r
 	}
 	return nil
 }
@@ -0,0 +1,32 @@
+package black_hole
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_BlackHole_SVCB(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeHTTPS)
+
+	b, err := NewBlackHole([]string{"0.0.0.0", "::"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := b.Response(q)
+	if r == nil {
+		t.Fatal("expect an empty response for HTTPS query")
+	}
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 || len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("unexpected response %v", r)
+	}
+
+	b, err = NewBlackHole([]string{"0.0.0.0", "pass_https"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := b.Response(q); r != nil {
+		t.Fatalf("HTTPS query should pass, got %v", r)
+	}
+}
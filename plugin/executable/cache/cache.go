@@ -1,8 +1,10 @@
 package cache
 
 import (
+    "bytes"
     "context"
     "encoding/binary"
+    "encoding/json"
     "errors"
     "fmt"
     "io"
@@ -20,6 +22,7 @@ import (
 	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/storage"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"github.com/go-chi/chi/v5"
@@ -69,15 +72,35 @@ type Args struct {
 	ExcludeIPs   []string `yaml:"exclude_ip"`
 	DumpFile     string   `yaml:"dump_file"`
 	DumpInterval int      `yaml:"dump_interval"`
+
+	// Prefetch refreshes a cached response in background when its remaining
+	// ttl is not longer than Prefetch seconds. 0 disables prefetch.
+	Prefetch int `yaml:"prefetch"`
+	// ServeStale changes how expired (lazy) entries are used. Instead of
+	// replying the expired response immediately, the query is sent to upstream
+	// first and the expired response is replied only if upstream fails.
+	// It requires lazy_cache_ttl.
+	ServeStale bool `yaml:"serve_stale"`
+	// Storage saves the dump to a storage url (see storage.Open) instead
+	// of dump_file, e.g. "redis://nas:6379/0".
+	Storage string `yaml:"storage"`
+	// MaxNegativeTTL caps the ttl in seconds of cached NXDOMAIN and NODATA
+	// responses. The ttl is taken from the SOA record in the authority
+	// section (RFC 2308). Default is 300.
+	MaxNegativeTTL int `yaml:"max_negative_ttl"`
 }
 
 type argsRaw struct {
-	Size         int         `yaml:"size"`
-	LazyCacheTTL int         `yaml:"lazy_cache_ttl"`
-	EnableECS    bool        `yaml:"enable_ecs"`
-	ExcludeIP    interface{} `yaml:"exclude_ip"`
-	DumpFile     string      `yaml:"dump_file"`
-	DumpInterval int         `yaml:"dump_interval"`
+	Size           int         `yaml:"size"`
+	LazyCacheTTL   int         `yaml:"lazy_cache_ttl"`
+	EnableECS      bool        `yaml:"enable_ecs"`
+	ExcludeIP      interface{} `yaml:"exclude_ip"`
+	DumpFile       string      `yaml:"dump_file"`
+	DumpInterval   int         `yaml:"dump_interval"`
+	Prefetch       int         `yaml:"prefetch"`
+	ServeStale     bool        `yaml:"serve_stale"`
+	Storage        string      `yaml:"storage"`
+	MaxNegativeTTL int         `yaml:"max_negative_ttl"`
 }
 
 // UnmarshalYAML supports both scalar (space-separated) and sequence forms for exclude_ip.
@@ -91,6 +114,10 @@ func (a *Args) UnmarshalYAML(node *yaml.Node) error {
 	a.DumpFile = raw.DumpFile
 	a.DumpInterval = raw.DumpInterval
 	a.EnableECS = raw.EnableECS
+	a.Prefetch = raw.Prefetch
+	a.ServeStale = raw.ServeStale
+	a.Storage = raw.Storage
+	a.MaxNegativeTTL = raw.MaxNegativeTTL
 
 	switch v := raw.ExcludeIP.(type) {
 	case string:
@@ -114,11 +141,13 @@ func (a *Args) UnmarshalYAML(node *yaml.Node) error {
 func (a *Args) init() {
 	utils.SetDefaultUnsignNum(&a.Size, 1024)
 	utils.SetDefaultUnsignNum(&a.DumpInterval, 600)
+	utils.SetDefaultUnsignNum(&a.MaxNegativeTTL, 300)
 }
 
 type Cache struct {
 	args         *Args
 	logger       *zap.Logger
+	store        storage.Storage // maybe nil
 	backend      *cache.Cache[key, *item]
 	lazyUpdateSF singleflight.Group
 	closeOnce    sync.Once
@@ -130,19 +159,32 @@ type Cache struct {
 	lazyHitTotal prometheus.Counter
 	size         prometheus.GaugeFunc
 
+	stats cacheStats
+
 	excludeNets []*net.IPNet // parsed exclude_ip CIDRs
 }
 
 type Opts struct {
 	Logger     *zap.Logger
 	MetricsTag string
+	// Storage saves the cache dump if not nil. It will be closed by Cache.
+	Storage storage.Storage
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
-	c := NewCache(args.(*Args), Opts{
+	a := args.(*Args)
+	opts := Opts{
 		Logger:     bp.L(),
 		MetricsTag: bp.Tag(),
-	})
+	}
+	if len(a.Storage) > 0 {
+		s, err := storage.Open(a.Storage)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open storage, %w", err)
+		}
+		opts.Storage = storage.WithPrefix(s, bp.Tag()+"/")
+	}
+	c := NewCache(a, opts)
 
 	if err := c.RegMetricsTo(prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg())); err != nil {
 		return nil, fmt.Errorf("failed to register metrics, %w", err)
@@ -189,6 +231,7 @@ func NewCache(args *Args, opts Opts) *Cache {
 	p := &Cache{
 		args:        args,
 		logger:      logger,
+		store:       opts.Storage,
 		backend:     backend,
 		closeNotify: make(chan struct{}),
 		excludeNets: excludeNets,
@@ -217,6 +260,8 @@ func NewCache(args *Args, opts Opts) *Cache {
 		}),
 	}
 
+	p.stats.since = time.Now()
+
 	if err := p.loadDump(); err != nil {
 		p.logger.Error("failed to load cache dump", zap.Error(err))
 	}
@@ -260,6 +305,7 @@ func (c *Cache) RegMetricsTo(r prometheus.Registerer) error {
 
 func (c *Cache) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
 	c.queryTotal.Inc()
+	c.stats.query.Add(1)
 	q := qCtx.Q()
 
 	msgKey := getMsgKey(q, qCtx, c.args.EnableECS)
@@ -268,12 +314,22 @@ func (c *Cache) Exec(ctx context.Context, qCtx *query_context.Context, next sequ
 	}
 
 	cachedResp, lazyHit, domainSet := getRespFromCache(msgKey, c.backend, c.args.LazyCacheTTL > 0, expiredMsgTtl)
+	if lazyHit && c.args.ServeStale {
+		return c.execServeStale(ctx, qCtx, next, msgKey, cachedResp, domainSet)
+	}
 	if lazyHit {
 		c.lazyHitTotal.Inc()
+		c.stats.lazyHit.Add(1)
 		c.doLazyUpdate(msgKey, qCtx, next)
+	} else if cachedResp != nil && c.args.Prefetch > 0 {
+		if v, _, _ := c.backend.Get(key(msgKey)); v != nil && shouldPrefetch(v, time.Now(), time.Duration(c.args.Prefetch)*time.Second) {
+			c.stats.prefetch.Add(1)
+			c.doLazyUpdate(msgKey, qCtx, next)
+		}
 	}
 	if cachedResp != nil {
 		c.hitTotal.Inc()
+		c.stats.hit.Add(1)
 		cachedResp.Id = q.Id
 		qCtx.SetResponse(cachedResp)
 		if domainSet != "" {
@@ -282,17 +338,44 @@ func (c *Cache) Exec(ctx context.Context, qCtx *query_context.Context, next sequ
 		return nil
 	}
 
+	c.stats.miss.Add(1)
 	err := next.ExecNext(ctx, qCtx)
 	r := qCtx.R()
 
 	if r != nil && !c.containsExcluded(r) {
-		saveRespToCache(msgKey, qCtx, c.backend, c.args.LazyCacheTTL)
+		saveRespToCache(msgKey, qCtx, c.backend, c.args.LazyCacheTTL, c.args.MaxNegativeTTL)
 		c.updatedKey.Add(1)
 	}
 
 	return err
 }
 
+// execServeStale sends the query to upstream and replies the expired
+// response stale only if upstream failed.
+func (c *Cache) execServeStale(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker, msgKey string, stale *dns.Msg, domainSet string) error {
+	err := next.ExecNext(ctx, qCtx)
+	r := qCtx.R()
+	if err == nil && r != nil && r.Rcode != dns.RcodeServerFailure {
+		c.stats.miss.Add(1)
+		if !c.containsExcluded(r) {
+			saveRespToCache(msgKey, qCtx, c.backend, c.args.LazyCacheTTL, c.args.MaxNegativeTTL)
+			c.updatedKey.Add(1)
+		}
+		return nil
+	}
+
+	c.logger.Debug("upstream failed, serving stale response", qCtx.InfoField(), zap.Error(err))
+	c.lazyHitTotal.Inc()
+	c.hitTotal.Inc()
+	c.stats.staleHit.Add(1)
+	stale.Id = qCtx.Q().Id
+	qCtx.SetResponse(stale)
+	if domainSet != "" {
+		qCtx.StoreValue(query_context.KeyDomainSet, domainSet)
+	}
+	return nil
+}
+
 func (c *Cache) doLazyUpdate(msgKey string, qCtx *query_context.Context, next sequence.ChainWalker) {
 	qCtxCopy := qCtx.Copy()
 	lazyUpdateFunc := func() (any, error) {
@@ -310,7 +393,7 @@ func (c *Cache) doLazyUpdate(msgKey string, qCtx *query_context.Context, next se
 
 		r := qCtx.R()
 		if r != nil && !c.containsExcluded(r) {
-			saveRespToCache(msgKey, qCtx, c.backend, c.args.LazyCacheTTL)
+			saveRespToCache(msgKey, qCtx, c.backend, c.args.LazyCacheTTL, c.args.MaxNegativeTTL)
 			c.updatedKey.Add(1)
 		}
 		c.logger.Debug("lazy cache updated", qCtx.InfoField())
@@ -326,10 +409,36 @@ func (c *Cache) Close() error {
 	c.closeOnce.Do(func() {
 		close(c.closeNotify)
 	})
+	if c.store != nil {
+		c.store.Close()
+	}
 	return c.backend.Close()
 }
 
+// dumpKey is the storage key of the cache dump.
+const dumpKey = "cache.dump"
+
+func (c *Cache) dumpEnabled() bool {
+	return c.store != nil || len(c.args.DumpFile) > 0
+}
+
 func (c *Cache) loadDump() error {
+	if c.store != nil {
+		b, err := c.store.Get(context.Background(), dumpKey)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				c.logger.Info("cache dump not found in storage, skipping load")
+				return nil
+			}
+			return err
+		}
+		en, err := c.readDump(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		c.logger.Info("cache dump loaded", zap.Int("entries", en))
+		return nil
+	}
 	if len(c.args.DumpFile) == 0 {
 		return nil
 	}
@@ -351,7 +460,7 @@ func (c *Cache) loadDump() error {
 }
 
 func (c *Cache) startDumpLoop() {
-	if len(c.args.DumpFile) == 0 {
+	if !c.dumpEnabled() {
 		return
 	}
 	go func() {
@@ -376,6 +485,18 @@ func (c *Cache) startDumpLoop() {
 }
 
 func (c *Cache) dumpCache() error {
+    if c.store != nil {
+        b := new(bytes.Buffer)
+        en, err := c.writeDump(b)
+        if err != nil {
+            return fmt.Errorf("failed to write dump, %w", err)
+        }
+        if err := c.store.Put(context.Background(), dumpKey, b.Bytes()); err != nil {
+            return fmt.Errorf("failed to save dump, %w", err)
+        }
+        c.logger.Info("cache dumped", zap.Int("entries", en))
+        return nil
+    }
     if len(c.args.DumpFile) == 0 {
         return nil
     }
@@ -416,7 +537,7 @@ func (c *Cache) dumpCache() error {
 func (c *Cache) Api() *chi.Mux {
 	r := chi.NewRouter()
 
-	r.Get("/flush", func(w http.ResponseWriter, req *http.Request) {
+	r.Get("/flush", coremain.AdminOnly(func(w http.ResponseWriter, req *http.Request) {
 		c.logger.Info("flushing cache via api")
 		// 1. Flush the in-memory cache.
 		c.backend.Flush()
@@ -434,6 +555,16 @@ func (c *Cache) Api() *chi.Mux {
 
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("Cache flushed and a background dump has been triggered.\n"))
+	}))
+
+	r.Get("/stats", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(c.stats.snapshot(c.backend.Len()))
+	})
+
+	r.Delete("/stats", func(w http.ResponseWriter, req *http.Request) {
+		c.stats.reset()
+		w.WriteHeader(http.StatusNoContent)
 	})
 
 	r.Get("/dump", func(w http.ResponseWriter, req *http.Request) {
@@ -622,8 +753,13 @@ func (c *Cache) writeDump(w io.Writer) (int, error) {
 	return en, gw.Close()
 }
 
+// readDump loads the entries of a dump. Entries that expired, or were
+// stored in the future (the clock went backwards), are skipped. It returns
+// the number of loaded entries. The ttl of loaded responses is adjusted on
+// cache hits, by the time elapsed since they were stored.
 func (c *Cache) readDump(r io.Reader) (int, error) {
 	en := 0
+	now := time.Now()
 	gr, err := gzip.NewReader(r)
 	if err != nil {
 		return en, fmt.Errorf("failed to read gzip header, %w", err)
@@ -658,11 +794,13 @@ func (c *Cache) readDump(r io.Reader) (int, error) {
 			return fmt.Errorf("failed to decode block data, %w", err)
 		}
 
-		en += len(block.GetEntries())
 		for _, entry := range block.GetEntries() {
 			cacheExpTime := time.Unix(entry.GetCacheExpirationTime(), 0)
 			msgExpTime := time.Unix(entry.GetMsgExpirationTime(), 0)
 			storedTime := time.Unix(entry.GetMsgStoredTime(), 0)
+			if !cacheExpTime.After(now) || storedTime.After(now) {
+				continue
+			}
 			resp := new(dns.Msg)
 			if err := resp.Unpack(entry.GetMsg()); err != nil {
 				return fmt.Errorf("failed to decode dns msg, %w", err)
@@ -674,6 +812,7 @@ func (c *Cache) readDump(r io.Reader) (int, error) {
 				domainSet:      entry.GetDomainSet(),
 			}
 			c.backend.Store(key(entry.GetKey()), i, cacheExpTime)
+			en++
 		}
 		return nil
 	}
@@ -21,6 +21,8 @@ package cache
 
 import (
 	"bytes"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/storage"
 	"github.com/miekg/dns"
 	"strconv"
 	"testing"
@@ -60,3 +62,137 @@ func Test_cachePlugin_Dump(t *testing.T) {
 		t.Fatalf("read err, wrote %d entries, read %d", enw, enr)
 	}
 }
+
+func Test_cachePlugin_DumpStorage(t *testing.T) {
+	dir := t.TempDir()
+	newStore := func() storage.Storage {
+		s, err := storage.NewFS(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	c := NewCache(&Args{}, Opts{Storage: newStore()})
+	resp := new(dns.Msg)
+	resp.SetQuestion("test.", dns.TypeA)
+	now := time.Now()
+	c.backend.Store(key("k"), &item{resp: resp, storedTime: now, expirationTime: now.Add(time.Hour)}, now.Add(time.Hour))
+	if err := c.Close(); err != nil { // Close dumps the cache.
+		t.Fatal(err)
+	}
+
+	c = NewCache(&Args{}, Opts{Storage: newStore()})
+	defer c.Close()
+	if _, _, ok := c.backend.Get(key("k")); !ok {
+		t.Fatal("cache should be loaded from storage")
+	}
+}
+
+func Test_shouldPrefetch(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		elapsed  time.Duration
+		prefetch time.Duration
+		want     bool
+	}{
+		{"fresh", time.Minute * 10, time.Minute, time.Minute, false},
+		{"near expiry", time.Minute * 10, time.Minute*9 + time.Second, time.Minute, true},
+		{"expired", time.Minute * 10, time.Minute * 11, time.Minute, false},
+		{"short ttl", time.Second * 30, time.Second * 20, time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored := now.Add(-tt.elapsed)
+			v := &item{storedTime: stored, expirationTime: stored.Add(tt.ttl)}
+			if got := shouldPrefetch(v, now, tt.prefetch); got != tt.want {
+				t.Errorf("shouldPrefetch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_saveRespToCache_negative(t *testing.T) {
+	soa := func(ttl, minTTL uint32) dns.RR {
+		return &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+			Ns:     "ns.example.",
+			Mbox:   "admin.example.",
+			Minttl: minTTL,
+		}
+	}
+	tests := []struct {
+		name    string
+		rcode   int
+		ns      []dns.RR
+		wantTtl time.Duration
+	}{
+		{"nxdomain soa minimum", dns.RcodeNameError, []dns.RR{soa(3600, 60)}, time.Minute},
+		{"nxdomain soa ttl", dns.RcodeNameError, []dns.RR{soa(120, 600)}, time.Second * 120},
+		{"nxdomain capped", dns.RcodeNameError, []dns.RR{soa(86400, 86400)}, time.Second * 300},
+		{"nxdomain no soa", dns.RcodeNameError, nil, time.Second * 30},
+		{"nodata soa", dns.RcodeSuccess, []dns.RR{soa(3600, 90)}, time.Second * 90},
+		{"nodata capped", dns.RcodeSuccess, []dns.RR{soa(3600, 3600)}, time.Second * 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(&Args{}, Opts{})
+			q := new(dns.Msg)
+			q.SetQuestion("nx.example.", dns.TypeA)
+			r := new(dns.Msg)
+			r.SetRcode(q, tt.rcode)
+			r.Ns = tt.ns
+			qCtx := query_context.NewContext(q)
+			qCtx.SetResponse(r)
+
+			if !saveRespToCache("k", qCtx, c.backend, 0, 300) {
+				t.Fatal("response not cached")
+			}
+			v, _, _ := c.backend.Get("k")
+			if got := v.expirationTime.Sub(v.storedTime); got != tt.wantTtl {
+				t.Fatalf("want ttl %s, got %s", tt.wantTtl, got)
+			}
+			if s := negativeSOA(v.resp); s != nil && time.Duration(s.Hdr.Ttl)*time.Second != tt.wantTtl {
+				t.Fatalf("want soa ttl %s, got %d", tt.wantTtl, s.Hdr.Ttl)
+			}
+		})
+	}
+}
+
+func Test_cachePlugin_DumpSkipExpired(t *testing.T) {
+	c := NewCache(&Args{}, Opts{})
+	resp := new(dns.Msg)
+	resp.SetQuestion("test.", dns.TypeA)
+	now := time.Now()
+	entries := []struct {
+		k        string
+		stored   time.Time
+		cacheExp time.Time
+	}{
+		{"valid", now.Add(-time.Minute), now.Add(time.Hour)},
+		{"expired", now.Add(-time.Hour), now.Add(-time.Minute)},
+		{"future", now.Add(time.Hour), now.Add(time.Hour * 2)},
+	}
+	for _, e := range entries {
+		v := &item{resp: resp, storedTime: e.stored, expirationTime: e.cacheExp}
+		c.backend.Store(key(e.k), v, e.cacheExp)
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := c.writeDump(buf); err != nil {
+		t.Fatal(err)
+	}
+	c2 := NewCache(&Args{}, Opts{})
+	n, err := c2.readDump(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || c2.backend.Len() != 1 {
+		t.Fatalf("want 1 entry loaded, got %d, cache len %d", n, c2.backend.Len())
+	}
+	if v, _, _ := c2.backend.Get("valid"); v == nil {
+		t.Fatal("valid entry not loaded")
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheStats are counters served by the /stats api. Unlike the prometheus
+// metrics, they can be reset.
+type cacheStats struct {
+	query    atomic.Uint64
+	hit      atomic.Uint64
+	miss     atomic.Uint64
+	lazyHit  atomic.Uint64
+	staleHit atomic.Uint64
+	prefetch atomic.Uint64
+
+	mu    sync.Mutex
+	since time.Time
+}
+
+type statsSnapshot struct {
+	Since    time.Time `json:"since"`
+	Query    uint64    `json:"query"`
+	Hit      uint64    `json:"hit"`
+	Miss     uint64    `json:"miss"`
+	LazyHit  uint64    `json:"lazy_hit"`
+	StaleHit uint64    `json:"stale_hit"`
+	Prefetch uint64    `json:"prefetch"`
+	HitRate  float64   `json:"hit_rate"`
+	Size     int       `json:"size"`
+}
+
+func (s *cacheStats) snapshot(size int) statsSnapshot {
+	s.mu.Lock()
+	since := s.since
+	s.mu.Unlock()
+	ss := statsSnapshot{
+		Since:    since,
+		Query:    s.query.Load(),
+		Hit:      s.hit.Load(),
+		Miss:     s.miss.Load(),
+		LazyHit:  s.lazyHit.Load(),
+		StaleHit: s.staleHit.Load(),
+		Prefetch: s.prefetch.Load(),
+		Size:     size,
+	}
+	if ss.Query > 0 {
+		ss.HitRate = float64(ss.Hit) / float64(ss.Query)
+	}
+	return ss
+}
+
+func (s *cacheStats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range [...]*atomic.Uint64{&s.query, &s.hit, &s.miss, &s.lazyHit, &s.staleHit, &s.prefetch} {
+		c.Store(0)
+	}
+	s.since = time.Now()
+}
@@ -147,6 +147,23 @@ func copyNoOpt(m *dns.Msg) *dns.Msg {
 	return m2
 }
 
+// negativeSOA returns the SOA record in the authority section of r, or
+// nil if there is none.
+func negativeSOA(r *dns.Msg) *dns.SOA {
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
+	return nil
+}
+
+// soaNegativeTTL returns the negative caching ttl of soa, which is the
+// minimum of its ttl and its MINIMUM field (RFC 2308 section 5).
+func soaNegativeTTL(soa *dns.SOA) uint32 {
+	return min(soa.Hdr.Ttl, soa.Minttl)
+}
+
 func min[T constraints.Ordered](a, b T) T {
 	if a < b {
 		return a
@@ -187,8 +204,9 @@ func getRespFromCache(msgKey string, backend *cache.Cache[key, *item], lazyCache
 }
 
 // saveRespToCache saves r to cache backend. It returns false if r
-// should not be cached and was skipped.
-func saveRespToCache(msgKey string, qCtx *query_context.Context, backend *cache.Cache[key, *item], lazyCacheTtl int) bool {
+// should not be cached and was skipped. The ttl of NXDOMAIN and NODATA
+// responses is taken from their SOA record and capped by maxNegativeTtl.
+func saveRespToCache(msgKey string, qCtx *query_context.Context, backend *cache.Cache[key, *item], lazyCacheTtl int, maxNegativeTtl int) bool {
 	r := qCtx.R()
 	if r.Truncated != false {
 		return false
@@ -196,18 +214,24 @@ func saveRespToCache(msgKey string, qCtx *query_context.Context, backend *cache.
 
 	var msgTtl time.Duration
 	var cacheTtl time.Duration
+	soa := negativeSOA(r)
 	switch r.Rcode {
 	case dns.RcodeNameError:
 		msgTtl = time.Second * 30
+		if soa != nil {
+			msgTtl = time.Duration(min(soaNegativeTTL(soa), uint32(maxNegativeTtl))) * time.Second
+		}
 		cacheTtl = msgTtl
 	case dns.RcodeServerFailure:
 		msgTtl = time.Second * 5
 		cacheTtl = msgTtl
 	case dns.RcodeSuccess:
 		minTTL := dnsutils.GetMinimalTTL(r)
-		if len(r.Answer) == 0 { // Empty answer. Set ttl between 0~300.
-			const maxEmtpyAnswerTtl = 300
-			msgTtl = time.Duration(min(minTTL, maxEmtpyAnswerTtl)) * time.Second
+		if len(r.Answer) == 0 { // Empty answer (NODATA).
+			if soa != nil {
+				minTTL = soaNegativeTTL(soa)
+			}
+			msgTtl = time.Duration(min(minTTL, uint32(maxNegativeTtl))) * time.Second
 			// --- START MODIFICATION 1 of 2: Apply lazy_cache_ttl to empty answers ---
 			if lazyCacheTtl > 0 {
 				cacheTtl = time.Duration(lazyCacheTtl) * time.Second
@@ -244,6 +268,12 @@ func saveRespToCache(msgKey string, qCtx *query_context.Context, backend *cache.
 		storedTime:     now,
 		expirationTime: now.Add(msgTtl),
 	}
+	if soa != nil && (r.Rcode == dns.RcodeNameError || len(r.Answer) == 0) {
+		// Clients should cache the negative response as long as we do.
+		if soa := negativeSOA(v.resp); soa != nil {
+			soa.Hdr.Ttl = uint32(msgTtl / time.Second)
+		}
+	}
 
 	if val, ok := qCtx.GetValue(query_context.KeyDomainSet); ok {
 		if name, isString := val.(string); isString {
@@ -254,3 +284,13 @@ func saveRespToCache(msgKey string, qCtx *query_context.Context, backend *cache.
 	backend.Store(key(msgKey), v, now.Add(cacheTtl))
 	return true
 }
+
+// shouldPrefetch reports whether a fresh cache item is about to expire and
+// should be refreshed in background. Items whose ttl is not longer than
+// prefetch are never prefetched, otherwise every hit would go to upstream.
+func shouldPrefetch(v *item, now time.Time, prefetch time.Duration) bool {
+	if v.expirationTime.Sub(v.storedTime) <= prefetch {
+		return false
+	}
+	return now.Before(v.expirationTime) && v.expirationTime.Sub(now) <= prefetch
+}
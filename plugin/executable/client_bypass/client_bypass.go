@@ -0,0 +1,355 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_bypass
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/go-chi/chi/v5"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "client_bypass"
+
+const (
+	cleanupInterval = time.Second * 30
+
+	// unlockWindow is the validity window of an unlock signature. Signatures of
+	// the current and the previous window are accepted to tolerate clock skew.
+	unlockWindow = time.Minute * 5
+	sigLen       = 32 // Hex chars of the truncated HMAC-SHA256 in the unlock label.
+)
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+type Args struct {
+	// Token enables unlock queries. A client that sends a TXT query for
+	// "[minutes.]<sig>.<unlock_domain>" will be exempted, where sig is the
+	// first 32 hex chars of HMAC-SHA256(token, "<minutes>:<unix_time/300>").
+	// See UnlockName. Each signature can only be used once.
+	// Empty token disables unlock queries. Bypass can still be managed via api.
+	Token        string `yaml:"token"`
+	UnlockDomain string `yaml:"unlock_domain"` // Default is "bypass.mosdns.".
+	Duration     int    `yaml:"duration"`      // Default bypass duration in minutes. Default is 10.
+	MaxDuration  int    `yaml:"max_duration"`  // Max bypass duration in minutes. Default is 1440.
+}
+
+func (a *Args) init() {
+	utils.SetDefaultString(&a.UnlockDomain, "bypass.mosdns.")
+	a.UnlockDomain = dns.Fqdn(strings.ToLower(a.UnlockDomain))
+	utils.SetDefaultNum(&a.Duration, 10)
+	utils.SetDefaultNum(&a.MaxDuration, 1440)
+}
+
+var _ sequence.Executable = (*ClientBypass)(nil)
+var _ sequence.Matcher = (*ClientBypass)(nil)
+
+// ClientBypass temporarily exempts clients from filtering.
+// As an Executable, it answers unlock queries.
+// As a Matcher, it matches queries from exempted clients.
+type ClientBypass struct {
+	args   Args
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	clients  map[netip.Addr]time.Time // client addr -> expiry
+	usedSigs map[string]time.Time     // used unlock signatures -> expiry, prevents replay
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	b := NewClientBypass(*args.(*Args), bp.L())
+	bp.RegAPI(b.Api())
+	return b, nil
+}
+
+func NewClientBypass(args Args, logger *zap.Logger) *ClientBypass {
+	args.init()
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	b := &ClientBypass{
+		args:        args,
+		logger:      logger,
+		clients:     make(map[netip.Addr]time.Time),
+		usedSigs:    make(map[string]time.Time),
+		closeNotify: make(chan struct{}),
+	}
+	go b.cleanupLoop()
+	return b
+}
+
+// Match implements sequence.Matcher.
+func (b *ClientBypass) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	addr := qCtx.ServerMeta.ClientAddr.Unmap()
+	if !addr.IsValid() {
+		return false, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	expire, ok := b.clients[addr]
+	return ok && time.Now().Before(expire), nil
+}
+
+// Exec implements sequence.Executable. It answers unlock queries.
+func (b *ClientBypass) Exec(_ context.Context, qCtx *query_context.Context) error {
+	if len(b.args.Token) == 0 {
+		return nil
+	}
+	q := qCtx.Q()
+	if len(q.Question) != 1 {
+		return nil
+	}
+	question := q.Question[0]
+	name := strings.ToLower(question.Name)
+	prefix, ok := strings.CutSuffix(name, "."+b.args.UnlockDomain)
+	if !ok {
+		return nil
+	}
+
+	// Queries under the unlock domain never go upstream.
+	r := new(dns.Msg)
+	r.SetReply(q)
+	labels := strings.Split(prefix, ".")
+	var minutesLabel string
+	if len(labels) == 2 {
+		minutesLabel = labels[0]
+	}
+	minutes := b.args.Duration
+	if len(minutesLabel) > 0 {
+		n, err := strconv.Atoi(minutesLabel)
+		if err != nil || n <= 0 {
+			minutes = -1
+		} else {
+			minutes = n
+		}
+	}
+	addr := qCtx.ServerMeta.ClientAddr.Unmap()
+	if question.Qtype != dns.TypeTXT || !addr.IsValid() || len(labels) > 2 || minutes <= 0 ||
+		!b.verify(minutesLabel, labels[len(labels)-1], time.Now()) {
+		r.Rcode = dns.RcodeRefused
+		qCtx.SetResponse(r)
+		return nil
+	}
+
+	expire := b.Add(addr, minutes, "unlock query")
+	r.Answer = append(r.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0},
+		Txt: []string{fmt.Sprintf("bypass enabled for %s until %s", addr, expire.Format(time.RFC3339))},
+	})
+	qCtx.SetResponse(r)
+	return nil
+}
+
+// verify reports whether sig is a valid unused signature of minutesLabel
+// for the current or the previous window. A valid signature is marked as used.
+func (b *ClientBypass) verify(minutesLabel, sig string, now time.Time) bool {
+	w := now.Unix() / int64(unlockWindow/time.Second)
+	for _, window := range []int64{w, w - 1} {
+		expected := unlockSig(b.args.Token, minutesLabel, window)
+		if subtle.ConstantTimeCompare([]byte(sig), []byte(expected)) != 1 {
+			continue
+		}
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, used := b.usedSigs[sig]; used {
+			return false
+		}
+		// Keep it until it can no longer be accepted.
+		b.usedSigs[sig] = time.Unix((window+2)*int64(unlockWindow/time.Second), 0)
+		return true
+	}
+	return false
+}
+
+func unlockSig(token, minutesLabel string, window int64) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	fmt.Fprintf(mac, "%s:%d", minutesLabel, window)
+	return hex.EncodeToString(mac.Sum(nil))[:sigLen]
+}
+
+// UnlockName returns the name of the unlock query at time t.
+// minutes <= 0 uses the default duration.
+func UnlockName(token, unlockDomain string, minutes int, t time.Time) string {
+	var minutesLabel string
+	if minutes > 0 {
+		minutesLabel = strconv.Itoa(minutes)
+	}
+	sig := unlockSig(token, minutesLabel, t.Unix()/int64(unlockWindow/time.Second))
+	if len(minutesLabel) > 0 {
+		sig = minutesLabel + "." + sig
+	}
+	return sig + "." + dns.Fqdn(strings.ToLower(unlockDomain))
+}
+
+// Add exempts addr for given minutes. minutes will be capped by max_duration.
+// It returns the expiry time.
+func (b *ClientBypass) Add(addr netip.Addr, minutes int, source string) time.Time {
+	if minutes <= 0 {
+		minutes = b.args.Duration
+	}
+	if minutes > b.args.MaxDuration {
+		minutes = b.args.MaxDuration
+	}
+	addr = addr.Unmap()
+	expire := time.Now().Add(time.Duration(minutes) * time.Minute)
+	b.mu.Lock()
+	b.clients[addr] = expire
+	b.mu.Unlock()
+	b.logger.Info("client bypass enabled", zap.Stringer("client", addr), zap.Int("minutes", minutes), zap.String("source", source))
+	return expire
+}
+
+// Remove removes the exemption of addr. It reports whether addr was exempted.
+func (b *ClientBypass) Remove(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	b.mu.Lock()
+	_, ok := b.clients[addr]
+	delete(b.clients, addr)
+	b.mu.Unlock()
+	if ok {
+		b.logger.Info("client bypass removed", zap.Stringer("client", addr))
+	}
+	return ok
+}
+
+func (b *ClientBypass) cleanupLoop() {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			b.mu.Lock()
+			for addr, expire := range b.clients {
+				if !now.Before(expire) {
+					delete(b.clients, addr)
+					b.logger.Info("client bypass expired", zap.Stringer("client", addr))
+				}
+			}
+			for sig, expire := range b.usedSigs {
+				if !now.Before(expire) {
+					delete(b.usedSigs, sig)
+				}
+			}
+			b.mu.Unlock()
+		case <-b.closeNotify:
+			return
+		}
+	}
+}
+
+func (b *ClientBypass) Close() error {
+	b.closeOnce.Do(func() { close(b.closeNotify) })
+	return nil
+}
+
+type bypassEntry struct {
+	Client           string    `json:"client"`
+	ExpireAt         time.Time `json:"expire_at"`
+	RemainingSeconds int       `json:"remaining_seconds"`
+}
+
+func (b *ClientBypass) list() []bypassEntry {
+	now := time.Now()
+	b.mu.Lock()
+	entries := make([]bypassEntry, 0, len(b.clients))
+	for addr, expire := range b.clients {
+		if !now.Before(expire) {
+			continue
+		}
+		entries = append(entries, bypassEntry{
+			Client:           addr.String(),
+			ExpireAt:         expire,
+			RemainingSeconds: int(expire.Sub(now) / time.Second),
+		})
+	}
+	b.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Client < entries[j].Client })
+	return entries
+}
+
+func (b *ClientBypass) Api() *chi.Mux {
+	r := chi.NewRouter()
+
+	r.Get("/clients", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b.list())
+	})
+
+	r.Post("/clients", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Client  string `json:"client"`
+			Minutes int    `json:"minutes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		addr, err := netip.ParseAddr(req.Client)
+		if err != nil {
+			http.Error(w, "invalid client address", http.StatusBadRequest)
+			return
+		}
+		expire := b.Add(addr, req.Minutes, "api")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bypassEntry{
+			Client:           addr.Unmap().String(),
+			ExpireAt:         expire,
+			RemainingSeconds: int(time.Until(expire) / time.Second),
+		})
+	})
+
+	r.Delete("/clients/{client}", func(w http.ResponseWriter, r *http.Request) {
+		addr, err := netip.ParseAddr(chi.URLParam(r, "client"))
+		if err != nil {
+			http.Error(w, "invalid client address", http.StatusBadRequest)
+			return
+		}
+		if !b.Remove(addr) {
+			http.Error(w, "client not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return r
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_bypass
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+var testClient = netip.MustParseAddr("192.168.1.10")
+
+func query(t *testing.T, b *ClientBypass, name string, qtype uint16, client netip.Addr) *dns.Msg {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	qCtx := query_context.NewContext(q)
+	qCtx.ServerMeta.ClientAddr = client
+	if err := b.Exec(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	return qCtx.R()
+}
+
+func bypassed(t *testing.T, b *ClientBypass, client netip.Addr) bool {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q)
+	qCtx.ServerMeta.ClientAddr = client
+	ok, err := b.Match(context.Background(), qCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestClientBypass_Unlock(t *testing.T) {
+	const token = "S3cret-Token" // upper case letters must work
+	b := NewClientBypass(Args{Token: token}, nil)
+	defer b.Close()
+
+	now := time.Now()
+	tests := []struct {
+		name     string
+		qname    string
+		qtype    uint16
+		wantCode int
+		wantMin  int // expected bypass minutes, 0 means not unlocked
+	}{
+		{"default duration", UnlockName(token, "bypass.mosdns.", 0, now), dns.TypeTXT, dns.RcodeSuccess, 10},
+		{"custom duration", UnlockName(token, "bypass.mosdns.", 30, now), dns.TypeTXT, dns.RcodeSuccess, 30},
+		{"capped duration", UnlockName(token, "bypass.mosdns.", 5000, now), dns.TypeTXT, dns.RcodeSuccess, 1440},
+		{"previous window", UnlockName(token, "bypass.mosdns.", 1, now.Add(-unlockWindow)), dns.TypeTXT, dns.RcodeSuccess, 1},
+		{"upper case query", strings.ToUpper(UnlockName(token, "bypass.mosdns.", 2, now)), dns.TypeTXT, dns.RcodeSuccess, 2},
+		{"wrong token", UnlockName("wrong", "bypass.mosdns.", 0, now), dns.TypeTXT, dns.RcodeRefused, 0},
+		{"plaintext token", strings.ToLower(token) + ".bypass.mosdns.", dns.TypeTXT, dns.RcodeRefused, 0},
+		{"expired window", UnlockName(token, "bypass.mosdns.", 3, now.Add(-2*unlockWindow)), dns.TypeTXT, dns.RcodeRefused, 0},
+		{"tampered minutes", "60." + strings.SplitN(UnlockName(token, "bypass.mosdns.", 4, now), ".", 2)[1], dns.TypeTXT, dns.RcodeRefused, 0},
+		{"not txt", UnlockName(token, "bypass.mosdns.", 5, now), dns.TypeA, dns.RcodeRefused, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b.Remove(testClient)
+			r := query(t, b, tt.qname, tt.qtype, testClient)
+			if r == nil || r.Rcode != tt.wantCode {
+				t.Fatalf("want rcode %d, got %v", tt.wantCode, r)
+			}
+			if got := bypassed(t, b, testClient); got != (tt.wantMin > 0) {
+				t.Fatalf("want bypassed %v, got %v", tt.wantMin > 0, got)
+			}
+			if tt.wantMin > 0 {
+				b.mu.Lock()
+				d := time.Until(b.clients[testClient])
+				b.mu.Unlock()
+				if want := time.Duration(tt.wantMin) * time.Minute; d > want || d < want-time.Minute {
+					t.Fatalf("want bypass for %s, got %s", want, d)
+				}
+			}
+		})
+	}
+
+	// Other names are not answered.
+	if r := query(t, b, "example.com.", dns.TypeTXT, testClient); r != nil {
+		t.Fatalf("unexpected response %v", r)
+	}
+}
+
+func TestClientBypass_Replay(t *testing.T) {
+	const token = "token"
+	b := NewClientBypass(Args{Token: token}, nil)
+	defer b.Close()
+
+	name := UnlockName(token, "bypass.mosdns.", 0, time.Now())
+	if r := query(t, b, name, dns.TypeTXT, testClient); r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("unlock failed, rcode %d", r.Rcode)
+	}
+	other := netip.MustParseAddr("192.168.1.20")
+	if r := query(t, b, name, dns.TypeTXT, other); r.Rcode != dns.RcodeRefused {
+		t.Fatalf("replayed unlock query is accepted, rcode %d", r.Rcode)
+	}
+	if bypassed(t, b, other) {
+		t.Fatal("replaying client is bypassed")
+	}
+}
+
+func TestClientBypass_Expiry(t *testing.T) {
+	b := NewClientBypass(Args{Token: "token"}, nil)
+	defer b.Close()
+
+	b.Add(testClient, 1, "test")
+	if !bypassed(t, b, testClient) {
+		t.Fatal("client is not bypassed")
+	}
+	if !bypassed(t, b, netip.MustParseAddr("::ffff:192.168.1.10")) {
+		t.Fatal("ipv4-mapped client is not bypassed")
+	}
+	b.mu.Lock()
+	b.clients[testClient] = time.Now().Add(-time.Second)
+	b.mu.Unlock()
+	if bypassed(t, b, testClient) {
+		t.Fatal("expired client is still bypassed")
+	}
+	if len(b.list()) != 0 {
+		t.Fatal("expired client is listed")
+	}
+}
+
+func TestClientBypass_NoToken(t *testing.T) {
+	b := NewClientBypass(Args{}, nil)
+	defer b.Close()
+	if r := query(t, b, UnlockName("", "bypass.mosdns.", 0, time.Now()), dns.TypeTXT, testClient); r != nil {
+		t.Fatalf("unlock query is answered without token: %v", r)
+	}
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dhcp_leases
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/hosts"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "dhcp_leases"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const (
+	formatDnsmasq = "dnsmasq"
+	formatISC     = "isc"
+)
+
+const (
+	// reloadDelay merges the burst of events of a lease file update.
+	reloadDelay = time.Millisecond * 500
+	// expireInterval is the interval to reload the files, so expired
+	// leases are removed even if the files didn't change.
+	expireInterval = time.Minute
+)
+
+type Args struct {
+	// Files are the lease files, e.g. /tmp/dhcp.leases or
+	// /var/lib/dhcp/dhcpd.leases.
+	Files []string `yaml:"files"`
+	// Format of the files, "dnsmasq" or "isc". Default is detected
+	// from the content.
+	Format string `yaml:"format"`
+	// Domain is the local domain, e.g. "lan". If set, hosts are also
+	// answered as "<hostname>.<domain>", and PTR queries are answered
+	// with this name.
+	Domain string `yaml:"domain"`
+}
+
+var _ sequence.Executable = (*Leases)(nil)
+
+// Leases answers A/AAAA queries of hostnames and PTR queries of
+// addresses in DHCP lease files. Expired leases are ignored.
+// The files are reloaded when they change, and every minute to remove
+// expired leases.
+type Leases struct {
+	args   *Args
+	logger *zap.Logger
+	h      atomic.Pointer[hosts.Hosts]
+	w      *utils.FileWatcher
+
+	reloadMu sync.Mutex
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	l, err := NewLeases(args.(*Args), bp.L())
+	if err != nil {
+		return nil, err
+	}
+	w, err := utils.NewFileWatcher(l.args.Files, reloadDelay, l.logger, l.reload)
+	if err != nil {
+		l.logger.Warn("failed to watch lease files, leases won't be reloaded", zap.Error(err))
+	} else {
+		l.w = w
+	}
+	go func() {
+		ticker := time.NewTicker(expireInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				l.reload()
+			case <-l.closeNotify:
+				return
+			}
+		}
+	}()
+	return l, nil
+}
+
+// NewLeases loads the lease files. logger can be nil.
+func NewLeases(args *Args, logger *zap.Logger) (*Leases, error) {
+	if len(args.Files) == 0 {
+		return nil, fmt.Errorf("no lease file is configured")
+	}
+	switch args.Format {
+	case "", formatDnsmasq, formatISC:
+	default:
+		return nil, fmt.Errorf("invalid format %s", args.Format)
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	l := &Leases{args: args, logger: logger, closeNotify: make(chan struct{})}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload reloads the lease files. The current leases are kept if any
+// file cannot be read. A missing file has no lease, because DHCP servers
+// may create it after the first lease.
+func (l *Leases) Reload() error {
+	l.reloadMu.Lock()
+	defer l.reloadMu.Unlock()
+
+	now := time.Now()
+	var leases []lease
+	for i, file := range l.args.Files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("failed to read file #%d %s, %w", i, file, err)
+		}
+		format := l.args.Format
+		if len(format) == 0 {
+			format = detectFormat(b)
+		}
+		var fileLeases []lease
+		if format == formatISC {
+			fileLeases = parseISC(b)
+		} else {
+			fileLeases = parseDnsmasq(b)
+		}
+		for _, ls := range fileLeases {
+			if ls.expiry.IsZero() || ls.expiry.After(now) {
+				leases = append(leases, ls)
+			}
+		}
+	}
+	l.h.Store(l.buildHosts(leases))
+	return nil
+}
+
+func (l *Leases) reload() {
+	if err := l.Reload(); err != nil {
+		l.logger.Warn("failed to reload leases, keep using the current ones", zap.Error(err))
+	}
+}
+
+func (l *Leases) buildHosts(leases []lease) *hosts.Hosts {
+	domainSuffix := strings.Trim(strings.ToLower(l.args.Domain), ".")
+	ipsOf := make(map[string]*hosts.IPs)
+	ptr := make(map[netip.Addr][]string)
+	add := func(name string, addr netip.Addr) {
+		ips := ipsOf[name]
+		if ips == nil {
+			ips = new(hosts.IPs)
+			ipsOf[name] = ips
+		}
+		if addr.Is4() {
+			ips.IPv4 = append(ips.IPv4, addr)
+		} else {
+			ips.IPv6 = append(ips.IPv6, addr)
+		}
+	}
+	for _, ls := range leases {
+		name := ls.hostname
+		if len(domainSuffix) > 0 {
+			fqdn := name + "." + domainSuffix
+			add(fqdn, ls.addr)
+			ptr[ls.addr] = []string{dns.Fqdn(fqdn)}
+		} else {
+			ptr[ls.addr] = []string{dns.Fqdn(name)}
+		}
+		add(name, ls.addr)
+	}
+
+	m := domain.NewFullMatcher[*hosts.IPs]()
+	for name, ips := range ipsOf {
+		_ = m.Add(name, ips)
+	}
+	l.logger.Debug("leases loaded", zap.Int("hosts", len(ptr)))
+	return hosts.NewHostsWithPTR(m, ptr)
+}
+
+// Close stops reloading the lease files.
+func (l *Leases) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closeNotify)
+		if l.w != nil {
+			l.w.Close()
+		}
+	})
+	return nil
+}
+
+func (l *Leases) Response(q *dns.Msg) *dns.Msg {
+	return l.h.Load().LookupMsg(q)
+}
+
+func (l *Leases) Exec(_ context.Context, qCtx *query_context.Context) error {
+	if r := l.Response(qCtx.Q()); r != nil {
+		qCtx.SetResponse(r)
+	}
+	return nil
+}
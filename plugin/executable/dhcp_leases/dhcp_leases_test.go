@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package dhcp_leases
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_Leases(t *testing.T) {
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	dnsmasqLeases := future + " aa:bb:cc:dd:ee:01 192.168.1.10 NAS 01:aa:bb:cc:dd:ee:01\n" +
+		"0 aa:bb:cc:dd:ee:02 192.168.1.11 printer *\n" +
+		past + " aa:bb:cc:dd:ee:03 192.168.1.12 old-phone *\n" +
+		future + " aa:bb:cc:dd:ee:04 192.168.1.13 * *\n" +
+		"duid 00:01:00:01:2c:aa:bb:cc:dd:ee:ff:00\n" +
+		future + " 12345 fd00::10 nas 00:01:00:01\n"
+
+	end := time.Now().Add(time.Hour).UTC().Format("2006/01/02 15:04:05")
+	iscLeases := `# dhcpd.leases
+lease 192.168.2.10 {
+  starts 1 2024/01/01 00:00:00;
+  ends 1 ` + end + `;
+  binding state active;
+  hardware ethernet aa:bb:cc:dd:ee:10;
+  client-hostname "laptop";
+}
+lease 192.168.2.11 {
+  ends never;
+  binding state active;
+  client-hostname "tv";
+}
+lease 192.168.2.11 {
+  ends never;
+  binding state free;
+  client-hostname "tv";
+}
+lease 192.168.2.12 {
+  ends epoch 1; # expired
+  binding state active;
+  client-hostname "old";
+}
+`
+	dir := t.TempDir()
+	f1, f2 := filepath.Join(dir, "dhcp.leases"), filepath.Join(dir, "dhcpd.leases")
+	if err := os.WriteFile(f1, []byte(dnsmasqLeases), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(f2, []byte(iscLeases), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewLeases(&Args{Files: []string{f1, f2, filepath.Join(dir, "missing")}, Domain: "lan"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(name string, qt uint16) []string {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qt)
+		r := l.Response(q)
+		if r == nil {
+			return nil
+		}
+		var s []string
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				s = append(s, rr.A.String())
+			case *dns.AAAA:
+				s = append(s, rr.AAAA.String())
+			case *dns.PTR:
+				s = append(s, rr.Ptr)
+			}
+		}
+		return s
+	}
+	tests := []struct {
+		name string
+		qt   uint16
+		want []string // nil means no response
+	}{
+		{"nas.", dns.TypeA, []string{"192.168.1.10"}},
+		{"nas.lan.", dns.TypeA, []string{"192.168.1.10"}},
+		{"NAS.lan.", dns.TypeAAAA, []string{"fd00::10"}},
+		{"10.1.168.192.in-addr.arpa.", dns.TypePTR, []string{"nas.lan."}},
+		{"printer.lan.", dns.TypeA, []string{"192.168.1.11"}},
+		{"old-phone.lan.", dns.TypeA, nil},
+		{"13.1.168.192.in-addr.arpa.", dns.TypePTR, nil},
+		{"laptop.lan.", dns.TypeA, []string{"192.168.2.10"}},
+		{"tv.lan.", dns.TypeA, nil},
+		{"old.lan.", dns.TypeA, nil},
+	}
+	for _, tt := range tests {
+		got := lookup(tt.name, tt.qt)
+		if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+			t.Errorf("%s %s: want %v, got %v", tt.name, dns.TypeToString[tt.qt], tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dhcp_leases
+
+import (
+	"bufio"
+	"bytes"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type lease struct {
+	addr     netip.Addr
+	hostname string    // lower case, a valid label
+	expiry   time.Time // zero means infinite
+}
+
+// detectFormat returns formatISC if b has a "lease <ip> {" statement.
+func detectFormat(b []byte) string {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		fs := strings.Fields(s.Text())
+		if len(fs) == 3 && fs[0] == "lease" && fs[2] == "{" {
+			return formatISC
+		}
+	}
+	return formatDnsmasq
+}
+
+// parseDnsmasq parses dnsmasq leases, one lease per line:
+// "<expiry> <mac|iaid> <ip> <hostname|*> <client-id>". Expiry is a unix
+// time, 0 means infinite. The "duid" line of DHCPv6 leases is skipped.
+// Invalid lines are ignored.
+func parseDnsmasq(b []byte) []lease {
+	var leases []lease
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		fs := strings.Fields(s.Text())
+		if len(fs) < 4 || fs[0] == "duid" {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fs[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		addr, err := netip.ParseAddr(fs[2])
+		if err != nil {
+			continue
+		}
+		name, ok := validHostname(fs[3])
+		if !ok {
+			continue
+		}
+		ls := lease{addr: addr.Unmap(), hostname: name}
+		if expiry > 0 {
+			ls.expiry = time.Unix(expiry, 0)
+		}
+		leases = append(leases, ls)
+	}
+	return leases
+}
+
+// parseISC parses ISC dhcpd leases. Later declarations of an address
+// replace former ones, as dhcpd appends updates to the file. Only active
+// leases with a client-hostname are returned.
+func parseISC(b []byte) []lease {
+	type decl struct {
+		lease
+		active bool
+	}
+	var order []netip.Addr
+	decls := make(map[netip.Addr]decl)
+
+	var cur *decl
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if cur == nil {
+			fs := strings.Fields(line)
+			if len(fs) == 3 && fs[0] == "lease" && fs[2] == "{" {
+				addr, err := netip.ParseAddr(fs[1])
+				if err == nil {
+					// Leases without a binding state (old dhcpd) are active.
+					cur = &decl{lease: lease{addr: addr.Unmap()}, active: true}
+				}
+			}
+			continue
+		}
+		if line == "}" {
+			if _, ok := decls[cur.addr]; !ok {
+				order = append(order, cur.addr)
+			}
+			decls[cur.addr] = *cur
+			cur = nil
+			continue
+		}
+
+		line = strings.TrimSuffix(line, ";")
+		switch {
+		case strings.HasPrefix(line, "binding state "):
+			cur.active = strings.TrimPrefix(line, "binding state ") == "active"
+		case strings.HasPrefix(line, "ends "):
+			cur.expiry = parseISCTime(strings.TrimPrefix(line, "ends "))
+		case strings.HasPrefix(line, "client-hostname "):
+			name := strings.Trim(strings.TrimPrefix(line, "client-hostname "), `"`)
+			cur.hostname, _ = validHostname(name)
+		}
+	}
+
+	var leases []lease
+	for _, addr := range order {
+		d := decls[addr]
+		if d.active && len(d.hostname) > 0 {
+			leases = append(leases, d.lease)
+		}
+	}
+	return leases
+}
+
+// parseISCTime parses "<weekday> <yyyy/mm/dd> <hh:mm:ss>" (UTC),
+// "epoch <unix> # <comment>" or "never". It returns the zero time for
+// "never". Invalid times are treated as expired.
+func parseISCTime(s string) time.Time {
+	fs := strings.Fields(s)
+	switch {
+	case len(fs) == 0:
+	case fs[0] == "never":
+		return time.Time{}
+	case fs[0] == "epoch" && len(fs) >= 2:
+		if n, err := strconv.ParseInt(fs[1], 10, 64); err == nil {
+			return time.Unix(n, 0)
+		}
+	case len(fs) >= 3:
+		if t, err := time.Parse("2006/01/02 15:04:05", fs[1]+" "+fs[2]); err == nil {
+			return t
+		}
+	}
+	return time.Unix(0, 0)
+}
+
+// validHostname returns the lower case name if it is a valid label.
+// Clients may send any hostname, e.g. with spaces, or none ("*").
+func validHostname(s string) (string, bool) {
+	if len(s) == 0 || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return "", false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return "", false
+		}
+	}
+	return strings.ToLower(s), true
+}
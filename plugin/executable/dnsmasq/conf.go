@@ -0,0 +1,251 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsmasq
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/hosts"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/forward"
+)
+
+// rule is the merged rule of a domain. If both "address" and "server"
+// rules exist, "address" wins, same as dnsmasq.
+type rule struct {
+	ips       *hosts.IPs // from "address", nil if no address
+	nx        bool       // local-only domain, "address=/d/" or "server=/d/"
+	upstreams []string   // from "server", empty means the default upstreams
+
+	fwd *fastforward.Forward
+}
+
+type config struct {
+	rules map[string]*rule      // normalized domain ("" means all domains) -> rule
+	hosts map[string]*hosts.IPs // normalized name -> ips
+	depth int                   // nesting depth of conf-file
+}
+
+func newConfig() *config {
+	return &config{rules: make(map[string]*rule), hosts: make(map[string]*hosts.IPs)}
+}
+
+func (c *config) loadConfFile(path string) error {
+	if c.depth > 8 {
+		return fmt.Errorf("conf-file %s is nested too deep", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c.depth++
+	defer func() { c.depth-- }()
+	if err := c.loadConf(f); err != nil {
+		return fmt.Errorf("failed to load %s, %w", path, err)
+	}
+	return nil
+}
+
+func (c *config) loadConf(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if len(s) == 0 || s[0] == '#' {
+			continue
+		}
+		k, v, _ := strings.Cut(s, "=")
+		var err error
+		switch strings.TrimSpace(k) {
+		case "address":
+			err = c.parseAddress(strings.TrimSpace(v))
+		case "server", "local":
+			err = c.parseServer(strings.TrimSpace(v))
+		case "addn-hosts":
+			err = c.loadHostsFile(strings.TrimSpace(v))
+		case "conf-file":
+			err = c.loadConfFile(strings.TrimSpace(v))
+		}
+		if err != nil {
+			return fmt.Errorf("line %d, %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// splitDomains splits "/d1/d2/target" into domains and target.
+// ok is false if v has no domain part, e.g. "server=8.8.8.8".
+func splitDomains(v string) (domains []string, target string, ok bool) {
+	if !strings.HasPrefix(v, "/") {
+		return nil, "", false
+	}
+	fs := strings.Split(v[1:], "/")
+	if len(fs) < 2 {
+		return nil, "", false
+	}
+	for _, d := range fs[:len(fs)-1] {
+		switch d {
+		case "": // Unqualified names. Not supported.
+		case "#":
+			domains = append(domains, "")
+		default:
+			domains = append(domains, domain.NormalizeDomain(d))
+		}
+	}
+	return domains, fs[len(fs)-1], true
+}
+
+func (c *config) getRule(d string) *rule {
+	r := c.rules[d]
+	if r == nil {
+		r = new(rule)
+		c.rules[d] = r
+	}
+	return r
+}
+
+func (c *config) parseAddress(v string) error {
+	domains, target, ok := splitDomains(v)
+	if !ok {
+		return fmt.Errorf("invalid address %s", v)
+	}
+	var ips []netip.Addr
+	switch target {
+	case "":
+	case "#":
+		ips = []netip.Addr{netip.IPv4Unspecified(), netip.IPv6Unspecified()}
+	default:
+		addr, err := netip.ParseAddr(target)
+		if err != nil {
+			return fmt.Errorf("invalid address %s, %w", v, err)
+		}
+		ips = []netip.Addr{addr}
+	}
+	for _, d := range domains {
+		r := c.getRule(d)
+		if len(ips) == 0 {
+			r.nx = true
+			continue
+		}
+		if r.ips == nil {
+			r.ips = new(hosts.IPs)
+		}
+		appendIPs(r.ips, ips...)
+	}
+	return nil
+}
+
+func (c *config) parseServer(v string) error {
+	domains, target, ok := splitDomains(v)
+	if !ok {
+		return nil // Default upstream servers. Configure them in forward.
+	}
+	var upstream string
+	if target != "" && target != "#" { // "#" means the default upstream servers.
+		var err error
+		upstream, err = parseUpstream(target)
+		if err != nil {
+			return fmt.Errorf("invalid server %s, %w", v, err)
+		}
+	}
+	for _, d := range domains {
+		r := c.getRule(d)
+		switch {
+		case target == "":
+			r.nx = true
+		case len(upstream) > 0:
+			r.upstreams = append(r.upstreams, upstream)
+		}
+	}
+	return nil
+}
+
+// parseUpstream converts dnsmasq server "ip[#port][@source]" to a
+// forward upstream addr.
+func parseUpstream(s string) (string, error) {
+	s, _, _ = strings.Cut(s, "@")
+	host, portStr, hasPort := strings.Cut(s, "#")
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return "", err
+	}
+	port := uint16(53)
+	if hasPort {
+		p, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return "", fmt.Errorf("invalid port %s", portStr)
+		}
+		port = uint16(p)
+	}
+	return "udp://" + netip.AddrPortFrom(addr, port).String(), nil
+}
+
+// loadHostsFile loads a hosts file in "ip name..." format.
+func (c *config) loadHostsFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s, _, _ := strings.Cut(scanner.Text(), "#")
+		fs := strings.Fields(s)
+		if len(fs) < 2 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fs[0])
+		if err != nil {
+			return fmt.Errorf("%s line %d, invalid ip %s", path, line, fs[0])
+		}
+		for _, name := range fs[1:] {
+			name = domain.NormalizeDomain(name)
+			ips := c.hosts[name]
+			if ips == nil {
+				ips = new(hosts.IPs)
+				c.hosts[name] = ips
+			}
+			appendIPs(ips, addr)
+		}
+	}
+	return scanner.Err()
+}
+
+func appendIPs(ips *hosts.IPs, addrs ...netip.Addr) {
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if addr.Is4() {
+			ips.IPv4 = append(ips.IPv4, addr)
+		} else {
+			ips.IPv6 = append(ips.IPv6, addr)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsmasq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/hosts"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/forward"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "dnsmasq"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+type Args struct {
+	// Files are dnsmasq config files. Supported options are "address",
+	// "server", "local" and "addn-hosts". Other options are ignored.
+	Files []string `yaml:"files"`
+	// AddnHosts are hosts files in "ip name..." format, same as
+	// dnsmasq's addn-hosts option.
+	AddnHosts []string `yaml:"addn_hosts"`
+}
+
+var _ sequence.Executable = (*Dnsmasq)(nil)
+var _ data_provider.DomainMatcherProvider = (*Dnsmasq)(nil)
+var _ io.Closer = (*Dnsmasq)(nil)
+
+// Dnsmasq answers queries from hosts files and "address" rules, replies
+// NXDOMAIN to local-only domains and forwards queries according to
+// "server" rules. Queries that match nothing are left untouched.
+type Dnsmasq struct {
+	hosts *hosts.Hosts // from addn-hosts, maybe nil
+	rules *domain.SubDomainMatcher[*rule]
+	fwds  map[string]*fastforward.Forward // upstream addrs -> forward
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	d, err := NewDnsmasq(args.(*Args), bp.L())
+	if err != nil {
+		return nil, err
+	}
+	bp.L().Info("dnsmasq config loaded", zap.Int("rules", d.rules.Len()))
+	return d, nil
+}
+
+func NewDnsmasq(args *Args, logger *zap.Logger) (*Dnsmasq, error) {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	cfg := newConfig()
+	for _, f := range args.Files {
+		if err := cfg.loadConfFile(f); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range args.AddnHosts {
+		if err := cfg.loadHostsFile(f); err != nil {
+			return nil, err
+		}
+	}
+
+	d := &Dnsmasq{
+		rules: domain.NewSubDomainMatcher[*rule](),
+		fwds:  make(map[string]*fastforward.Forward),
+	}
+	if len(cfg.hosts) > 0 {
+		m := domain.NewFullMatcher[*hosts.IPs]()
+		for name, ips := range cfg.hosts {
+			if err := m.Add(name, ips); err != nil {
+				return nil, err
+			}
+		}
+		d.hosts = hosts.NewHosts(m)
+	}
+	for name, r := range cfg.rules {
+		if len(r.upstreams) > 0 && r.ips == nil && !r.nx {
+			key := strings.Join(r.upstreams, ",")
+			fwd, ok := d.fwds[key]
+			if !ok {
+				fArgs := new(fastforward.Args)
+				for _, u := range r.upstreams {
+					fArgs.Upstreams = append(fArgs.Upstreams, fastforward.UpstreamConfig{Addr: u})
+				}
+				var err error
+				fwd, err = fastforward.NewForward(fArgs, fastforward.Opts{Logger: logger})
+				if err != nil {
+					d.Close()
+					return nil, fmt.Errorf("failed to init upstream %s, %w", key, err)
+				}
+				d.fwds[key] = fwd
+			}
+			r.fwd = fwd
+		}
+		if err := d.rules.Add(name, r); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *Dnsmasq) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	if d.hosts != nil {
+		if r := d.hosts.LookupMsg(q); r != nil {
+			qCtx.SetResponse(r)
+			return nil
+		}
+	}
+
+	r, ok := d.rules.Match(q.Question[0].Name)
+	if !ok {
+		return nil
+	}
+	switch {
+	case r.ips != nil:
+		qCtx.SetResponse(addressReply(q, r.ips))
+	case r.nx:
+		qCtx.SetResponse(dnsutils.GenEmptyReply(q, dns.RcodeNameError))
+	case r.fwd != nil:
+		return r.fwd.Exec(ctx, qCtx)
+	}
+	// "server=/domain/#" uses the default upstreams. Nothing to do.
+	return nil
+}
+
+// addressReply replies q with ips. Queries of other types get an empty
+// answer, same as dnsmasq.
+func addressReply(q *dns.Msg, ips *hosts.IPs) *dns.Msg {
+	question := q.Question[0]
+	var addrs []netip.Addr
+	switch question.Qtype {
+	case dns.TypeA:
+		addrs = ips.IPv4
+	case dns.TypeAAAA:
+		addrs = ips.IPv6
+	}
+	if len(addrs) == 0 {
+		return dnsutils.GenEmptyReply(q, dns.RcodeSuccess)
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: 10}
+	for _, addr := range addrs {
+		if question.Qtype == dns.TypeA {
+			r.Answer = append(r.Answer, &dns.A{Hdr: hdr, A: addr.AsSlice()})
+		} else {
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: addr.AsSlice()})
+		}
+	}
+	return r
+}
+
+// GetDomainMatcher returns a matcher of all domains that have a rule.
+func (d *Dnsmasq) GetDomainMatcher() domain.Matcher[struct{}] {
+	return ruleDomains{d.rules}
+}
+
+type ruleDomains struct {
+	m *domain.SubDomainMatcher[*rule]
+}
+
+func (m ruleDomains) Match(s string) (struct{}, bool) {
+	_, ok := m.m.Match(s)
+	return struct{}{}, ok
+}
+
+func (d *Dnsmasq) Close() error {
+	var errs []error
+	for _, fwd := range d.fwds {
+		errs = append(errs, fwd.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsmasq
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+func Test_Dnsmasq(t *testing.T) {
+	dir := t.TempDir()
+	hostsFile := filepath.Join(dir, "hosts")
+	conf := filepath.Join(dir, "dnsmasq.conf")
+	os.WriteFile(hostsFile, []byte("192.168.1.2 nas nas.lan # comment\n"), 0644)
+	os.WriteFile(conf, []byte(`
+# comment
+address=/ad.com/tracker.net/0.0.0.0
+address=/blocked.com/#
+address=/local.lan/
+local=/lan/
+server=/corp.com/10.0.0.1#5353@eth0
+server=/corp.com/10.0.0.2
+server=/public.corp.com/#
+server=8.8.8.8
+cache-size=1000
+addn-hosts=`+hostsFile+`
+`), 0644)
+
+	d, err := NewDnsmasq(&Args{Files: []string{conf}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	exec := func(name string, typ uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, typ)
+		qCtx := query_context.NewContext(q)
+		if err := d.Exec(context.Background(), qCtx); err != nil {
+			t.Fatal(err)
+		}
+		return qCtx.R()
+	}
+
+	if r := exec("nas.", dns.TypeA); r == nil || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "192.168.1.2" {
+		t.Fatalf("unexpected hosts response %v", r)
+	}
+	if r := exec("www.ad.com.", dns.TypeA); r == nil || len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "0.0.0.0" {
+		t.Fatalf("unexpected address response %v", r)
+	}
+	if r := exec("tracker.net.", dns.TypeAAAA); r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Fatalf("expect an empty response for other ip families, got %v", r)
+	}
+	if r := exec("blocked.com.", dns.TypeAAAA); r == nil || len(r.Answer) != 1 || r.Answer[0].(*dns.AAAA).AAAA.String() != "::" {
+		t.Fatalf("unexpected null address response %v", r)
+	}
+	if r := exec("printer.lan.", dns.TypeA); r == nil || r.Rcode != dns.RcodeNameError {
+		t.Fatalf("expect NXDOMAIN for local-only domains, got %v", r)
+	}
+	if r := exec("example.org.", dns.TypeA); r != nil {
+		t.Fatalf("unmatched query should be left untouched, got %v", r)
+	}
+	if r := exec("public.corp.com.", dns.TypeA); r != nil {
+		t.Fatalf("server=/d/# should be left untouched, got %v", r)
+	}
+
+	r, ok := d.rules.Match("www.corp.com.")
+	if !ok || r.fwd == nil || len(r.upstreams) != 2 || r.upstreams[0] != "udp://10.0.0.1:5353" {
+		t.Fatalf("unexpected server rule %+v", r)
+	}
+	if _, ok := d.GetDomainMatcher().Match("x.tracker.net."); !ok {
+		t.Fatal("domain matcher should match rule domains")
+	}
+}
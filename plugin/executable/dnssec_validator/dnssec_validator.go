@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_validator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "dnssec_validator"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+// defaultTrustAnchors are the DS records of the root zone KSKs.
+var defaultTrustAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+var _ sequence.RecursiveExecutable = (*Validator)(nil)
+
+type Args struct {
+	// Upstream is the tag of the executable (e.g. a forward) used to
+	// query DNSKEY and DS records.
+	Upstream string `yaml:"upstream"`
+	// Upstreams are the names (tags or addresses) of forward upstreams
+	// whose responses are validated. Default is all upstreams.
+	// Responses that are not from an upstream are never validated.
+	Upstreams []string `yaml:"upstreams"`
+	// TrustAnchors are DS records in zone file format.
+	// Default is the root zone KSKs.
+	TrustAnchors []string `yaml:"trust_anchors"`
+	// NegativeTrustAnchors are domains that are not validated (RFC 7646).
+	NegativeTrustAnchors []string `yaml:"negative_trust_anchors"`
+}
+
+// Validator validates the responses of the rest of the sequence.
+// It sets the AD bit on secure responses and replaces bogus responses
+// with SERVFAIL.
+type Validator struct {
+	logger    *zap.Logger
+	upstream  sequence.Executable
+	upstreams []string
+	v         *validator
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	if len(a.Upstream) == 0 {
+		return nil, errors.New("missing upstream")
+	}
+	e := sequence.ToExecutable(bp.M().GetPlugin(a.Upstream))
+	if e == nil {
+		return nil, fmt.Errorf("can not find executable %s", a.Upstream)
+	}
+	return NewValidator(e, a, bp.L())
+}
+
+func NewValidator(upstream sequence.Executable, args *Args, logger *zap.Logger) (*Validator, error) {
+	anchorStrs := args.TrustAnchors
+	if len(anchorStrs) == 0 {
+		anchorStrs = defaultTrustAnchors
+	}
+	anchors := make([]*dns.DS, 0, len(anchorStrs))
+	for _, s := range anchorStrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor %q, %w", s, err)
+		}
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			return nil, fmt.Errorf("trust anchor %q is not a DS record", s)
+		}
+		anchors = append(anchors, ds)
+	}
+	for _, n := range args.NegativeTrustAnchors {
+		if _, ok := dns.IsDomainName(n); !ok {
+			return nil, fmt.Errorf("invalid negative trust anchor %q", n)
+		}
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	d := &Validator{
+		logger:    logger,
+		upstream:  upstream,
+		upstreams: args.Upstreams,
+	}
+	d.v = newValidator(d.lookup, anchors, args.NegativeTrustAnchors)
+	return d, nil
+}
+
+func (d *Validator) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	q := qCtx.Q()
+	if q.CheckingDisabled {
+		return next.ExecNext(ctx, qCtx)
+	}
+	clientOpt := qCtx.ClientOpt()
+	clientDo := clientOpt != nil && clientOpt.Do()
+	qCtx.QOpt().SetDo()
+
+	if err := next.ExecNext(ctx, qCtx); err != nil {
+		return err
+	}
+	r := qCtx.R()
+	if r == nil || !d.shouldValidate(qCtx) {
+		return nil
+	}
+
+	res, err := d.v.validate(ctx, qCtx.QQuestion(), r)
+	switch res {
+	case resultSecure:
+		// RFC 6840 5.8
+		r.AuthenticatedData = clientDo || q.AuthenticatedData
+	case resultInsecure:
+		r.AuthenticatedData = false
+	case resultBogus:
+		d.logger.Warn("bogus response", qCtx.InfoField(), zap.Error(err))
+		resp := new(dns.Msg)
+		resp.SetRcode(q, dns.RcodeServerFailure)
+		qCtx.SetResponse(resp)
+		if respOpt := qCtx.RespOpt(); respOpt != nil {
+			respOpt.Option = append(respOpt.Option, &dns.EDNS0_EDE{
+				InfoCode:  dns.ExtendedErrorCodeDNSBogus,
+				ExtraText: err.Error(),
+			})
+		}
+		return nil
+	}
+	if !clientDo {
+		stripDNSSEC(r, qCtx.QQuestion().Qtype)
+	}
+	return nil
+}
+
+// shouldValidate reports whether the response of qCtx is from an
+// upstream that should be validated.
+func (d *Validator) shouldValidate(qCtx *query_context.Context) bool {
+	v, _ := qCtx.GetValue(query_context.KeyUpstream)
+	name, _ := v.(string)
+	if len(name) == 0 {
+		return false
+	}
+	return len(d.upstreams) == 0 || slices.Contains(d.upstreams, name)
+}
+
+func (d *Validator) lookup(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	q.CheckingDisabled = true
+	qCtx := query_context.NewContext(q)
+	qCtx.QOpt().SetDo()
+	if err := d.upstream.Exec(ctx, qCtx); err != nil {
+		return nil, err
+	}
+	r := qCtx.R()
+	if r == nil {
+		return nil, errors.New("no response")
+	}
+	return r, nil
+}
+
+// stripDNSSEC removes DNSSEC records that the client did not ask for.
+func stripDNSSEC(r *dns.Msg, qtype uint16) {
+	filter := func(rrs []dns.RR) []dns.RR {
+		return slices.DeleteFunc(rrs, func(rr dns.RR) bool {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				return t != qtype
+			}
+			return false
+		})
+	}
+	r.Answer = filter(r.Answer)
+	r.Ns = filter(r.Ns)
+	r.Extra = filter(r.Extra)
+}
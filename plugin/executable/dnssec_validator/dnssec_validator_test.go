@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_validator
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	t.Helper()
+	k := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := k.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testZone{name: name, key: k, priv: priv.(crypto.Signer)}
+}
+
+// sign returns rrs and their signature.
+func (z *testZone) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	t.Helper()
+	h := rrs[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: h.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: h.Ttl},
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.priv, rrs); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrs, sig)
+}
+
+func newRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+// testUpstream answers from a signed hierarchy: the root, a signed zone
+// "example." and an unsigned delegation "insecure.".
+type testUpstream struct {
+	answers map[dns.Question]*dns.Msg
+}
+
+func (u *testUpstream) Exec(_ context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	r := new(dns.Msg)
+	if a, ok := u.answers[q.Question[0]]; ok {
+		r = a.Copy()
+	} else {
+		r.Rcode = dns.RcodeServerFailure
+	}
+	r.SetReply(q)
+	qCtx.SetResponse(r)
+	qCtx.StoreValue(query_context.KeyUpstream, "test")
+	return nil
+}
+
+func newTestUpstream(t *testing.T) (*testUpstream, *dns.DS) {
+	root := newTestZone(t, ".")
+	example := newTestZone(t, "example.")
+	u := &testUpstream{answers: make(map[dns.Question]*dns.Msg)}
+	add := func(name string, qtype uint16, rcode int, answer, ns []dns.RR) {
+		u.answers[dns.Question{Name: name, Qtype: qtype, Qclass: dns.ClassINET}] = &dns.Msg{
+			MsgHdr: dns.MsgHdr{Rcode: rcode},
+			Answer: answer,
+			Ns:     ns,
+		}
+	}
+
+	add(".", dns.TypeDNSKEY, dns.RcodeSuccess, root.sign(t, root.key), nil)
+	exampleDS := example.key.ToDS(dns.SHA256)
+	exampleDS.Hdr.Ttl = 3600
+	add("example.", dns.TypeDS, dns.RcodeSuccess, root.sign(t, exampleDS), nil)
+	add("insecure.", dns.TypeDS, dns.RcodeSuccess, nil,
+		root.sign(t, newRR(t, "insecure. 3600 IN NSEC zzz. NS RRSIG NSEC")))
+	add("example.", dns.TypeDNSKEY, dns.RcodeSuccess, example.sign(t, example.key), nil)
+	add("www.example.", dns.TypeDS, dns.RcodeSuccess, nil,
+		example.sign(t, newRR(t, "www.example. 3600 IN NSEC zzz.example. A RRSIG NSEC")))
+
+	add("www.example.", dns.TypeA, dns.RcodeSuccess, example.sign(t, newRR(t, "www.example. 300 IN A 192.0.2.1")), nil)
+	add("www.example.", dns.TypeAAAA, dns.RcodeSuccess, nil,
+		append(example.sign(t, newRR(t, "www.example. 3600 IN NSEC zzz.example. A RRSIG NSEC")),
+			example.sign(t, newRR(t, "example. 3600 IN SOA ns.example. admin.example. 1 3600 600 86400 300"))...))
+	add("forged.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{newRR(t, "forged.example. 300 IN A 192.0.2.2")}, nil)
+	tampered := example.sign(t, newRR(t, "tampered.example. 300 IN A 192.0.2.3"))
+	tampered[0].(*dns.A).A = net.ParseIP("192.0.2.4")
+	add("tampered.example.", dns.TypeA, dns.RcodeSuccess, tampered, nil)
+	add("a.insecure.", dns.TypeA, dns.RcodeSuccess, []dns.RR{newRR(t, "a.insecure. 300 IN A 192.0.2.5")}, nil)
+
+	anchor := root.key.ToDS(dns.SHA256)
+	return u, anchor
+}
+
+func TestValidator(t *testing.T) {
+	u, anchor := newTestUpstream(t)
+
+	tests := []struct {
+		name     string
+		qtype    uint16
+		ntas     []string
+		wantRes  result
+		wantCode int
+	}{
+		{"www.example.", dns.TypeA, nil, resultSecure, dns.RcodeSuccess},
+		{"www.example.", dns.TypeAAAA, nil, resultSecure, dns.RcodeSuccess},
+		{"forged.example.", dns.TypeA, nil, resultBogus, dns.RcodeServerFailure},
+		{"tampered.example.", dns.TypeA, nil, resultBogus, dns.RcodeServerFailure},
+		{"a.insecure.", dns.TypeA, nil, resultInsecure, dns.RcodeSuccess},
+		{"forged.example.", dns.TypeA, []string{"example."}, resultInsecure, dns.RcodeSuccess},
+	}
+	for _, tt := range tests {
+		d, err := NewValidator(u, &Args{
+			TrustAnchors:         []string{anchor.String()},
+			NegativeTrustAnchors: tt.ntas,
+		}, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := new(dns.Msg)
+		q.SetQuestion(tt.name, tt.qtype)
+		q.SetEdns0(1232, true)
+		qCtx := query_context.NewContext(q)
+		cw := sequence.NewChainWalker([]*sequence.ChainNode{{RE: d}, {E: u}}, nil, zap.NewNop())
+		if err := cw.ExecNext(context.Background(), qCtx); err != nil {
+			t.Fatal(err)
+		}
+		r := qCtx.R()
+		if r.Rcode != tt.wantCode {
+			t.Errorf("%s %s: rcode = %s, want %s", tt.name, dns.TypeToString[tt.qtype],
+				dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.wantCode])
+		}
+		if ad := tt.wantRes == resultSecure; r.AuthenticatedData != ad {
+			t.Errorf("%s %s: ad = %v, want %v", tt.name, dns.TypeToString[tt.qtype], r.AuthenticatedData, ad)
+		}
+	}
+}
+
+func TestValidator_StripDNSSEC(t *testing.T) {
+	u, anchor := newTestUpstream(t)
+	d, err := NewValidator(u, &Args{TrustAnchors: []string{anchor.String()}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.", dns.TypeA)
+	qCtx := query_context.NewContext(q)
+	cw := sequence.NewChainWalker([]*sequence.ChainNode{{RE: d}, {E: u}}, nil, zap.NewNop())
+	if err := cw.ExecNext(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	r := qCtx.R()
+	if len(r.Answer) != 1 || r.Answer[0].Header().Rrtype != dns.TypeA {
+		t.Fatalf("RRSIG should be removed for non DO client, got %v", r.Answer)
+	}
+	if r.AuthenticatedData {
+		t.Fatal("AD should not be set for non DO client")
+	}
+}
@@ -0,0 +1,538 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_validator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type result int
+
+const (
+	// resultInsecure means the response is not protected by DNSSEC,
+	// e.g. it is from an unsigned zone.
+	resultInsecure result = iota
+	resultSecure
+	resultBogus
+)
+
+func (r result) String() string {
+	switch r {
+	case resultSecure:
+		return "secure"
+	case resultBogus:
+		return "bogus"
+	default:
+		return "insecure"
+	}
+}
+
+const (
+	minCacheTTL     = time.Second * 30
+	maxCacheTTL     = time.Hour
+	maxCacheEntries = 8192
+)
+
+// lookupFunc sends a query with DO and CD bits to upstream.
+type lookupFunc func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error)
+
+// validator validates responses by following the chain of trust from
+// the trust anchors. It is safe for concurrent use.
+type validator struct {
+	lookup  lookupFunc
+	anchors map[string]*rrset // zone -> DS rrset
+	ntas    []string
+	now     func() time.Time
+
+	mu    sync.Mutex
+	zones map[string]*zoneEntry
+}
+
+type entryKind int
+
+const (
+	// kindSecure is a signed zone, its keys are in zoneEntry.keys.
+	kindSecure entryKind = iota
+	// kindInsecure is an insecure delegation, or a zone signed with
+	// unsupported algorithms.
+	kindInsecure
+	// kindNotCut is a name that is not a zone cut.
+	kindNotCut
+	// kindNXDomain is a name that does not exist.
+	kindNXDomain
+)
+
+type zoneEntry struct {
+	kind   entryKind
+	keys   []*dns.DNSKEY
+	expire time.Time
+}
+
+func newValidator(lookup lookupFunc, anchors []*dns.DS, ntas []string) *validator {
+	v := &validator{
+		lookup:  lookup,
+		anchors: make(map[string]*rrset),
+		now:     time.Now,
+		zones:   make(map[string]*zoneEntry),
+	}
+	for _, ds := range anchors {
+		zone := dns.CanonicalName(ds.Hdr.Name)
+		s := v.anchors[zone]
+		if s == nil {
+			s = &rrset{name: zone, rtype: dns.TypeDS}
+			v.anchors[zone] = s
+		}
+		s.rrs = append(s.rrs, ds)
+	}
+	for _, n := range ntas {
+		v.ntas = append(v.ntas, dns.CanonicalName(n))
+	}
+	return v
+}
+
+// validate validates r, the response of q.
+// If the result is resultBogus, the error explains why.
+func (v *validator) validate(ctx context.Context, q dns.Question, r *dns.Msg) (result, error) {
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return resultInsecure, nil
+	}
+	if v.isNTA(q.Name) {
+		return resultInsecure, nil
+	}
+
+	res := resultSecure
+	answer, ns := rrsets(r.Answer), rrsets(r.Ns)
+	for i, s := range append(answer, ns...) {
+		inNs := i >= len(answer)
+		if v.isNTA(s.name) {
+			res = resultInsecure
+			continue
+		}
+		if len(s.sigs) == 0 {
+			if inNs && s.rtype == dns.TypeNS {
+				continue // delegation, never signed.
+			}
+			_, keys, err := v.walk(ctx, s.name)
+			if err != nil {
+				return resultBogus, err
+			}
+			if keys == nil {
+				res = resultInsecure
+				continue
+			}
+			return resultBogus, fmt.Errorf("missing signature of %s %s", s.name, dns.TypeToString[s.rtype])
+		}
+
+		signer := dns.CanonicalName(s.sigs[0].SignerName)
+		if !dns.IsSubDomain(signer, s.name) {
+			return resultBogus, fmt.Errorf("signer %s of %s is out of zone", signer, s.name)
+		}
+		zone, keys, err := v.walk(ctx, signer)
+		if err != nil {
+			return resultBogus, err
+		}
+		if keys == nil {
+			res = resultInsecure
+			continue
+		}
+		if zone != signer {
+			return resultBogus, fmt.Errorf("signer %s of %s is not a zone", signer, s.name)
+		}
+		if err := v.verifySet(s, zone, keys); err != nil {
+			return resultBogus, err
+		}
+	}
+
+	// Negative responses from secure zones must have a signed denial.
+	if res == resultSecure && len(r.Answer) == 0 {
+		if len(ns) == 0 {
+			_, keys, err := v.walk(ctx, q.Name)
+			if err != nil {
+				return resultBogus, err
+			}
+			if keys == nil {
+				return resultInsecure, nil
+			}
+		}
+		if !hasDenial(ns) {
+			return resultBogus, fmt.Errorf("missing denial of existence of %s", q.Name)
+		}
+	}
+	return res, nil
+}
+
+// walk finds the closest enclosing zone of name by following the chain of
+// trust from the closest trust anchor. It returns the zone and its keys.
+// keys is nil if name is not covered by a secure zone.
+func (v *validator) walk(ctx context.Context, name string) (string, []*dns.DNSKEY, error) {
+	name = dns.CanonicalName(name)
+	zone := v.closestAnchor(name)
+	if len(zone) == 0 || v.isNTA(zone) {
+		return "", nil, nil
+	}
+	e, err := v.anchorKeys(ctx, zone)
+	if err != nil {
+		return "", nil, err
+	}
+	if e.kind != kindSecure {
+		return zone, nil, nil
+	}
+	keys := e.keys
+
+	labels := dns.Split(name)
+	for i := len(labels) - dns.CountLabel(zone) - 1; i >= 0; i-- {
+		child := name[labels[i]:]
+		if v.isNTA(child) {
+			return child, nil, nil
+		}
+		e, err := v.step(ctx, zone, keys, child)
+		if err != nil {
+			return "", nil, err
+		}
+		switch e.kind {
+		case kindSecure:
+			zone, keys = child, e.keys
+		case kindInsecure:
+			return child, nil, nil
+		case kindNXDomain:
+			return zone, keys, nil
+		}
+	}
+	return zone, keys, nil
+}
+
+// anchorKeys returns the keys of zone that match its trust anchor.
+func (v *validator) anchorKeys(ctx context.Context, zone string) (*zoneEntry, error) {
+	if e := v.cached(zone); e != nil {
+		return e, nil
+	}
+	e, err := v.keysFromDS(ctx, zone, v.anchors[zone])
+	if err != nil {
+		return nil, err
+	}
+	v.store(zone, e)
+	return e, nil
+}
+
+// step queries the DS of child, whose parent zone is zone.
+func (v *validator) step(ctx context.Context, zone string, keys []*dns.DNSKEY, child string) (*zoneEntry, error) {
+	if e := v.cached(child); e != nil {
+		return e, nil
+	}
+	r, err := v.lookup(ctx, child, dns.TypeDS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query DS of %s, %w", child, err)
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("DS query of %s got rcode %s", child, dns.RcodeToString[r.Rcode])
+	}
+
+	var e *zoneEntry
+	if ds := findSet(rrsets(r.Answer), child, dns.TypeDS); ds != nil {
+		if err := v.verifySet(ds, zone, keys); err != nil {
+			return nil, err
+		}
+		e, err = v.keysFromDS(ctx, child, ds)
+	} else {
+		e, err = v.denial(zone, keys, child, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.store(child, e)
+	return e, nil
+}
+
+// keysFromDS fetches the DNSKEY of zone and validates it with ds.
+func (v *validator) keysFromDS(ctx context.Context, zone string, ds *rrset) (*zoneEntry, error) {
+	if !hasSupportedDS(ds) {
+		return &zoneEntry{kind: kindInsecure, expire: v.expire(ds)}, nil
+	}
+	r, err := v.lookup(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query DNSKEY of %s, %w", zone, err)
+	}
+	s := findSet(rrsets(r.Answer), zone, dns.TypeDNSKEY)
+	if s == nil {
+		return nil, fmt.Errorf("missing DNSKEY of %s", zone)
+	}
+	keys := make([]*dns.DNSKEY, 0, len(s.rrs))
+	for _, rr := range s.rrs {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+
+	now := v.now()
+	for _, sig := range s.sigs {
+		if dns.CanonicalName(sig.SignerName) != zone || !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm || !matchDS(k, ds) {
+				continue
+			}
+			if sig.Verify(k, s.rrs) == nil {
+				return &zoneEntry{kind: kindSecure, keys: keys, expire: v.expire(ds, s)}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no DNSKEY of %s matches its DS", zone)
+}
+
+// denial checks the proof that child, whose parent zone is zone, has no DS.
+func (v *validator) denial(zone string, keys []*dns.DNSKEY, child string, r *dns.Msg) (*zoneEntry, error) {
+	sets := rrsets(r.Ns)
+	kind := kindNotCut
+	denied := false
+	for _, s := range sets {
+		if len(s.sigs) == 0 && s.rtype == dns.TypeNS {
+			continue
+		}
+		if err := v.verifySet(s, zone, keys); err != nil {
+			return nil, err
+		}
+		for _, rr := range s.rrs {
+			var types []uint16
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				denied = true
+				if dns.CanonicalName(rr.Hdr.Name) != child {
+					continue
+				}
+				types = rr.TypeBitMap
+			case *dns.NSEC3:
+				denied = true
+				if !rr.Match(child) {
+					if rr.Cover(child) && rr.Flags&1 == 1 { // opt-out
+						kind = kindInsecure
+					}
+					continue
+				}
+				types = rr.TypeBitMap
+			default:
+				continue
+			}
+			if hasType(types, dns.TypeDS) {
+				return nil, fmt.Errorf("DS of %s is denied but exists", child)
+			}
+			if hasType(types, dns.TypeNS) {
+				kind = kindInsecure
+			}
+		}
+	}
+	if !denied {
+		return nil, fmt.Errorf("missing denial of DS of %s", child)
+	}
+	if kind == kindNotCut && r.Rcode == dns.RcodeNameError {
+		kind = kindNXDomain
+	}
+	return &zoneEntry{kind: kind, expire: v.expire(sets...)}, nil
+}
+
+var errNoValidSig = errors.New("no valid signature")
+
+// verifySet verifies s with the keys of zone.
+func (v *validator) verifySet(s *rrset, zone string, keys []*dns.DNSKEY) error {
+	now := v.now()
+	for _, sig := range s.sigs {
+		if dns.CanonicalName(sig.SignerName) != zone || !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() == sig.KeyTag && k.Algorithm == sig.Algorithm && sig.Verify(k, s.rrs) == nil {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w of %s %s", errNoValidSig, s.name, dns.TypeToString[s.rtype])
+}
+
+func (v *validator) closestAnchor(name string) string {
+	var zone string
+	for z := range v.anchors {
+		if dns.IsSubDomain(z, name) && (len(zone) == 0 || dns.CountLabel(z) > dns.CountLabel(zone)) {
+			zone = z
+		}
+	}
+	return zone
+}
+
+func (v *validator) isNTA(name string) bool {
+	for _, nta := range v.ntas {
+		if dns.IsSubDomain(nta, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *validator) cached(name string) *zoneEntry {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	e := v.zones[name]
+	if e == nil || v.now().After(e.expire) {
+		return nil
+	}
+	return e
+}
+
+func (v *validator) store(name string, e *zoneEntry) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.zones) >= maxCacheEntries {
+		now := v.now()
+		for n, e := range v.zones {
+			if now.After(e.expire) {
+				delete(v.zones, n)
+			}
+		}
+		if len(v.zones) >= maxCacheEntries {
+			clear(v.zones)
+		}
+	}
+	v.zones[name] = e
+}
+
+// expire returns the expire time of an entry built from sets.
+func (v *validator) expire(sets ...*rrset) time.Time {
+	ttl := maxCacheTTL
+	for _, s := range sets {
+		for _, rr := range s.rrs {
+			if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+				ttl = t
+			}
+		}
+	}
+	if ttl < minCacheTTL {
+		ttl = minCacheTTL
+	}
+	return v.now().Add(ttl)
+}
+
+// rrset is a set of records with the same name and type, and their
+// signatures.
+type rrset struct {
+	name  string // canonical
+	rtype uint16
+	rrs   []dns.RR
+	sigs  []*dns.RRSIG
+}
+
+// rrsets groups rrs into rrsets. OPT records and signatures without
+// records are ignored.
+func rrsets(rrs []dns.RR) []*rrset {
+	var sets []*rrset
+	get := func(name string, rtype uint16) *rrset {
+		name = dns.CanonicalName(name)
+		if s := findSet(sets, name, rtype); s != nil {
+			return s
+		}
+		s := &rrset{name: name, rtype: rtype}
+		sets = append(sets, s)
+		return s
+	}
+	for _, rr := range rrs {
+		h := rr.Header()
+		switch rr := rr.(type) {
+		case *dns.OPT:
+		case *dns.RRSIG:
+			s := get(h.Name, rr.TypeCovered)
+			s.sigs = append(s.sigs, rr)
+		default:
+			s := get(h.Name, h.Rrtype)
+			s.rrs = append(s.rrs, rr)
+		}
+	}
+	n := 0
+	for _, s := range sets {
+		if len(s.rrs) > 0 {
+			sets[n] = s
+			n++
+		}
+	}
+	return sets[:n]
+}
+
+// findSet finds the rrset of name (canonical) and rtype in sets.
+func findSet(sets []*rrset, name string, rtype uint16) *rrset {
+	for _, s := range sets {
+		if s.rtype == rtype && s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func hasDenial(sets []*rrset) bool {
+	for _, s := range sets {
+		if s.rtype == dns.TypeNSEC || s.rtype == dns.TypeNSEC3 {
+			return true
+		}
+	}
+	return false
+}
+
+func hasType(types []uint16, t uint16) bool {
+	for _, tt := range types {
+		if tt == t {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDS(k *dns.DNSKEY, ds *rrset) bool {
+	for _, rr := range ds.rrs {
+		d := rr.(*dns.DS)
+		if d.KeyTag != k.KeyTag() || d.Algorithm != k.Algorithm {
+			continue
+		}
+		if kd := k.ToDS(d.DigestType); kd != nil && strings.EqualFold(kd.Digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSupportedDS reports whether ds has a record that can be validated.
+// Zones that only have unsupported algorithms are treated as insecure
+// (RFC 4035 5.2).
+func hasSupportedDS(ds *rrset) bool {
+	for _, rr := range ds.rrs {
+		d := rr.(*dns.DS)
+		switch d.Algorithm {
+		case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+			dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		default:
+			continue
+		}
+		switch d.DigestType {
+		case dns.SHA1, dns.SHA256, dns.SHA384:
+			return true
+		}
+	}
+	return false
+}
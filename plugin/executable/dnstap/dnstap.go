@@ -0,0 +1,375 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const PluginType = "dnstap"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const (
+	defaultBufferSize = 1024
+	dialTimeout       = time.Second * 5
+	maxRetryInterval  = time.Second * 30
+	stopTimeout       = time.Second
+)
+
+type Args struct {
+	// Unix is the path of a unix socket, e.g. /var/run/dnstap.sock.
+	Unix string `yaml:"unix"`
+	// TCP is a tcp address, e.g. 127.0.0.1:6000. One of Unix and TCP
+	// is required.
+	TCP string `yaml:"tcp"`
+
+	// Identity is the server identity in frames. Default is the hostname.
+	Identity string `yaml:"identity"`
+	// Resolver also logs RESOLVER_QUERY/RESOLVER_RESPONSE frames of the
+	// exchanges of forward plugins after this plugin.
+	Resolver bool `yaml:"resolver"`
+	// BufferSize is the number of frames buffered while the collector is
+	// slow or disconnected. More frames are dropped. Default is 1024.
+	BufferSize int `yaml:"buffer_size"`
+}
+
+var _ sequence.RecursiveExecutable = (*Dnstap)(nil)
+var _ query_context.UpstreamObserver = (*Dnstap)(nil)
+
+// Dnstap sends CLIENT_QUERY/CLIENT_RESPONSE frames of queries that pass
+// through it, and optionally RESOLVER_* frames of upstream exchanges, to
+// a dnstap collector over a bidirectional Frame Streams connection.
+// Frames never block queries. They are dropped if the buffer is full.
+type Dnstap struct {
+	network, addr string
+	identity      string
+	version       string
+	resolver      bool
+	logger        *zap.Logger
+
+	frames chan []byte
+
+	sentTotal    prometheus.Counter
+	droppedTotal prometheus.Counter
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	done        chan struct{}
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	d, err := NewDnstap(args.(*Args), bp.Tag(), bp.L())
+	if err != nil {
+		return nil, err
+	}
+	if err := d.RegMetricsTo(prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg())); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("failed to register metrics, %w", err)
+	}
+	return d, nil
+}
+
+// NewDnstap starts connecting to the collector. tag is the metrics label.
+// logger can be nil.
+func NewDnstap(args *Args, tag string, logger *zap.Logger) (*Dnstap, error) {
+	lb := map[string]string{"tag": tag}
+	d := &Dnstap{
+		identity:    args.Identity,
+		version:     "mosdns " + coremain.GetBuildVersion(),
+		resolver:    args.Resolver,
+		logger:      logger,
+		closeNotify: make(chan struct{}),
+		done:        make(chan struct{}),
+		sentTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "sent_total",
+			Help:        "The total number of frames sent to the collector",
+			ConstLabels: lb,
+		}),
+		droppedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "dropped_total",
+			Help:        "The total number of frames dropped because the buffer was full",
+			ConstLabels: lb,
+		}),
+	}
+	switch {
+	case len(args.Unix) > 0 && len(args.TCP) > 0:
+		return nil, errors.New("unix and tcp cannot be both set")
+	case len(args.Unix) > 0:
+		d.network, d.addr = "unix", args.Unix
+	case len(args.TCP) > 0:
+		d.network, d.addr = "tcp", args.TCP
+	default:
+		return nil, errors.New("missing unix or tcp address")
+	}
+	if len(d.identity) == 0 {
+		d.identity, _ = os.Hostname()
+	}
+	size := args.BufferSize
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	d.frames = make(chan []byte, size)
+	if d.logger == nil {
+		d.logger = zap.NewNop()
+	}
+	go d.run()
+	return d, nil
+}
+
+func (d *Dnstap) RegMetricsTo(r prometheus.Registerer) error {
+	for _, c := range [...]prometheus.Collector{d.sentTotal, d.droppedTotal} {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Dnstap) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	meta := qCtx.ServerMeta
+	m := &message{
+		protocol:  clientProtocol(meta),
+		queryAddr: netip.AddrPortFrom(meta.ClientAddr, 0),
+		queryTime: qCtx.StartTime(),
+	}
+	if q, err := qCtx.Q().Pack(); err == nil {
+		m.typ = msgClientQuery
+		m.query = q
+		d.send(m)
+	}
+
+	if d.resolver {
+		qCtx.StoreValue(query_context.KeyUpstreamObserver, d)
+	}
+	err := next.ExecNext(ctx, qCtx)
+
+	if r := qCtx.R(); r != nil {
+		if b, packErr := r.Pack(); packErr == nil {
+			m.typ = msgClientResponse
+			m.respTime = time.Now()
+			m.resp = b
+			d.send(m)
+		}
+	}
+	return err
+}
+
+// ObserveUpstream implements query_context.UpstreamObserver.
+func (d *Dnstap) ObserveUpstream(upstream string, q []byte, qTime time.Time, r []byte, rTime time.Time) {
+	protocol, addr := parseUpstream(upstream)
+	m := &message{
+		typ:       msgResolverQuery,
+		protocol:  protocol,
+		respAddr:  addr,
+		queryTime: qTime,
+		query:     q,
+	}
+	d.send(m)
+	if r != nil {
+		m.typ = msgResolverResponse
+		m.respTime = rTime
+		m.resp = r
+		d.send(m)
+	}
+}
+
+// send encodes m and queues it without blocking.
+func (d *Dnstap) send(m *message) {
+	select {
+	case d.frames <- appendDnstap(nil, d.identity, d.version, m):
+	default:
+		d.droppedTotal.Inc()
+	}
+}
+
+// run connects to the collector and writes frames until d is closed.
+// It reconnects after errors.
+func (d *Dnstap) run() {
+	defer close(d.done)
+	retry := time.Second
+	for {
+		err := d.serve()
+		if err == nil { // closed
+			return
+		}
+		d.logger.Warn("dnstap connection failed", zap.String("addr", d.addr), zap.Error(err), zap.Duration("retry_in", retry))
+		select {
+		case <-time.After(retry):
+		case <-d.closeNotify:
+			return
+		}
+		retry = min(retry*2, maxRetryInterval)
+	}
+}
+
+// serve writes frames to a new connection. It returns nil if d is closed.
+func (d *Dnstap) serve() error {
+	c, err := net.DialTimeout(d.network, d.addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(dialTimeout))
+	if err := handshake(c); err != nil {
+		return fmt.Errorf("handshake failed, %w", err)
+	}
+	c.SetDeadline(time.Time{})
+	d.logger.Info("dnstap connected", zap.String("addr", d.addr))
+
+	// The collector only sends FINISH after STOP. Anything else, e.g.
+	// EOF, means the connection is broken.
+	readErr := make(chan error, 1)
+	stopped := make(chan struct{})
+	go func() {
+		typ, err := readControl(c)
+		select {
+		case <-stopped:
+			if err == nil && typ != fsControlFinish {
+				err = fmt.Errorf("want FINISH frame, got type %d", typ)
+			}
+			readErr <- err
+		default:
+			if err == nil {
+				err = fmt.Errorf("unexpected control frame type %d", typ)
+			}
+			readErr <- err
+			c.Close()
+		}
+	}()
+
+	bw := bufio.NewWriter(c)
+	for {
+		select {
+		case b := <-d.frames:
+			// Don't get stuck if the collector stops reading.
+			c.SetWriteDeadline(time.Now().Add(dialTimeout))
+			if err := writeDataFrame(bw, b); err != nil {
+				return err
+			}
+			if len(d.frames) == 0 {
+				if err := bw.Flush(); err != nil {
+					return err
+				}
+			}
+			d.sentTotal.Inc()
+		case err := <-readErr:
+			return err
+		case <-d.closeNotify:
+			close(stopped)
+			c.SetDeadline(time.Now().Add(stopTimeout))
+			for len(d.frames) > 0 {
+				if err := writeDataFrame(bw, <-d.frames); err != nil {
+					return nil
+				}
+				d.sentTotal.Inc()
+			}
+			if err := writeControl(bw, fsControlStop); err != nil {
+				return nil
+			}
+			if err := bw.Flush(); err != nil {
+				return nil
+			}
+			<-readErr // wait for FINISH
+			return nil
+		}
+	}
+}
+
+// Close sends the buffered frames and stops the stream.
+func (d *Dnstap) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.closeNotify)
+		<-d.done
+	})
+	return nil
+}
+
+func clientProtocol(meta query_context.ServerMeta) uint64 {
+	switch meta.Protocol {
+	case server.ProtocolUDP:
+		return protocolUDP
+	case server.ProtocolTCP:
+		return protocolTCP
+	case server.ProtocolTLS:
+		return protocolDOT
+	case server.ProtocolHTTP, server.ProtocolHTTPS:
+		return protocolDOH
+	case server.ProtocolQUIC:
+		return protocolDOQ
+	}
+	if meta.FromUDP {
+		return protocolUDP
+	}
+	return 0
+}
+
+// parseUpstream returns the protocol and the address of an upstream
+// address in forward config, e.g. "tls://1.1.1.1". The address is
+// invalid if the upstream is a domain name.
+func parseUpstream(s string) (uint64, netip.AddrPort) {
+	scheme, host := "udp", s
+	if i := strings.Index(s, "://"); i >= 0 {
+		scheme = strings.ToLower(s[:i])
+		if u, err := url.Parse(s); err == nil {
+			host = u.Host
+		}
+	}
+	var protocol uint64
+	var port uint16
+	switch scheme {
+	case "udp", "udpme":
+		protocol, port = protocolUDP, 53
+	case "tcp", "tcp+pipeline":
+		protocol, port = protocolTCP, 53
+	case "tls", "tls+pipeline":
+		protocol, port = protocolDOT, 853
+	case "https", "h3":
+		protocol, port = protocolDOH, 443
+	case "quic", "doq":
+		protocol, port = protocolDOQ, 853
+	}
+	if ap, err := netip.ParseAddrPort(host); err == nil {
+		return protocol, ap
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return protocol, netip.AddrPortFrom(addr, port)
+	}
+	return protocol, netip.AddrPort{}
+}
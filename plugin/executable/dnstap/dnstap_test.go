@@ -0,0 +1,175 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// collector is a bidirectional Frame Streams reader. It sends the
+// message types of received frames to types.
+func collector(t *testing.T, l net.Listener, types chan<- uint64) {
+	c, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	if typ, err := readControl(c); err != nil || typ != fsControlReady {
+		t.Errorf("want READY, got %d, %v", typ, err)
+		return
+	}
+	if err := writeControl(c, fsControlAccept); err != nil {
+		t.Error(err)
+		return
+	}
+	if typ, err := readControl(c); err != nil || typ != fsControlStart {
+		t.Errorf("want START, got %d, %v", typ, err)
+		return
+	}
+	for {
+		var h [4]byte
+		if _, err := io.ReadFull(c, h[:]); err != nil {
+			t.Error(err)
+			return
+		}
+		n := binary.BigEndian.Uint32(h[:])
+		if n == 0 { // control frame
+			var lb [4]byte
+			io.ReadFull(c, lb[:])
+			body := make([]byte, binary.BigEndian.Uint32(lb[:]))
+			io.ReadFull(c, body)
+			if binary.BigEndian.Uint32(body) == fsControlStop {
+				writeControl(c, fsControlFinish)
+				close(types)
+				return
+			}
+			continue
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Error(err)
+			return
+		}
+		types <- messageType(t, b)
+	}
+}
+
+func messageType(t *testing.T, b []byte) uint64 {
+	t.Helper()
+	var typ uint64
+	for len(b) > 0 {
+		num, wt, n := protowire.ConsumeTag(b)
+		b = b[n:]
+		if num == fieldMessage && wt == protowire.BytesType {
+			msg, _ := protowire.ConsumeBytes(b)
+			_, _, tn := protowire.ConsumeTag(msg)
+			typ, _ = protowire.ConsumeVarint(msg[tn:])
+		}
+		b = b[protowire.ConsumeFieldValue(num, wt, b):]
+	}
+	return typ
+}
+
+type setResp struct{}
+
+func (setResp) Exec(_ context.Context, qCtx *query_context.Context) error {
+	v, _ := qCtx.GetValue(query_context.KeyUpstreamObserver)
+	if o, ok := v.(query_context.UpstreamObserver); ok {
+		q, _ := qCtx.Q().Pack()
+		o.ObserveUpstream("tls://1.1.1.1", q, time.Now(), q, time.Now())
+	}
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func TestDnstap(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "dnstap.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	types := make(chan uint64, 16)
+	go collector(t, l, types)
+
+	d, err := NewDnstap(&Args{Unix: sock, Resolver: true}, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q)
+	qCtx.ServerMeta = query_context.ServerMeta{ClientAddr: netip.MustParseAddr("10.0.0.2"), Protocol: server.ProtocolUDP}
+	next := sequence.NewChainWalker([]*sequence.ChainNode{{E: setResp{}}}, nil, zap.NewNop())
+	if err := d.Exec(context.Background(), qCtx, next); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	var got []uint64
+	for typ := range types {
+		got = append(got, typ)
+	}
+	want := []uint64{msgClientQuery, msgResolverQuery, msgResolverResponse, msgClientResponse}
+	if len(got) != len(want) {
+		t.Fatalf("got frames %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got frames %v, want %v", got, want)
+		}
+	}
+}
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		s        string
+		protocol uint64
+		addr     string
+	}{
+		{"8.8.8.8", protocolUDP, "8.8.8.8:53"},
+		{"tcp://8.8.8.8:5353", protocolTCP, "8.8.8.8:5353"},
+		{"tls://[2606:4700::1111]", protocolDOT, "[2606:4700::1111]:853"},
+		{"https://dns.google/dns-query", protocolDOH, "invalid AddrPort"},
+		{"quic://1.1.1.1", protocolDOQ, "1.1.1.1:853"},
+	}
+	for _, tt := range tests {
+		p, ap := parseUpstream(tt.s)
+		if p != tt.protocol || ap.String() != tt.addr {
+			t.Errorf("parseUpstream(%s) = %d %s, want %d %s", tt.s, p, ap, tt.protocol, tt.addr)
+		}
+	}
+}
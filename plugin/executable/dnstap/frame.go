@@ -0,0 +1,250 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnstap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Frame Streams, see https://github.com/farsightsec/fstrm.
+const (
+	fsControlAccept = 0x01
+	fsControlStart  = 0x02
+	fsControlStop   = 0x03
+	fsControlReady  = 0x04
+	fsControlFinish = 0x05
+
+	fsFieldContentType = 0x01
+
+	fsMaxControlSize = 512
+
+	contentType = "protobuf:dnstap.Dnstap"
+)
+
+// writeControl writes a control frame. All frames we write, except
+// FINISH, have the content type field.
+func writeControl(w io.Writer, typ uint32) error {
+	var b []byte
+	b = binary.BigEndian.AppendUint32(b, 0) // escape
+	body := binary.BigEndian.AppendUint32(nil, typ)
+	if typ != fsControlFinish && typ != fsControlStop {
+		body = binary.BigEndian.AppendUint32(body, fsFieldContentType)
+		body = binary.BigEndian.AppendUint32(body, uint32(len(contentType)))
+		body = append(body, contentType...)
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(len(body)))
+	b = append(b, body...)
+	_, err := w.Write(b)
+	return err
+}
+
+// readControl reads a control frame and returns its type. A frame
+// with a content type other than ours is an error.
+func readControl(r io.Reader) (uint32, error) {
+	var h [8]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(h[:4]) != 0 {
+		return 0, errors.New("not a control frame")
+	}
+	n := binary.BigEndian.Uint32(h[4:])
+	if n < 4 || n > fsMaxControlSize {
+		return 0, fmt.Errorf("invalid control frame length %d", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, err
+	}
+	typ := binary.BigEndian.Uint32(body)
+	fields := body[4:]
+	for len(fields) >= 8 {
+		ft, fl := binary.BigEndian.Uint32(fields), binary.BigEndian.Uint32(fields[4:])
+		fields = fields[8:]
+		if uint32(len(fields)) < fl {
+			return 0, errors.New("invalid control field length")
+		}
+		if ft == fsFieldContentType && string(fields[:fl]) != contentType {
+			return 0, fmt.Errorf("unsupported content type %q", fields[:fl])
+		}
+		fields = fields[fl:]
+	}
+	return typ, nil
+}
+
+// handshake starts a bidirectional stream as the writer.
+func handshake(rw io.ReadWriter) error {
+	if err := writeControl(rw, fsControlReady); err != nil {
+		return err
+	}
+	typ, err := readControl(rw)
+	if err != nil {
+		return err
+	}
+	if typ != fsControlAccept {
+		return fmt.Errorf("want ACCEPT frame, got type %d", typ)
+	}
+	return writeControl(rw, fsControlStart)
+}
+
+func writeDataFrame(w *bufio.Writer, b []byte) error {
+	var h [4]byte
+	binary.BigEndian.PutUint32(h[:], uint32(len(b)))
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// Field numbers and enum values of dnstap.proto.
+const (
+	fieldIdentity = 1
+	fieldVersion  = 2
+	fieldMessage  = 14
+	fieldType     = 15
+
+	fieldMsgType             = 1
+	fieldMsgSocketFamily     = 2
+	fieldMsgSocketProtocol   = 3
+	fieldMsgQueryAddress     = 4
+	fieldMsgResponseAddress  = 5
+	fieldMsgQueryPort        = 6
+	fieldMsgResponsePort     = 7
+	fieldMsgQueryTimeSec     = 8
+	fieldMsgQueryTimeNsec    = 9
+	fieldMsgQueryMessage     = 10
+	fieldMsgResponseTimeSec  = 12
+	fieldMsgResponseTimeNsec = 13
+	fieldMsgResponseMessage  = 14
+
+	typeMessage = 1
+
+	msgResolverQuery    = 3
+	msgResolverResponse = 4
+	msgClientQuery      = 5
+	msgClientResponse   = 6
+
+	familyINET  = 1
+	familyINET6 = 2
+
+	protocolUDP = 1
+	protocolTCP = 2
+	protocolDOT = 3
+	protocolDOH = 4
+	protocolDOQ = 7
+)
+
+// message is a dnstap Message. Zero fields are omitted.
+type message struct {
+	typ       uint64
+	protocol  uint64
+	queryAddr netip.AddrPort // client of CLIENT_*
+	respAddr  netip.AddrPort // upstream of RESOLVER_*
+	queryTime time.Time
+	respTime  time.Time
+	query     []byte
+	resp      []byte
+}
+
+// appendDnstap appends the Dnstap frame of m to b.
+func appendDnstap(b []byte, identity, version string, m *message) []byte {
+	if len(identity) > 0 {
+		b = protowire.AppendTag(b, fieldIdentity, protowire.BytesType)
+		b = protowire.AppendString(b, identity)
+	}
+	if len(version) > 0 {
+		b = protowire.AppendTag(b, fieldVersion, protowire.BytesType)
+		b = protowire.AppendString(b, version)
+	}
+	b = protowire.AppendTag(b, fieldType, protowire.VarintType)
+	b = protowire.AppendVarint(b, typeMessage)
+	b = protowire.AppendTag(b, fieldMessage, protowire.BytesType)
+	return protowire.AppendBytes(b, m.marshal())
+}
+
+func (m *message) marshal() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, fieldMsgType, protowire.VarintType)
+	b = protowire.AppendVarint(b, m.typ)
+
+	family := uint64(0)
+	for _, ap := range [...]netip.AddrPort{m.queryAddr, m.respAddr} {
+		if ap.Addr().IsValid() {
+			family = familyINET
+			if ap.Addr().Unmap().Is6() {
+				family = familyINET6
+			}
+			break
+		}
+	}
+	if family != 0 {
+		b = protowire.AppendTag(b, fieldMsgSocketFamily, protowire.VarintType)
+		b = protowire.AppendVarint(b, family)
+	}
+	if m.protocol != 0 {
+		b = protowire.AppendTag(b, fieldMsgSocketProtocol, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.protocol)
+	}
+	b = appendAddr(b, fieldMsgQueryAddress, fieldMsgQueryPort, m.queryAddr)
+	b = appendAddr(b, fieldMsgResponseAddress, fieldMsgResponsePort, m.respAddr)
+	b = appendTime(b, fieldMsgQueryTimeSec, fieldMsgQueryTimeNsec, m.queryTime)
+	if m.query != nil {
+		b = protowire.AppendTag(b, fieldMsgQueryMessage, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.query)
+	}
+	b = appendTime(b, fieldMsgResponseTimeSec, fieldMsgResponseTimeNsec, m.respTime)
+	if m.resp != nil {
+		b = protowire.AppendTag(b, fieldMsgResponseMessage, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.resp)
+	}
+	return b
+}
+
+func appendAddr(b []byte, addrField, portField protowire.Number, ap netip.AddrPort) []byte {
+	if !ap.Addr().IsValid() {
+		return b
+	}
+	b = protowire.AppendTag(b, addrField, protowire.BytesType)
+	b = protowire.AppendBytes(b, ap.Addr().Unmap().AsSlice())
+	if ap.Port() != 0 {
+		b = protowire.AppendTag(b, portField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(ap.Port()))
+	}
+	return b
+}
+
+func appendTime(b []byte, secField, nsecField protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	b = protowire.AppendTag(b, secField, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(t.Unix()))
+	b = protowire.AppendTag(b, nsecField, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, uint32(t.Nanosecond()))
+}
@@ -357,17 +357,17 @@ func restartSelf() {
 func (d *domainOutput) Api() *chi.Mux {
 	r := chi.NewRouter()
 
-	r.Get("/flush", func(w http.ResponseWriter, req *http.Request) {
+	r.Get("/flush", coremain.AdminOnly(func(w http.ResponseWriter, req *http.Request) {
 		d.performWrite(WriteModeFlush)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("domain_output flushed and files rewritten."))
-	})
+	}))
 
-	r.Get("/save", func(w http.ResponseWriter, req *http.Request) {
+	r.Get("/save", coremain.AdminOnly(func(w http.ResponseWriter, req *http.Request) {
 		d.performWrite(WriteModeSave)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("domain_output files saved."))
-	})
+	}))
 
 	// GET /plugins/{tag}/show
 	// Directly reads from memory, sorts, and returns real-time statistics as plain text.
@@ -405,12 +405,12 @@ func (d *domainOutput) Api() *chi.Mux {
 		}
 	})
 
-	r.Get("/restartall", func(w http.ResponseWriter, req *http.Request) {
+	r.Get("/restartall", coremain.AdminOnly(func(w http.ResponseWriter, req *http.Request) {
 		d.performWrite(WriteModeSave)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("mosdns restarted"))
 		go restartSelf()
-	})
+	}))
 
 	return r
 }
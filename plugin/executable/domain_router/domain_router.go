@@ -0,0 +1,286 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain_router
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+const PluginType = "domain_router"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+type Args struct {
+	// Routes maps domains to the tags of executables (e.g. forward
+	// plugins). A domain also matches its subdomains.
+	Routes map[string]string `yaml:"routes"`
+	// Files are route files. Files ending with .yaml or .yml are yaml maps
+	// of domain to tag. Other files have lines of "domain tag" or dnsmasq's
+	// "server=/domain/.../tag".
+	Files []string `yaml:"files"`
+	// Default is the tag of the executable for queries that match no
+	// route. If empty, those queries are left untouched.
+	Default string `yaml:"default"`
+
+	// AutoReload watches Files and reloads them when they change.
+	AutoReload bool `yaml:"auto_reload"`
+}
+
+var _ sequence.Executable = (*Router)(nil)
+
+// Router dispatches queries to executables by the longest matching domain
+// suffix.
+type Router struct {
+	args   *Args
+	lookup func(tag string) sequence.Executable
+	t      atomic.Pointer[table]
+
+	w *utils.FileWatcher // nil if auto reload is disabled
+}
+
+type route struct {
+	tag string
+	e   sequence.Executable
+}
+
+type table struct {
+	m   *domain.SubDomainMatcher[*route]
+	def *route // maybe nil
+}
+
+// reloadDelay merges the burst of events of a file update.
+const reloadDelay = time.Millisecond * 500
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	lookup := func(tag string) sequence.Executable {
+		return sequence.ToExecutable(bp.M().GetPlugin(tag))
+	}
+	r, err := NewRouter(args.(*Args), lookup)
+	if err != nil {
+		return nil, err
+	}
+	if r.args.AutoReload && len(r.args.Files) > 0 {
+		r.watch(bp.L())
+	}
+	bp.L().Info("domain routes loaded", zap.Int("routes", r.t.Load().m.Len()))
+	bp.RegAPI(r.api())
+	return r, nil
+}
+
+// NewRouter loads the routes. lookup returns the executable of a tag, or
+// nil if it does not exist.
+func NewRouter(args *Args, lookup func(tag string) sequence.Executable) (*Router, error) {
+	r := &Router{args: args, lookup: lookup}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Router) watch(logger *zap.Logger) {
+	w, err := utils.NewFileWatcher(r.args.Files, reloadDelay, logger, func() {
+		if err := r.Reload(); err != nil {
+			logger.Warn("failed to reload domain routes, keep using the current one", zap.Error(err))
+			return
+		}
+		logger.Info("domain routes reloaded", zap.Int("routes", r.t.Load().m.Len()))
+	})
+	if err != nil {
+		logger.Warn("failed to watch route files, auto reload is disabled", zap.Error(err))
+		return
+	}
+	r.w = w
+}
+
+// Reload reloads the routes and files. The current routes are kept if
+// any of them is invalid.
+func (r *Router) Reload() error {
+	t := &table{m: domain.NewSubDomainMatcher[*route]()}
+	routes := make(map[string]*route) // tag -> route
+	add := func(d, tag string) error {
+		if len(d) == 0 || len(tag) == 0 {
+			return errors.New("empty domain or tag")
+		}
+		rt, ok := routes[tag]
+		if !ok {
+			e := r.lookup(tag)
+			if e == nil {
+				return fmt.Errorf("can not find executable %s", tag)
+			}
+			rt = &route{tag: tag, e: e}
+			routes[tag] = rt
+		}
+		return t.m.Add(d, rt)
+	}
+
+	for d, tag := range r.args.Routes {
+		if err := add(d, tag); err != nil {
+			return fmt.Errorf("invalid route %s, %w", d, err)
+		}
+	}
+	for i, file := range r.args.Files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read file #%d %s, %w", i, file, err)
+		}
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".yaml", ".yml":
+			var m map[string]string
+			if err := yaml.Unmarshal(b, &m); err != nil {
+				return fmt.Errorf("failed to load file #%d %s, %w", i, file, err)
+			}
+			for d, tag := range m {
+				if err := add(d, tag); err != nil {
+					return fmt.Errorf("failed to load file #%d %s, invalid route %s, %w", i, file, d, err)
+				}
+			}
+		default:
+			if err := loadLines(b, add); err != nil {
+				return fmt.Errorf("failed to load file #%d %s, %w", i, file, err)
+			}
+		}
+	}
+	if tag := r.args.Default; len(tag) > 0 {
+		e := r.lookup(tag)
+		if e == nil {
+			return fmt.Errorf("can not find default executable %s", tag)
+		}
+		t.def = &route{tag: tag, e: e}
+	}
+	r.t.Store(t)
+	return nil
+}
+
+// loadLines loads lines of "domain tag" or "server=/domain/.../tag".
+func loadLines(b []byte, add func(d, tag string) error) error {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	line := 0
+	for s.Scan() {
+		line++
+		text, _, _ := strings.Cut(s.Text(), "#")
+		text = strings.TrimSpace(text)
+		if len(text) == 0 {
+			continue
+		}
+		var domains []string
+		var tag string
+		if v, ok := strings.CutPrefix(text, "server="); ok {
+			fs := strings.Split(v, "/")
+			if len(fs) < 3 || len(fs[0]) > 0 {
+				return fmt.Errorf("line %d: invalid server line %s", line, text)
+			}
+			domains, tag = fs[1:len(fs)-1], fs[len(fs)-1]
+		} else {
+			fs := strings.Fields(text)
+			if len(fs) != 2 {
+				return fmt.Errorf("line %d: want \"domain tag\", got %s", line, text)
+			}
+			domains, tag = fs[:1], fs[1]
+		}
+		for _, d := range domains {
+			if err := add(d, tag); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+	}
+	return s.Err()
+}
+
+// Close stops watching the files.
+func (r *Router) Close() error {
+	if r.w != nil {
+		return r.w.Close()
+	}
+	return nil
+}
+
+// Route returns the tag of the executable for qname, or "" if none.
+func (r *Router) Route(qname string) string {
+	if rt := r.route(qname); rt != nil {
+		return rt.tag
+	}
+	return ""
+}
+
+func (r *Router) route(qname string) *route {
+	t := r.t.Load()
+	if rt, ok := t.m.Match(qname); ok {
+		return rt
+	}
+	return t.def
+}
+
+func (r *Router) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 {
+		return nil
+	}
+	if rt := r.route(q.Question[0].Name); rt != nil {
+		return rt.e.Exec(ctx, qCtx)
+	}
+	return nil
+}
+
+func (r *Router) api() *chi.Mux {
+	m := chi.NewRouter()
+
+	// GET /route?domain=example.com
+	m.Get("/route", func(w http.ResponseWriter, req *http.Request) {
+		d := req.URL.Query().Get("domain")
+		if len(d) == 0 {
+			http.Error(w, "missing domain", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"domain": d, "upstream": r.Route(d)})
+	})
+
+	// POST /reload reloads the routes and files.
+	m.Post("/reload", func(w http.ResponseWriter, req *http.Request) {
+		if err := r.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return m
+}
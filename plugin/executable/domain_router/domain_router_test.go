@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package domain_router
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+// tagExec records the tag of the last executed upstream.
+type tagExec struct {
+	tag  string
+	last *string
+}
+
+func (e *tagExec) Exec(_ context.Context, _ *query_context.Context) error {
+	*e.last = e.tag
+	return nil
+}
+
+func Test_Router(t *testing.T) {
+	dir := t.TempDir()
+	txt := filepath.Join(dir, "routes.conf")
+	yml := filepath.Join(dir, "routes.yaml")
+	if err := os.WriteFile(txt, []byte("# comment\nserver=/corp.example/lan.example/corp\ncn.example cn\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(yml, []byte("a.cn.example: overseas\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var last string
+	lookup := func(tag string) sequence.Executable {
+		switch tag {
+		case "corp", "cn", "overseas", "default":
+			return &tagExec{tag: tag, last: &last}
+		}
+		return nil
+	}
+	args := &Args{
+		Routes:  map[string]string{"example": "overseas"},
+		Files:   []string{txt, yml},
+		Default: "default",
+	}
+	r, err := NewRouter(args, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for qname, want := range map[string]string{
+		"www.corp.example.": "corp",
+		"lan.example.":      "corp",
+		"www.cn.example.":   "cn",
+		"b.a.cn.example.":   "overseas", // longest suffix
+		"other.example.":    "overseas",
+		"example.org.":      "default",
+	} {
+		last = ""
+		q := new(dns.Msg)
+		q.SetQuestion(qname, dns.TypeA)
+		if err := r.Exec(context.Background(), query_context.NewContext(q)); err != nil {
+			t.Fatal(err)
+		}
+		if last != want {
+			t.Errorf("%s: want %s, got %s", qname, want, last)
+		}
+	}
+
+	// Invalid files keep the current routes.
+	if err := os.WriteFile(txt, []byte("cn.example unknown\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("reload with an unknown tag should fail")
+	}
+	if got := r.Route("www.cn.example."); got != "cn" {
+		t.Fatalf("routes should be kept, got %s", got)
+	}
+}
@@ -51,6 +51,12 @@ type Args struct {
 	Preset  string `yaml:"preset"`
 	Mask4   int    `yaml:"mask4"`
 	Mask6   int    `yaml:"mask6"`
+
+	// Strip removes the ECS sent by the client from the client OPT (and any
+	// ECS already added to the query), so plugins after this one, e.g. another
+	// ecs_handler with forward or forward_edns0opt 8, cannot pass it to upstreams.
+	// preset or send can still add a new one.
+	Strip bool `yaml:"strip"`
 }
 
 type ECSHandler struct {
@@ -59,6 +65,9 @@ type ECSHandler struct {
 }
 
 func NewHandler(args Args) (*ECSHandler, error) {
+	if args.Forward && args.Strip {
+		return nil, errors.New("forward and strip cannot be both enabled")
+	}
 	var preset netip.Addr
 	if len(args.Preset) > 0 {
 		addr, err := netip.ParseAddr(args.Preset)
@@ -119,6 +128,12 @@ func (e *ECSHandler) Exec(ctx context.Context, qCtx *query_context.Context, next
 // AddECS adds a *dns.EDNS0_SUBNET record to q.
 func (e *ECSHandler) addECS(qCtx *query_context.Context) (forwarded bool) {
 	queryOpt := qCtx.QOpt()
+	if e.args.Strip {
+		if clientOpt := qCtx.ClientOpt(); clientOpt != nil {
+			removeECS(clientOpt)
+		}
+		removeECS(queryOpt)
+	}
 	// Check if query already has an ecs.
 	for _, o := range queryOpt.Option {
 		if o.Option() == dns.EDNS0SUBNET {
@@ -172,6 +187,17 @@ func (e *ECSHandler) addECS(qCtx *query_context.Context) (forwarded bool) {
 	return false
 }
 
+// removeECS removes all ECS options from opt.
+func removeECS(opt *dns.OPT) {
+	kept := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			kept = append(kept, o)
+		}
+	}
+	opt.Option = kept
+}
+
 func newSubnet(ip net.IP, mask uint8, v6 bool) *dns.EDNS0_SUBNET {
 	edns0Subnet := new(dns.EDNS0_SUBNET)
 	// edns family: https://www.iana.org/assignments/address-family-numbers/address-family-numbers.xhtml
@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ecs_handler
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// upstream records the ECS of the query it receives.
+type upstream struct {
+	ecs **dns.EDNS0_SUBNET
+}
+
+func (u upstream) Exec(_ context.Context, qCtx *query_context.Context) error {
+	for _, o := range qCtx.QOpt().Option {
+		if s, ok := o.(*dns.EDNS0_SUBNET); ok {
+			*u.ecs = s
+		}
+	}
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	qCtx.SetResponse(r)
+	return nil
+}
+
+// exec runs handlers in order with a client query that has ECS 1.2.3.0/24
+// and returns the ECS received by the upstream.
+func exec(t *testing.T, handlers ...*ECSHandler) (*dns.EDNS0_SUBNET, *query_context.Context) {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	opt := new(dns.OPT)
+	opt.Hdr.Name = "."
+	opt.Hdr.Rrtype = dns.TypeOPT
+	opt.Option = append(opt.Option, newSubnet(net.IPv4(1, 2, 3, 0).To4(), 24, false))
+	q.Extra = append(q.Extra, opt)
+	qCtx := query_context.NewContext(q)
+
+	var ecs *dns.EDNS0_SUBNET
+	var nodes []*sequence.ChainNode
+	for _, h := range handlers {
+		nodes = append(nodes, &sequence.ChainNode{RE: h})
+	}
+	nodes = append(nodes, &sequence.ChainNode{E: upstream{&ecs}})
+	cw := sequence.NewChainWalker(nodes, nil, zap.NewNop())
+	if err := cw.ExecNext(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	return ecs, qCtx
+}
+
+func mustHandler(t *testing.T, args Args) *ECSHandler {
+	t.Helper()
+	h, err := NewHandler(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestECSHandler_Strip(t *testing.T) {
+	forward := mustHandler(t, Args{Forward: true})
+	strip := mustHandler(t, Args{Strip: true})
+
+	// Without strip, the client ECS is forwarded.
+	ecs, _ := exec(t, forward)
+	if ecs == nil || ecs.Address.String() != "1.2.3.0" {
+		t.Fatalf("client ecs is not forwarded, got %v", ecs)
+	}
+
+	// With strip, later plugins cannot forward the client ECS.
+	ecs, qCtx := exec(t, strip, forward)
+	if ecs != nil {
+		t.Fatalf("client ecs is not stripped, upstream got %v", ecs)
+	}
+	for _, o := range qCtx.ClientOpt().Option {
+		if o.Option() == dns.EDNS0SUBNET {
+			t.Fatal("client opt still has ecs")
+		}
+	}
+
+	// A new ECS can still be added.
+	ecs, _ = exec(t, mustHandler(t, Args{Strip: true, Preset: "5.6.7.8"}), forward)
+	if ecs == nil || ecs.Address.String() != "5.6.7.8" || ecs.SourceNetmask != 24 {
+		t.Fatalf("want preset ecs 5.6.7.8/24, got %v", ecs)
+	}
+}
+
+func TestNewHandler(t *testing.T) {
+	for _, args := range []Args{{Forward: true, Strip: true}, {Mask4: 33}, {Mask6: -1}, {Preset: "x"}} {
+		if _, err := NewHandler(args); err == nil {
+			t.Errorf("want error for %+v", args)
+		}
+	}
+}
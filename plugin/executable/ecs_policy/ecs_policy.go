@@ -0,0 +1,197 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ecs_policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/domain_set"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "ecs_policy"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const (
+	actionStrip    = "strip"
+	actionTruncate = "truncate"
+)
+
+type Args struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule applies Action to the ECS of queries that match DomainSets or
+// Domains.
+type Rule struct {
+	DomainSets []string `yaml:"domain_sets"` // tags of domain providers
+	Domains    []string `yaml:"domains"`     // domain expressions
+
+	// Action is "strip" (default) or "truncate".
+	Action string `yaml:"action"`
+	// Masks used by "truncate". Defaults are 16 and 32.
+	Mask4 int `yaml:"mask4"`
+	Mask6 int `yaml:"mask6"`
+}
+
+var _ sequence.Executable = (*ECSPolicy)(nil)
+
+// ECSPolicy strips or truncates the ECS option of queries to sensitive
+// domains. It should be placed after ecs_handler, which adds the ECS.
+// The first matched rule applies. Queries that match no rule are
+// not modified.
+type ECSPolicy struct {
+	rules []rule
+}
+
+type rule struct {
+	matchers []domain.Matcher[struct{}]
+	strip    bool
+	mask4    uint8
+	mask6    uint8
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	lookup := func(tag string) (domain.Matcher[struct{}], error) {
+		provider, _ := bp.M().GetPlugin(tag).(data_provider.DomainMatcherProvider)
+		if provider == nil {
+			return nil, fmt.Errorf("%s is not a DomainMatcherProvider", tag)
+		}
+		return provider.GetDomainMatcher(), nil
+	}
+	return NewECSPolicy(*args.(*Args), lookup)
+}
+
+func NewECSPolicy(args Args, lookup func(tag string) (domain.Matcher[struct{}], error)) (*ECSPolicy, error) {
+	if len(args.Rules) == 0 {
+		return nil, errors.New("no rule is configured")
+	}
+	p := new(ECSPolicy)
+	for i, r := range args.Rules {
+		var nr rule
+		for _, tag := range r.DomainSets {
+			m, err := lookup(tag)
+			if err != nil {
+				return nil, fmt.Errorf("rule #%d: %w", i, err)
+			}
+			nr.matchers = append(nr.matchers, m)
+		}
+		if len(r.Domains) > 0 {
+			m := domain.NewMixMatcher[struct{}]()
+			m.SetDefaultMatcher(domain.MatcherDomain)
+			if err := domain_set.LoadExps(r.Domains, m); err != nil {
+				return nil, fmt.Errorf("rule #%d: %w", i, err)
+			}
+			nr.matchers = append(nr.matchers, m)
+		}
+		if len(nr.matchers) == 0 {
+			return nil, fmt.Errorf("rule #%d has no domain_sets or domains", i)
+		}
+
+		switch r.Action {
+		case "", actionStrip:
+			nr.strip = true
+		case actionTruncate:
+			if r.Mask4 < 0 || r.Mask4 > 32 {
+				return nil, fmt.Errorf("rule #%d: invalid mask4", i)
+			}
+			if r.Mask6 < 0 || r.Mask6 > 128 {
+				return nil, fmt.Errorf("rule #%d: invalid mask6", i)
+			}
+			nr.mask4, nr.mask6 = 16, 32
+			if r.Mask4 > 0 {
+				nr.mask4 = uint8(r.Mask4)
+			}
+			if r.Mask6 > 0 {
+				nr.mask6 = uint8(r.Mask6)
+			}
+		default:
+			return nil, fmt.Errorf("rule #%d: invalid action %s", i, r.Action)
+		}
+		p.rules = append(p.rules, nr)
+	}
+	return p, nil
+}
+
+func (p *ECSPolicy) Exec(_ context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 {
+		return nil
+	}
+	name := q.Question[0].Name
+	for _, r := range p.rules {
+		if r.match(name) {
+			r.apply(qCtx.QOpt())
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r *rule) match(name string) bool {
+	for _, m := range r.matchers {
+		if _, ok := m.Match(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) apply(opt *dns.OPT) {
+	kept := opt.Option[:0]
+	for _, o := range opt.Option {
+		ecs, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			kept = append(kept, o)
+			continue
+		}
+		if r.strip {
+			continue
+		}
+		truncate(ecs, r.mask4, r.mask6)
+		kept = append(kept, ecs)
+	}
+	opt.Option = kept
+}
+
+// truncate shortens the source prefix of ecs to mask4/mask6 and zeros
+// the address bits beyond it. Shorter prefixes are kept.
+func truncate(ecs *dns.EDNS0_SUBNET, mask4, mask6 uint8) {
+	mask, bits := mask4, 32
+	if ecs.Family == 2 {
+		mask, bits = mask6, 128
+	}
+	if ecs.SourceNetmask <= mask {
+		return
+	}
+	ecs.SourceNetmask = mask
+	ecs.Address = ecs.Address.Mask(net.CIDRMask(int(mask), bits))
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ecs_policy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+func Test_ECSPolicy(t *testing.T) {
+	bank := domain.NewMixMatcher[struct{}]()
+	if err := bank.Add("domain:bank.com", struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(tag string) (domain.Matcher[struct{}], error) {
+		if tag == "bank" {
+			return bank, nil
+		}
+		return nil, errors.New("not found")
+	}
+	p, err := NewECSPolicy(Args{Rules: []Rule{
+		{DomainSets: []string{"bank"}},
+		{Domains: []string{"health.org"}, Action: actionTruncate, Mask4: 16},
+	}}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec := func(name string) *dns.EDNS0_SUBNET {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		qCtx := query_context.NewContext(q)
+		qCtx.QOpt().Option = append(qCtx.QOpt().Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: 24,
+			Address:       net.IPv4(1, 2, 3, 0).To4(),
+		})
+		if err := p.Exec(context.Background(), qCtx); err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range qCtx.QOpt().Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				return ecs
+			}
+		}
+		return nil
+	}
+
+	if ecs := exec("www.bank.com."); ecs != nil {
+		t.Fatal("ecs should be stripped")
+	}
+	ecs := exec("a.health.org.")
+	if ecs == nil || ecs.SourceNetmask != 16 || !ecs.Address.Equal(net.IPv4(1, 2, 0, 0)) {
+		t.Fatalf("ecs should be truncated, got %v", ecs)
+	}
+	if ecs := exec("cdn.example.com."); ecs == nil || ecs.SourceNetmask != 24 {
+		t.Fatalf("ecs should be kept, got %v", ecs)
+	}
+
+	if _, err := NewECSPolicy(Args{Rules: []Rule{{DomainSets: []string{"missing"}}}}, lookup); err == nil {
+		t.Fatal("missing domain set should be rejected")
+	}
+}
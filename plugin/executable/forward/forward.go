@@ -24,8 +24,8 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"math/rand"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
@@ -59,8 +59,20 @@ type Args struct {
 	Socks5       string `yaml:"socks5"`
 	SoMark       int    `yaml:"so_mark"`
 	BindToDevice string `yaml:"bind_to_device"`
+	BindAddr     string `yaml:"bind_addr"`
 	Bootstrap    string `yaml:"bootstrap"`
 	BootstrapVer int    `yaml:"bootstrap_version"`
+
+	// Sanity enables extra verification of upstream responses. Optional.
+	Sanity *SanityConfig `yaml:"sanity"`
+
+	// Policy selects the upstreams to query. One of "random" (default),
+	// "fastest", "round_robin" and "weighted".
+	Policy string `yaml:"policy"`
+
+	// HealthCheck enables periodic probing and ejection of failed
+	// upstreams. Optional.
+	HealthCheck *HealthCheckConfig `yaml:"health_check"`
 }
 
 type UpstreamConfig struct {
@@ -77,15 +89,32 @@ type UpstreamConfig struct {
 	EnableHTTP3        bool `yaml:"enable_http3"`
 	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
 
+	// TruncatedFallback specifies how a udp upstream handles truncated
+	// responses. One of "tcp" (default), "tls", "none".
+	TruncatedFallback string `yaml:"truncated_fallback"`
+
+	// Enable0x20 randomizes the case of udp query names and rejects
+	// responses that do not echo it.
+	Enable0x20 bool `yaml:"enable_0x20"`
+	// RandomSourcePort sends each udp query from a new source port.
+	RandomSourcePort bool `yaml:"random_source_port"`
+	// QNAMEMinimization sends only the minimal labels of the query name
+	// to each authoritative server. For recursive upstreams.
+	QNAMEMinimization bool `yaml:"qname_minimization"`
+
 	Socks5       string `yaml:"socks5"`
 	SoMark       int    `yaml:"so_mark"`
 	BindToDevice string `yaml:"bind_to_device"`
+	BindAddr     string `yaml:"bind_addr"`
 	Bootstrap    string `yaml:"bootstrap"`
 	BootstrapVer int    `yaml:"bootstrap_version"`
+
+	// Weight is used by the "weighted" policy. Default is 1.
+	Weight int `yaml:"weight"`
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
-	f, err := NewForward(args.(*Args), Opts{Logger: bp.L(), MetricsTag: bp.Tag()})
+	f, err := NewForward(args.(*Args), Opts{Logger: bp.L(), MetricsTag: bp.Tag(), BQ: sequence.NewBQ(bp.M(), bp.L()), CheckMode: bp.M().CheckMode()})
 	if err != nil {
 		return nil, err
 	}
@@ -93,6 +122,7 @@ func Init(bp *coremain.BP, args any) (any, error) {
 		_ = f.Close()
 		return nil, err
 	}
+	bp.RegAPI(f.api())
 	return f, nil
 }
 
@@ -105,11 +135,28 @@ type Forward struct {
 	logger       *zap.Logger
 	us           []*upstreamWrapper
 	tag2Upstream map[string]*upstreamWrapper // for fast tag lookup only.
+
+	sanity         *sanityChecker // maybe nil
+	sanityFallback []*upstreamWrapper
+
+	checkName string // non-empty in check mode
+
+	policy string
+	rr     atomic.Uint64  // round-robin counter
+	hc     *healthChecker // maybe nil
 }
 
 type Opts struct {
 	Logger     *zap.Logger
 	MetricsTag string
+
+	// BQ is used to look up ip sets. Optional.
+	BQ sequence.BQ
+
+	// CheckMode makes Forward reply empty responses instead of sending
+	// queries, see coremain.Mosdns.CheckMode. The responses are recorded
+	// as answered by MetricsTag.
+	CheckMode bool
 }
 
 // NewForward inits a Forward from given args.
@@ -126,12 +173,27 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 		args:         args,
 		logger:       opt.Logger,
 		tag2Upstream: make(map[string]*upstreamWrapper),
+		policy:       args.Policy,
+	}
+	switch f.policy {
+	case "":
+		f.policy = policyRandom
+	case policyRandom, policyFastest, policyRoundRobin, policyWeighted:
+	default:
+		return nil, fmt.Errorf("invalid policy %s", args.Policy)
+	}
+	if opt.CheckMode {
+		f.checkName = opt.MetricsTag
+		if len(f.checkName) == 0 {
+			f.checkName = PluginType
+		}
 	}
 
 	applyGlobal := func(c *UpstreamConfig) {
 		utils.SetDefaultString(&c.Socks5, args.Socks5)
 		utils.SetDefaultUnsignNum(&c.SoMark, args.SoMark)
 		utils.SetDefaultString(&c.BindToDevice, args.BindToDevice)
+		utils.SetDefaultString(&c.BindAddr, args.BindAddr)
 		utils.SetDefaultString(&c.Bootstrap, args.Bootstrap)
 		utils.SetDefaultUnsignNum(&c.BootstrapVer, args.BootstrapVer)
 	}
@@ -148,6 +210,7 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 			Socks5:         c.Socks5,
 			SoMark:         c.SoMark,
 			BindToDevice:   c.BindToDevice,
+			BindAddr:       c.BindAddr,
 			IdleTimeout:    time.Duration(c.IdleTimeout) * time.Second,
 			EnablePipeline: c.EnablePipeline,
 			EnableHTTP3:    c.EnableHTTP3,
@@ -157,8 +220,12 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 				InsecureSkipVerify: c.InsecureSkipVerify,
 				ClientSessionCache: tls.NewLRUClientSessionCache(4),
 			},
-			Logger:        opt.Logger,
-			EventObserver: uw,
+			Logger:            opt.Logger,
+			EventObserver:     uw,
+			TruncatedFallback: c.TruncatedFallback,
+			Enable0x20:        c.Enable0x20,
+			RandomSourcePort:  c.RandomSourcePort,
+			QNAMEMinimization: c.QNAMEMinimization,
 		}
 
 		u, err := upstream.NewUpstream(c.Addr, uOpt)
@@ -178,6 +245,35 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 		}
 	}
 
+	if args.Sanity != nil {
+		sc, err := newSanityChecker(*args.Sanity, opt.BQ)
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("invalid sanity args, %w", err)
+		}
+		f.sanity = sc
+		for _, tag := range args.Sanity.Fallback {
+			u := f.tag2Upstream[tag]
+			if u == nil {
+				_ = f.Close()
+				return nil, fmt.Errorf("cannot find sanity fallback upstream by tag %s", tag)
+			}
+			f.sanityFallback = append(f.sanityFallback, u)
+		}
+	}
+
+	if args.HealthCheck != nil {
+		hc, err := newHealthChecker(f, *args.HealthCheck)
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("invalid health_check args, %w", err)
+		}
+		f.hc = hc
+		if !opt.CheckMode {
+			hc.start()
+		}
+	}
+
 	return f, nil
 }
 
@@ -195,7 +291,7 @@ func (f *Forward) RegisterMetricsTo(r prometheus.Registerer) error {
 }
 
 func (f *Forward) Exec(ctx context.Context, qCtx *query_context.Context) (err error) {
-	r, err := f.exchange(ctx, qCtx, f.us)
+	r, err := f.exchangeChecked(ctx, qCtx, f.us)
 	if err != nil {
 		return err
 	}
@@ -218,7 +314,7 @@ func (f *Forward) QuickConfigureExec(args string) (any, error) {
 		}
 	}
 	var execFunc sequence.ExecutableFunc = func(ctx context.Context, qCtx *query_context.Context) error {
-		r, err := f.exchange(ctx, qCtx, us)
+		r, err := f.exchangeChecked(ctx, qCtx, us)
 		if err != nil {
 			return err
 		}
@@ -228,18 +324,52 @@ func (f *Forward) QuickConfigureExec(args string) (any, error) {
 	return execFunc, nil
 }
 
+// Upstreams implements coremain.UpstreamReporter.
+func (f *Forward) Upstreams() []string {
+	names := make([]string, 0, len(f.us)+len(f.sanityFallback))
+	for _, u := range f.us {
+		names = append(names, u.name())
+	}
+	for _, u := range f.sanityFallback {
+		names = append(names, u.name())
+	}
+	return names
+}
+
 func (f *Forward) Close() error {
+	if f.hc != nil {
+		f.hc.close()
+	}
 	for _, u := range f.us {
 		_ = u.Close()
 	}
 	return nil
 }
 
+// exchangeChecked exchanges the query with us. If all responses were
+// discarded by the sanity check, it retries over the sanity fallback upstreams.
+func (f *Forward) exchangeChecked(ctx context.Context, qCtx *query_context.Context, us []*upstreamWrapper) (*dns.Msg, error) {
+	if len(f.checkName) > 0 {
+		r := new(dns.Msg)
+		r.SetReply(qCtx.Q())
+		qCtx.StoreValue(query_context.KeyUpstream, f.checkName)
+		return r, nil
+	}
+	r, err := f.exchange(ctx, qCtx, us, f.sanity)
+	if err != nil && errors.Is(err, errResponseDiscarded) && len(f.sanityFallback) > 0 {
+		f.logger.Debug("all responses were discarded, retrying over fallback upstreams", qCtx.InfoField(), zap.Error(err))
+		return f.exchange(ctx, qCtx, f.sanityFallback, nil)
+	}
+	return r, err
+}
+
 // ===============================================================================
 // ===== VVVV  The only modified function is `exchange` below. VVVV =====
 // ===============================================================================
 
-func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us []*upstreamWrapper) (*dns.Msg, error) {
+// exchange exchanges the query with us. Responses that fail the sanity
+// check of sc are discarded. A nil sc only verifies the question section.
+func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us []*upstreamWrapper, sc *sanityChecker) (*dns.Msg, error) {
 	if len(us) == 0 {
 		return nil, errors.New("no upstream to exchange")
 	}
@@ -259,8 +389,10 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 	}
 
 	type res struct {
-		r   *dns.Msg
-		err error
+		r         *dns.Msg
+		u         *upstreamWrapper
+		transport string
+		err       error
 	}
 
     // 使用带缓冲通道，避免竞争窗口中的短暂阻塞（功能行为不变）。
@@ -270,14 +402,19 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 
 	// --- MODIFICATION START ---
 	// Variables to store the best available "fallback" results according to priority.
-	var lastSuccessOrNXRes *dns.Msg // Priority 2: Stores NOERROR or NXDOMAIN responses.
-	var lastOtherRes *dns.Msg       // Priority 3: Stores other responses like SERVFAIL.
+	var lastSuccessOrNXRes *res // Priority 2: Stores NOERROR or NXDOMAIN responses.
+	var lastOtherRes *res       // Priority 3: Stores other responses like SERVFAIL.
 	var lastError error              // Priority 4: Stores the first encountered network error.
+	var discarded error              // The first error of a response discarded by sanity check.
 	// --- MODIFICATION END ---
 
-	r := rand.Intn(len(us))
-	for i := 0; i < concurrent; i++ {
-		u := us[(r+i)%len(us)]
+	// Read it here, qCtx is not safe for concurrent use.
+	observer, _ := qCtx.GetValue(query_context.KeyUpstreamObserver)
+	upstreamObserver, _ := observer.(query_context.UpstreamObserver)
+
+	picked := f.pick(us, concurrent)
+	concurrent = len(picked)
+	for _, u := range picked {
 		qc := copyPayload(queryPayload)
 
 		upstreamTimeout := time.Duration(u.cfg.UpstreamQueryTimeout) * time.Millisecond
@@ -290,21 +427,38 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
             // 重要：派生自父 ctx，确保上层取消/超时可传递到子查询。
             upstreamCtx, cancel := context.WithTimeout(ctx, upstreamTimeout)
 			defer cancel()
+			upstreamCtx, transport := upstream.WithTransportRecorder(upstreamCtx)
 
 			var r *dns.Msg
+			start := time.Now()
 			respPayload, err := u.ExchangeContext(upstreamCtx, *qc)
+			if upstreamObserver != nil {
+				var rb []byte
+				if err == nil {
+					rb = *respPayload
+				}
+				upstreamObserver.ObserveUpstream(u.cfg.Addr, *qc, start, rb, time.Now())
+			}
 			if err != nil {
 				// Skip logging "context deadline exceeded"
+				if f.hc != nil && ctx.Err() == nil {
+					f.hc.onFailure(u, err)
+				}
 			} else {
+				u.health.onSuccess(time.Since(start))
 				r = new(dns.Msg)
 				err = r.Unpack(*respPayload)
 				pool.ReleaseBuf(respPayload)
 				if err != nil {
 					r = nil
+				} else if reason := sc.check(question, r, time.Since(start)); len(reason) > 0 {
+					f.logger.Debug("upstream response discarded", zap.Uint32("uqid", uqid), zap.String("upstream", u.name()), zap.String("reason", reason))
+					r = nil
+					err = fmt.Errorf("%w, %s", errResponseDiscarded, reason)
 				}
 			}
 			select {
-			case resChan <- res{r: r, err: err}:
+			case resChan <- res{r: r, u: u, transport: transport(), err: err}:
 			case <-done:
 			}
 		}(qCtx.Id(), qCtx.QQuestion())
@@ -317,7 +471,11 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 
 			// --- MODIFICATION START ---
 			if err != nil {
-				if lastError == nil { // Record the first network error encountered.
+				if errors.Is(err, errResponseDiscarded) {
+					if discarded == nil {
+						discarded = err
+					}
+				} else if lastError == nil { // Record the first network error encountered.
 					lastError = err
 				}
 				continue // Move to the next result.
@@ -327,10 +485,10 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 			if len(r.Answer) > 0 {
 				for _, ans := range r.Answer {
 					if a, ok := ans.(*dns.A); ok && len(a.A) > 0 {
-						return r, nil
+						return answeredBy(qCtx, r, res.u, res.transport), nil
 					}
 					if aaaa, ok := ans.(*dns.AAAA); ok && len(aaaa.AAAA) > 0 {
-						return r, nil
+						return answeredBy(qCtx, r, res.u, res.transport), nil
 					}
 				}
 			}
@@ -339,11 +497,11 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 			// Priority 2: A definitive response (NOERROR or NXDOMAIN).
 			if r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError {
 				if lastSuccessOrNXRes == nil {
-					lastSuccessOrNXRes = r
+					lastSuccessOrNXRes = &res
 				}
 			} else { // Priority 3: Other responses like SERVFAIL, REFUSED, etc.
 				if lastOtherRes == nil {
-					lastOtherRes = r
+					lastOtherRes = &res
 				}
 			}
 			// --- MODIFICATION END ---
@@ -356,10 +514,14 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 	// --- MODIFICATION START ---
 	// After all concurrent queries are done, return the best result we found based on priority.
 	if lastSuccessOrNXRes != nil {
-		return lastSuccessOrNXRes, nil
+		return answeredBy(qCtx, lastSuccessOrNXRes.r, lastSuccessOrNXRes.u, lastSuccessOrNXRes.transport), nil
 	}
 	if lastOtherRes != nil {
-		return lastOtherRes, nil
+		return answeredBy(qCtx, lastOtherRes.r, lastOtherRes.u, lastOtherRes.transport), nil
+	}
+	if discarded != nil {
+		// Let the caller retry over fallback upstreams.
+		return nil, errors.Join(discarded, lastError)
 	}
 	if lastError != nil {
 		// Priority 4: If all we got were network errors, propagate the first error up.
@@ -375,6 +537,18 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 // ===== ^^^^ The only modified function is `exchange` above. ^^^^ =====
 // ===============================================================================
 
+// answeredBy records u as the upstream that produced r in qCtx and returns r.
+// transport is the transport that r was received over, "" if it is the
+// protocol of u.
+func answeredBy(qCtx *query_context.Context, r *dns.Msg, u *upstreamWrapper, transport string) *dns.Msg {
+	qCtx.StoreValue(query_context.KeyUpstream, u.name())
+	if len(transport) == 0 {
+		transport = u.protocol()
+	}
+	qCtx.StoreValue(query_context.KeyUpstreamTransport, transport)
+	return r
+}
+
 
 func quickSetup(bq sequence.BQ, s string) (any, error) {
 	args := new(Args)
@@ -382,5 +556,5 @@ func quickSetup(bq sequence.BQ, s string) (any, error) {
 	for _, u := range strings.Fields(s) {
 		args.Upstreams = append(args.Upstreams, UpstreamConfig{Addr: u})
 	}
-	return NewForward(args, Opts{Logger: bq.L()})
+	return NewForward(args, Opts{Logger: bq.L(), CheckMode: bq.M().CheckMode()})
 }
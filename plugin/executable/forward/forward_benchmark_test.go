@@ -89,7 +89,7 @@ func BenchmarkForwardExchange_Parallel(b *testing.B) {
             ctx, cancel := context.WithTimeout(context.Background(), time.Second)
             _ = func() error {
                 qCtx := query_context.NewContext(q)
-                _, err := f.exchange(ctx, qCtx, f.us)
+                _, err := f.exchange(ctx, qCtx, f.us, nil)
                 return err
             }()
             cancel()
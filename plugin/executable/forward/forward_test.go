@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+func Test_Forward_checkMode(t *testing.T) {
+	// The upstream is unreachable, check mode must not send queries to it.
+	f, err := NewForward(&Args{Upstreams: []UpstreamConfig{{Addr: "192.0.2.1"}}}, Opts{MetricsTag: "remote", CheckMode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q)
+	if err := f.Exec(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if r := qCtx.R(); r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) != 0 {
+		t.Fatalf("want an empty response, got %v", r)
+	}
+	if v, _ := qCtx.GetValue(query_context.KeyUpstream); v != "remote" {
+		t.Fatalf("want answered by remote, got %v", v)
+	}
+}
+
+func Test_Forward_truncatedFallback(t *testing.T) {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := udpConn.LocalAddr().String()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replies truncated responses over udp.
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			r.Truncated = true
+		} else {
+			r.Answer = append(r.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, 1),
+			})
+		}
+		w.WriteMsg(r)
+	})
+	udpServer := dns.Server{PacketConn: udpConn, Handler: handler}
+	tcpServer := dns.Server{Listener: l, Handler: handler}
+	go udpServer.ActivateAndServe()
+	go tcpServer.ActivateAndServe()
+	defer udpServer.Shutdown()
+	defer tcpServer.Shutdown()
+
+	for fallback, want := range map[string]string{"": "tcp", "none": "udp"} {
+		f, err := NewForward(&Args{Upstreams: []UpstreamConfig{{Addr: addr, TruncatedFallback: fallback}}}, Opts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		qCtx := query_context.NewContext(q)
+		err = f.Exec(context.Background(), qCtx)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := qCtx.GetValue(query_context.KeyUpstreamTransport); v != want {
+			t.Fatalf("fallback %q: transport = %v, want %s", fallback, v, want)
+		}
+		if r := qCtx.R(); r.Truncated != (want == "udp") {
+			t.Fatalf("fallback %q: truncated = %v", fallback, r.Truncated)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/go-chi/chi/v5"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	policyRandom     = "random"
+	policyFastest    = "fastest"
+	policyRoundRobin = "round_robin"
+	policyWeighted   = "weighted"
+)
+
+const (
+	defaultHealthCheckInterval = time.Second * 30
+	defaultHealthCheckTimeout  = time.Second * 3
+	defaultMaxFailures         = 3
+)
+
+type HealthCheckConfig struct {
+	// Interval between two probes in seconds. Default is 30.
+	Interval int `yaml:"interval"`
+	// Timeout of a probe in seconds. Default is 3.
+	Timeout int `yaml:"timeout"`
+	// Domain and Type of the probe query. Default is ". NS".
+	Domain string `yaml:"domain"`
+	Type   string `yaml:"type"`
+	// MaxFailures is the number of consecutive failures, from probes or
+	// queries, after which an upstream is ejected. Default is 3.
+	MaxFailures int `yaml:"max_failures"`
+}
+
+// upstreamHealth tracks the health of an upstream.
+// The zero value is a healthy upstream without rtt samples.
+type upstreamHealth struct {
+	rtt      atomic.Int64 // smoothed rtt in nanoseconds, 0 means no sample
+	failures atomic.Int32 // consecutive failures
+	ejected  atomic.Bool
+
+	mu        sync.Mutex
+	lastCheck time.Time
+	lastErr   string
+}
+
+// onSuccess records a response that took rtt.
+func (h *upstreamHealth) onSuccess(rtt time.Duration) {
+	for {
+		old := h.rtt.Load()
+		n := int64(rtt)
+		if old > 0 {
+			n = old - old/4 + n/4 // EWMA, alpha = 0.25
+		}
+		if h.rtt.CompareAndSwap(old, n) {
+			break
+		}
+	}
+	h.failures.Store(0)
+}
+
+// onFailure records a failure. It returns true if the upstream
+// has just been ejected.
+func (h *upstreamHealth) onFailure(maxFailures int32) bool {
+	return h.failures.Add(1) >= maxFailures && h.ejected.CompareAndSwap(false, true)
+}
+
+func (h *upstreamHealth) healthy() bool {
+	return !h.ejected.Load()
+}
+
+type healthChecker struct {
+	f           *Forward
+	interval    time.Duration
+	timeout     time.Duration
+	probe       *dns.Msg
+	maxFailures int32
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+func newHealthChecker(f *Forward, c HealthCheckConfig) (*healthChecker, error) {
+	hc := &healthChecker{
+		f:           f,
+		interval:    time.Duration(c.Interval) * time.Second,
+		timeout:     time.Duration(c.Timeout) * time.Second,
+		maxFailures: int32(c.MaxFailures),
+		closeCh:     make(chan struct{}),
+	}
+	if hc.interval <= 0 {
+		hc.interval = defaultHealthCheckInterval
+	}
+	if hc.timeout <= 0 {
+		hc.timeout = defaultHealthCheckTimeout
+	}
+	if hc.maxFailures <= 0 {
+		hc.maxFailures = defaultMaxFailures
+	}
+
+	qName := c.Domain
+	if len(qName) == 0 {
+		qName = "."
+	}
+	qType := dns.TypeNS
+	if len(c.Type) > 0 {
+		t, ok := dns.StringToType[c.Type]
+		if !ok {
+			return nil, fmt.Errorf("invalid probe type %s", c.Type)
+		}
+		qType = t
+	}
+	hc.probe = new(dns.Msg)
+	hc.probe.SetQuestion(dns.Fqdn(qName), qType)
+	return hc, nil
+}
+
+func (hc *healthChecker) start() {
+	go func() {
+		ticker := time.NewTicker(hc.interval)
+		defer ticker.Stop()
+		for {
+			hc.checkAll()
+			select {
+			case <-ticker.C:
+			case <-hc.closeCh:
+				return
+			}
+		}
+	}()
+}
+
+func (hc *healthChecker) close() {
+	hc.closeOnce.Do(func() { close(hc.closeCh) })
+}
+
+func (hc *healthChecker) checkAll() {
+	var wg sync.WaitGroup
+	for _, u := range hc.f.us {
+		wg.Add(1)
+		go func(u *upstreamWrapper) {
+			defer wg.Done()
+			hc.check(u)
+		}(u)
+	}
+	wg.Wait()
+}
+
+func (hc *healthChecker) check(u *upstreamWrapper) {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := hc.exchangeProbe(ctx, u)
+	h := &u.health
+	h.mu.Lock()
+	h.lastCheck = start
+	if err != nil {
+		h.lastErr = err.Error()
+	} else {
+		h.lastErr = ""
+	}
+	h.mu.Unlock()
+
+	if err != nil {
+		hc.onFailure(u, err)
+		return
+	}
+	h.onSuccess(time.Since(start))
+	if h.ejected.CompareAndSwap(true, false) {
+		hc.f.logger.Info("upstream recovered", zap.String("upstream", u.name()))
+	}
+}
+
+func (hc *healthChecker) exchangeProbe(ctx context.Context, u *upstreamWrapper) error {
+	q := hc.probe.Copy()
+	q.Id = dns.Id()
+	b, err := q.Pack()
+	if err != nil {
+		return err
+	}
+	respPayload, err := u.u.ExchangeContext(ctx, b)
+	if err != nil {
+		return err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(*respPayload); err != nil {
+		return err
+	}
+	if r.Rcode == dns.RcodeServerFailure {
+		return errors.New("probe got SERVFAIL")
+	}
+	return nil
+}
+
+func (hc *healthChecker) onFailure(u *upstreamWrapper, err error) {
+	if u.health.onFailure(hc.maxFailures) {
+		hc.f.logger.Warn("upstream ejected", zap.String("upstream", u.name()), zap.Error(err))
+	}
+}
+
+// pick returns up to n upstreams from us according to the policy.
+// Ejected upstreams are skipped unless all upstreams were ejected.
+func (f *Forward) pick(us []*upstreamWrapper, n int) []*upstreamWrapper {
+	if f.hc != nil {
+		healthy := make([]*upstreamWrapper, 0, len(us))
+		for _, u := range us {
+			if u.health.healthy() {
+				healthy = append(healthy, u)
+			}
+		}
+		if len(healthy) > 0 {
+			us = healthy
+		}
+	}
+	if n > len(us) {
+		n = len(us)
+	}
+
+	switch f.policy {
+	case policyFastest:
+		sorted := slices.Clone(us)
+		// Upstreams without rtt samples go first so they get measured.
+		slices.SortStableFunc(sorted, func(a, b *upstreamWrapper) int {
+			return cmp.Compare(a.health.rtt.Load(), b.health.rtt.Load())
+		})
+		return sorted[:n]
+	case policyWeighted:
+		return pickWeighted(us, n)
+	}
+
+	var start int
+	if f.policy == policyRoundRobin {
+		start = int(f.rr.Add(1) % uint64(len(us)))
+	} else {
+		start = rand.Intn(len(us))
+	}
+	picked := make([]*upstreamWrapper, 0, n)
+	for i := 0; i < n; i++ {
+		picked = append(picked, us[(start+i)%len(us)])
+	}
+	return picked
+}
+
+// pickWeighted picks n upstreams without replacement. The chance of
+// an upstream being picked is proportional to its weight.
+func pickWeighted(us []*upstreamWrapper, n int) []*upstreamWrapper {
+	left := slices.Clone(us)
+	picked := make([]*upstreamWrapper, 0, n)
+	for len(picked) < n {
+		total := 0
+		for _, u := range left {
+			total += u.weight()
+		}
+		x := rand.Intn(total)
+		for i, u := range left {
+			if x -= u.weight(); x < 0 {
+				picked = append(picked, u)
+				left = slices.Delete(left, i, i+1)
+				break
+			}
+		}
+	}
+	return picked
+}
+
+func (uw *upstreamWrapper) weight() int {
+	if uw.cfg.Weight > 0 {
+		return uw.cfg.Weight
+	}
+	return 1
+}
+
+var _ coremain.HealthReporter = (*Forward)(nil)
+
+// Healthy implements coremain.HealthReporter. Forward is unhealthy if
+// health checking is enabled and all upstreams were ejected.
+func (f *Forward) Healthy() error {
+	if f.hc == nil {
+		return nil
+	}
+	for _, u := range f.us {
+		if u.health.healthy() {
+			return nil
+		}
+	}
+	return errors.New("no healthy upstream")
+}
+
+type UpstreamStatus struct {
+	Name      string    `json:"name"`
+	Addr      string    `json:"addr"`
+	Weight    int       `json:"weight"`
+	Healthy   bool      `json:"healthy"`
+	RttMs     float64   `json:"rtt_ms"`
+	Failures  int32     `json:"consecutive_failures"`
+	LastCheck time.Time `json:"last_check,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Status returns the health status of all upstreams.
+func (f *Forward) Status() []UpstreamStatus {
+	s := make([]UpstreamStatus, 0, len(f.us))
+	for _, u := range f.us {
+		h := &u.health
+		h.mu.Lock()
+		lastCheck, lastErr := h.lastCheck, h.lastErr
+		h.mu.Unlock()
+		s = append(s, UpstreamStatus{
+			Name:      u.name(),
+			Addr:      u.cfg.Addr,
+			Weight:    u.weight(),
+			Healthy:   h.healthy(),
+			RttMs:     float64(h.rtt.Load()) / float64(time.Millisecond),
+			Failures:  h.failures.Load(),
+			LastCheck: lastCheck,
+			LastError: lastErr,
+		})
+	}
+	return s
+}
+
+func (f *Forward) api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]any{
+			"policy":       f.policy,
+			"health_check": f.hc != nil,
+			"upstreams":    f.Status(),
+		})
+	})
+	return r
+}
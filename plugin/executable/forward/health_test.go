@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type switchUpstream struct {
+	fakeUpstream
+	down atomic.Bool
+}
+
+func (u *switchUpstream) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	if u.down.Load() {
+		return nil, errors.New("down")
+	}
+	return u.fakeUpstream.ExchangeContext(ctx, m)
+}
+
+func Test_healthChecker(t *testing.T) {
+	f := buildForwardForBench([]time.Duration{0, 0}, 2)
+	f.logger = zap.NewNop()
+	f.policy = policyRandom
+	su := &switchUpstream{}
+	f.us[0].u = su
+
+	hc, err := newHealthChecker(f, HealthCheckConfig{MaxFailures: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.hc = hc
+
+	su.down.Store(true)
+	hc.checkAll()
+	if !f.us[0].health.healthy() {
+		t.Fatal("upstream should not be ejected after one failure")
+	}
+	hc.checkAll()
+	if f.us[0].health.healthy() {
+		t.Fatal("upstream should be ejected")
+	}
+	for i := 0; i < 10; i++ {
+		if p := f.pick(f.us, 2); len(p) != 1 || p[0] != f.us[1] {
+			t.Fatalf("ejected upstream was picked")
+		}
+	}
+
+	// All upstreams ejected, pick falls back to all of them.
+	f.us[1].health.ejected.Store(true)
+	if p := f.pick(f.us, 2); len(p) != 2 {
+		t.Fatalf("want 2 upstreams, got %d", len(p))
+	}
+	f.us[1].health.ejected.Store(false)
+
+	su.down.Store(false)
+	hc.checkAll()
+	if !f.us[0].health.healthy() || f.us[0].health.failures.Load() != 0 {
+		t.Fatal("upstream should be recovered")
+	}
+	if s := f.Status(); !s[0].Healthy || len(s[0].LastError) != 0 || s[0].LastCheck.IsZero() {
+		t.Fatalf("unexpected status %+v", s[0])
+	}
+}
+
+func Test_Forward_pick(t *testing.T) {
+	f := buildForwardForBench([]time.Duration{0, 0, 0}, 3)
+
+	f.policy = policyFastest
+	f.us[0].health.rtt.Store(int64(30 * time.Millisecond))
+	f.us[1].health.rtt.Store(int64(10 * time.Millisecond))
+	f.us[2].health.rtt.Store(int64(20 * time.Millisecond))
+	if p := f.pick(f.us, 2); p[0] != f.us[1] || p[1] != f.us[2] {
+		t.Fatal("fastest policy picked wrong upstreams")
+	}
+
+	f.policy = policyRoundRobin
+	first := f.pick(f.us, 1)[0]
+	if second := f.pick(f.us, 1)[0]; second == first {
+		t.Fatal("round_robin policy picked the same upstream twice")
+	}
+
+	f.policy = policyWeighted
+	f.us[0].cfg.Weight = 1000000
+	n := 0
+	for i := 0; i < 100; i++ {
+		p := f.pick(f.us, 2)
+		if len(p) != 2 || p[0] == p[1] {
+			t.Fatal("weighted policy picked duplicated upstreams")
+		}
+		if p[0] == f.us[0] {
+			n++
+		}
+	}
+	if n < 90 {
+		t.Fatalf("heavy upstream was picked first %d/100 times", n)
+	}
+}
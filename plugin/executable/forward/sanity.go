@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/ip_set"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+// SanityConfig configures the verification of upstream responses.
+// It is a defense against middleboxes that inject forged responses.
+type SanityConfig struct {
+	// BogusIP discards responses that contain these addresses.
+	// Format is the same as resp_ip: "[ip|cidr]", "$ip_set_tag" or "&file".
+	BogusIP []string `yaml:"bogus_ip"`
+	// MinRTT discards responses that arrive faster than MinRTT milliseconds.
+	// Injected responses often arrive before the real one could.
+	MinRTT int `yaml:"min_rtt"`
+	// Fallback is a list of upstream tags, preferably encrypted ones. If all
+	// responses were discarded, the query is retried over them.
+	Fallback []string `yaml:"fallback"`
+}
+
+var errResponseDiscarded = errors.New("upstream response discarded by sanity check")
+
+type sanityChecker struct {
+	bogusIP netlist.Matcher // maybe nil
+	minRTT  time.Duration
+}
+
+func newSanityChecker(cfg SanityConfig, bq sequence.BQ) (*sanityChecker, error) {
+	sc := &sanityChecker{minRTT: time.Duration(cfg.MinRTT) * time.Millisecond}
+
+	var mg ip_set.MatcherGroup
+	var ips, files []string
+	for _, exp := range cfg.BogusIP {
+		switch {
+		case strings.HasPrefix(exp, "$"):
+			tag := strings.TrimPrefix(exp, "$")
+			if bq == nil {
+				return nil, fmt.Errorf("cannot use ip set %s here", tag)
+			}
+			provider, _ := bq.M().GetPlugin(tag).(data_provider.IPMatcherProvider)
+			if provider == nil {
+				return nil, fmt.Errorf("cannot find ip set %s", tag)
+			}
+			mg = append(mg, provider.GetIPMatcher())
+		case strings.HasPrefix(exp, "&"):
+			files = append(files, strings.TrimPrefix(exp, "&"))
+		default:
+			ips = append(ips, exp)
+		}
+	}
+	if len(ips)+len(files) > 0 {
+		l := netlist.NewList()
+		if err := ip_set.LoadFromIPsAndFiles(ips, files, l); err != nil {
+			return nil, fmt.Errorf("failed to load bogus ip, %w", err)
+		}
+		l.Sort()
+		mg = append(mg, l)
+	}
+	if len(mg) > 0 {
+		sc.bogusIP = mg
+	}
+	return sc, nil
+}
+
+// check returns a non-empty reason if r should be discarded.
+// A nil checker only verifies the question section.
+func (sc *sanityChecker) check(q dns.Question, r *dns.Msg, rtt time.Duration) string {
+	// Some servers omit the question section in error responses.
+	if n := len(r.Question); n > 1 || n == 1 && (!strings.EqualFold(r.Question[0].Name, q.Name) ||
+		r.Question[0].Qtype != q.Qtype || r.Question[0].Qclass != q.Qclass) {
+		return "question mismatched"
+	}
+	if sc == nil {
+		return ""
+	}
+	if rtt < sc.minRTT {
+		return fmt.Sprintf("rtt %s is lower than min_rtt", rtt)
+	}
+	if sc.bogusIP != nil {
+		for _, rr := range r.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			if addr, ok := netip.AddrFromSlice(ip); ok && sc.bogusIP.Match(addr.Unmap()) {
+				return fmt.Sprintf("bogus ip %s", addr)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_sanityChecker_check(t *testing.T) {
+	sc, err := newSanityChecker(SanityConfig{BogusIP: []string{"10.0.0.0/8"}, MinRTT: 10}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	newResp := func(name string, ip string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.Response = true
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		})
+		return m
+	}
+
+	tests := []struct {
+		name    string
+		sc      *sanityChecker
+		r       *dns.Msg
+		rtt     time.Duration
+		discard bool
+	}{
+		{"ok", sc, newResp("example.com.", "1.1.1.1"), time.Millisecond * 20, false},
+		{"case insensitive", sc, newResp("ExAmple.com.", "1.1.1.1"), time.Millisecond * 20, false},
+		{"question mismatched", sc, newResp("example.org.", "1.1.1.1"), time.Millisecond * 20, true},
+		{"too fast", sc, newResp("example.com.", "1.1.1.1"), time.Millisecond, true},
+		{"bogus ip", sc, newResp("example.com.", "10.1.2.3"), time.Millisecond * 20, true},
+		{"nil checker", nil, newResp("example.com.", "10.1.2.3"), 0, false},
+		{"nil checker mismatched", nil, newResp("example.org.", "1.1.1.1"), 0, true},
+		{"no question", sc, new(dns.Msg), time.Millisecond * 20, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.sc.check(q, tt.r, tt.rtt); (len(got) > 0) != tt.discard {
+				t.Errorf("check() = %q, want discard %v", got, tt.discard)
+			}
+		})
+	}
+}
@@ -21,6 +21,7 @@ package fastforward
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
@@ -41,6 +42,10 @@ type upstreamWrapper struct {
 
 	connOpened prometheus.Counter
 	connClosed prometheus.Counter
+	truncated  prometheus.Counter
+	mismatch   prometheus.Counter
+
+	health upstreamHealth
 }
 
 func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
@@ -49,6 +54,10 @@ func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
 		uw.connOpened.Inc()
 	case upstream.EventConnClose:
 		uw.connClosed.Inc()
+	case upstream.EventUDPTruncated:
+		uw.truncated.Inc()
+	case upstream.EventUDP0x20Mismatch:
+		uw.mismatch.Inc()
 	}
 }
 
@@ -90,6 +99,16 @@ func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper
 			Help:        "The total number of connections that are closed",
 			ConstLabels: lb,
 		}),
+		truncated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "udp_truncated_total",
+			Help:        "The total number of truncated udp responses",
+			ConstLabels: lb,
+		}),
+		mismatch: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "udp_0x20_mismatch_total",
+			Help:        "The total number of udp responses that failed the 0x20 check",
+			ConstLabels: lb,
+		}),
 	}
 }
 
@@ -101,6 +120,8 @@ func (uw *upstreamWrapper) registerMetricsTo(r prometheus.Registerer) error {
 		uw.responseLatency,
 		uw.connOpened,
 		uw.connClosed,
+		uw.truncated,
+		uw.mismatch,
 	} {
 		if err := r.Register(collector); err != nil {
 			return err
@@ -118,6 +139,23 @@ func (uw *upstreamWrapper) name() string {
 	return uw.cfg.Addr
 }
 
+// protocol returns the protocol of the upstream, e.g. "udp", "tls", "h3".
+func (uw *upstreamWrapper) protocol() string {
+	scheme, _, ok := strings.Cut(uw.cfg.Addr, "://")
+	if !ok {
+		return "udp"
+	}
+	switch scheme {
+	case "tcp+pipeline", "tls+pipeline":
+		return scheme[:3]
+	case "https":
+		if uw.cfg.EnableHTTP3 {
+			return "h3"
+		}
+	}
+	return scheme
+}
+
 func (uw *upstreamWrapper) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
 	uw.queryTotal.Inc()
 
@@ -20,6 +20,7 @@
 package hosts
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"fmt"
@@ -27,9 +28,16 @@ import (
 	"github.com/IrineSistiana/mosdns/v5/pkg/hosts"
 	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"io"
+	"net/netip"
 	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const PluginType = "hosts"
@@ -43,47 +51,209 @@ var _ sequence.Executable = (*Hosts)(nil)
 type Args struct {
 	Entries []string `yaml:"entries"`
 	Files   []string `yaml:"files"`
+
+	// AutoReload watches Files and reloads them when they change.
+	AutoReload bool `yaml:"auto_reload"`
 }
 
 type Hosts struct {
-	h *hosts.Hosts
+	args *Args
+	h    atomic.Pointer[hosts.Hosts]
+
+	w *utils.FileWatcher // nil if auto reload is disabled
+}
+
+// reloadDelay merges the burst of events of a file update, e.g. an
+// editor that writes a temp file and renames it.
+const reloadDelay = time.Millisecond * 500
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	h, err := NewHosts(args.(*Args))
+	if err != nil {
+		return nil, err
+	}
+	if h.args.AutoReload && len(h.args.Files) > 0 {
+		h.watch(bp.L())
+	}
+	return h, nil
 }
 
-func Init(_ *coremain.BP, args any) (any, error) {
-	return NewHosts(args.(*Args))
+func (h *Hosts) watch(logger *zap.Logger) {
+	w, err := utils.NewFileWatcher(h.args.Files, reloadDelay, logger, func() {
+		if err := h.Reload(); err != nil {
+			logger.Warn("failed to reload hosts, keep using the current one", zap.Error(err))
+			return
+		}
+		logger.Info("hosts reloaded")
+	})
+	if err != nil {
+		logger.Warn("failed to watch hosts files, auto reload is disabled", zap.Error(err))
+		return
+	}
+	h.w = w
 }
 
 func NewHosts(args *Args) (*Hosts, error) {
-	m := domain.NewMixMatcher[*hosts.IPs]()
-	m.SetDefaultMatcher(domain.MatcherFull)
-	for i, entry := range args.Entries {
-		if err := domain.Load[*hosts.IPs](m, entry, hosts.ParseIPs); err != nil {
-			return nil, fmt.Errorf("failed to load entry #%d %s, %w", i, entry, err)
+	h := &Hosts{args: args}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload reloads the entries and files. The current hosts is kept
+// if any of them is invalid.
+func (h *Hosts) Reload() error {
+	l := newLoader()
+	for i, entry := range h.args.Entries {
+		if err := l.loadLine(entry); err != nil {
+			return fmt.Errorf("failed to load entry #%d %s, %w", i, entry, err)
 		}
 	}
-	for i, file := range args.Files {
+	for i, file := range h.args.Files {
 		b, err := os.ReadFile(file)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read file #%d %s, %w", i, file, err)
+			return fmt.Errorf("failed to read file #%d %s, %w", i, file, err)
 		}
-		if err := domain.LoadFromTextReader[*hosts.IPs](m, bytes.NewReader(b), hosts.ParseIPs); err != nil {
-			return nil, fmt.Errorf("failed to load file #%d %s, %w", i, file, err)
+		if err := l.load(bytes.NewReader(b)); err != nil {
+			return fmt.Errorf("failed to load file #%d %s, %w", i, file, err)
 		}
 	}
+	h.h.Store(l.hosts())
+	return nil
+}
 
-	return &Hosts{
-		h: hosts.NewHosts(m),
-	}, nil
+// Close stops watching the files.
+func (h *Hosts) Close() error {
+	if h.w != nil {
+		return h.w.Close()
+	}
+	return nil
 }
 
 func (h *Hosts) Response(q *dns.Msg) *dns.Msg {
-	return h.h.LookupMsg(q)
+	return h.h.Load().LookupMsg(q)
 }
 
 func (h *Hosts) Exec(_ context.Context, qCtx *query_context.Context) error {
-	r := h.h.LookupMsg(qCtx.Q())
+	r := h.h.Load().LookupMsg(qCtx.Q())
 	if r != nil {
 		qCtx.SetResponse(r)
 	}
 	return nil
 }
+
+// loader loads lines in two formats:
+//   - "pattern ip...", e.g. "domain:example.com 1.2.3.4". A later line
+//     with the same pattern replaces the former one.
+//   - "ip name..." (/etc/hosts), e.g. "192.168.1.2 nas nas.lan". Names
+//     are full domains. The ips of a name are merged, and PTR queries of
+//     the ip are answered with the first name.
+//
+// In both formats, "*.example.com" matches the subdomains of example.com,
+// but not example.com itself. Other matches take precedence over it.
+type loader struct {
+	m         *domain.MixMatcher[*hosts.IPs]
+	wildcard  *domain.SubDomainMatcher[*hosts.IPs]
+	etcHosts  map[string]*hosts.IPs // names from "ip name..." lines
+	wildHosts map[string]*hosts.IPs // wildcards from "ip name..." lines
+	ptr       map[netip.Addr][]string
+}
+
+func newLoader() *loader {
+	m := domain.NewMixMatcher[*hosts.IPs]()
+	m.SetDefaultMatcher(domain.MatcherFull)
+	return &loader{
+		m:         m,
+		wildcard:  domain.NewSubDomainMatcher[*hosts.IPs](),
+		etcHosts:  make(map[string]*hosts.IPs),
+		wildHosts: make(map[string]*hosts.IPs),
+		ptr:       make(map[netip.Addr][]string),
+	}
+}
+
+func (l *loader) load(r io.Reader) error {
+	s := bufio.NewScanner(r)
+	line := 0
+	for s.Scan() {
+		line++
+		if err := l.loadLine(s.Text()); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return s.Err()
+}
+
+func (l *loader) loadLine(s string) error {
+	s, _, _ = strings.Cut(s, "#")
+	fs := strings.Fields(s)
+	if len(fs) == 0 {
+		return nil
+	}
+
+	addr, err := netip.ParseAddr(fs[0])
+	if err != nil { // "pattern ip..."
+		pattern, ips, err := hosts.ParseIPs(s)
+		if err != nil {
+			return err
+		}
+		if parent, ok := strings.CutPrefix(pattern, "*."); ok {
+			return l.wildcard.Add(parent, ips)
+		}
+		return l.m.Add(pattern, ips)
+	}
+
+	// "ip name..."
+	if len(fs) < 2 {
+		return fmt.Errorf("no name for ip %s", fs[0])
+	}
+	addr = addr.Unmap()
+	if len(l.ptr[addr]) == 0 && !strings.HasPrefix(fs[1], "*.") {
+		l.ptr[addr] = []string{dns.Fqdn(domain.NormalizeDomain(fs[1]))}
+	}
+	for _, name := range fs[1:] {
+		set := l.etcHosts
+		if parent, ok := strings.CutPrefix(name, "*."); ok {
+			set, name = l.wildHosts, parent
+		}
+		name = domain.NormalizeDomain(name)
+		ips := set[name]
+		if ips == nil {
+			ips = new(hosts.IPs)
+			set[name] = ips
+		}
+		if addr.Is4() {
+			ips.IPv4 = append(ips.IPv4, addr)
+		} else {
+			ips.IPv6 = append(ips.IPv6, addr)
+		}
+	}
+	return nil
+}
+
+func (l *loader) hosts() *hosts.Hosts {
+	for name, ips := range l.etcHosts {
+		_ = l.m.GetSubMatcher(domain.MatcherFull).Add(name, ips)
+	}
+	for name, ips := range l.wildHosts {
+		_ = l.wildcard.Add(name, ips)
+	}
+	return hosts.NewHostsWithPTR(&matcher{m: l.m, wildcard: l.wildcard}, l.ptr)
+}
+
+// matcher matches the names of wildcards against the parent domain of
+// the query name.
+type matcher struct {
+	m        *domain.MixMatcher[*hosts.IPs]
+	wildcard *domain.SubDomainMatcher[*hosts.IPs]
+}
+
+func (m *matcher) Match(s string) (*hosts.IPs, bool) {
+	if v, ok := m.m.Match(s); ok {
+		return v, ok
+	}
+	if _, parent, ok := strings.Cut(s, "."); ok && len(parent) > 0 {
+		return m.wildcard.Match(parent)
+	}
+	return nil, false
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package hosts
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const testHosts = `
+# /etc/hosts style
+192.168.1.2 nas nas.lan # comment
+192.168.1.2 backup.lan
+fd00::2 nas.lan
+10.0.0.1 *.dev.lan
+
+# mosdns style
+*.example.com 1.2.3.4
+www.example.com 2.3.4.5
+domain:google.com 8.8.8.8
+`
+
+func Test_Hosts(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(file, []byte(testHosts), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHosts(&Args{Files: []string{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(name string, qt uint16) []string {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qt)
+		r := h.Response(q)
+		if r == nil {
+			return nil
+		}
+		var s []string
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				s = append(s, rr.A.String())
+			case *dns.AAAA:
+				s = append(s, rr.AAAA.String())
+			case *dns.PTR:
+				s = append(s, rr.Ptr)
+			}
+		}
+		return s
+	}
+
+	tests := []struct {
+		name string
+		qt   uint16
+		want []string // nil means no response
+	}{
+		{"nas.", dns.TypeA, []string{"192.168.1.2"}},
+		{"nas.lan.", dns.TypeAAAA, []string{"fd00::2"}},
+		{"backup.lan.", dns.TypeA, []string{"192.168.1.2"}},
+		{"2.1.168.192.in-addr.arpa.", dns.TypePTR, []string{"nas."}},
+		{"3.1.168.192.in-addr.arpa.", dns.TypePTR, nil},
+		{"a.b.dev.lan.", dns.TypeA, []string{"10.0.0.1"}},
+		{"dev.lan.", dns.TypeA, nil},
+		{"a.example.com.", dns.TypeA, []string{"1.2.3.4"}},
+		{"www.example.com.", dns.TypeA, []string{"2.3.4.5"}},
+		{"example.com.", dns.TypeA, nil},
+		{"dns.google.com.", dns.TypeA, []string{"8.8.8.8"}},
+	}
+	for _, tt := range tests {
+		got := lookup(tt.name, tt.qt)
+		if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+			t.Errorf("%s %s: want %v, got %v", tt.name, dns.TypeToString[tt.qt], tt.want, got)
+		}
+	}
+
+	// Invalid files are not loaded.
+	if err := os.WriteFile(file, []byte("nas 1.2.3"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Reload(); err == nil {
+		t.Fatal("invalid file should not be loaded")
+	}
+	if got := lookup("nas.", dns.TypeA); len(got) != 1 {
+		t.Fatalf("current hosts should be kept, got %v", got)
+	}
+}
+
+func Test_Hosts_AutoReload(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "hosts")
+	if err := os.WriteFile(file, []byte("192.168.1.2 nas"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewHosts(&Args{Files: []string{file}, AutoReload: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.watch(zap.NewNop())
+	defer h.Close()
+
+	if err := os.WriteFile(file, []byte("192.168.1.3 nas"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("nas.", dns.TypeA)
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		if r := h.Response(q); r != nil && r.Answer[0].(*dns.A).A.String() == "192.168.1.3" {
+			return
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Fatal("hosts was not reloaded")
+}
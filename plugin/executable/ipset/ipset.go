@@ -21,7 +21,10 @@ package ipset
 
 import (
 	"fmt"
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
 	"strconv"
 	"strings"
 )
@@ -29,6 +32,7 @@ import (
 const PluginType = "ipset"
 
 func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
 	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
 }
 
@@ -37,10 +41,59 @@ type Args struct {
 	SetName6 string `yaml:"set_name6"`
 	Mask4    int    `yaml:"mask4"` // default 24
 	Mask6    int    `yaml:"mask6"` // default 32
+
+	// Timeout is the set entry timeout in seconds. 0 means using the
+	// default timeout of the set.
+	Timeout int `yaml:"timeout"`
+
+	// PinTTL keeps set entries and client caches expiring in sync.
+	// The entry timeout will be at least the answer ttl, and the answer
+	// ttl will be pinned to the entry timeout.
+	// Note: The set must be created with the timeout option.
+	PinTTL bool `yaml:"pin_ttl"`
+
+	// TTLTimeout sets the timeout of each entry to the ttl of its record,
+	// but at least Timeout. Unlike PinTTL, the answer is not modified.
+	// Note: The set must be created with the timeout option.
+	TTLTimeout bool `yaml:"ttl_timeout"`
 }
 
 var _ sequence.Executable = (*ipSetPlugin)(nil)
 
+func Init(_ *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	if a.Timeout < 0 {
+		return nil, fmt.Errorf("invalid timeout %d", a.Timeout)
+	}
+	return newIpSetPlugin(a)
+}
+
+// entryTimeout returns the timeout of set entries that are added from r.
+// If PinTTL is enabled, the ttl of A/AAAA records in r will be pinned
+// to the returned value.
+func (a *Args) entryTimeout(r *dns.Msg) uint32 {
+	timeout := uint32(a.Timeout)
+	if !a.PinTTL {
+		return timeout
+	}
+	if ttl := dnsutils.GetMaxAddrTTL(r); ttl > timeout {
+		timeout = ttl
+	}
+	if timeout > 0 {
+		dnsutils.SetAddrTTL(r, timeout)
+	}
+	return timeout
+}
+
+// recordTimeout returns the timeout of the entry that is added from the
+// record of hdr. base is the value returned by entryTimeout.
+func (a *Args) recordTimeout(base uint32, hdr *dns.RR_Header) uint32 {
+	if a.TTLTimeout && hdr.Ttl > base {
+		return hdr.Ttl
+	}
+	return base
+}
+
 // QuickSetup format: [set_name,{inet|inet6},mask] *2
 // e.g. "my_set,inet,24 my_set6,inet6,48"
 func QuickSetup(_ sequence.BQ, s string) (any, error) {
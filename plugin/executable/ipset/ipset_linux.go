@@ -69,6 +69,14 @@ func (p *ipSetPlugin) Close() error {
 }
 
 func (p *ipSetPlugin) addIPSet(r *dns.Msg) error {
+	base := p.args.entryTimeout(r)
+	opts := func(hdr *dns.RR_Header) []ipset.Option {
+		if timeout := p.args.recordTimeout(base, hdr); timeout > 0 {
+			return []ipset.Option{ipset.OptTimeout(timeout)}
+		}
+		return nil
+	}
+
 	for i := range r.Answer {
 		switch rr := r.Answer[i].(type) {
 		case *dns.A:
@@ -79,7 +87,7 @@ func (p *ipSetPlugin) addIPSet(r *dns.Msg) error {
 			if !ok {
 				return fmt.Errorf("invalid A record with ip: %s", rr.A)
 			}
-			if err := ipset.AddPrefix(p.nl, p.args.SetName4, netip.PrefixFrom(addr, p.args.Mask4)); err != nil {
+			if err := ipset.AddPrefix(p.nl, p.args.SetName4, netip.PrefixFrom(addr, p.args.Mask4), opts(&rr.Hdr)...); err != nil {
 				return err
 			}
 
@@ -91,7 +99,7 @@ func (p *ipSetPlugin) addIPSet(r *dns.Msg) error {
 			if !ok {
 				return fmt.Errorf("invalid AAAA record with ip: %s", rr.AAAA)
 			}
-			if err := ipset.AddPrefix(p.nl, p.args.SetName6, netip.PrefixFrom(addr, p.args.Mask6)); err != nil {
+			if err := ipset.AddPrefix(p.nl, p.args.SetName6, netip.PrefixFrom(addr, p.args.Mask6), opts(&rr.Hdr)...); err != nil {
 				return err
 			}
 		default:
@@ -118,3 +118,37 @@ func Test_ipset(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func Test_Args_recordTimeout(t *testing.T) {
+	newResp := func() *dns.Msg {
+		r := new(dns.Msg)
+		r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA, Ttl: 30}, A: net.ParseIP("127.0.0.1")})
+		r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA, Ttl: 600}, A: net.ParseIP("127.0.0.2")})
+		return r
+	}
+	tests := []struct {
+		name    string
+		args    Args
+		want    []uint32 // timeout of each record
+		wantTTL []uint32 // ttl of each record after entryTimeout
+	}{
+		{"fixed", Args{Timeout: 60}, []uint32{60, 60}, []uint32{30, 600}},
+		{"ttl", Args{TTLTimeout: true}, []uint32{30, 600}, []uint32{30, 600}},
+		{"ttl with min", Args{Timeout: 60, TTLTimeout: true}, []uint32{60, 600}, []uint32{30, 600}},
+		{"pin", Args{Timeout: 60, PinTTL: true}, []uint32{600, 600}, []uint32{600, 600}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newResp()
+			base := tt.args.entryTimeout(r)
+			for i, rr := range r.Answer {
+				if got := tt.args.recordTimeout(base, rr.Header()); got != tt.want[i] {
+					t.Errorf("record #%d timeout = %d, want %d", i, got, tt.want[i])
+				}
+				if got := rr.Header().Ttl; got != tt.wantTTL[i] {
+					t.Errorf("record #%d ttl = %d, want %d", i, got, tt.wantTTL[i])
+				}
+			}
+		})
+	}
+}
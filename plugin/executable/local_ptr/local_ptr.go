@@ -0,0 +1,269 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package local_ptr
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "local_ptr"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
+}
+
+var _ sequence.Executable = (*LocalPTR)(nil)
+
+// defaultSubnets are the locally served reverse zones of RFC 6303,
+// plus the shared address space (RFC 7793).
+var defaultSubnets = []string{
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10",
+	"0.0.0.0/8", "127.0.0.0/8", "169.254.0.0/16",
+	"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24", "255.255.255.255/32",
+	"::/128", "::1/128", "fd00::/8", "fe80::/10", "2001:db8::/32",
+}
+
+type Args struct {
+	// Subnets whose reverse zones are answered locally. Default is the
+	// private and special-use ranges of RFC 6303.
+	Subnets []string `yaml:"subnets"`
+	// Entries and Files are PTR records in hosts format "ip name...".
+	Entries []string `yaml:"entries"`
+	Files   []string `yaml:"files"`
+	// Response for addresses in Subnets without records.
+	// One of "nxdomain" (default), "nodata".
+	Response string `yaml:"response"`
+	TTL      uint32 `yaml:"ttl"` // Default is 300.
+}
+
+// LocalPTR answers reverse lookups of local subnets authoritatively, so
+// they are not leaked to upstreams.
+type LocalPTR struct {
+	subnets []netip.Prefix
+	records map[netip.Addr][]string
+	nodata  bool
+	ttl     uint32
+}
+
+func Init(_ *coremain.BP, args any) (any, error) {
+	return NewLocalPTR(args.(*Args))
+}
+
+// QuickSetup format: [subnet]...
+// e.g. "192.168.0.0/16 fd00::/8". Default is the ranges of RFC 6303.
+func QuickSetup(_ sequence.BQ, s string) (any, error) {
+	return NewLocalPTR(&Args{Subnets: strings.Fields(s)})
+}
+
+func NewLocalPTR(args *Args) (*LocalPTR, error) {
+	p := &LocalPTR{
+		records: make(map[netip.Addr][]string),
+		ttl:     args.TTL,
+	}
+	if p.ttl == 0 {
+		p.ttl = 300
+	}
+	switch args.Response {
+	case "", "nxdomain":
+	case "nodata":
+		p.nodata = true
+	default:
+		return nil, fmt.Errorf("invalid response %s", args.Response)
+	}
+
+	subnets := args.Subnets
+	if len(subnets) == 0 {
+		subnets = defaultSubnets
+	}
+	for _, s := range subnets {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid subnet %s, %w", s, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		p.subnets = append(p.subnets, prefix.Masked())
+	}
+
+	for i, e := range args.Entries {
+		if err := p.loadRecords(strings.NewReader(e)); err != nil {
+			return nil, fmt.Errorf("failed to load entry #%d %s, %w", i, e, err)
+		}
+	}
+	for i, file := range args.Files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file #%d %s, %w", i, file, err)
+		}
+		if err := p.loadRecords(bytes.NewReader(b)); err != nil {
+			return nil, fmt.Errorf("failed to load file #%d %s, %w", i, file, err)
+		}
+	}
+	return p, nil
+}
+
+func (p *LocalPTR) loadRecords(r io.Reader) error {
+	s := bufio.NewScanner(r)
+	for line := 0; s.Scan(); {
+		line++
+		t, _, _ := strings.Cut(s.Text(), "#")
+		fs := strings.Fields(t)
+		if len(fs) == 0 {
+			continue
+		}
+		if len(fs) < 2 {
+			return fmt.Errorf("line %d: missing name", line)
+		}
+		addr, err := netip.ParseAddr(fs[0])
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		addr = addr.Unmap()
+		for _, name := range fs[1:] {
+			p.records[addr] = append(p.records[addr], dns.Fqdn(name))
+		}
+	}
+	return s.Err()
+}
+
+func (p *LocalPTR) Exec(_ context.Context, qCtx *query_context.Context) error {
+	if r := p.Response(qCtx.Q()); r != nil {
+		qCtx.SetResponse(r)
+	}
+	return nil
+}
+
+// Response returns the response of q, or nil if q is not a reverse
+// lookup of the local subnets or records.
+func (p *LocalPTR) Response(q *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	question := q.Question[0]
+	prefix, err := dnsutils.ParsePTRPrefix(question.Name)
+	if err != nil {
+		return nil
+	}
+	isAddr := prefix.IsSingleIP()
+	names := p.records[prefix.Addr()]
+	subnet, local := p.subnetOf(prefix)
+	if !local && !(isAddr && len(names) > 0) {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	if len(names) > 0 && isAddr {
+		if question.Qtype == dns.TypePTR || question.Qtype == dns.TypeANY {
+			for _, name := range names {
+				r.Answer = append(r.Answer, &dns.PTR{
+					Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: p.ttl},
+					Ptr: name,
+				})
+			}
+			return r
+		}
+		// NODATA, and records outside the subnets have no zone.
+		if !local {
+			return r
+		}
+	}
+
+	apex := zoneApex(prefix, subnet)
+	soa := p.soa(apex)
+	switch {
+	case question.Qtype == dns.TypeSOA && strings.EqualFold(question.Name, apex):
+		r.Answer = []dns.RR{soa}
+	case isAddr && len(names) == 0 && !p.nodata:
+		r.Rcode = dns.RcodeNameError
+		r.Ns = []dns.RR{soa}
+	default: // Existing names, empty non-terminals and the apex.
+		r.Ns = []dns.RR{soa}
+	}
+	return r
+}
+
+// subnetOf returns the subnet that contains prefix.
+func (p *LocalPTR) subnetOf(prefix netip.Prefix) (netip.Prefix, bool) {
+	for _, s := range p.subnets {
+		if prefix.Bits() >= s.Bits() && s.Contains(prefix.Addr()) && prefix.Addr().Is4() == s.Addr().Is4() {
+			return s, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+func (p *LocalPTR) soa(apex string) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: apex, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: p.ttl},
+		Ns:      apex,
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 604800,
+		Retry:   86400,
+		Expire:  2419200,
+		Minttl:  p.ttl,
+	}
+}
+
+// zoneApex returns the name of the reverse zone of subnet that contains
+// prefix. Zones are cut at octet (v4) or nibble (v6) boundaries, e.g.
+// 172.20.0.0/16 of 172.16.0.0/12 is in zone "20.172.in-addr.arpa.".
+func zoneApex(prefix, subnet netip.Prefix) string {
+	var b strings.Builder
+	if prefix.Addr().Is4() {
+		a := prefix.Addr().As4()
+		for i := (subnet.Bits()+7)/8 - 1; i >= 0; i-- {
+			b.WriteString(strconv.Itoa(int(a[i])))
+			b.WriteByte('.')
+		}
+		b.WriteString("in-addr.arpa.")
+		return b.String()
+	}
+	a := prefix.Addr().As16()
+	for i := (subnet.Bits()+3)/4 - 1; i >= 0; i-- {
+		n := a[i/2]
+		if i%2 == 0 {
+			n >>= 4
+		}
+		b.WriteString(strconv.FormatUint(uint64(n&0xf), 16))
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package local_ptr
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_LocalPTR(t *testing.T) {
+	p, err := NewLocalPTR(&Args{
+		Subnets: []string{"192.168.0.0/16", "172.16.0.0/12", "fd00::/8"},
+		Entries: []string{"192.168.1.10 nas.lan nas", "8.8.8.8 dns.google # outside subnets"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		handled bool
+		rcode   int
+		answer  string // value of the first answer
+		ns      string // owner of the soa in the authority section
+	}{
+		{"10.1.168.192.in-addr.arpa.", dns.TypePTR, true, dns.RcodeSuccess, "nas.lan.", ""},
+		{"10.1.168.192.in-addr.arpa.", dns.TypeA, true, dns.RcodeSuccess, "", "168.192.in-addr.arpa."},
+		{"11.1.168.192.in-addr.arpa.", dns.TypePTR, true, dns.RcodeNameError, "", "168.192.in-addr.arpa."},
+		{"1.168.192.in-addr.arpa.", dns.TypePTR, true, dns.RcodeSuccess, "", "168.192.in-addr.arpa."},
+		{"168.192.in-addr.arpa.", dns.TypeSOA, true, dns.RcodeSuccess, "168.192.in-addr.arpa.", ""},
+		{"1.0.20.172.in-addr.arpa.", dns.TypePTR, true, dns.RcodeNameError, "", "20.172.in-addr.arpa."},
+		{"1.0.32.172.in-addr.arpa.", dns.TypePTR, false, 0, "", ""},
+		{"172.in-addr.arpa.", dns.TypeNS, false, 0, "", ""},
+		{"8.8.8.8.in-addr.arpa.", dns.TypePTR, true, dns.RcodeSuccess, "dns.google.", ""},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dns.TypePTR, true, dns.RcodeNameError, "", "d.f.ip6.arpa."},
+		{"example.com.", dns.TypePTR, false, 0, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.name, tt.qtype)
+			r := p.Response(q)
+			if (r != nil) != tt.handled {
+				t.Fatalf("want handled %v, got %v", tt.handled, r)
+			}
+			if r == nil {
+				return
+			}
+			if r.Rcode != tt.rcode || !r.Authoritative {
+				t.Fatalf("unexpected rcode or aa, %v", r)
+			}
+			var answer, ns string
+			if len(r.Answer) > 0 {
+				switch rr := r.Answer[0].(type) {
+				case *dns.PTR:
+					answer = rr.Ptr
+				case *dns.SOA:
+					answer = rr.Hdr.Name
+				}
+			}
+			if len(r.Ns) > 0 {
+				ns = r.Ns[0].Header().Name
+			}
+			if answer != tt.answer || ns != tt.ns {
+				t.Fatalf("want answer %q ns %q, got %v", tt.answer, tt.ns, r)
+			}
+		})
+	}
+}
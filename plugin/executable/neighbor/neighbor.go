@@ -0,0 +1,468 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package neighbor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+const PluginType = "neighbor"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+type Args struct {
+	// Interval is the refresh interval of the neighbor (ARP/NDP) table in seconds.
+	// Default is 60.
+	Interval int `yaml:"interval"`
+
+	// StateFile persists known devices, so devices won't be considered
+	// as new after a restart. Optional.
+	StateFile string `yaml:"state_file"`
+
+	// OUIFile is an optional IEEE oui.txt or wireshark manuf file for
+	// MAC vendor lookup.
+	OUIFile string `yaml:"oui_file"`
+
+	// TrustAfter is the duration (in minutes) after which a new device
+	// will be trusted automatically. 0 means new devices stay untrusted
+	// until they are trusted via api.
+	TrustAfter int `yaml:"trust_after"`
+
+	// Aliases maps a client address to its other addresses or MAC addresses,
+	// e.g. {"192.168.1.10": ["2001:db8::10", "aa:bb:cc:dd:ee:ff"]}. Optional.
+	// Without aliases, addresses of a device that share a MAC address in the
+	// neighbor table (or in the EUI-64 interface id) map to its IPv4 address.
+	Aliases map[string][]string `yaml:"aliases"`
+}
+
+func (a *Args) init() {
+	utils.SetDefaultNum(&a.Interval, 60)
+}
+
+// neighEntry is an entry of the system neighbor table.
+type neighEntry struct {
+	Addr netip.Addr
+	MAC  string
+}
+
+type device struct {
+	MAC       string    `json:"mac"`
+	Vendor    string    `json:"vendor,omitempty"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Trusted   bool      `json:"trusted"`
+}
+
+var _ sequence.Matcher = (*Neighbor)(nil)
+var _ sequence.Executable = (*Neighbor)(nil)
+
+// Neighbor reads the system neighbor table and associates client
+// addresses with MAC addresses. As a sequence.Matcher, it matches
+// queries from new (untrusted) devices. As a sequence.Executable, it
+// replaces the client address with the address of its logical client,
+// so IPv6 and link-local addresses of a device share its IPv4 policies.
+type Neighbor struct {
+	args   Args
+	logger *zap.Logger
+	oui    map[string]string // 6 upper case hex digits -> vendor
+
+	addrAlias map[netip.Addr]netip.Addr // from args.Aliases
+	macAlias  map[string]netip.Addr     // from args.Aliases
+
+	mu      sync.RWMutex
+	addrMAC map[netip.Addr]string
+	macIPv4 map[string]netip.Addr // mac -> the device's ipv4 address
+	devices map[string]*device    // mac -> device
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	n, err := NewNeighbor(*args.(*Args), bp.L())
+	if err != nil {
+		return nil, err
+	}
+	bp.RegAPI(n.Api())
+	return n, nil
+}
+
+func NewNeighbor(args Args, logger *zap.Logger) (*Neighbor, error) {
+	args.init()
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	n := &Neighbor{
+		args:        args,
+		logger:      logger,
+		addrAlias:   make(map[netip.Addr]netip.Addr),
+		macAlias:    make(map[string]netip.Addr),
+		addrMAC:     make(map[netip.Addr]string),
+		macIPv4:     make(map[string]netip.Addr),
+		devices:     make(map[string]*device),
+		closeNotify: make(chan struct{}),
+	}
+	if err := n.loadAliases(); err != nil {
+		return nil, fmt.Errorf("invalid aliases, %w", err)
+	}
+	if len(args.OUIFile) > 0 {
+		oui, err := loadOUIFile(args.OUIFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load oui file, %w", err)
+		}
+		n.oui = oui
+	}
+	if err := n.loadState(); err != nil {
+		return nil, fmt.Errorf("failed to load state file, %w", err)
+	}
+	if err := n.refresh(); err != nil {
+		return nil, fmt.Errorf("failed to read neighbor table, %w", err)
+	}
+	go n.refreshLoop()
+	return n, nil
+}
+
+// Match implements sequence.Matcher. It returns true if the client is
+// a device in the neighbor table that is not trusted yet.
+func (n *Neighbor) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	addr := qCtx.ServerMeta.ClientAddr.Unmap()
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	mac, ok := n.addrMAC[addr]
+	if !ok {
+		return false, nil
+	}
+	d := n.devices[mac]
+	return d != nil && !n.isTrusted(d, time.Now()), nil
+}
+
+// Exec implements sequence.Executable. It replaces the client address with
+// the address of its logical client. The original address is stored in
+// qCtx with query_context.KeyOriginalClientAddr.
+func (n *Neighbor) Exec(_ context.Context, qCtx *query_context.Context) error {
+	addr := qCtx.ServerMeta.ClientAddr
+	if !addr.IsValid() {
+		return nil
+	}
+	if c := n.Canonical(addr); c != addr.Unmap() {
+		qCtx.StoreValue(query_context.KeyOriginalClientAddr, addr)
+		qCtx.ServerMeta.ClientAddr = c
+	}
+	return nil
+}
+
+// Canonical returns the address of the logical client of addr. That is
+// the configured alias, or the IPv4 address of the device that has the
+// same MAC address. If nothing is known, addr itself is returned.
+func (n *Neighbor) Canonical(addr netip.Addr) netip.Addr {
+	addr = addr.Unmap()
+	if c, ok := n.addrAlias[addr]; ok {
+		return c
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	mac, ok := n.addrMAC[addr]
+	if !ok {
+		// Link-local and SLAAC addresses may embed the MAC address.
+		if mac, ok = eui64MAC(addr); !ok {
+			return addr
+		}
+	}
+	if c, ok := n.macAlias[mac]; ok {
+		return c
+	}
+	if c, ok := n.macIPv4[mac]; ok {
+		return c
+	}
+	return addr
+}
+
+func (n *Neighbor) loadAliases() error {
+	for client, aliases := range n.args.Aliases {
+		c, err := netip.ParseAddr(client)
+		if err != nil {
+			return err
+		}
+		c = c.Unmap()
+		for _, s := range aliases {
+			if hw, err := net.ParseMAC(s); err == nil {
+				n.macAlias[hw.String()] = c
+				continue
+			}
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return fmt.Errorf("%s is neither an ip nor a mac address", s)
+			}
+			n.addrAlias[addr.Unmap()] = c
+		}
+	}
+	return nil
+}
+
+// eui64MAC returns the MAC address embedded in the modified EUI-64
+// interface id of an IPv6 address.
+func eui64MAC(addr netip.Addr) (string, bool) {
+	if !addr.Is6() || addr.Is4In6() {
+		return "", false
+	}
+	b := addr.As16()
+	if b[11] != 0xff || b[12] != 0xfe {
+		return "", false
+	}
+	hw := net.HardwareAddr{b[8] ^ 0x02, b[9], b[10], b[13], b[14], b[15]}
+	return hw.String(), true
+}
+
+func (n *Neighbor) isTrusted(d *device, now time.Time) bool {
+	if d.Trusted {
+		return true
+	}
+	return n.args.TrustAfter > 0 && now.Sub(d.FirstSeen) >= time.Duration(n.args.TrustAfter)*time.Minute
+}
+
+func (n *Neighbor) refreshLoop() {
+	ticker := time.NewTicker(time.Duration(n.args.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := n.refresh(); err != nil {
+				n.logger.Warn("failed to refresh neighbor table", zap.Error(err))
+			}
+		case <-n.closeNotify:
+			return
+		}
+	}
+}
+
+func (n *Neighbor) refresh() error {
+	entries, err := readNeighbors()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	addrMAC := make(map[netip.Addr]string, len(entries))
+	macIPv4 := make(map[string]netip.Addr)
+	var newDevices []string
+
+	n.mu.Lock()
+	for _, e := range entries {
+		addrMAC[e.Addr] = e.MAC
+		if e.Addr.Is4() {
+			// Prefer the lowest address, so the result is stable.
+			if old, ok := macIPv4[e.MAC]; !ok || e.Addr.Less(old) {
+				macIPv4[e.MAC] = e.Addr
+			}
+		}
+		d, ok := n.devices[e.MAC]
+		if !ok {
+			d = &device{MAC: e.MAC, FirstSeen: now, Vendor: n.lookupVendor(e.MAC)}
+			n.devices[e.MAC] = d
+			newDevices = append(newDevices, e.MAC)
+			n.logger.Info("new device detected", zap.String("mac", e.MAC), zap.Stringer("addr", e.Addr), zap.String("vendor", d.Vendor))
+		}
+		d.LastSeen = now
+	}
+	n.addrMAC = addrMAC
+	n.macIPv4 = macIPv4
+	n.mu.Unlock()
+
+	if len(newDevices) > 0 {
+		if err := n.saveState(); err != nil {
+			n.logger.Warn("failed to save state file", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+func (n *Neighbor) lookupVendor(mac string) string {
+	if n.oui == nil {
+		return ""
+	}
+	key := strings.ToUpper(strings.ReplaceAll(mac, ":", ""))
+	if len(key) < 6 {
+		return ""
+	}
+	return n.oui[key[:6]]
+}
+
+func (n *Neighbor) loadState() error {
+	if len(n.args.StateFile) == 0 {
+		return nil
+	}
+	b, err := os.ReadFile(n.args.StateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var devices []*device
+	if err := json.Unmarshal(b, &devices); err != nil {
+		return err
+	}
+	for _, d := range devices {
+		n.devices[d.MAC] = d
+	}
+	return nil
+}
+
+func (n *Neighbor) saveState() error {
+	if len(n.args.StateFile) == 0 {
+		return nil
+	}
+	n.mu.RLock()
+	devices := make([]*device, 0, len(n.devices))
+	for _, d := range n.devices {
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].MAC < devices[j].MAC })
+	b, err := json.MarshalIndent(devices, "", "  ")
+	n.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	tmp := n.args.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, n.args.StateFile)
+}
+
+func (n *Neighbor) Close() error {
+	n.closeOnce.Do(func() { close(n.closeNotify) })
+	return nil
+}
+
+type clientInfo struct {
+	Addr string `json:"addr"`
+	device
+	New bool `json:"new"`
+}
+
+func (n *Neighbor) Api() *chi.Mux {
+	r := chi.NewRouter()
+
+	r.Get("/clients", func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		n.mu.RLock()
+		clients := make([]clientInfo, 0, len(n.addrMAC))
+		for addr, mac := range n.addrMAC {
+			d := n.devices[mac]
+			if d == nil {
+				continue
+			}
+			clients = append(clients, clientInfo{Addr: addr.String(), device: *d, New: !n.isTrusted(d, now)})
+		}
+		n.mu.RUnlock()
+		sort.Slice(clients, func(i, j int) bool { return clients[i].Addr < clients[j].Addr })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(clients)
+	})
+
+	setTrusted := func(trusted bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			hw, err := net.ParseMAC(chi.URLParam(r, "mac"))
+			if err != nil {
+				http.Error(w, "invalid mac address", http.StatusBadRequest)
+				return
+			}
+			mac := hw.String()
+			n.mu.Lock()
+			d, ok := n.devices[mac]
+			if ok {
+				d.Trusted = trusted
+			}
+			n.mu.Unlock()
+			if !ok {
+				http.Error(w, "device not found", http.StatusNotFound)
+				return
+			}
+			if err := n.saveState(); err != nil {
+				http.Error(w, "failed to save state: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			n.logger.Info("device trust changed", zap.String("mac", mac), zap.Bool("trusted", trusted))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+	r.Post("/devices/{mac}/trust", setTrusted(true))
+	r.Delete("/devices/{mac}/trust", setTrusted(false))
+
+	return r
+}
+
+// loadOUIFile loads an IEEE oui.txt or wireshark manuf style file.
+// Lines look like "00-00-0C   (hex)		Cisco Systems, Inc" or "00:00:0C	Cisco".
+func loadOUIFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		prefix, vendor, ok := strings.Cut(strings.ReplaceAll(line, "\t", " "), " ")
+		if !ok {
+			continue
+		}
+		prefix = strings.ToUpper(strings.NewReplacer(":", "", "-", "", ".", "").Replace(prefix))
+		if len(prefix) != 6 || strings.Trim(prefix, "0123456789ABCDEF") != "" {
+			continue
+		}
+		vendor = strings.TrimSpace(vendor)
+		if strings.HasPrefix(vendor, "(") { // "(hex)" or "(base 16)" in oui.txt
+			if _, after, ok := strings.Cut(vendor, ")"); ok {
+				vendor = strings.TrimSpace(after)
+			}
+		}
+		if len(vendor) > 0 {
+			m[prefix] = vendor
+		}
+	}
+	return m, scanner.Err()
+}
@@ -0,0 +1,71 @@
+package neighbor
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_loadOUIFile(t *testing.T) {
+	data := "# comment\n" +
+		"00-00-0C   (hex)\t\tCisco Systems, Inc\n" +
+		"00000C     (base 16)\t\tCisco Systems, Inc\n" +
+		"00:1A:11\tGoogle\n" +
+		"invalid line\n"
+	f := filepath.Join(t.TempDir(), "oui.txt")
+	if err := os.WriteFile(f, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadOUIFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := &Neighbor{oui: m}
+	tests := map[string]string{
+		"00:00:0c:12:34:56": "Cisco Systems, Inc",
+		"00:1a:11:00:00:01": "Google",
+		"aa:bb:cc:00:00:01": "",
+	}
+	for mac, want := range tests {
+		if got := n.lookupVendor(mac); got != want {
+			t.Errorf("lookupVendor(%s) = %q, want %q", mac, got, want)
+		}
+	}
+}
+
+func Test_Neighbor_Canonical(t *testing.T) {
+	n := &Neighbor{
+		args: Args{Aliases: map[string][]string{
+			"192.168.1.20": {"2001:db8::20", "aa:bb:cc:dd:ee:20"},
+		}},
+		addrAlias: make(map[netip.Addr]netip.Addr),
+		macAlias:  make(map[string]netip.Addr),
+		addrMAC: map[netip.Addr]string{
+			netip.MustParseAddr("192.168.1.10"):        "aa:bb:cc:dd:ee:10",
+			netip.MustParseAddr("2001:db8::1234:5678"): "aa:bb:cc:dd:ee:10",
+		},
+		macIPv4: map[string]netip.Addr{
+			"aa:bb:cc:dd:ee:10": netip.MustParseAddr("192.168.1.10"),
+		},
+	}
+	if err := n.loadAliases(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"2001:db8::1234:5678":       "192.168.1.10", // neighbor table
+		"fe80::a8bb:ccff:fedd:ee10": "192.168.1.10", // eui-64
+		"::ffff:192.168.1.10":       "192.168.1.10",
+		"2001:db8::20":              "192.168.1.20", // address alias
+		"fe80::a8bb:ccff:fedd:ee20": "192.168.1.20", // mac alias via eui-64
+		"fe80::1":                   "fe80::1",      // unknown
+		"192.168.1.30":              "192.168.1.30",
+	}
+	for addr, want := range tests {
+		if got := n.Canonical(netip.MustParseAddr(addr)); got.String() != want {
+			t.Errorf("Canonical(%s) = %s, want %s", addr, got, want)
+		}
+	}
+}
@@ -21,6 +21,7 @@ package nftset
 
 import (
 	"fmt"
+	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"strconv"
 	"strings"
@@ -29,6 +30,7 @@ import (
 const PluginType = "nftset"
 
 func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
 	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
 }
 
@@ -37,6 +39,19 @@ var _ sequence.Executable = (*nftSetPlugin)(nil)
 type Args struct {
 	IPv4 SetArgs `yaml:"ipv4"`
 	IPv6 SetArgs `yaml:"ipv6"`
+
+	// PinTTL keeps set elements and client caches expiring in sync.
+	// The element timeout will be at least the answer ttl, and the answer
+	// ttl will be pinned to the element timeout. If the element is already
+	// in the set, the answer ttl will be pinned to its remaining lifetime.
+	// Note: The set must have the timeout flag.
+	PinTTL bool `yaml:"pin_ttl"`
+
+	// TTLTimeout sets the timeout of each element to the ttl of its record,
+	// but at least the Timeout of the set. Unlike PinTTL, the answer is
+	// not modified.
+	// Note: The set must have the timeout flag.
+	TTLTimeout bool `yaml:"ttl_timeout"`
 }
 
 type SetArgs struct {
@@ -44,6 +59,18 @@ type SetArgs struct {
 	Table       string `yaml:"table_name"`
 	Set         string `yaml:"set_name"`
 	Mask        int    `yaml:"mask"`
+
+	// Timeout is the element timeout in seconds. 0 means using the
+	// default timeout of the set.
+	Timeout int `yaml:"timeout"`
+}
+
+func Init(_ *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	if a.IPv4.Timeout < 0 || a.IPv6.Timeout < 0 {
+		return nil, fmt.Errorf("invalid timeout, ipv4 %d, ipv6 %d", a.IPv4.Timeout, a.IPv6.Timeout)
+	}
+	return newNftSetPlugin(a)
 }
 
 // QuickSetup format: [{ip|ip6|inet},table_name,set_name,{ipv4_addr|ipv6_addr},mask] *2 (can repeat once)
@@ -26,6 +26,7 @@ import (
 	"fmt"
 	"net/netip"
 	"sync"
+	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/nftset_utils"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
@@ -40,8 +41,8 @@ type nftSetPlugin struct {
 	v6Handler *nftset_utils.NftSetHandler
 
 	mu     sync.RWMutex
-	seenV4 map[netip.Prefix]struct{}
-	seenV6 map[netip.Prefix]struct{}
+	seenV4 map[netip.Prefix]time.Time // value is the element expire time.
+	seenV6 map[netip.Prefix]time.Time
 }
 
 func newNftSetPlugin(args *Args) (*nftSetPlugin, error) {
@@ -56,8 +57,8 @@ func newNftSetPlugin(args *Args) (*nftSetPlugin, error) {
 
 	p := &nftSetPlugin{
 		args:   args,
-		seenV4: make(map[netip.Prefix]struct{}),
-		seenV6: make(map[netip.Prefix]struct{}),
+		seenV4: make(map[netip.Prefix]time.Time),
+		seenV6: make(map[netip.Prefix]time.Time),
 	}
 
 	newHandler := func(sa SetArgs) (*nftset_utils.NftSetHandler, error) {
@@ -100,8 +101,9 @@ func (p *nftSetPlugin) Exec(_ context.Context, qCtx *query_context.Context) erro
 }
 
 func (p *nftSetPlugin) addElems(r *dns.Msg) error {
-	var toAddV4 []netip.Prefix
-	var toAddV6 []netip.Prefix
+	toAddV4 := make(map[time.Duration][]netip.Prefix)
+	toAddV6 := make(map[time.Duration][]netip.Prefix)
+	now := time.Now()
 
 	for _, ans := range r.Answer {
 		switch rr := ans.(type) {
@@ -115,15 +117,8 @@ func (p *nftSetPlugin) addElems(r *dns.Msg) error {
 				return fmt.Errorf("internal: dns.A record [%s] is not ipv4", rr.A)
 			}
 			pfx := netip.PrefixFrom(addr, p.args.IPv4.Mask)
-
-			p.mu.RLock()
-			_, seen := p.seenV4[pfx]
-			p.mu.RUnlock()
-			if !seen {
-				p.mu.Lock()
-				p.seenV4[pfx] = struct{}{}
-				p.mu.Unlock()
-				toAddV4 = append(toAddV4, pfx)
+			if timeout, add := p.checkElem(p.seenV4, pfx, &rr.Hdr, p.args.IPv4.Timeout, now); add {
+				toAddV4[timeout] = append(toAddV4[timeout], pfx)
 			}
 
 		case *dns.AAAA:
@@ -138,15 +133,8 @@ func (p *nftSetPlugin) addElems(r *dns.Msg) error {
 				addr = netip.AddrFrom16(addr.As16())
 			}
 			pfx := netip.PrefixFrom(addr, p.args.IPv6.Mask)
-
-			p.mu.RLock()
-			_, seen := p.seenV6[pfx]
-			p.mu.RUnlock()
-			if !seen {
-				p.mu.Lock()
-				p.seenV6[pfx] = struct{}{}
-				p.mu.Unlock()
-				toAddV6 = append(toAddV6, pfx)
+			if timeout, add := p.checkElem(p.seenV6, pfx, &rr.Hdr, p.args.IPv6.Timeout, now); add {
+				toAddV6[timeout] = append(toAddV6[timeout], pfx)
 			}
 
 		default:
@@ -154,19 +142,56 @@ func (p *nftSetPlugin) addElems(r *dns.Msg) error {
 		}
 	}
 
-	if p.v4Handler != nil && len(toAddV4) > 0 {
-		if err := p.v4Handler.AddElems(toAddV4...); err != nil {
-			return fmt.Errorf("failed to add ipv4 elems %v: %w", toAddV4, err)
+	for timeout, pfxs := range toAddV4 {
+		if err := p.v4Handler.AddElemsWithTimeout(timeout, pfxs...); err != nil {
+			return fmt.Errorf("failed to add ipv4 elems %v: %w", pfxs, err)
 		}
 	}
-	if p.v6Handler != nil && len(toAddV6) > 0 {
-		if err := p.v6Handler.AddElems(toAddV6...); err != nil {
-			return fmt.Errorf("failed to add ipv6 elems %v: %w", toAddV6, err)
+	for timeout, pfxs := range toAddV6 {
+		if err := p.v6Handler.AddElemsWithTimeout(timeout, pfxs...); err != nil {
+			return fmt.Errorf("failed to add ipv6 elems %v: %w", pfxs, err)
 		}
 	}
 	return nil
 }
 
+// checkElem reports whether pfx needs to be added to the set and the
+// timeout of the new element. Elements that are still alive in the set
+// won't be added again. If PinTTL is enabled, the ttl in hdr will be pinned
+// to the lifetime of the element.
+func (p *nftSetPlugin) checkElem(seen map[netip.Prefix]time.Time, pfx netip.Prefix, hdr *dns.RR_Header, timeoutSec int, now time.Time) (time.Duration, bool) {
+	p.mu.RLock()
+	expire, ok := seen[pfx]
+	p.mu.RUnlock()
+
+	// Zero expire time means the element never expires.
+	if ok && (expire.IsZero() || expire.After(now)) {
+		if p.args.PinTTL && !expire.IsZero() {
+			hdr.Ttl = max(uint32(expire.Sub(now)/time.Second), 1)
+		}
+		return 0, false
+	}
+
+	timeout := uint32(timeoutSec)
+	if p.args.PinTTL {
+		if hdr.Ttl > timeout {
+			timeout = hdr.Ttl
+		}
+		hdr.Ttl = timeout
+	} else if p.args.TTLTimeout && hdr.Ttl > timeout {
+		timeout = hdr.Ttl
+	}
+
+	expire = time.Time{}
+	if timeout > 0 {
+		expire = now.Add(time.Duration(timeout) * time.Second)
+	}
+	p.mu.Lock()
+	seen[pfx] = expire
+	p.mu.Unlock()
+	return time.Duration(timeout) * time.Second, true
+}
+
 func (p *nftSetPlugin) Close() error {
 	if p.v4Handler != nil {
 		_ = p.v4Handler.Close()
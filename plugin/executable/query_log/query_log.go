@@ -0,0 +1,266 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const PluginType = "query_log"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const (
+	defaultMaxSizeMB  = 100
+	defaultMaxBackups = 7
+	defaultBufferSize = 4096
+	flushInterval     = time.Second
+	maxBatchSize      = 64 << 10
+)
+
+type Args struct {
+	// File is the log file. Required.
+	File string `yaml:"file"`
+	// MaxSize is the size in MB to rotate the file. Default is 100.
+	// -1 disables size based rotation.
+	MaxSize int `yaml:"max_size"`
+	// MaxAge is the age in hours to rotate the file. Default is 0, no
+	// time based rotation.
+	MaxAge int `yaml:"max_age"`
+	// MaxBackups is the number of rotated files to keep. Default is 7.
+	// -1 keeps all of them.
+	MaxBackups int `yaml:"max_backups"`
+	// BufferSize is the number of entries buffered while the file is
+	// being written. More entries are dropped. Default is 4096.
+	BufferSize int `yaml:"buffer_size"`
+}
+
+// Entry is a line of the log.
+type Entry struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Client      string    `json:"client,omitempty"`
+	Protocol    string    `json:"protocol,omitempty"`
+	QName       string    `json:"qname"`
+	QType       string    `json:"qtype"`
+	Rcode       string    `json:"rcode"` // "" if there is no response
+	DurationMs  float64   `json:"duration_ms"`
+	Upstream    string    `json:"upstream,omitempty"`
+	Transport   string    `json:"upstream_transport,omitempty"`
+	DomainSet   string    `json:"domain_set,omitempty"`
+	BlockReason string    `json:"block_reason,omitempty"`
+	TraceID     string    `json:"trace_id"`
+	Error       string    `json:"error,omitempty"`
+}
+
+var _ sequence.RecursiveExecutable = (*QueryLog)(nil)
+
+// QueryLog writes a JSON line for every query that passes through it,
+// after the rest of the sequence is executed. Lines are written in the
+// background and never block queries.
+type QueryLog struct {
+	logger *zap.Logger
+	f      *rotatingFile
+	lines  chan []byte
+
+	droppedTotal prometheus.Counter
+
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+	done        chan struct{}
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	l, err := NewQueryLog(args.(*Args), bp.Tag(), bp.L())
+	if err != nil {
+		return nil, err
+	}
+	if err := bp.M().GetMetricsReg().Register(l.droppedTotal); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// NewQueryLog creates a QueryLog. tag is the metrics label. logger can be nil.
+func NewQueryLog(args *Args, tag string, logger *zap.Logger) (*QueryLog, error) {
+	if len(args.File) == 0 {
+		return nil, errors.New("missing log file")
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	f := &rotatingFile{
+		path:       args.File,
+		maxSize:    int64(defaultMaxSizeMB) << 20,
+		maxAge:     time.Duration(args.MaxAge) * time.Hour,
+		maxBackups: defaultMaxBackups,
+	}
+	switch {
+	case args.MaxSize < 0:
+		f.maxSize = 0
+	case args.MaxSize > 0:
+		f.maxSize = int64(args.MaxSize) << 20
+	}
+	switch {
+	case args.MaxBackups < 0:
+		f.maxBackups = 0
+	case args.MaxBackups > 0:
+		f.maxBackups = args.MaxBackups
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	size := args.BufferSize
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	l := &QueryLog{
+		logger: logger,
+		f:      f,
+		lines:  make(chan []byte, size),
+		droppedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "query_log_dropped_total",
+			Help:        "The total number of query log entries dropped because the buffer was full",
+			ConstLabels: map[string]string{"tag": tag},
+		}),
+		closeNotify: make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+func (l *QueryLog) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	err := next.ExecNext(ctx, qCtx)
+	l.log(qCtx, err)
+	return err
+}
+
+// NewEntry returns the log entry of qCtx.
+func NewEntry(qCtx *query_context.Context, err error) Entry {
+	q := qCtx.QQuestion()
+	e := Entry{
+		Timestamp:  qCtx.StartTime(),
+		Protocol:   qCtx.ServerMeta.Protocol,
+		QName:      q.Name,
+		QType:      typeString(q.Qtype),
+		DurationMs: float64(time.Since(qCtx.StartTime()).Microseconds()) / 1000,
+		TraceID:    qCtx.TraceID,
+	}
+	if addr := qCtx.ServerMeta.ClientAddr; addr.IsValid() {
+		e.Client = addr.String()
+	}
+	if r := qCtx.R(); r != nil {
+		e.Rcode = dns.RcodeToString[r.Rcode]
+	}
+	e.Upstream = stringValue(qCtx, query_context.KeyUpstream)
+	e.Transport = stringValue(qCtx, query_context.KeyUpstreamTransport)
+	e.DomainSet = stringValue(qCtx, query_context.KeyDomainSet)
+	e.BlockReason = stringValue(qCtx, query_context.KeyBlockReason)
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+func (l *QueryLog) log(qCtx *query_context.Context, err error) {
+	b, jsonErr := json.Marshal(NewEntry(qCtx, err))
+	if jsonErr != nil {
+		return
+	}
+	select {
+	case l.lines <- append(b, '\n'):
+	default:
+		l.droppedTotal.Inc()
+	}
+}
+
+func (l *QueryLog) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	// Lines are written to f in batches of whole lines, so a rotation
+	// never splits a line.
+	var buf []byte
+	flush := func() {
+		if len(buf) == 0 {
+			return
+		}
+		if _, err := l.f.Write(buf); err != nil {
+			l.logger.Warn("failed to write query log", zap.Error(err))
+		}
+		buf = buf[:0]
+	}
+	for {
+		select {
+		case b := <-l.lines:
+			buf = append(buf, b...)
+			if len(buf) >= maxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-l.closeNotify:
+			for len(l.lines) > 0 {
+				buf = append(buf, <-l.lines...)
+			}
+			flush()
+			l.f.Close()
+			return
+		}
+	}
+}
+
+// Close writes the buffered entries and closes the file.
+func (l *QueryLog) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closeNotify)
+		<-l.done
+	})
+	return nil
+}
+
+func stringValue(qCtx *query_context.Context, k uint32) string {
+	v, _ := qCtx.GetValue(k)
+	s, _ := v.(string)
+	return s
+}
+
+func typeString(t uint16) string {
+	if s, ok := dns.TypeToString[t]; ok {
+		return s
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
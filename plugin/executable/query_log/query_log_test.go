@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+type blockExec struct{}
+
+func (blockExec) Exec(_ context.Context, qCtx *query_context.Context) error {
+	r := new(dns.Msg)
+	r.SetRcode(qCtx.Q(), dns.RcodeNameError)
+	qCtx.SetResponse(r)
+	qCtx.StoreValue(query_context.KeyBlockReason, "adguard_rule: ads")
+	return errors.New("test err")
+}
+
+func TestQueryLog(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "query.log")
+	l, err := NewQueryLog(&Args{File: file}, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := new(dns.Msg)
+	q.SetQuestion("ads.example.com.", dns.TypeAAAA)
+	qCtx := query_context.NewContext(q)
+	qCtx.ServerMeta = query_context.ServerMeta{ClientAddr: netip.MustParseAddr("10.0.0.2"), Protocol: "udp"}
+	next := sequence.NewChainWalker([]*sequence.ChainNode{{E: blockExec{}}}, nil, zap.NewNop())
+	if err := l.Exec(context.Background(), qCtx, next); err == nil {
+		t.Fatal("want exec error")
+	}
+	l.Close()
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e Entry
+	if err := json.Unmarshal(b, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Client != "10.0.0.2" || e.QName != "ads.example.com." || e.QType != "AAAA" || e.Rcode != "NXDOMAIN" ||
+		e.BlockReason != "adguard_rule: ads" || e.Error != "test err" || e.Protocol != "udp" || e.TraceID != qCtx.TraceID {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "query.log")
+	r := &rotatingFile{path: file, maxSize: 100, maxBackups: 2}
+	line := []byte(strings.Repeat("x", 39) + "\n")
+	for i := 0; i < 10; i++ {
+		if _, err := r.Write(line); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond) // unique backup names
+	}
+	r.Close()
+
+	backups := r.backups()
+	if len(backups) != 2 {
+		t.Fatalf("want 2 backups, got %v", backups)
+	}
+	for _, f := range append(backups, file) {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) == 0 || len(b) > 100 || !bytes.HasSuffix(b, []byte("\n")) {
+			t.Fatalf("%s has %d bytes", f, len(b))
+		}
+	}
+
+	// Existing files are appended to, and rotated by age.
+	r = &rotatingFile{path: file, maxAge: time.Hour}
+	if err := r.open(); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	r.openedAt = old
+	if _, err := r.Write(line); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if n := len(r.backups()); n != 3 {
+		t.Fatalf("want 3 backups, got %d", n)
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const backupTimeFormat = "20060102-150405.000"
+
+// rotatingFile is a file that is rotated by size and age. Rotated files
+// are renamed to "<file>.<time>", the oldest ones beyond maxBackups are
+// removed. It is not safe for concurrent use.
+type rotatingFile struct {
+	path       string
+	maxSize    int64         // 0 means no limit
+	maxAge     time.Duration // 0 means no limit
+	maxBackups int           // 0 means keeping all backups
+
+	f        *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.shouldRotate(int64(len(b))) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) shouldRotate(n int64) bool {
+	if r.size == 0 {
+		return false
+	}
+	return r.maxSize > 0 && r.size+n > r.maxSize ||
+		r.maxAge > 0 && time.Since(r.openedAt) >= r.maxAge
+}
+
+// open opens or creates the file. An existing file is appended to and
+// its age starts from its last modification.
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	r.f, r.size, r.openedAt = f, 0, time.Now()
+	if info, err := f.Stat(); err == nil {
+		r.size = info.Size()
+		if r.size > 0 {
+			r.openedAt = info.ModTime()
+		}
+	}
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+	backup := r.path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(r.path, backup); err != nil {
+		return fmt.Errorf("failed to rename log file, %w", err)
+	}
+	r.removeOldBackups()
+	return r.open()
+}
+
+func (r *rotatingFile) removeOldBackups() {
+	if r.maxBackups <= 0 {
+		return
+	}
+	backups := r.backups()
+	for len(backups) > r.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+// backups returns the rotated files, oldest first.
+func (r *rotatingFile) backups() []string {
+	matches, _ := filepath.Glob(r.path + ".*")
+	backups := matches[:0]
+	for _, m := range matches {
+		ts := strings.TrimPrefix(m, r.path+".")
+		if _, err := time.Parse(backupTimeFormat, ts); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	slices.Sort(backups) // the time format sorts as strings
+	return backups
+}
+
+func (r *rotatingFile) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
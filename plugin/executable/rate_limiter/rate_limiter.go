@@ -24,12 +24,14 @@ import (
 	"fmt"
 	"io"
 	"net/netip"
+	"strings"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v5/pkg/rate_limiter"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
 	"golang.org/x/time/rate"
 )
 
@@ -44,8 +46,20 @@ type Args struct {
 	Burst int     `yaml:"burst"`
 	Mask4 int     `yaml:"mask4"`
 	Mask6 int     `yaml:"mask6"`
+
+	// PerQname makes the limit per client and qname, instead of per client.
+	PerQname bool `yaml:"per_qname"`
+	// Action is what to do with limited queries when the plugin is used
+	// as an executable. "refused" (default) replies REFUSED, "drop" does
+	// not reply.
+	Action string `yaml:"action"`
 }
 
+const (
+	actionRefused = "refused"
+	actionDrop    = "drop"
+)
+
 func (args *Args) init() error {
 	utils.SetDefaultUnsignNum(&args.Qps, 20)
 	utils.SetDefaultUnsignNum(&args.Burst, 40)
@@ -58,10 +72,18 @@ func (args *Args) init() error {
 	if !utils.CheckNumRange(args.Mask6, 0, 128) {
 		return fmt.Errorf("invalid mask6")
 	}
+	switch args.Action {
+	case "":
+		args.Action = actionRefused
+	case actionRefused, actionDrop:
+	default:
+		return fmt.Errorf("invalid action %q", args.Action)
+	}
 	return nil
 }
 
 var _ sequence.Matcher = (*RateLimiter)(nil)
+var _ sequence.Executable = (*RateLimiter)(nil)
 var _ io.Closer = (*RateLimiter)(nil)
 
 type RateLimiter struct {
@@ -82,12 +104,38 @@ func New(args Args) (*RateLimiter, error) {
 	return &RateLimiter{l: l, args: args}, nil
 }
 
-func (s *RateLimiter) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+// Match returns false if the query exceeds the limit.
+func (s *RateLimiter) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	return s.allow(qCtx), nil
+}
+
+// Exec replies or drops the query according to Args.Action if it
+// exceeds the limit.
+func (s *RateLimiter) Exec(_ context.Context, qCtx *query_context.Context) error {
+	if s.allow(qCtx) {
+		return nil
+	}
+	qCtx.StoreValue(query_context.KeyBlockReason, PluginType)
+	if s.args.Action == actionDrop {
+		qCtx.StoreValue(query_context.KeyDropQuery, true)
+		qCtx.SetResponse(nil)
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetRcode(qCtx.Q(), dns.RcodeRefused)
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func (s *RateLimiter) allow(qCtx *query_context.Context) bool {
 	addr := s.getMaskedClientAddr(qCtx)
-	if addr.IsValid() {
-		return s.l.Allow(addr), nil
+	if !addr.IsValid() {
+		return true
+	}
+	if s.args.PerQname {
+		return s.l.AllowName(addr, strings.ToLower(qCtx.QQuestion().Name))
 	}
-	return true, nil
+	return s.l.Allow(addr)
 }
 
 func (s *RateLimiter) getMaskedClientAddr(qCtx *query_context.Context) netip.Addr {
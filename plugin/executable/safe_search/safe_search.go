@@ -0,0 +1,303 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package safe_search
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/go-chi/chi/v5"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "safe_search"
+
+// cnameTTL is the ttl of the inserted CNAME record. It is kept short
+// so that per client tag changes take effect quickly.
+const cnameTTL = 60
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const (
+	serviceGoogle     = "google"
+	serviceBing       = "bing"
+	serviceDuckDuckGo = "duckduckgo"
+	serviceYoutube    = "youtube"
+)
+
+var allServices = []string{serviceGoogle, serviceBing, serviceDuckDuckGo, serviceYoutube}
+
+// serviceDomains are the search domains of each service (except google,
+// see googleDomain) that will be redirected to its safe search address.
+var serviceDomains = map[string][]string{
+	serviceBing:       {"bing.com.", "www.bing.com."},
+	serviceDuckDuckGo: {"duckduckgo.com.", "www.duckduckgo.com.", "start.duckduckgo.com."},
+	serviceYoutube: {
+		"youtube.com.", "www.youtube.com.", "m.youtube.com.",
+		"youtubei.googleapis.com.", "youtube.googleapis.com.", "www.youtube-nocookie.com.",
+	},
+}
+
+// googleDomain matches google search domains in all countries,
+// e.g. google.com, www.google.co.uk, google.com.hk.
+var googleDomain = regexp.MustCompile(`^(www\.)?google\.(com?\.)?[a-z]{2,3}\.$`)
+
+type Args struct {
+	// Services to enforce, any of google, bing, duckduckgo and youtube.
+	// Default is all of them.
+	Services []string `yaml:"services"`
+	// YoutubeModerate uses the moderate restricted mode of youtube
+	// instead of the strict one.
+	YoutubeModerate bool `yaml:"youtube_moderate"`
+	// ClientTags enforces safe search only for clients with these tags (see
+	// client_acl.tags of servers). Empty enforces it for all clients.
+	// Can be changed via api.
+	ClientTags []string `yaml:"client_tags"`
+}
+
+var _ sequence.RecursiveExecutable = (*SafeSearch)(nil)
+
+// SafeSearch redirects queries for search engines to their safe search
+// addresses by inserting a CNAME, e.g. www.google.com -> forcesafesearch.google.com.
+type SafeSearch struct {
+	targets map[string]string // domain (fqdn) -> safe search address
+	google  string            // safe search address of google, empty if disabled
+
+	mu         sync.RWMutex
+	defaultOn  bool            // for clients without a tag setting
+	clientTags map[string]bool // client tag -> enforced
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	s, err := NewSafeSearch(args.(*Args))
+	if err != nil {
+		return nil, err
+	}
+	bp.L().Info("safe search enabled", zap.Strings("services", s.services()))
+	bp.RegAPI(s.Api())
+	return s, nil
+}
+
+func NewSafeSearch(args *Args) (*SafeSearch, error) {
+	services := args.Services
+	if len(services) == 0 {
+		services = allServices
+	}
+	s := &SafeSearch{
+		targets:    make(map[string]string),
+		defaultOn:  len(args.ClientTags) == 0,
+		clientTags: make(map[string]bool),
+	}
+	for _, service := range services {
+		var target string
+		switch service {
+		case serviceGoogle:
+			s.google = "forcesafesearch.google.com."
+			continue
+		case serviceBing:
+			target = "strict.bing.com."
+		case serviceDuckDuckGo:
+			target = "safe.duckduckgo.com."
+		case serviceYoutube:
+			target = "restrict.youtube.com."
+			if args.YoutubeModerate {
+				target = "restrictmoderate.youtube.com."
+			}
+		default:
+			return nil, fmt.Errorf("unknown service %s", service)
+		}
+		for _, d := range serviceDomains[service] {
+			s.targets[d] = target
+		}
+	}
+	for _, tag := range args.ClientTags {
+		s.clientTags[tag] = true
+	}
+	return s, nil
+}
+
+// services returns the enforced services for logging.
+func (s *SafeSearch) services() []string {
+	var ss []string
+	if len(s.google) > 0 {
+		ss = append(ss, serviceGoogle)
+	}
+	for _, service := range allServices[1:] {
+		if _, ok := s.targets[serviceDomains[service][0]]; ok {
+			ss = append(ss, service)
+		}
+	}
+	return ss
+}
+
+// target returns the safe search address of name (lower case fqdn).
+func (s *SafeSearch) target(name string) (string, bool) {
+	if t, ok := s.targets[name]; ok {
+		return t, true
+	}
+	if len(s.google) > 0 && googleDomain.MatchString(name) {
+		return s.google, true
+	}
+	return "", false
+}
+
+// enforced reports whether safe search is enforced for clients with tag.
+func (s *SafeSearch) enforced(tag string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if on, ok := s.clientTags[tag]; ok && len(tag) > 0 {
+		return on
+	}
+	return s.defaultOn
+}
+
+func (s *SafeSearch) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return next.ExecNext(ctx, qCtx)
+	}
+
+	orgQName := q.Question[0].Name
+	target, ok := s.target(strings.ToLower(orgQName))
+	if !ok {
+		return next.ExecNext(ctx, qCtx)
+	}
+	var tag string
+	if v, ok := qCtx.GetValue(query_context.KeyClientTag); ok {
+		tag, _ = v.(string)
+	}
+	if !s.enforced(tag) {
+		return next.ExecNext(ctx, qCtx)
+	}
+
+	q.Question[0].Name = target
+	defer func() {
+		q.Question[0].Name = orgQName
+	}()
+	err := next.ExecNext(ctx, qCtx)
+	if r := qCtx.R(); r != nil {
+		for i := range r.Question {
+			if r.Question[i].Name == target {
+				r.Question[i].Name = orgQName
+			}
+		}
+		newAns := make([]dns.RR, 1, len(r.Answer)+1)
+		newAns[0] = &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   orgQName,
+				Rrtype: dns.TypeCNAME,
+				Class:  dns.ClassINET,
+				Ttl:    cnameTTL,
+			},
+			Target: target,
+		}
+		r.Answer = append(newAns, r.Answer...)
+	}
+	return err
+}
+
+type status struct {
+	Services   []string        `json:"services"`
+	Default    bool            `json:"default"`     // enforced for clients without a tag setting
+	ClientTags map[string]bool `json:"client_tags"` // per client tag settings
+}
+
+type enabledPayload struct {
+	Enabled *bool `json:"enabled"`
+}
+
+func (s *SafeSearch) status() status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	st := status{Services: s.services(), Default: s.defaultOn, ClientTags: make(map[string]bool, len(s.clientTags))}
+	for tag, on := range s.clientTags {
+		st.ClientTags[tag] = on
+	}
+	return st
+}
+
+func (s *SafeSearch) Api() *chi.Mux {
+	r := chi.NewRouter()
+
+	writeStatus := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.status())
+	}
+	decodeEnabled := func(w http.ResponseWriter, r *http.Request) (bool, bool) {
+		var p enabledPayload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil || p.Enabled == nil {
+			http.Error(w, `invalid JSON, want {"enabled": true|false}`, http.StatusBadRequest)
+			return false, false
+		}
+		return *p.Enabled, true
+	}
+
+	r.Get("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w)
+	})
+
+	r.Put("/default", func(w http.ResponseWriter, r *http.Request) {
+		on, ok := decodeEnabled(w, r)
+		if !ok {
+			return
+		}
+		s.mu.Lock()
+		s.defaultOn = on
+		s.mu.Unlock()
+		writeStatus(w)
+	})
+
+	r.Put("/client_tags/{tag}", func(w http.ResponseWriter, r *http.Request) {
+		on, ok := decodeEnabled(w, r)
+		if !ok {
+			return
+		}
+		s.mu.Lock()
+		s.clientTags[chi.URLParam(r, "tag")] = on
+		s.mu.Unlock()
+		writeStatus(w)
+	})
+
+	r.Delete("/client_tags/{tag}", func(w http.ResponseWriter, r *http.Request) {
+		tag := chi.URLParam(r, "tag")
+		s.mu.Lock()
+		_, ok := s.clientTags[tag]
+		delete(s.clientTags, tag)
+		s.mu.Unlock()
+		if !ok {
+			http.Error(w, "client tag not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return r
+}
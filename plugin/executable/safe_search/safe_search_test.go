@@ -0,0 +1,139 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package safe_search
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+type upstream struct {
+	qname *string
+}
+
+func (u upstream) Exec(_ context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	*u.qname = q.Question[0].Name
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   []byte{216, 239, 38, 120},
+	}}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func exec(t *testing.T, s *SafeSearch, name, tag string) (string, *dns.Msg) {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	qCtx := query_context.NewContext(q)
+	if len(tag) > 0 {
+		qCtx.StoreValue(query_context.KeyClientTag, tag)
+	}
+	var upstreamQName string
+	cw := sequence.NewChainWalker([]*sequence.ChainNode{{RE: s}, {E: upstream{&upstreamQName}}}, nil, zap.NewNop())
+	if err := cw.ExecNext(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if q.Question[0].Name != name {
+		t.Fatalf("query name is not restored, got %s", q.Question[0].Name)
+	}
+	return upstreamQName, qCtx.R()
+}
+
+func TestSafeSearch_Exec(t *testing.T) {
+	s, err := NewSafeSearch(&Args{YoutubeModerate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		target string
+	}{
+		{"www.google.com.", "forcesafesearch.google.com."},
+		{"www.Google.co.uk.", "forcesafesearch.google.com."},
+		{"google.com.hk.", "forcesafesearch.google.com."},
+		{"www.bing.com.", "strict.bing.com."},
+		{"duckduckgo.com.", "safe.duckduckgo.com."},
+		{"m.youtube.com.", "restrictmoderate.youtube.com."},
+		{"mail.google.com.", ""},
+		{"forcesafesearch.google.com.", ""},
+		{"example.com.", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qname, r := exec(t, s, tt.name, "")
+			if len(tt.target) == 0 {
+				if qname != tt.name || len(r.Answer) != 1 {
+					t.Fatalf("query should not be redirected, upstream got %s, answer %v", qname, r.Answer)
+				}
+				return
+			}
+			if qname != tt.target {
+				t.Fatalf("upstream got %s, want %s", qname, tt.target)
+			}
+			cname, ok := r.Answer[0].(*dns.CNAME)
+			if !ok || cname.Hdr.Name != tt.name || cname.Target != tt.target || len(r.Answer) != 2 {
+				t.Fatalf("unexpected answer %v", r.Answer)
+			}
+			if r.Question[0].Name != tt.name {
+				t.Fatalf("response question is not restored, got %s", r.Question[0].Name)
+			}
+		})
+	}
+}
+
+func TestSafeSearch_ClientTags(t *testing.T) {
+	s, err := NewSafeSearch(&Args{Services: []string{"bing"}, ClientTags: []string{"kids"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qname, _ := exec(t, s, "www.google.com.", "kids"); qname != "www.google.com." {
+		t.Fatalf("google should not be enforced, upstream got %s", qname)
+	}
+	if qname, _ := exec(t, s, "www.bing.com.", "kids"); qname != "strict.bing.com." {
+		t.Fatalf("bing should be enforced for kids, upstream got %s", qname)
+	}
+	if qname, _ := exec(t, s, "www.bing.com.", "adults"); qname != "www.bing.com." {
+		t.Fatalf("bing should not be enforced for adults, upstream got %s", qname)
+	}
+
+	s.mu.Lock()
+	s.defaultOn = true
+	s.clientTags["kids"] = false
+	s.mu.Unlock()
+	if qname, _ := exec(t, s, "www.bing.com.", "kids"); qname != "www.bing.com." {
+		t.Fatalf("bing should not be enforced for kids, upstream got %s", qname)
+	}
+	if qname, _ := exec(t, s, "www.bing.com.", ""); qname != "strict.bing.com." {
+		t.Fatalf("bing should be enforced by default, upstream got %s", qname)
+	}
+
+	if _, err := NewSafeSearch(&Args{Services: []string{"yahoo"}}); err == nil {
+		t.Fatal("unknown service should be rejected")
+	}
+}
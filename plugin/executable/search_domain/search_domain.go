@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package search_domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/IrineSistiana/mosdns/v5/plugin/matcher/client_ip"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "search_domain"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.RecursiveExecutable = (*SearchDomain)(nil)
+
+type Args struct {
+	// Domains are the default search domains, tried in order.
+	Domains []string `yaml:"domains"`
+	// Clients overrides Domains for client groups. The first matched
+	// group is used.
+	Clients []ClientGroup `yaml:"clients"`
+}
+
+type ClientGroup struct {
+	// IPs has the same format as client_ip: "[ip|cidr]", "$ip_set_tag" or "&file".
+	IPs     []string `yaml:"ips"`
+	Domains []string `yaml:"domains"`
+}
+
+type clientGroup struct {
+	m       sequence.Matcher
+	domains []string
+}
+
+// SearchDomain expands single-label queries, e.g. "nas", with search
+// domains. The first expanded name that has an answer wins. If no expanded
+// name has an answer, the original query continues.
+type SearchDomain struct {
+	domains []string
+	groups  []clientGroup
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewSearchDomain(sequence.NewBQ(bp.M(), bp.L()), args.(*Args))
+}
+
+func NewSearchDomain(bq sequence.BQ, args *Args) (*SearchDomain, error) {
+	s := &SearchDomain{domains: normDomains(args.Domains)}
+	for i, g := range args.Clients {
+		if len(g.IPs) == 0 {
+			return nil, fmt.Errorf("client group #%d has no ip", i)
+		}
+		m, err := client_ip.QuickSetup(bq, strings.Join(g.IPs, " "))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ips in client group #%d, %w", i, err)
+		}
+		s.groups = append(s.groups, clientGroup{m: m, domains: normDomains(g.Domains)})
+	}
+	if len(s.domains) == 0 && len(s.groups) == 0 {
+		return nil, errors.New("no search domain is configured")
+	}
+	return s, nil
+}
+
+func normDomains(ds []string) []string {
+	var out []string
+	for _, d := range ds {
+		d = strings.Trim(d, ".")
+		if len(d) > 0 {
+			out = append(out, dns.Fqdn(strings.ToLower(d)))
+		}
+	}
+	return out
+}
+
+func (s *SearchDomain) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	q := qCtx.Q()
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET || dns.CountLabel(q.Question[0].Name) != 1 {
+		return next.ExecNext(ctx, qCtx)
+	}
+	domains, err := s.searchDomains(ctx, qCtx)
+	if err != nil {
+		return err
+	}
+
+	orgQName := q.Question[0].Name
+	for _, d := range domains {
+		target := orgQName + d
+		sub := qCtx.Copy()
+		sub.Q().Question[0].Name = target
+		if err := next.ExecNext(ctx, sub); err != nil {
+			return err
+		}
+		r := sub.R()
+		if r == nil || r.Rcode != dns.RcodeSuccess || len(r.Answer) == 0 {
+			continue
+		}
+
+		*qCtx = *sub
+		qCtx.Q().Question[0].Name = orgQName
+		// Restore original query name and insert a CNAME record, same as redirect.
+		for i := range r.Question {
+			if r.Question[i].Name == target {
+				r.Question[i].Name = orgQName
+			}
+		}
+		newAns := make([]dns.RR, 1, len(r.Answer)+1)
+		newAns[0] = &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   orgQName,
+				Rrtype: dns.TypeCNAME,
+				Class:  dns.ClassINET,
+				Ttl:    1,
+			},
+			Target: target,
+		}
+		r.Answer = append(newAns, r.Answer...)
+		return nil
+	}
+	return next.ExecNext(ctx, qCtx)
+}
+
+func (s *SearchDomain) searchDomains(ctx context.Context, qCtx *query_context.Context) ([]string, error) {
+	for _, g := range s.groups {
+		ok, err := g.m.Match(ctx, qCtx)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return g.domains, nil
+		}
+	}
+	return s.domains, nil
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package search_domain
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// zone answers A queries for its names and NXDOMAIN otherwise.
+type zone map[string]bool
+
+func (z zone) Exec(_ context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	name := q.Question[0].Name
+	if z[name] {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 168, 1, 2),
+		})
+	} else {
+		r.Rcode = dns.RcodeNameError
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_SearchDomain_Exec(t *testing.T) {
+	s, err := NewSearchDomain(nil, &Args{
+		Domains: []string{"lan", "home.lan."},
+		Clients: []ClientGroup{{IPs: []string{"192.168.2.0/24"}, Domains: []string{"iot.lan"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := sequence.NewChainWalker([]*sequence.ChainNode{{E: zone{"nas.home.lan.": true, "cam.iot.lan.": true}}}, nil, zap.NewNop())
+
+	tests := []struct {
+		name       string
+		qName      string
+		client     string
+		wantTarget string // empty means no expansion
+		wantRcode  int
+	}{
+		{"second search domain", "nas.", "192.168.1.10", "nas.home.lan.", dns.RcodeSuccess},
+		{"not found", "foo.", "192.168.1.10", "", dns.RcodeNameError},
+		{"multi label", "nas.home.lan.", "192.168.1.10", "", dns.RcodeSuccess},
+		{"client group", "cam.", "192.168.2.10", "cam.iot.lan.", dns.RcodeSuccess},
+		{"client group excludes default", "nas.", "192.168.2.10", "", dns.RcodeNameError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qName, dns.TypeA)
+			qCtx := query_context.NewContext(q)
+			qCtx.ServerMeta.ClientAddr = netip.MustParseAddr(tt.client)
+			if err := s.Exec(context.Background(), qCtx, next); err != nil {
+				t.Fatal(err)
+			}
+			if got := qCtx.Q().Question[0].Name; got != tt.qName {
+				t.Fatalf("query name = %s, want %s", got, tt.qName)
+			}
+			r := qCtx.R()
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("rcode = %d, want %d", r.Rcode, tt.wantRcode)
+			}
+			if r.Question[0].Name != tt.qName {
+				t.Fatalf("response question = %s, want %s", r.Question[0].Name, tt.qName)
+			}
+			if len(tt.wantTarget) > 0 {
+				cname, ok := r.Answer[0].(*dns.CNAME)
+				if !ok || cname.Target != tt.wantTarget {
+					t.Fatalf("unexpected first answer %v", r.Answer[0])
+				}
+			}
+		})
+	}
+}
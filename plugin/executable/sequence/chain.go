@@ -28,6 +28,7 @@ import (
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
@@ -42,10 +43,24 @@ type ChainNode struct {
 	// MODIFIED: Use the new struct to store matchers.
 	Matches []NamedMatcher // Can be empty, indicates this node has no match specified.
 
+	// AnyMatches are ORed. If not empty, at least one of them must
+	// match in addition to Matches.
+	AnyMatches []NamedMatcher
+
 	// At least one of E or RE must not nil.
 	// In case both are set. E is preferred.
 	E  Executable
 	RE RecursiveExecutable
+
+	// ElseE or ElseRE is executed instead of skipping this node if the
+	// matches were not met. Both can be nil.
+	ElseName string
+	ElseE    Executable
+	ElseRE   RecursiveExecutable
+
+	// execDuration observes the latency of E. Only set for plugins
+	// referenced by tag. Maybe nil.
+	execDuration prometheus.Observer
 }
 
 type ChainWalker struct {
@@ -69,6 +84,8 @@ func (w *ChainWalker) ExecNext(ctx context.Context, qCtx *query_context.Context)
 checkMatchesLoop:
 	for p < len(w.chain) {
 		n := w.chain[p]
+		hasElse := n.ElseE != nil || n.ElseRE != nil
+		matched := true
 
 		// MODIFIED: The loop now iterates over NamedMatcher.
 		for _, namedMatch := range n.Matches {
@@ -147,11 +164,32 @@ checkMatchesLoop:
 					// END OF MODIFICATION
 				}
 			} else {
-				// Skip this node if a condition was not met.
+				// Skip this node if a condition was not met, unless it
+				// has an else branch.
+				if hasElse {
+					matched = false
+					break
+				}
 				p++
 				continue checkMatchesLoop
 			}
 		}
+		if matched && len(n.AnyMatches) > 0 {
+			ok, err := w.matchAny(ctx, qCtx, n.AnyMatches)
+			if err != nil {
+				return err
+			}
+			if !ok && !hasElse {
+				p++
+				continue
+			}
+			matched = ok
+		}
+
+		pluginName, e, re := n.PluginName, n.E, n.RE
+		if !matched {
+			pluginName, e, re = n.ElseName, n.ElseE, n.ElseRE
+		}
 
 		if w.logger != nil {
 			if ce := w.logger.Check(zap.DebugLevel, "dns query flows through plugin"); ce != nil {
@@ -164,7 +202,7 @@ checkMatchesLoop:
 					zap.String("trace_id", qCtx.TraceID),
 					zap.Uint16("query_id", qCtx.Q().Id),
 					zap.String("domain", domain),
-					zap.String("plugin_name", n.PluginName),
+					zap.String("plugin_name", pluginName),
 					zap.Time("time", time.Now()),
 				)
 			}
@@ -172,20 +210,25 @@ checkMatchesLoop:
 
 		// Exec rules' executables in loop, or in stack if it is a recursive executable.
 		switch {
-		case n.E != nil:
-			if err := n.E.Exec(ctx, qCtx); err != nil {
+		case e != nil:
+			start := time.Now()
+			err := e.Exec(ctx, qCtx)
+			if matched && n.execDuration != nil {
+				n.execDuration.Observe(time.Since(start).Seconds())
+			}
+			if err != nil {
 				return err
 			}
 			p++
 			continue
-		case n.RE != nil:
+		case re != nil:
 			next := ChainWalker{
 				p:        p + 1,
 				chain:    w.chain,
 				jumpBack: w.jumpBack,
 				logger:   w.logger,
 			}
-			return n.RE.Exec(ctx, qCtx, next)
+			return re.Exec(ctx, qCtx, next)
 		default:
 			panic("n cannot be executed")
 		}
@@ -199,6 +242,29 @@ checkMatchesLoop:
 	return nil
 }
 
+// matchAny reports whether any of ms matches.
+func (w *ChainWalker) matchAny(ctx context.Context, qCtx *query_context.Context, ms []NamedMatcher) (bool, error) {
+	for _, namedMatch := range ms {
+		ok, err := namedMatch.Matcher.Match(ctx, qCtx)
+		if err != nil {
+			return false, err
+		}
+		if w.logger != nil {
+			if ce := w.logger.Check(zap.DebugLevel, "dns query flows through matcher"); ce != nil {
+				ce.Write(
+					zap.String("trace_id", qCtx.TraceID),
+					zap.String("matcher_name", namedMatch.Name),
+					zap.Bool("match_result", ok),
+				)
+			}
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (w *ChainWalker) nop() bool {
 	return w.p >= len(w.chain)
 }
@@ -239,6 +305,14 @@ func (s *Sequence) newNode(bq BQ, r RuleConfig, ri int) (*ChainNode, error) {
 		n.Matches = append(n.Matches, namedM)
 	}
 
+	for mi, mc := range r.AnyMatches {
+		namedM, err := s.newMatcher(bq, mc, ri, len(r.Matches)+mi)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init matcher #%d of if, %w", mi, err)
+		}
+		n.AnyMatches = append(n.AnyMatches, namedM)
+	}
+
 	// init exec
 	e, re, err := s.newExec(bq, r, ri)
 	if err != nil {
@@ -246,6 +320,24 @@ func (s *Sequence) newNode(bq BQ, r RuleConfig, ri int) (*ChainNode, error) {
 	}
 	n.E = e
 	n.RE = re
+	if r.Else != nil {
+		e, re, err := s.newExec(bq, *r.Else, ri)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init else_exec, %w", err)
+		}
+		n.ElseE, n.ElseRE = e, re
+		n.ElseName = r.Else.Tag
+		if len(n.ElseName) == 0 {
+			n.ElseName = fmt.Sprintf("anonymous_exec(%s: %v)", r.Else.Type, r.Else.Args)
+		}
+	}
+	if e != nil && len(r.Tag) > 0 {
+		o, err := newExecDurationObserver(bq, r.Tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to register metrics, %w", err)
+		}
+		n.execDuration = o
+	}
 	return n, nil
 }
 
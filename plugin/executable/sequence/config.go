@@ -24,6 +24,13 @@ import "strings"
 type RuleArgs struct {
 	Matches []string `yaml:"matches"`
 	Exec    string   `yaml:"exec"`
+
+	// If matches if any of its matchers matches. IfAnd matches if all of
+	// its matchers match, same as Matches. All of them must be met.
+	If    []string `yaml:"if"`
+	IfAnd []string `yaml:"if_and"`
+	// ElseExec is executed if the rule was not met. Optional.
+	ElseExec string `yaml:"else_exec"`
 }
 
 func parseArgs(ra RuleArgs) RuleConfig {
@@ -31,10 +38,20 @@ func parseArgs(ra RuleArgs) RuleConfig {
 	for _, s := range ra.Matches {
 		rc.Matches = append(rc.Matches, parseMatch(s))
 	}
+	for _, s := range ra.IfAnd {
+		rc.Matches = append(rc.Matches, parseMatch(s))
+	}
+	for _, s := range ra.If {
+		rc.AnyMatches = append(rc.AnyMatches, parseMatch(s))
+	}
 	tag, typ, args := parseExec(ra.Exec)
 	rc.Tag = tag
 	rc.Type = typ
 	rc.Args = args
+	if len(strings.TrimSpace(ra.ElseExec)) > 0 {
+		tag, typ, args := parseExec(ra.ElseExec)
+		rc.Else = &RuleConfig{Tag: tag, Type: typ, Args: args}
+	}
 	return rc
 }
 
@@ -68,10 +85,15 @@ func parseExec(s string) (tag string, typ string, args string) {
 }
 
 type RuleConfig struct {
-	Matches []MatchConfig `yaml:"matches"`
-	Tag     string        `yaml:"tag"`
-	Type    string        `yaml:"type"`
-	Args    string        `yaml:"args"`
+	Matches    []MatchConfig `yaml:"matches"`
+	AnyMatches []MatchConfig `yaml:"any_matches"`
+	Tag        string        `yaml:"tag"`
+	Type       string        `yaml:"type"`
+	Args       string        `yaml:"args"`
+
+	// Else is executed if the matches were not met. Only its Tag, Type
+	// and Args are used.
+	Else *RuleConfig `yaml:"else"`
 }
 
 type MatchConfig struct {
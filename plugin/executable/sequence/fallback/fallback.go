@@ -49,6 +49,7 @@ type fallback struct {
 	secondary            sequence.Executable
 	fastFallbackDuration time.Duration
 	alwaysStandby        bool
+	fallbackRcodes       map[int]struct{}
 }
 
 type Args struct {
@@ -62,6 +63,10 @@ type Args struct {
 
 	// AlwaysStandby: secondary should always stand by in fallback.
 	AlwaysStandby bool `yaml:"always_standby"`
+
+	// FallbackRcodes: primary responses with these rcodes are treated as
+	// failures. They are only used if secondary also fails.
+	FallbackRcodes []int `yaml:"fallback_rcodes"`
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
@@ -92,6 +97,10 @@ func newFallbackPlugin(bp *coremain.BP, args *Args) (*fallback, error) {
 		secondary:            se,
 		fastFallbackDuration: threshold,
 		alwaysStandby:        args.AlwaysStandby,
+		fallbackRcodes:       make(map[int]struct{}),
+	}
+	for _, rcode := range args.FallbackRcodes {
+		s.fallbackRcodes[rcode] = struct{}{}
 	}
 	return s, nil
 }
@@ -126,6 +135,9 @@ func (f *fallback) doFallback(ctx context.Context, qCtx *query_context.Context)
 		if err != nil || r == nil {
 			close(primFailed)
 			respChan <- nil
+		} else if f.undesired(r.Rcode) {
+			close(primFailed)
+			respChan <- qCtx
 		} else {
 			close(primDone)
 			respChan <- qCtx
@@ -180,6 +192,7 @@ func (f *fallback) doFallback(ctx context.Context, qCtx *query_context.Context)
 		}
 	}()
 
+	var lastResort *query_context.Context // a response with an undesired rcode
 	for i := 0; i < 2; i++ {
 		select {
 		case <-ctx.Done():
@@ -188,16 +201,32 @@ func (f *fallback) doFallback(ctx context.Context, qCtx *query_context.Context)
 			if successCtx == nil { // One of goroutines finished but failed or was skipped.
 				continue
 			}
+			if f.undesired(successCtx.R().Rcode) {
+				if lastResort == nil {
+					lastResort = successCtx
+				}
+				continue
+			}
 			// Copy all data from the successful context to the original context.
 			successCtx.CopyTo(qCtx)
 			return nil
 		}
 	}
 
+	if lastResort != nil {
+		lastResort.CopyTo(qCtx)
+		return nil
+	}
+
 	// All goroutines finished but failed.
 	return ErrFailed
 }
 
+func (f *fallback) undesired(rcode int) bool {
+	_, ok := f.fallbackRcodes[rcode]
+	return ok
+}
+
 func makeDdlCtx(ctx context.Context, timeout time.Duration) (context.Context, func()) {
 	ddl, ok := ctx.Deadline()
 	if !ok {
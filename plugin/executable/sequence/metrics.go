@@ -0,0 +1,42 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sequence
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newExecDurationObserver returns the latency observer of the executable
+// plugin tag. The histogram is shared by all sequences. It returns nil if
+// metrics are not available.
+func newExecDurationObserver(bq BQ, tag string) (prometheus.Observer, error) {
+	if bq.M() == nil {
+		return nil, nil
+	}
+	c, err := bq.M().RegSharedCollector(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "plugin_exec_duration_seconds",
+		Help:    "The execution latency of non-recursive executable plugins in sequences",
+		Buckets: []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5},
+	}, []string{"tag"}))
+	if err != nil {
+		return nil, err
+	}
+	return c.(*prometheus.HistogramVec).WithLabelValues(tag), nil
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package parallel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "parallel"
+
+const defaultParallelTimeout = time.Second * 5
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+type Args struct {
+	// Entries are the tags of the executables that run concurrently.
+	Entries []string `yaml:"entries"`
+
+	// RejectRcodes: responses with these rcodes are only used if no
+	// entry returns another response. Default is [2, 5] (SERVFAIL, REFUSED).
+	RejectRcodes []int `yaml:"reject_rcodes"`
+}
+
+var _ sequence.Executable = (*parallel)(nil)
+
+// parallel runs all entries with a copy of the query concurrently and
+// accepts the first valid response.
+type parallel struct {
+	logger       *zap.Logger
+	entries      []sequence.Executable
+	rejectRcodes map[int]struct{}
+}
+
+var ErrFailed = errors.New("no valid response from all entries")
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	if len(a.Entries) == 0 {
+		return nil, errors.New("args missing entries")
+	}
+	var es []sequence.Executable
+	for _, tag := range a.Entries {
+		e := sequence.ToExecutable(bp.M().GetPlugin(tag))
+		if e == nil {
+			return nil, fmt.Errorf("can not find executable %s", tag)
+		}
+		es = append(es, e)
+	}
+	return newParallel(bp.L(), es, a.RejectRcodes), nil
+}
+
+func newParallel(logger *zap.Logger, es []sequence.Executable, rejectRcodes []int) *parallel {
+	if rejectRcodes == nil {
+		rejectRcodes = []int{dns.RcodeServerFailure, dns.RcodeRefused}
+	}
+	p := &parallel{
+		logger:       logger,
+		entries:      es,
+		rejectRcodes: make(map[int]struct{}),
+	}
+	for _, rcode := range rejectRcodes {
+		p.rejectRcodes[rcode] = struct{}{}
+	}
+	return p
+}
+
+func (p *parallel) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	respChan := make(chan *query_context.Context, len(p.entries)) // resp could be nil.
+	for i, e := range p.entries {
+		qCtxCopy := qCtx.Copy()
+		go func(i int, e sequence.Executable) {
+			qCtx := qCtxCopy
+			ctx, cancel := makeDdlCtx(ctx, defaultParallelTimeout)
+			defer cancel()
+			err := e.Exec(ctx, qCtx)
+			if err != nil {
+				p.logger.Warn("entry error", zap.Int("entry", i), qCtx.InfoField(), zap.Error(err))
+			}
+			if err != nil || qCtx.R() == nil {
+				respChan <- nil
+				return
+			}
+			respChan <- qCtx
+		}(i, e)
+	}
+
+	var lastResort *query_context.Context // a response with a rejected rcode
+	for range p.entries {
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case successCtx := <-respChan:
+			if successCtx == nil {
+				continue
+			}
+			if _, rejected := p.rejectRcodes[successCtx.R().Rcode]; rejected {
+				if lastResort == nil {
+					lastResort = successCtx
+				}
+				continue
+			}
+			successCtx.CopyTo(qCtx)
+			return nil
+		}
+	}
+
+	if lastResort != nil {
+		lastResort.CopyTo(qCtx)
+		return nil
+	}
+	return ErrFailed
+}
+
+// makeDdlCtx makes a context that has the deadline of ctx but is not
+// cancelled with it, so slower entries can still finish (e.g. to fill
+// caches) after a response was accepted.
+func makeDdlCtx(ctx context.Context, timeout time.Duration) (context.Context, func()) {
+	ddl, ok := ctx.Deadline()
+	if !ok {
+		ddl = time.Now().Add(timeout)
+	}
+	return context.WithDeadline(context.Background(), ddl)
+}
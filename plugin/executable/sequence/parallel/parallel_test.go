@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package parallel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+type dummy struct {
+	delay time.Duration
+	rcode int
+	err   error
+}
+
+func (d *dummy) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	time.Sleep(d.delay)
+	if d.err != nil {
+		return d.err
+	}
+	r := new(dns.Msg)
+	r.SetRcode(qCtx.Q(), d.rcode)
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_parallel_Exec(t *testing.T) {
+	var (
+		fastOk     = &dummy{delay: 10 * time.Millisecond, rcode: dns.RcodeSuccess}
+		slowNx     = &dummy{delay: 50 * time.Millisecond, rcode: dns.RcodeNameError}
+		fastFail   = &dummy{rcode: dns.RcodeServerFailure}
+		errEntry   = &dummy{err: errors.New("err")}
+		fastRefuse = &dummy{rcode: dns.RcodeRefused}
+	)
+	tests := []struct {
+		name      string
+		entries   []sequence.Executable
+		wantRcode int
+		wantErr   bool
+	}{
+		{"first valid", []sequence.Executable{slowNx, fastOk}, dns.RcodeSuccess, false},
+		{"skip rejected", []sequence.Executable{fastFail, slowNx}, dns.RcodeNameError, false},
+		{"skip error", []sequence.Executable{errEntry, slowNx}, dns.RcodeNameError, false},
+		{"all rejected", []sequence.Executable{errEntry, fastRefuse}, dns.RcodeRefused, false},
+		{"all failed", []sequence.Executable{errEntry, errEntry}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newParallel(zap.NewNop(), tt.entries, nil)
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			qCtx := query_context.NewContext(q)
+			err := p.Exec(context.Background(), qCtx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Exec() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if r := qCtx.R(); r == nil || r.Rcode != tt.wantRcode {
+				t.Fatalf("want rcode %d, got %v", tt.wantRcode, r)
+			}
+		})
+	}
+}
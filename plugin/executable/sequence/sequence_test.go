@@ -161,6 +161,21 @@ func Test_sequence_Exec(t *testing.T) {
 			wantErr:    false,
 			wantTarget: true,
 		},
+		{
+			name: "if else",
+			ra: []RuleArgs{
+				{If: []string{"$false", "$false"}, Exec: "$err"}, // no else, skipped
+				{If: []string{"$false", "$true"}, IfAnd: []string{"$true"}, Exec: "$nop", ElseExec: "$err"},
+				{If: []string{"$true"}, Matches: []string{"$false"}, Exec: "$err", ElseExec: "jump seq2"},
+				{Exec: "$err"}, // accepted in seq2, skipped
+			},
+			ra2: []RuleArgs{
+				{Exec: "$target"},
+				{Exec: "accept"},
+			},
+			wantErr:    false,
+			wantTarget: true,
+		},
 		{
 			name: "reject",
 			ra: []RuleArgs{
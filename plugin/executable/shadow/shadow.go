@@ -0,0 +1,282 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package shadow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/go-chi/chi/v5"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "shadow"
+
+const (
+	defaultSampleRate = 0.1
+	defaultTimeout    = time.Second * 5
+	defaultConcurrent = 64
+	maxDiffs          = 100
+)
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.RecursiveExecutable = (*Shadow)(nil)
+
+type Args struct {
+	// Entry is the tag of the shadow sequence.
+	Entry string `yaml:"entry"`
+	// SampleRate is the fraction of queries that are also sent to Entry,
+	// in (0, 1]. Default is 0.1.
+	SampleRate float64 `yaml:"sample_rate"`
+	// Timeout of a shadow evaluation in seconds. Default is 5.
+	Timeout int `yaml:"timeout"`
+	// Concurrent is the maximum number of in-flight shadow evaluations.
+	// Samples beyond it are dropped. Default is 64.
+	Concurrent int `yaml:"concurrent"`
+}
+
+// Shadow runs the rest of the sequence as usual, and evaluates a sample of
+// queries with a shadow sequence in the background. The shadow response is
+// never sent to the client. Responses that differ are logged.
+type Shadow struct {
+	logger     *zap.Logger
+	entry      sequence.Executable
+	sampleRate float64
+	timeout    time.Duration
+	sem        chan struct{}
+
+	sampled   atomic.Uint64
+	dropped   atomic.Uint64
+	same      atomic.Uint64
+	different atomic.Uint64
+	errs      atomic.Uint64
+
+	mu    sync.Mutex
+	diffs []Diff // ring buffer, the newest is the last one.
+}
+
+// Diff is a query that got different responses.
+type Diff struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client,omitempty"`
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Primary Answer    `json:"primary"`
+	Shadow  Answer    `json:"shadow"`
+}
+
+// Answer is the comparable part of a response.
+type Answer struct {
+	Rcode   string   `json:"rcode"`
+	Answers []string `json:"answers,omitempty"`
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	if len(a.Entry) == 0 {
+		return nil, errors.New("missing entry")
+	}
+	e := sequence.ToExecutable(bp.M().GetPlugin(a.Entry))
+	if e == nil {
+		return nil, fmt.Errorf("can not find executable %s", a.Entry)
+	}
+	s, err := NewShadow(e, a, bp.L())
+	if err != nil {
+		return nil, err
+	}
+	bp.RegAPI(s.api())
+	return s, nil
+}
+
+func NewShadow(entry sequence.Executable, args *Args, logger *zap.Logger) (*Shadow, error) {
+	rate := args.SampleRate
+	if rate == 0 {
+		rate = defaultSampleRate
+	}
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("invalid sample_rate %v, must be in (0, 1]", rate)
+	}
+	timeout := time.Duration(args.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	concurrent := args.Concurrent
+	if concurrent <= 0 {
+		concurrent = defaultConcurrent
+	}
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &Shadow{
+		logger:     logger,
+		entry:      entry,
+		sampleRate: rate,
+		timeout:    timeout,
+		sem:        make(chan struct{}, concurrent),
+	}, nil
+}
+
+func (s *Shadow) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	if s.sampleRate < 1 && rand.Float64() >= s.sampleRate {
+		return next.ExecNext(ctx, qCtx)
+	}
+
+	// Copy the query before the primary chain modifies it.
+	shadowCtx := qCtx.Copy()
+	err := next.ExecNext(ctx, qCtx)
+	if err != nil {
+		// Nothing to compare with.
+		return err
+	}
+
+	select {
+	case s.sem <- struct{}{}:
+	default:
+		s.dropped.Add(1)
+		return nil
+	}
+	s.sampled.Add(1)
+	var primary *dns.Msg
+	if r := qCtx.R(); r != nil {
+		primary = r.Copy()
+	}
+	go func() {
+		defer func() { <-s.sem }()
+		s.evaluate(shadowCtx, primary)
+	}()
+	return nil
+}
+
+func (s *Shadow) evaluate(qCtx *query_context.Context, primary *dns.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	if err := s.entry.Exec(ctx, qCtx); err != nil {
+		s.errs.Add(1)
+		s.logger.Warn("shadow sequence error", qCtx.InfoField(), zap.Error(err))
+		return
+	}
+
+	pa, sa := toAnswer(primary), toAnswer(qCtx.R())
+	if pa.Rcode == sa.Rcode && slices.Equal(pa.Answers, sa.Answers) {
+		s.same.Add(1)
+		return
+	}
+
+	d := Diff{Time: time.Now(), Primary: pa, Shadow: sa}
+	if q := qCtx.QQuestion(); len(q.Name) > 0 {
+		d.Name = q.Name
+		d.Type = dns.TypeToString[q.Qtype]
+	}
+	if meta := qCtx.ServerMeta; meta.ClientAddr.IsValid() {
+		d.Client = meta.ClientAddr.String()
+	}
+	s.logger.Info(
+		"shadow response differs",
+		qCtx.InfoField(),
+		zap.String("primary_rcode", pa.Rcode),
+		zap.Strings("primary_answers", pa.Answers),
+		zap.String("shadow_rcode", sa.Rcode),
+		zap.Strings("shadow_answers", sa.Answers),
+	)
+
+	s.mu.Lock()
+	if len(s.diffs) >= maxDiffs {
+		s.diffs = slices.Delete(s.diffs, 0, 1)
+	}
+	s.diffs = append(s.diffs, d)
+	s.mu.Unlock()
+	s.different.Add(1)
+}
+
+// toAnswer returns the rcode and sorted answer records of r with ttl
+// ignored. A nil r has rcode "NONE".
+func toAnswer(r *dns.Msg) Answer {
+	if r == nil {
+		return Answer{Rcode: "NONE"}
+	}
+	a := Answer{Rcode: dns.RcodeToString[r.Rcode]}
+	for _, rr := range r.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		a.Answers = append(a.Answers, strings.ReplaceAll(rr.String(), "\t", " "))
+	}
+	slices.Sort(a.Answers)
+	return a
+}
+
+// Stats are the shadow evaluation counters.
+type Stats struct {
+	Sampled   uint64 `json:"sampled"`
+	Dropped   uint64 `json:"dropped"`
+	Same      uint64 `json:"same"`
+	Different uint64 `json:"different"`
+	Errors    uint64 `json:"errors"`
+}
+
+func (s *Shadow) Stats() Stats {
+	return Stats{
+		Sampled:   s.sampled.Load(),
+		Dropped:   s.dropped.Load(),
+		Same:      s.same.Load(),
+		Different: s.different.Load(),
+		Errors:    s.errs.Load(),
+	}
+}
+
+// Diffs returns recent differences, newest first.
+func (s *Shadow) Diffs() []Diff {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := append([]Diff{}, s.diffs...)
+	slices.Reverse(d)
+	return d
+}
+
+func (s *Shadow) api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Stats())
+	})
+	r.Get("/diffs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Diffs())
+	})
+	return r
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
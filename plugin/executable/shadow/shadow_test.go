@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package shadow
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// answer answers A queries with ip, or NXDOMAIN if ip is nil.
+type answer struct {
+	ip  net.IP
+	ttl uint32
+}
+
+func (a answer) Exec(_ context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	if a.ip == nil {
+		r.Rcode = dns.RcodeNameError
+	} else {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: a.ttl},
+			A:   a.ip,
+		})
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_Shadow_Exec(t *testing.T) {
+	tests := []struct {
+		name     string
+		primary  answer
+		shadow   answer
+		wantDiff bool
+	}{
+		{"same", answer{net.IPv4(1, 1, 1, 1), 60}, answer{net.IPv4(1, 1, 1, 1), 60}, false},
+		{"ttl ignored", answer{net.IPv4(1, 1, 1, 1), 60}, answer{net.IPv4(1, 1, 1, 1), 300}, false},
+		{"different ip", answer{net.IPv4(1, 1, 1, 1), 60}, answer{net.IPv4(2, 2, 2, 2), 60}, true},
+		{"blocked", answer{net.IPv4(1, 1, 1, 1), 60}, answer{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewShadow(tt.shadow, &Args{SampleRate: 1}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := sequence.NewChainWalker([]*sequence.ChainNode{{E: tt.primary}}, nil, zap.NewNop())
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			qCtx := query_context.NewContext(q)
+			if err := s.Exec(context.Background(), qCtx, next); err != nil {
+				t.Fatal(err)
+			}
+			if r := qCtx.R(); r == nil || len(r.Answer) != 1 || !r.Answer[0].(*dns.A).A.Equal(tt.primary.ip) {
+				t.Fatalf("client should get the primary response, got %v", r)
+			}
+
+			for i := 0; i < 100 && s.Stats().Same+s.Stats().Different == 0; i++ {
+				time.Sleep(time.Millisecond * 10)
+			}
+			st := s.Stats()
+			if st.Sampled != 1 || st.Same+st.Different != 1 {
+				t.Fatalf("unexpected stats %+v", st)
+			}
+			if gotDiff := st.Different == 1; gotDiff != tt.wantDiff {
+				t.Fatalf("want diff %v, got stats %+v", tt.wantDiff, st)
+			}
+			if tt.wantDiff {
+				d := s.Diffs()
+				if len(d) != 1 || d[0].Name != "example.com." || d[0].Type != "A" {
+					t.Fatalf("unexpected diffs %+v", d)
+				}
+			}
+		})
+	}
+}
+
+func Test_Shadow_SampleRate(t *testing.T) {
+	if _, err := NewShadow(answer{}, &Args{SampleRate: 1.5}, nil); err == nil {
+		t.Fatal("sample_rate > 1 should be rejected")
+	}
+}
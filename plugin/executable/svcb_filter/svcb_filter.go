@@ -0,0 +1,209 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package svcb_filter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/domain_set"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+const (
+	PluginType = "svcb_filter"
+)
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
+}
+
+// Args of the svcb_filter plugin. HTTPS (type 65) and SVCB (type 64)
+// records can carry ech configs and ip hints that let clients bypass
+// policies based on A/AAAA records and SNI.
+type Args struct {
+	// Strip removes all HTTPS and SVCB records.
+	Strip bool `yaml:"strip"`
+	// RemoveKeys are the SvcParam keys removed from the records,
+	// e.g. "ech", "ipv6hint", "key65500".
+	RemoveKeys []string `yaml:"remove_keys"`
+
+	// If DomainSets or Domains is set, only responses to queries that
+	// match them are modified. Others are passed through.
+	DomainSets []string `yaml:"domain_sets"` // tags of domain providers
+	Domains    []string `yaml:"domains"`     // domain expressions
+}
+
+var _ sequence.Executable = (*Filter)(nil)
+
+type Filter struct {
+	strip      bool
+	removeKeys map[dns.SVCBKey]struct{}
+
+	matchers []domain.Matcher[struct{}] // nil means all domains
+}
+
+// NewFilter returns a Filter that removes all records if strip is true,
+// otherwise removes removeKeys from the records.
+func NewFilter(strip bool, removeKeys []string) (*Filter, error) {
+	f := &Filter{strip: strip, removeKeys: make(map[dns.SVCBKey]struct{})}
+	for _, s := range removeKeys {
+		k, err := parseKey(s)
+		if err != nil {
+			return nil, err
+		}
+		f.removeKeys[k] = struct{}{}
+	}
+	if !f.strip && len(f.removeKeys) == 0 {
+		return nil, errors.New("one of strip and remove_keys is required")
+	}
+	return f, nil
+}
+
+// parseKey parses a SvcParam key name, e.g. "ech" or "key65500".
+func parseKey(s string) (dns.SVCBKey, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if n, ok := strings.CutPrefix(s, "key"); ok {
+		k, err := strconv.ParseUint(n, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid svc param key %s", s)
+		}
+		return dns.SVCBKey(k), nil
+	}
+	for k := dns.SVCB_MANDATORY; k <= dns.SVCB_OHTTP; k++ {
+		if k.String() == s {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown svc param key %s", s)
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	f, err := NewFilter(a.Strip, a.RemoveKeys)
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range a.DomainSets {
+		provider, _ := bp.M().GetPlugin(tag).(data_provider.DomainMatcherProvider)
+		if provider == nil {
+			return nil, fmt.Errorf("%s is not a DomainMatcherProvider", tag)
+		}
+		f.matchers = append(f.matchers, provider.GetDomainMatcher())
+	}
+	if len(a.Domains) > 0 {
+		m := domain.NewMixMatcher[struct{}]()
+		m.SetDefaultMatcher(domain.MatcherDomain)
+		if err := domain_set.LoadExps(a.Domains, m); err != nil {
+			return nil, err
+		}
+		f.matchers = append(f.matchers, m)
+	}
+	return f, nil
+}
+
+// QuickSetup format: "strip" or svc param keys to remove,
+// e.g. "ech ipv6hint".
+func QuickSetup(_ sequence.BQ, s string) (any, error) {
+	fs := strings.Fields(s)
+	if len(fs) == 1 && fs[0] == "strip" {
+		return NewFilter(true, nil)
+	}
+	return NewFilter(false, fs)
+}
+
+func (f *Filter) Exec(_ context.Context, qCtx *query_context.Context) error {
+	if r := qCtx.R(); r != nil && f.matchQuery(qCtx.Q()) {
+		r.Answer = f.filter(r.Answer)
+		r.Extra = f.filter(r.Extra)
+	}
+	return nil
+}
+
+// filter removes or modifies the HTTPS and SVCB records in rrs in place.
+func (f *Filter) filter(rrs []dns.RR) []dns.RR {
+	res := rrs[:0]
+	for _, rr := range rrs {
+		var svcb *dns.SVCB
+		switch v := rr.(type) {
+		case *dns.SVCB:
+			svcb = v
+		case *dns.HTTPS:
+			svcb = &v.SVCB
+		}
+		if svcb != nil {
+			if f.strip {
+				continue
+			}
+			svcb.Value = f.removeValues(svcb.Value)
+		}
+		res = append(res, rr)
+	}
+	return res
+}
+
+// removeValues removes f.removeKeys from values, including from the
+// mandatory key list, otherwise clients must ignore the record (RFC 9460
+// section 8).
+func (f *Filter) removeValues(values []dns.SVCBKeyValue) []dns.SVCBKeyValue {
+	res := values[:0]
+	for _, v := range values {
+		if _, ok := f.removeKeys[v.Key()]; ok {
+			continue
+		}
+		if m, ok := v.(*dns.SVCBMandatory); ok {
+			codes := m.Code[:0]
+			for _, k := range m.Code {
+				if _, ok := f.removeKeys[k]; !ok {
+					codes = append(codes, k)
+				}
+			}
+			if m.Code = codes; len(codes) == 0 {
+				continue
+			}
+		}
+		res = append(res, v)
+	}
+	return res
+}
+
+func (f *Filter) matchQuery(q *dns.Msg) bool {
+	if f.matchers == nil {
+		return true
+	}
+	if len(q.Question) != 1 {
+		return false
+	}
+	for _, m := range f.matchers {
+		if _, ok := m.Match(q.Question[0].Name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package svcb_filter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+func exec(t *testing.T, f *Filter, name string) *dns.Msg {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeHTTPS)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	rr, err := dns.NewRR(name + ` 300 IN HTTPS 1 . alpn="h3,h2" ipv4hint=1.2.3.4 ech="AEX+DQBBpQAgACA=" ipv6hint=2001:db8::1 mandatory=alpn,ech`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Answer = append(r.Answer, rr)
+	qCtx := query_context.NewContext(q)
+	qCtx.SetResponse(r)
+	if err := f.Exec(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	return qCtx.R()
+}
+
+func Test_Filter_RemoveKeys(t *testing.T) {
+	f, err := NewFilter(false, []string{"ech", "ipv6hint"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := exec(t, f, "example.com.")
+	if len(r.Answer) != 1 {
+		t.Fatalf("want 1 record, got %d", len(r.Answer))
+	}
+	var keys []string
+	for _, v := range r.Answer[0].(*dns.HTTPS).Value {
+		keys = append(keys, v.Key().String())
+		if m, ok := v.(*dns.SVCBMandatory); ok && len(m.Code) != 1 {
+			t.Fatalf("ech should be removed from mandatory, got %v", m.Code)
+		}
+	}
+	want := []string{"alpn", "ipv4hint", "mandatory"}
+	if len(keys) != len(want) {
+		t.Fatalf("want keys %v, got %v", want, keys)
+	}
+	for i := range want {
+		if keys[i] != want[i] {
+			t.Fatalf("want keys %v, got %v", want, keys)
+		}
+	}
+}
+
+func Test_Filter_Strip(t *testing.T) {
+	f, err := NewFilter(true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := domain.NewMixMatcher[struct{}]()
+	m.SetDefaultMatcher(domain.MatcherDomain)
+	if err := m.Add("example.com", struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	f.matchers = []domain.Matcher[struct{}]{m}
+
+	if r := exec(t, f, "www.example.com."); len(r.Answer) != 0 {
+		t.Fatalf("want records stripped, got %v", r.Answer)
+	}
+	if r := exec(t, f, "example.net."); len(r.Answer) != 1 {
+		t.Fatal("records of other domains should be passed through")
+	}
+}
+
+func Test_parseKey(t *testing.T) {
+	for s, want := range map[string]dns.SVCBKey{"ech": dns.SVCB_ECHCONFIG, "IPv6Hint": dns.SVCB_IPV6HINT, "key65500": 65500} {
+		if k, err := parseKey(s); err != nil || k != want {
+			t.Fatalf("parseKey(%s) = %d, %v, want %d", s, k, err, want)
+		}
+	}
+	for _, s := range []string{"foo", "key70000"} {
+		if _, err := parseKey(s); err == nil {
+			t.Fatalf("parseKey(%s) should fail", s)
+		}
+	}
+}
@@ -21,9 +21,14 @@ package ttl
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/domain_set"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"github.com/miekg/dns"
 	"strconv"
@@ -35,15 +40,30 @@ const (
 )
 
 func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
 	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
 }
 
+// Args of the ttl plugin. Fix overrides Min and Max.
+type Args struct {
+	Fix uint32 `yaml:"fix"`
+	Min uint32 `yaml:"min"`
+	Max uint32 `yaml:"max"`
+
+	// If DomainSets or Domains is set, only responses to queries that
+	// match them are modified.
+	DomainSets []string `yaml:"domain_sets"` // tags of domain providers
+	Domains    []string `yaml:"domains"`     // domain expressions
+}
+
 var _ sequence.Executable = (*TTL)(nil)
 
 type TTL struct {
 	fix uint32
 	min uint32
 	max uint32
+
+	matchers []domain.Matcher[struct{}] // nil means all domains
 }
 
 func NewTTL(fix, min, max uint32) *TTL {
@@ -54,22 +74,55 @@ func NewTTL(fix, min, max uint32) *TTL {
 	}
 }
 
+func Init(bp *coremain.BP, args any) (any, error) {
+	a := args.(*Args)
+	if a.Fix == 0 && a.Min == 0 && a.Max == 0 {
+		return nil, errors.New("one of fix, min and max is required")
+	}
+	if a.Max > 0 && a.Min > a.Max {
+		return nil, fmt.Errorf("min %d is greater than max %d", a.Min, a.Max)
+	}
+	t := NewTTL(a.Fix, a.Min, a.Max)
+	for _, tag := range a.DomainSets {
+		provider, _ := bp.M().GetPlugin(tag).(data_provider.DomainMatcherProvider)
+		if provider == nil {
+			return nil, fmt.Errorf("%s is not a DomainMatcherProvider", tag)
+		}
+		t.matchers = append(t.matchers, provider.GetDomainMatcher())
+	}
+	if len(a.Domains) > 0 {
+		m := domain.NewMixMatcher[struct{}]()
+		m.SetDefaultMatcher(domain.MatcherDomain)
+		if err := domain_set.LoadExps(a.Domains, m); err != nil {
+			return nil, err
+		}
+		t.matchers = append(t.matchers, m)
+	}
+	return t, nil
+}
+
 // QuickSetup format: {[min-max]|[fix]}
 // e.g. range "300-600", fixed ttl "5".
+// Either bound of the range can be omitted, e.g. "60-" only sets
+// a minimum ttl, "-3600" only sets a maximum ttl.
 func QuickSetup(_ sequence.BQ, s string) (any, error) {
 	var f, l, u uint32
 	ls, us, ok := strings.Cut(s, "-")
 	if ok { // range
-		n, err := strconv.ParseUint(ls, 10, 32)
-		if err != nil {
-			return nil, fmt.Errorf("invalid lower bound, %w", err)
+		if len(ls) > 0 {
+			n, err := strconv.ParseUint(ls, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid lower bound, %w", err)
+			}
+			l = uint32(n)
 		}
-		l = uint32(n)
-		n, err = strconv.ParseUint(us, 10, 32)
-		if err != nil {
-			return nil, fmt.Errorf("invalid upper bound, %w", err)
+		if len(us) > 0 {
+			n, err := strconv.ParseUint(us, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid upper bound, %w", err)
+			}
+			u = uint32(n)
 		}
-		u = uint32(n)
 	} else { // fixed
 		n, err := strconv.ParseUint(s, 10, 32)
 		if err != nil {
@@ -82,7 +135,7 @@ func QuickSetup(_ sequence.BQ, s string) (any, error) {
 }
 
 func (t *TTL) Exec(_ context.Context, qCtx *query_context.Context) error {
-	if r := qCtx.R(); r != nil {
+	if r := qCtx.R(); r != nil && t.matchQuery(qCtx.Q()) {
 		if t.fix > 0 {
 			dnsutils.SetTTL(r, t.fix)
 		} else {
@@ -98,3 +151,17 @@ func (t *TTL) Exec(_ context.Context, qCtx *query_context.Context) error {
 	return nil
 }
 
+func (t *TTL) matchQuery(q *dns.Msg) bool {
+	if t.matchers == nil {
+		return true
+	}
+	if len(q.Question) != 1 {
+		return false
+	}
+	for _, m := range t.matchers {
+		if _, ok := m.Match(q.Question[0].Name); ok {
+			return true
+		}
+	}
+	return false
+}
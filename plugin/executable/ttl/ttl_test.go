@@ -0,0 +1,66 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package ttl
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+func Test_TTL_Domains(t *testing.T) {
+	m := domain.NewMixMatcher[struct{}]()
+	m.SetDefaultMatcher(domain.MatcherDomain)
+	if err := m.Add("cdn.com", struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	p := NewTTL(0, 300, 3600)
+	p.matchers = []domain.Matcher[struct{}]{m}
+
+	exec := func(name string, ttl uint32) uint32 {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IPv4(1, 2, 3, 4),
+		})
+		qCtx := query_context.NewContext(q)
+		qCtx.SetResponse(r)
+		if err := p.Exec(context.Background(), qCtx); err != nil {
+			t.Fatal(err)
+		}
+		return qCtx.R().Answer[0].Header().Ttl
+	}
+
+	if got := exec("a.cdn.com.", 5); got != 300 {
+		t.Fatalf("want min ttl 300, got %d", got)
+	}
+	if got := exec("a.cdn.com.", 86400); got != 3600 {
+		t.Fatalf("want max ttl 3600, got %d", got)
+	}
+	if got := exec("example.com.", 5); got != 5 {
+		t.Fatalf("ttl of other domains should not change, got %d", got)
+	}
+}
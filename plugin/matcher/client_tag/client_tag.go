@@ -0,0 +1,64 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package client_tag
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+)
+
+const PluginType = "client_tag"
+
+func init() {
+	sequence.MustRegMatchQuickSetup(PluginType, QuickSetup)
+}
+
+var _ sequence.Matcher = (*matcher)(nil)
+
+// matcher matches the client tag assigned by the client_acl of servers.
+type matcher struct {
+	tags map[string]struct{}
+}
+
+// QuickSetup format: [tag]...
+func QuickSetup(_ sequence.BQ, s string) (sequence.Matcher, error) {
+	m := &matcher{tags: make(map[string]struct{})}
+	for _, tag := range strings.Fields(s) {
+		m.tags[tag] = struct{}{}
+	}
+	if len(m.tags) == 0 {
+		return nil, errors.New("no tag is specified")
+	}
+	return m, nil
+}
+
+func (m *matcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	v, ok := qCtx.GetValue(query_context.KeyClientTag)
+	if !ok {
+		return false, nil
+	}
+	tag, _ := v.(string)
+	_, ok = m.tags[tag]
+	return ok, nil
+}
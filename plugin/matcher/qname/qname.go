@@ -39,7 +39,14 @@ func QuickSetup(bq sequence.BQ, s string) (sequence.Matcher, error) {
 }
 
 func matchQName(qCtx *query_context.Context, m domain.Matcher[struct{}]) (bool, error) {
+	qm, _ := m.(domain.QtypeMatcher[struct{}])
 	for _, question := range qCtx.Q().Question {
+		if qm != nil {
+			if _, ok := qm.MatchQtype(question.Name, question.Qtype); ok {
+				return true, nil
+			}
+			continue
+		}
 		if _, ok := m.Match(question.Name); ok {
 			return true, nil
 		}
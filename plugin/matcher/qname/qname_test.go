@@ -0,0 +1,70 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package qname
+
+import (
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+// qtypeMatcher matches "v6.example." for AAAA queries only.
+type qtypeMatcher struct{}
+
+func (qtypeMatcher) Match(string) (struct{}, bool) { return struct{}{}, false }
+
+func (qtypeMatcher) MatchQtype(s string, qtype uint16) (struct{}, bool) {
+	return struct{}{}, s == "v6.example." && qtype == dns.TypeAAAA
+}
+
+func Test_matchQName(t *testing.T) {
+	mixM := domain.NewMixMatcher[struct{}]()
+	mixM.SetDefaultMatcher(domain.MatcherDomain)
+	if err := mixM.Add("example.", struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		m     domain.Matcher[struct{}]
+		qname string
+		qtype uint16
+		want  bool
+	}{
+		{"qtype matcher AAAA", qtypeMatcher{}, "v6.example.", dns.TypeAAAA, true},
+		{"qtype matcher A", qtypeMatcher{}, "v6.example.", dns.TypeA, false},
+		{"plain matcher", mixM, "a.example.", dns.TypeA, true},
+		{"plain matcher miss", mixM, "a.example.net.", dns.TypeA, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, tt.qtype)
+			got, err := matchQName(query_context.NewContext(q), tt.m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package resp_geoip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/geoip"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "resp_geoip"
+
+func init() {
+	sequence.MustRegMatchQuickSetup(PluginType, QuickSetup)
+}
+
+var _ sequence.Matcher = (*Matcher)(nil)
+
+// Matcher matches responses that have an A/AAAA record located in
+// one of the countries.
+type Matcher struct {
+	db    geoip.CountryProvider
+	codes map[string]struct{}
+}
+
+// QuickSetup format: "$geoip_tag country_code..."
+// e.g. "$geoip cn hk".
+func QuickSetup(bq sequence.BQ, s string) (sequence.Matcher, error) {
+	fs := strings.Fields(s)
+	if len(fs) < 2 || !strings.HasPrefix(fs[0], "$") {
+		return nil, errors.New("invalid args, format is \"$geoip_tag country_code...\"")
+	}
+	tag := strings.TrimPrefix(fs[0], "$")
+	db, _ := bq.M().GetPlugin(tag).(geoip.CountryProvider)
+	if db == nil {
+		return nil, fmt.Errorf("cannot find geoip %s", tag)
+	}
+	return NewMatcher(db, fs[1:]), nil
+}
+
+func NewMatcher(db geoip.CountryProvider, codes []string) *Matcher {
+	m := &Matcher{db: db, codes: make(map[string]struct{}, len(codes))}
+	for _, c := range codes {
+		m.codes[strings.ToUpper(c)] = struct{}{}
+	}
+	return m
+}
+
+func (m *Matcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	r := qCtx.R()
+	if r == nil {
+		return false, nil
+	}
+	for _, rr := range r.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+		if _, ok := m.codes[m.db.Country(addr.Unmap())]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
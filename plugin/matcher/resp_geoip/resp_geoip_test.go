@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package resp_geoip
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+type fakeDB map[netip.Addr]string
+
+func (f fakeDB) Country(addr netip.Addr) string { return f[addr] }
+
+func Test_Matcher(t *testing.T) {
+	db := fakeDB{
+		netip.MustParseAddr("1.1.1.1"):     "CN",
+		netip.MustParseAddr("2001:db8::1"): "HK",
+		netip.MustParseAddr("8.8.8.8"):     "US",
+	}
+	m := NewMatcher(db, []string{"cn", "hk"})
+
+	tests := []struct {
+		name string
+		ans  []dns.RR
+		want bool
+	}{
+		{"no answer", nil, false},
+		{"a", []dns.RR{&dns.A{A: net.ParseIP("1.1.1.1")}}, true},
+		{"aaaa", []dns.RR{&dns.AAAA{AAAA: net.ParseIP("2001:db8::1")}}, true},
+		{"other country", []dns.RR{&dns.A{A: net.ParseIP("8.8.8.8")}}, false},
+		{"unknown", []dns.RR{&dns.A{A: net.ParseIP("9.9.9.9")}}, false},
+		{"mixed", []dns.RR{&dns.A{A: net.ParseIP("8.8.8.8")}, &dns.A{A: net.ParseIP("1.1.1.1")}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			qCtx := query_context.NewContext(q)
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.Answer = tt.ans
+			qCtx.SetResponse(r)
+			got, err := m.Match(context.Background(), qCtx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
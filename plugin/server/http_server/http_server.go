@@ -25,6 +25,7 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
@@ -46,25 +47,58 @@ type Args struct {
 		Exec string `yaml:"exec"`
 		Path string `yaml:"path"`
 	} `yaml:"entries"`
-	Listen      string `yaml:"listen"`
-	SrcIPHeader string `yaml:"src_ip_header"`
-	Cert        string `yaml:"cert"`
-	Key         string `yaml:"key"`
-	IdleTimeout int    `yaml:"idle_timeout"`
-	EnableAudit bool   `yaml:"enable_audit"` // ADDED: Flag to enable audit logging for this server instance.
+	Listen        string `yaml:"listen"`
+	SrcIPHeader   string `yaml:"src_ip_header"`
+	Cert          string `yaml:"cert"`
+	Key           string `yaml:"key"`
+	IdleTimeout   int    `yaml:"idle_timeout"`
+	EnableAudit   bool   `yaml:"enable_audit"`   // ADDED: Flag to enable audit logging for this server instance.
+	NSID          string `yaml:"nsid"`           // Optional NSID (RFC 5001) to identify this instance.
+	MinTTL        uint32 `yaml:"min_ttl"`        // Optional minimum ttl of the answers sent to clients.
+	TraceUpstream bool   `yaml:"trace_upstream"` // Optional. Reply the upstream name to clients that request it.
+	Malformed     string `yaml:"malformed"`      // Optional. One of "drop" (default), "formerr", "repair".
+
+	// EmergencyEntry is executed instead if entry panics. Optional.
+	EmergencyEntry string `yaml:"emergency_entry"`
+
+	// ClientACL controls client access and assigns client tags. Optional.
+	ClientACL *server_utils.ClientACLArgs `yaml:"client_acl"`
+
+	// Socket sets socket options of the listeners. Optional.
+	Socket server_utils.SocketArgs `yaml:"socket"`
+
+	// CertReloadInterval is the interval in seconds to check cert files
+	// for changes, in addition to watching them. Default is 3600,
+	// negative disables it.
+	CertReloadInterval int `yaml:"cert_reload_interval"`
 }
 
 func (a *Args) init() {
 	utils.SetDefaultNum(&a.IdleTimeout, 30)
 }
 
+// ReferredTags implements coremain.TagReferrer.
+func (a *Args) ReferredTags() []string {
+	tags := []string{a.EmergencyEntry}
+	for _, e := range a.Entries {
+		tags = append(tags, e.Exec)
+	}
+	return tags
+}
+
 type HttpServer struct {
 	args *Args
 
 	server *http.Server
+	cr     *server.CertReloader // nil if tls is disabled
+	closed atomic.Bool
 }
 
 func (s *HttpServer) Close() error {
+	s.closed.Store(true)
+	if s.cr != nil {
+		s.cr.Close()
+	}
 	return s.server.Close()
 }
 
@@ -79,7 +113,15 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 	for _, entry := range args.Entries {
 		// MODIFIED: Pass the EnableAudit flag from HTTP server args.
 		// Note: HTTP server args contain a list of entries, so we pass the main EnableAudit flag for all sub-entries.
-		dh, err := server_utils.NewHandler(bp, entry.Exec, args.EnableAudit) 
+		dh, err := server_utils.NewHandler(bp, entry.Exec, server_utils.HandlerOpts{
+			EnableAudit:    args.EnableAudit,
+			NSID:           args.NSID,
+			MinTTL:         args.MinTTL,
+			TraceUpstream:  args.TraceUpstream,
+			Malformed:      args.Malformed,
+			EmergencyEntry: args.EmergencyEntry,
+			ClientACL:      args.ClientACL,
+		}) 
 		if err != nil {
 			return nil, fmt.Errorf("failed to init dns handler for path %s, %w", entry.Path, err)
 		}
@@ -91,21 +133,46 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 		mux.Handle(entry.Path, hh)
 	}
 
+	var cr *server.CertReloader
+	if len(args.Key)+len(args.Cert) > 0 {
+		var err error
+		cr, err = server_utils.NewCertReloader(bp, args.Cert, args.Key, args.CertReloadInterval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tls cert, %w", err)
+		}
+	}
+	closeCr := func() {
+		if cr != nil {
+			cr.Close()
+		}
+	}
+
 	socketOpt := server_utils.ListenerSocketOpts{
 		SO_REUSEPORT: true,
 		SO_RCVBUF:    64 * 1024,
 	}
-	lc := net.ListenConfig{Control: server_utils.ListenerControl(socketOpt)}
+	lc := args.Socket.ListenConfig(socketOpt)
 
 	listenerNetwork := "tcp"
 	if strings.HasPrefix(args.Listen, "@") {
 		listenerNetwork = "unix"
 	}
-	l, err := lc.Listen(context.Background(), listenerNetwork, args.Listen)
-	if err != nil {
-		return nil, fmt.Errorf("failed to listen socket, %w", err)
+	var ls []net.Listener
+	closeLs := func() {
+		for _, l := range ls {
+			l.Close()
+		}
+	}
+	for i := 0; i < args.Socket.ListenerNum(); i++ {
+		l, err := lc.Listen(context.Background(), listenerNetwork, args.Listen)
+		if err != nil {
+			closeLs()
+			closeCr()
+			return nil, fmt.Errorf("failed to listen socket, %w", err)
+		}
+		ls = append(ls, l)
 	}
-	bp.L().Info("http server started", zap.Stringer("addr", l.Addr()))
+	bp.L().Info("http server started", zap.Stringer("addr", ls[0].Addr()), zap.Int("listeners", len(ls)))
 
 	hs := &http.Server{
 		Handler:        mux,
@@ -119,20 +186,32 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 		MaxUploadBufferPerConnection: 65535,
 		MaxUploadBufferPerStream:     65535,
 	}); err != nil {
+		closeLs()
+		closeCr()
 		return nil, fmt.Errorf("failed to setup http2 server, %w", err)
 	}
+	if cr != nil {
+		// Set after http2.ConfigureServer, which inits hs.TLSConfig.
+		hs.TLSConfig.GetCertificate = cr.GetCertificate
+	}
 
-	go func() {
-		var err error
-		if len(args.Key)+len(args.Cert) > 0 {
-			err = hs.ServeTLS(l, args.Cert, args.Key)
-		} else {
-			err = hs.Serve(l)
-		}
-		bp.M().GetSafeClose().SendCloseSignal(err)
-	}()
-	return &HttpServer{
+	s := &HttpServer{
 		args:   args,
 		server: hs,
-	}, nil
+		cr:     cr,
+	}
+	for _, l := range ls {
+		go func() {
+			var err error
+			if cr != nil {
+				err = hs.ServeTLS(l, "", "")
+			} else {
+				err = hs.Serve(l)
+			}
+			if !s.closed.Load() { // Closed by Close(), e.g. plugin restart.
+				bp.M().GetSafeClose().SendCloseSignal(err)
+			}
+		}()
+	}
+	return s, nil
 }
@@ -20,10 +20,14 @@
 package quic_server
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
@@ -41,14 +45,38 @@ func init() {
 }
 
 type Args struct {
-	Entry       string `yaml:"entry"`
-	Listen      string `yaml:"listen"`
-	Cert        string `yaml:"cert"`
-	Key         string `yaml:"key"`
-	IdleTimeout int    `yaml:"idle_timeout"`
-	MaxStreamData   int    `yaml:"max_stream_data"` // original field
-	MaxConnectionData int  `yaml:"max_connection_data"` // original field
-	EnableAudit bool   `yaml:"enable_audit"` // ADDED: Flag to enable audit logging for this server instance.
+	Entry             string `yaml:"entry"`
+	Listen            string `yaml:"listen"`
+	Cert              string `yaml:"cert"`
+	Key               string `yaml:"key"`
+	IdleTimeout       int    `yaml:"idle_timeout"`
+	MaxStreamData     int    `yaml:"max_stream_data"`     // original field
+	MaxConnectionData int    `yaml:"max_connection_data"` // original field
+	EnableAudit       bool   `yaml:"enable_audit"`        // ADDED: Flag to enable audit logging for this server instance.
+	NSID              string `yaml:"nsid"`                // Optional NSID (RFC 5001) to identify this instance.
+	MinTTL            uint32 `yaml:"min_ttl"`             // Optional minimum ttl of the answers sent to clients.
+	TraceUpstream     bool   `yaml:"trace_upstream"`      // Optional. Reply the upstream name to clients that request it.
+	Malformed         string `yaml:"malformed"`           // Optional. One of "drop" (default), "formerr", "repair".
+
+	// EmergencyEntry is executed instead if entry panics. Optional.
+	EmergencyEntry string `yaml:"emergency_entry"`
+
+	// ClientACL controls client access and assigns client tags. Optional.
+	ClientACL *server_utils.ClientACLArgs `yaml:"client_acl"`
+
+	// Socket sets socket options of the listener. Optional.
+	// Socket.Listeners is not supported.
+	Socket server_utils.SocketArgs `yaml:"socket"`
+
+	// Allow0RTT accepts queries in 0-RTT data from resumed sessions.
+	// Only standard queries are answered before the handshake completes,
+	// since 0-RTT data can be replayed.
+	Allow0RTT bool `yaml:"allow_0rtt"`
+
+	// CertReloadInterval is the interval in seconds to check cert files
+	// for changes, in addition to watching them. Default is 3600,
+	// negative disables it.
+	CertReloadInterval int `yaml:"cert_reload_interval"`
 }
 
 func (a *Args) init() {
@@ -56,14 +84,28 @@ func (a *Args) init() {
 	// No defaults for MaxStreamData/MaxConnectionData based on provided original init()
 }
 
+// ReferredTags implements coremain.TagReferrer.
+func (a *Args) ReferredTags() []string {
+	return []string{a.Entry, a.EmergencyEntry}
+}
+
 type QuicServer struct {
 	args *Args
 
-	l *quic.Listener
+	l      io.Closer // *quic.Listener or *quic.EarlyListener
+	t      *quic.Transport
+	c      net.PacketConn
+	cr     *server.CertReloader
+	closed atomic.Bool
 }
 
 func (s *QuicServer) Close() error {
-	return s.l.Close()
+	s.closed.Store(true)
+	err := s.l.Close()
+	s.t.Close()
+	s.c.Close()
+	s.cr.Close()
+	return err
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
@@ -76,23 +118,45 @@ func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 	logger := bp.L()
 
 	// MODIFIED: Pass the EnableAudit flag to the handler constructor.
-	dh, err := server_utils.NewHandler(bp, args.Entry, args.EnableAudit)
+	dh, err := server_utils.NewHandler(bp, args.Entry, server_utils.HandlerOpts{
+		EnableAudit:    args.EnableAudit,
+		NSID:           args.NSID,
+		MinTTL:         args.MinTTL,
+		TraceUpstream:  args.TraceUpstream,
+		Malformed:      args.Malformed,
+		EmergencyEntry: args.EmergencyEntry,
+		ClientACL:      args.ClientACL,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to init dns handler, %w", err)
 	}
 
+	if args.Socket.ListenerNum() > 1 {
+		return nil, errors.New("quic server does not support multiple listeners")
+	}
+
 	// Init tls
 	if len(args.Key) == 0 || len(args.Cert) == 0 {
 		return nil, errors.New("quic server requires a tls certificate")
 	}
-	tlsConfig := new(tls.Config)
-	if err := server.LoadCert(tlsConfig, args.Cert, args.Key); err != nil {
+	cr, err := server_utils.NewCertReloader(bp, args.Cert, args.Key, args.CertReloadInterval)
+	if err != nil {
 		return nil, fmt.Errorf("failed to read tls cert, %w", err)
 	}
-	tlsConfig.NextProtos = []string{"doq"}
+	tlsConfig := &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		NextProtos:     []string{"doq"},
+	}
 
-	uc, err := net.ListenPacket("udp", args.Listen)
+	// Accept "quic://addr" and "doq://addr", as in forward upstreams.
+	listen := args.Listen
+	for _, scheme := range []string{"quic://", "doq://"} {
+		listen = strings.TrimPrefix(listen, scheme)
+	}
+	lc := args.Socket.ListenConfig(server_utils.ListenerSocketOpts{})
+	uc, err := lc.ListenPacket(context.Background(), "udp", listen)
 	if err != nil {
+		cr.Close()
 		return nil, fmt.Errorf("failed to listen socket, %w", err)
 	}
 
@@ -104,7 +168,7 @@ func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 		MaxStreamReceiveWindow:         4 * 1024,
 		InitialConnectionReceiveWindow: 8 * 1024,
 		MaxConnectionReceiveWindow:     16 * 1024,
-		Allow0RTT:                      false,
+		Allow0RTT:                      args.Allow0RTT,
 
 		// UniStream is not allowed.
 		MaxIncomingUniStreams: -1,
@@ -119,21 +183,43 @@ func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 		StatelessResetKey: (*quic.StatelessResetKey)(srk),
 	}
 
-	quicListener, err := qt.Listen(tlsConfig, quicConfig)
-	if err != nil {
-		qt.Close()
-		return nil, fmt.Errorf("failed to listen quic, %w", err)
+	var (
+		l    server.DoQListener
+		addr net.Addr
+	)
+	if args.Allow0RTT {
+		el, err := qt.ListenEarly(tlsConfig, quicConfig)
+		if err != nil {
+			qt.Close()
+			cr.Close()
+			return nil, fmt.Errorf("failed to listen quic, %w", err)
+		}
+		l, addr = el, el.Addr()
+	} else {
+		ql, err := qt.Listen(tlsConfig, quicConfig)
+		if err != nil {
+			qt.Close()
+			cr.Close()
+			return nil, fmt.Errorf("failed to listen quic, %w", err)
+		}
+		l, addr = ql, ql.Addr()
 	}
-	bp.L().Info("quic server started", zap.Stringer("addr", quicListener.Addr()))
+	bp.L().Info("quic server started", zap.Stringer("addr", addr), zap.Bool("allow_0rtt", args.Allow0RTT))
 
+	s := &QuicServer{
+		args: args,
+		l:    l.(io.Closer),
+		t:    qt,
+		c:    uc,
+		cr:   cr,
+	}
 	go func() {
-		defer quicListener.Close()
+		defer s.l.Close()
 		serverOpts := server.DoQServerOpts{Logger: bp.L(), IdleTimeout: idleTimeout}
-		err := server.ServeDoQ(quicListener, dh, serverOpts)
-		bp.M().GetSafeClose().SendCloseSignal(err)
+		err := server.ServeDoQ(l, dh, serverOpts)
+		if !s.closed.Load() { // Closed by Close(), e.g. plugin restart.
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
 	}()
-	return &QuicServer{
-		args: args,
-		l:    quicListener,
-	}, nil
+	return s, nil
 }
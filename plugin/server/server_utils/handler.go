@@ -26,10 +26,56 @@ import (
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server_handler"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-// MODIFIED: Function signature now accepts the enableAudit flag.
-func NewHandler(bp *coremain.BP, entry string, enableAudit bool) (server.Handler, error) {
+// HandlerOpts contains the common options of server plugins.
+type HandlerOpts struct {
+	EnableAudit   bool
+	NSID          string
+	MinTTL        uint32
+	TraceUpstream bool
+	Malformed     string
+
+	// EmergencyEntry is the tag of the executable that handles the query
+	// if entry panics. Optional.
+	EmergencyEntry string
+
+	// ClientACL controls client access and assigns client tags. Optional.
+	ClientACL *ClientACLArgs
+}
+
+// ClientACLArgs is the "client_acl" arg of server plugins.
+type ClientACLArgs struct {
+	Allow  []string `yaml:"allow"`  // IPs and CIDRs. Empty allows all clients.
+	Deny   []string `yaml:"deny"`   // IPs and CIDRs. Deny takes priority over allow.
+	Action string   `yaml:"action"` // Action for denied queries. "refuse" (default) or "drop".
+	Tags   []struct {
+		Tag     string   `yaml:"tag"`
+		Clients []string `yaml:"clients"` // IPs and CIDRs.
+	} `yaml:"tags"` // The first matched tag is assigned to the query.
+}
+
+func newClientACL(args *ClientACLArgs) (*server_handler.ClientACL, error) {
+	opts := server_handler.ClientACLOpts{Allow: args.Allow, Deny: args.Deny}
+	switch args.Action {
+	case "", "refuse":
+	case "drop":
+		opts.Drop = true
+	default:
+		return nil, fmt.Errorf("invalid action %s", args.Action)
+	}
+	for _, t := range args.Tags {
+		opts.Tags = append(opts.Tags, server_handler.ClientTagOpts{Tag: t.Tag, Clients: t.Clients})
+	}
+	return server_handler.NewClientACL(opts)
+}
+
+// MODIFIED: Function signature now accepts the handler options.
+func NewHandler(bp *coremain.BP, entry string, opts HandlerOpts) (server.Handler, error) {
+	if err := server_handler.ValidMalformedBehavior(opts.Malformed); err != nil {
+		return nil, err
+	}
 	p := bp.M().GetPlugin(entry)
 	exec := sequence.ToExecutable(p)
 	if exec == nil {
@@ -40,7 +86,74 @@ func NewHandler(bp *coremain.BP, entry string, enableAudit bool) (server.Handler
 		Logger: bp.L(),
 		Entry:  exec,
 		// ADDED: Pass the enableAudit flag to the handler options.
-		EnableAudit: enableAudit,
+		EnableAudit:   opts.EnableAudit,
+		NSID:          opts.NSID,
+		MinTTL:        opts.MinTTL,
+		TraceUpstream: opts.TraceUpstream,
+		Malformed:     opts.Malformed,
+	}
+	if opts.ClientACL != nil {
+		acl, err := newClientACL(opts.ClientACL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client_acl, %w", err)
+		}
+		handlerOpts.ACL = acl
+	}
+	if len(opts.EmergencyEntry) > 0 {
+		handlerOpts.EmergencyEntry = sequence.ToExecutable(bp.M().GetPlugin(opts.EmergencyEntry))
+		if handlerOpts.EmergencyEntry == nil {
+			return nil, fmt.Errorf("cannot find executable emergency entry by tag %s", opts.EmergencyEntry)
+		}
+	}
+	if err := regHandlerMetrics(bp, &handlerOpts); err != nil {
+		return nil, fmt.Errorf("failed to register metrics, %w", err)
 	}
 	return server_handler.NewEntryHandler(handlerOpts), nil
 }
+
+// regHandlerMetrics sets the per-server query metrics of opts. Metrics are
+// labeled by server plugin tag and shared by all server plugins.
+func regHandlerMetrics(bp *coremain.BP, opts *server_handler.EntryHandlerOpts) error {
+	total, err := bp.M().RegSharedCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "server_query_total",
+		Help: "The total number of queries received by server plugins",
+	}, []string{"tag"}))
+	if err != nil {
+		return err
+	}
+	duration, err := bp.M().RegSharedCollector(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "server_query_duration_seconds",
+		Help:    "The time spent by server plugins handling a query",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5},
+	}, []string{"tag"}))
+	if err != nil {
+		return err
+	}
+	malformed, err := bp.M().RegSharedCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "server_malformed_query_total",
+		Help: "The total number of malformed queries received by server plugins",
+	}, []string{"tag", "action"}))
+	if err != nil {
+		return err
+	}
+	panics, err := bp.M().RegSharedCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "server_panic_total",
+		Help: "The total number of queries that caused a panic in the entry of server plugins",
+	}, []string{"tag"}))
+	if err != nil {
+		return err
+	}
+	denied, err := bp.M().RegSharedCollector(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "server_acl_denied_total",
+		Help: "The total number of queries denied by the client_acl of server plugins",
+	}, []string{"tag"}))
+	if err != nil {
+		return err
+	}
+	opts.QueryTotal = total.(*prometheus.CounterVec).WithLabelValues(bp.Tag())
+	opts.QueryDuration = duration.(*prometheus.HistogramVec).WithLabelValues(bp.Tag())
+	opts.MalformedTotal = malformed.(*prometheus.CounterVec).MustCurryWith(prometheus.Labels{"tag": bp.Tag()})
+	opts.PanicTotal = panics.(*prometheus.CounterVec).WithLabelValues(bp.Tag())
+	opts.DeniedTotal = denied.(*prometheus.CounterVec).WithLabelValues(bp.Tag())
+	return nil
+}
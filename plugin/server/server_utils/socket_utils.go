@@ -1,6 +1,9 @@
 package server_utils
 
-import "syscall"
+import (
+	"net"
+	"syscall"
+)
 
 type ControlFunc func(network, address string, c syscall.RawConn) error
 
@@ -9,7 +12,45 @@ func NopControlFunc(network, address string, c syscall.RawConn) error {
 }
 
 type ListenerSocketOpts struct {
-	SO_REUSEPORT bool
-	SO_RCVBUF    int
-	SO_SNDBUF    int
+	SO_REUSEPORT    bool
+	SO_RCVBUF       int
+	SO_SNDBUF       int
+	SO_MARK         int
+	SO_BINDTODEVICE string
+	IP_FREEBIND     bool
+}
+
+// SocketArgs are the optional socket options of server listeners.
+// They are only implemented on linux.
+type SocketArgs struct {
+	// Listeners is the number of sockets listening on the same address
+	// with SO_REUSEPORT. The kernel distributes clients among them, and
+	// each of them is served by its own goroutines. Default is 1.
+	Listeners int `yaml:"listeners"`
+
+	// SoMark sets SO_MARK, e.g. for policy routing.
+	SoMark int `yaml:"so_mark"`
+
+	// BindToDevice sets SO_BINDTODEVICE.
+	BindToDevice string `yaml:"bind_to_device"`
+
+	// Freebind sets IP_FREEBIND, so the server can listen on an address
+	// that is not (yet) configured.
+	Freebind bool `yaml:"freebind"`
+}
+
+// ListenerNum returns the number of listeners, at least 1.
+func (a *SocketArgs) ListenerNum() int {
+	return max(a.Listeners, 1)
+}
+
+// ListenConfig returns a net.ListenConfig that sets o and the options of a.
+func (a *SocketArgs) ListenConfig(o ListenerSocketOpts) net.ListenConfig {
+	o.SO_MARK = a.SoMark
+	o.SO_BINDTODEVICE = a.BindToDevice
+	o.IP_FREEBIND = a.Freebind
+	if a.ListenerNum() > 1 {
+		o.SO_REUSEPORT = true
+	}
+	return net.ListenConfig{Control: ListenerControl(o)}
 }
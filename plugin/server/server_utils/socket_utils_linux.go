@@ -3,6 +3,7 @@
 package server_utils
 
 import (
+	"strings"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -36,6 +37,31 @@ func ListenerControl(opt ListenerSocketOpts) ControlFunc {
 					return
 				}
 			}
+
+			if opt.SO_MARK > 0 {
+				errSyscall = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, opt.SO_MARK)
+				if errSyscall != nil {
+					return
+				}
+			}
+
+			if len(opt.SO_BINDTODEVICE) > 0 {
+				errSyscall = unix.BindToDevice(int(fd), opt.SO_BINDTODEVICE)
+				if errSyscall != nil {
+					return
+				}
+			}
+
+			if opt.IP_FREEBIND && !strings.HasPrefix(network, "unix") {
+				if strings.HasSuffix(network, "6") {
+					errSyscall = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_FREEBIND, 1)
+				} else {
+					errSyscall = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_FREEBIND, 1)
+				}
+				if errSyscall != nil {
+					return
+				}
+			}
 		})
 
 		if errControl != nil {
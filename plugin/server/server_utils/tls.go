@@ -0,0 +1,60 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/go-chi/chi/v5"
+)
+
+const defaultCertReloadInterval = time.Hour
+
+// NewCertReloader loads the cert of a tls server plugin and registers
+// "POST /reload_cert" to its api. interval is in seconds, 0 means
+// the default, negative disables the periodic check (files are still
+// watched).
+func NewCertReloader(bp *coremain.BP, cert, key string, interval int) (*server.CertReloader, error) {
+	d := defaultCertReloadInterval
+	if interval != 0 {
+		d = time.Duration(interval) * time.Second
+	}
+	r, err := server.NewCertReloader(cert, key, d, bp.L())
+	if err != nil {
+		return nil, err
+	}
+
+	mux := chi.NewRouter()
+	mux.Post("/reload_cert", func(w http.ResponseWriter, req *http.Request) {
+		changed, err := r.Reload()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"changed": changed, "not_after": r.Leaf().NotAfter})
+	})
+	bp.RegAPI(mux)
+	return r, nil
+}
@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
@@ -41,12 +42,30 @@ func init() {
 }
 
 type Args struct {
-	Entry       string `yaml:"entry"`
-	Listen      string `yaml:"listen"`
-	Cert        string `yaml:"cert"`
-	Key         string `yaml:"key"`
-	IdleTimeout int    `yaml:"idle_timeout"`
-	EnableAudit bool   `yaml:"enable_audit"` // ADDED: Optional config to enable logging for this server instance.
+	Entry         string `yaml:"entry"`
+	Listen        string `yaml:"listen"`
+	Cert          string `yaml:"cert"`
+	Key           string `yaml:"key"`
+	IdleTimeout   int    `yaml:"idle_timeout"`
+	EnableAudit   bool   `yaml:"enable_audit"`   // ADDED: Optional config to enable logging for this server instance.
+	NSID          string `yaml:"nsid"`           // Optional NSID (RFC 5001) to identify this instance.
+	MinTTL        uint32 `yaml:"min_ttl"`        // Optional minimum ttl of the answers sent to clients.
+	TraceUpstream bool   `yaml:"trace_upstream"` // Optional. Reply the upstream name to clients that request it.
+	Malformed     string `yaml:"malformed"`      // Optional. One of "drop" (default), "formerr", "repair".
+
+	// EmergencyEntry is executed instead if entry panics. Optional.
+	EmergencyEntry string `yaml:"emergency_entry"`
+
+	// ClientACL controls client access and assigns client tags. Optional.
+	ClientACL *server_utils.ClientACLArgs `yaml:"client_acl"`
+
+	// Socket sets socket options of the listeners. Optional.
+	Socket server_utils.SocketArgs `yaml:"socket"`
+
+	// CertReloadInterval is the interval in seconds to check cert files
+	// for changes, in addition to watching them. Default is 3600,
+	// negative disables it.
+	CertReloadInterval int `yaml:"cert_reload_interval"`
 }
 
 func (a *Args) init() {
@@ -54,14 +73,28 @@ func (a *Args) init() {
 	utils.SetDefaultNum(&a.IdleTimeout, 10)
 }
 
+// ReferredTags implements coremain.TagReferrer.
+func (a *Args) ReferredTags() []string {
+	return []string{a.Entry, a.EmergencyEntry}
+}
+
 type TcpServer struct {
 	args *Args
 
-	l net.Listener
+	ls     []net.Listener
+	cr     *server.CertReloader // nil if tls is disabled
+	closed atomic.Bool
 }
 
 func (s *TcpServer) Close() error {
-	return s.l.Close()
+	s.closed.Store(true)
+	if s.cr != nil {
+		s.cr.Close()
+	}
+	for _, l := range s.ls {
+		l.Close()
+	}
+	return nil
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
@@ -72,46 +105,71 @@ func Init(bp *coremain.BP, args any) (any, error) {
 
 func StartServer(bp *coremain.BP, args *Args) (*TcpServer, error) {
 	// MODIFIED: Pass the EnableAudit flag to the handler constructor.
-	dh, err := server_utils.NewHandler(bp, args.Entry, args.EnableAudit)
+	dh, err := server_utils.NewHandler(bp, args.Entry, server_utils.HandlerOpts{
+		EnableAudit:    args.EnableAudit,
+		NSID:           args.NSID,
+		MinTTL:         args.MinTTL,
+		TraceUpstream:  args.TraceUpstream,
+		Malformed:      args.Malformed,
+		EmergencyEntry: args.EmergencyEntry,
+		ClientACL:      args.ClientACL,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to init dns handler, %w", err)
 	}
 
 	// Init tls
-	var tc *tls.Config
+	var (
+		tc *tls.Config
+		cr *server.CertReloader
+	)
 	if len(args.Key)+len(args.Cert) > 0 {
-		tc = new(tls.Config)
-		if err := server.LoadCert(tc, args.Cert, args.Key); err != nil {
+		cr, err = server_utils.NewCertReloader(bp, args.Cert, args.Key, args.CertReloadInterval)
+		if err != nil {
 			return nil, fmt.Errorf("failed to read tls cert, %w", err)
 		}
+		tc = &tls.Config{GetCertificate: cr.GetCertificate}
+		// DoT ALPN (RFC 7858). Session resumption via session tickets
+		// is enabled by crypto/tls by default.
+		tc.NextProtos = []string{"dot"}
+		tc.MinVersion = tls.VersionTLS12
 	}
 
 	socketOpt := server_utils.ListenerSocketOpts{
 		SO_REUSEPORT: true,
 		SO_RCVBUF:    64 * 1024,
 	}
-	lc := net.ListenConfig{Control: server_utils.ListenerControl(socketOpt)}
+	lc := args.Socket.ListenConfig(socketOpt)
 	listenerNetwork := "tcp"
 	if strings.HasPrefix(args.Listen, "@") {
 		listenerNetwork = "unix"
 	}
-	l, err := lc.Listen(context.Background(), listenerNetwork, args.Listen)
-	if err != nil {
-		return nil, fmt.Errorf("failed to listen socket, %w", err)
+	s := &TcpServer{
+		args: args,
+		cr:   cr,
 	}
-	if tc != nil {
-		l = tls.NewListener(l, tc)
+	for i := 0; i < args.Socket.ListenerNum(); i++ {
+		l, err := lc.Listen(context.Background(), listenerNetwork, args.Listen)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to listen socket, %w", err)
+		}
+		if tc != nil {
+			l = tls.NewListener(l, tc)
+		}
+		s.ls = append(s.ls, l)
 	}
-	bp.L().Info("tcp server started", zap.Stringer("addr", l.Addr()), zap.Bool("tls", tc != nil))
-
-	go func() {
-		defer l.Close()
-		serverOpts := server.TCPServerOpts{Logger: bp.L(), IdleTimeout: time.Duration(args.IdleTimeout) * time.Second}
-		err := server.ServeTCP(l, dh, serverOpts)
-		bp.M().GetSafeClose().SendCloseSignal(err)
-	}()
-	return &TcpServer{
-		args: args,
-		l:    l,
-	}, nil
+	bp.L().Info("tcp server started", zap.Stringer("addr", s.ls[0].Addr()), zap.Bool("tls", tc != nil), zap.Int("listeners", len(s.ls)))
+
+	serverOpts := server.TCPServerOpts{Logger: bp.L(), IdleTimeout: time.Duration(args.IdleTimeout) * time.Second}
+	for _, l := range s.ls {
+		go func() {
+			defer l.Close()
+			err := server.ServeTCP(l, dh, serverOpts)
+			if !s.closed.Load() { // Closed by Close(), e.g. plugin restart.
+				bp.M().GetSafeClose().SendCloseSignal(err)
+			}
+		}()
+	}
+	return s, nil
 }
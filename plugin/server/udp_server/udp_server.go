@@ -23,6 +23,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync/atomic"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
@@ -38,23 +39,46 @@ func init() {
 }
 
 type Args struct {
-	Entry       string `yaml:"entry"`
-	Listen      string `yaml:"listen"`
-	EnableAudit bool   `yaml:"enable_audit"` // ADDED: Optional config to enable logging for this server instance.
+	Entry         string `yaml:"entry"`
+	Listen        string `yaml:"listen"`
+	EnableAudit   bool   `yaml:"enable_audit"`   // ADDED: Optional config to enable logging for this server instance.
+	NSID          string `yaml:"nsid"`           // Optional NSID (RFC 5001) to identify this instance.
+	MinTTL        uint32 `yaml:"min_ttl"`        // Optional minimum ttl of the answers sent to clients.
+	TraceUpstream bool   `yaml:"trace_upstream"` // Optional. Reply the upstream name to clients that request it.
+	Malformed     string `yaml:"malformed"`      // Optional. One of "drop" (default), "formerr", "repair".
+
+	// EmergencyEntry is executed instead if entry panics. Optional.
+	EmergencyEntry string `yaml:"emergency_entry"`
+
+	// ClientACL controls client access and assigns client tags. Optional.
+	ClientACL *server_utils.ClientACLArgs `yaml:"client_acl"`
+
+	// Socket sets socket options of the listeners. Optional.
+	Socket server_utils.SocketArgs `yaml:"socket"`
 }
 
 func (a *Args) init() {
 	utils.SetDefaultString(&a.Listen, "127.0.0.1:53")
 }
 
+// ReferredTags implements coremain.TagReferrer.
+func (a *Args) ReferredTags() []string {
+	return []string{a.Entry, a.EmergencyEntry}
+}
+
 type UdpServer struct {
 	args *Args
 
-	c net.PacketConn
+	cs     []net.PacketConn
+	closed atomic.Bool
 }
 
 func (s *UdpServer) Close() error {
-	return s.c.Close()
+	s.closed.Store(true)
+	for _, c := range s.cs {
+		c.Close()
+	}
+	return nil
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
@@ -65,7 +89,15 @@ func Init(bp *coremain.BP, args any) (any, error) {
 
 func StartServer(bp *coremain.BP, args *Args) (*UdpServer, error) {
 	// MODIFIED: Pass the EnableAudit flag to the handler constructor.
-	dh, err := server_utils.NewHandler(bp, args.Entry, args.EnableAudit)
+	dh, err := server_utils.NewHandler(bp, args.Entry, server_utils.HandlerOpts{
+		EnableAudit:    args.EnableAudit,
+		NSID:           args.NSID,
+		MinTTL:         args.MinTTL,
+		TraceUpstream:  args.TraceUpstream,
+		Malformed:      args.Malformed,
+		EmergencyEntry: args.EmergencyEntry,
+		ClientACL:      args.ClientACL,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to init dns handler, %w", err)
 	}
@@ -74,20 +106,26 @@ func StartServer(bp *coremain.BP, args *Args) (*UdpServer, error) {
 		SO_REUSEPORT: true,
 		SO_RCVBUF:    64 * 1024,
 	}
-	lc := net.ListenConfig{Control: server_utils.ListenerControl(socketOpt)}
-	c, err := lc.ListenPacket(context.Background(), "udp", args.Listen)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create socket, %w", err)
+	lc := args.Socket.ListenConfig(socketOpt)
+	s := &UdpServer{args: args}
+	for i := 0; i < args.Socket.ListenerNum(); i++ {
+		c, err := lc.ListenPacket(context.Background(), "udp", args.Listen)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to create socket, %w", err)
+		}
+		s.cs = append(s.cs, c)
+	}
+	bp.L().Info("udp server started", zap.Stringer("addr", s.cs[0].LocalAddr()), zap.Int("listeners", len(s.cs)))
+
+	for _, c := range s.cs {
+		go func() {
+			defer c.Close()
+			err := server.ServeUDP(c.(*net.UDPConn), dh, server.UDPServerOpts{Logger: bp.L()})
+			if !s.closed.Load() { // Closed by Close(), e.g. plugin restart.
+				bp.M().GetSafeClose().SendCloseSignal(err)
+			}
+		}()
 	}
-	bp.L().Info("udp server started", zap.Stringer("addr", c.LocalAddr()))
-
-	go func() {
-		defer c.Close()
-		err := server.ServeUDP(c.(*net.UDPConn), dh, server.UDPServerOpts{Logger: bp.L()})
-		bp.M().GetSafeClose().SendCloseSignal(err)
-	}()
-	return &UdpServer{
-		args: args,
-		c:    c,
-	}, nil
+	return s, nil
 }
@@ -0,0 +1,315 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	configTestTimeout = time.Second * 5
+	errContextLines   = 2 // Lines printed before and after the line of an error.
+)
+
+func newCheckCmd() *cobra.Command {
+	var (
+		cfg      string
+		runTests bool
+	)
+	c := &cobra.Command{
+		Use:   "check -c config [--run-tests]",
+		Args:  cobra.NoArgs,
+		Short: "Load all plugins of the config without serving, and optionally run its tests.",
+		Long: `Load all plugins of the config without serving, and optionally run its tests.
+
+Server plugins are not loaded and forward plugins reply empty responses
+instead of sending queries, so the check can run next to a running
+instance and without network. With --run-tests, the queries in the
+"tests" section of the config are executed and their outcomes compared
+with the expectations.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := checkCfg(cfg, runTests, os.Stdout); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	c.Flags().StringVarP(&cfg, "config", "c", "", "config file")
+	c.Flags().BoolVar(&runTests, "run-tests", false, "run the tests in the config")
+	c.MarkFlagFilename("config")
+	return c
+}
+
+func newConfigCheckCmd() *cobra.Command {
+	var runTests bool
+	c := &cobra.Command{
+		Use:   "check config_file [--run-tests]",
+		Args:  cobra.ExactArgs(1),
+		Short: "Validate the config without serving.",
+		Long: `Validate the config without serving.
+
+The config is parsed and all plugins are initialized in validation-only
+mode: no listeners are opened, no rules are downloaded and no queries are
+sent to upstreams. The tags referred by plugins, servers and tests must
+exist. Errors are reported with the lines of the config around them.
+With --run-tests, the "tests" section of the config is run as well.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := checkCfg(args[0], runTests, os.Stdout); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	c.Flags().BoolVar(&runTests, "run-tests", false, "run the tests in the config")
+	return c
+}
+
+func checkCfg(cfg string, runTests bool, w io.Writer) error {
+	m, err := coremain.NewCheckServer(cfg)
+	if err != nil {
+		if lines := errContext(cfg, err); len(lines) > 0 {
+			fmt.Fprint(w, lines)
+		}
+		return err
+	}
+	defer func() {
+		m.CloseWithErr(nil)
+		_ = m.GetSafeClose().WaitClosed()
+	}()
+	fmt.Fprintln(w, "config ok")
+	if !runTests {
+		return nil
+	}
+
+	tests := m.ConfigTests()
+	failed := 0
+	for i, t := range tests {
+		name := t.Name
+		if len(name) == 0 {
+			name = fmt.Sprintf("#%d %s", i, t.Query.Name)
+		}
+		if errs := runConfigTest(m, t); len(errs) > 0 {
+			failed++
+			fmt.Fprintf(w, "FAIL %s\n", name)
+			for _, err := range errs {
+				fmt.Fprintf(w, "     %v\n", err)
+			}
+		} else {
+			fmt.Fprintf(w, "PASS %s\n", name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tests failed", failed, len(tests))
+	}
+	fmt.Fprintf(w, "all %d tests passed\n", len(tests))
+	return nil
+}
+
+// runConfigTest runs t and returns the mismatches.
+func runConfigTest(m *coremain.Mosdns, t coremain.ConfigTest) []error {
+	exec := sequence.ToExecutable(m.GetPlugin(t.Entry))
+	if exec == nil {
+		return []error{fmt.Errorf("cannot find executable entry by tag %q", t.Entry)}
+	}
+	qtype := dns.TypeA
+	if len(t.Query.Type) > 0 {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(t.Query.Type)]; !ok {
+			return []error{fmt.Errorf("invalid query type %s", t.Query.Type)}
+		}
+	}
+	if len(t.Query.Name) == 0 {
+		return []error{errors.New("missing query name")}
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(t.Query.Name), qtype)
+	qCtx := query_context.NewContext(q)
+	qCtx.ServerMeta.Protocol = server.ProtocolUDP
+	if len(t.Query.Client) > 0 {
+		addr, err := netip.ParseAddr(t.Query.Client)
+		if err != nil {
+			return []error{fmt.Errorf("invalid client ip, %w", err)}
+		}
+		qCtx.ServerMeta.ClientAddr = addr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), configTestTimeout)
+	defer cancel()
+	if err := exec.Exec(ctx, qCtx); err != nil {
+		return []error{fmt.Errorf("exec error, %w", err)}
+	}
+
+	r := qCtx.R()
+	var forward string
+	if v, ok := qCtx.GetValue(query_context.KeyUpstream); ok {
+		forward, _ = v.(string)
+	}
+	var errs []error
+	want := t.Expect
+	if want.Blocked != nil {
+		if blocked := isBlockedResp(r, len(forward) > 0); blocked != *want.Blocked {
+			errs = append(errs, fmt.Errorf("want blocked %v, got %v", *want.Blocked, blocked))
+		}
+	}
+	if len(want.Forward) > 0 && want.Forward != forward {
+		errs = append(errs, fmt.Errorf("want forwarded to %s, got %q", want.Forward, forward))
+	}
+	if len(want.Rcode) > 0 {
+		got := "none"
+		if r != nil {
+			got = dns.RcodeToString[r.Rcode]
+		}
+		if !strings.EqualFold(want.Rcode, got) {
+			errs = append(errs, fmt.Errorf("want rcode %s, got %s", want.Rcode, got))
+		}
+	}
+	if len(want.Answer) > 0 {
+		var got []string
+		if r != nil {
+			for _, rr := range r.Answer {
+				got = append(got, strings.TrimPrefix(rr.String(), rr.Header().String()))
+			}
+		}
+		wantAns := slices.Clone(want.Answer)
+		slices.Sort(wantAns)
+		slices.Sort(got)
+		if !slices.Equal(wantAns, got) {
+			errs = append(errs, fmt.Errorf("want answer %v, got %v", wantAns, got))
+		}
+	}
+	return errs
+}
+
+// isBlockedResp reports whether r looks like a block response: a
+// NXDOMAIN/REFUSED, an empty answer or unspecified ips, that was not
+// answered by an upstream.
+func isBlockedResp(r *dns.Msg, forwarded bool) bool {
+	if r == nil || forwarded {
+		return false
+	}
+	switch r.Rcode {
+	case dns.RcodeNameError, dns.RcodeRefused:
+		return true
+	case dns.RcodeSuccess:
+	default:
+		return false
+	}
+	for _, rr := range r.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if !rr.A.IsUnspecified() {
+				return false
+			}
+		case *dns.AAAA:
+			if !rr.AAAA.IsUnspecified() {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+var yamlErrLine = regexp.MustCompile(`yaml: line (\d+)`)
+
+// errContext returns the lines of the config around the location of err,
+// with the line of err marked. It returns "" if the location is unknown.
+func errContext(cfg string, err error) string {
+	var file string
+	var line int
+	var pe *coremain.PluginError
+	if errors.As(err, &pe) {
+		file = pe.File
+		line = pluginLine(file, pe.Index)
+	} else if sm := yamlErrLine.FindStringSubmatch(err.Error()); sm != nil {
+		file = cfg
+		line, _ = strconv.Atoi(sm[1])
+	}
+	if len(file) == 0 || line <= 0 {
+		return ""
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(string(b), "\n")
+	if line > len(lines) {
+		return ""
+	}
+
+	sb := new(strings.Builder)
+	fmt.Fprintf(sb, "%s:%d:\n", file, line)
+	for i := max(line-errContextLines, 1); i <= min(line+errContextLines, len(lines)); i++ {
+		mark := " "
+		if i == line {
+			mark = ">"
+		}
+		fmt.Fprintf(sb, "%s %4d | %s\n", mark, i, lines[i-1])
+	}
+	return sb.String()
+}
+
+// pluginLine returns the line of the idx-th plugin in the yaml config
+// file, or 0 if it cannot be found.
+func pluginLine(file string, idx int) int {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return 0
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil || len(doc.Content) == 0 {
+		return 0
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return 0
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "plugins" {
+			continue
+		}
+		plugins := root.Content[i+1]
+		if plugins.Kind != yaml.SequenceNode || idx >= len(plugins.Content) {
+			return 0
+		}
+		return plugins.Content[idx].Line
+	}
+	return 0
+}
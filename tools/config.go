@@ -20,10 +20,16 @@
 package tools
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/provision"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"strings"
 )
 
 func newConvCmd() *cobra.Command {
@@ -67,6 +73,78 @@ func newGenCmd() *cobra.Command {
 	return c
 }
 
+func newProvisionCmd() *cobra.Command {
+	var (
+		cfg    string
+		out    string
+		format string
+		o      provision.Options
+	)
+	c := &cobra.Command{
+		Use:   "provision -c config --host dns.example.com [--format stamps|mobileconfig|android] [-o output]",
+		Args:  cobra.NoArgs,
+		Short: "Generate client provisioning artifacts (DNS stamps, Apple mobileconfig, Android Private DNS) from the DoH/DoT/DoQ listeners in the config.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := provisionCfg(cfg, out, format, o); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	c.Flags().StringVarP(&cfg, "config", "c", "config.yaml", "config file")
+	c.Flags().StringVarP(&out, "out", "o", "", "output file, default is stdout")
+	c.Flags().StringVar(&format, "format", "stamps", "one of stamps, mobileconfig, android")
+	c.Flags().StringVar(&o.Host, "host", "", "server name in the certificate")
+	c.Flags().StringVar(&o.Addr, "addr", "", "optional server ip address")
+	c.Flags().StringVar(&o.Name, "name", "", "profile display name, default is host")
+	c.MarkFlagRequired("host")
+	c.MarkFlagFilename("config")
+	return c
+}
+
+func provisionCfg(cfg, out, format string, o provision.Options) error {
+	ls, err := coremain.ProvisionListeners(cfg)
+	if err != nil {
+		return err
+	}
+	if len(ls) == 0 {
+		return fmt.Errorf("no DoH/DoT/DoQ listener with cert in %s", cfg)
+	}
+
+	var w io.Writer = os.Stdout
+	if len(out) > 0 {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch format {
+	case "stamps":
+		for _, l := range ls {
+			s, err := provision.Stamp(l, o)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s %s\n", l.URL(o.Host), s)
+		}
+	case "mobileconfig":
+		b, err := provision.MobileConfig(ls, o)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	case "android":
+		fmt.Fprint(w, provision.AndroidInstructions(ls, o))
+	default:
+		return fmt.Errorf("unknown format %s", format)
+	}
+	return nil
+}
+
 func convCfg(in, out string) error {
 	v := viper.New()
 	v.SetConfigFile(in)
@@ -42,9 +42,15 @@ func init() {
 		Use:   "config",
 		Short: "Tools that can generate/convert mosdns config file.",
 	}
-	configCmd.AddCommand(newGenCmd(), newConvCmd())
+	configCmd.AddCommand(newGenCmd(), newConvCmd(), newProvisionCmd(), newConfigCheckCmd())
 	coremain.AddSubCmd(configCmd)
 
+	// 创建 migrate 命令
+	coremain.AddSubCmd(newMigrateCmd())
+
+	// 创建 check 命令
+	coremain.AddSubCmd(newCheckCmd())
+
 	// 创建 resend 命令
 	resendCmd := &cobra.Command{
 		Use:   "resend",
@@ -0,0 +1,1104 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+func newMigrateCmd() *cobra.Command {
+	var (
+		in  string
+		out string
+	)
+	c := &cobra.Command{
+		Use:   "migrate -i old_config.yaml [-o new_config.yaml]",
+		Args:  cobra.NoArgs,
+		Short: "Convert an upstream mosdns v4/v5 config to the format of this build.",
+		Long: `Convert an upstream mosdns v4/v5 config to the format of this build.
+
+v4 configs (servers, data_providers, query_matcher, v4 sequences, etc.) are
+converted to v5 plugins. v5 configs are compatible and only checked against
+the plugins of this build. Constructs that can not be converted exactly are
+listed as warnings and in the header of the output. Included files are not
+converted, run migrate on each of them.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := migrateCfg(in, out); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	c.Flags().StringVarP(&in, "in", "i", "", "input config")
+	c.Flags().StringVarP(&out, "out", "o", "", "output config, default is stdout")
+	c.MarkFlagRequired("in")
+	c.MarkFlagFilename("in")
+	c.MarkFlagFilename("out")
+	return c
+}
+
+func migrateCfg(in, out string) error {
+	b, err := os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	res, warnings, err := migrate(b)
+	if err != nil {
+		return err
+	}
+	for _, w := range warnings {
+		mlog.S().Warn(w)
+	}
+	if len(out) == 0 {
+		_, err = os.Stdout.Write(res)
+		return err
+	}
+	return os.WriteFile(out, res, 0644)
+}
+
+// pluginConfig is coremain.PluginConfig that omits empty args.
+type pluginConfig struct {
+	Tag  string `yaml:"tag"`
+	Type string `yaml:"type"`
+	Args any    `yaml:"args,omitempty"`
+}
+
+type migratedConfig struct {
+	Log     any            `yaml:"log,omitempty"`
+	Include []string       `yaml:"include,omitempty"`
+	Plugins []pluginConfig `yaml:"plugins"`
+	API     any            `yaml:"api,omitempty"`
+}
+
+// migrate converts config b. It returns the converted config and the
+// constructs that need manual review.
+func migrate(b []byte) ([]byte, []string, error) {
+	var raw map[string]any
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, nil, fmt.Errorf("invalid yaml, %w", err)
+	}
+	var plugins []pluginConfig
+	if err := utils.WeakDecode(raw["plugins"], &plugins); err != nil {
+		return nil, nil, fmt.Errorf("invalid plugins, %w", err)
+	}
+	if !isV4Config(raw, plugins) {
+		// v5 configs are compatible, keep the original file as is.
+		return b, checkV5Plugins(plugins), nil
+	}
+
+	m := newV4Migrator()
+	cfg, err := m.migrate(raw, plugins)
+	if err != nil {
+		return nil, nil, err
+	}
+	var n yaml.Node
+	if err := n.Encode(cfg); err != nil {
+		return nil, nil, err
+	}
+	n.HeadComment = "Migrated from a mosdns v4 config by `mosdns migrate`."
+	if len(m.warnings) > 0 {
+		n.HeadComment += "\nPlease review:\n- " + strings.Join(m.warnings, "\n- ")
+	}
+	var buf bytes.Buffer
+	e := yaml.NewEncoder(&buf)
+	e.SetIndent(2)
+	if err := e.Encode(&n); err != nil {
+		return nil, nil, err
+	}
+	e.Close()
+	return buf.Bytes(), m.warnings, nil
+}
+
+var v4OnlyTypes = map[string]bool{
+	"fast_forward":     true,
+	"query_matcher":    true,
+	"response_matcher": true,
+	"blackhole":        true,
+	"ecs":              true,
+	"padding":          true,
+	"bufsize":          true,
+	"parallel":         true,
+}
+
+func isV4Config(raw map[string]any, plugins []pluginConfig) bool {
+	if _, ok := raw["servers"]; ok {
+		return true
+	}
+	if _, ok := raw["data_providers"]; ok {
+		return true
+	}
+	for _, p := range plugins {
+		if v4OnlyTypes[p.Type] {
+			return true
+		}
+		if _, ok := p.Args.(map[string]any); ok && p.Type == "sequence" { // v5 args is a rule list
+			return true
+		}
+	}
+	return false
+}
+
+// checkV5Plugins reports plugins, args and sequence rules that are not
+// supported by this build.
+func checkV5Plugins(plugins []pluginConfig) []string {
+	var warnings []string
+	for _, p := range plugins {
+		info, ok := coremain.GetPluginType(p.Type)
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("plugin %s: type %s is not supported", p.Tag, p.Type))
+			continue
+		}
+		args := info.NewArgs()
+		if err := utils.WeakDecode(p.Args, args); err != nil {
+			warnings = append(warnings, fmt.Sprintf("plugin %s: %s", p.Tag, strings.Join(strings.Fields(err.Error()), " ")))
+			continue
+		}
+		if rules, ok := args.(*[]sequence.RuleArgs); ok {
+			for i, r := range *rules {
+				for _, s := range r.Matches {
+					if typ := quickSetupType(s); len(typ) > 0 && sequence.GetMatchQuickSetup(typ) == nil {
+						warnings = append(warnings, fmt.Sprintf("plugin %s: rule #%d: matcher %s is not supported", p.Tag, i, typ))
+					}
+				}
+				if typ := quickSetupType(r.Exec); len(typ) > 0 && sequence.GetExecQuickSetup(typ) == nil {
+					warnings = append(warnings, fmt.Sprintf("plugin %s: rule #%d: exec %s is not supported", p.Tag, i, typ))
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+// quickSetupType returns the quick setup type of a sequence rule
+// expression, or "" if it refers to a plugin tag.
+func quickSetupType(s string) string {
+	s = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(s), "!"))
+	typ, _, _ := strings.Cut(s, " ")
+	if strings.HasPrefix(typ, "$") {
+		return ""
+	}
+	return typ
+}
+
+// ruleArgs is sequence.RuleArgs that omits empty matches.
+type ruleArgs struct {
+	Matches []string `yaml:"matches,omitempty"`
+	Exec    string   `yaml:"exec"`
+}
+
+// v4Migrator converts a v4 config.
+type v4Migrator struct {
+	warnings []string
+	tags     map[string]bool // tags in use
+
+	providers map[string]string // data provider tag -> file
+	sets      []pluginConfig    // generated domain_set and ip_set
+	plugins   []pluginConfig    // converted plugins
+	seqs      []pluginConfig    // converted sequences, dependencies first
+	servers   []pluginConfig
+
+	matchers     map[string][]string // v4 matcher tag -> v5 match expressions, ANDed
+	respMatchers map[string]bool     // v4 matcher tags that match responses
+	execs        map[string]string   // v4 plugin tag -> v5 exec expression
+	pending      map[string]pluginConfig
+	converting   map[string]bool
+}
+
+func newV4Migrator() *v4Migrator {
+	return &v4Migrator{
+		tags:         make(map[string]bool),
+		providers:    make(map[string]string),
+		matchers:     make(map[string][]string),
+		respMatchers: make(map[string]bool),
+		execs:        make(map[string]string),
+		pending:      make(map[string]pluginConfig),
+		converting:   make(map[string]bool),
+	}
+}
+
+func (m *v4Migrator) warnf(format string, args ...any) {
+	m.warnings = append(m.warnings, fmt.Sprintf(format, args...))
+}
+
+// newTag returns an unused tag based on base.
+func (m *v4Migrator) newTag(base string) string {
+	tag := base
+	for i := 2; m.tags[tag]; i++ {
+		tag = base + "_" + strconv.Itoa(i)
+	}
+	m.tags[tag] = true
+	return tag
+}
+
+func (m *v4Migrator) migrate(raw map[string]any, plugins []pluginConfig) (*migratedConfig, error) {
+	cfg := &migratedConfig{Log: raw["log"], API: raw["api"]}
+	if err := utils.WeakDecode(raw["include"], &cfg.Include); err != nil {
+		return nil, fmt.Errorf("invalid include, %w", err)
+	}
+	if len(cfg.Include) > 0 {
+		m.warnf("included files are not converted, run migrate on each of them")
+	}
+	for _, k := range sortedKeys(raw) {
+		switch k {
+		case "log", "api", "include", "plugins", "data_providers", "servers":
+		default:
+			m.warnf("top level key %s is not supported and was dropped", k)
+		}
+	}
+
+	var providers []struct {
+		Tag        string `yaml:"tag"`
+		File       string `yaml:"file"`
+		AutoReload bool   `yaml:"auto_reload"`
+	}
+	if err := utils.WeakDecode(raw["data_providers"], &providers); err != nil {
+		return nil, fmt.Errorf("invalid data_providers, %w", err)
+	}
+	for _, p := range providers {
+		m.providers[p.Tag] = p.File
+		if p.AutoReload {
+			m.warnf("data provider %s: auto_reload is not supported, reload sets via their api instead", p.Tag)
+		}
+	}
+
+	for _, p := range plugins {
+		if len(p.Tag) == 0 {
+			return nil, fmt.Errorf("plugin of type %s has no tag", p.Type)
+		}
+		m.tags[p.Tag] = true
+	}
+	for _, p := range plugins {
+		switch p.Type {
+		case "sequence", "fallback":
+			m.pending[p.Tag] = p // converted on demand, after their dependencies.
+		default:
+			if err := m.convertPlugin(p); err != nil {
+				return nil, fmt.Errorf("plugin %s: %w", p.Tag, err)
+			}
+		}
+	}
+	for _, p := range plugins {
+		if _, ok := m.pending[p.Tag]; ok {
+			m.resolve(p.Tag)
+		}
+	}
+
+	if err := m.convertServers(raw["servers"]); err != nil {
+		return nil, fmt.Errorf("invalid servers, %w", err)
+	}
+
+	cfg.Plugins = append(cfg.Plugins, m.sets...)
+	cfg.Plugins = append(cfg.Plugins, m.plugins...)
+	cfg.Plugins = append(cfg.Plugins, m.seqs...)
+	cfg.Plugins = append(cfg.Plugins, m.servers...)
+	return cfg, nil
+}
+
+// decodeArgs decodes args to struct pointer v. Unknown keys are reported
+// and dropped.
+func (m *v4Migrator) decodeArgs(p pluginConfig, v any) error {
+	known := make(map[string]bool)
+	t := reflect.TypeOf(v).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		known[t.Field(i).Tag.Get("yaml")] = true
+	}
+	args, _ := p.Args.(map[string]any)
+	filtered := make(map[string]any, len(args))
+	for _, k := range sortedKeys(args) {
+		val := args[k]
+		if !known[k] {
+			m.warnf("plugin %s: arg %s is not supported and was dropped", p.Tag, k)
+			continue
+		}
+		filtered[k] = val
+	}
+	return utils.WeakDecode(filtered, v)
+}
+
+func (m *v4Migrator) convertPlugin(p pluginConfig) error {
+	switch p.Type {
+	case "forward":
+		return m.convertForward(p)
+	case "fast_forward":
+		return m.convertFastForward(p)
+	case "cache":
+		return m.convertCache(p)
+	case "hosts", "arbitrary", "redirect":
+		return m.convertRuleFiles(p)
+	case "query_matcher", "response_matcher":
+		return m.convertMatcher(p)
+	case "blackhole":
+		return m.convertBlackhole(p)
+	case "ttl":
+		return m.convertTTL(p)
+	case "ecs":
+		return m.convertECS(p)
+	case "nftset":
+		return m.convertNftset(p)
+	}
+
+	if _, ok := coremain.GetPluginType(p.Type); !ok {
+		m.warnf("plugin %s: type %s is not supported and was kept as is", p.Tag, p.Type)
+	} else if info, _ := coremain.GetPluginType(p.Type); utils.WeakDecode(p.Args, info.NewArgs()) != nil {
+		m.warnf("plugin %s: args of %s may be incompatible and were kept as is", p.Tag, p.Type)
+	}
+	m.plugins = append(m.plugins, p)
+	return nil
+}
+
+type v4Upstream struct {
+	Addr               string   `yaml:"addr"`
+	IPAddr             []string `yaml:"ip_addr"`
+	DialAddr           string   `yaml:"dial_addr"`
+	Trusted            bool     `yaml:"trusted"`
+	Socks5             string   `yaml:"socks5"`
+	SoMark             int      `yaml:"so_mark"`
+	BindToDevice       string   `yaml:"bind_to_device"`
+	IdleTimeout        int      `yaml:"idle_timeout"`
+	MaxConns           int      `yaml:"max_conns"`
+	EnablePipeline     bool     `yaml:"enable_pipeline"`
+	EnableHTTP3        bool     `yaml:"enable_http3"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"`
+	Bootstrap          string   `yaml:"bootstrap"`
+}
+
+// toV5 returns the v5 upstream config of u.
+func (u v4Upstream) toV5() map[string]any {
+	v := map[string]any{"addr": u.Addr}
+	set := func(k string, val any, ok bool) {
+		if ok {
+			v[k] = val
+		}
+	}
+	set("dial_addr", u.DialAddr, len(u.DialAddr) > 0)
+	set("socks5", u.Socks5, len(u.Socks5) > 0)
+	set("so_mark", u.SoMark, u.SoMark != 0)
+	set("bind_to_device", u.BindToDevice, len(u.BindToDevice) > 0)
+	set("idle_timeout", u.IdleTimeout, u.IdleTimeout > 0)
+	set("max_conns", u.MaxConns, u.MaxConns > 0)
+	set("enable_pipeline", true, u.EnablePipeline)
+	set("enable_http3", true, u.EnableHTTP3)
+	set("insecure_skip_verify", true, u.InsecureSkipVerify)
+	set("bootstrap", u.Bootstrap, len(u.Bootstrap) > 0)
+	return v
+}
+
+func (m *v4Migrator) convertForward(p pluginConfig) error {
+	var args struct {
+		Upstream           []v4Upstream `yaml:"upstream"`
+		Timeout            int          `yaml:"timeout"`
+		InsecureSkipVerify bool         `yaml:"insecure_skip_verify"`
+		Bootstrap          []string     `yaml:"bootstrap"`
+	}
+	if err := m.decodeArgs(p, &args); err != nil {
+		return err
+	}
+	if args.Timeout > 0 {
+		m.warnf("plugin %s: timeout is not supported, use upstream_query_timeout of each upstream", p.Tag)
+	}
+	if len(args.Bootstrap) > 1 {
+		m.warnf("plugin %s: only the first bootstrap server is used", p.Tag)
+	}
+	var ups []map[string]any
+	for _, u := range args.Upstream {
+		if len(u.IPAddr) > 0 {
+			u.DialAddr = u.IPAddr[0]
+			if len(u.IPAddr) > 1 {
+				m.warnf("plugin %s: upstream %s: only the first ip_addr is used as dial_addr", p.Tag, u.Addr)
+			}
+		}
+		u.InsecureSkipVerify = u.InsecureSkipVerify || args.InsecureSkipVerify
+		if len(args.Bootstrap) > 0 && len(u.Bootstrap) == 0 {
+			u.Bootstrap = args.Bootstrap[0]
+		}
+		if u.Trusted {
+			m.warnf("plugin %s: upstream %s: trusted is not supported, see the sanity option of forward", p.Tag, u.Addr)
+		}
+		ups = append(ups, u.toV5())
+	}
+	m.plugins = append(m.plugins, pluginConfig{Tag: p.Tag, Type: "forward", Args: map[string]any{"upstreams": ups}})
+	return nil
+}
+
+func (m *v4Migrator) convertFastForward(p pluginConfig) error {
+	var args struct {
+		Upstream []v4Upstream `yaml:"upstream"`
+		CA       []string     `yaml:"ca"`
+	}
+	if err := m.decodeArgs(p, &args); err != nil {
+		return err
+	}
+	if len(args.CA) > 0 {
+		m.warnf("plugin %s: ca is not supported, add the certs to the system pool", p.Tag)
+	}
+	var ups []map[string]any
+	for _, u := range args.Upstream {
+		if u.Trusted {
+			m.warnf("plugin %s: upstream %s: trusted is not supported, see the sanity option of forward", p.Tag, u.Addr)
+		}
+		ups = append(ups, u.toV5())
+	}
+	m.plugins = append(m.plugins, pluginConfig{Tag: p.Tag, Type: "forward", Args: map[string]any{"upstreams": ups}})
+	return nil
+}
+
+func (m *v4Migrator) convertCache(p pluginConfig) error {
+	var args struct {
+		Size         int    `yaml:"size"`
+		LazyCacheTTL int    `yaml:"lazy_cache_ttl"`
+		DumpFile     string `yaml:"dump_file"`
+		DumpInterval int    `yaml:"dump_interval"`
+	}
+	if err := m.decodeArgs(p, &args); err != nil {
+		return err
+	}
+	v := map[string]any{}
+	if args.Size > 0 {
+		v["size"] = args.Size
+	}
+	if args.LazyCacheTTL > 0 {
+		v["lazy_cache_ttl"] = args.LazyCacheTTL
+	}
+	if len(args.DumpFile) > 0 {
+		v["dump_file"] = args.DumpFile
+	}
+	if args.DumpInterval > 0 {
+		v["dump_interval"] = args.DumpInterval
+	}
+	m.plugins = append(m.plugins, pluginConfig{Tag: p.Tag, Type: "cache", Args: v})
+	return nil
+}
+
+// splitProviders splits v4 rules into inline rules and files of the
+// referenced data providers.
+func (m *v4Migrator) splitProviders(owner string, rules []string) (inline, files []string) {
+	for _, s := range rules {
+		ref, ok := strings.CutPrefix(s, "provider:")
+		if !ok {
+			inline = append(inline, s)
+			continue
+		}
+		tag, attr, hasAttr := strings.Cut(ref, ":")
+		f, ok := m.providers[tag]
+		if !ok {
+			m.warnf("%s: data provider %s does not exist", owner, tag)
+			continue
+		}
+		if hasAttr || strings.HasSuffix(f, ".dat") {
+			m.warnf("%s: v2ray dat file %s (attr %q) is not supported and was dropped, convert it to a text list or load geosite dat files with a geosite plugin", owner, f, attr)
+			continue
+		}
+		files = append(files, f)
+	}
+	return inline, files
+}
+
+// convertRuleFiles converts plugins whose v4 args is a rule list that may
+// reference data providers.
+func (m *v4Migrator) convertRuleFiles(p pluginConfig) error {
+	key, v5Key := "rule", "rules"
+	if p.Type == "hosts" {
+		key, v5Key = "hosts", "entries"
+	}
+	var rules []string
+	args, _ := p.Args.(map[string]any)
+	for _, k := range sortedKeys(args) {
+		v := args[k]
+		if k != key {
+			m.warnf("plugin %s: arg %s is not supported and was dropped", p.Tag, k)
+			continue
+		}
+		if err := utils.WeakDecode(v, &rules); err != nil {
+			return err
+		}
+	}
+	inline, files := m.splitProviders("plugin "+p.Tag, rules)
+	v := map[string]any{}
+	if len(inline) > 0 {
+		v[v5Key] = inline
+	}
+	if len(files) > 0 {
+		v["files"] = files
+	}
+	m.plugins = append(m.plugins, pluginConfig{Tag: p.Tag, Type: p.Type, Args: v})
+	return nil
+}
+
+// newSet adds a domain_set or ip_set and returns its tag.
+func (m *v4Migrator) newSet(typ, base string, rules []string) string {
+	inline, files := m.splitProviders("plugin "+base, rules)
+	tag := m.newTag(base)
+	key := "exps"
+	if typ == "ip_set" {
+		key = "ips"
+	}
+	v := map[string]any{}
+	if len(inline) > 0 {
+		v[key] = inline
+	}
+	if len(files) > 0 {
+		v["files"] = files
+	}
+	m.sets = append(m.sets, pluginConfig{Tag: tag, Type: typ, Args: v})
+	return tag
+}
+
+// sortedKeys returns the keys of v in order, so that the output and the
+// warnings of a migration are stable.
+func sortedKeys(v map[string]any) []string {
+	return slices.Sorted(maps.Keys(v))
+}
+
+func intsToString(ns []int) string {
+	ss := make([]string, 0, len(ns))
+	for _, n := range ns {
+		ss = append(ss, strconv.Itoa(n))
+	}
+	return strings.Join(ss, " ")
+}
+
+// convertMatcher converts a v4 matcher to v5 match expressions. The
+// conditions of a v4 matcher are ANDed, as are v5 matches of a rule.
+func (m *v4Migrator) convertMatcher(p pluginConfig) error {
+	var args struct {
+		Domain   []string `yaml:"domain"`
+		ClientIP []string `yaml:"client_ip"`
+		QType    []int    `yaml:"qtype"`
+		QClass   []int    `yaml:"qclass"`
+		IP       []string `yaml:"ip"`
+		CNAME    []string `yaml:"cname"`
+		RCode    []int    `yaml:"rcode"`
+	}
+	if err := m.decodeArgs(p, &args); err != nil {
+		return err
+	}
+	var exps []string
+	if len(args.Domain) > 0 {
+		exps = append(exps, "qname $"+m.newSet("domain_set", p.Tag+"_domain", args.Domain))
+	}
+	if len(args.ClientIP) > 0 {
+		exps = append(exps, "client_ip $"+m.newSet("ip_set", p.Tag+"_client_ip", args.ClientIP))
+	}
+	if len(args.QType) > 0 {
+		exps = append(exps, "qtype "+intsToString(args.QType))
+	}
+	if len(args.QClass) > 0 {
+		exps = append(exps, "qclass "+intsToString(args.QClass))
+	}
+	if len(args.IP) > 0 {
+		exps = append(exps, "resp_ip $"+m.newSet("ip_set", p.Tag+"_ip", args.IP))
+	}
+	if len(args.CNAME) > 0 {
+		exps = append(exps, "cname $"+m.newSet("domain_set", p.Tag+"_cname", args.CNAME))
+	}
+	if len(args.RCode) > 0 {
+		exps = append(exps, "rcode "+intsToString(args.RCode))
+	}
+	if len(exps) == 0 {
+		m.warnf("plugin %s: matcher has no supported condition, it always matches", p.Tag)
+		exps = []string{"_true"}
+	}
+	m.matchers[p.Tag] = exps
+	m.respMatchers[p.Tag] = p.Type == "response_matcher"
+	return nil
+}
+
+func (m *v4Migrator) convertBlackhole(p pluginConfig) error {
+	var args struct {
+		IPv4  []string `yaml:"ipv4"`
+		IPv6  []string `yaml:"ipv6"`
+		RCode int      `yaml:"rcode"`
+	}
+	if err := m.decodeArgs(p, &args); err != nil {
+		return err
+	}
+	ips := append(args.IPv4, args.IPv6...)
+	switch {
+	case len(ips) > 0:
+		if args.RCode != 0 {
+			m.warnf("plugin %s: rcode is ignored when ips are set", p.Tag)
+		}
+		m.execs[p.Tag] = "black_hole " + strings.Join(ips, " ")
+	default:
+		m.execs[p.Tag] = "reject " + strconv.Itoa(args.RCode)
+	}
+	return nil
+}
+
+func (m *v4Migrator) convertTTL(p pluginConfig) error {
+	var args struct {
+		MinimalTTL int `yaml:"minimal_ttl"`
+		MaximumTTL int `yaml:"maximum_ttl"`
+	}
+	if err := m.decodeArgs(p, &args); err != nil {
+		return err
+	}
+	r := "-"
+	if args.MinimalTTL > 0 {
+		r = strconv.Itoa(args.MinimalTTL) + r
+	}
+	if args.MaximumTTL > 0 {
+		r += strconv.Itoa(args.MaximumTTL)
+	}
+	m.execs[p.Tag] = "ttl " + r
+	return nil
+}
+
+func (m *v4Migrator) convertECS(p pluginConfig) error {
+	var args struct {
+		Auto           bool   `yaml:"auto"`
+		ForceOverwrite bool   `yaml:"force_overwrite"`
+		Mask4          int    `yaml:"mask4"`
+		Mask6          int    `yaml:"mask6"`
+		IPv4           string `yaml:"ipv4"`
+		IPv6           string `yaml:"ipv6"`
+	}
+	if err := m.decodeArgs(p, &args); err != nil {
+		return err
+	}
+	v := map[string]any{}
+	if !args.ForceOverwrite {
+		v["forward"] = true
+	}
+	if args.Auto {
+		v["send"] = true
+	}
+	if len(args.IPv4) > 0 {
+		v["preset"] = args.IPv4
+		if len(args.IPv6) > 0 {
+			m.warnf("plugin %s: only one preset address is supported, ipv6 %s was dropped", p.Tag, args.IPv6)
+		}
+	} else if len(args.IPv6) > 0 {
+		v["preset"] = args.IPv6
+	}
+	if args.Mask4 > 0 {
+		v["mask4"] = args.Mask4
+	}
+	if args.Mask6 > 0 {
+		v["mask6"] = args.Mask6
+	}
+	m.plugins = append(m.plugins, pluginConfig{Tag: p.Tag, Type: "ecs_handler", Args: v})
+	return nil
+}
+
+func (m *v4Migrator) convertNftset(p pluginConfig) error {
+	var args struct {
+		TableFamily4 string `yaml:"table_family4"`
+		TableFamily6 string `yaml:"table_family6"`
+		TableName4   string `yaml:"table_name4"`
+		TableName6   string `yaml:"table_name6"`
+		SetName4     string `yaml:"set_name4"`
+		SetName6     string `yaml:"set_name6"`
+		Mask4        int    `yaml:"mask4"`
+		Mask6        int    `yaml:"mask6"`
+	}
+	if err := m.decodeArgs(p, &args); err != nil {
+		return err
+	}
+	v := map[string]any{}
+	if len(args.SetName4) > 0 {
+		v["ipv4"] = map[string]any{"table_family": args.TableFamily4, "table_name": args.TableName4, "set_name": args.SetName4, "mask": args.Mask4}
+	}
+	if len(args.SetName6) > 0 {
+		v["ipv6"] = map[string]any{"table_family": args.TableFamily6, "table_name": args.TableName6, "set_name": args.SetName6, "mask": args.Mask6}
+	}
+	m.plugins = append(m.plugins, pluginConfig{Tag: p.Tag, Type: "nftset", Args: v})
+	return nil
+}
+
+// resolve converts the pending sequence or fallback of tag, after the
+// pending plugins it references.
+func (m *v4Migrator) resolve(tag string) {
+	p, ok := m.pending[tag]
+	if !ok {
+		return
+	}
+	if m.converting[tag] {
+		m.warnf("plugin %s: circular reference, plugins must be reordered by hand", tag)
+		return
+	}
+	m.converting[tag] = true
+	defer delete(m.converting, tag)
+
+	if p.Type == "fallback" {
+		m.convertFallback(p)
+	} else {
+		args, _ := p.Args.(map[string]any)
+		for _, k := range sortedKeys(args) {
+			if k != "exec" {
+				m.warnf("plugin %s: arg %s is not supported and was dropped", tag, k)
+			}
+		}
+		m.seqs = append(m.seqs, pluginConfig{Tag: tag, Type: "sequence", Args: m.convertExec(tag, args["exec"])})
+	}
+	delete(m.pending, tag)
+}
+
+func (m *v4Migrator) convertFallback(p pluginConfig) {
+	args, _ := p.Args.(map[string]any)
+	v := map[string]any{}
+	for _, k := range sortedKeys(args) {
+		val := args[k]
+		switch k {
+		case "primary", "secondary":
+			if s, ok := val.(string); ok && m.tags[s] {
+				m.resolve(s)
+				v[k] = s
+				continue
+			}
+			tag := m.newTag(p.Tag + "_" + k)
+			m.seqs = append(m.seqs, pluginConfig{Tag: tag, Type: "sequence", Args: m.convertExec(tag, val)})
+			v[k] = tag
+		case "threshold", "always_standby":
+			v[k] = val
+		default:
+			m.warnf("plugin %s: arg %s is not supported and was dropped", p.Tag, k)
+		}
+	}
+	m.seqs = append(m.seqs, pluginConfig{Tag: p.Tag, Type: "fallback", Args: v})
+}
+
+var v4BuiltinExecs = map[string]string{
+	"_end":                       "accept",
+	"_block_with_nxdomain":       "reject 3",
+	"_block_with_servfail":       "reject 2",
+	"_block_with_empty_response": "reject 0",
+	"_drop_response":             "drop_resp",
+	"_prefer_ipv4":               "prefer_ipv4",
+	"_prefer_ipv6":               "prefer_ipv6",
+}
+
+var v4BuiltinMatchers = map[string]string{
+	"_query_is_ipv4":         "qtype 1",
+	"_query_is_ipv6":         "qtype 28",
+	"_query_is_common":       "qtype 1 28",
+	"_response_valid_answer": "has_wanted_ans",
+	"_response_has_answer":   "has_wanted_ans",
+}
+
+// convertExec converts a v4 exec list to v5 sequence rules. owner is the
+// tag of the sequence, used to name generated sub sequences.
+func (m *v4Migrator) convertExec(owner string, v any) []ruleArgs {
+	var items []any
+	switch v := v.(type) {
+	case nil:
+	case []any:
+		items = v
+	default:
+		items = []any{v}
+	}
+
+	var rules []ruleArgs
+	for _, item := range items {
+		switch item := item.(type) {
+		case string:
+			if e := m.execExpr(owner, item); len(e) > 0 {
+				rules = append(rules, ruleArgs{Exec: e})
+			}
+		case map[string]any:
+			rules = append(rules, m.convertIf(owner, item)...)
+		default:
+			m.warnf("plugin %s: parallel exec %v is not supported and was dropped", owner, item)
+		}
+	}
+	return rules
+}
+
+func (m *v4Migrator) execExpr(owner, s string) string {
+	if e, ok := v4BuiltinExecs[s]; ok {
+		return e
+	}
+	if s == "_default_cache" {
+		if !m.tags["default_cache"] {
+			m.tags["default_cache"] = true
+			m.plugins = append(m.plugins, pluginConfig{Tag: "default_cache", Type: "cache", Args: map[string]any{"size": 1024}})
+		}
+		return "$default_cache"
+	}
+	if strings.HasPrefix(s, "_") {
+		m.warnf("plugin %s: built-in plugin %s is not supported and was dropped", owner, s)
+		return ""
+	}
+	if e, ok := m.execs[s]; ok {
+		return e
+	}
+	if _, ok := m.matchers[s]; ok {
+		m.warnf("plugin %s: matcher %s can not be executed and was dropped", owner, s)
+		return ""
+	}
+	if !m.tags[s] {
+		m.warnf("plugin %s: plugin %s does not exist", owner, s)
+	}
+	m.resolve(s)
+	return "$" + s
+}
+
+// matchExprs converts a v4 matcher reference, e.g. "!tag", to v5 match
+// expressions that are ANDed. resp reports whether it matches responses.
+func (m *v4Migrator) matchExprs(owner, s string) (exps []string, resp bool, ok bool) {
+	s, neg := strings.CutPrefix(strings.TrimSpace(s), "!")
+	if e, isBuiltin := v4BuiltinMatchers[s]; isBuiltin {
+		exps, resp = []string{e}, strings.HasPrefix(s, "_response")
+	} else if e, exist := m.matchers[s]; exist {
+		exps, resp = e, m.respMatchers[s]
+	} else {
+		m.warnf("plugin %s: matcher %s is not supported, the rule was dropped", owner, s)
+		return nil, false, false
+	}
+	if neg {
+		if len(exps) > 1 {
+			m.warnf("plugin %s: negated matcher %s has multiple conditions, each of them was negated, which is not equivalent", owner, s)
+		}
+		exps = negateAll(exps)
+	}
+	return exps, resp, true
+}
+
+func negate(e string) string {
+	if s, ok := strings.CutPrefix(e, "!"); ok {
+		return strings.TrimSpace(s)
+	}
+	return "!" + e
+}
+
+func negateAll(exps []string) []string {
+	res := make([]string, 0, len(exps))
+	for _, e := range exps {
+		res = append(res, negate(e))
+	}
+	return res
+}
+
+// convertIf converts a v4 if block:
+// {if|if_and: [matchers], exec: [...], else_exec: [...], goto: tag}.
+// "if" matches if any of the matchers matches, "if_and" if all match.
+func (m *v4Migrator) convertIf(owner string, b map[string]any) []ruleArgs {
+	var (
+		conds []string
+		and   bool
+	)
+	for _, k := range sortedKeys(b) {
+		v := b[k]
+		switch k {
+		case "if", "if_and":
+			var s []string
+			if err := utils.WeakDecode(v, &s); err != nil {
+				m.warnf("plugin %s: invalid %s %v, the block was dropped", owner, k, v)
+				return nil
+			}
+			conds, and = append(conds, s...), k == "if_and"
+		case "exec", "else_exec", "goto":
+		default:
+			m.warnf("plugin %s: key %s of if block is not supported and was dropped", owner, k)
+		}
+	}
+	if _, ok := b["if"]; ok {
+		if _, ok := b["if_and"]; ok {
+			m.warnf("plugin %s: if block has both if and if_and, which are ANDed", owner)
+			and = true
+		}
+	}
+
+	body := m.convertExec(owner, b["exec"])
+	if g, ok := b["goto"].(string); ok {
+		m.resolve(g)
+		body = append(body, ruleArgs{Exec: "goto " + g})
+	}
+	bodyExec := m.subSequence(owner+"_if", body)
+	elseExec := m.subSequence(owner+"_else", m.convertExec(owner, b["else_exec"]))
+
+	var (
+		exps     [][]string
+		hasResp  bool
+		multiExp bool
+	)
+	for _, c := range conds {
+		e, resp, ok := m.matchExprs(owner, c)
+		if !ok {
+			return nil
+		}
+		exps = append(exps, e)
+		hasResp = hasResp || resp
+		multiExp = multiExp || len(e) > 1
+	}
+
+	var rules []ruleArgs
+	switch {
+	case len(exps) == 0:
+		if len(bodyExec) > 0 {
+			rules = append(rules, ruleArgs{Exec: bodyExec})
+		}
+		return rules
+	case and || len(exps) == 1:
+		var all []string
+		for _, e := range exps {
+			all = append(all, e...)
+		}
+		if len(bodyExec) > 0 {
+			rules = append(rules, ruleArgs{Matches: all, Exec: bodyExec})
+		}
+		if len(elseExec) > 0 {
+			// Not all conditions match: the first one that doesn't.
+			for i := range exps {
+				var ms []string
+				for _, e := range exps[:i] {
+					ms = append(ms, e...)
+				}
+				if len(exps[i]) > 1 {
+					multiExp = true
+				}
+				ms = append(ms, negateAll(exps[i])...)
+				rules = append(rules, ruleArgs{Matches: ms, Exec: elseExec})
+			}
+		}
+	default:
+		// Any condition matches: the first one that does.
+		if len(bodyExec) > 0 {
+			for i := range exps {
+				var ms []string
+				for _, e := range exps[:i] {
+					ms = append(ms, negateAll(e)...)
+				}
+				ms = append(ms, exps[i]...)
+				rules = append(rules, ruleArgs{Matches: ms, Exec: bodyExec})
+			}
+		}
+		if len(elseExec) > 0 {
+			var ms []string
+			for _, e := range exps {
+				ms = append(ms, negateAll(e)...)
+			}
+			rules = append(rules, ruleArgs{Matches: ms, Exec: elseExec})
+		}
+	}
+	if len(rules) > 1 {
+		if multiExp {
+			m.warnf("plugin %s: a matcher with multiple conditions was negated in if block %v, which is not equivalent", owner, conds)
+		}
+		if hasResp {
+			m.warnf("plugin %s: response matchers in if block %v are evaluated again after exec, check the converted rules", owner, conds)
+		}
+	}
+	return rules
+}
+
+// subSequence returns the exec expression that runs rules. A single rule
+// without matches is inlined, otherwise a sub sequence is generated.
+func (m *v4Migrator) subSequence(base string, rules []ruleArgs) string {
+	switch {
+	case len(rules) == 0:
+		return ""
+	case len(rules) == 1 && len(rules[0].Matches) == 0:
+		return rules[0].Exec
+	}
+	tag := m.newTag(base)
+	m.seqs = append(m.seqs, pluginConfig{Tag: tag, Type: "sequence", Args: rules})
+	return "jump " + tag
+}
+
+func (m *v4Migrator) convertServers(v any) error {
+	var servers []struct {
+		Exec      string `yaml:"exec"`
+		Timeout   int    `yaml:"timeout"`
+		Listeners []struct {
+			Protocol             string `yaml:"protocol"`
+			Addr                 string `yaml:"addr"`
+			Cert                 string `yaml:"cert"`
+			Key                  string `yaml:"key"`
+			URLPath              string `yaml:"url_path"`
+			GetUserIPFromHeader  string `yaml:"get_user_ip_from_header"`
+			IdleTimeout          int    `yaml:"idle_timeout"`
+			ProxyProtocol        bool   `yaml:"proxy_protocol"`
+			AllowedClientSubnets any    `yaml:"allowed_client_subnets"`
+		} `yaml:"listeners"`
+	}
+	if err := utils.WeakDecode(v, &servers); err != nil {
+		return err
+	}
+	for i, s := range servers {
+		if len(s.Exec) == 0 {
+			return fmt.Errorf("server #%d has no exec", i)
+		}
+		m.resolve(s.Exec)
+		if s.Timeout > 0 {
+			m.warnf("server #%d: timeout is not supported and was dropped", i)
+		}
+		for _, l := range s.Listeners {
+			if l.ProxyProtocol || l.AllowedClientSubnets != nil {
+				m.warnf("server #%d: proxy_protocol and allowed_client_subnets are not supported and were dropped", i)
+			}
+			var typ string
+			args := map[string]any{"listen": l.Addr}
+			switch l.Protocol {
+			case "", "udp":
+				typ = "udp_server"
+			case "tcp", "tls", "dot":
+				typ = "tcp_server"
+			case "http", "https", "doh":
+				typ = "http_server"
+			case "quic", "doq":
+				typ = "quic_server"
+			default:
+				return fmt.Errorf("server #%d: unknown protocol %s", i, l.Protocol)
+			}
+			if typ == "http_server" {
+				path := l.URLPath
+				if len(path) == 0 {
+					path = "/dns-query"
+				}
+				args["entries"] = []map[string]any{{"path": path, "exec": s.Exec}}
+				if len(l.GetUserIPFromHeader) > 0 {
+					args["src_ip_header"] = l.GetUserIPFromHeader
+				}
+			} else {
+				args["entry"] = s.Exec
+			}
+			if typ != "udp_server" {
+				if len(l.Cert) > 0 || len(l.Key) > 0 {
+					args["cert"], args["key"] = l.Cert, l.Key
+				} else if l.Protocol != "tcp" && l.Protocol != "http" {
+					m.warnf("server #%d: %s listener %s has no cert", i, l.Protocol, l.Addr)
+				}
+				if l.IdleTimeout > 0 {
+					args["idle_timeout"] = l.IdleTimeout
+				}
+			}
+			m.servers = append(m.servers, pluginConfig{Tag: m.newTag(typ), Type: typ, Args: args})
+		}
+	}
+	if len(servers) == 0 {
+		m.warnf("config has no server")
+	}
+	return nil
+}
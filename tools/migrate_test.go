@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files of migrate tests")
+
+const migrateTestdata = "testdata/migrate"
+
+// Each case reads <name>.in.yaml and compares the migrated config and its
+// warnings with <name>.golden.yaml and <name>.warnings. Run the tests with
+// -update to rewrite the golden files.
+func Test_migrate_golden(t *testing.T) {
+	tests := []struct {
+		name     string
+		checkErr string // tag of the plugin that fails the check, "" if the output is valid
+	}{
+		{name: "forward"},
+		{name: "exec"},
+		{name: "matchers"},
+		{name: "fallback"},
+		{name: "servers"},
+		{name: "passthrough"},
+		{name: "unsupported", checkErr: "pad"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, err := os.ReadFile(filepath.Join(migrateTestdata, tt.name+".in.yaml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, warnings, err := migrate(in)
+			if err != nil {
+				t.Fatalf("migrate: %v", err)
+			}
+			var w bytes.Buffer
+			for _, s := range warnings {
+				w.WriteString(s + "\n")
+			}
+			compareGolden(t, tt.name+".golden.yaml", out)
+			compareGolden(t, tt.name+".warnings", w.Bytes())
+
+			err = checkMigrated(t, out)
+			if len(tt.checkErr) == 0 {
+				if err != nil {
+					t.Fatalf("migrated config failed the check: %v", err)
+				}
+				return
+			}
+			var pe *coremain.PluginError
+			if !errors.As(err, &pe) || pe.Tag != tt.checkErr {
+				t.Fatalf("want check error of plugin %s, got %v", tt.checkErr, err)
+			}
+		})
+	}
+}
+
+func Test_migrate_idempotent(t *testing.T) {
+	in, err := os.ReadFile(filepath.Join(migrateTestdata, "matchers.in.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _, err := migrate(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, warnings, err := migrate(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, out) {
+		t.Fatal("migrating a migrated config changed it")
+	}
+	if len(warnings) > 0 {
+		t.Fatalf("unexpected warnings for a migrated config: %v", warnings)
+	}
+}
+
+func compareGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	p := filepath.Join(migrateTestdata, name)
+	if *updateGolden {
+		if err := os.WriteFile(p, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s mismatch, run the test with -update to review the diff\ngot:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+// checkMigrated loads cfg in check mode. The files the test configs refer
+// to are copied next to it.
+func checkMigrated(t *testing.T, cfg []byte) error {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.CopyFS(dir, os.DirFS(migrateTestdata)); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(p, cfg, 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(wd) // The server changes the working directory to the config dir.
+	return checkCfg(p, false, io.Discard)
+}